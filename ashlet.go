@@ -2,6 +2,8 @@
 // Messages are JSON-encoded and sent over a Unix domain socket, one per line.
 package ashlet
 
+import "time"
+
 // Request is sent from the shell client to the daemon.
 type Request struct {
 	// RequestID is a per-session incrementing identifier assigned by the shell.
@@ -13,10 +15,56 @@ type Request struct {
 	CursorPos int `json:"cursor_pos"`
 	// Cwd is the current working directory of the shell.
 	Cwd string `json:"cwd"`
+	// CwdGeneration numbers the session's cwds, so Cwd need only be sent
+	// when it changes: a request with a generation and an empty Cwd uses
+	// the Cwd last sent under that generation. 0 means Cwd is always sent.
+	CwdGeneration int `json:"cwd_generation,omitempty"`
+	// Host is the hostname of the machine the shell runs on. When it differs
+	// from the daemon's host (socket forwarded over SSH), Cwd does not refer
+	// to the daemon's filesystem and directory context is skipped.
+	Host string `json:"host,omitempty"`
 	// SessionID identifies the shell session.
 	SessionID string `json:"session_id"`
 	// MaxCandidates is the maximum number of completion candidates to return.
 	MaxCandidates int `json:"max_candidates,omitempty"`
+	// NixShell is the value of $IN_NIX_SHELL in the shell ("pure" or "impure").
+	// Empty when the shell is not running inside a nix shell.
+	NixShell string `json:"nix_shell,omitempty"`
+	// Shell names the shell the request comes from: "zsh", "bash", "fish",
+	// "nushell", or "powershell". Candidates are written in its syntax.
+	// Empty means zsh.
+	Shell string `json:"shell,omitempty"`
+	// Mode selects the completion mode: "" (default) completes Input,
+	// "fix" suggests corrections for LastCommand.
+	Mode string `json:"mode,omitempty"`
+	// Completer names the engine that produces candidates: "" or "model"
+	// for the generation model, "history" for history commands only, or
+	// one registered by the daemon. Unknown names use the model.
+	Completer string `json:"completer,omitempty"`
+	// LastCommand is the previously executed command line.
+	LastCommand string `json:"last_command,omitempty"`
+	// ExitCode is the exit status of LastCommand.
+	ExitCode int `json:"exit_code,omitempty"`
+	// Stderr is a trailing snippet of LastCommand's error output, if captured.
+	Stderr string `json:"stderr,omitempty"`
+	// Path is the shell's $PATH, used to check that suggested commands
+	// exist. Ignored when the shell runs on another host.
+	Path string `json:"path,omitempty"`
+	// Aliases maps the shell's alias names to their expansions. Shell
+	// functions are listed with an empty expansion.
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// Progressive lets the daemon answer in two parts (see
+	// Response.Pending), so the client must read until the connection
+	// closes.
+	Progressive bool `json:"progressive,omitempty"`
+	// DryRun gathers context and builds the prompt as usual but does not
+	// call the generation API: the response has no candidates, only the
+	// Prompt that would have been sent. Nothing about the request is
+	// recorded.
+	DryRun bool `json:"dry_run,omitempty"`
+	// Verbose adds Response.Debug, describing the context gathered for
+	// the request, and keeps each candidate's Score.
+	Verbose bool `json:"verbose,omitempty"`
 }
 
 // Candidate represents a single completion suggestion with a confidence score.
@@ -28,6 +76,65 @@ type Candidate struct {
 	CursorPos *int `json:"cursor_pos,omitempty"`
 	// Confidence is the model's confidence score (0.0 to 1.0).
 	Confidence float64 `json:"confidence"`
+	// Danger is a short reason when the candidate is potentially destructive
+	// (e.g. "drops a database object"); empty for ordinary candidates.
+	Danger string `json:"danger,omitempty"`
+	// Warning is a short note when the candidate may not work as written
+	// (e.g. "git commit: unknown flag --amned"); empty otherwise.
+	Warning string `json:"warning,omitempty"`
+	// Diff locates the edit the completion makes to the input, so clients
+	// can render just the changed text (e.g. as ghost text after the
+	// cursor) without diffing it themselves.
+	Diff *Diff `json:"diff,omitempty"`
+	// Words lists the byte offsets in Completion where each shell word
+	// after the text shared with the input ends, so clients can accept a
+	// candidate one word at a time. The last is normally len(Completion).
+	Words []int `json:"words,omitempty"`
+	// Score explains how the candidate was ranked. It is only set in
+	// verbose responses.
+	Score *Score `json:"score,omitempty"`
+}
+
+// Score breaks down how a candidate came to its place, for tuning the
+// ranking strategies. Components a strategy did not use are zero.
+type Score struct {
+	// Position is the confidence the completer gave the candidate for its
+	// place in the answer, before ranking.
+	Position float64 `json:"position"`
+	// QuoteExtension is how much more of a quoted argument the candidate
+	// fills in than the others, from 0 to 1 ("quote_extension" strategy).
+	QuoteExtension float64 `json:"quote_extension,omitempty"`
+	// Frequency is the boost from how often the candidate's command appears
+	// in the history sent with the request ("frequency_blend" strategy).
+	Frequency float64 `json:"frequency,omitempty"`
+	// Learned is the adjustment from accepted and rejected suggestions of
+	// the same shape; negative moves the candidate down.
+	Learned float64 `json:"learned,omitempty"`
+	// Penalties lists the checks that moved the candidate after the others
+	// (e.g. "unknown command", "unknown flag").
+	Penalties []string `json:"penalties,omitempty"`
+}
+
+// Diff describes a completion as one edit of the input: the input's
+// Replaced span is replaced by the completion's Inserted span, and the
+// text around them is shared. Offsets are in bytes and never split a
+// UTF-8 character.
+type Diff struct {
+	// Prefix is the length of the text the completion and input start
+	// with.
+	Prefix int `json:"prefix"`
+	// Replaced is the span of the input the completion drops; empty when
+	// the completion only adds text.
+	Replaced Span `json:"replaced"`
+	// Inserted is the span of the completion that is not in the input;
+	// empty when the completion only removes text.
+	Inserted Span `json:"inserted"`
+}
+
+// Span is the half-open byte range [Start, End) of a string.
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
 }
 
 // Response is sent from the daemon back to the shell client.
@@ -36,10 +143,92 @@ type Response struct {
 	RequestID int `json:"request_id"`
 	// Candidates is the list of completion suggestions, sorted by confidence descending.
 	Candidates []Candidate `json:"candidates"`
+	// PromptVariant names the prompt template ("a" or "b") that produced
+	// the candidates while two templates are being A/B tested; empty
+	// otherwise.
+	PromptVariant string `json:"prompt_variant,omitempty"`
+	// Meta records which model produced the candidates; nil when no model
+	// was asked (an error, or nothing to complete).
+	Meta *Meta `json:"meta,omitempty"`
+	// Prompt is what would have been sent to the generation API, for a
+	// DryRun request.
+	Prompt *Prompt `json:"prompt,omitempty"`
+	// Debug describes how the candidates were arrived at, for a Verbose
+	// request.
+	Debug *Debug `json:"debug,omitempty"`
+	// Pending marks an early answer from history to a progressive request
+	// while the model is still working; a response with the model's
+	// candidates and the same RequestID may follow on the connection.
+	Pending bool `json:"pending,omitempty"`
 	// Error is set when the daemon cannot fulfill the request.
 	Error *Error `json:"error,omitempty"`
 }
 
+// Prompt is a prompt as sent to the generation API.
+type Prompt struct {
+	// System is the system prompt, or, for a fill-in-the-middle model,
+	// the text before the insertion point.
+	System string `json:"system"`
+	// User is the user message, or, for a fill-in-the-middle model, the
+	// text after the insertion point.
+	User string `json:"user"`
+}
+
+// Debug is the context behind a verbose response, for debugging shell
+// integrations. It stays on the local socket, so history is as read, not
+// redacted.
+type Debug struct {
+	// RecentCommands, RelevantCommands, and RecentHere are the history
+	// gathered for the request: the most frecent commands, those
+	// semantically related to the input, and those that last succeeded in
+	// the cwd.
+	RecentCommands   []string `json:"recent_commands,omitempty"`
+	RelevantCommands []string `json:"relevant_commands,omitempty"`
+	RecentHere       []string `json:"recent_here,omitempty"`
+	// LastFailure describes the previous command's failure; empty if it
+	// succeeded.
+	LastFailure string `json:"last_failure,omitempty"`
+	// Dir summarises the directory context; nil when none was read.
+	Dir *DirSummary `json:"dir,omitempty"`
+	// SystemPromptBytes and UserMessageBytes are the sizes of the prompt
+	// the model was shown, and PromptTokens an estimate of its tokens; 0
+	// when no prompt was built.
+	SystemPromptBytes int `json:"system_prompt_bytes,omitempty"`
+	UserMessageBytes  int `json:"user_message_bytes,omitempty"`
+	PromptTokens      int `json:"prompt_tokens,omitempty"`
+	// GatherMs is how long gathering history took, and TotalMs the whole
+	// request, in milliseconds.
+	GatherMs int64 `json:"gather_ms"`
+	TotalMs  int64 `json:"total_ms"`
+}
+
+// DirSummary summarises the directory context of a request.
+type DirSummary struct {
+	// Files, ProjectFiles, and Staged count the entries of the cwd, of
+	// the git root when it is elsewhere, and the staged files.
+	Files        int `json:"files"`
+	ProjectFiles int `json:"project_files,omitempty"`
+	Staged       int `json:"staged,omitempty"`
+	// PackageManager, Nix, Terraform, and Languages are as detected.
+	PackageManager string `json:"package_manager,omitempty"`
+	Nix            string `json:"nix,omitempty"`
+	Terraform      string `json:"terraform,omitempty"`
+	Languages      string `json:"languages,omitempty"`
+	// Manifests names the manifests read in the cwd.
+	Manifests []string `json:"manifests,omitempty"`
+}
+
+// Meta is the provenance of a response's candidates, for users who must
+// log which model produced the commands they run.
+type Meta struct {
+	// Provider is the host of the generation API (e.g. "openrouter.ai").
+	Provider string `json:"provider"`
+	// Model is the configured model name.
+	Model string `json:"model"`
+	// Time is when the candidates were generated.
+	Time time.Time `json:"time"`
+}
+
 // Error describes a daemon-side error returned to the shell client.
 type Error struct {
 	// Code is a machine-readable error identifier (e.g. "not_configured", "api_error").
@@ -50,34 +239,370 @@ type Error struct {
 
 // ContextRequest is sent from the shell client to warm the directory context cache.
 type ContextRequest struct {
+	// RequestID, when set, is echoed in the response, so a client sending
+	// many messages on one connection can match it up.
+	RequestID int `json:"request_id,omitempty"`
 	// Type is always "context".
 	Type string `json:"type"`
 	// Cwd is the directory to pre-cache context for.
 	Cwd string `json:"cwd"`
+	// Host is the hostname of the machine the shell runs on (see Request.Host).
+	Host string `json:"host,omitempty"`
 }
 
 // ContextResponse is sent from the daemon in response to a ContextRequest.
 type ContextResponse struct {
+	// RequestID is echoed from the request.
+	RequestID int `json:"request_id,omitempty"`
 	// OK is true when the warm-up was accepted.
 	OK bool `json:"ok"`
 	// Error is set when the operation fails.
 	Error *Error `json:"error,omitempty"`
 }
 
+// FeedbackRequest is sent from the shell client when the user acts on a candidate.
+type FeedbackRequest struct {
+	// RequestID, when set, is echoed in the response, so a client sending
+	// many messages on one connection can match it up.
+	RequestID int `json:"request_id,omitempty"`
+	// Type is always "feedback".
+	Type string `json:"type"`
+	// Event is what the user did: "accepted", "rejected", or "edited".
+	Event string `json:"event"`
+	// Candidate is the completion the event applies to.
+	Candidate string `json:"candidate"`
+	// Executed is the command line that was finally executed (for "edited").
+	Executed string `json:"executed,omitempty"`
+	// Cwd is the working directory of the shell.
+	Cwd string `json:"cwd,omitempty"`
+	// SessionID identifies the shell session.
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// FeedbackResponse is sent from the daemon in response to a FeedbackRequest.
+type FeedbackResponse struct {
+	// RequestID is echoed from the request.
+	RequestID int `json:"request_id,omitempty"`
+	// OK is true when the feedback was recorded.
+	OK bool `json:"ok"`
+	// Error is set when the operation fails.
+	Error *Error `json:"error,omitempty"`
+}
+
+// PreviewRequest is sent from the shell client to preview what a candidate
+// would do before it is accepted.
+type PreviewRequest struct {
+	// RequestID, when set, is echoed in the response, so a client sending
+	// many messages on one connection can match it up.
+	RequestID int `json:"request_id,omitempty"`
+	// Type is always "preview".
+	Type string `json:"type"`
+	// Command is the candidate command line to preview.
+	Command string `json:"command"`
+	// Cwd is the working directory the command would run in.
+	Cwd string `json:"cwd"`
+	// Host is the hostname of the machine the shell runs on (see Request.Host).
+	Host string `json:"host,omitempty"`
+}
+
+// PreviewResponse is sent from the daemon in response to a PreviewRequest.
+type PreviewResponse struct {
+	// RequestID is echoed from the request.
+	RequestID int `json:"request_id,omitempty"`
+	// OK is true when the request was valid.
+	OK bool `json:"ok"`
+	// Supported is true when the command has a side-effect-free preview.
+	Supported bool `json:"supported"`
+	// Output is the preview text (e.g. files that would be deleted).
+	Output string `json:"output,omitempty"`
+	// Truncated is true when Output was cut short.
+	Truncated bool `json:"truncated,omitempty"`
+	// Error is set when the operation fails.
+	Error *Error `json:"error,omitempty"`
+}
+
+// RecallRequest is sent from the shell client to search past suggestions.
+type RecallRequest struct {
+	// RequestID, when set, is echoed in the response, so a client sending
+	// many messages on one connection can match it up.
+	RequestID int `json:"request_id,omitempty"`
+	// Type is always "recall".
+	Type string `json:"type"`
+	// Query is matched against suggested commands (all words must appear).
+	Query string `json:"query"`
+	// Limit caps the number of entries returned (0 = default).
+	Limit int `json:"limit,omitempty"`
+}
+
+// RecallEntry is one past suggestion returned by a recall search.
+type RecallEntry struct {
+	// Command is the suggested command (redacted).
+	Command string `json:"command"`
+	// Cwd is the directory the suggestion was made in.
+	Cwd string `json:"cwd,omitempty"`
+	// Time is when the suggestion was last shown or accepted (RFC 3339).
+	Time string `json:"time"`
+	// Accepted is true when the user accepted the suggestion at least once.
+	Accepted bool `json:"accepted"`
+}
+
+// RecallResponse is sent from the daemon in response to a RecallRequest.
+type RecallResponse struct {
+	// RequestID is echoed from the request.
+	RequestID int `json:"request_id,omitempty"`
+	// OK is true when the search succeeded.
+	OK bool `json:"ok"`
+	// Entries are matching suggestions, most recent first.
+	Entries []RecallEntry `json:"entries"`
+	// Error is set when the operation fails.
+	Error *Error `json:"error,omitempty"`
+}
+
+// CaptureRequest is sent from the shell client to control capture of its
+// completions into the eval corpus.
+type CaptureRequest struct {
+	// RequestID, when set, is echoed in the response, so a client sending
+	// many messages on one connection can match it up.
+	RequestID int `json:"request_id,omitempty"`
+	// Type is always "capture".
+	Type string `json:"type"`
+	// Action is "start" or "stop" to turn capture on or off for the
+	// session, or "executed" to report the command line the user ran.
+	Action string `json:"action"`
+	// SessionID identifies the shell session.
+	SessionID string `json:"session_id"`
+	// Executed is the command line that was run (for "executed").
+	Executed string `json:"executed,omitempty"`
+}
+
+// CaptureResponse is sent from the daemon in response to a CaptureRequest.
+type CaptureResponse struct {
+	// RequestID is echoed from the request.
+	RequestID int `json:"request_id,omitempty"`
+	// OK is true when the action was applied.
+	OK bool `json:"ok"`
+	// Enabled is true while the session is capturing.
+	Enabled bool `json:"enabled"`
+	// Path is the eval corpus file captured completions are appended to.
+	Path string `json:"path,omitempty"`
+	// Error is set when the operation fails.
+	Error *Error `json:"error,omitempty"`
+}
+
+// HistoryEventRequest is sent from the shell client when a command
+// finished, so the daemon learns history as it happens rather than from
+// the shell's history files.
+type HistoryEventRequest struct {
+	// RequestID, when set, is echoed in the response, so a client sending
+	// many messages on one connection can match it up.
+	RequestID int `json:"request_id,omitempty"`
+	// Type is always "history_event".
+	Type string `json:"type"`
+	// Command is the command line that ran.
+	Command string `json:"command"`
+	// Cwd is the directory the command ran in.
+	Cwd string `json:"cwd"`
+	// ExitCode is the command's exit status.
+	ExitCode int `json:"exit_code"`
+	// DurationMs is how long the command ran, in milliseconds. The
+	// command is taken to have just finished.
+	DurationMs int64 `json:"duration_ms,omitempty"`
+	// SessionID identifies the shell session.
+	SessionID string `json:"session_id"`
+}
+
+// HistoryEventResponse is sent from the daemon in response to a
+// HistoryEventRequest.
+type HistoryEventResponse struct {
+	// RequestID is echoed from the request.
+	RequestID int `json:"request_id,omitempty"`
+	// OK is true when the event was accepted.
+	OK bool `json:"ok"`
+	// Error is set when the operation fails.
+	Error *Error `json:"error,omitempty"`
+}
+
 // ConfigRequest is sent from the shell client for configuration operations.
 type ConfigRequest struct {
-	// Action is the config operation: "get", "reload", "defaults", or "default_prompt".
+	// RequestID, when set, is echoed in the response, so a client sending
+	// many messages on one connection can match it up.
+	RequestID int `json:"request_id,omitempty"`
+	// Action is the config operation: "get", "reload", "defaults",
+	// "default_prompt", "prompt_reference", "validate", "providers",
+	// "stats", "storage", "prune", "audit", "metrics", or "status".
 	Action string `json:"action"`
+	// Items names the kinds of state to delete (for "prune" action);
+	// empty deletes all of them.
+	Items []string `json:"items,omitempty"`
+	// Limit is how many of the latest audit entries to return (for
+	// "audit" action); 0 means 20.
+	Limit int `json:"limit,omitempty"`
 }
 
 // ConfigResponse is sent from the daemon in response to a ConfigRequest.
 type ConfigResponse struct {
+	// RequestID is echoed from the request.
+	RequestID int `json:"request_id,omitempty"`
 	// Config is the current configuration (for "get", "reload", and "defaults" actions).
 	Config *Config `json:"config,omitempty"`
-	// Prompt is the default prompt template (for "default_prompt" action).
+	// Prompt is the default prompt template (for "default_prompt" action),
+	// or the reference of template fields and functions (for
+	// "prompt_reference" action).
 	Prompt string `json:"prompt,omitempty"`
 	// Warnings contains configuration warnings (for "validate" action).
 	Warnings []string `json:"warnings,omitempty"`
+	// Providers is the health of each configured API provider (for
+	// "providers" action).
+	Providers []ProviderHealth `json:"providers,omitempty"`
+	// Stats is the API token usage per day and model (for "stats" action).
+	Stats []UsageStats `json:"stats,omitempty"`
+	// Upgrades counts how progressive completions were answered (for
+	// "stats" action).
+	Upgrades *UpgradeStats `json:"upgrades,omitempty"`
+	// Storage is the size of each kind of state on disk (for "storage"
+	// action), or what was deleted (for "prune" action).
+	Storage []StorageItem `json:"storage,omitempty"`
+	// Audit is what was last sent to the APIs, oldest first (for "audit"
+	// action); empty unless the audit log is on.
+	Audit []AuditEntry `json:"audit,omitempty"`
+	// Metrics is what the daemon has served since it started, in the
+	// Prometheus text exposition format (for "metrics" action).
+	Metrics string `json:"metrics,omitempty"`
+	// Status is the daemon's version, uptime, and health (for "status"
+	// action).
+	Status *DaemonStatus `json:"status,omitempty"`
 	// Error is set when the operation fails.
 	Error *Error `json:"error,omitempty"`
 }
+
+// StorageItem is one kind of state the daemon keeps on disk.
+type StorageItem struct {
+	// Name identifies the kind of state, e.g. "feedback".
+	Name string `json:"name"`
+	// Description says what the state is for.
+	Description string `json:"description"`
+	// Path is the file it is kept in.
+	Path string `json:"path"`
+	// Bytes is the size of the file; 0 when it does not exist.
+	Bytes int64 `json:"bytes"`
+}
+
+// ProviderHealth is the recent health of one configured API provider.
+type ProviderHealth struct {
+	// Kind is what the provider is used for: "generation" or "embedding".
+	Kind string `json:"kind"`
+	// Provider is the host of the API.
+	Provider string `json:"provider"`
+	// Model is the configured model name.
+	Model string `json:"model"`
+	// Circuit is the circuit breaker state: "closed" (requests are sent),
+	// "open" (requests fail fast after repeated failures), or "half_open"
+	// (the next request probes whether the provider has recovered).
+	Circuit string `json:"circuit"`
+	// Requests is the number of recent requests the rates are over.
+	Requests int `json:"requests"`
+	// ErrorRate is the fraction of recent requests that failed.
+	ErrorRate float64 `json:"error_rate"`
+	// AvgLatencyMs is the mean latency of recent successful requests.
+	AvgLatencyMs int64 `json:"avg_latency_ms"`
+	// TotalRequests is the number of requests since the daemon started.
+	TotalRequests int64 `json:"total_requests"`
+	// TotalErrors is the number of those requests that failed.
+	TotalErrors int64 `json:"total_errors"`
+	// LastSuccess is when a request last succeeded; nil if none has.
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// LastFailure is when a request last failed; nil if none has.
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	// LastError is the error of the last failed request.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// AuditEntry is one request's worth of text sent to an API, as it was
+// sent: after redaction.
+type AuditEntry struct {
+	// Time is when the request was made.
+	Time time.Time `json:"time"`
+	// Kind is the API: "generation" or "embedding".
+	Kind string `json:"kind"`
+	// Model is the model the request was for.
+	Model string `json:"model"`
+	// Texts are the texts sent: the system prompt and user message of a
+	// generation request, or the inputs of an embedding request.
+	Texts []string `json:"texts"`
+}
+
+// UsageStats is the API usage of one model on one day.
+type UsageStats struct {
+	// Date is the local day, as YYYY-MM-DD.
+	Date string `json:"date"`
+	// Kind is what the model is used for: "generation" or "embedding".
+	Kind string `json:"kind"`
+	// Model is the model name.
+	Model string `json:"model"`
+	// Requests is the number of requests that reported usage.
+	Requests int `json:"requests"`
+	// PromptTokens and CompletionTokens are the tokens sent and generated,
+	// as the API reported them.
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	// Cost is the total price the provider reported, in its currency
+	// (USD for OpenRouter); 0 when it reports none.
+	Cost float64 `json:"cost,omitempty"`
+}
+
+// UpgradeStats counts how progressive completions were answered since the
+// daemon started.
+type UpgradeStats struct {
+	// Immediate is the number answered by the model within the soft
+	// deadline, in one part.
+	Immediate int `json:"immediate"`
+	// Upgraded is the number answered early from history and then by the
+	// model within the upgrade deadline.
+	Upgraded int `json:"upgraded"`
+	// Missed is the number answered early whose model answer came too late
+	// or failed.
+	Missed int `json:"missed"`
+}
+
+// DaemonStatus sums up whether the daemon is working, for tools that check
+// on it without reading its logs.
+type DaemonStatus struct {
+	// Version is the daemon's build version.
+	Version string `json:"version"`
+	// StartedAt is when the daemon started.
+	StartedAt time.Time `json:"started_at"`
+	// UptimeSeconds is how long the daemon has been running.
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	// InFlight is the number of completion requests being answered, for
+	// all users.
+	InFlight int `json:"in_flight"`
+	// Providers is the health of each configured API provider.
+	Providers []ProviderHealth `json:"providers"`
+	// Engine is the size of the history index and the cache counters; nil
+	// if the engine does not report them.
+	Engine *EngineMetrics `json:"engine,omitempty"`
+	// LastError is the last error a completion request was answered with;
+	// nil if there was none.
+	LastError *StatusError `json:"last_error,omitempty"`
+}
+
+// StatusError is an error the daemon answered with, and when.
+type StatusError struct {
+	Time time.Time `json:"time"`
+	Error
+}
+
+// EngineMetrics is what an engine counts about its index and caches, for
+// the daemon's metrics.
+type EngineMetrics struct {
+	// IndexedCommands is the number of history commands in the semantic
+	// index.
+	IndexedCommands int `json:"indexed_commands"`
+	// CacheRebuilds is how many times the embedding cache was emptied
+	// because the embedding model or schema changed.
+	CacheRebuilds int64 `json:"cache_rebuilds"`
+	// DirCacheHits and DirCacheMisses count completions whose directory
+	// context was, or was not, already gathered.
+	DirCacheHits   int64 `json:"dir_cache_hits"`
+	DirCacheMisses int64 `json:"dir_cache_misses"`
+}
@@ -1,9 +1,15 @@
 package ashlet
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 
 	defaults "github.com/Paranoid-AF/ashlet/default"
 )
@@ -13,7 +19,12 @@ type Config struct {
 	Version    int              `json:"version"`
 	Generation GenerationConfig `json:"generation"`
 	Embedding  EmbeddingConfig  `json:"embedding"`
+	Rank       RankConfig       `json:"rank"`
 	Telemetry  TelemetryConfig  `json:"telemetry"`
+
+	// notes are warnings from loading the file (upgrades, deprecated
+	// fields), reported by ValidateConfig.
+	notes []string
 }
 
 // GenerationConfig holds settings for the generation API.
@@ -26,6 +37,160 @@ type GenerationConfig struct {
 	Temperature  float64  `json:"temperature,omitempty"`
 	Stop         []string `json:"stop,omitempty"`
 	NoRawHistory *bool    `json:"no_raw_history,omitempty"`
+	// WatermarkedHistory decides how history commands the shell marked as
+	// accepted suggestions (ASHLET_WATERMARK) are used as context:
+	// "downweight" (default) ranks them below typed commands in semantic
+	// search, "exclude" leaves them out, "keep" treats them as typed.
+	WatermarkedHistory string `json:"watermarked_history,omitempty"`
+	// HistorySource is where history context is read from: "file"
+	// (default), the HistoryFiles; "atuin", Atuin's history database,
+	// which also records each command's directory and exit status; or
+	// "shell", the commands the shell reports as they finish (see
+	// HistoryEventRequest), kept in the state directory.
+	HistorySource string `json:"history_source,omitempty"`
+	// HistoryFiles are the shell history files read, their commands
+	// interleaved by time. Empty means those of $HISTFILE,
+	// ~/.zsh_history, and ~/.bash_history that exist.
+	HistoryFiles []string `json:"history_files,omitempty"`
+	// AtuinDB is the path of Atuin's history database; empty means
+	// Atuin's default location.
+	AtuinDB string `json:"atuin_db,omitempty"`
+	// SecretSensitivity is how eagerly commands are scanned for literal
+	// secrets, long tokens that look random, which are masked before they
+	// are stored or sent: "off", "low", "medium" (default), or "high".
+	// Tokens in a known key format (AWS, GitHub, Slack, JWTs, ...) are
+	// masked at every level.
+	SecretSensitivity string `json:"secret_sensitivity,omitempty"`
+	// Anonymize rewrites, in history commands, the working directory, and
+	// directory listings before they are embedded or shown to the model,
+	// the home directory to ~, other users' names in home paths to
+	// <user>, and internal hostnames and private IPv4 addresses to <host>
+	// and <ip>.
+	Anonymize bool `json:"anonymize,omitempty"`
+	// InternalDomains are domains whose hostnames Anonymize rewrites,
+	// besides those under .local, .internal, .corp, .lan, .intranet, and
+	// .home.arpa.
+	InternalDomains []string `json:"internal_domains,omitempty"`
+	// Temperatures, when it has two or more entries, samples each
+	// completion once per temperature in parallel and merges the results,
+	// for more varied candidates than a single call gives.
+	Temperatures []float64 `json:"temperatures,omitempty"`
+	// ChainSeparator joins chained commands in suggestions: "&&" (default),
+	// ";", or "newline".
+	ChainSeparator string `json:"chain_separator,omitempty"`
+	// OutputFormat is how the model returns candidates: "xml" (default),
+	// "json", which uses structured outputs when the API supports them, or
+	// "tool", which has the model call a submit_candidates tool whose
+	// arguments are that JSON.
+	OutputFormat string `json:"output_format,omitempty"`
+	// TimeoutMs limits a whole generation request, in milliseconds; a
+	// request that runs out fails with the "timeout" error code.
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+	// DebounceMs holds each completion this many milliseconds before any
+	// work starts; a newer request from the same shell session arriving
+	// meanwhile cancels it, so clients need not debounce keystrokes
+	// themselves. 0 disables the wait.
+	DebounceMs int `json:"debounce_ms,omitempty"`
+	// SoftDeadlineMs is how long a progressive completion waits for the
+	// model before answering from history, in milliseconds; the model's
+	// candidates follow if they arrive within UpgradeDeadlineMs (default
+	// TimeoutMs) of the request. 0 answers once, when the model is done.
+	SoftDeadlineMs    int `json:"soft_deadline_ms,omitempty"`
+	UpgradeDeadlineMs int `json:"upgrade_deadline_ms,omitempty"`
+	// LatencySLOMs bounds how long a completion waits for the model, in
+	// milliseconds. When it passes, the candidates streamed so far are
+	// returned instead. 0 disables the bound.
+	LatencySLOMs int `json:"latency_slo_ms,omitempty"`
+	// AdaptiveLatency, when no LatencySLOMs is set, bounds each completion
+	// by the provider's rolling p95 latency instead, so outlier-slow
+	// responses return their streamed candidates early.
+	AdaptiveLatency bool `json:"adaptive_latency,omitempty"`
+	// MaxRequestsPerMinute caps the requests sent to the model in any
+	// minute (a completion sampling several Temperatures makes one each), and MaxTokensPerDay the generation tokens (prompt plus
+	// completion, as reported by the API) used today. Requests over either
+	// budget fail with the "rate_limited" error code. 0 means no limit.
+	MaxRequestsPerMinute int `json:"max_requests_per_minute,omitempty"`
+	MaxTokensPerDay      int `json:"max_tokens_per_day,omitempty"`
+	// MaxPromptTokens caps the estimated tokens of the context sent with
+	// each request; the lowest-value sections are trimmed to fit. Negative
+	// disables the cap.
+	MaxPromptTokens int `json:"max_prompt_tokens,omitempty"`
+	// InputMaxLines and InputMaxBytes bound how much of a multi-line
+	// (pasted) input is sent: only its last line is completed, and at most
+	// this many lines and bytes above it are shown as context. An edited
+	// line longer than InputMaxBytes is not completed. 0 uses the defaults
+	// (10 lines, 1024 bytes).
+	InputMaxLines int `json:"input_max_lines,omitempty"`
+	InputMaxBytes int `json:"input_max_bytes,omitempty"`
+	// UnknownCommands decides what happens to candidates whose command is
+	// not found on the shell's $PATH (nor a builtin, alias, or function):
+	// "downrank" (default) lists them last, "drop" removes them, "keep"
+	// leaves them in place.
+	UnknownCommands string `json:"unknown_commands,omitempty"`
+	// ModelFirstWord sends a bare partial first word (e.g. "doc") to the
+	// model too. By default such input is completed locally from the
+	// executables on the shell's $PATH and its aliases, most used first,
+	// and the model is asked only when none match.
+	ModelFirstWord bool `json:"model_first_word,omitempty"`
+	// SensitiveDirs lists directories (and everything below them) whose
+	// listing, manifests, and git metadata are never gathered. A leading ~
+	// is the user's home directory. Unset means the defaults (~/.ssh,
+	// ~/.gnupg, password stores, cloud credentials); an empty list turns
+	// the protection off.
+	SensitiveDirs []string `json:"sensitive_dirs,omitempty"`
+	// NeverSuggest lists commands, or their leading words, that are never
+	// suggested: candidates running one, alone or within a chain or
+	// pipeline, are dropped whatever the model answers, and the list is
+	// added to the system prompt so the model avoids them.
+	NeverSuggest []string `json:"never_suggest,omitempty"`
+	// ContextSections lists the optional context sections to send, most
+	// important first; the last ones are trimmed first to fit the prompt
+	// budget. Unlisted sections are left out. Empty means
+	// DefaultContextSections.
+	ContextSections []string `json:"context_sections,omitempty"`
+	// NoHistory leaves shell history out of the context entirely: neither
+	// recent nor related commands are sent. Mostly useful per project (see
+	// ProjectConfigFile).
+	NoHistory bool `json:"no_history,omitempty"`
+	// ProjectSummary has the model condense each git project's file listing
+	// and manifests into a short summary, generated in the background and
+	// cached per project, which is sent instead of them.
+	ProjectSummary bool `json:"project_summary,omitempty"`
+	// SystemContext sends a completion's context in the system prompt,
+	// where prompt templates can place each part of it ({{.RecentCommands}},
+	// {{.DirListing}}, or all of it as {{.Context}}), and reduces the user
+	// message to the input line.
+	SystemContext bool `json:"system_context,omitempty"`
+	// PromptSplit decides which requests use the second prompt template
+	// (prompt_b.md) when one exists: "alternate" (default) takes turns
+	// request by request, "session" gives each shell session one template
+	// by a hash of its ID.
+	PromptSplit string `json:"prompt_split,omitempty"`
+}
+
+// DefaultContextSections is the default set and priority of optional context
+// sections, most important first. The working directory, last failed
+// command, and input are always sent.
+var DefaultContextSections = []string{
+	"pkg",
+	"nix",
+	"terraform",
+	"languages",
+	"summary",
+	"staged",
+	"date",
+	"session",
+	"accepted_here",
+	"recent_here",
+	"aliases",
+	"recent",
+	"files",
+	"related",
+	"flags",
+	"docs",
+	"manifests",
+	"project_files",
+	"project_manifests",
 }
 
 // EmbeddingConfig holds settings for the embedding API.
@@ -36,16 +201,82 @@ type EmbeddingConfig struct {
 	Dimensions         int    `json:"dimensions,omitempty"`
 	TTLMinutes         int    `json:"ttl_minutes,omitempty"`
 	MaxHistoryCommands int    `json:"max_history_commands,omitempty"`
+	// DedupeThreshold is the cosine similarity above which a relevant
+	// command counts as a near duplicate of a recent one already in the
+	// prompt and is dropped; 0 means 0.95, and 1 or more drops only exact
+	// duplicates.
+	DedupeThreshold float64 `json:"dedupe_threshold,omitempty"`
+	// MaxIndexSize caps how many commands the embedding index keeps; past
+	// it, commands are evicted per Eviction. 0 means 10000.
+	MaxIndexSize int `json:"max_index_size,omitempty"`
+	// Eviction is which commands leave a full index first:
+	// "least_frecent" (default), or "oldest", the longest since last run.
+	Eviction string `json:"eviction,omitempty"`
+	// AgeHalfLifeDays is how many days after a command last ran its
+	// similarity in related-command search has lost half of what age can
+	// take off it (at most half). 0 means 90; negative turns decay off.
+	AgeHalfLifeDays float64 `json:"age_half_life_days,omitempty"`
+	// Parallelism is how many embedding requests indexing keeps in flight
+	// at once. 0 means 4.
+	Parallelism int `json:"parallelism,omitempty"`
+	// ExcludePatterns are regular expressions (RE2 syntax) for history
+	// commands that are never embedded nor shown to the model, e.g.
+	// "vault" or "^op run". Invalid patterns are ignored.
+	ExcludePatterns []string `json:"exclude_patterns,omitempty"`
+}
+
+// RankConfig holds settings for ordering candidates.
+type RankConfig struct {
+	// Strategy names how candidates are ordered after generation (see
+	// RankStrategies); empty means "quote_extension".
+	Strategy string `json:"strategy,omitempty"`
 }
 
+// RankStrategies are the values rank.strategy accepts:
+//   - "quote_extension" (default): candidates that fill in more of a quoted
+//     argument move up, then the learned acceptance of each candidate's
+//     shape adjusts the order
+//   - "position": the model's order, unchanged
+//   - "frequency_blend": the model's order blended with how often each
+//     candidate's command appears in the history shown to the model, then
+//     adjusted by learned acceptance
+//   - "learned": the model's order adjusted by learned acceptance only
+var RankStrategies = []string{"quote_extension", "position", "frequency_blend", "learned"}
+
 // TelemetryConfig holds telemetry settings.
 type TelemetryConfig struct {
 	OpenRouter *bool `json:"openrouter,omitempty"`
+	// AuditLog keeps a local log, in the state directory, of every text
+	// sent to the generation and embedding APIs, as sent, for the "audit"
+	// config action. Nothing in it is transmitted.
+	AuditLog bool `json:"audit_log,omitempty"`
+}
+
+// Paths locates one user's ashlet files. The zero value resolves paths for
+// the current process user, honouring the environment overrides below. A
+// daemon serving several users sets Home (and usually State) so paths are
+// resolved for the connecting user instead of from the daemon's environment.
+type Paths struct {
+	// Home is the user's home directory. When set, environment overrides
+	// are ignored and config lives under Home/.config/ashlet.
+	Home string
+	// State overrides the state directory.
+	State string
+	// Cache overrides the cache directory.
+	Cache string
+	// Owner, when set, is the uid of the user the paths belong to, as in
+	// os/user.User.Uid. Files read through Open are then only read when
+	// that user owns them, so a daemon running as root cannot be pointed
+	// at another file by a symlink.
+	Owner string
 }
 
 // ConfigDir returns the config directory path.
 // Resolution order: $ASHLET_CONFIG_DIR > $XDG_CONFIG_HOME/ashlet > ~/.config/ashlet
-func ConfigDir() string {
+func (p Paths) ConfigDir() string {
+	if p.Home != "" {
+		return filepath.Join(p.Home, ".config", "ashlet")
+	}
 	if dir := os.Getenv("ASHLET_CONFIG_DIR"); dir != "" {
 		return dir
 	}
@@ -59,16 +290,253 @@ func ConfigDir() string {
 	return filepath.Join(home, ".config", "ashlet")
 }
 
+// StateDir returns the directory for daemon state (learned statistics, caches).
+// Resolution order: State > $ASHLET_STATE_DIR > $XDG_STATE_HOME/ashlet > ~/.local/state/ashlet
+func (p Paths) StateDir() string {
+	if p.State != "" {
+		return p.State
+	}
+	if p.Home != "" {
+		return filepath.Join(p.Home, ".local", "state", "ashlet")
+	}
+	if dir := os.Getenv("ASHLET_STATE_DIR"); dir != "" {
+		return dir
+	}
+	if stateHome := os.Getenv("XDG_STATE_HOME"); stateHome != "" {
+		return filepath.Join(stateHome, "ashlet")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join("/tmp", "ashlet-state")
+	}
+	return filepath.Join(home, ".local", "state", "ashlet")
+}
+
+// CacheDir returns the directory for caches that can be rebuilt, such as
+// the embeddings of history commands.
+// Resolution order: Cache > $ASHLET_CACHE_DIR > $XDG_CACHE_HOME/ashlet > ~/.cache/ashlet
+func (p Paths) CacheDir() string {
+	if p.Cache != "" {
+		return p.Cache
+	}
+	if p.Home != "" {
+		return filepath.Join(p.Home, ".cache", "ashlet")
+	}
+	if dir := os.Getenv("ASHLET_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	if cacheHome := os.Getenv("XDG_CACHE_HOME"); cacheHome != "" {
+		return filepath.Join(cacheHome, "ashlet")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join("/tmp", "ashlet-cache")
+	}
+	return filepath.Join(home, ".cache", "ashlet")
+}
+
+// FeedbackPath returns the path of the candidate feedback store.
+func (p Paths) FeedbackPath() string {
+	return filepath.Join(p.StateDir(), "feedback.json")
+}
+
+// LedgerPath returns the path of the suggestion ledger.
+func (p Paths) LedgerPath() string {
+	return filepath.Join(p.StateDir(), "ledger.jsonl")
+}
+
+// CorpusPath returns the path of the eval corpus that captured completions
+// are appended to.
+func (p Paths) CorpusPath() string {
+	return filepath.Join(p.StateDir(), "corpus.jsonl")
+}
+
+// UsagePath returns the path of the API usage totals.
+func (p Paths) UsagePath() string {
+	return filepath.Join(p.StateDir(), "usage.json")
+}
+
+// AuditPath returns the path of the audit log of what was sent to the APIs
+// (see TelemetryConfig.AuditLog).
+func (p Paths) AuditPath() string {
+	return filepath.Join(p.StateDir(), "audit.jsonl")
+}
+
+// ReportedHistoryPath returns the path of the history the shell reports,
+// read with history_source "shell".
+func (p Paths) ReportedHistoryPath() string {
+	return filepath.Join(p.StateDir(), "history.jsonl")
+}
+
+// EmbeddingCachePath returns the path of the SQLite database of saved
+// embeddings of history commands.
+func (p Paths) EmbeddingCachePath() string {
+	return filepath.Join(p.CacheDir(), "embeddings.db")
+}
+
+// errNotOwned is returned by Paths.Open for a file the owner cannot vouch
+// for.
+var errNotOwned = errors.New("not a regular file owned by the user")
+
+// Open opens the file at path for reading. With an Owner, it must be a
+// regular file owned by that user.
+func (p Paths) Open(path string) (*os.File, error) {
+	if p.Owner == "" {
+		return os.Open(path)
+	}
+	return openOwned(path, p.Owner)
+}
+
+// ReadFile reads the file at path like os.ReadFile, opening it with Open.
+func (p Paths) ReadFile(path string) ([]byte, error) {
+	f, err := p.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
 // ConfigPath returns the full path to the config file.
-func ConfigPath() string {
-	return filepath.Join(ConfigDir(), "config.json")
+func (p Paths) ConfigPath() string {
+	return filepath.Join(p.ConfigDir(), "config.json")
 }
 
 // PromptPath returns the prompt file path.
-func PromptPath() string {
-	return filepath.Join(ConfigDir(), "prompt.md")
+func (p Paths) PromptPath() string {
+	return filepath.Join(p.ConfigDir(), "prompt.md")
+}
+
+// FixPromptPath returns the fix-mode prompt file path.
+func (p Paths) FixPromptPath() string {
+	return filepath.Join(p.ConfigDir(), "fix_prompt.md")
+}
+
+// PromptBPath returns the path of the second prompt template, which is
+// A/B tested against prompt.md when present.
+func (p Paths) PromptBPath() string {
+	return filepath.Join(p.ConfigDir(), "prompt_b.md")
+}
+
+// ProjectConfigFile is the name of a project's config overrides, read from
+// the root of its git work tree. It holds the parts of config.json a
+// project may set, layered over it for requests from inside the project
+// (see Config.WithProject).
+const ProjectConfigFile = ".ashlet.json"
+
+// ProjectPromptPath returns the path of the prompt template that replaces
+// prompt.md for the project rooted at root.
+func ProjectPromptPath(root string) string {
+	return filepath.Join(root, ".ashlet", "prompt.md")
 }
 
+// projectConfig is what a ProjectConfigFile may set: how completions are
+// prompted and shaped, and which context they are given. Everything else
+// in the file is ignored.
+type projectConfig struct {
+	Generation struct {
+		Stop                 []string `json:"stop"`
+		WatermarkedHistory   string   `json:"watermarked_history"`
+		ChainSeparator       string   `json:"chain_separator"`
+		OutputFormat         string   `json:"output_format"`
+		UnknownCommands      string   `json:"unknown_commands"`
+		SystemContext        *bool    `json:"system_context"`
+		ContextSections      []string `json:"context_sections"`
+		NoHistory            bool     `json:"no_history"`
+		NeverSuggest         []string `json:"never_suggest"`
+		MaxRequestsPerMinute int      `json:"max_requests_per_minute"`
+		MaxTokensPerDay      int      `json:"max_tokens_per_day"`
+	} `json:"generation"`
+	Rank RankConfig `json:"rank"`
+}
+
+// WithProject returns a copy of c with the project overrides in data (the
+// contents of a ProjectConfigFile) layered on top. Only the fields of
+// projectConfig are read, so a cloned repository cannot send requests
+// elsewhere, pick the model or spend more, or lift the user's safeguards:
+// it can keep history out, add to never_suggest, and lower the rate
+// limits, but not the reverse, and its context_sections can only reorder
+// or drop the sections c sends.
+func (c *Config) WithProject(data []byte) (*Config, error) {
+	var project projectConfig
+	if err := json.Unmarshal(data, &project); err != nil {
+		return nil, err
+	}
+	base, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(base, &cfg); err != nil {
+		return nil, err
+	}
+	cfg.notes = c.notes
+
+	gen, over := &cfg.Generation, project.Generation
+	if over.Stop != nil {
+		gen.Stop = over.Stop
+	}
+	gen.WatermarkedHistory = cmp.Or(over.WatermarkedHistory, gen.WatermarkedHistory)
+	gen.ChainSeparator = cmp.Or(over.ChainSeparator, gen.ChainSeparator)
+	gen.OutputFormat = cmp.Or(over.OutputFormat, gen.OutputFormat)
+	gen.UnknownCommands = cmp.Or(over.UnknownCommands, gen.UnknownCommands)
+	if over.SystemContext != nil {
+		gen.SystemContext = *over.SystemContext
+	}
+	allowed := c.Generation.ContextSections
+	if len(allowed) == 0 {
+		allowed = DefaultContextSections
+	}
+	if sections := slices.DeleteFunc(slices.Clone(over.ContextSections), func(s string) bool {
+		return !slices.Contains(allowed, s)
+	}); len(sections) > 0 {
+		gen.ContextSections = sections
+	}
+	gen.NoHistory = gen.NoHistory || over.NoHistory
+	for _, cmd := range over.NeverSuggest {
+		if !slices.Contains(gen.NeverSuggest, cmd) {
+			gen.NeverSuggest = append(slices.Clip(gen.NeverSuggest), cmd)
+		}
+	}
+	gen.MaxRequestsPerMinute = lowerLimit(c.Generation.MaxRequestsPerMinute, over.MaxRequestsPerMinute)
+	gen.MaxTokensPerDay = lowerLimit(c.Generation.MaxTokensPerDay, over.MaxTokensPerDay)
+	cfg.Rank.Strategy = cmp.Or(project.Rank.Strategy, cfg.Rank.Strategy)
+	return &cfg, nil
+}
+
+// lowerLimit returns the tighter of the user's limit and a project's,
+// where 0 or less is no limit.
+func lowerLimit(user, project int) int {
+	if project <= 0 || (user > 0 && user <= project) {
+		return user
+	}
+	return project
+}
+
+// ConfigDir returns the config directory path for the current user.
+func ConfigDir() string { return Paths{}.ConfigDir() }
+
+// StateDir returns the state directory path for the current user.
+func StateDir() string { return Paths{}.StateDir() }
+
+// FeedbackPath returns the feedback store path for the current user.
+func FeedbackPath() string { return Paths{}.FeedbackPath() }
+
+// LedgerPath returns the suggestion ledger path for the current user.
+func LedgerPath() string { return Paths{}.LedgerPath() }
+
+// ConfigPath returns the config file path for the current user.
+func ConfigPath() string { return Paths{}.ConfigPath() }
+
+// PromptPath returns the prompt file path for the current user.
+func PromptPath() string { return Paths{}.PromptPath() }
+
+// FixPromptPath returns the fix-mode prompt file path for the current user.
+func FixPromptPath() string { return Paths{}.FixPromptPath() }
+
+// PromptBPath returns the second prompt template path for the current user.
+func PromptBPath() string { return Paths{}.PromptBPath() }
+
 // DefaultConfig returns the default configuration from the embedded default_config.json.
 func DefaultConfig() *Config {
 	var cfg Config
@@ -80,8 +548,25 @@ func DefaultConfig() *Config {
 
 // LoadConfig loads config from disk or returns defaults if not found.
 func LoadConfig() (*Config, error) {
-	path := ConfigPath()
-	data, err := os.ReadFile(path)
+	return LoadConfigFile(ConfigPath())
+}
+
+// LoadConfigFile loads config from path or returns defaults if not found.
+// A config written for an older version is upgraded in place first (see
+// configMigrations), keeping a backup of the original.
+func LoadConfigFile(path string) (*Config, error) {
+	return Paths{}.loadConfigFile(path)
+}
+
+// LoadConfig loads the config file of p like LoadConfigFile. With an
+// Owner, the file is read through Open, and an older config is upgraded in
+// memory only: the daemon does not write to files the user controls.
+func (p Paths) LoadConfig() (*Config, error) {
+	return p.loadConfigFile(p.ConfigPath())
+}
+
+func (p Paths) loadConfigFile(path string) (*Config, error) {
+	data, err := p.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return DefaultConfig(), nil
@@ -89,10 +574,24 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
+	var notes []string
+	if p.Owner == "" {
+		data, notes, err = migrateConfigFile(path, data)
+	} else {
+		var out []byte
+		if out, _, notes, err = migrateConfig(data, configMigrations); out != nil {
+			data = out
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	var cfg Config
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	cfg.notes = notes
 
 	// Apply defaults for missing fields
 	defaults := DefaultConfig()
@@ -111,6 +610,12 @@ func LoadConfig() (*Config, error) {
 	if cfg.Generation.Temperature == 0 {
 		cfg.Generation.Temperature = defaults.Generation.Temperature
 	}
+	if cfg.Generation.TimeoutMs == 0 {
+		cfg.Generation.TimeoutMs = defaults.Generation.TimeoutMs
+	}
+	if cfg.Generation.MaxPromptTokens == 0 {
+		cfg.Generation.MaxPromptTokens = defaults.Generation.MaxPromptTokens
+	}
 	if cfg.Embedding.Model == "" {
 		cfg.Embedding.Model = defaults.Embedding.Model
 	}
@@ -123,6 +628,9 @@ func LoadConfig() (*Config, error) {
 	if cfg.Embedding.MaxHistoryCommands == 0 {
 		cfg.Embedding.MaxHistoryCommands = defaults.Embedding.MaxHistoryCommands
 	}
+	if cfg.Generation.SensitiveDirs == nil {
+		cfg.Generation.SensitiveDirs = defaults.Generation.SensitiveDirs
+	}
 	if cfg.Generation.NoRawHistory == nil {
 		cfg.Generation.NoRawHistory = defaults.Generation.NoRawHistory
 	}
@@ -139,12 +647,87 @@ func ValidateConfig(cfg *Config) []string {
 	if cfg == nil {
 		return warnings
 	}
+	warnings = append(warnings, cfg.notes...)
 	if cfg.Generation.NoRawHistory != nil && *cfg.Generation.NoRawHistory && !EmbeddingEnabled(cfg) {
 		warnings = append(warnings, "no_raw_history is enabled but embedding API key is not configured; history context will be unavailable")
 	}
+	switch cfg.Generation.OutputFormat {
+	case "", "xml", "json", "tool":
+	default:
+		warnings = append(warnings, "unknown output_format "+strconv.Quote(cfg.Generation.OutputFormat)+"; using xml")
+	}
+	switch cfg.Generation.ChainSeparator {
+	case "", "&&", ";", "newline":
+	default:
+		warnings = append(warnings, "unknown chain_separator "+strconv.Quote(cfg.Generation.ChainSeparator)+"; using &&")
+	}
+	switch cfg.Generation.WatermarkedHistory {
+	case "", "downweight", "exclude", "keep":
+	default:
+		warnings = append(warnings, "unknown watermarked_history "+strconv.Quote(cfg.Generation.WatermarkedHistory)+"; using downweight")
+	}
+	switch cfg.Embedding.Eviction {
+	case "", "least_frecent", "oldest":
+	default:
+		warnings = append(warnings, "unknown eviction "+strconv.Quote(cfg.Embedding.Eviction)+"; using least_frecent")
+	}
+	for _, pattern := range cfg.Embedding.ExcludePatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			warnings = append(warnings, "invalid exclude pattern "+strconv.Quote(pattern)+": "+err.Error()+"; ignoring")
+		}
+	}
+	switch cfg.Generation.HistorySource {
+	case "", "file", "atuin", "shell":
+	default:
+		warnings = append(warnings, "unknown history_source "+strconv.Quote(cfg.Generation.HistorySource)+"; using file")
+	}
+	switch cfg.Generation.SecretSensitivity {
+	case "", "off", "low", "medium", "high":
+	default:
+		warnings = append(warnings, "unknown secret_sensitivity "+strconv.Quote(cfg.Generation.SecretSensitivity)+"; using medium")
+	}
+	switch cfg.Generation.UnknownCommands {
+	case "", "downrank", "drop", "keep":
+	default:
+		warnings = append(warnings, "unknown unknown_commands "+strconv.Quote(cfg.Generation.UnknownCommands)+"; using downrank")
+	}
+	switch cfg.Generation.PromptSplit {
+	case "", "alternate", "session":
+	default:
+		warnings = append(warnings, "unknown prompt_split "+strconv.Quote(cfg.Generation.PromptSplit)+"; using alternate")
+	}
+	if cfg.Generation.MaxRequestsPerMinute < 0 {
+		warnings = append(warnings, "max_requests_per_minute is negative; not limiting requests")
+	}
+	if n := len(cfg.Generation.Temperatures); n > 1 && cfg.Generation.MaxRequestsPerMinute > 0 && cfg.Generation.MaxRequestsPerMinute < n {
+		warnings = append(warnings, "max_requests_per_minute is below the number of temperatures; every completion will be rate limited")
+	}
+	if cfg.Generation.MaxTokensPerDay < 0 {
+		warnings = append(warnings, "max_tokens_per_day is negative; not limiting tokens")
+	}
+	if cfg.Rank.Strategy != "" && !slices.Contains(RankStrategies, cfg.Rank.Strategy) {
+		warnings = append(warnings, "unknown rank strategy "+strconv.Quote(cfg.Rank.Strategy)+"; using quote_extension")
+	}
+	for _, name := range cfg.Generation.ContextSections {
+		if !slices.Contains(DefaultContextSections, name) {
+			warnings = append(warnings, "unknown context section "+strconv.Quote(name)+"; ignoring")
+		}
+	}
 	return warnings
 }
 
+// JSONOutputEnabled reports whether the model is asked for candidates as
+// JSON, in its reply or as tool call arguments.
+func JSONOutputEnabled(cfg *Config) bool {
+	return cfg != nil && (cfg.Generation.OutputFormat == "json" || ToolOutputEnabled(cfg))
+}
+
+// ToolOutputEnabled reports whether the model is asked to submit candidates
+// through a tool call.
+func ToolOutputEnabled(cfg *Config) bool {
+	return cfg != nil && cfg.Generation.OutputFormat == "tool"
+}
+
 // ResolveGenerationBaseURL returns the generation API base URL.
 // Priority: $ASHLET_GENERATION_API_BASE_URL env > config value.
 func ResolveGenerationBaseURL(cfg *Config) string {
@@ -0,0 +1,208 @@
+package ashlet
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestPathsDefaultsHonourEnvironment(t *testing.T) {
+	t.Setenv("ASHLET_CONFIG_DIR", "/cfg")
+	t.Setenv("ASHLET_STATE_DIR", "/state")
+
+	if got := ConfigPath(); got != "/cfg/config.json" {
+		t.Errorf("ConfigPath() = %q", got)
+	}
+	if got := FeedbackPath(); got != "/state/feedback.json" {
+		t.Errorf("FeedbackPath() = %q", got)
+	}
+}
+
+func TestPathsHomeIgnoresEnvironment(t *testing.T) {
+	t.Setenv("ASHLET_CONFIG_DIR", "/cfg")
+	t.Setenv("ASHLET_STATE_DIR", "/state")
+	t.Setenv("ASHLET_CACHE_DIR", "/cache")
+
+	p := Paths{Home: "/home/alice"}
+	if got := p.ConfigPath(); got != "/home/alice/.config/ashlet/config.json" {
+		t.Errorf("ConfigPath() = %q", got)
+	}
+	if got := p.LedgerPath(); got != "/home/alice/.local/state/ashlet/ledger.jsonl" {
+		t.Errorf("LedgerPath() = %q", got)
+	}
+
+	if got := p.EmbeddingCachePath(); got != "/home/alice/.cache/ashlet/embeddings.db" {
+		t.Errorf("EmbeddingCachePath() = %q", got)
+	}
+
+	p.State = "/var/lib/ashlet/1000"
+	if got := p.FeedbackPath(); got != "/var/lib/ashlet/1000/feedback.json" {
+		t.Errorf("FeedbackPath() with State = %q", got)
+	}
+}
+
+func TestPathsOpenChecksOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file ownership is not checked on windows")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.json")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+	uid := os.Getuid()
+
+	owner := Paths{Owner: strconv.Itoa(uid)}
+	if data, err := owner.ReadFile(link); err != nil || string(data) != "{}" {
+		t.Errorf("the owner's file = %q, %v", data, err)
+	}
+	if _, err := owner.ReadFile(dir); !errors.Is(err, errNotOwned) {
+		t.Errorf("a directory should be refused, got %v", err)
+	}
+	if _, err := owner.ReadFile(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("a missing file should not exist, got %v", err)
+	}
+	other := Paths{Owner: strconv.Itoa(uid + 1)}
+	if _, err := other.ReadFile(link); !errors.Is(err, errNotOwned) {
+		t.Errorf("another user's file should be refused, got %v", err)
+	}
+	if _, err := (Paths{}).ReadFile(link); err != nil {
+		t.Errorf("without an Owner any file is read, got %v", err)
+	}
+}
+
+func TestLoadConfigFileMissingReturnsDefaults(t *testing.T) {
+	cfg, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Generation.Model != DefaultConfig().Generation.Model {
+		t.Errorf("expected default model, got %q", cfg.Generation.Model)
+	}
+}
+
+func TestLoadConfigFileAppliesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"generation":{"model":"custom"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Generation.Model != "custom" {
+		t.Errorf("model = %q, want custom", cfg.Generation.Model)
+	}
+	if cfg.Generation.BaseURL != DefaultConfig().Generation.BaseURL {
+		t.Errorf("base_url should default, got %q", cfg.Generation.BaseURL)
+	}
+}
+
+func TestLoadConfigFileSensitiveDirs(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		json string
+		want int
+	}{
+		{`{}`, len(DefaultConfig().Generation.SensitiveDirs)},
+		{`{"generation":{"sensitive_dirs":["~/vault"]}}`, 1},
+		{`{"generation":{"sensitive_dirs":[]}}`, 0},
+	} {
+		path := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(path, []byte(tt.json), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfigFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(cfg.Generation.SensitiveDirs); got != tt.want {
+			t.Errorf("%s: %d sensitive dirs, want %d", tt.json, got, tt.want)
+		}
+	}
+	if !slices.Contains(DefaultConfig().Generation.SensitiveDirs, "~/.ssh") {
+		t.Error("~/.ssh should be sensitive by default")
+	}
+}
+
+func TestConfigWithProject(t *testing.T) {
+	base := DefaultConfig()
+	base.Generation.APIKey = "secret"
+	base.Generation.NeverSuggest = []string{"rm -rf"}
+
+	base.Generation.MaxRequestsPerMinute = 30
+	base.Generation.Temperatures = []float64{0.2, 0.7}
+
+	cfg, err := base.WithProject([]byte(`{
+		"generation": {"system_context": true, "context_sections": ["recent", "bogus"], "never_suggest": ["terraform destroy"], "no_history": true,
+			"base_url": "https://attacker.example", "api_key": "theirs",
+			"max_requests_per_minute": 1000, "max_tokens_per_day": 5000, "temperatures": [0.1, 0.4, 0.7, 1.0]},
+		"embedding": {"base_url": "https://attacker.example"},
+		"rank": {"strategy": "position"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Generation.SystemContext || !cfg.Generation.NoHistory || cfg.Rank.Strategy != "position" {
+		t.Errorf("project settings not applied: %+v", cfg.Generation)
+	}
+	if !slices.Equal(cfg.Generation.ContextSections, []string{"recent"}) {
+		t.Errorf("ContextSections = %v, want only the project's sections the user sends", cfg.Generation.ContextSections)
+	}
+	if !slices.Equal(cfg.Generation.NeverSuggest, []string{"rm -rf", "terraform destroy"}) {
+		t.Errorf("NeverSuggest = %v, want the user's list and the project's", cfg.Generation.NeverSuggest)
+	}
+	if cfg.Generation.MaxRequestsPerMinute != 30 || cfg.Generation.MaxTokensPerDay != 5000 {
+		t.Errorf("limits = %d/min, %d/day; want the user's, lowered by the project", cfg.Generation.MaxRequestsPerMinute, cfg.Generation.MaxTokensPerDay)
+	}
+	if !slices.Equal(cfg.Generation.Temperatures, []float64{0.2, 0.7}) {
+		t.Errorf("Temperatures = %v, want the user's", cfg.Generation.Temperatures)
+	}
+	if cleared, _ := base.WithProject([]byte(`{"generation": {"never_suggest": []}}`)); !slices.Equal(cleared.Generation.NeverSuggest, []string{"rm -rf"}) {
+		t.Errorf("NeverSuggest = %v, a project must not clear it", cleared.Generation.NeverSuggest)
+	}
+	if cfg.Generation.BaseURL != base.Generation.BaseURL || cfg.Generation.APIKey != "secret" || cfg.Embedding.BaseURL != base.Embedding.BaseURL {
+		t.Error("a project must not change endpoints or API keys")
+	}
+	if cfg.Generation.Temperature != base.Generation.Temperature {
+		t.Error("settings the project leaves out should be inherited")
+	}
+	if !slices.Equal(base.Generation.NeverSuggest, []string{"rm -rf"}) || base.Generation.SystemContext {
+		t.Error("the base config must not change")
+	}
+
+	// Nor may a project lift the user's safeguards or spend more.
+	strict := DefaultConfig()
+	strict.Generation.NoRawHistory = new(bool)
+	*strict.Generation.NoRawHistory = true
+	strict.Generation.NoHistory = true
+	strict.Generation.ContextSections = []string{"recent"}
+	loose, err := strict.WithProject([]byte(`{"generation": {"no_raw_history": false, "sensitive_dirs": [], "no_history": false,
+		"context_sections": ["related", "files"], "max_tokens": 100000, "model": "expensive/model", "max_prompt_tokens": -1,
+		"model_first_word": true, "project_summary": true}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg, sg := loose.Generation, strict.Generation
+	if !*lg.NoRawHistory || !slices.Equal(lg.SensitiveDirs, sg.SensitiveDirs) || !lg.NoHistory {
+		t.Errorf("project loosened safeguards: no_raw_history %v, sensitive_dirs %v, no_history %v", *lg.NoRawHistory, lg.SensitiveDirs, lg.NoHistory)
+	}
+	if !slices.Equal(lg.ContextSections, []string{"recent"}) {
+		t.Errorf("ContextSections = %v, a project must not add sections", lg.ContextSections)
+	}
+	if lg.MaxTokens != sg.MaxTokens || lg.Model != sg.Model || lg.MaxPromptTokens != sg.MaxPromptTokens || lg.ModelFirstWord || lg.ProjectSummary {
+		t.Errorf("project raised spend: %+v", lg)
+	}
+
+	if _, err := base.WithProject([]byte(`{"generation":`)); err == nil {
+		t.Error("invalid JSON should fail")
+	}
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"slices"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// AliasContext formats the user's aliases and functions for the prompt:
+// aliases as name='expansion' and functions (empty expansion) as name().
+// Entries related to the first word of input come first, the rest follow
+// by name, and at most max are returned (0 means no limit).
+func AliasContext(aliases map[string]string, input string, max int) []string {
+	first := firstWord(input)
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	related := func(name string) bool {
+		return first != "" && (strings.HasPrefix(name, first) || firstWord(aliases[name]) == first)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		if ra, rb := related(a), related(b); ra != rb {
+			if ra {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	if max > 0 && len(names) > max {
+		names = names[:max]
+	}
+
+	items := make([]string, len(names))
+	for i, name := range names {
+		if exp := aliases[name]; exp != "" {
+			items[i] = name + "='" + exp + "'"
+		} else {
+			items[i] = name + "()"
+		}
+	}
+	return items
+}
+
+// PreferAliases rewrites commands in candidates to use the user's aliases,
+// e.g. "git checkout main" becomes "gco main" given gco='git checkout'.
+// Only expansions that start a command (at the beginning of the line or
+// after ;, &, |, or an opening parenthesis) are rewritten, longest first.
+// A rewrite that would stop a candidate from extending what the user has
+// typed is skipped, as is one that spans the candidate's cursor. Candidates
+// that become duplicates are dropped.
+func PreferAliases(candidates []ashlet.Candidate, input string, aliases map[string]string) []ashlet.Candidate {
+	type alias struct{ name, exp string }
+	var list []alias
+	for name, exp := range aliases {
+		exp = strings.TrimSpace(exp)
+		if exp == "" || firstWord(exp) == name {
+			continue // a function, or an alias that only adds flags
+		}
+		list = append(list, alias{name, exp})
+	}
+	if len(list) == 0 {
+		return candidates
+	}
+	slices.SortFunc(list, func(a, b alias) int {
+		if d := len(b.exp) - len(a.exp); d != 0 {
+			return d
+		}
+		return strings.Compare(a.name, b.name)
+	})
+
+	seen := make(map[string]bool, len(candidates))
+	out := candidates[:0]
+	for _, c := range candidates {
+		cmd := c.Completion
+		extends := strings.HasPrefix(cmd, input)
+		starts := commandStarts(cmd)
+		for i := len(starts) - 1; i >= 0; i-- {
+			start := starts[i]
+			for _, a := range list {
+				end := start + len(a.exp)
+				if !strings.HasPrefix(cmd[start:], a.exp) || !wordBoundary(cmd, end) {
+					continue
+				}
+				if c.CursorPos != nil && *c.CursorPos > start && *c.CursorPos < end {
+					break
+				}
+				rewritten := cmd[:start] + a.name + cmd[end:]
+				if extends && !strings.HasPrefix(rewritten, input) {
+					break
+				}
+				if c.CursorPos != nil && *c.CursorPos >= end {
+					pos := *c.CursorPos + len(a.name) - len(a.exp)
+					c.CursorPos = &pos
+				}
+				cmd = rewritten
+				break
+			}
+		}
+		if seen[cmd] {
+			continue
+		}
+		seen[cmd] = true
+		c.Completion = cmd
+		out = append(out, c)
+	}
+	return out
+}
+
+// commandStarts returns the offsets in cmd where a command begins: the
+// first non-blank byte of the line and of each part after a separator.
+// Quoted text is skipped.
+func commandStarts(cmd string) []int {
+	masked := []byte(cmd)
+	for _, sp := range quoteSpans(cmd) {
+		end := sp.close
+		if end < 0 {
+			end = len(cmd) - 1
+		}
+		for i := sp.open; i <= end; i++ {
+			masked[i] = 'x'
+		}
+	}
+
+	var starts []int
+	expect := true
+	for i, ch := range masked {
+		switch ch {
+		case ';', '&', '|', '(', '\n':
+			expect = true
+		case ' ', '\t':
+		default:
+			if expect {
+				starts = append(starts, i)
+				expect = false
+			}
+		}
+	}
+	return starts
+}
+
+// wordBoundary reports whether a word in cmd can end at offset i.
+func wordBoundary(cmd string, i int) bool {
+	if i >= len(cmd) {
+		return true
+	}
+	switch cmd[i] {
+	case ' ', '\t', '\n', ';', '&', '|', ')':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"slices"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestPreferAliases(t *testing.T) {
+	aliases := map[string]string{
+		"g":      "git",
+		"gco":    "git checkout",
+		"ll":     "ls -l",
+		"ls":     "ls --color=auto", // adds flags only, never rewritten
+		"deploy": "",                // a function
+	}
+	tests := []struct {
+		input string
+		cmd   string
+		want  string
+	}{
+		{"", "git checkout main", "gco main"},
+		{"g", "git checkout main", "gco main"},
+		{"", "git status", "g status"},
+		{"git che", "git checkout main", "git checkout main"}, // keeps what was typed
+		{"make &&", "make && git checkout main", "make && gco main"},
+		{"", "ls -la", "ls -la"},
+		{"", "ls -l | grep go", "ll | grep go"},
+		{"", `echo "git checkout main"`, `echo "git checkout main"`},
+		{"", "gitk --all", "gitk --all"},
+		{"", "deploy prod", "deploy prod"},
+	}
+	for _, tt := range tests {
+		got := PreferAliases([]ashlet.Candidate{{Completion: tt.cmd}}, tt.input, aliases)
+		if len(got) != 1 || got[0].Completion != tt.want {
+			t.Errorf("PreferAliases(%q, input %q) = %+v, want %q", tt.cmd, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestPreferAliasesCursorAndDuplicates(t *testing.T) {
+	aliases := map[string]string{"gco": "git checkout"}
+	pos := 17
+	got := PreferAliases([]ashlet.Candidate{
+		{Completion: `git checkout -b ""`, CursorPos: &pos},
+		{Completion: "gco main"},
+		{Completion: "git checkout main"},
+	}, "", aliases)
+	if len(got) != 2 {
+		t.Fatalf("expected the duplicate to be dropped, got %+v", got)
+	}
+	if got[0].Completion != `gco -b ""` || got[0].CursorPos == nil || *got[0].CursorPos != 8 {
+		t.Errorf("got %q cursor %v, want %q cursor 8", got[0].Completion, got[0].CursorPos, `gco -b ""`)
+	}
+}
+
+func TestAliasContext(t *testing.T) {
+	aliases := map[string]string{
+		"ll":     "ls -l",
+		"gco":    "git checkout",
+		"deploy": "",
+		"k":      "kubectl",
+	}
+	got := AliasContext(aliases, "git st", 3)
+	want := []string{"gco='git checkout'", "deploy()", "k='kubectl'"}
+	if !slices.Equal(got, want) {
+		t.Errorf("AliasContext() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// internalSuffixes are the domain suffixes of hostnames on private networks.
+var internalSuffixes = []string{"local", "internal", "corp", "lan", "intranet", "home.arpa"}
+
+var (
+	reOtherHome = regexp.MustCompile(`(/home/|/Users/)([^/\s'"<>]+)`)
+	reIPv4      = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+	// cgnat is the shared address space (RFC 6598) that Tailscale and
+	// carrier networks hand out.
+	cgnat = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// Anonymizer rewrites what identifies the user and their network in text
+// bound for embeddings or prompts: the home directory becomes ~, other
+// users' home directories /home/<user>, and internal hostnames and private
+// IPv4 addresses <host> and <ip>. A nil Anonymizer changes nothing.
+type Anonymizer struct {
+	reHome *regexp.Regexp // nil without a home directory
+	reHost *regexp.Regexp
+}
+
+// NewAnonymizer returns an Anonymizer for a user whose home directory is
+// home. Hostnames under domains, as well as the usual private suffixes
+// (.local, .internal, .corp, .lan, ...), count as internal.
+func NewAnonymizer(home string, domains []string) *Anonymizer {
+	a := &Anonymizer{}
+	if home = strings.TrimRight(home, "/"); home != "" {
+		a.reHome = regexp.MustCompile(regexp.QuoteMeta(home) + `(/|[^A-Za-z0-9._-]|$)`)
+	}
+	// The configured domains go first, so a host under one is matched
+	// whole rather than up to an internal-looking label (corp.example.com).
+	suffixes := make([]string, 0, len(domains)+len(internalSuffixes))
+	for _, d := range domains {
+		if d = strings.Trim(d, "."); d != "" {
+			suffixes = append(suffixes, `(?:[A-Za-z0-9-]+\.)*`+regexp.QuoteMeta(d))
+		}
+	}
+	for _, s := range internalSuffixes {
+		suffixes = append(suffixes, `[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.`+regexp.QuoteMeta(s))
+	}
+	a.reHost = regexp.MustCompile(`(?i)\b(?:` + strings.Join(suffixes, "|") + `)\b`)
+	return a
+}
+
+// Anonymize returns s with the home directory, other users' names in home
+// paths, internal hostnames, and private IPv4 addresses rewritten.
+func (a *Anonymizer) Anonymize(s string) string {
+	if a == nil || s == "" {
+		return s
+	}
+	if a.reHome != nil {
+		s = a.reHome.ReplaceAllString(s, "~$1")
+	}
+	s = reOtherHome.ReplaceAllString(s, "$1<user>")
+	s = replaceHosts(s, a.reHost)
+	return reIPv4.ReplaceAllStringFunc(s, func(ip string) string {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || !(addr.IsPrivate() || addr.IsLinkLocalUnicast() || cgnat.Contains(addr)) {
+			return ip
+		}
+		return "<ip>"
+	})
+}
+
+// replaceHosts replaces the hostnames re matches in s with <host>, except
+// where the match goes on as a file name (config.local.json).
+func replaceHosts(s string, re *regexp.Regexp) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringIndex(s, -1) {
+		if rest := s[m[1]:]; len(rest) > 1 && rest[0] == '.' && isWordByte(rest[1]) {
+			continue
+		}
+		b.WriteString(s[last:m[0]])
+		b.WriteString("<host>")
+		last = m[1]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// AnonymizeAll applies Anonymize to each element.
+func (a *Anonymizer) AnonymizeAll(ss []string) []string {
+	if a == nil {
+		return ss
+	}
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = a.Anonymize(s)
+	}
+	return out
+}
+
+// AnonymizeDir returns a copy of d with its paths, listings, and manifests
+// anonymized.
+func (a *Anonymizer) AnonymizeDir(d *DirContext) *DirContext {
+	if a == nil || d == nil {
+		return d
+	}
+	out := *d
+	out.CwdPath = a.Anonymize(d.CwdPath)
+	out.CwdListing = a.Anonymize(d.CwdListing)
+	out.GitRootListing = a.Anonymize(d.GitRootListing)
+	out.GitStagedFiles = a.Anonymize(d.GitStagedFiles)
+	out.Terraform = a.Anonymize(d.Terraform)
+	out.CwdManifests = a.anonymizeValues(d.CwdManifests)
+	out.GitManifests = a.anonymizeValues(d.GitManifests)
+	return &out
+}
+
+func (a *Anonymizer) anonymizeValues(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = a.Anonymize(v)
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+package core
+
+import "testing"
+
+func TestAnonymize(t *testing.T) {
+	a := NewAnonymizer("/home/alice", []string{"corp.example.com"})
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"home path", "cd /home/alice/src/app", "cd ~/src/app"},
+		{"home itself", "ls /home/alice", "ls ~"},
+		{"home prefix of another", "ls /home/alice2/x", "ls /home/<user>/x"},
+		{"other user", "cp /home/bob/notes.txt .", "cp /home/<user>/notes.txt ."},
+		{"mac user", "open /Users/carol/Desktop", "open /Users/<user>/Desktop"},
+		{"private ip", "ssh deploy@10.0.3.14", "ssh deploy@<ip>"},
+		{"cgnat ip", "ping 100.101.2.3", "ping <ip>"},
+		{"public ip", "dig @1.1.1.1 example.com", "dig @1.1.1.1 example.com"},
+		{"loopback", "curl 127.0.0.1:8080", "curl 127.0.0.1:8080"},
+		{"internal host", "ssh build01.internal", "ssh <host>"},
+		{"local host", "curl http://printer.local/status", "curl http://<host>/status"},
+		{"configured domain", "kubectl --server https://k8s.eu.corp.example.com:6443 get pods", "kubectl --server https://<host>:6443 get pods"},
+		{"public host", "curl https://example.com", "curl https://example.com"},
+		{"dot local dir", "ls ~/.local/share /usr/local/bin", "ls ~/.local/share /usr/local/bin"},
+		{"file name", "vim config.local.json", "vim config.local.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.Anonymize(tt.input); got != tt.want {
+				t.Errorf("Anonymize(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnonymizerNil(t *testing.T) {
+	var a *Anonymizer
+	if got := a.Anonymize("cd /home/alice"); got != "cd /home/alice" {
+		t.Errorf("nil Anonymize = %q, want unchanged", got)
+	}
+	d := &DirContext{CwdListing: "a b"}
+	if a.AnonymizeDir(d) != d {
+		t.Error("nil AnonymizeDir returned a copy")
+	}
+}
+
+func TestAnonymizeDir(t *testing.T) {
+	a := NewAnonymizer("/home/alice", nil)
+	d := &DirContext{
+		CwdPath:      "/home/alice/app",
+		CwdListing:   "main.go db.internal.yaml",
+		CwdManifests: map[string]string{"Makefile": "deploy: ssh 192.168.1.20"},
+	}
+	got := a.AnonymizeDir(d)
+	if got.CwdPath != "~/app" || got.CwdManifests["Makefile"] != "deploy: ssh <ip>" {
+		t.Errorf("AnonymizeDir = %+v", got)
+	}
+	if d.CwdPath != "/home/alice/app" {
+		t.Error("AnonymizeDir modified its argument")
+	}
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// NeverSuggestMatch returns the first of patterns that cmd runs, or "" when
+// none does. A pattern is a command or the leading words of one: it
+// matches when cmd, or any command chained or piped within it, starts with
+// the pattern's words, so "rm -rf /" matches `cd && rm -fr / ` but not
+// `rm -rf /tmp/x`, and "telnet" matches every telnet invocation. Both
+// sides are compared in normalized form (see NormalizeCommand), so quoting
+// and flag spelling do not evade a pattern.
+func NeverSuggestMatch(cmd string, patterns []string) string {
+	if len(patterns) == 0 {
+		return ""
+	}
+	norm := NormalizeCommand(cmd)
+	starts := commandStarts(norm)
+	for _, pattern := range patterns {
+		p := NormalizeCommand(pattern)
+		if p == "" {
+			continue
+		}
+		if norm == p {
+			return pattern
+		}
+		for _, start := range starts {
+			if strings.HasPrefix(norm[start:], p) && wordBoundary(norm, start+len(p)) {
+				return pattern
+			}
+		}
+	}
+	return ""
+}
+
+// FilterNeverSuggest removes the candidates matching any of patterns (see
+// NeverSuggestMatch), whatever the model or history proposed.
+func FilterNeverSuggest(candidates []ashlet.Candidate, patterns []string) []ashlet.Candidate {
+	if len(patterns) == 0 {
+		return candidates
+	}
+	filtered := candidates[:0]
+	for _, c := range candidates {
+		if NeverSuggestMatch(c.Completion, patterns) == "" {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// NeverSuggestGuidance is the system prompt addendum listing patterns the
+// model must not suggest, or "" when there are none.
+func NeverSuggestGuidance(patterns []string) string {
+	var sb strings.Builder
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if sb.Len() == 0 {
+			sb.WriteString("Never suggest these commands, alone or as part of a longer command, even if asked:\n")
+		}
+		sb.WriteString("- `" + pattern + "`\n")
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
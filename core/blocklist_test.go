@@ -0,0 +1,62 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestNeverSuggestMatch(t *testing.T) {
+	patterns := []string{"rm -rf /", ":(){ :|:& };:", "telnet", "git push --force"}
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"rm -rf /", "rm -rf /"},
+		// Flag spelling and order, chains, and pipelines do not evade a pattern.
+		{"rm -fr /", "rm -rf /"},
+		{"cd / && rm -r -f /", "rm -rf /"},
+		{"rm -rf / --no-preserve-root", "rm -rf /"},
+		{":(){ :|:& };:", ":(){ :|:& };:"},
+		{"telnet example.com 23", "telnet"},
+		{"echo quit | telnet localhost", "telnet"},
+		{"git push -f origin main", "git push --force"},
+		// Only whole words of a command's start match.
+		{"rm -rf /tmp/build", ""},
+		{"telnetd --help", ""},
+		{"echo telnet", ""},
+		{`git commit -m "rm -rf /"`, ""},
+		{"git push origin main", ""},
+	}
+	for _, tt := range tests {
+		if got := NeverSuggestMatch(tt.cmd, patterns); got != tt.want {
+			t.Errorf("NeverSuggestMatch(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+	if got := NeverSuggestMatch("rm -rf /", nil); got != "" {
+		t.Errorf("NeverSuggestMatch without patterns = %q", got)
+	}
+}
+
+func TestFilterNeverSuggest(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: "telnet example.com"},
+		{Completion: "ssh example.com"},
+		{Completion: "nc example.com 23 | telnet"},
+	}
+	got := FilterNeverSuggest(candidates, []string{"telnet"})
+	if len(got) != 1 || got[0].Completion != "ssh example.com" {
+		t.Errorf("FilterNeverSuggest = %+v, want only ssh", got)
+	}
+}
+
+func TestNeverSuggestGuidance(t *testing.T) {
+	if got := NeverSuggestGuidance([]string{"", " "}); got != "" {
+		t.Errorf("guidance for blank patterns = %q, want none", got)
+	}
+	got := NeverSuggestGuidance([]string{"rm -rf /", "telnet"})
+	if !strings.Contains(got, "- `rm -rf /`\n- `telnet`") {
+		t.Errorf("guidance = %q, want each pattern listed", got)
+	}
+}
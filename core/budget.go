@@ -0,0 +1,168 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Paranoid-AF/ashlet"
+)
+
+// keepAlways marks sections that fitBudget never trims (cwd, database, nix
+// shell, last command). Optional sections have positive keep values from
+// sectionPriorities.
+const keepAlways = 0
+
+// sectionPriorities maps each optional section name to its keep value:
+// sections listed first get the highest and are trimmed last. Names not in
+// the list are absent from the map and their sections are left out.
+func sectionPriorities(names []string) map[string]int {
+	if len(names) == 0 {
+		names = ashlet.DefaultContextSections
+	}
+	keep := make(map[string]int, len(names))
+	for i, name := range names {
+		if _, dup := keep[name]; !dup {
+			keep[name] = len(names) - i
+		}
+	}
+	return keep
+}
+
+// minSectionTokens is the smallest a text section is truncated to; below
+// this it is dropped instead, since a stub of a manifest is mostly noise.
+const minSectionTokens = 8
+
+// section is one "label: value" line of the user message.
+type section struct {
+	name  string // context section name; empty for required sections
+	label string
+	text  string   // value, for text sections
+	items []string // values joined with sep, for list sections
+	sep   string
+	keep  int
+}
+
+func (s section) render() string {
+	value := s.text
+	if s.items != nil {
+		value = strings.Join(s.items, s.sep)
+	}
+	return s.label + ": " + value + "\n"
+}
+
+// fitBudget trims sections, lowest keep value first, until their estimated
+// tokens fit budget. List sections lose items from the end (least recent or
+// least related); text sections are truncated, or dropped when little would
+// be left. Section order is preserved.
+func fitBudget(sections []section, budget int) []section {
+	tokens := make([]int, len(sections))
+	total := 0
+	for i, sec := range sections {
+		tokens[i] = EstimateTokens(sec.render())
+		total += tokens[i]
+	}
+	if total <= budget {
+		return sections
+	}
+
+	order := make([]int, 0, len(sections))
+	for i, sec := range sections {
+		if sec.keep != keepAlways {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return sections[order[a]].keep < sections[order[b]].keep
+	})
+
+	dropped := make([]bool, len(sections))
+	for _, i := range order {
+		if total <= budget {
+			break
+		}
+		sec := &sections[i]
+		if sec.items != nil {
+			for len(sec.items) > 0 && total > budget {
+				sec.items = sec.items[:len(sec.items)-1]
+				total -= tokens[i]
+				tokens[i] = EstimateTokens(sec.render())
+				total += tokens[i]
+			}
+			dropped[i] = len(sec.items) == 0
+		} else {
+			keep := EstimateTokens(sec.text) - (total - budget)
+			if keep < minSectionTokens {
+				dropped[i] = true
+			} else {
+				sec.text = truncateTokens(sec.text, keep)
+			}
+		}
+		if dropped[i] {
+			total -= tokens[i]
+			continue
+		}
+		total -= tokens[i]
+		tokens[i] = EstimateTokens(sec.render())
+		total += tokens[i]
+	}
+
+	kept := sections[:0]
+	for i, sec := range sections {
+		if !dropped[i] {
+			kept = append(kept, sec)
+		}
+	}
+	return kept
+}
+
+// EstimateTokens approximates how many tokens a BPE tokenizer (as used by
+// common code models) produces for s: about one token per four letters or
+// digits of a word, one per punctuation mark or symbol, and one per
+// non-ASCII rune. It errs high on identifiers and low on common English,
+// which suits shell context.
+func EstimateTokens(s string) int {
+	n, run := 0, 0
+	flush := func() {
+		n += (run + 3) / 4
+		run = 0
+	}
+	for _, r := range s {
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			run++
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			n++
+		}
+	}
+	flush()
+	return n
+}
+
+// truncateTokens returns the longest prefix of s estimated at no more than
+// maxTokens tokens, including a trailing "..." marker.
+func truncateTokens(s string, maxTokens int) string {
+	if EstimateTokens(s) <= maxTokens {
+		return s
+	}
+	maxTokens -= EstimateTokens("...")
+	// Binary search over rune boundaries for the longest fitting prefix.
+	bounds := make([]int, 0, len(s))
+	for i := range s {
+		bounds = append(bounds, i)
+	}
+	lo, hi := 0, len(bounds)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if EstimateTokens(s[:bounds[mid]]) <= maxTokens {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return strings.TrimRight(s[:bounds[lo]], " ,;") + "..."
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{"", 0},
+		{"git", 1},
+		{"git status", 3},
+		{"kubectl", 2},
+		{"--force", 4},
+		{"a/b.c", 5},
+		{"日本", 2},
+	}
+	for _, tt := range tests {
+		if got := EstimateTokens(tt.input); got != tt.want {
+			t.Errorf("EstimateTokens(%q) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateTokens(t *testing.T) {
+	s := strings.Repeat("word ", 50)
+	got := truncateTokens(s, 10)
+	if n := EstimateTokens(got); n > 10 {
+		t.Errorf("truncated to %d tokens, want <= 10: %q", n, got)
+	}
+	if !strings.HasSuffix(got, "...") {
+		t.Errorf("truncated text should end with ..., got %q", got)
+	}
+	if short := "git status"; truncateTokens(short, 10) != short {
+		t.Errorf("text within budget should be unchanged")
+	}
+}
+
+func TestBuildUserMessageBudget(t *testing.T) {
+	uc := UserContext{
+		Cwd: "/home/user/project",
+		Dir: &DirContext{
+			CwdListing:   strings.Repeat("file.txt ", 100),
+			GitManifests: map[string]string{"Makefile": strings.Repeat("target, ", 100)},
+		},
+		Recent:      []string{"git status", "make build", "go test ./..."},
+		LastFailure: "make deploy (exit 2)",
+		Input:       "git ",
+		CursorPos:   4,
+	}
+
+	full := BuildUserMessage(uc)
+	uc.TokenBudget = 60
+	got := BuildUserMessage(uc)
+
+	if n := EstimateTokens(got); n > uc.TokenBudget {
+		t.Errorf("message is %d tokens, want <= %d:\n%s", n, uc.TokenBudget, got)
+	}
+	if len(got) >= len(full) {
+		t.Errorf("budgeted message should be shorter than unbudgeted")
+	}
+	for _, want := range []string{"cwd: /home/user/project", "last command: make deploy", "recent: git status", "Input: `git `"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("message missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Makefile:") {
+		t.Errorf("git manifest should be dropped before recent commands:\n%s", got)
+	}
+}
+
+func TestBuildUserMessageNoBudget(t *testing.T) {
+	uc := UserContext{
+		Cwd:       "/tmp",
+		Recent:    []string{"ls", "pwd"},
+		Related:   []string{"ls -la"},
+		Input:     "l",
+		CursorPos: 1,
+	}
+	want := "cwd: /tmp\nrecent: ls, pwd\nrelated: ls -la\n\nInput: `l`"
+	if got := BuildUserMessage(uc); got != want {
+		t.Errorf("BuildUserMessage() = %q, want %q", got, want)
+	}
+}
+
+func TestBuildUserMessageSections(t *testing.T) {
+	uc := UserContext{
+		Cwd:       "/tmp",
+		Dir:       &DirContext{CwdListing: "a.txt b.txt", PackageManager: "pnpm"},
+		Recent:    []string{"ls"},
+		Related:   []string{"ls -la"},
+		Input:     "l",
+		CursorPos: 1,
+		Sections:  []string{"related", "files"},
+	}
+	got := BuildUserMessage(uc)
+	want := "cwd: /tmp\nfiles: a.txt b.txt\nrelated: ls -la\n\nInput: `l`"
+	if got != want {
+		t.Errorf("BuildUserMessage() = %q, want %q", got, want)
+	}
+}
+
+func TestBuildUserMessageSectionPriority(t *testing.T) {
+	uc := UserContext{
+		Cwd:       "/tmp",
+		Recent:    []string{"git status", "git diff", "make build"},
+		Related:   []string{"git log --oneline", "git show HEAD"},
+		Input:     "git ",
+		CursorPos: 4,
+	}
+	uc.TokenBudget = EstimateTokens(BuildUserMessage(uc)) - 5
+
+	// By default related commands are trimmed before recent ones.
+	got := BuildUserMessage(uc)
+	if !strings.Contains(got, "make build") {
+		t.Errorf("default priority should keep all recent commands:\n%s", got)
+	}
+
+	uc.Sections = []string{"related", "recent"}
+	got = BuildUserMessage(uc)
+	if !strings.Contains(got, "git show HEAD") || strings.Contains(got, "make build") {
+		t.Errorf("recent should be trimmed before related when listed last:\n%s", got)
+	}
+}
+
+func TestBuildInfillPrompt(t *testing.T) {
+	uc := UserContext{
+		Cwd:       "/tmp",
+		Recent:    []string{"ls", "make"},
+		Input:     "git  main",
+		CursorPos: 4,
+		Sections:  []string{"recent"},
+	}
+	prompt, suffix := BuildInfillPrompt(uc)
+	if want := "# cwd: /tmp\n# recent: ls, make\ngit "; prompt != want {
+		t.Errorf("prompt = %q, want %q", prompt, want)
+	}
+	if suffix != " main" {
+		t.Errorf("suffix = %q, want %q", suffix, " main")
+	}
+}
@@ -0,0 +1,205 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// constructClosers maps keywords that open a compound command to the
+// keyword that closes it.
+var constructClosers = map[string]string{
+	"for":    "done",
+	"while":  "done",
+	"until":  "done",
+	"select": "done",
+	"if":     "fi",
+	"case":   "esac",
+	"{":      "}",
+}
+
+// bodyKeywords are reserved words after which a command is expected, so
+// the next word is again in command position.
+var bodyKeywords = map[string]bool{
+	"do": true, "then": true, "else": true, "elif": true,
+	"if": true, "while": true, "until": true, "{": true, "!": true,
+}
+
+// CompleteConstructs checks candidates that use compound commands (for,
+// while, until, select, if, case, { } and function definitions) with the
+// shell parser. A candidate that is only missing its closing keywords has
+// them appended (done, fi, esac, }); one that still does not parse is
+// dropped. Heredocs missing their delimiter line are closed too.
+// Candidates without compound commands are otherwise returned unchanged.
+func CompleteConstructs(candidates []ashlet.Candidate) []ashlet.Candidate {
+	out := candidates[:0]
+	for _, c := range candidates {
+		cmd, ok := completeConstruct(c.Completion)
+		if !ok {
+			continue
+		}
+		c.Completion = cmd
+		out = append(out, c)
+	}
+	return out
+}
+
+// completeConstruct returns cmd with any missing closing keywords
+// appended. ok is false if cmd opens or closes a compound command but
+// cannot be made to parse.
+func completeConstruct(cmd string) (string, bool) {
+	cmd = closeHeredocs(cmd)
+	if parses(cmd) {
+		return cmd, true
+	}
+	closers, hasConstruct := openConstructs(cmd)
+	if !hasConstruct {
+		return cmd, true
+	}
+	if len(closers) > 0 {
+		sep := "; "
+		if strings.Contains(cmd, "\n") {
+			sep = "\n"
+		}
+		trimmed := strings.TrimRight(cmd, " \t;\n")
+		if fields := strings.Fields(trimmed); len(fields) == 0 || bodyKeywords[fields[len(fields)-1]] {
+			return "", false // the body itself is missing
+		}
+		for i := len(closers) - 1; i >= 0; i-- {
+			trimmed += sep + closers[i]
+		}
+		cmd = trimmed
+	}
+	if !parses(cmd) {
+		return "", false
+	}
+	return cmd, true
+}
+
+// reHeredoc matches a heredoc operator (<<WORD, <<-WORD, <<'WORD',
+// <<"WORD"), but not a here-string (<<<).
+var reHeredoc = regexp.MustCompile(`(?:^|[^<])<<(-?)[ \t]*['"]?([A-Za-z_][A-Za-z0-9_]*)['"]?`)
+
+// heredoc is a heredoc whose body has not ended yet.
+type heredoc struct {
+	delim string
+	tabs  bool // <<- allows the delimiter line to be indented with tabs
+}
+
+// closeHeredocs appends the delimiter lines of heredocs in cmd whose
+// bodies do not end, in the order the shell reads them. A heredoc whose
+// body has not started is left open for the user to type.
+func closeHeredocs(cmd string) string {
+	if !strings.Contains(cmd, "<<") {
+		return cmd
+	}
+	var owed []heredoc
+	body := false
+	for _, line := range strings.Split(cmd, "\n") {
+		if len(owed) > 0 {
+			body = true
+			if owed[0].tabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == owed[0].delim {
+				owed = owed[1:]
+			}
+			continue
+		}
+		for _, m := range reHeredoc.FindAllStringSubmatch(line, -1) {
+			owed = append(owed, heredoc{delim: m[2], tabs: m[1] == "-"})
+		}
+	}
+	if !body {
+		return cmd
+	}
+	for _, h := range owed {
+		cmd += "\n" + h.delim
+	}
+	return cmd
+}
+
+// parses reports whether s is syntactically complete shell code.
+func parses(s string) bool {
+	parser := syntax.NewParser(syntax.Variant(syntax.LangBash))
+	_, err := parser.Parse(strings.NewReader(s), "")
+	return err == nil
+}
+
+// openConstructs scans the words of s in command position and returns the
+// closing keywords still owed, innermost last. hasConstruct reports
+// whether s contains any compound command keyword or function definition.
+// Quoted text is masked first so that keywords inside strings are ignored.
+func openConstructs(s string) (closers []string, hasConstruct bool) {
+	masked := []byte(s)
+	for _, sp := range quoteSpans(s) {
+		end := sp.close
+		if end < 0 {
+			end = len(s) - 1
+		}
+		for i := sp.open; i <= end; i++ {
+			masked[i] = 'x'
+		}
+	}
+
+	cmdPos, funcName := true, false
+	word := func(w string) {
+		if funcName {
+			// The body follows the name in "function name { ... }".
+			funcName, cmdPos = false, true
+			return
+		}
+		if !cmdPos {
+			return
+		}
+		cmdPos = bodyKeywords[w]
+		if closer, ok := constructClosers[w]; ok {
+			closers = append(closers, closer)
+			hasConstruct = true
+			return
+		}
+		switch w {
+		case "done", "fi", "esac", "}":
+			hasConstruct = true
+			if n := len(closers); n > 0 && closers[n-1] == w {
+				closers = closers[:n-1]
+			}
+			cmdPos = false
+		case "function":
+			hasConstruct, funcName = true, true
+		}
+	}
+
+	start := -1
+	for i := 0; i <= len(masked); i++ {
+		var ch byte = '\n'
+		if i < len(masked) {
+			ch = masked[i]
+		}
+		switch ch {
+		case ' ', '\t', '\n', ';', '&', '|', '(', ')':
+			if start >= 0 {
+				word(string(masked[start:i]))
+				start = -1
+			}
+			switch ch {
+			case ' ', '\t':
+			case '(':
+				// name() marks a function definition.
+				if i+1 < len(masked) && masked[i+1] == ')' && !cmdPos {
+					hasConstruct = true
+				}
+				cmdPos = true
+			default:
+				cmdPos = true
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	return closers, hasConstruct
+}
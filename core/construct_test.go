@@ -0,0 +1,62 @@
+package core
+
+import (
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestCompleteConstruct(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+		ok   bool
+	}{
+		{"git status", "git status", true},
+		{`echo "unterminated`, `echo "unterminated`, true}, // not a construct, left alone
+		{"for f in *.go; do gofmt -w $f; done", "for f in *.go; do gofmt -w $f; done", true},
+		{"for f in *.go; do gofmt -w $f", "for f in *.go; do gofmt -w $f; done", true},
+		{"for f in *.go; do gofmt -w $f;", "for f in *.go; do gofmt -w $f; done", true},
+		{"while true; do if ping -c1 host; then break", "while true; do if ping -c1 host; then break; fi; done", true},
+		{"if [ -f go.mod ]; then go test ./...; else make", "if [ -f go.mod ]; then go test ./...; else make; fi", true},
+		{"case $1 in start) up;; stop) down;;", "case $1 in start) up;; stop) down; esac", true},
+		{"deploy() { make && scp app host:", "deploy() { make && scp app host:; }", true},
+		{"function deploy { make", "function deploy { make; }", true},
+		{"for f in *\ndo\n echo $f", "for f in *\ndo\n echo $f\ndone", true},
+		{`echo "done" && for x in a b; do echo "fi $x"`, `echo "done" && for x in a b; do echo "fi $x"; done`, true},
+		{"cat <<EOF > notes.txt\nfor the win\nEOF", "cat <<EOF > notes.txt\nfor the win\nEOF", true}, // keywords in a heredoc body
+		{"cat <<'EOF' > notes.txt\nhello", "cat <<'EOF' > notes.txt\nhello\nEOF", true},
+		{"cat <<-END | sh\n\techo hi\n\tEND", "cat <<-END | sh\n\techo hi\n\tEND", true},
+		{"cat <<EOF", "cat <<EOF", true}, // body left for the user
+		{"grep x <<< \"$s\"", "grep x <<< \"$s\"", true},
+		{"for f in *; do", "", false},           // empty body
+		{"if true; then echo; done", "", false}, // mismatched closer
+		{"echo hi; fi", "", false},              // stray closer
+		{"git log | head; done", "", false},     // stray closer
+	}
+	for _, tt := range tests {
+		got, ok := completeConstruct(tt.cmd)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("completeConstruct(%q) = %q, %v; want %q, %v", tt.cmd, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCompleteConstructsKeepsOrderAndCursor(t *testing.T) {
+	pos := 26
+	candidates := []ashlet.Candidate{
+		{Completion: "for f in *; do echo $f", Confidence: 0.9, CursorPos: &pos},
+		{Completion: "for f in *; do", Confidence: 0.8},
+		{Completion: "ls", Confidence: 0.5},
+	}
+	got := CompleteConstructs(candidates)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 candidates, got %d: %+v", len(got), got)
+	}
+	if got[0].Completion != "for f in *; do echo $f; done" || got[0].CursorPos != &pos {
+		t.Errorf("unexpected first candidate: %+v", got[0])
+	}
+	if got[1].Completion != "ls" {
+		t.Errorf("expected ls second, got %q", got[1].Completion)
+	}
+}
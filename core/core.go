@@ -0,0 +1,6 @@
+// Package core holds the pure completion logic shared by the daemon and
+// browser tools: prompt rendering, user message formatting, candidate
+// parsing, filtering, ranking, and redaction. It must not run processes,
+// open sockets, or touch the filesystem, so it also compiles to wasm/js
+// (see core/wasm).
+package core
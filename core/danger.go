@@ -0,0 +1,84 @@
+package core
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// dbClients are database command-line clients whose arguments (or stdin)
+// carry SQL-ish statements.
+var dbClients = map[string]bool{
+	"psql": true, "pgcli": true, "mysql": true, "mariadb": true, "mycli": true,
+	"sqlite3": true, "litecli": true, "duckdb": true, "mongosh": true, "mongo": true,
+	"clickhouse-client": true, "sqlcmd": true, "cockroach": true, "redis-cli": true,
+}
+
+// dbClient returns the first database client invoked by cmd, or "".
+func dbClient(cmd string) string {
+	for _, seg := range reSegmentSep.Split(cmd, -1) {
+		for _, f := range strings.Fields(seg) {
+			if strings.Contains(f, "=") && !strings.HasPrefix(f, "-") {
+				continue // leading env assignment
+			}
+			if name := filepath.Base(f); dbClients[name] {
+				return name
+			}
+			break
+		}
+	}
+	return ""
+}
+
+// dangerRule flags candidates matching pattern with a short reason.
+type dangerRule struct {
+	pattern *regexp.Regexp
+	reason  string
+	// dbOnly limits the rule to commands that invoke a database client,
+	// so e.g. `git commit -m "drop table"` is not flagged.
+	dbOnly bool
+	// unless suppresses the rule when it also matches (e.g. a WHERE clause).
+	unless *regexp.Regexp
+}
+
+var dangerRules = []dangerRule{
+	{pattern: regexp.MustCompile(`\brm\s+(-[a-zA-Z]*[rR][a-zA-Z]*\s+)+(/|~|\$HOME)(\s|/?$|/\*)`), reason: "recursively deletes a root or home directory"},
+	{pattern: regexp.MustCompile(`\bmkfs(\.\w+)?\s`), reason: "formats a filesystem"},
+	{pattern: regexp.MustCompile(`\bdd\b.*\bof=/dev/`), reason: "writes directly to a device"},
+	{pattern: regexp.MustCompile(`\bgit\s+push\b.*\s(--force|-f)(\s|$)`), reason: "rewrites remote history"},
+	{pattern: regexp.MustCompile(`\bgit\s+reset\s+--hard\b`), reason: "discards uncommitted changes"},
+	{pattern: regexp.MustCompile(`(?i)\bdrop\s+(table|database|schema|view|index|user|role)\b`), reason: "drops a database object", dbOnly: true},
+	{pattern: regexp.MustCompile(`(?i)\btruncate\s+(table\s+)?\w`), reason: "deletes all rows", dbOnly: true},
+	{pattern: regexp.MustCompile(`(?i)\bdelete\s+from\s+\S+`), reason: "deletes rows without a WHERE clause", dbOnly: true, unless: regexp.MustCompile(`(?i)\bwhere\b`)},
+	{pattern: regexp.MustCompile(`(?i)\bupdate\s+\S+\s+set\b`), reason: "updates rows without a WHERE clause", dbOnly: true, unless: regexp.MustCompile(`(?i)\bwhere\b`)},
+	{pattern: regexp.MustCompile(`(?i)\balter\s+table\b.*\bdrop\b`), reason: "drops a column or constraint", dbOnly: true},
+	{pattern: regexp.MustCompile(`(?i)\b(flushall|flushdb|dropDatabase\(\))`), reason: "deletes all data", dbOnly: true},
+}
+
+// ClassifyDanger returns a short reason when cmd is potentially destructive,
+// or "" when no rule matches.
+func ClassifyDanger(cmd string) string {
+	isDB := dbClient(cmd) != ""
+	for _, r := range dangerRules {
+		if r.dbOnly && !isDB {
+			continue
+		}
+		if !r.pattern.MatchString(cmd) {
+			continue
+		}
+		if r.unless != nil && r.unless.MatchString(cmd) {
+			continue
+		}
+		return r.reason
+	}
+	return ""
+}
+
+// FlagDangerous sets Danger on candidates the classifier considers destructive.
+func FlagDangerous(candidates []ashlet.Candidate) {
+	for i := range candidates {
+		candidates[i].Danger = ClassifyDanger(candidates[i].Completion)
+	}
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestDBClient(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"psql -h db app", "psql"},
+		{"PGPASSWORD=x psql", "psql"},
+		{"/usr/local/bin/mysql -u root", "mysql"},
+		{"cat dump.sql | sqlite3 app.db", "sqlite3"},
+		{"git status", ""},
+		{"echo psql", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := dbClient(tt.input); got != tt.want {
+			t.Errorf("dbClient(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyDanger(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		dangerous bool
+	}{
+		{"drop table", `psql -c "DROP TABLE users"`, true},
+		{"truncate", `mysql -e 'truncate orders' app`, true},
+		{"delete without where", `psql -c "DELETE FROM sessions"`, true},
+		{"delete with where", `psql -c "DELETE FROM sessions WHERE expired"`, false},
+		{"update without where", `sqlite3 app.db "UPDATE users SET admin = 1"`, true},
+		{"update with where", `sqlite3 app.db "update users set admin = 1 where id = 3"`, false},
+		{"select", `psql -c "SELECT * FROM users"`, false},
+		{"redis flushall", "redis-cli FLUSHALL", true},
+		{"sql words outside db client", `git commit -m "drop table users"`, false},
+		{"rm -rf root", "rm -rf /", true},
+		{"rm -rf home", "rm -rf ~", true},
+		{"rm -rf subdir", "rm -rf ./build", false},
+		{"mkfs", "mkfs.ext4 /dev/sdb1", true},
+		{"dd to device", "dd if=image.iso of=/dev/sdb bs=4M", true},
+		{"force push", "git push --force origin main", true},
+		{"plain push", "git push origin main", false},
+		{"reset hard", "git reset --hard HEAD~1", true},
+		{"ls", "ls -la", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ClassifyDanger(tt.input)
+			if (got != "") != tt.dangerous {
+				t.Errorf("ClassifyDanger(%q) = %q, want dangerous=%v", tt.input, got, tt.dangerous)
+			}
+		})
+	}
+}
+
+func TestFlagDangerous(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: `psql -c "SELECT 1"`, Confidence: 0.95},
+		{Completion: `psql -c "DROP DATABASE app"`, Confidence: 0.8},
+	}
+	FlagDangerous(candidates)
+	if candidates[0].Danger != "" {
+		t.Errorf("candidate 0 should not be flagged, got %q", candidates[0].Danger)
+	}
+	if candidates[1].Danger == "" {
+		t.Error("candidate 1 should be flagged as dangerous")
+	}
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"unicode/utf8"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// CandidateDiff returns the single edit that turns input into completion:
+// the longest common prefix, then the longest common suffix of what is
+// left, with everything between replaced.
+func CandidateDiff(input, completion string) *ashlet.Diff {
+	prefix := 0
+	for prefix < len(input) && prefix < len(completion) && input[prefix] == completion[prefix] {
+		prefix++
+	}
+	for prefix > 0 && (!runeStart(input, prefix) || !runeStart(completion, prefix)) {
+		prefix--
+	}
+
+	suffix := 0
+	limit := min(len(input), len(completion)) - prefix
+	for suffix < limit && input[len(input)-1-suffix] == completion[len(completion)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && (!runeStart(input, len(input)-suffix) || !runeStart(completion, len(completion)-suffix)) {
+		suffix--
+	}
+
+	return &ashlet.Diff{
+		Prefix:   prefix,
+		Replaced: ashlet.Span{Start: prefix, End: len(input) - suffix},
+		Inserted: ashlet.Span{Start: prefix, End: len(completion) - suffix},
+	}
+}
+
+// runeStart reports whether offset i of s is at a character boundary.
+func runeStart(s string, i int) bool {
+	return i >= len(s) || utf8.RuneStart(s[i])
+}
+
+// WordEnds returns the offsets in cmd, after from, where a shell word
+// ends: unquoted, unescaped whitespace follows it, or cmd does. A quoted
+// string is one word even when it contains spaces, so accepting up to each
+// offset in turn never leaves a quote open. The last offset is len(cmd)
+// unless cmd ends in whitespace.
+func WordEnds(cmd string, from int) []int {
+	var ends []int
+	spans := quoteSpans(cmd)
+	inWord := false
+	for i := 0; i < len(cmd); i++ {
+		if len(spans) > 0 && spans[0].open == i {
+			if spans[0].close < 0 {
+				break
+			}
+			i = spans[0].close
+			spans = spans[1:]
+			inWord = true
+			continue
+		}
+		switch cmd[i] {
+		case ' ', '\t', '\n':
+			if inWord && i > from {
+				ends = append(ends, i)
+			}
+			inWord = false
+		case '\\':
+			i++
+			inWord = true
+		default:
+			inWord = true
+		}
+	}
+	if (inWord || len(spans) > 0) && len(cmd) > from {
+		ends = append(ends, len(cmd))
+	}
+	return ends
+}
+
+// AnnotateDiffs sets Diff and Words on each candidate, relative to input.
+func AnnotateDiffs(candidates []ashlet.Candidate, input string) {
+	for i := range candidates {
+		diff := CandidateDiff(input, candidates[i].Completion)
+		candidates[i].Diff = diff
+		candidates[i].Words = WordEnds(candidates[i].Completion, diff.Prefix)
+	}
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"slices"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// edit builds the Diff of a completion sharing prefix bytes with the input
+// that replaces input[prefix:replacedEnd] with completion[prefix:insertedEnd].
+func edit(prefix, replacedEnd, insertedEnd int) ashlet.Diff {
+	return ashlet.Diff{
+		Prefix:   prefix,
+		Replaced: ashlet.Span{Start: prefix, End: replacedEnd},
+		Inserted: ashlet.Span{Start: prefix, End: insertedEnd},
+	}
+}
+
+func TestCandidateDiff(t *testing.T) {
+	tests := []struct {
+		input, completion string
+		want              ashlet.Diff
+	}{
+		// Appends: only the tail is inserted.
+		{"git st", "git status", edit(6, 6, 10)},
+		{"", "ls -la", edit(0, 0, 6)},
+		// A typo fix in the middle keeps the shared tail.
+		{"gti status", "git status", edit(1, 3, 3)},
+		// Insertion before text after the cursor.
+		{`git commit -m ""`, `git commit -m "fix"`, edit(15, 15, 18)},
+		// Repeated characters do not let prefix and suffix overlap.
+		{"aa", "aaa", edit(2, 2, 3)},
+		// Removal.
+		{"rm -rf build", "rm build", edit(3, 7, 3)},
+		// Offsets never split a character: é and è share their first byte.
+		{"echo é", "echo è", edit(5, 7, 7)},
+		{"unchanged", "unchanged", edit(9, 9, 9)},
+	}
+	for _, tt := range tests {
+		got := CandidateDiff(tt.input, tt.completion)
+		if *got != tt.want {
+			t.Errorf("CandidateDiff(%q, %q) = %+v, want %+v", tt.input, tt.completion, *got, tt.want)
+		}
+		// Applying the edit to the input gives the completion.
+		applied := tt.input[:got.Replaced.Start] + tt.completion[got.Inserted.Start:got.Inserted.End] + tt.input[got.Replaced.End:]
+		if applied != tt.completion {
+			t.Errorf("CandidateDiff(%q, %q) applies to %q", tt.input, tt.completion, applied)
+		}
+	}
+}
+
+func TestWordEnds(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		from int
+		want []int
+	}{
+		{"git status --short", 6, []int{10, 18}},
+		{"git status --short", 0, []int{3, 10, 18}},
+		// A word ending exactly at from is already accepted.
+		{"git status", 3, []int{10}},
+		// Quoted strings and escaped spaces are one word.
+		{`git commit -m "fix the parser"`, 10, []int{13, 30}},
+		{`cat my\ file.txt | wc -l`, 4, []int{16, 18, 21, 24}},
+		// An unterminated quote runs to the end.
+		{`echo 'a b`, 4, []int{9}},
+		{"make\n  install", 0, []int{4, 14}},
+		{"ls ", 0, []int{2}},
+		{"ls", 2, nil},
+	}
+	for _, tt := range tests {
+		got := WordEnds(tt.cmd, tt.from)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("WordEnds(%q, %d) = %v, want %v", tt.cmd, tt.from, got, tt.want)
+		}
+	}
+}
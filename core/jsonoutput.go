@@ -0,0 +1,99 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// CandidateSchemaName names CandidateSchema in structured output requests.
+const CandidateSchemaName = "candidates"
+
+// SubmitToolName names the tool a model calls with CandidateSchema arguments
+// in the "tool" output format.
+const SubmitToolName = "submit_candidates"
+
+// SubmitToolDescription describes SubmitToolName to the model.
+const SubmitToolDescription = "Submit the shell command suggestions."
+
+// CandidateSchema is the JSON schema for the "json" output format and the
+// arguments of SubmitToolName. Structured
+// output APIs require an object at the top level, so the candidate array is
+// wrapped in {"candidates": [...]}.
+var CandidateSchema = json.RawMessage(`{
+  "type": "object",
+  "properties": {
+    "candidates": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "type": {"type": "string", "enum": ["replace", "append", "suffix"]},
+          "commands": {"type": "array", "items": {"type": "string"}}
+        },
+        "required": ["type", "commands"],
+        "additionalProperties": false
+      }
+    }
+  },
+  "required": ["candidates"],
+  "additionalProperties": false
+}`)
+
+// jsonCandidate is one candidate in the "json" output format.
+type jsonCandidate struct {
+	Type     string   `json:"type"`
+	Commands []string `json:"commands"`
+}
+
+// ParseCandidatesJSON parses model output in the "json" output format:
+// either {"candidates": [...]} or a bare array, optionally inside a code
+// fence. Output that is not valid JSON is parsed as XML candidates instead,
+// so a model ignoring the format still produces suggestions.
+func ParseCandidatesJSON(output string, input string, max int, sep string) []ashlet.Candidate {
+	items, ok := decodeJSONCandidates(output)
+	if !ok {
+		return ParseCandidates(output, input, max, sep)
+	}
+
+	p := NewCandidateParser(input, max, sep)
+	for _, item := range items {
+		if item.Type != "append" && item.Type != "suffix" {
+			item.Type = "replace"
+		}
+		var commands []commandTag
+		for _, raw := range item.Commands {
+			if cmd, ok := newCommandTag(raw); ok {
+				commands = append(commands, cmd)
+			}
+		}
+		p.addCommands(item.Type, commands)
+	}
+	return p.candidates
+}
+
+// decodeJSONCandidates extracts the candidate list from output.
+func decodeJSONCandidates(output string) ([]jsonCandidate, bool) {
+	text := strings.TrimSpace(output)
+	if strings.HasPrefix(text, "```") {
+		// Drop the opening fence line (which may name a language) and the
+		// closing fence.
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = text[i+1:]
+		}
+		text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "```"))
+	}
+
+	var wrapped struct {
+		Candidates []jsonCandidate `json:"candidates"`
+	}
+	if err := json.Unmarshal([]byte(text), &wrapped); err == nil {
+		return wrapped.Candidates, true
+	}
+	var items []jsonCandidate
+	if err := json.Unmarshal([]byte(text), &items); err == nil {
+		return items, true
+	}
+	return nil, false
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	defaults "github.com/Paranoid-AF/ashlet/default"
+)
+
+func TestParseCandidatesJSON(t *testing.T) {
+	output := `{"candidates": [
+		{"type": "replace", "commands": ["git commit -m \"█\""]},
+		{"type": "replace", "commands": ["git commit --amend"]},
+		{"type": "replace", "commands": ["git commit --amend"]}
+	]}`
+	candidates := ParseCandidatesJSON(output, "git com", 4, "")
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates (duplicate dropped), got %d", len(candidates))
+	}
+	if candidates[0].Completion != `git commit -m ""` {
+		t.Errorf("candidate[0]: got %q", candidates[0].Completion)
+	}
+	if candidates[0].CursorPos == nil || *candidates[0].CursorPos != 15 {
+		t.Errorf("candidate[0] cursor: got %v, want 15", candidates[0].CursorPos)
+	}
+	if candidates[0].Confidence <= candidates[1].Confidence {
+		t.Errorf("unexpected confidences: %v, %v", candidates[0].Confidence, candidates[1].Confidence)
+	}
+}
+
+func TestParseCandidatesJSONSuffix(t *testing.T) {
+	output := `{"candidates": [{"type": "suffix", "commands": ["tus"]}, {"type": "suffix", "commands": [" --short"]}]}`
+	candidates := ParseCandidatesJSON(output, "git sta", 4, "")
+	if len(candidates) != 2 || candidates[0].Completion != "git status" || candidates[1].Completion != "git sta --short" {
+		t.Errorf("got %+v", candidates)
+	}
+}
+
+func TestParseCandidatesJSONAppendAndMultipleCommands(t *testing.T) {
+	output := "```json\n[{\"type\": \"append\", \"commands\": [\"git push\", \"git status\"]}]\n```"
+	candidates := ParseCandidatesJSON(output, "git commit -m \"x\" &&", 4, "")
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	if want := `git commit -m "x" && git push && git status`; candidates[0].Completion != want {
+		t.Errorf("got %q, want %q", candidates[0].Completion, want)
+	}
+}
+
+func TestParseCandidatesJSONFallsBackToXML(t *testing.T) {
+	output := `<candidate type="replace"><command>git status</command></candidate>`
+	candidates := ParseCandidatesJSON(output, "git s", 4, "")
+	if len(candidates) != 1 || candidates[0].Completion != "git status" {
+		t.Errorf("expected XML fallback to parse git status, got %+v", candidates)
+	}
+}
+
+func TestBuildSystemPromptJSONOutput(t *testing.T) {
+	for _, builtin := range []string{defaults.DefaultPrompt, defaults.DefaultFixPrompt} {
+		prompt := RenderPrompt("", builtin, PromptData{MaxCandidates: 4, JSONOutput: true})
+		if !strings.Contains(prompt, `{"candidates": [`) {
+			t.Error("JSON prompt should describe the JSON format")
+		}
+		if strings.Contains(prompt, "<candidate") {
+			t.Error("JSON prompt should not mention XML tags")
+		}
+	}
+}
+
+func TestBuildSystemPromptToolOutput(t *testing.T) {
+	for _, builtin := range []string{defaults.DefaultPrompt, defaults.DefaultFixPrompt} {
+		prompt := RenderPrompt("", builtin, PromptData{MaxCandidates: 4, JSONOutput: true, ToolOutput: true})
+		if !strings.Contains(prompt, "`"+SubmitToolName+"` tool") {
+			t.Error("tool prompt should ask for a submit_candidates call")
+		}
+		if strings.Contains(prompt, "Respond with only a JSON object") {
+			t.Error("tool prompt should not ask for a JSON reply")
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package core
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// NormalizeCommand returns a canonical form of cmd so that semantically
+// equivalent commands compare equal: it is reformatted by the shell printer
+// (spacing, operator layout), options of well-known commands are put in a
+// canonical form (see canonicalFlags), and each literal argument is
+// requoted minimally, so `git commit -m "fix"`, `git commit -m 'fix'`,
+// `git commit --message=fix`, and `git  commit -m fix` all normalize the
+// same. Commands that do not parse fall back to whitespace collapsing.
+func NormalizeCommand(cmd string) string {
+	parser := syntax.NewParser(syntax.Variant(syntax.LangBash))
+	prog, err := parser.Parse(strings.NewReader(cmd), "")
+	if err != nil {
+		return collapseSpaces(strings.TrimSpace(cmd))
+	}
+
+	syntax.Walk(prog, func(node syntax.Node) bool {
+		if call, ok := node.(*syntax.CallExpr); ok {
+			call.Args = canonicalFlags(call.Args)
+			for _, word := range call.Args {
+				requoteWord(word)
+			}
+		}
+		return true
+	})
+
+	var buf bytes.Buffer
+	printer := syntax.NewPrinter(syntax.Indent(0), syntax.Minify(true))
+	if err := printer.Print(&buf, prog); err != nil {
+		return collapseSpaces(strings.TrimSpace(cmd))
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+// flagSpec describes the options of a well-known command: long options
+// that have a one-letter equivalent, and the one-letter options that take
+// no argument and so can be bundled (as in ls -la).
+type flagSpec struct {
+	short map[string]byte
+	bools string
+}
+
+// flagSpecs holds the commands whose options canonicalFlags rewrites,
+// keyed by the command name and, for tools with subcommands, the
+// subcommand. Only options that mean the same on GNU and BSD systems are
+// listed.
+var flagSpecs = map[string]flagSpec{
+	"git add":    {map[string]byte{"all": 'A', "patch": 'p', "update": 'u', "force": 'f', "dry-run": 'n', "verbose": 'v'}, "Afnpuv"},
+	"git commit": {map[string]byte{"message": 'm', "all": 'a', "signoff": 's', "verbose": 'v', "quiet": 'q', "patch": 'p'}, "apqsv"},
+	"git push":   {map[string]byte{"force": 'f', "set-upstream": 'u', "verbose": 'v', "quiet": 'q', "dry-run": 'n'}, "fnquv"},
+	"git status": {map[string]byte{"short": 's', "branch": 'b'}, "bs"},
+	"git branch": {map[string]byte{"all": 'a', "remotes": 'r', "verbose": 'v'}, "arv"},
+	"docker run": {map[string]byte{"interactive": 'i', "tty": 't', "detach": 'd', "env": 'e', "publish": 'p', "volume": 'v', "workdir": 'w'}, "dit"},
+	"grep":       {map[string]byte{"ignore-case": 'i', "recursive": 'r', "line-number": 'n', "invert-match": 'v', "count": 'c', "files-with-matches": 'l', "extended-regexp": 'E', "fixed-strings": 'F', "word-regexp": 'w', "regexp": 'e'}, "EFcilnrvw"},
+	"ls":         {map[string]byte{"all": 'a', "almost-all": 'A', "recursive": 'R', "reverse": 'r', "directory": 'd'}, "1ARSadhlrt"},
+	"mkdir":      {map[string]byte{"parents": 'p', "verbose": 'v'}, "pv"},
+	"rm":         {map[string]byte{"recursive": 'r', "force": 'f', "verbose": 'v'}, "firv"},
+}
+
+// canonicalFlags rewrites the options of a well-known command so that
+// equivalent spellings print the same: long options with a one-letter
+// equivalent become that letter (--message=x becomes -m x), and each run
+// of argument-less one-letter options, bundled or not, becomes a single
+// sorted bundle (ls -l -a, ls -la, and ls -al all become ls -al). A
+// bundle ending in an option that takes an argument (git commit -am x)
+// is split before it. Options after -- and those of unknown commands are
+// left alone.
+func canonicalFlags(args []*syntax.Word) []*syntax.Word {
+	name, skip := "", 0
+	if len(args) > 0 {
+		name, skip = args[0].Lit(), 1
+	}
+	if len(args) > 1 {
+		if sub := name + " " + args[1].Lit(); flagSpecs[sub].short != nil {
+			name, skip = sub, 2
+		}
+	}
+	spec, ok := flagSpecs[name]
+	if !ok {
+		return args
+	}
+
+	out := append([]*syntax.Word(nil), args[:skip]...)
+	var run []byte
+	flush := func() {
+		if len(run) > 0 {
+			slices.Sort(run)
+			run = slices.Compact(run)
+			out = append(out, litWord("-"+string(run)))
+			run = nil
+		}
+	}
+	for i, word := range args[skip:] {
+		lit := word.Lit()
+		switch {
+		case lit == "--":
+			flush()
+			return append(out, args[skip+i:]...)
+		case strings.HasPrefix(firstLit(word), "--"):
+			name, value, hasValue := strings.Cut(firstLit(word)[2:], "=")
+			letter, known := spec.short[name]
+			isBool := strings.IndexByte(spec.bools, letter) >= 0
+			switch {
+			case known && isBool && !hasValue:
+				run = append(run, letter)
+			case known && !isBool:
+				// --name=value, where value may be quoted or expanded,
+				// becomes -x value.
+				flush()
+				out = append(out, litWord("-"+string(letter)))
+				if hasValue {
+					parts := append([]syntax.WordPart{&syntax.Lit{Value: value}}, word.Parts[1:]...)
+					out = append(out, &syntax.Word{Parts: parts})
+				}
+			default:
+				flush()
+				out = append(out, word)
+			}
+		case len(lit) > 1 && lit[0] == '-':
+			letters := lit[1:]
+			last := letters[len(letters)-1]
+			if strings.IndexByte(spec.bools, last) < 0 && isShort(spec, last) {
+				letters = letters[:len(letters)-1]
+			} else {
+				last = 0
+			}
+			if strings.Trim(letters, spec.bools) != "" {
+				flush()
+				out = append(out, word)
+				continue
+			}
+			run = append(run, letters...)
+			if last != 0 {
+				flush()
+				out = append(out, litWord("-"+string(last)))
+			}
+		default:
+			flush()
+			out = append(out, word)
+		}
+	}
+	flush()
+	return out
+}
+
+// isShort reports whether letter is one of spec's one-letter options.
+func isShort(spec flagSpec, letter byte) bool {
+	for _, l := range spec.short {
+		if l == letter {
+			return true
+		}
+	}
+	return false
+}
+
+// firstLit returns the leading literal text of word, if any.
+func firstLit(word *syntax.Word) string {
+	if len(word.Parts) > 0 {
+		if lit, ok := word.Parts[0].(*syntax.Lit); ok {
+			return lit.Value
+		}
+	}
+	return ""
+}
+
+func litWord(value string) *syntax.Word {
+	return &syntax.Word{Parts: []syntax.WordPart{&syntax.Lit{Value: value}}}
+}
+
+// requoteWord replaces a word made only of literal text with its minimally
+// quoted form. Words with expansions, or unquoted glob, brace, or tilde
+// characters (whose meaning depends on being unquoted), are left as-is.
+func requoteWord(word *syntax.Word) {
+	var value strings.Builder
+	for _, part := range word.Parts {
+		switch p := part.(type) {
+		case *syntax.Lit:
+			if strings.ContainsAny(p.Value, "*?[{~") {
+				return
+			}
+			value.WriteString(unescape(p.Value, ""))
+		case *syntax.SglQuoted:
+			if p.Dollar {
+				return
+			}
+			value.WriteString(p.Value)
+		case *syntax.DblQuoted:
+			if p.Dollar {
+				return
+			}
+			for _, inner := range p.Parts {
+				lit, ok := inner.(*syntax.Lit)
+				if !ok {
+					return
+				}
+				value.WriteString(unescape(lit.Value, "$`\"\\\n"))
+			}
+		default:
+			return
+		}
+	}
+	quoted, err := syntax.Quote(value.String(), syntax.LangBash)
+	if err != nil {
+		return
+	}
+	word.Parts = []syntax.WordPart{&syntax.Lit{Value: quoted}}
+}
+
+// unescape removes backslash escapes from s. If only is non-empty, just
+// the characters in it are unescaped, as inside double quotes.
+func unescape(s, only string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (only == "" || strings.IndexByte(only, s[i+1]) >= 0) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,375 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// candidateBlock represents a parsed <candidate> tag from model output.
+type candidateBlock struct {
+	typ     string // "replace", "append", or "suffix"
+	content string // inner content between tags
+}
+
+// commandTag represents a parsed <command> tag from model output.
+type commandTag struct {
+	text   string
+	cursor int  // byte offset for cursor, or -1 if not set
+	spaced bool // raw text began with a space or tab, which a suffix keeps
+}
+
+var (
+	reCandidate = regexp.MustCompile(`(?s)<candidate[^>]*\btype="(replace|append|suffix)"[^>]*>(.*?)</candidate>`)
+	reCommand   = regexp.MustCompile(`(?s)<command\s*>(.*?)</command>`)
+)
+
+// nextCandidateBlock finds the first complete <candidate> block in s and
+// returns it with the offset just past its closing tag.
+func nextCandidateBlock(s string) (block candidateBlock, end int, ok bool) {
+	m := reCandidate.FindStringSubmatchIndex(s)
+	if m == nil {
+		return candidateBlock{}, 0, false
+	}
+	return candidateBlock{typ: s[m[2]:m[3]], content: s[m[4]:m[5]]}, m[1], true
+}
+
+// parseCandidateBlocks extracts <candidate> blocks from model output.
+func parseCandidateBlocks(output string) []candidateBlock {
+	var blocks []candidateBlock
+	for {
+		block, end, ok := nextCandidateBlock(output)
+		if !ok {
+			return blocks
+		}
+		blocks = append(blocks, block)
+		output = output[end:]
+	}
+}
+
+// parseCommands extracts <command> tags from a candidate block's inner content.
+// Cursor position is determined by the █ sentinel character in the command text.
+func parseCommands(content string) []commandTag {
+	matches := reCommand.FindAllStringSubmatch(content, -1)
+	cmds := make([]commandTag, 0, len(matches))
+	for _, m := range matches {
+		if cmd, ok := newCommandTag(m[1]); ok {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+// newCommandTag cleans up raw command text, taking the cursor position
+// from the █ sentinel. ok is false when the command is empty.
+func newCommandTag(raw string) (cmd commandTag, ok bool) {
+	spaced := strings.HasPrefix(raw, " ") || strings.HasPrefix(raw, "\t")
+	text := normalizeCommand(raw)
+	cursor := strings.Index(text, "█")
+	if cursor >= 0 {
+		text = text[:cursor] + text[cursor+len("█"):]
+		// Spaces on both sides of the sentinel collapse into one.
+		if cursor > 0 && cursor < len(text) && text[cursor-1] == ' ' && text[cursor] == ' ' {
+			text = text[:cursor] + text[cursor+1:]
+		}
+		trimmed := strings.TrimLeft(text, " \t\n")
+		cursor = max(cursor-(len(text)-len(trimmed)), 0)
+		text = strings.TrimRight(trimmed, " \t\n")
+		cursor = min(cursor, len(text))
+	}
+	return commandTag{text: text, cursor: cursor, spaced: spaced}, text != ""
+}
+
+// normalizeCommand trims the text of a command and collapses runs of
+// spaces on its first line. Further lines (a loop body, heredoc, or
+// backslash continuation) keep their indentation and spacing, losing only
+// trailing whitespace and carriage returns.
+func normalizeCommand(raw string) string {
+	raw = strings.TrimLeft(raw, " \t\r\n")
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	lines[0] = collapseSpaces(lines[0])
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+// chainJoiner returns the text placed between chained commands under a
+// chain separator policy: "&&" (default), ";", or "newline".
+func chainJoiner(policy string) string {
+	switch policy {
+	case ";":
+		return "; "
+	case "newline":
+		return "\n"
+	default:
+		return " && "
+	}
+}
+
+// chainSeparator returns the string to insert between existing input and
+// appended commands. If the input already ends with a control or
+// redirection operator (&&, ||, |, |&, ;, &, >, >>, <, ...), an opening
+// parenthesis, a newline, or a keyword that starts a body (do, then, else,
+// {, ...), only a space is added if needed. Otherwise the policy's joiner.
+func chainSeparator(input, policy string) string {
+	trimmed := strings.TrimRight(input, " \t")
+	if trimmed == "" || strings.HasSuffix(trimmed, "\n") {
+		return ""
+	}
+	fields := strings.Fields(trimmed)
+	switch last := fields[len(fields)-1]; {
+	case strings.ContainsRune("&|;<>(", rune(last[len(last)-1])), bodyKeywords[last]:
+		if len(trimmed) < len(input) {
+			return ""
+		}
+		return " "
+	}
+	return chainJoiner(policy)
+}
+
+// ParseCandidates parses complete model output into at most max candidates.
+// sep is the chain separator policy ("&&", ";", or "newline"; empty means
+// "&&") used to join commands.
+func ParseCandidates(output string, input string, max int, sep string) []ashlet.Candidate {
+	p := NewCandidateParser(input, max, sep)
+	p.Write(output)
+	return p.Finish()
+}
+
+// CandidateParser incrementally parses streamed model output. Each
+// <candidate> block becomes a candidate as soon as its closing tag arrives;
+// Finish falls back to line-based parsing when the output had no blocks.
+type CandidateParser struct {
+	input string
+	max   int
+	sep   string // chain separator policy
+
+	pending    string          // unconsumed output, starting at a possible <candidate tag
+	output     strings.Builder // full output, for the fallback
+	sawBlock   bool
+	candidates []ashlet.Candidate
+	seen       map[string]bool // NormalizeCommand keys of candidates so far
+}
+
+// NewCandidateParser creates a parser for output completing input; max and
+// sep are as for ParseCandidates.
+func NewCandidateParser(input string, max int, sep string) *CandidateParser {
+	return &CandidateParser{input: input, max: max, sep: sep, seen: make(map[string]bool)}
+}
+
+// Write consumes the next chunk of model output and returns the candidates
+// completed by it, if any.
+func (p *CandidateParser) Write(chunk string) []ashlet.Candidate {
+	p.output.WriteString(chunk)
+	p.pending += chunk
+
+	first := len(p.candidates)
+	for {
+		block, end, ok := nextCandidateBlock(p.pending)
+		if !ok {
+			break
+		}
+		p.sawBlock = true
+		p.addBlock(block)
+		p.pending = p.pending[end:]
+	}
+
+	// Drop text that cannot be part of a later block: keep from the first
+	// opening tag, or from a trailing "<" that may begin one.
+	if i := strings.Index(p.pending, "<candidate"); i >= 0 {
+		p.pending = p.pending[i:]
+	} else if i := strings.LastIndexByte(p.pending, '<'); i >= 0 {
+		p.pending = p.pending[i:]
+	} else {
+		p.pending = ""
+	}
+
+	return p.candidates[first:]
+}
+
+// Finish returns every candidate parsed from the output.
+func (p *CandidateParser) Finish() []ashlet.Candidate {
+	if !p.sawBlock {
+		return parseCandidatesFallback(p.output.String(), p.input, p.max)
+	}
+	return p.candidates
+}
+
+// Candidates returns the candidates completed so far, without the fallback
+// Finish applies to output that had no blocks.
+func (p *CandidateParser) Candidates() []ashlet.Candidate {
+	return p.candidates
+}
+
+// addBlock converts a candidate block into a candidate, skipping empty
+// blocks and duplicates.
+func (p *CandidateParser) addBlock(block candidateBlock) {
+	p.addCommands(block.typ, parseCommands(block.content))
+}
+
+// addCommands adds a candidate of type typ ("replace", "append", or
+// "suffix") built from commands, skipping empty candidates and duplicates.
+// A suffix is added to the input as-is: it continues the last word unless
+// it starts with a space, and later commands are chained after it.
+func (p *CandidateParser) addCommands(typ string, commands []commandTag) {
+	if len(p.candidates) >= p.max || len(commands) == 0 {
+		return
+	}
+
+	// Join multiple commands per the separator policy
+	parts := make([]string, len(commands))
+	for i, cmd := range commands {
+		parts[i] = cmd.text
+	}
+	joined := strings.Join(parts, chainJoiner(p.sep))
+
+	var completion string
+	var cursorOffset int
+	switch typ {
+	case "append":
+		sep := chainSeparator(p.input, p.sep)
+		completion = p.input + sep + joined
+		cursorOffset = len(p.input) + len(sep)
+	case "suffix":
+		sep := ""
+		if commands[0].spaced && p.input != "" && !strings.HasSuffix(p.input, " ") {
+			sep = " "
+		}
+		completion = p.input + sep + joined
+		cursorOffset = len(p.input) + len(sep)
+	default: // "replace"
+		completion = joined
+	}
+
+	completion = strings.TrimSpace(completion)
+	key := NormalizeCommand(completion)
+	if completion == "" || p.seen[key] {
+		return
+	}
+	p.seen[key] = true
+
+	// Use cursor from the first <command> that specifies one
+	var cursorPos *int
+	for _, cmd := range commands {
+		if cmd.cursor >= 0 {
+			pos := cmd.cursor + cursorOffset
+			cursorPos = &pos
+			break
+		}
+	}
+
+	// Position-based confidence
+	confidence := 0.95 - float64(len(p.candidates))*0.15
+	if confidence < 0.1 {
+		confidence = 0.1
+	}
+
+	p.candidates = append(p.candidates, ashlet.Candidate{
+		Completion: completion,
+		Confidence: confidence,
+		CursorPos:  cursorPos,
+	})
+}
+
+// ParseInfill turns the output of a fill-in-the-middle model, the text to
+// insert at cursor in input, into a candidate. Only the first line of
+// output is used; the cursor is placed after the insertion when text
+// follows it. It returns nil when nothing would be inserted.
+func ParseInfill(output, input string, cursor int) []ashlet.Candidate {
+	middle, _, _ := strings.Cut(output, "\n")
+	middle = strings.TrimRight(middle, " \t\r")
+	if strings.TrimSpace(middle) == "" {
+		return nil
+	}
+	before, after := input[:cursor], input[cursor:]
+	c := ashlet.Candidate{Completion: before + middle + after, Confidence: 0.95}
+	if after != "" {
+		pos := len(before) + len(middle)
+		c.CursorPos = &pos
+	}
+	return []ashlet.Candidate{c}
+}
+
+// parseCandidatesFallback handles model output without <autocomplete> tags.
+// Accepts unmarked lines that share the first word with the input.
+func parseCandidatesFallback(output string, input string, max int) []ashlet.Candidate {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	trimmedInput := strings.TrimSpace(input)
+	var candidates []ashlet.Candidate
+	seen := make(map[string]bool)
+
+	for _, rawLine := range lines {
+		if len(candidates) >= max {
+			break
+		}
+		line := strings.TrimSpace(rawLine)
+		if line == "" || strings.HasPrefix(line, "$ ") || strings.HasPrefix(line, "<") {
+			continue
+		}
+
+		candidate := strings.Trim(line, "`")
+		candidate = strings.TrimSpace(candidate)
+
+		var command string
+		if trimmedInput == "" {
+			command = candidate
+		} else if firstWord(candidate) == firstWord(trimmedInput) {
+			command = candidate
+		} else {
+			continue
+		}
+
+		command = collapseSpaces(strings.TrimSpace(command))
+
+		key := NormalizeCommand(command)
+		if command == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		candidates = append(candidates, ashlet.Candidate{
+			Completion: command,
+			Confidence: -1,
+		})
+	}
+
+	// Position-based confidence
+	for i := range candidates {
+		candidates[i].Confidence = 0.95 - float64(i)*0.15
+		if candidates[i].Confidence < 0.1 {
+			candidates[i].Confidence = 0.1
+		}
+	}
+
+	return candidates
+}
+
+// collapseSpaces replaces runs of multiple spaces with a single space.
+func collapseSpaces(s string) string {
+	var buf strings.Builder
+	buf.Grow(len(s))
+	prevSpace := false
+	for _, r := range s {
+		if r == ' ' {
+			if !prevSpace {
+				buf.WriteByte(' ')
+			}
+			prevSpace = true
+		} else {
+			buf.WriteRune(r)
+			prevSpace = false
+		}
+	}
+	return buf.String()
+}
+
+// firstWord returns the first whitespace-delimited word of s.
+func firstWord(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, ' '); i > 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,538 @@
+package core
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestParseCandidatesXMLReplace(t *testing.T) {
+	output := `<candidate type="replace">
+<command>git checkout</command>
+</candidate>
+<candidate type="replace">
+<command>git cherry-pick</command>
+</candidate>`
+	candidates := ParseCandidates(output, "git ch", 4, "")
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %d", len(candidates))
+	}
+	if candidates[0].Completion != "git checkout" {
+		t.Errorf("expected %q, got %q", "git checkout", candidates[0].Completion)
+	}
+	if candidates[1].Completion != "git cherry-pick" {
+		t.Errorf("expected %q, got %q", "git cherry-pick", candidates[1].Completion)
+	}
+}
+
+func TestParseCandidatesXMLReplaceWithCursor(t *testing.T) {
+	output := `<candidate type="replace">
+<command>git commit -m "█"</command>
+</candidate>`
+	candidates := ParseCandidates(output, "git com", 4, "")
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	c := candidates[0]
+	if c.Completion != `git commit -m ""` {
+		t.Errorf("expected %q, got %q", `git commit -m ""`, c.Completion)
+	}
+	if c.CursorPos == nil {
+		t.Fatal("expected CursorPos to be set")
+	}
+	if *c.CursorPos != 15 {
+		t.Errorf("expected CursorPos=15, got %d", *c.CursorPos)
+	}
+}
+
+func TestParseCandidatesXMLNoCursor(t *testing.T) {
+	output := `<candidate type="replace">
+<command>git status</command>
+</candidate>`
+	candidates := ParseCandidates(output, "git s", 4, "")
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	if candidates[0].CursorPos != nil {
+		t.Errorf("expected CursorPos=nil, got %d", *candidates[0].CursorPos)
+	}
+}
+
+func TestParseCandidatesXMLAppend(t *testing.T) {
+	output := `<candidate type="append">
+<command>git push</command>
+</candidate>
+<candidate type="append">
+<command>npm run build</command>
+</candidate>`
+	input := `git commit -m "initial" && `
+	candidates := ParseCandidates(output, input, 4, "")
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %d", len(candidates))
+	}
+	if candidates[0].Completion != `git commit -m "initial" && git push` {
+		t.Errorf("expected %q, got %q", `git commit -m "initial" && git push`, candidates[0].Completion)
+	}
+	if candidates[1].Completion != `git commit -m "initial" && npm run build` {
+		t.Errorf("expected %q, got %q", `git commit -m "initial" && npm run build`, candidates[1].Completion)
+	}
+}
+
+func TestParseCandidatesXMLAppendAutoSeparator(t *testing.T) {
+	// Input doesn't end with && — separator is added automatically
+	output := `<candidate type="append">
+<command>git push</command>
+</candidate>`
+	input := `git commit -m "done"`
+	candidates := ParseCandidates(output, input, 4, "")
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	if candidates[0].Completion != `git commit -m "done" && git push` {
+		t.Errorf("expected %q, got %q", `git commit -m "done" && git push`, candidates[0].Completion)
+	}
+}
+
+func TestParseCandidatesXMLAppendCursorOffset(t *testing.T) {
+	// cursor in append mode is relative to appended part start
+	output := `<candidate type="append">
+<command>git commit -m "█"</command>
+</candidate>`
+	input := "make build && "
+	candidates := ParseCandidates(output, input, 4, "")
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	c := candidates[0]
+	if c.Completion != `make build && git commit -m ""` {
+		t.Errorf("expected %q, got %q", `make build && git commit -m ""`, c.Completion)
+	}
+	if c.CursorPos == nil {
+		t.Fatal("expected CursorPos to be set")
+	}
+	// "make build && " is 14 chars, separator is "" (input ends with space after &&)
+	// cursor 15 + offset 14 = 29
+	if *c.CursorPos != 29 {
+		t.Errorf("expected CursorPos=29, got %d", *c.CursorPos)
+	}
+}
+
+func TestParseCandidatesXMLSuffix(t *testing.T) {
+	output := `<candidate type="suffix"><command>mit -m "█"</command></candidate>
+<candidate type="suffix"><command> --amend</command></candidate>
+<candidate type="suffix"><command>mit</command><command>git push</command></candidate>`
+	candidates := ParseCandidates(output, "git com", 4, "")
+	want := []string{`git commit -m ""`, "git com --amend", "git commit && git push"}
+	if len(candidates) != len(want) {
+		t.Fatalf("expected %d candidates, got %d: %+v", len(want), len(candidates), candidates)
+	}
+	for i, w := range want {
+		if candidates[i].Completion != w {
+			t.Errorf("candidate[%d] = %q, want %q", i, candidates[i].Completion, w)
+		}
+	}
+	// "git com" is 7 bytes; the cursor sits 8 bytes into the suffix.
+	if c := candidates[0].CursorPos; c == nil || *c != 15 {
+		t.Errorf("candidate[0] cursor = %v, want 15", c)
+	}
+}
+
+func TestParseCandidatesXMLSuffixAfterSpace(t *testing.T) {
+	output := `<candidate type="suffix"><command> status</command></candidate>`
+	candidates := ParseCandidates(output, "git ", 4, "")
+	if len(candidates) != 1 || candidates[0].Completion != "git status" {
+		t.Errorf("got %+v, want a single space between words", candidates)
+	}
+}
+
+func TestNewCommandTagCursorAfterLeadingSpace(t *testing.T) {
+	cmd, ok := newCommandTag(`  echo "█"`)
+	if !ok || cmd.text != `echo ""` || cmd.cursor != 6 || !cmd.spaced {
+		t.Errorf("newCommandTag = %+v, %v; want cursor 6 in trimmed text", cmd, ok)
+	}
+}
+
+func TestParseCandidatesXMLMultiLine(t *testing.T) {
+	output := `<candidate type="replace"><command>cat <<EOF > notes.txt
+hello   world
+EOF</command></candidate>
+<candidate type="replace"><command>docker  run \` + "\r" + `
+  --rm █ \
+  alpine   </command></candidate>`
+	candidates := ParseCandidates(output, "", 4, "")
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %+v", candidates)
+	}
+	if want := "cat <<EOF > notes.txt\nhello   world\nEOF"; candidates[0].Completion != want {
+		t.Errorf("heredoc = %q, want %q", candidates[0].Completion, want)
+	}
+	want := "docker run \\\n  --rm \\\n  alpine"
+	if candidates[1].Completion != want {
+		t.Errorf("continuation = %q, want %q", candidates[1].Completion, want)
+	}
+	if c := candidates[1].CursorPos; c == nil || *c != len("docker run \\\n  --rm ") {
+		t.Errorf("cursor = %v, want after --rm", c)
+	}
+}
+
+func TestParseCandidatesXMLMultiCommand(t *testing.T) {
+	// Multiple commands in one candidate are joined with " && "
+	output := `<candidate type="replace">
+<command>git commit -m "█"</command>
+<command>git push</command>
+</candidate>`
+	candidates := ParseCandidates(output, "git com", 4, "")
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	c := candidates[0]
+	if c.Completion != `git commit -m "" && git push` {
+		t.Errorf("expected %q, got %q", `git commit -m "" && git push`, c.Completion)
+	}
+	if c.CursorPos == nil {
+		t.Fatal("expected CursorPos to be set")
+	}
+	if *c.CursorPos != 15 {
+		t.Errorf("expected CursorPos=15, got %d", *c.CursorPos)
+	}
+}
+
+func TestParseCandidatesXMLDeduplicates(t *testing.T) {
+	output := `<candidate type="replace">
+<command>git status</command>
+</candidate>
+<candidate type="replace">
+<command>git status</command>
+</candidate>
+<candidate type="replace">
+<command>git stash</command>
+</candidate>`
+	candidates := ParseCandidates(output, "git s", 4, "")
+	if len(candidates) != 2 {
+		t.Errorf("expected 2 unique candidates, got %d", len(candidates))
+	}
+}
+
+func TestParseCandidatesXMLDeduplicatesEquivalent(t *testing.T) {
+	output := `<candidate type="replace"><command>git commit -m ""</command></candidate>
+<candidate type="replace"><command>git commit --message ''</command></candidate>
+<candidate type="replace"><command>git commit -am ""</command></candidate>`
+	candidates := ParseCandidates(output, "git commit", 4, "")
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %+v", candidates)
+	}
+	if candidates[0].Completion != `git commit -m ""` {
+		t.Errorf("the first spelling should be kept, got %q", candidates[0].Completion)
+	}
+}
+
+func TestParseCandidatesXMLRespectsMax(t *testing.T) {
+	output := `<candidate type="replace"><command>one</command></candidate>
+<candidate type="replace"><command>two</command></candidate>
+<candidate type="replace"><command>three</command></candidate>`
+	candidates := ParseCandidates(output, "", 2, "")
+	if len(candidates) != 2 {
+		t.Errorf("expected 2 candidates with max=2, got %d", len(candidates))
+	}
+}
+
+func TestParseCandidatesXMLEmptyCommand(t *testing.T) {
+	// Empty command tag should be skipped
+	output := `<candidate type="replace">
+<command></command>
+</candidate>`
+	candidates := ParseCandidates(output, "", 4, "")
+	if len(candidates) != 0 {
+		t.Errorf("expected 0 candidates for empty command, got %d", len(candidates))
+	}
+}
+
+func TestParseCandidatesConfidence(t *testing.T) {
+	output := `<candidate type="replace"><command>one</command></candidate>
+<candidate type="replace"><command>two</command></candidate>
+<candidate type="replace"><command>three</command></candidate>
+<candidate type="replace"><command>four</command></candidate>`
+	candidates := ParseCandidates(output, "", 4, "")
+	if len(candidates) != 4 {
+		t.Fatalf("expected 4 candidates, got %d", len(candidates))
+	}
+	expectedConf := []float64{0.95, 0.80, 0.65, 0.50}
+	for i, exp := range expectedConf {
+		if math.Abs(candidates[i].Confidence-exp) > 1e-9 {
+			t.Errorf("candidate[%d] confidence: expected %.2f, got %.2f", i, exp, candidates[i].Confidence)
+		}
+	}
+}
+
+func TestParseCandidatesEmptyOutput(t *testing.T) {
+	candidates := ParseCandidates("", "", 4, "")
+	if candidates != nil {
+		t.Errorf("expected nil for empty output, got %v", candidates)
+	}
+}
+
+func TestParseCandidatesXMLPipeReplace(t *testing.T) {
+	output := `<candidate type="replace">
+<command>cat foo.log | grep -i error</command>
+</candidate>
+<candidate type="replace">
+<command>cat foo.log | grep warning</command>
+</candidate>`
+	candidates := ParseCandidates(output, "cat foo.log | grep", 4, "")
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %d", len(candidates))
+	}
+	if candidates[0].Completion != "cat foo.log | grep -i error" {
+		t.Errorf("expected %q, got %q", "cat foo.log | grep -i error", candidates[0].Completion)
+	}
+	if candidates[1].Completion != "cat foo.log | grep warning" {
+		t.Errorf("expected %q, got %q", "cat foo.log | grep warning", candidates[1].Completion)
+	}
+}
+
+func TestChainSeparator(t *testing.T) {
+	tests := []struct {
+		input  string
+		policy string
+		want   string
+	}{
+		{`git commit -m "done" && `, "", ""}, // already has && with trailing space
+		{`git commit -m "done" &&`, "", " "}, // has && but no space
+		{`echo hello |`, "", " "},            // pipe, no space
+		{`echo hello | `, "", ""},            // pipe with space
+		{`echo hello ;`, "", " "},            // semicolon, no space
+		{`git commit -m "done"`, "", " && "}, // no operator
+		{`git status`, "", " && "},           // plain command
+		{`make |&`, "", " "},                 // pipe with stderr
+		{`sleep 10 &`, "", " "},              // background job
+		{`sleep 10 & `, "", ""},              // background job with space
+		{`make >`, "", " "},                  // redirection awaiting a target
+		{`make 2>>`, "", " "},                // append redirection
+		{`sort <`, "", " "},                  // input redirection
+		{`make 2>&1`, "", " && "},            // complete redirection
+		{`make > build.log`, ";", "; "},      // semicolon policy
+		{`git pull`, "newline", "\n"},        // newline policy
+		{`git pull &&`, ";", " "},            // existing operator wins over policy
+		{"git pull\n", "", ""},               // already on a new line
+		{`for f in *.go; do`, "", " "},       // loop body
+		{`if make; then `, "", ""},           // if body with space
+		{`deploy() {`, "", " "},              // function body
+		{`echo $(`, "", " "},                 // command substitution
+		{"", "", ""},                         // nothing to chain onto
+	}
+	for _, tt := range tests {
+		got := chainSeparator(tt.input, tt.policy)
+		if got != tt.want {
+			t.Errorf("chainSeparator(%q, %q) = %q, want %q", tt.input, tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestParseCandidatesSeparatorPolicy(t *testing.T) {
+	output := `<candidate type="replace"><command>git add .</command><command>git commit</command></candidate>
+<candidate type="append"><command>git push</command></candidate>`
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{"", []string{"git add . && git commit", "git pull && git push"}},
+		{";", []string{"git add .; git commit", "git pull; git push"}},
+		{"newline", []string{"git add .\ngit commit", "git pull\ngit push"}},
+	}
+	for _, tt := range tests {
+		candidates := ParseCandidates(output, "git pull", 4, tt.policy)
+		if len(candidates) != len(tt.want) {
+			t.Fatalf("policy %q: expected %d candidates, got %d", tt.policy, len(tt.want), len(candidates))
+		}
+		for i, want := range tt.want {
+			if candidates[i].Completion != want {
+				t.Errorf("policy %q: candidate %d = %q, want %q", tt.policy, i, candidates[i].Completion, want)
+			}
+		}
+	}
+}
+
+func TestParseCandidatesFallbackFirstWordMatch(t *testing.T) {
+	output := "git checkout\ngit cherry-pick"
+	candidates := ParseCandidates(output, "git ch", 4, "")
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %d", len(candidates))
+	}
+	if candidates[0].Completion != "git checkout" {
+		t.Errorf("expected %q, got %q", "git checkout", candidates[0].Completion)
+	}
+	if candidates[1].Completion != "git cherry-pick" {
+		t.Errorf("expected %q, got %q", "git cherry-pick", candidates[1].Completion)
+	}
+}
+
+func TestParseCandidatesFallbackRejectsUnrelatedLine(t *testing.T) {
+	output := "brew install"
+	candidates := ParseCandidates(output, "git co", 4, "")
+	if len(candidates) != 0 {
+		t.Errorf("expected 0 candidates (different first word), got %d: %v", len(candidates), candidates)
+	}
+}
+
+func TestParseCandidatesFallbackRejectsSuffixOnly(t *testing.T) {
+	output := "--amend"
+	candidates := ParseCandidates(output, "git c", 4, "")
+	if len(candidates) != 0 {
+		t.Errorf("expected 0 candidates (suffix without XML), got %d: %v", len(candidates), candidates)
+	}
+}
+
+func TestParseCandidatesFallbackStripsBackticks(t *testing.T) {
+	output := "`git status`\n`git stash`"
+	candidates := ParseCandidates(output, "git ", 4, "")
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %d", len(candidates))
+	}
+	if candidates[0].Completion != "git status" {
+		t.Errorf("expected 'git status', got %q", candidates[0].Completion)
+	}
+}
+
+func TestParseCandidatesFallbackSkipsXMLLines(t *testing.T) {
+	// Partial/broken XML should be skipped in fallback
+	output := "<autocomplete\ngit checkout"
+	candidates := ParseCandidates(output, "git ch", 4, "")
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	if candidates[0].Completion != "git checkout" {
+		t.Errorf("expected %q, got %q", "git checkout", candidates[0].Completion)
+	}
+}
+
+func TestParseCandidatesFallbackSkipsPromptDelimiter(t *testing.T) {
+	output := "$ brew install\nbrew install vim"
+	candidates := ParseCandidates(output, "brew ", 4, "")
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate (skipping $ line), got %d", len(candidates))
+	}
+	if candidates[0].Completion != "brew install vim" {
+		t.Errorf("expected %q, got %q", "brew install vim", candidates[0].Completion)
+	}
+}
+
+func TestParseCandidateBlocks(t *testing.T) {
+	output := `<candidate type="replace">
+<command>git checkout</command>
+</candidate>
+<candidate type="append">
+<command>git push</command>
+</candidate>`
+	blocks := parseCandidateBlocks(output)
+	if len(blocks) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", len(blocks))
+	}
+	if blocks[0].typ != "replace" {
+		t.Errorf("block[0] type: expected %q, got %q", "replace", blocks[0].typ)
+	}
+	if blocks[1].typ != "append" {
+		t.Errorf("block[1] type: expected %q, got %q", "append", blocks[1].typ)
+	}
+}
+
+func TestParseCommands(t *testing.T) {
+	content := `<command>git commit -m "█"</command>
+<command>git push</command>`
+	cmds := parseCommands(content)
+	if len(cmds) != 2 {
+		t.Fatalf("expected 2 commands, got %d", len(cmds))
+	}
+	if cmds[0].text != `git commit -m ""` || cmds[0].cursor != 15 {
+		t.Errorf("cmd[0]: expected text=%q cursor=15, got text=%q cursor=%d", `git commit -m ""`, cmds[0].text, cmds[0].cursor)
+	}
+	if cmds[1].text != "git push" || cmds[1].cursor != -1 {
+		t.Errorf("cmd[1]: expected text=%q cursor=-1, got text=%q cursor=%d", "git push", cmds[1].text, cmds[1].cursor)
+	}
+}
+
+func TestParseCommandsNoCursor(t *testing.T) {
+	content := `<command>git commit -m ""</command>`
+	cmds := parseCommands(content)
+	if len(cmds) != 1 {
+		t.Fatalf("expected 1 command, got %d", len(cmds))
+	}
+	// No █ sentinel = no cursor
+	if cmds[0].cursor != -1 {
+		t.Errorf("expected cursor=-1 for no sentinel, got %d", cmds[0].cursor)
+	}
+}
+
+func TestCandidateParserStreaming(t *testing.T) {
+	output := `Sure:
+<candidate type="replace">
+<command>git checkout main</command>
+</candidate>
+<candidate type="append">
+<command>git push</command>
+</candidate>`
+
+	// Feed the output a few bytes at a time; each candidate must be emitted
+	// by the chunk containing the end of its closing tag.
+	p := NewCandidateParser("git ch", 4, "")
+	var streamed []ashlet.Candidate
+	firstAt := -1
+	for i := 0; i < len(output); i += 3 {
+		chunk := output[i:min(i+3, len(output))]
+		got := p.Write(chunk)
+		if len(got) > 0 && firstAt < 0 {
+			firstAt = i + len(chunk)
+		}
+		streamed = append(streamed, got...)
+	}
+	if firstEnd := strings.Index(output, "</candidate>") + len("</candidate>"); firstAt < firstEnd || firstAt >= firstEnd+3 {
+		t.Errorf("first candidate emitted after %d bytes, closing tag ends at %d", firstAt, firstEnd)
+	}
+
+	want := ParseCandidates(output, "git ch", 4, "")
+	final := p.Finish()
+	if len(streamed) != 2 || len(final) != 2 || len(want) != 2 {
+		t.Fatalf("expected 2 candidates, got streamed=%d final=%d whole=%d", len(streamed), len(final), len(want))
+	}
+	for i := range want {
+		if streamed[i].Completion != want[i].Completion || final[i].Completion != want[i].Completion {
+			t.Errorf("candidate %d: streamed %q, final %q, whole %q", i, streamed[i].Completion, final[i].Completion, want[i].Completion)
+		}
+		if streamed[i].Confidence != want[i].Confidence {
+			t.Errorf("candidate %d confidence: streamed %v, whole %v", i, streamed[i].Confidence, want[i].Confidence)
+		}
+	}
+}
+
+func TestCandidateParserFallbackOnFinish(t *testing.T) {
+	p := NewCandidateParser("git s", 4, "")
+	for _, chunk := range []string{"git st", "atus\ngit sta", "sh\n"} {
+		if got := p.Write(chunk); len(got) != 0 {
+			t.Fatalf("untagged output should not stream candidates, got %v", got)
+		}
+	}
+	final := p.Finish()
+	if len(final) != 2 || final[0].Completion != "git status" || final[1].Completion != "git stash" {
+		t.Errorf("unexpected fallback candidates: %+v", final)
+	}
+}
+
+func TestParseInfill(t *testing.T) {
+	got := ParseInfill("checkout\n# trailing text\n", "git  main", 4)
+	if len(got) != 1 || got[0].Completion != "git checkout main" {
+		t.Fatalf("ParseInfill() = %+v, want one candidate %q", got, "git checkout main")
+	}
+	if got[0].CursorPos == nil || *got[0].CursorPos != 12 {
+		t.Errorf("CursorPos = %v, want 12", got[0].CursorPos)
+	}
+
+	got = ParseInfill("status  ", "git ", 4)
+	if len(got) != 1 || got[0].Completion != "git status" || got[0].CursorPos != nil {
+		t.Errorf("ParseInfill() at end = %+v, want %q without cursor", got, "git status")
+	}
+
+	if got := ParseInfill("\n", "git ", 4); got != nil {
+		t.Errorf("ParseInfill() of blank output = %+v, want nil", got)
+	}
+}
@@ -0,0 +1,376 @@
+package core
+
+import (
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// PromptData holds the data passed to the prompt template.
+type PromptData struct {
+	MaxCandidates    int
+	JSONOutput       bool
+	ToolOutput       bool   // JSON is submitted as SubmitToolName arguments
+	ChainSeparator   string // "&&", ";", or "newline"; empty means "&&"
+	Shell            string // shell dialect (see ShellName); empty means zsh
+	CWD              string
+	RecentCommands   []string
+	RelevantCommands []string
+	InputBefore      string
+	InputAfter       string
+	Input            string
+	DirListing       string
+	DirManifests     map[string]string
+	GitRootListing   string
+	GitStagedFiles   string
+	GitManifests     map[string]string
+	PackageManager   string
+
+	// The fields below are filled in (see WithContext) only when context is
+	// sent in the system prompt rather than the user message.
+
+	// Context is the context sections as the user message would carry
+	// them, trimmed to the token budget.
+	Context        string
+	NixShell       string
+	Nix            string
+	Terraform      string
+	Languages      string
+	ProjectSummary string
+	LastFailure    string
+	Session        string
+	AcceptedHere   []string
+	RecentHere     []string
+	Aliases        []string
+	FlagsCommand   string
+	Flags          []string
+	DocsCommand    string
+	Docs           string
+	Date           string
+	Preceding      string
+}
+
+// WithContext returns d with the context fields filled in from uc, for
+// templates that place the context in the system prompt themselves.
+func (d PromptData) WithContext(uc UserContext) PromptData {
+	d.Context = strings.TrimSpace(renderSections(uc))
+	d.CWD = uc.Cwd
+	d.NixShell = uc.NixShell
+	d.RecentCommands = uc.Recent
+	d.RelevantCommands = uc.Related
+	d.Input = uc.Input
+	d.InputBefore = uc.Input[:uc.CursorPos]
+	d.InputAfter = uc.Input[uc.CursorPos:]
+	if dir := uc.Dir; dir != nil {
+		d.DirListing = dir.CwdListing
+		d.DirManifests = dir.CwdManifests
+		d.GitRootListing = dir.GitRootListing
+		d.GitStagedFiles = dir.GitStagedFiles
+		d.GitManifests = dir.GitManifests
+		d.PackageManager = dir.PackageManager
+		d.Nix = dir.Nix
+		d.Terraform = dir.Terraform
+		d.Languages = dir.Languages
+	}
+	d.ProjectSummary = uc.ProjectSummary
+	d.LastFailure = uc.LastFailure
+	d.Session = uc.Session
+	d.AcceptedHere = uc.AcceptedHere
+	d.RecentHere = uc.RecentHere
+	d.Aliases = uc.Aliases
+	d.FlagsCommand, d.Flags = uc.FlagsCommand, uc.Flags
+	d.DocsCommand, d.Docs = uc.DocsCommand, uc.Docs
+	d.Date = uc.Date
+	d.Preceding = uc.Preceding
+	return d
+}
+
+var promptFuncs = template.FuncMap{
+	"bullet": func(items []string) string {
+		if len(items) == 0 {
+			return ""
+		}
+		var sb strings.Builder
+		for _, item := range items {
+			sb.WriteString("- ")
+			sb.WriteString(item)
+			sb.WriteString("\n")
+		}
+		return strings.TrimSuffix(sb.String(), "\n")
+	},
+	"join": func(items []string, sep string) string {
+		return strings.Join(items, sep)
+	},
+	"truncate": func(n int, s string) string {
+		if n < 0 || len(s) <= n {
+			return s
+		}
+		return s[:n] + "..."
+	},
+	"codeblock": func(s string) string {
+		if s == "" {
+			return ""
+		}
+		fence := "```"
+		for strings.Contains(s, fence) {
+			fence += "`"
+		}
+		return fence + "\n" + strings.TrimRight(s, "\n") + "\n" + fence
+	},
+	"ifNonEmpty": func(prefix string, v any) string {
+		switch v := v.(type) {
+		case string:
+			if v != "" {
+				return prefix + v
+			}
+		case []string:
+			if len(v) > 0 {
+				return prefix + strings.Join(v, ", ")
+			}
+		case map[string]string:
+			if len(v) > 0 {
+				return prefix + formatMap(v)
+			}
+		}
+		return ""
+	},
+	"limit": func(n int, items []string) []string {
+		if n >= 0 && len(items) > n {
+			return items[:n]
+		}
+		return items
+	},
+	"jsonEscape": func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b[1 : len(b)-1])
+	},
+	"basename": func(path string) string {
+		if path == "" {
+			return ""
+		}
+		return filepath.Base(path)
+	},
+}
+
+// formatMap renders a map as "key: value" lines sorted by key, as
+// ifNonEmpty shows manifests.
+func formatMap(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var sb strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(k)
+		sb.WriteString(": ")
+		sb.WriteString(m[k])
+	}
+	return sb.String()
+}
+
+// RenderPrompt executes the custom template tmplSrc with data, falling back to
+// the built-in template when tmplSrc is empty or fails to parse or execute.
+func RenderPrompt(tmplSrc, builtin string, data PromptData) string {
+	if tmplSrc == "" {
+		tmplSrc = builtin
+	}
+
+	t, err := template.New("prompt").Funcs(promptFuncs).Parse(tmplSrc)
+	if err != nil {
+		slog.Warn("failed to parse prompt template, falling back to default", "error", err)
+		t, _ = template.New("prompt").Funcs(promptFuncs).Parse(builtin)
+	}
+
+	var buf strings.Builder
+	if err := t.Execute(&buf, data); err != nil {
+		slog.Warn("failed to execute prompt template, falling back to default", "error", err)
+		t, _ = template.New("prompt").Funcs(promptFuncs).Parse(builtin)
+		buf.Reset()
+		t.Execute(&buf, data)
+	}
+
+	return strings.TrimRight(buf.String(), " \t\n")
+}
+
+// DirContext holds gathered context for one directory.
+type DirContext struct {
+	CwdPath        string
+	CwdListing     string            // ls -A output (space-separated, no . or ..)
+	CwdManifests   map[string]string // filename label -> extracted content
+	PackageManager string            // detected from lockfile (pnpm, yarn, bun, npm, cargo)
+	Nix            string            // nix project type (flake, shell), detected from cwd or git root
+	Terraform      string            // terraform workspace, backend, and targets in cwd
+	Languages      string            // share of source files per language in the repository, e.g. "Go 80%, Shell 20%"
+	GitRootListing string
+	GitStagedFiles string
+	GitManifests   map[string]string // manifest files at git root (if different from cwd)
+}
+
+// UserContext is the context shown to the model for one completion request.
+// Callers redact and filter history before filling it in; BuildUserMessage
+// only formats.
+type UserContext struct {
+	Cwd          string      `json:"cwd,omitempty"`
+	NixShell     string      `json:"nix_shell,omitempty"` // $IN_NIX_SHELL
+	Shell        string      `json:"shell,omitempty"`     // shell dialect (see ShellName); zsh is not shown
+	Dir          *DirContext `json:"dir,omitempty"`       // nil when no directory context is available
+	Recent       []string    `json:"recent,omitempty"`    // recent history commands, most frecent first
+	Related      []string    `json:"related,omitempty"`   // history commands semantically related to the input
+	LastFailure  string      `json:"last_failure,omitempty"`
+	Session      string      `json:"session,omitempty"` // rendered session trail
+	AcceptedHere []string    `json:"accepted_here,omitempty"`
+	RecentHere   []string    `json:"recent_here,omitempty"`   // commands that last succeeded in the cwd, most recent first
+	Preceding    string      `json:"preceding,omitempty"`     // summary of input lines above the one being completed
+	Date         string      `json:"date,omitempty"`          // current local date, time, and timezone
+	Aliases      []string    `json:"aliases,omitempty"`       // the user's aliases and functions (see AliasContext)
+	FlagsCommand string      `json:"flags_command,omitempty"` // command (and subcommand) being typed whose flags are known
+	Flags        []string    `json:"flags,omitempty"`         // long flags FlagsCommand accepts, from its --help
+	DocsCommand  string      `json:"docs_command,omitempty"`  // command being typed whose documentation is known
+	Docs         string      `json:"docs,omitempty"`          // condensed tldr page or man page synopsis of DocsCommand
+	// ProjectSummary is a model-written summary of the project, sent in
+	// place of its file listing and manifests.
+	ProjectSummary string `json:"project_summary,omitempty"`
+	Input          string `json:"input"`
+	CursorPos      int    `json:"cursor_pos"`
+	// TokenBudget caps the estimated tokens of the message; 0 means no cap.
+	TokenBudget int `json:"token_budget,omitempty"`
+	// Sections names the optional sections to include, most important
+	// first; empty means ashlet.DefaultContextSections.
+	Sections []string `json:"sections,omitempty"`
+}
+
+// BuildUserMessage constructs the user message from context and input.
+// Only the optional sections named in Sections are included. With a
+// TokenBudget, the lowest-priority sections are trimmed or dropped until the
+// message fits (see fitBudget).
+func BuildUserMessage(uc UserContext) string {
+	return renderSections(uc) + "\n" + BuildInputMessage(uc)
+}
+
+// BuildInputMessage renders just the input line of the user message, with
+// the cursor marked, for prompts that carry the context elsewhere.
+func BuildInputMessage(uc UserContext) string {
+	before := uc.Input[:uc.CursorPos]
+	after := uc.Input[uc.CursorPos:]
+
+	var sb strings.Builder
+	sb.WriteString("Input: `")
+	sb.WriteString(before)
+	if len(after) > 0 {
+		sb.WriteString("█")
+	}
+	sb.WriteString(after)
+	sb.WriteString("`")
+	return sb.String()
+}
+
+// renderSections renders the context sections of the user message, one per
+// line, trimmed to what the TokenBudget leaves beside the input line.
+func renderSections(uc UserContext) string {
+	sections := contextSections(uc)
+	if uc.TokenBudget > 0 {
+		sections = fitBudget(sections, uc.TokenBudget-EstimateTokens("\n"+BuildInputMessage(uc)))
+	}
+
+	var sb strings.Builder
+	for _, sec := range sections {
+		sb.WriteString(sec.render())
+	}
+	return sb.String()
+}
+
+// BuildInfillPrompt builds the prompt and suffix of a fill-in-the-middle
+// request: the context sections as shell comments followed by the input up
+// to the cursor, and the input after the cursor. The context is trimmed to
+// TokenBudget like BuildUserMessage's.
+func BuildInfillPrompt(uc UserContext) (prompt, suffix string) {
+	sections := contextSections(uc)
+	before := uc.Input[:uc.CursorPos]
+	suffix = uc.Input[uc.CursorPos:]
+
+	if uc.TokenBudget > 0 {
+		sections = fitBudget(sections, uc.TokenBudget-EstimateTokens(uc.Input))
+	}
+
+	var sb strings.Builder
+	for _, sec := range sections {
+		line := strings.TrimSuffix(sec.render(), "\n")
+		sb.WriteString("# ")
+		sb.WriteString(strings.ReplaceAll(line, "\n", " "))
+		sb.WriteString("\n")
+	}
+	sb.WriteString(before)
+	return sb.String(), suffix
+}
+
+// contextSections collects the sections of uc shown before the input, in
+// display order.
+func contextSections(uc UserContext) []section {
+	priorities := sectionPriorities(uc.Sections)
+	var sections []section
+	add := func(sec section) {
+		if sec.text == "" && len(sec.items) == 0 {
+			return
+		}
+		if sec.name != "" {
+			keep, ok := priorities[sec.name]
+			if !ok {
+				return
+			}
+			sec.keep = keep
+		}
+		sections = append(sections, sec)
+	}
+
+	add(section{label: "cwd", text: uc.Cwd})
+	add(section{label: "database", text: dbClient(uc.Input)})
+	add(section{label: "nix shell", text: uc.NixShell})
+	if uc.Shell != "zsh" {
+		add(section{label: "shell", text: uc.Shell})
+	}
+
+	if dirCtx := uc.Dir; dirCtx != nil {
+		add(section{name: "files", label: "files", items: strings.Fields(dirCtx.CwdListing), sep: " "})
+		add(section{name: "pkg", label: "pkg", text: dirCtx.PackageManager})
+		add(section{name: "nix", label: "nix", text: dirCtx.Nix})
+		add(section{name: "terraform", label: "terraform", text: dirCtx.Terraform})
+		add(section{name: "languages", label: "languages", text: dirCtx.Languages})
+		if uc.ProjectSummary == "" {
+			add(section{name: "project_files", label: "project files", items: strings.Fields(dirCtx.GitRootListing), sep: " "})
+		}
+		add(section{name: "staged", label: "staged", text: dirCtx.GitStagedFiles})
+		// The summary covers the git root's manifests, which are the
+		// current directory's when it is the root.
+		if uc.ProjectSummary == "" || dirCtx.GitRootListing != "" {
+			for name, content := range dirCtx.CwdManifests {
+				add(section{name: "manifests", label: name, text: content})
+			}
+		}
+		if uc.ProjectSummary == "" {
+			for name, content := range dirCtx.GitManifests {
+				add(section{name: "project_manifests", label: name, text: content})
+			}
+		}
+	}
+	add(section{name: "summary", label: "project", text: uc.ProjectSummary})
+
+	add(section{name: "recent", label: "recent", items: uc.Recent, sep: ", "})
+	add(section{name: "related", label: "related", items: uc.Related, sep: ", "})
+	add(section{name: "flags", label: "flags of " + uc.FlagsCommand, items: uc.Flags, sep: " "})
+	add(section{name: "docs", label: "docs of " + uc.DocsCommand, text: uc.Docs})
+	add(section{label: "last command", text: uc.LastFailure})
+	add(section{name: "date", label: "date", text: uc.Date})
+	add(section{name: "session", label: "session", text: uc.Session})
+	add(section{name: "accepted_here", label: "accepted here", items: uc.AcceptedHere, sep: ", "})
+	add(section{name: "recent_here", label: "run here", items: uc.RecentHere, sep: ", "})
+	add(section{name: "aliases", label: "aliases", items: uc.Aliases, sep: ", "})
+	add(section{label: "lines above", text: uc.Preceding})
+	return sections
+}
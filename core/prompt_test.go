@@ -0,0 +1,58 @@
+package core
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	defaults "github.com/Paranoid-AF/ashlet/default"
+)
+
+func TestPromptFuncs(t *testing.T) {
+	data := PromptData{
+		CWD:            "/home/me/src/ashlet",
+		RecentCommands: []string{"make", "go test ./...", "git status"},
+		DirListing:     "Makefile go.mod main.go",
+		DirManifests:   map[string]string{"package.json": "scripts: dev", "Makefile": "build test"},
+		Docs:           "go test [packages]",
+	}
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{`{{.DirListing | truncate 8}}`, "Makefile..."},
+		{`{{.DirListing | truncate 100}}`, "Makefile go.mod main.go"},
+		{`{{codeblock .Docs}}`, "```\ngo test [packages]\n```"},
+		{`{{codeblock .LastFailure}}`, ""},
+		{"{{codeblock \"a ``` b\"}}", "````\na ``` b\n````"},
+		{`{{ifNonEmpty "Last: " .LastFailure}}`, ""},
+		{`{{ifNonEmpty "Recent: " .RecentCommands}}`, "Recent: make, go test ./..., git status"},
+		{`{{ifNonEmpty "" .DirManifests}}`, "Makefile: build test\npackage.json: scripts: dev"},
+		{`{{join (limit 2 .RecentCommands) " | "}}`, "make | go test ./..."},
+		{`{{jsonEscape "say \"hi\"\n"}}`, `say \"hi\"\n`},
+		{`{{basename .CWD}}`, "ashlet"},
+		{`[{{basename .Input}}]`, "[]"},
+	}
+	for _, tt := range tests {
+		if got := RenderPrompt(tt.tmpl, "builtin", data); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+// The reference served for prompt authors must cover every field and
+// function templates can use.
+func TestPromptReferenceComplete(t *testing.T) {
+	for name := range promptFuncs {
+		if !strings.Contains(defaults.PromptReference, "`"+name+" ") {
+			t.Errorf("function %s is missing from prompt_reference.md", name)
+		}
+	}
+	typ := reflect.TypeFor[PromptData]()
+	for i := range typ.NumField() {
+		f := typ.Field(i)
+		if !strings.Contains(defaults.PromptReference, "`."+f.Name+"`") {
+			t.Errorf("field %s is missing from prompt_reference.md", f.Name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package core
+
+// quoteSpan is a quoted string in a command: the byte offsets of its
+// opening and closing quote characters. close is -1 if the quote is
+// unterminated.
+type quoteSpan struct {
+	open, close int
+}
+
+// quoteSpans tokenizes cmd the way the shell would and returns its
+// outermost quoted strings in order. Backslash escapes, command
+// substitutions ($(...) and backticks), and $'...' strings are understood,
+// so quotes inside a substitution are found as their own spans when the
+// substitution is unquoted, and are part of the enclosing string when it is
+// inside double quotes. Incomplete input (an unterminated quote or
+// substitution) is scanned as far as it goes.
+func quoteSpans(cmd string) []quoteSpan {
+	var spans []quoteSpan
+	scanCode(cmd, 0, 0, &spans)
+	return spans
+}
+
+// scanCode scans unquoted shell code from i until the byte term (0 for
+// end of input), returning the terminator's offset or len(s). Quoted
+// strings found are appended to spans unless spans is nil.
+func scanCode(s string, i int, term byte, spans *[]quoteSpan) int {
+	for i < len(s) {
+		switch ch := s[i]; {
+		case ch == term:
+			return i
+		case ch == '\\':
+			i += 2
+			continue
+		case ch == '\'':
+			end := scanSingle(s, i, false)
+			record(spans, i, end)
+			if end < 0 {
+				return len(s)
+			}
+			i = end
+		case ch == '"':
+			end := scanDouble(s, i)
+			record(spans, i, end)
+			if end < 0 {
+				return len(s)
+			}
+			i = end
+		case ch == '`':
+			i = scanCode(s, i+1, '`', spans)
+		case ch == '$' && i+1 < len(s) && s[i+1] == '\'':
+			end := scanSingle(s, i+1, true)
+			record(spans, i+1, end)
+			if end < 0 {
+				return len(s)
+			}
+			i = end
+		case ch == '$' && i+1 < len(s) && s[i+1] == '(':
+			i = scanCode(s, i+2, ')', spans)
+		case ch == '(' && term == ')':
+			// Nested parentheses inside $(...), e.g. a subshell.
+			i = scanCode(s, i+1, ')', spans)
+		}
+		i++
+	}
+	return len(s)
+}
+
+// scanSingle returns the offset of the quote closing the single-quoted
+// string opened at i, or -1. Backslash escapes apply only in $'...'
+// strings (escapes true).
+func scanSingle(s string, i int, escapes bool) int {
+	for i++; i < len(s); i++ {
+		if escapes && s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == '\'' {
+			return i
+		}
+	}
+	return -1
+}
+
+// scanDouble returns the offset of the quote closing the double-quoted
+// string opened at i, or -1. Substitutions inside are skipped over whole,
+// so their own quotes do not end the string.
+func scanDouble(s string, i int) int {
+	for i++; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			return i
+		case s[i] == '`':
+			i = scanCode(s, i+1, '`', nil)
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '(':
+			i = scanCode(s, i+2, ')', nil)
+		}
+	}
+	return -1
+}
+
+func record(spans *[]quoteSpan, open, close int) {
+	if spans != nil {
+		*spans = append(*spans, quoteSpan{open: open, close: close})
+	}
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"sort"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// FilterCandidateQuotes applies quote-content filtering to candidates based on input.
+// If the input has no quotes: strip quote content from each candidate, deduplicate,
+// and set CursorPos before the last closing quote (so cursor lands inside "").
+// If the input has quotes: keep content as-is, set CursorPos before last closing quote.
+func FilterCandidateQuotes(candidates []ashlet.Candidate, input string) []ashlet.Candidate {
+	if len(candidates) == 0 {
+		return candidates
+	}
+
+	inputHasQuotes := strings.ContainsAny(input, "\"'")
+
+	seen := make(map[string]bool, len(candidates))
+	var out []ashlet.Candidate
+	for _, c := range candidates {
+		cmd := c.Completion
+		if !inputHasQuotes {
+			cmd = FilterQuoteContent(cmd)
+		}
+
+		if seen[cmd] {
+			continue
+		}
+		seen[cmd] = true
+
+		cursorPos := c.CursorPos
+		if cursorPos == nil {
+			if pos := findLastClosingQuotePos(cmd); pos >= 0 {
+				// Only position cursor inside quotes if nothing meaningful
+				// follows the closing quote (e.g. "&&", "||", "| grep").
+				// Otherwise leave cursor at end so user can edit the chain.
+				afterQuote := strings.TrimSpace(cmd[pos+1:])
+				if afterQuote == "" {
+					cursorPos = &pos
+				}
+			}
+		}
+
+		out = append(out, ashlet.Candidate{
+			Completion: cmd,
+			Confidence: c.Confidence,
+			CursorPos:  cursorPos,
+		})
+	}
+	return out
+}
+
+// findLastClosingQuotePos tokenizes s (see quoteSpans) and returns the byte
+// index of the last closing quote, or -1 if none found.
+func findLastClosingQuotePos(s string) int {
+	lastClose := -1
+	for _, sp := range quoteSpans(s) {
+		if sp.close >= 0 {
+			lastClose = sp.close
+		}
+	}
+	return lastClose
+}
+
+// commonPrefix returns the longest common prefix of two strings.
+func commonPrefix(a, b string) string {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return a[:i]
+		}
+	}
+	return a[:n]
+}
+
+// quoteExtensionLength returns the number of characters before the first
+// closing quote (" or ') in suffix. Returns 0 if no quote found.
+func quoteExtensionLength(suffix string) int {
+	for i, ch := range suffix {
+		if ch == '"' || ch == '\'' {
+			return i
+		}
+	}
+	return 0
+}
+
+// MergeCandidates combines candidate lists sampled independently for the
+// same input into one list of at most max, ranked by self-consistency:
+// commands that are equivalent under NormalizeCommand are merged, and each
+// gets its confidence averaged over all lists, counting lists without it as
+// 0. Commands most samples agree on rank first; position within a sample
+// breaks ties. Each merged candidate keeps the text of its best-placed
+// occurrence.
+func MergeCandidates(lists [][]ashlet.Candidate, max int) []ashlet.Candidate {
+	if len(lists) == 0 {
+		return nil
+	}
+	type merged struct {
+		candidate ashlet.Candidate
+		best      float64
+		total     float64
+		votes     int
+	}
+	var out []*merged
+	byKey := make(map[string]*merged)
+	for _, list := range lists {
+		counted := make(map[string]bool)
+		for _, c := range list {
+			key := NormalizeCommand(c.Completion)
+			m, ok := byKey[key]
+			if !ok {
+				m = &merged{candidate: c, best: c.Confidence}
+				byKey[key] = m
+				out = append(out, m)
+			} else if c.Confidence > m.best {
+				m.candidate, m.best = c, c.Confidence
+			}
+			// A sample repeating a command still counts once.
+			if !counted[key] {
+				counted[key] = true
+				if c.Confidence > 0 { // fallback candidates carry -1
+					m.total += c.Confidence
+				}
+				m.votes++
+			}
+		}
+	}
+
+	for _, m := range out {
+		m.candidate.Confidence = m.total / float64(len(lists))
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].candidate.Confidence != out[j].candidate.Confidence {
+			return out[i].candidate.Confidence > out[j].candidate.Confidence
+		}
+		if out[i].votes != out[j].votes {
+			return out[i].votes > out[j].votes
+		}
+		return out[i].best > out[j].best
+	})
+
+	var candidates []ashlet.Candidate
+	for _, m := range out {
+		if len(candidates) >= max {
+			break
+		}
+		candidates = append(candidates, m.candidate)
+	}
+	return candidates
+}
+
+// QuoteVariantKey identifies the command cmd runs apart from the content
+// of its quoted strings, so candidates that differ only in e.g. a commit
+// message share a key.
+func QuoteVariantKey(cmd string) string {
+	return NormalizeCommand(FilterQuoteContent(cmd))
+}
+
+// CollapseQuoteVariants keeps the first of each group of candidates that
+// differ only in quoted text (see QuoteVariantKey), so the list offers
+// genuinely different commands rather than four wordings of one. It reports
+// how many candidates were dropped.
+func CollapseQuoteVariants(candidates []ashlet.Candidate) ([]ashlet.Candidate, int) {
+	if len(candidates) < 2 {
+		return candidates, 0
+	}
+	seen := make(map[string]bool, len(candidates))
+	out := candidates[:0]
+	for _, c := range candidates {
+		key := QuoteVariantKey(c.Completion)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, c)
+	}
+	return out, len(candidates) - len(out)
+}
+
+// SortCandidates re-orders candidates using a weighted formula that favours
+// candidates extending quote content. Candidates are only re-sorted when they
+// share a sufficiently long common prefix; otherwise the original position-based
+// ordering is preserved.
+func SortCandidates(candidates []ashlet.Candidate, input string) {
+	if len(candidates) < 2 {
+		return
+	}
+
+	// Compute LCP of all candidates
+	lcp := candidates[0].Completion
+	for _, c := range candidates[1:] {
+		lcp = commonPrefix(lcp, c.Completion)
+		if lcp == "" {
+			break
+		}
+	}
+
+	// Threshold: candidates must share a meaningful prefix
+	minLen := len(input) / 2
+	if minLen < 3 {
+		minLen = 3
+	}
+	if len(lcp) < minLen {
+		return
+	}
+
+	// Compute raw scores
+	type scored struct {
+		idx int
+		raw float64
+	}
+	scores := make([]scored, len(candidates))
+	for i, c := range candidates {
+		suffix := c.Completion[len(lcp):]
+		suffixLen := float64(len(suffix))
+		quoteExt := float64(quoteExtensionLength(suffix))
+		scores[i] = scored{idx: i, raw: suffixLen*0.2 + quoteExt*0.8}
+	}
+
+	// Min-max normalization
+	minRaw, maxRaw := scores[0].raw, scores[0].raw
+	for _, s := range scores[1:] {
+		if s.raw < minRaw {
+			minRaw = s.raw
+		}
+		if s.raw > maxRaw {
+			maxRaw = s.raw
+		}
+	}
+
+	rangeRaw := maxRaw - minRaw
+	type ranked struct {
+		candidate ashlet.Candidate
+		weight    float64
+	}
+	items := make([]ranked, len(candidates))
+	for i, s := range scores {
+		var normalized float64
+		if rangeRaw > 0 {
+			normalized = (s.raw - minRaw) / rangeRaw
+		}
+		weight := candidates[s.idx].Confidence*0.2 + 0.8*normalized
+		if score := candidates[s.idx].Score; score != nil {
+			score.QuoteExtension = normalized
+		}
+		items[i] = ranked{candidate: candidates[s.idx], weight: weight}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].weight > items[j].weight
+	})
+
+	// Write back and re-assign position-based confidence
+	for i, item := range items {
+		candidates[i] = item.candidate
+		candidates[i].Confidence = 0.95 - float64(i)*0.15
+		if candidates[i].Confidence < 0.1 {
+			candidates[i].Confidence = 0.1
+		}
+	}
+}
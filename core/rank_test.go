@@ -0,0 +1,367 @@
+package core
+
+import (
+	"math"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestFilterCandidateQuotesNoQuotesInInput(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: `git commit -m "initial"`, Confidence: 0.95},
+		{Completion: `git commit -m "fix bug"`, Confidence: 0.80},
+		{Completion: `git status`, Confidence: 0.65},
+	}
+	result := FilterCandidateQuotes(candidates, "git commi")
+
+	if len(result) != 2 {
+		t.Fatalf("expected 2 candidates after dedup, got %d", len(result))
+	}
+	if result[0].Completion != `git commit -m ""` {
+		t.Errorf("expected %q, got %q", `git commit -m ""`, result[0].Completion)
+	}
+	if result[0].CursorPos == nil || *result[0].CursorPos != 15 {
+		t.Errorf("expected CursorPos=15 inside quotes, got %v", result[0].CursorPos)
+	}
+}
+
+func TestFilterCandidateQuotesWithQuotesInInput(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: `git commit -m "feat: sign-in page"`, Confidence: 0.95},
+	}
+	result := FilterCandidateQuotes(candidates, `git commit -m "feat:`)
+
+	if len(result) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(result))
+	}
+	if result[0].Completion != `git commit -m "feat: sign-in page"` {
+		t.Errorf("expected content preserved, got %q", result[0].Completion)
+	}
+	if result[0].CursorPos == nil || *result[0].CursorPos != 33 {
+		t.Errorf("expected CursorPos=33, got %v", result[0].CursorPos)
+	}
+}
+
+func TestFilterCandidateQuotesCursorAfterChain(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: `git commit -m "a" && git push`, Confidence: 0.95},
+	}
+	result := FilterCandidateQuotes(candidates, `git commit -m "a`)
+
+	if len(result) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(result))
+	}
+	if result[0].CursorPos != nil {
+		t.Errorf("expected CursorPos=nil when chain follows quote, got %d", *result[0].CursorPos)
+	}
+}
+
+func TestFilterCandidateQuotesNoClobberExistingCursor(t *testing.T) {
+	pos := 5
+	candidates := []ashlet.Candidate{
+		{Completion: `echo "hello"`, Confidence: 0.95, CursorPos: &pos},
+	}
+	result := FilterCandidateQuotes(candidates, `echo "he`)
+
+	if result[0].CursorPos == nil || *result[0].CursorPos != 5 {
+		t.Errorf("expected existing CursorPos=5 preserved, got %v", result[0].CursorPos)
+	}
+}
+
+func TestFilterCandidateQuotesNoQuotesInCandidate(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: "git status", Confidence: 0.95},
+	}
+	result := FilterCandidateQuotes(candidates, "git s")
+	if result[0].CursorPos != nil {
+		t.Errorf("expected no CursorPos for command without quotes, got %d", *result[0].CursorPos)
+	}
+}
+
+func TestFilterCandidateQuotesEmpty(t *testing.T) {
+	result := FilterCandidateQuotes(nil, "git s")
+	if result != nil {
+		t.Errorf("expected nil for empty input, got %v", result)
+	}
+}
+
+func TestFindLastClosingQuotePos(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{`git commit -m ""`, 15},
+		{`echo "hello"`, 11},
+		{`echo ''`, 6},
+		{`git status`, -1},
+		{`echo "a" && echo "b"`, 19},
+		{`echo "escaped \" quote"`, 22},
+		{`echo "`, -1},
+		{`echo 'a' "b"`, 11},
+		{`git commit -m "$(date +"%F")"`, 28},
+		{`echo $(git log --format="%h")`, 27},
+		{"echo `date +'%H'`", 15},
+		{`echo \"a\"`, -1},
+		{`echo "$(printf ")")"`, 19},
+	}
+	for _, tt := range tests {
+		got := findLastClosingQuotePos(tt.input)
+		if got != tt.want {
+			t.Errorf("findLastClosingQuotePos(%q) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestSortCandidatesQuoteExtensionFirst(t *testing.T) {
+	// Scenario: shared prefix = `git commit -m "feat: implement new funct`
+	// The candidate extending the quote content should rank first.
+	prefix := `git commit -m "feat: implement new funct`
+	candidates := []ashlet.Candidate{
+		{Completion: prefix + `" && git push`, Confidence: 0.95},
+		{Completion: prefix + `ion"`, Confidence: 0.80},
+		{Completion: prefix + `"`, Confidence: 0.65},
+	}
+	input := `git commit -m "feat: implement new funct`
+
+	SortCandidates(candidates, input)
+
+	// Quote-extending candidate should be first
+	if candidates[0].Completion != prefix+`ion"` {
+		t.Errorf("expected quote-extending candidate first, got %q", candidates[0].Completion)
+	}
+	// Chain command second
+	if candidates[1].Completion != prefix+`" && git push` {
+		t.Errorf("expected chain command second, got %q", candidates[1].Completion)
+	}
+	// Trivial completion last
+	if candidates[2].Completion != prefix+`"` {
+		t.Errorf("expected trivial completion last, got %q", candidates[2].Completion)
+	}
+
+	// Confidence should be re-assigned position-based
+	if math.Abs(candidates[0].Confidence-0.95) > 1e-9 {
+		t.Errorf("expected first candidate confidence 0.95, got %.2f", candidates[0].Confidence)
+	}
+	if math.Abs(candidates[1].Confidence-0.80) > 1e-9 {
+		t.Errorf("expected second candidate confidence 0.80, got %.2f", candidates[1].Confidence)
+	}
+	if math.Abs(candidates[2].Confidence-0.65) > 1e-9 {
+		t.Errorf("expected third candidate confidence 0.65, got %.2f", candidates[2].Confidence)
+	}
+}
+
+func TestSortCandidatesNoResortShortPrefix(t *testing.T) {
+	// Candidates with diverse prefixes (short LCP) should keep original order
+	candidates := []ashlet.Candidate{
+		{Completion: "git status", Confidence: 0.95},
+		{Completion: "git commit", Confidence: 0.80},
+		{Completion: "grep -r foo", Confidence: 0.65},
+	}
+
+	SortCandidates(candidates, "g")
+
+	// Order should be preserved
+	if candidates[0].Completion != "git status" {
+		t.Errorf("expected order preserved, got %q first", candidates[0].Completion)
+	}
+	if candidates[1].Completion != "git commit" {
+		t.Errorf("expected order preserved, got %q second", candidates[1].Completion)
+	}
+	// Confidence should remain unchanged (no re-sort happened)
+	if math.Abs(candidates[0].Confidence-0.95) > 1e-9 {
+		t.Errorf("expected confidence unchanged, got %.2f", candidates[0].Confidence)
+	}
+}
+
+func TestSortCandidatesSingleCandidate(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: "git status", Confidence: 0.95},
+	}
+	SortCandidates(candidates, "git s")
+
+	if candidates[0].Completion != "git status" {
+		t.Errorf("single candidate should be unchanged")
+	}
+	if math.Abs(candidates[0].Confidence-0.95) > 1e-9 {
+		t.Errorf("confidence should be unchanged, got %.2f", candidates[0].Confidence)
+	}
+}
+
+func TestSortCandidatesAllSame(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: "git status", Confidence: 0.95},
+		{Completion: "git status", Confidence: 0.80},
+	}
+	SortCandidates(candidates, "git s")
+
+	// Both are identical — should remain stable
+	if candidates[0].Completion != "git status" || candidates[1].Completion != "git status" {
+		t.Error("equal candidates should stay stable")
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"abc", "abd", "ab"},
+		{"abc", "abc", "abc"},
+		{"abc", "xyz", ""},
+		{"abc", "ab", "ab"},
+		{"", "abc", ""},
+	}
+	for _, tt := range tests {
+		got := commonPrefix(tt.a, tt.b)
+		if got != tt.want {
+			t.Errorf("commonPrefix(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteExtensionLength(t *testing.T) {
+	tests := []struct {
+		suffix string
+		want   int
+	}{
+		{`ion"`, 3},
+		{`" && git push`, 0},
+		{`"`, 0},
+		{`hello world`, 0},
+		{`some text' more`, 9},
+	}
+	for _, tt := range tests {
+		got := quoteExtensionLength(tt.suffix)
+		if got != tt.want {
+			t.Errorf("quoteExtensionLength(%q) = %d, want %d", tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestMergeCandidates(t *testing.T) {
+	lists := [][]ashlet.Candidate{
+		{{Completion: "git status", Confidence: 0.95}, {Completion: "git stash", Confidence: 0.8}},
+		{{Completion: "git  status", Confidence: 0.95}, {Completion: "git stage", Confidence: 0.8}},
+		{{Completion: "git stage", Confidence: 0.95}},
+	}
+	got := MergeCandidates(lists, 4)
+	want := []string{"git status", "git stage", "git stash"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d candidates, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Completion != want[i] {
+			t.Errorf("candidate %d = %q, want %q", i, got[i].Completion, want[i])
+		}
+	}
+
+	if got := MergeCandidates(lists, 1); len(got) != 1 {
+		t.Errorf("expected max 1 candidate, got %d", len(got))
+	}
+}
+
+func TestMergeCandidatesSelfConsistency(t *testing.T) {
+	// Each sample's top pick differs, but all agree on one command (written
+	// with different quoting), which should win.
+	lists := [][]ashlet.Candidate{
+		{{Completion: "git commit --amend", Confidence: 0.95}, {Completion: `git commit -m "wip"`, Confidence: 0.8}},
+		{{Completion: "git commit -v", Confidence: 0.95}, {Completion: "git commit -m 'wip'", Confidence: 0.8}},
+		{{Completion: "git commit -a", Confidence: 0.95}, {Completion: "git commit -m wip", Confidence: 0.8}},
+	}
+	got := MergeCandidates(lists, 4)
+	if len(got) != 4 {
+		t.Fatalf("expected 4 candidates, got %+v", got)
+	}
+	if got[0].Completion != `git commit -m "wip"` {
+		t.Errorf("expected the agreed command first, got %q", got[0].Completion)
+	}
+	if math.Abs(got[0].Confidence-0.8) > 1e-9 {
+		t.Errorf("confidence = %v, want mean 0.8", got[0].Confidence)
+	}
+	if got[1].Confidence >= got[0].Confidence {
+		t.Errorf("single-sample candidates should rank below the agreed one: %+v", got)
+	}
+}
+
+func TestNormalizeCommand(t *testing.T) {
+	same := [][]string{
+		{`git commit -m "fix bug"`, `git commit -m 'fix bug'`, `git  commit -m fix\ bug`},
+		{`echo "a"&&ls`, `echo a && ls`},
+		{`ls | grep "x"`, `ls|grep x`},
+		// Options of well-known commands.
+		{`git commit -m ""`, `git commit --message ""`, `git commit --message=""`, `git commit --message=`},
+		{`git commit -a -m "fix bug"`, `git commit -am "fix bug"`, `git commit --all --message="fix bug"`},
+		{`ls -la`, `ls -al`, `ls -l -a`, `ls --all -l`},
+		{`rm -rf build`, `rm -fr build`, `rm -r -f build`, `rm --recursive --force build`},
+		{`grep -rn TODO .`, `grep -n -r TODO .`},
+	}
+	for _, group := range same {
+		want := NormalizeCommand(group[0])
+		for _, cmd := range group[1:] {
+			if got := NormalizeCommand(cmd); got != want {
+				t.Errorf("NormalizeCommand(%q) = %q, want %q (as for %q)", cmd, got, want, group[0])
+			}
+		}
+	}
+
+	different := [][2]string{
+		{`ls *.go`, `ls '*.go'`},                 // glob vs literal
+		{`echo $HOME`, `echo '$HOME'`},           // expansion vs literal
+		{`rm -rf build`, `rm -rf dist`},          // different arguments
+		{`git commit -m -a`, `git commit -a -m`}, // -a is the message
+		{`ls -l -- -a`, `ls -la`},                // -a after -- is a file
+		{`git commit -ma`, `git commit -am`},     // message "a" vs -a -m
+		{`foo --all`, `foo -a`},                  // unknown command
+		{`git log -p`, `git log --patch`},        // unlisted subcommand
+	}
+	for _, pair := range different {
+		if NormalizeCommand(pair[0]) == NormalizeCommand(pair[1]) {
+			t.Errorf("NormalizeCommand(%q) and (%q) should differ", pair[0], pair[1])
+		}
+	}
+
+	if got := NormalizeCommand(`echo "unterminated`); got != `echo "unterminated` {
+		t.Errorf("unparsable command should fall back to itself, got %q", got)
+	}
+}
+
+func TestSortCandidatesScoresQuoteExtension(t *testing.T) {
+	prefix := `git commit -m "fix parser`
+	candidates := []ashlet.Candidate{
+		{Completion: prefix + `"`, Confidence: 0.95, Score: &ashlet.Score{Position: 0.95}},
+		{Completion: prefix + ` crash"`, Confidence: 0.80, Score: &ashlet.Score{Position: 0.80}},
+	}
+	SortCandidates(candidates, prefix)
+
+	if candidates[0].Completion != prefix+` crash"` {
+		t.Fatalf("expected quote-extending candidate first, got %q", candidates[0].Completion)
+	}
+	// The breakdown moves with its candidate.
+	if s := candidates[0].Score; s.Position != 0.80 || s.QuoteExtension != 1 {
+		t.Errorf("first score = %+v, want position 0.80 and full quote extension", s)
+	}
+	if s := candidates[1].Score; s.Position != 0.95 || s.QuoteExtension != 0 {
+		t.Errorf("second score = %+v, want position 0.95 and no quote extension", s)
+	}
+}
+
+func TestCollapseQuoteVariants(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: `git commit -m "fix parser crash"`},
+		{Completion: `git commit -m "Fix the parser"`},
+		{Completion: `git commit -am "fix parser"`},
+		{Completion: `git commit -m 'parser fix'`},
+	}
+	got, dropped := CollapseQuoteVariants(candidates)
+	if dropped != 2 || len(got) != 2 {
+		t.Fatalf("CollapseQuoteVariants = %+v (dropped %d), want one per command", got, dropped)
+	}
+	if got[0].Completion != `git commit -m "fix parser crash"` || got[1].Completion != `git commit -am "fix parser"` {
+		t.Errorf("kept %q and %q, want the first of each group", got[0].Completion, got[1].Completion)
+	}
+
+	distinct := []ashlet.Candidate{{Completion: "git status"}, {Completion: "git stash"}}
+	if got, dropped := CollapseQuoteVariants(distinct); dropped != 0 || len(got) != 2 {
+		t.Errorf("distinct candidates collapsed to %+v", got)
+	}
+}
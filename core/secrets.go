@@ -0,0 +1,125 @@
+package core
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// secretLevel is how eagerly redactSecrets masks a token by its entropy:
+// tokens of at least minLen characters carrying at least minEntropy bits
+// per character, in both cases unless anyCase.
+type secretLevel struct {
+	minLen     int
+	minEntropy float64
+	anyCase    bool
+}
+
+// SecretSensitivities are the values SetSecretSensitivity accepts, from
+// no entropy scan ("off") to the most eager ("high"). Known key formats are
+// masked at every level.
+var SecretSensitivities = []string{"off", "low", "medium", "high"}
+
+var secretLevels = map[string]*secretLevel{
+	"off":    nil,
+	"low":    {minLen: 32, minEntropy: 4.3},
+	"medium": {minLen: 20, minEntropy: 3.9},
+	"high":   {minLen: 16, minEntropy: 3.5, anyCase: true},
+}
+
+// secretSensitivity is the entropy scan in use; nil turns it off.
+var secretSensitivity atomic.Pointer[secretLevel]
+
+func init() {
+	secretSensitivity.Store(secretLevels["medium"])
+}
+
+// SetSecretSensitivity sets, for the whole process, how eagerly
+// RedactCommand masks literal tokens that look random: one of
+// SecretSensitivities, or "" for "medium". It reports false, changing
+// nothing, for other values.
+func SetSecretSensitivity(level string) bool {
+	if level == "" {
+		level = "medium"
+	}
+	l, ok := secretLevels[level]
+	if ok {
+		secretSensitivity.Store(l)
+	}
+	return ok
+}
+
+var (
+	// reKnownSecret matches credentials by their issuers' formats: AWS
+	// access key IDs, GitHub, OpenAI/Anthropic-style, Slack, GitLab, and
+	// Google API tokens, and JWTs.
+	reKnownSecret = regexp.MustCompile(`\b(?:(?:AKIA|ASIA)[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{30,}|github_pat_[A-Za-z0-9_]{22,}|sk-[A-Za-z0-9_-]{20,}|xox[abposr]-[A-Za-z0-9-]{10,}|glpat-[A-Za-z0-9_-]{20,}|AIza[0-9A-Za-z_-]{35}|eyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]*)`)
+	// reSecretToken matches the literal tokens the entropy scan weighs:
+	// runs of base64, base64url, and hex characters.
+	reSecretToken = regexp.MustCompile(`[A-Za-z0-9+/_-]+=*`)
+	reHexOnly     = regexp.MustCompile(`^(?:[0-9a-f]+|[0-9A-F]+)$`)
+)
+
+// redactSecrets masks literal secrets in cmd with ***: tokens in a known
+// key format, and, per the secret sensitivity, long tokens whose characters
+// look random. Hex strings (commit and content hashes), paths, and flags
+// are kept, as they are seldom secret and often the point of a command.
+func redactSecrets(cmd string) string {
+	cmd = reKnownSecret.ReplaceAllString(cmd, "***")
+	level := secretSensitivity.Load()
+	if level == nil {
+		return cmd
+	}
+	return reSecretToken.ReplaceAllStringFunc(cmd, func(tok string) string {
+		if looksRandom(tok, level) {
+			return "***"
+		}
+		return tok
+	})
+}
+
+// looksRandom reports whether tok is long and random enough, for level, to
+// be a secret.
+func looksRandom(tok string, level *secretLevel) bool {
+	if len(tok) < level.minLen || strings.HasPrefix(tok, "-") || strings.Count(tok, "/") > 1 ||
+		reHexOnly.MatchString(tok) {
+		return false
+	}
+	// Secrets mix digits with letters, usually of both cases; names made
+	// of words (release-2024-final, docker_compose_v2) do not.
+	if !strings.ContainsAny(tok, "0123456789") || !strings.ContainsFunc(tok, unicode.IsLetter) {
+		return false
+	}
+	if !level.anyCase && (!strings.ContainsFunc(tok, unicode.IsUpper) || !strings.ContainsFunc(tok, unicode.IsLower)) {
+		return false
+	}
+	words := 0
+	for _, seg := range strings.FieldsFunc(tok, func(r rune) bool { return strings.ContainsRune("-_/+=", r) }) {
+		if len(seg) >= 3 && strings.Trim(seg, "abcdefghijklmnopqrstuvwxyz") == "" {
+			words++
+		}
+	}
+	if words >= 2 {
+		return false
+	}
+	return shannonEntropy(tok) >= level.minEntropy
+}
+
+// shannonEntropy returns the entropy of s in bits per byte.
+func shannonEntropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var h float64
+	n := float64(len(s))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
@@ -0,0 +1,43 @@
+package core
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// shellAliases maps shell names and executables to the dialect they speak.
+var shellAliases = map[string]string{
+	"nu":             "nushell",
+	"pwsh":           "powershell",
+	"powershell.exe": "powershell",
+	"pwsh.exe":       "powershell",
+}
+
+// posixShells are the dialects the shell parser (bash syntax) can check,
+// normalize, and complete constructs for.
+var posixShells = map[string]bool{
+	"zsh": true, "bash": true, "sh": true, "dash": true, "ksh": true, "mksh": true,
+}
+
+// ShellName returns the dialect a request's shell name refers to: "zsh",
+// "bash", "fish", "nushell", "powershell", or the lowercased name for other
+// shells. A path is reduced to its last element (/usr/bin/fish is "fish"),
+// and an empty name is "zsh".
+func ShellName(shell string) string {
+	shell = strings.ToLower(strings.TrimSpace(shell))
+	if shell == "" {
+		return "zsh"
+	}
+	shell = filepath.Base(shell)
+	if alias, ok := shellAliases[shell]; ok {
+		return alias
+	}
+	return shell
+}
+
+// POSIXShell reports whether shell (see ShellName) takes POSIX sh syntax,
+// so candidates for it can be checked with the shell parser. fish, nushell,
+// and PowerShell cannot.
+func POSIXShell(shell string) bool {
+	return posixShells[ShellName(shell)]
+}
@@ -0,0 +1,30 @@
+package core
+
+import "testing"
+
+func TestShellName(t *testing.T) {
+	tests := []struct {
+		shell string
+		want  string
+		posix bool
+	}{
+		{"", "zsh", true},
+		{"zsh", "zsh", true},
+		{"Bash", "bash", true},
+		{"/bin/sh", "sh", true},
+		{"/usr/local/bin/fish", "fish", false},
+		{"nu", "nushell", false},
+		{"nushell", "nushell", false},
+		{"pwsh", "powershell", false},
+		{"PowerShell", "powershell", false},
+		{"xonsh", "xonsh", false},
+	}
+	for _, tt := range tests {
+		if got := ShellName(tt.shell); got != tt.want {
+			t.Errorf("ShellName(%q) = %q, want %q", tt.shell, got, tt.want)
+		}
+		if got := POSIXShell(tt.shell); got != tt.posix {
+			t.Errorf("POSIXShell(%q) = %v, want %v", tt.shell, got, tt.posix)
+		}
+	}
+}
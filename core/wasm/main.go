@@ -0,0 +1,122 @@
+//go:build js && wasm
+
+// Command wasm exposes ashlet's prompt building and candidate parsing to
+// JavaScript, so browser tools (a playground, prompt tuning) run the same
+// code as the daemon. Build with:
+//
+//	GOOS=js GOARCH=wasm go build -o ashlet.wasm ./core/wasm
+//
+// It registers a global `ashlet` object whose functions take and return
+// strings (JSON for structured values):
+//
+//	ashlet.renderPrompt(template, mode, maxCandidates, jsonOutput[, chainSeparator]) → system prompt
+//	ashlet.buildUserMessage(contextJSON) → user message
+//	ashlet.parseCandidates(output, input, maxCandidates, jsonOutput[, chainSeparator[, aliasesJSON]]) → candidates JSON
+//
+// mode is "complete" or "fix"; an empty template uses the built-in one.
+// chainSeparator is "&&" (default), ";", or "newline". aliasesJSON maps
+// alias names to expansions, as in a request's "aliases".
+// Errors are returned as {"error": "..."}.
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"syscall/js"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+	defaults "github.com/Paranoid-AF/ashlet/default"
+)
+
+func main() {
+	js.Global().Set("ashlet", js.ValueOf(map[string]any{
+		"renderPrompt":     js.FuncOf(renderPrompt),
+		"buildUserMessage": js.FuncOf(buildUserMessage),
+		"parseCandidates":  js.FuncOf(parseCandidates),
+	}))
+	select {} // keep the functions callable
+}
+
+func renderPrompt(_ js.Value, args []js.Value) any {
+	if len(args) < 4 {
+		return errorJSON("renderPrompt(template, mode, maxCandidates, jsonOutput)")
+	}
+	builtin := defaults.DefaultPrompt
+	if args[1].String() == "fix" {
+		builtin = defaults.DefaultFixPrompt
+	}
+	return core.RenderPrompt(args[0].String(), builtin, core.PromptData{
+		MaxCandidates:  args[2].Int(),
+		JSONOutput:     args[3].Bool(),
+		ChainSeparator: optionalString(args, 4),
+	})
+}
+
+func buildUserMessage(_ js.Value, args []js.Value) any {
+	if len(args) < 1 {
+		return errorJSON("buildUserMessage(contextJSON)")
+	}
+	var uc core.UserContext
+	if err := json.Unmarshal([]byte(args[0].String()), &uc); err != nil {
+		return errorJSON(err.Error())
+	}
+	if uc.CursorPos < 0 || uc.CursorPos > len(uc.Input) {
+		uc.CursorPos = len(uc.Input)
+	}
+	uc.Recent = core.FilterQuoteContentSlice(core.RedactCommands(uc.Recent))
+	uc.Related = core.FilterQuoteContentSlice(core.RedactCommands(uc.Related))
+	uc.AcceptedHere = core.FilterQuoteContentSlice(uc.AcceptedHere)
+	uc.RecentHere = core.FilterQuoteContentSlice(core.RedactCommands(uc.RecentHere))
+	return core.BuildUserMessage(uc)
+}
+
+// parseCandidates runs the daemon's post-processing, minus the ranking
+// that needs the user's learned feedback.
+func parseCandidates(_ js.Value, args []js.Value) any {
+	if len(args) < 4 {
+		return errorJSON("parseCandidates(output, input, maxCandidates, jsonOutput)")
+	}
+	output := args[0].String()
+	input := strings.TrimLeft(args[1].String(), " \t")
+	max := args[2].Int()
+	sep := optionalString(args, 4)
+	var aliases map[string]string
+	if s := optionalString(args, 5); s != "" {
+		if err := json.Unmarshal([]byte(s), &aliases); err != nil {
+			return errorJSON(err.Error())
+		}
+	}
+
+	var candidates []ashlet.Candidate
+	if args[3].Bool() {
+		candidates = core.ParseCandidatesJSON(output, input, max, sep)
+	} else {
+		candidates = core.ParseCandidates(output, input, max, sep)
+	}
+	candidates = core.FilterCandidateQuotes(candidates, input)
+	candidates = core.PreferAliases(candidates, input, aliases)
+	candidates = core.CompleteConstructs(candidates)
+	core.SortCandidates(candidates, input)
+	core.FlagDangerous(candidates)
+	core.AnnotateDiffs(candidates, input)
+
+	data, err := json.Marshal(candidates)
+	if err != nil {
+		return errorJSON(err.Error())
+	}
+	return string(data)
+}
+
+// optionalString returns args[i] as a string, or "" if it was not passed.
+func optionalString(args []js.Value, i int) string {
+	if len(args) <= i || args[i].Type() != js.TypeString {
+		return ""
+	}
+	return args[i].String()
+}
+
+func errorJSON(msg string) string {
+	data, _ := json.Marshal(map[string]string{"error": msg})
+	return string(data)
+}
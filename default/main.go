@@ -1,4 +1,4 @@
-// Package defaults provides embedded default assets (prompt template and config).
+// Package defaults provides embedded default assets (prompt templates and config).
 package defaults
 
 import _ "embed"
@@ -6,5 +6,11 @@ import _ "embed"
 //go:embed default_prompt.md
 var DefaultPrompt string
 
+//go:embed default_fix_prompt.md
+var DefaultFixPrompt string
+
+//go:embed prompt_reference.md
+var PromptReference string
+
 //go:embed default_config.json
 var DefaultConfigJSON []byte
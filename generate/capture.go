@@ -0,0 +1,154 @@
+package generate
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+)
+
+// captureMaxPending caps the completions held per command line while
+// waiting for the command the user runs; the oldest are dropped first.
+const captureMaxPending = 64
+
+// corpusEntry is one line of the eval corpus: what the model was shown
+// for a completion, what it suggested, and what the user then ran.
+// Everything is redacted like history before it is stored.
+type corpusEntry struct {
+	Time          time.Time        `json:"time"`
+	Model         string           `json:"model,omitempty"`
+	PromptVariant string           `json:"prompt_variant,omitempty"`
+	Context       core.UserContext `json:"context"`
+	Prompt        string           `json:"prompt"`
+	Output        []string         `json:"output"`
+	Executed      string           `json:"executed"`
+}
+
+// CaptureStore collects completions from shell sessions that turned
+// capture on, and appends them to the eval corpus once the command the
+// user finally ran is known, so real usage grows a personal benchmark.
+type CaptureStore struct {
+	path string // empty = nothing is written
+
+	mu       sync.Mutex
+	sessions map[string][]corpusEntry // capturing sessions -> entries awaiting the executed command
+}
+
+// NewCaptureStore creates a CaptureStore appending to the corpus at path.
+func NewCaptureStore(path string) *CaptureStore {
+	return &CaptureStore{path: path, sessions: make(map[string][]corpusEntry)}
+}
+
+// Handle starts or stops capture for a session, or records the command it
+// ran, completing the entries captured for that command line.
+func (cs *CaptureStore) Handle(req *ashlet.CaptureRequest) *ashlet.CaptureResponse {
+	if cs == nil {
+		return &ashlet.CaptureResponse{Error: &ashlet.Error{Code: "unsupported", Message: "capture is not available"}}
+	}
+	if req.SessionID == "" {
+		return &ashlet.CaptureResponse{Error: &ashlet.Error{Code: "invalid_request", Message: "session_id is required"}}
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	switch req.Action {
+	case "start":
+		if _, ok := cs.sessions[req.SessionID]; !ok {
+			cs.sessions[req.SessionID] = nil
+		}
+	case "stop":
+		delete(cs.sessions, req.SessionID)
+	case "executed":
+		if pending, ok := cs.sessions[req.SessionID]; ok {
+			cs.sessions[req.SessionID] = nil
+			cs.appendLocked(pending, core.RedactCommand(strings.TrimSpace(req.Executed)))
+		}
+	default:
+		return &ashlet.CaptureResponse{Error: &ashlet.Error{Code: "invalid_request", Message: "unknown capture action: " + req.Action}}
+	}
+	_, enabled := cs.sessions[req.SessionID]
+	return &ashlet.CaptureResponse{OK: true, Enabled: enabled, Path: cs.path}
+}
+
+// Enabled reports whether sessionID is capturing.
+func (cs *CaptureStore) Enabled(sessionID string) bool {
+	if cs == nil || sessionID == "" {
+		return false
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	_, ok := cs.sessions[sessionID]
+	return ok
+}
+
+// Record holds a completion the model answered for a capturing session
+// until the session reports the command it ran.
+func (cs *CaptureStore) Record(sessionID string, uc core.UserContext, resp *ashlet.Response) {
+	if cs == nil || resp.Meta == nil || resp.Error != nil {
+		return
+	}
+	uc = redactInput(uc)
+	entry := corpusEntry{
+		Time:          time.Now(),
+		Model:         resp.Meta.Model,
+		PromptVariant: resp.PromptVariant,
+		Context:       uc,
+		Prompt:        core.BuildUserMessage(uc),
+		Output:        make([]string, len(resp.Candidates)),
+	}
+	for i, c := range resp.Candidates {
+		entry.Output[i] = core.RedactCommand(c.Completion)
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	pending, ok := cs.sessions[sessionID]
+	if !ok {
+		return
+	}
+	if len(pending) >= captureMaxPending {
+		pending = pending[1:]
+	}
+	cs.sessions[sessionID] = append(pending, entry)
+}
+
+// appendLocked writes entries to the corpus with the command that was run.
+func (cs *CaptureStore) appendLocked(entries []corpusEntry, executed string) {
+	if len(entries) == 0 || cs.path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(cs.path), 0700); err != nil {
+		slog.Warn("failed to write eval corpus", "path", cs.path, "error", err)
+		return
+	}
+	f, err := os.OpenFile(cs.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Warn("failed to write eval corpus", "path", cs.path, "error", err)
+		return
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, entry := range entries {
+		entry.Executed = executed
+		if err := enc.Encode(entry); err != nil {
+			slog.Warn("failed to write eval corpus", "path", cs.path, "error", err)
+			return
+		}
+	}
+}
+
+// redactInput redacts the input in uc like a history command. The cursor
+// moves to the end when redaction changed the input.
+func redactInput(uc core.UserContext) core.UserContext {
+	redacted := core.RedactCommand(uc.Input)
+	if strings.Join(strings.Fields(redacted), " ") != strings.Join(strings.Fields(uc.Input), " ") {
+		uc.Input, uc.CursorPos = redacted, len(redacted)
+	}
+	return uc
+}
@@ -0,0 +1,97 @@
+package generate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func readCorpus(t *testing.T, path string) []corpusEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []corpusEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry corpusEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestCaptureIntoCorpus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<candidate type=\"replace\"><command>curl -H \"Authorization: $TOKEN\" example.com</command></candidate>"}}]}`))
+	}))
+	defer srv.Close()
+
+	corpus := filepath.Join(t.TempDir(), "corpus.jsonl")
+	gen := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), generator: gen, dirCache: NewDirCache(), config: ashlet.DefaultConfig(), capture: NewCaptureStore(corpus)}
+	defer e.gatherer.Close()
+
+	complete := func(sid string) {
+		e.Complete(context.Background(), &ashlet.Request{Input: "SECRET=hunter2 curl", CursorPos: 19, SessionID: sid})
+	}
+
+	// Sessions that have not turned capture on are not recorded.
+	complete("1")
+	if resp := e.Capture(&ashlet.CaptureRequest{Action: "executed", SessionID: "1", Executed: "ls"}); resp.Enabled {
+		t.Errorf("session 1 should not be capturing: %+v", resp)
+	}
+
+	if resp := e.Capture(&ashlet.CaptureRequest{Action: "start", SessionID: "2"}); !resp.OK || !resp.Enabled || resp.Path != corpus {
+		t.Fatalf("start = %+v", resp)
+	}
+	complete("2")
+	complete("2")
+	if got := readCorpus(t, corpus); len(got) != 0 {
+		t.Fatalf("entries written before the command ran: %+v", got)
+	}
+	e.Capture(&ashlet.CaptureRequest{Action: "executed", SessionID: "2", Executed: "SECRET=hunter2 curl example.com"})
+
+	entries := readCorpus(t, corpus)
+	if len(entries) != 2 {
+		t.Fatalf("got %d corpus entries, want 2", len(entries))
+	}
+	entry := entries[0]
+	if entry.Model != "test-model" || len(entry.Output) != 1 || entry.Prompt == "" {
+		t.Errorf("entry = %+v", entry)
+	}
+	data, _ := os.ReadFile(corpus)
+	if strings.Contains(string(data), "hunter2") || strings.Contains(string(data), "$TOKEN") {
+		t.Errorf("corpus is not redacted: %s", data)
+	}
+	if !strings.HasSuffix(entry.Executed, "curl example.com") {
+		t.Errorf("executed = %q", entry.Executed)
+	}
+
+	// Stopping discards what has not been completed.
+	complete("2")
+	e.Capture(&ashlet.CaptureRequest{Action: "stop", SessionID: "2"})
+	e.Capture(&ashlet.CaptureRequest{Action: "executed", SessionID: "2", Executed: "ls"})
+	if got := readCorpus(t, corpus); len(got) != 2 {
+		t.Errorf("got %d corpus entries after stop, want 2", len(got))
+	}
+
+	if resp := e.Capture(&ashlet.CaptureRequest{Action: "pause", SessionID: "2"}); resp.Error == nil {
+		t.Error("unknown action should be an error")
+	}
+}
@@ -0,0 +1,77 @@
+package generate
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// flightGroup coalesces concurrent identical completions, such as two tmux
+// panes in one repository typing the same thing, into one model request
+// whose result every caller receives. Unlike a plain singleflight, the
+// shared request is cancelled only once every caller waiting on it has
+// gone, so one shell moving on does not fail the others.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is one in-progress shared request.
+type flight struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	result  *Completion
+	err     error
+}
+
+// do returns the result of fn for key, joining a call already running for
+// the same key instead of starting another. fn runs with a context that
+// carries ctx's values but is cancelled only when all callers have left.
+// Each caller gets its own copy of the candidates.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (*Completion, error)) (*Completion, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f, ok := g.flights[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+		go func() {
+			result, err := fn(fctx)
+			g.mu.Lock()
+			f.result, f.err = result, err
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		if f.result == nil {
+			return nil, f.err
+		}
+		result := *f.result
+		result.Candidates = slices.Clone(result.Candidates)
+		return &result, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
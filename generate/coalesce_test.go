@@ -0,0 +1,96 @@
+package generate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestCompleteCoalescesIdenticalRequests(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<candidate type=\"replace\"><command>git status</command></candidate>"}}]}`))
+	}))
+	defer srv.Close()
+
+	gen := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), generator: gen, dirCache: NewDirCache(), config: ashlet.DefaultConfig(), sessions: NewSessionTracker()}
+	defer e.gatherer.Close()
+	defer e.sessions.Close()
+	// Each pane has typed something else before: their session trails
+	// differ, which should not keep them from sharing the request.
+	for i, ran := range []string{"make", "cd src", "ls"} {
+		e.sessions.RecordRan("pane"+strconv.Itoa(i), ran)
+	}
+
+	// The first pane moves on; the other two still get the shared result.
+	gone, leave := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	responses := make([]*ashlet.Response, 3)
+	for i := range responses {
+		ctx := context.Background()
+		if i == 0 {
+			ctx = gone
+		}
+		wg.Go(func() {
+			responses[i] = e.Complete(ctx, &ashlet.Request{Input: "git st", CursorPos: 6, Cwd: "/repo", SessionID: "pane" + strconv.Itoa(i)})
+		})
+	}
+	time.Sleep(100 * time.Millisecond)
+	leave()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("API called %d times for identical concurrent requests, want 1", got)
+	}
+	for i, resp := range responses[1:] {
+		if resp.Error != nil || len(resp.Candidates) != 1 || resp.Candidates[0].Completion != "git status" {
+			t.Errorf("waiter %d got %+v, want the shared candidate", i+1, resp)
+		}
+	}
+}
+
+func TestFlightGroupCancelledWhenAllLeave(t *testing.T) {
+	var g flightGroup
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	fn := func(ctx context.Context) (*Completion, error) {
+		close(started)
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := g.do(ctx, "k", fn); err != context.Canceled {
+		t.Errorf("do = %v, want context.Canceled", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the shared call should be cancelled once no caller waits")
+	}
+
+	// A later call for the key starts afresh.
+	got, err := g.do(context.Background(), "k", func(context.Context) (*Completion, error) {
+		return &Completion{Candidates: []ashlet.Candidate{{Completion: "ls"}}}, nil
+	})
+	if err != nil || len(got.Candidates) != 1 {
+		t.Errorf("fresh call = %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,87 @@
+package generate
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// bareWordRe matches input that can only be the start of a command name.
+var bareWordRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+-]*$`)
+
+// completesFirstWord reports whether input is a partial command name to
+// complete locally: a single bare word, e.g. "doc", that does not yet name
+// a command. Arguments, complete words, and requests whose $PATH is
+// unknown go to the model, as does everything with
+// generation.model_first_word set.
+func (e *Engine) completesFirstWord(req *ashlet.Request, input string) bool {
+	if e.config != nil && e.config.Generation.ModelFirstWord {
+		return false
+	}
+	if req.CursorPos != len(req.Input) || !bareWordRe.MatchString(input) || !e.localContext(req.Host) {
+		return false
+	}
+	execs := e.execs.Lookup(req.Path)
+	return execs != nil && !commandResolves(input, execs, req.Aliases, req.Cwd)
+}
+
+// commandCompleter completes a partial first word from the executables on
+// the shell's $PATH and its aliases and functions, the ones run most in
+// history first, without asking the model. When nothing matches, next
+// answers instead, so a typo can still be corrected.
+type commandCompleter struct {
+	e    *Engine
+	next Completer
+}
+
+func (c commandCompleter) Complete(ctx context.Context, q *Query) (*Completion, error) {
+	req := q.Request
+	names := make(map[string]bool)
+	for name := range c.e.execs.Lookup(req.Path) {
+		if strings.HasPrefix(name, q.Input) {
+			names[name] = true
+		}
+	}
+	for name := range req.Aliases {
+		if strings.HasPrefix(name, q.Input) {
+			names[name] = true
+		}
+	}
+	if len(names) == 0 {
+		return c.next.Complete(ctx, q)
+	}
+	scores := c.e.gatherer.CommandFrecency()
+	candidates := rankCommandNames(names, scores, q.Max)
+	return &Completion{Candidates: candidates, Ranked: true}, nil
+}
+
+// rankCommandNames orders names by frecency score, then shortest (the
+// closest completion of what was typed), then by name, and returns the
+// first max as candidates.
+func rankCommandNames(names map[string]bool, scores map[string]float64, max int) []ashlet.Candidate {
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	if len(list) > max {
+		list = list[:max]
+	}
+	candidates := make([]ashlet.Candidate, len(list))
+	for i, name := range list {
+		candidates[i] = ashlet.Candidate{Completion: name, Confidence: positionConfidence(i)}
+	}
+	return candidates
+}
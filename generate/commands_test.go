@@ -0,0 +1,81 @@
+package generate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestRankCommandNames(t *testing.T) {
+	names := map[string]bool{"docker": true, "dockerd": true, "doctl": true, "docx2txt": true}
+	scores := map[string]float64{"doctl": 0.5, "docker": 2}
+	got := rankCommandNames(names, scores, 3)
+	var cmds []string
+	for _, c := range got {
+		cmds = append(cmds, c.Completion)
+	}
+	if strings.Join(cmds, "|") != "docker|doctl|dockerd" {
+		t.Errorf("rankCommandNames = %q, want most used first, then shortest", cmds)
+	}
+	if got[0].Confidence <= got[1].Confidence {
+		t.Error("confidence should fall with rank")
+	}
+}
+
+func TestCompleteFirstWordLocally(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<candidate>docker ps</candidate>"}}]}`))
+	}))
+	defer srv.Close()
+
+	bin := t.TempDir()
+	for _, name := range []string{"docker", "doctl", "git"} {
+		os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"), 0755)
+	}
+	hist := filepath.Join(t.TempDir(), ".zsh_history")
+	os.WriteFile(hist, []byte(": 1:0;doctl auth init\n"), 0644)
+
+	gen := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, hist), generator: gen, dirCache: NewDirCache(), execs: NewExecCache(), config: ashlet.DefaultConfig()}
+	defer e.gatherer.Close()
+	defer e.execs.Close()
+
+	complete := func(input string, aliases map[string]string) *ashlet.Response {
+		return e.Complete(context.Background(), &ashlet.Request{Input: input, CursorPos: len(input), Path: bin, Aliases: aliases})
+	}
+
+	resp := complete("doc", map[string]string{"docs": "cd ~/docs"})
+	var cmds []string
+	for _, c := range resp.Candidates {
+		cmds = append(cmds, c.Completion)
+	}
+	if strings.Join(cmds, "|") != "doctl|docs|docker" {
+		t.Errorf("candidates = %q, want PATH and alias names, most used first", cmds)
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("API called %d times for a partial first word, want 0", got)
+	}
+
+	// No local match: the model may know better (a typo, a new tool).
+	complete("dcoker", nil)
+	// A complete command name: the model suggests arguments.
+	complete("git", nil)
+	if got := calls.Load(); got != 2 {
+		t.Errorf("API called %d times, want 2", got)
+	}
+
+	e.config.Generation.ModelFirstWord = true
+	complete("doc", nil)
+	if got := calls.Load(); got != 3 {
+		t.Errorf("API called %d times with model_first_word, want 3", got)
+	}
+}
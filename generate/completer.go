@@ -0,0 +1,167 @@
+package generate
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+)
+
+// Completer produces the raw candidates for a completion request: it runs
+// after context is gathered and before candidates are filtered, ranked,
+// and checked, which the engine does the same for every completer. The
+// model is the default completer; others (history-only, rules-only,
+// remote) are chosen per request by name.
+type Completer interface {
+	Complete(ctx context.Context, q *Query) (*Completion, error)
+}
+
+// Query is a prepared completion request.
+type Query struct {
+	// Request is the shell's request. For multi-line input, Input and
+	// CursorPos are those of the line being completed.
+	Request *ashlet.Request
+	// Input is Request.Input without leading blanks.
+	Input string
+	// Info is the history gathered for the request.
+	Info *Info
+	// Context is what the model would be shown.
+	Context core.UserContext
+	// Max is the number of candidates wanted.
+	Max int
+}
+
+// Completion is a completer's answer to a Query.
+type Completion struct {
+	Candidates []ashlet.Candidate
+	// PromptVariant is the prompt template used, during an A/B test.
+	PromptVariant string
+	// Meta is the provenance of the candidates; nil when no model was asked.
+	Meta *ashlet.Meta
+	// Ranked keeps the candidates in the completer's order rather than
+	// re-ranking them with rank.strategy.
+	Ranked bool
+}
+
+// Built-in completer names, as sent in Request.Completer.
+const (
+	completerModel   = "model"
+	completerHistory = "history"
+)
+
+// SetCompleter registers c under name, for requests that name it.
+// Registering "model" replaces the default completer. It is not safe to
+// call while the engine is serving requests.
+func (e *Engine) SetCompleter(name string, c Completer) {
+	if e.completers == nil {
+		e.completers = make(map[string]Completer)
+	}
+	e.completers[name] = c
+}
+
+// completer returns the completer a request names, falling back to the
+// model for an empty or unknown name. It returns nil when the model is
+// wanted but not configured.
+func (e *Engine) completer(name string) Completer {
+	if c, ok := e.completers[name]; ok {
+		return c
+	}
+	if name == completerHistory {
+		return e.fallback()
+	}
+	if name != "" && name != completerModel {
+		slog.Debug("unknown completer, using the model", "completer", name)
+	}
+	if c, ok := e.completers[completerModel]; ok {
+		return c
+	}
+	if e.generator == nil {
+		return nil
+	}
+	return modelCompleter{e}
+}
+
+// modelCompleter asks the configured generation model, by fill-in-the-middle
+// or with the chat prompt.
+type modelCompleter struct {
+	e *Engine
+}
+
+func (m modelCompleter) Complete(ctx context.Context, q *Query) (*Completion, error) {
+	e := m.e
+	// Fill-in-the-middle models take no system prompt, so there is no
+	// prompt variant to attribute.
+	variant := ""
+	if !e.generator.fim() {
+		variant = e.promptVariant(q.Request.SessionID)
+	}
+	systemPrompt, userMessage := "", core.BuildUserMessage(q.Context)
+	if !e.generator.fim() {
+		systemPrompt, userMessage = e.buildPrompts(q.Max, variant, q.Context)
+	}
+	// Identical prompts in flight at once share one model request.
+	key := m.flightKey(q, variant, systemPrompt, userMessage)
+	return e.flights.do(ctx, key, func(ctx context.Context) (*Completion, error) {
+		result := &Completion{PromptVariant: variant, Meta: e.generator.meta()}
+		err := e.allowGeneration(e.sampledCalls())
+		if err != nil {
+			return result, err
+		}
+		if e.generator.fim() {
+			result.Candidates, err = e.inferFIM(ctx, q.Context, q.Max)
+		} else {
+			slog.Debug("prompt", "system", systemPrompt, "user", userMessage)
+			result.Candidates, err = e.infer(ctx, systemPrompt, userMessage, q.Input, q.Max, historyCandidates(q.Input, q.Info, q.Max))
+		}
+		return result, err
+	})
+}
+
+// flightKey returns the key that identical completions in flight share,
+// from the prompts built for q. The session trail is left out: shells in
+// the same place typing the same thing rarely share one, and without it
+// they would almost never coalesce. The shared answer may then come from a
+// prompt with another shell's trail.
+func (m modelCompleter) flightKey(q *Query, variant, systemPrompt, userMessage string) string {
+	if q.Context.Session != "" {
+		uc := q.Context
+		uc.Session = ""
+		if m.e.generator.fim() {
+			userMessage = core.BuildUserMessage(uc)
+		} else {
+			systemPrompt, userMessage = m.e.buildPrompts(q.Max, variant, uc)
+		}
+	}
+	return strings.Join([]string{variant, strconv.Itoa(q.Max), q.Input, systemPrompt, userMessage}, "\x00")
+}
+
+// fallback returns the history completer, used for requests naming it and
+// when the model is not configured or fails.
+func (e *Engine) fallback() Completer {
+	if c, ok := e.completers[completerHistory]; ok {
+		return c
+	}
+	return historyCompleter{e.gatherer}
+}
+
+// historyCompleter suggests the user's history commands extending the
+// input, the most frecent first, without a model; it works offline and
+// without an API key.
+type historyCompleter struct {
+	gatherer *Gatherer // nil = only the commands in the query's Info
+}
+
+func (h historyCompleter) Complete(_ context.Context, q *Query) (*Completion, error) {
+	if h.gatherer == nil {
+		return &Completion{Candidates: historyCandidates(q.Input, q.Info, q.Max)}, nil
+	}
+	cmds := h.gatherer.HistoryMatches(q.Input, q.Max)
+	candidates := make([]ashlet.Candidate, len(cmds))
+	for i, cmd := range cmds {
+		candidates[i] = ashlet.Candidate{Completion: cmd, Confidence: positionConfidence(i)}
+	}
+	return &Completion{Candidates: candidates}, nil
+}
@@ -0,0 +1,218 @@
+package generate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// stubCompleter answers every query with fixed candidates and records the
+// query it was given.
+type stubCompleter struct {
+	candidates []ashlet.Candidate
+	query      *Query
+}
+
+func (s *stubCompleter) Complete(_ context.Context, q *Query) (*Completion, error) {
+	s.query = q
+	return &Completion{Candidates: append([]ashlet.Candidate(nil), s.candidates...)}, nil
+}
+
+func TestCompleterChosenPerRequest(t *testing.T) {
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), dirCache: NewDirCache(), config: ashlet.DefaultConfig()}
+	rules := &stubCompleter{candidates: []ashlet.Candidate{
+		{Completion: "rm -rf /", Confidence: 0.9},
+		{Completion: "rm -i notes.txt", Confidence: 0.8},
+	}}
+	e.SetCompleter("rules", rules)
+
+	// Without a generator the model is not configured...
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: "rm ", CursorPos: 3})
+	if resp.Error == nil || resp.Error.Code != "not_configured" {
+		t.Errorf("default completer without a generator = %+v, want not_configured", resp)
+	}
+
+	// ...but other completers work, and their candidates are post-processed.
+	resp = e.Complete(context.Background(), &ashlet.Request{Input: "  rm ", CursorPos: 5, Completer: "rules", MaxCandidates: 2})
+	if resp.Error != nil || len(resp.Candidates) != 2 {
+		t.Fatalf("rules completer = %+v, want its candidates", resp)
+	}
+	if rules.query.Input != "rm " || rules.query.Max != 2 {
+		t.Errorf("query = %+v, want trimmed input and max 2", rules.query)
+	}
+	for _, c := range resp.Candidates {
+		if c.Diff == nil || (c.Completion == "rm -rf /") != (c.Danger != "") {
+			t.Errorf("candidate was not post-processed: %+v", c)
+		}
+	}
+	if resp.Meta != nil {
+		t.Errorf("meta = %+v, want none without a model", resp.Meta)
+	}
+
+	resp = e.Complete(context.Background(), &ashlet.Request{Input: "rm ", CursorPos: 3, Completer: "history"})
+	if resp.Error != nil {
+		t.Errorf("history completer = %+v, want no error", resp.Error)
+	}
+}
+
+func TestHistoryCompleter(t *testing.T) {
+	q := &Query{
+		Input: "git st",
+		Info:  &Info{RecentCommands: []string{"git status", "ls"}},
+		Max:   4,
+	}
+	got, err := historyCompleter{}.Complete(context.Background(), q)
+	if err != nil || len(got.Candidates) != 1 || got.Candidates[0].Completion != "git status" {
+		t.Errorf("historyCompleter = %+v, %v; want git status", got, err)
+	}
+}
+
+func TestHistoryFallback(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), ".zsh_history")
+	if err := os.WriteFile(hist, []byte(": 1:0;git status\n: 2:0;git stash\n: 3:0;git status\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"upstream down"}`, http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name      string
+		generator *Generator
+	}{
+		{"no api key", nil},
+		{"api unreachable", NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)},
+	} {
+		e := &Engine{gatherer: NewGathererForHistory(nil, nil, hist), generator: tt.generator, dirCache: NewDirCache(), config: ashlet.DefaultConfig()}
+		resp := e.Complete(context.Background(), &ashlet.Request{Input: "git st", CursorPos: 6})
+		if resp.Error != nil || len(resp.Candidates) != 2 {
+			t.Fatalf("%s: response = %+v, want history candidates", tt.name, resp)
+		}
+		if got := resp.Candidates[0].Completion; got != "git status" {
+			t.Errorf("%s: first candidate = %q, want the most frecent command", tt.name, got)
+		}
+		if resp.Meta != nil {
+			t.Errorf("%s: meta = %+v, want none without a model", tt.name, resp.Meta)
+		}
+		e.gatherer.Close()
+	}
+
+	// With no history match, a missing key is still reported.
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, hist), dirCache: NewDirCache(), config: ashlet.DefaultConfig()}
+	defer e.gatherer.Close()
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: "docker ", CursorPos: 7})
+	if resp.Error == nil || resp.Error.Code != "not_configured" {
+		t.Errorf("unmatched input = %+v, want not_configured", resp)
+	}
+}
+
+func TestNeverSuggest(t *testing.T) {
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.NeverSuggest = []string{"rm -rf /", "telnet"}
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), dirCache: NewDirCache(), config: cfg, customPrompt: "Complete the command."}
+	e.SetCompleter("rules", &stubCompleter{candidates: []ashlet.Candidate{
+		{Completion: "rm -fr /", Confidence: 0.9},
+		{Completion: "rm -rf ./build", Confidence: 0.8},
+		{Completion: "rm -rf / && telnet bbs", Confidence: 0.7},
+	}})
+
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: "rm ", CursorPos: 3, Completer: "rules"})
+	if len(resp.Candidates) != 1 || resp.Candidates[0].Completion != "rm -rf ./build" {
+		t.Errorf("candidates = %+v, want the never-suggest commands dropped", resp.Candidates)
+	}
+
+	// Custom templates get the list too.
+	if prompt := e.buildSystemPrompt(4, ""); !strings.HasSuffix(prompt, "- `rm -rf /`\n- `telnet`") {
+		t.Errorf("system prompt = %q, want the never-suggest list appended", prompt)
+	}
+}
+
+func TestCompleteVerboseScores(t *testing.T) {
+	cfg := ashlet.DefaultConfig()
+	cfg.Rank.Strategy = "learned"
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), dirCache: NewDirCache(), config: cfg, feedback: NewFeedbackStore("")}
+	for range feedbackMinEvents {
+		e.feedback.Record(&ashlet.FeedbackRequest{Event: "accepted", Candidate: "git status"})
+		e.feedback.Record(&ashlet.FeedbackRequest{Event: "rejected", Candidate: "git stash"})
+	}
+	e.SetCompleter("rules", &stubCompleter{candidates: []ashlet.Candidate{
+		{Completion: "git stash", Confidence: 0.95},
+		{Completion: "git status", Confidence: 0.8},
+	}})
+	req := func() *ashlet.Request {
+		return &ashlet.Request{Input: "git st", CursorPos: 6, Completer: "rules"}
+	}
+
+	resp := e.CompleteVerbose(context.Background(), req()).Response
+	if len(resp.Candidates) != 2 || resp.Candidates[0].Completion != "git status" {
+		t.Fatalf("candidates = %+v, want the accepted shape first", resp.Candidates)
+	}
+	first, second := resp.Candidates[0].Score, resp.Candidates[1].Score
+	if first == nil || second == nil {
+		t.Fatalf("verbose candidates should carry scores, got %+v", resp.Candidates)
+	}
+	if first.Position != 0.8 || first.Learned <= 0 {
+		t.Errorf("first score = %+v, want position 0.8 and a learned boost", first)
+	}
+	if second.Position != 0.95 || second.Learned >= 0 {
+		t.Errorf("second score = %+v, want position 0.95 and a learned penalty", second)
+	}
+
+	for _, c := range e.Complete(context.Background(), req()).Candidates {
+		if c.Score != nil {
+			t.Errorf("non-verbose candidate %q carries a score", c.Completion)
+		}
+	}
+}
+
+func TestCompleteDiversifiesQuoteVariants(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), ".zsh_history")
+	content := ": 1:0;git commit -m \"wip\" && git push\n: 2:0;git commit -m \"release\" --amend\n"
+	if err := os.WriteFile(hist, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, hist), dirCache: NewDirCache(), config: ashlet.DefaultConfig()}
+	defer e.gatherer.Close()
+	e.SetCompleter("rules", &stubCompleter{candidates: []ashlet.Candidate{
+		{Completion: `git commit -m "fix parser"`, Confidence: 0.95},
+		{Completion: `git commit -m "fix the parser"`, Confidence: 0.8},
+		{Completion: `git commit -m "parser fix"`, Confidence: 0.65},
+	}})
+
+	input := `git commit -m "`
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: input, CursorPos: len(input), Completer: "rules", MaxCandidates: 3})
+	var got []string
+	for _, c := range resp.Candidates {
+		got = append(got, c.Completion)
+	}
+	want := []string{`git commit -m "release" --amend`, `git commit -m "wip" && git push`}
+	if len(got) != 3 || !strings.HasPrefix(got[0], `git commit -m "`) || !slices.Contains(got, want[0]) || !slices.Contains(got, want[1]) {
+		t.Errorf("candidates = %q, want one message variant topped up with %q", got, want)
+	}
+}
+
+func TestCompleteKeepsOtherShellSyntax(t *testing.T) {
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, filepath.Join(t.TempDir(), "none")), dirCache: NewDirCache(), config: ashlet.DefaultConfig()}
+	defer e.gatherer.Close()
+	fishLoop := "for f in *.go; gofmt -w $f; end"
+	e.SetCompleter("rules", &stubCompleter{candidates: []ashlet.Candidate{{Completion: fishLoop, Confidence: 0.9}}})
+
+	input := "for f in"
+	req := &ashlet.Request{Input: input, CursorPos: len(input), Completer: "rules"}
+	if resp := e.Complete(context.Background(), req); len(resp.Candidates) != 0 {
+		t.Errorf("zsh: a loop bash cannot parse should be dropped, got %+v", resp.Candidates)
+	}
+	req.Shell = "fish"
+	resp := e.Complete(context.Background(), req)
+	if len(resp.Candidates) != 1 || resp.Candidates[0].Completion != fishLoop {
+		t.Errorf("fish: candidates = %+v, want the fish loop unchanged", resp.Candidates)
+	}
+}
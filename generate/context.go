@@ -2,32 +2,76 @@ package generate
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
 	"github.com/Paranoid-AF/ashlet/index"
 )
 
 // Info holds gathered context for a completion request.
 type Info struct {
-	RecentCommands   []string
+	RecentCommands   []string // distinct recent commands, the most frecent first
 	RelevantCommands []string
+	RecentHere       []string // commands that last ran in the cwd and succeeded, most recent first
+	LastFailure      string   // e.g. "`make test` failed with exit 2"; empty if the last command succeeded
+	// Elapsed is how long gathering took, for verbose responses.
+	Elapsed time.Duration
 }
 
 // Gatherer collects context for completion requests.
 type Gatherer struct {
 	historyIndexer   *index.Indexer
+	reported         *index.ReportedHistory // nil unless history_source is "shell"
 	embeddingEnabled bool
 	noRawHistory     bool
 }
 
-// NewGatherer creates a new context gatherer.
+// NewGatherer creates a new context gatherer for the current user's history.
 // embedder may be nil to disable semantic features.
 func NewGatherer(embedder *index.Embedder, cfg *ashlet.Config) *Gatherer {
+	return newGatherer(embedder, cfg, historySource(cfg, ashlet.Paths{}), gathererOptions{})
+}
+
+// NewGathererForHistory creates a context gatherer reading historyPath.
+func NewGathererForHistory(embedder *index.Embedder, cfg *ashlet.Config, historyPath string) *Gatherer {
+	return newGatherer(embedder, cfg, index.NewFileHistory(historyPath), gathererOptions{})
+}
+
+// gathererOptions are what an engine gives its gatherer beyond the config.
+type gathererOptions struct {
+	// sched is what background indexing yields to interactive work on.
+	sched *index.Scheduler
+	// cachePath is where the embedding index is kept (see OpenIndexCache);
+	// empty keeps none.
+	cachePath string
+	// ignore are exclude patterns (see index.Indexer.SetExcludePatterns)
+	// besides embedding.exclude_patterns.
+	ignore []string
+	// anonymizer rewrites commands before they are embedded; nil leaves
+	// them as they are.
+	anonymizer *core.Anonymizer
+}
+
+// newGatherer creates a context gatherer reading history from src. A cache
+// in opts is opened before indexing starts, so cached commands are not
+// embedded again.
+func newGatherer(embedder *index.Embedder, cfg *ashlet.Config, src index.HistorySource, opts gathererOptions) *Gatherer {
 	var maxHistory int
 	var ttlMinutes int
 	var noRawHistory bool
+	var watermark string
+	var dedupe float64
+	var maxIndex int
+	var eviction string
+	var ageHalfLifeDays float64
+	var exclude []string
 	embeddingEnabled := embedder != nil
 	if cfg != nil {
 		maxHistory = cfg.Embedding.MaxHistoryCommands
@@ -35,6 +79,12 @@ func NewGatherer(embedder *index.Embedder, cfg *ashlet.Config) *Gatherer {
 		if cfg.Generation.NoRawHistory != nil {
 			noRawHistory = *cfg.Generation.NoRawHistory
 		}
+		watermark = cfg.Generation.WatermarkedHistory
+		dedupe = cfg.Embedding.DedupeThreshold
+		maxIndex = cfg.Embedding.MaxIndexSize
+		eviction = cfg.Embedding.Eviction
+		ageHalfLifeDays = cfg.Embedding.AgeHalfLifeDays
+		exclude = cfg.Embedding.ExcludePatterns
 	}
 	if maxHistory == 0 {
 		maxHistory = 3000
@@ -42,13 +92,36 @@ func NewGatherer(embedder *index.Embedder, cfg *ashlet.Config) *Gatherer {
 	if ttlMinutes == 0 {
 		ttlMinutes = 60
 	}
+	if dedupe == 0 {
+		dedupe = 0.95
+	}
+	if maxIndex == 0 {
+		maxIndex = 10000
+	}
+	if ageHalfLifeDays == 0 {
+		ageHalfLifeDays = 90
+	}
 
 	g := &Gatherer{
-		historyIndexer:   index.NewIndexer(embedder, maxHistory, time.Duration(ttlMinutes)*time.Minute),
+		historyIndexer:   index.NewIndexerForSource(embedder, maxHistory, time.Duration(ttlMinutes)*time.Minute, src),
 		embeddingEnabled: embeddingEnabled,
 		noRawHistory:     noRawHistory,
 	}
+	g.reported, _ = src.(*index.ReportedHistory)
 
+	g.historyIndexer.SetScheduler(opts.sched)
+	g.historyIndexer.SetWatermarkPolicy(watermark)
+	g.historyIndexer.SetDedupeThreshold(dedupe)
+	g.historyIndexer.SetMaxSize(maxIndex, eviction)
+	g.historyIndexer.SetAgeHalfLife(time.Duration(ageHalfLifeDays * float64(24*time.Hour)))
+	g.historyIndexer.SetParallelism(embedParallelism(cfg))
+	g.historyIndexer.SetExcludePatterns(slices.Concat(exclude, opts.ignore))
+	g.historyIndexer.SetAnonymizer(opts.anonymizer)
+	if embeddingEnabled && opts.cachePath != "" {
+		if err := g.historyIndexer.OpenCache(opts.cachePath); err != nil {
+			slog.Warn("failed to open embedding cache", "path", opts.cachePath, "error", err)
+		}
+	}
 	if embeddingEnabled {
 		go g.historyIndexer.StartRefreshLoop()
 	}
@@ -56,9 +129,87 @@ func NewGatherer(embedder *index.Embedder, cfg *ashlet.Config) *Gatherer {
 	return g
 }
 
+// embedParallelism returns how many embedding requests indexing keeps in
+// flight, per embedding.parallelism.
+func embedParallelism(cfg *ashlet.Config) int {
+	if cfg == nil || cfg.Embedding.Parallelism == 0 {
+		return 4
+	}
+	return cfg.Embedding.Parallelism
+}
+
+// historySource returns the history generation.history_source selects for
+// the user paths locate: the history the shell reports, Atuin's database,
+// or else the history files, merged, read through paths.Open. A missing
+// Atuin database falls back to the history files, as does Atuin for paths
+// with an Owner.
+func historySource(cfg *ashlet.Config, paths ashlet.Paths) index.HistorySource {
+	home := paths.Home
+	if cfg != nil && cfg.Generation.HistorySource == "shell" {
+		return index.NewReportedHistory(paths.ReportedHistoryPath())
+	}
+	if cfg != nil && cfg.Generation.HistorySource == "atuin" && paths.Owner != "" {
+		// SQLite opens the database by path, which cannot be checked to
+		// belong to the user the way history files are (see
+		// ashlet.Paths.Open).
+		slog.Warn("atuin history is not read for another user, reading history files")
+	} else if cfg != nil && cfg.Generation.HistorySource == "atuin" {
+		path := expandHome(cfg.Generation.AtuinDB, home)
+		if path == "" {
+			path = index.ResolveAtuinPath(home)
+		}
+		if _, err := os.Stat(path); err == nil {
+			return index.NewAtuinHistory(path)
+		}
+		slog.Warn("atuin history database not found, reading history files", "path", path)
+	}
+	return index.NewHistoryFilesOpenedWith(historyFiles(cfg, home), paths.Open)
+}
+
+// historyIgnore returns exclude patterns for the commands the shell's own
+// history settings ignore, $HISTIGNORE (bash) and $HISTORY_IGNORE (zsh),
+// when they are in the environment. A daemon serving another user (paths
+// with a Home) has not got that user's environment.
+func historyIgnore(paths ashlet.Paths) []string {
+	if paths.Home != "" {
+		return nil
+	}
+	return index.HistoryIgnorePatterns(os.Getenv("HISTIGNORE"), os.Getenv("HISTORY_IGNORE"))
+}
+
+// historyFiles returns the files of generation.history_files that exist,
+// or the default history files under home when none are configured.
+func historyFiles(cfg *ashlet.Config, home string) []string {
+	if cfg == nil || len(cfg.Generation.HistoryFiles) == 0 {
+		return index.ResolveHistoryPaths(home)
+	}
+	var paths []string
+	for _, path := range cfg.Generation.HistoryFiles {
+		path = expandHome(path, home)
+		if _, err := os.Stat(path); err != nil {
+			slog.Warn("history file not found", "path", path)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// expandHome replaces a leading ~ in path with home, or the current user's
+// home directory when home is empty.
+func expandHome(path, home string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	if home == "" {
+		home, _ = os.UserHomeDir()
+	}
+	return filepath.Join(home, path[1:])
+}
+
 // Gather collects context based on the completion request.
 func (g *Gatherer) Gather(ctx context.Context, req *ashlet.Request) *Info {
-	info := &Info{}
+	info := &Info{LastFailure: describeLastFailure(req.LastCommand, req.ExitCode)}
 
 	if g.noRawHistory && g.embeddingEnabled {
 		// Block-wait for indexing to complete (up to 10s), then return only relevant commands.
@@ -66,7 +217,7 @@ func (g *Gatherer) Gather(ctx context.Context, req *ashlet.Request) *Info {
 		defer timer.Stop()
 		select {
 		case <-g.historyIndexer.InitDone():
-			if cmds, err := g.historyIndexer.SearchRelevant(req.Input, 20); err == nil && len(cmds) > 0 {
+			if cmds, err := g.historyIndexer.SearchRelevant(req.Input, req.Cwd, 20); err == nil && len(cmds) > 0 {
 				info.RelevantCommands = cmds
 			}
 		case <-timer.C:
@@ -79,12 +230,15 @@ func (g *Gatherer) Gather(ctx context.Context, req *ashlet.Request) *Info {
 
 	// Default: include recent commands
 	info.RecentCommands = g.historyIndexer.RecentCommands(20)
+	info.RecentHere = g.historyIndexer.RecentIn(req.Cwd, maxRecentShown)
 
 	if g.embeddingEnabled {
 		// Non-blocking semantic search if indexing has completed
 		select {
 		case <-g.historyIndexer.InitDone():
-			if cmds, err := g.historyIndexer.SearchRelevant(req.Input, 20); err == nil && len(cmds) > 0 {
+			// Leave out what the recent commands in the prompt already show.
+			shown := info.RecentCommands[:min(len(info.RecentCommands), maxRecentShown)]
+			if cmds, err := g.historyIndexer.SearchRelevantExcluding(req.Input, req.Cwd, 20, shown); err == nil && len(cmds) > 0 {
 				info.RelevantCommands = cmds
 			}
 		default:
@@ -95,25 +249,102 @@ func (g *Gatherer) Gather(ctx context.Context, req *ashlet.Request) *Info {
 	return info
 }
 
-// LoadIndexCache loads a previously saved embedding cache from disk.
-func (g *Gatherer) LoadIndexCache(path string) error {
-	model := g.historyIndexer.EmbeddingModel()
-	if model == "" {
-		return nil
+// NoteExecuted indexes a command the shell just ran in the background, so
+// it can already be found as a related command on the next completions.
+// Commands with a leading space, which the shell keeps out of history, are
+// not indexed.
+func (g *Gatherer) NoteExecuted(cmd string) {
+	g.NoteExecutedIn(cmd, "")
+}
+
+// NoteExecutedIn is NoteExecuted for a command known to have run in cwd,
+// which related-command searches from cwd then favour.
+func (g *Gatherer) NoteExecutedIn(cmd, cwd string) {
+	if !g.embeddingEnabled || strings.TrimSpace(cmd) == "" || strings.HasPrefix(cmd, " ") {
+		return
 	}
-	return g.historyIndexer.LoadCache(path, model)
+	go func() {
+		if err := g.historyIndexer.IndexRun(cmd, cwd); err != nil {
+			slog.Debug("indexing executed command failed", "error", err)
+		}
+	}()
 }
 
-// SaveIndexCache writes the current embedding index to disk.
-func (g *Gatherer) SaveIndexCache(path string) error {
-	model := g.historyIndexer.EmbeddingModel()
-	if model == "" {
-		return nil
+// RecordHistory learns that the shell ran entry's command: it is added to
+// the reported history when that is the history source, and indexed like
+// NoteExecutedIn.
+func (g *Gatherer) RecordHistory(entry index.HistoryEntry) {
+	if g.reported != nil {
+		g.reported.Add(entry)
 	}
-	return g.historyIndexer.SaveCache(path, model)
+	g.NoteExecutedIn(entry.Command, entry.Cwd)
+}
+
+// HistoryMatches returns up to n history commands extending prefix, the
+// most frecent first.
+func (g *Gatherer) HistoryMatches(prefix string, n int) []string {
+	return g.historyIndexer.PrefixMatches(prefix, n)
+}
+
+// CommandFrecency scores the commands run in recent history, the most
+// frecent highest.
+func (g *Gatherer) CommandFrecency() map[string]float64 {
+	return g.historyIndexer.CommandFrecency()
+}
+
+// OpenIndexCache keeps the embedding index in the SQLite database at path,
+// so commands embedded before are not embedded again (see
+// index.Indexer.OpenCache).
+func (g *Gatherer) OpenIndexCache(path string) error {
+	return g.historyIndexer.OpenCache(path)
+}
+
+// IndexedCommands returns the number of history commands in the semantic
+// index.
+func (g *Gatherer) IndexedCommands() int {
+	return g.historyIndexer.Len()
+}
+
+// CacheRebuilds returns how many times the embedding cache was emptied
+// (see index.Indexer.CacheRebuilds).
+func (g *Gatherer) CacheRebuilds() int64 {
+	return g.historyIndexer.CacheRebuilds()
 }
 
 // Close releases resources held by the gatherer.
 func (g *Gatherer) Close() {
 	g.historyIndexer.Close()
 }
+
+// describeLastFailure summarises a failed previous command for the prompt,
+// or returns "" when it succeeded or is unknown. The command is redacted
+// like history.
+func describeLastFailure(cmd string, exitCode int) string {
+	cmd = strings.TrimSpace(cmd)
+	if cmd == "" || exitCode == 0 {
+		return ""
+	}
+	desc := fmt.Sprintf("`%s` failed with exit %d", core.RedactCommand(cmd), exitCode)
+	switch {
+	case exitCode == 126:
+		desc += " (not executable)"
+	case exitCode == 127:
+		desc += " (command not found)"
+	case exitCode == 130:
+		desc += " (interrupted)"
+	case exitCode > 128 && exitCode < 128+32:
+		desc += fmt.Sprintf(" (killed by signal %d)", exitCode-128)
+	}
+	return desc
+}
+
+// formatDate renders t for the prompt's date section, to the minute, e.g.
+// "2026-05-01 Fri 14:03 +0200 (CEST)". Zones without an abbreviation show
+// only the offset.
+func formatDate(t time.Time) string {
+	date := t.Format("2006-01-02 Mon 15:04 -0700")
+	if name, _ := t.Zone(); name != "" && name[0] != '+' && name[0] != '-' {
+		date += " (" + name + ")"
+	}
+	return date
+}
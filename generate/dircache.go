@@ -9,35 +9,40 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/jellydator/ttlcache/v3"
+
+	"github.com/Paranoid-AF/ashlet/core"
 )
 
 // DirContext holds gathered context for one directory.
-type DirContext struct {
-	CwdPath        string
-	CwdListing     string            // ls -A output (space-separated, no . or ..)
-	CwdManifests   map[string]string // filename label -> extracted content
-	PackageManager string            // detected from lockfile (pnpm, yarn, bun, npm, cargo)
-	GitRootListing string
-	GitStagedFiles string
-	GitManifests   map[string]string // manifest files at git root (if different from cwd)
-}
+type DirContext = core.DirContext
 
 const (
-	dirCacheTTL      = 1 * time.Hour
-	gatherTimeout    = 5 * time.Second
-	manifestMaxBytes = 512
-	fieldMaxBytes    = 512
+	dirCacheTTL   = 1 * time.Hour
+	gatherTimeout = 5 * time.Second
+	// Byte caps only bound gathering; the prompt token budget decides how
+	// much of each field reaches the model.
+	manifestMaxBytes = 2048
+	fieldMaxBytes    = 2048
 )
 
 // DirCache is a TTL cache of DirContext entries keyed by absolute path.
 type DirCache struct {
-	cache *ttlcache.Cache[string, *DirContext]
+	cache     *ttlcache.Cache[string, *DirContext]
+	sensitive []string // absolute directories never gathered
+
+	mu     sync.Mutex
+	prints map[string]string // path -> fingerprint key of its cached entry
+
+	hits, misses atomic.Int64 // lookups by Get
 }
 
 // NewDirCache creates a new DirCache with TTL-based expiration.
@@ -47,7 +52,7 @@ func NewDirCache() *DirCache {
 		ttlcache.WithDisableTouchOnHit[string, *DirContext](),
 	)
 	go c.Start()
-	return &DirCache{cache: c}
+	return &DirCache{cache: c, prints: make(map[string]string)}
 }
 
 // Close stops the cache expiration loop.
@@ -55,17 +60,83 @@ func (dc *DirCache) Close() {
 	dc.cache.Stop()
 }
 
+// SetSensitiveDirs sets the directories, with everything below them, that
+// Gather refuses to read. A leading ~ in dirs is replaced by home. Both the
+// path as given and its symlink target are protected. Call before the cache
+// is used.
+func (dc *DirCache) SetSensitiveDirs(dirs []string, home string) {
+	dc.sensitive = nil
+	for _, dir := range dirs {
+		if dir == "~" || strings.HasPrefix(dir, "~/") {
+			if home == "" {
+				continue
+			}
+			dir = filepath.Join(home, dir[1:])
+		}
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		dir = filepath.Clean(dir)
+		dc.sensitive = append(dc.sensitive, dir)
+		if real, err := filepath.EvalSymlinks(dir); err == nil && real != dir {
+			dc.sensitive = append(dc.sensitive, real)
+		}
+	}
+}
+
+// isSensitive reports whether path is in or below a sensitive directory,
+// directly or through a symlink.
+func (dc *DirCache) isSensitive(path string) bool {
+	if len(dc.sensitive) == 0 {
+		return false
+	}
+	paths := []string{filepath.Clean(path)}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		paths = append(paths, real)
+	}
+	for _, p := range paths {
+		for _, dir := range dc.sensitive {
+			if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Get returns the cached DirContext for the given path, or nil if not cached/expired.
 func (dc *DirCache) Get(absPath string) *DirContext {
 	item := dc.cache.Get(absPath)
 	if item == nil {
+		dc.misses.Add(1)
 		return nil
 	}
+	dc.hits.Add(1)
 	return item.Value()
 }
 
+// Stats returns how many Get calls found a cached entry, and how many did
+// not.
+func (dc *DirCache) Stats() (hits, misses int64) {
+	return dc.hits.Load(), dc.misses.Load()
+}
+
 // Gather collects directory context for the given path and caches it.
+// A cached entry is kept while the directory's ContextFingerprint is
+// unchanged. Sensitive directories (see SetSensitiveDirs) are left alone,
+// so prompts sent from them carry no listing, manifests, or git metadata.
 func (dc *DirCache) Gather(ctx context.Context, cwd string) {
+	if dc.isSensitive(cwd) {
+		slog.Debug("not gathering context in sensitive directory", "cwd", cwd)
+		return
+	}
+	printKey := Fingerprint(cwd, nil).Key()
+	dc.mu.Lock()
+	unchanged := dc.prints[cwd] == printKey
+	dc.mu.Unlock()
+	if unchanged && dc.cache.Get(cwd) != nil {
+		return
+	}
 	ctx, cancel := context.WithTimeout(ctx, gatherTimeout)
 	defer cancel()
 
@@ -100,6 +171,14 @@ func (dc *DirCache) Gather(ctx context.Context, cwd string) {
 		ch <- result{"git_root", out}
 	}()
 
+	// tracked files of the whole repository, for the language summary
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		out := runCmd(ctx, cwd, "git", "ls-files", ":/")
+		ch <- result{"git_files", out}
+	}()
+
 	// git staged (single-line, space-separated, with change types)
 	wg.Add(1)
 	go func() {
@@ -114,7 +193,7 @@ func (dc *DirCache) Gather(ctx context.Context, cwd string) {
 		close(ch)
 	}()
 
-	var gitRoot string
+	var gitRoot, gitFiles string
 	for r := range ch {
 		switch r.key {
 		case "cwd_listing":
@@ -123,9 +202,19 @@ func (dc *DirCache) Gather(ctx context.Context, cwd string) {
 			gitRoot = r.val
 		case "git_staged":
 			entry.GitStagedFiles = r.val
+		case "git_files":
+			gitFiles = r.val
 		}
 	}
 
+	// Outside a git repository, the directory listing stands in for the
+	// tracked files.
+	if gitFiles != "" {
+		entry.Languages = summarizeLanguages(strings.Split(gitFiles, "\n"))
+	} else {
+		entry.Languages = summarizeLanguages(strings.Fields(entry.CwdListing))
+	}
+
 	// After git root is known, gather git-root listing and manifests
 	if gitRoot != "" && gitRoot != cwd {
 		out := runCmd(ctx, gitRoot, "ls", "-A")
@@ -139,11 +228,40 @@ func (dc *DirCache) Gather(ctx context.Context, cwd string) {
 	// Detect package manager
 	entry.PackageManager = detectPackageManager(cwd, gitRoot)
 
+	// Detect nix flake / shell.nix
+	entry.Nix = detectNix(cwd, gitRoot)
+
+	// Terraform workspace context (cwd only: terraform runs per directory)
+	entry.Terraform = gatherTerraform(cwd)
+
 	dc.cache.Set(cwd, entry, ttlcache.DefaultTTL)
+	dc.mu.Lock()
+	dc.prints[cwd] = printKey
+	dc.mu.Unlock()
 
 	slog.Debug("gathered directory context", "path", cwd)
 }
 
+// IsLocalHost reports whether host names the machine the daemon runs on.
+// An empty host (older clients) is assumed local. Only the first DNS label
+// is compared, since shells may report a short name and the OS an FQDN.
+func IsLocalHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	local, err := os.Hostname()
+	if err != nil {
+		return true
+	}
+	short := func(h string) string {
+		if i := strings.IndexByte(h, '.'); i >= 0 {
+			h = h[:i]
+		}
+		return strings.ToLower(h)
+	}
+	return short(host) == short(local)
+}
+
 // runCmd runs a command and returns its stdout, or empty string on error.
 func runCmd(ctx context.Context, dir string, name string, args ...string) string {
 	cmd := exec.CommandContext(ctx, name, args...)
@@ -164,6 +282,7 @@ var manifestFiles = []string{
 	"pyproject.toml",
 	"go.mod",
 	"CMakeLists.txt",
+	"flake.nix",
 }
 
 func gatherManifests(dir string, out map[string]string) {
@@ -195,6 +314,8 @@ func gatherManifests(dir string, out map[string]string) {
 			extracted = extractPyprojectInfo(string(data))
 		case "CMakeLists.txt":
 			extracted = extractCMakeInfo(string(data))
+		case "flake.nix":
+			extracted = extractFlakeOutputs(string(data))
 		}
 
 		if extracted != "" {
@@ -205,6 +326,8 @@ func gatherManifests(dir string, out map[string]string) {
 				label = "Makefile targets"
 			} else if name == "justfile" {
 				label = "justfile recipes"
+			} else if name == "flake.nix" {
+				label = "flake outputs"
 			}
 			out[label] = extracted
 		}
@@ -354,6 +477,226 @@ func detectPackageManager(cwd, gitRoot string) string {
 	return ""
 }
 
+// nixFiles maps nix entry-point files to the project type they indicate.
+// Ordered by priority (flakes take precedence over legacy shell.nix).
+var nixFiles = []struct {
+	file string
+	kind string
+}{
+	{"flake.nix", "flake"},
+	{"shell.nix", "shell"},
+	{"default.nix", "shell"},
+}
+
+// detectNix detects a nix flake or legacy shell.nix project.
+// Checks cwd first, then git root.
+func detectNix(cwd, gitRoot string) string {
+	for _, dir := range []string{cwd, gitRoot} {
+		if dir == "" {
+			continue
+		}
+		for _, nf := range nixFiles {
+			if _, err := os.Stat(filepath.Join(dir, nf.file)); err == nil {
+				return nf.kind
+			}
+		}
+	}
+	return ""
+}
+
+const (
+	// languageMaxFiles caps the paths counted for the language summary.
+	languageMaxFiles = 20000
+	// languageMaxShown is the number of languages named in the summary.
+	languageMaxShown = 4
+	// languageMinPercent drops languages with a smaller share of files.
+	languageMinPercent = 2
+)
+
+// languageByExt maps source file extensions to the language name shown in
+// the language summary.
+var languageByExt = map[string]string{
+	".go":     "Go",
+	".rs":     "Rust",
+	".py":     "Python",
+	".js":     "JavaScript",
+	".jsx":    "JavaScript",
+	".mjs":    "JavaScript",
+	".cjs":    "JavaScript",
+	".ts":     "TypeScript",
+	".tsx":    "TypeScript",
+	".vue":    "Vue",
+	".svelte": "Svelte",
+	".rb":     "Ruby",
+	".java":   "Java",
+	".kt":     "Kotlin",
+	".scala":  "Scala",
+	".swift":  "Swift",
+	".c":      "C",
+	".h":      "C",
+	".cc":     "C++",
+	".cpp":    "C++",
+	".cxx":    "C++",
+	".hpp":    "C++",
+	".cs":     "C#",
+	".php":    "PHP",
+	".ex":     "Elixir",
+	".exs":    "Elixir",
+	".erl":    "Erlang",
+	".hs":     "Haskell",
+	".ml":     "OCaml",
+	".clj":    "Clojure",
+	".dart":   "Dart",
+	".zig":    "Zig",
+	".lua":    "Lua",
+	".sh":     "Shell",
+	".bash":   "Shell",
+	".zsh":    "Shell",
+	".nix":    "Nix",
+	".tf":     "Terraform",
+}
+
+// summarizeLanguages counts paths by source language and summarizes the
+// largest shares in one line, e.g. "Go 70%, Shell 20%, TypeScript 10%".
+// Files in languages it does not know (docs, config, images) are ignored.
+func summarizeLanguages(paths []string) string {
+	if len(paths) > languageMaxFiles {
+		paths = paths[:languageMaxFiles]
+	}
+	counts := make(map[string]int)
+	total := 0
+	for _, p := range paths {
+		lang, ok := languageByExt[strings.ToLower(filepath.Ext(p))]
+		if !ok {
+			continue
+		}
+		counts[lang]++
+		total++
+	}
+	if total == 0 {
+		return ""
+	}
+
+	langs := make([]string, 0, len(counts))
+	for lang := range counts {
+		langs = append(langs, lang)
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		if counts[langs[i]] != counts[langs[j]] {
+			return counts[langs[i]] > counts[langs[j]]
+		}
+		return langs[i] < langs[j]
+	})
+
+	var parts []string
+	for _, lang := range langs {
+		percent := counts[lang] * 100 / total
+		if len(parts) == languageMaxShown || percent < languageMinPercent {
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s %d%%", lang, percent))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// reFlakeOutput matches flake output attribute definitions such as
+// "packages.default =", "apps.${system}.serve =", or
+// "devShells.x86_64-linux.ci =".
+var reFlakeOutput = regexp.MustCompile(`\b(packages|apps|devShells)(?:\.\$\{?system\}?|\.[A-Za-z0-9_]+-(?:linux|darwin))?\.([A-Za-z0-9_-]+)\s*=`)
+
+// extractFlakeOutputs summarizes the packages, apps, and devShells declared
+// in a flake.nix without evaluating it (e.g. "apps: serve; packages: default").
+func extractFlakeOutputs(content string) string {
+	groups := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, m := range reFlakeOutput.FindAllStringSubmatch(content, -1) {
+		// Skip per-system attribute sets ("packages.x86_64-linux = { ... }")
+		if strings.HasSuffix(m[2], "-linux") || strings.HasSuffix(m[2], "-darwin") {
+			continue
+		}
+		key := m[1] + "." + m[2]
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		groups[m[1]] = append(groups[m[1]], m[2])
+	}
+	var parts []string
+	for _, kind := range []string{"apps", "packages", "devShells"} {
+		if names := groups[kind]; len(names) > 0 {
+			parts = append(parts, kind+": "+strings.Join(names, ", "))
+		}
+	}
+	return truncate(strings.Join(parts, "; "), manifestMaxBytes)
+}
+
+const tfMaxFiles = 20
+
+var (
+	reTFBackend  = regexp.MustCompile(`(?m)^\s*backend\s+"([A-Za-z0-9_-]+)"`)
+	reTFResource = regexp.MustCompile(`(?m)^\s*resource\s+"([A-Za-z0-9_-]+)"\s+"([A-Za-z0-9_-]+)"`)
+	reTFModule   = regexp.MustCompile(`(?m)^\s*module\s+"([A-Za-z0-9_-]+)"`)
+)
+
+// gatherTerraform summarizes a terraform (or terragrunt) working directory:
+// the selected workspace, the configured backend type, and resource/module
+// addresses usable with -target. Returns empty when dir has no .tf files.
+func gatherTerraform(dir string) string {
+	tfFiles, _ := filepath.Glob(filepath.Join(dir, "*.tf"))
+	_, err := os.Stat(filepath.Join(dir, "terragrunt.hcl"))
+	terragrunt := err == nil
+	if len(tfFiles) == 0 && !terragrunt {
+		return ""
+	}
+	if len(tfFiles) > tfMaxFiles {
+		tfFiles = tfFiles[:tfMaxFiles]
+	}
+
+	var parts []string
+	if terragrunt {
+		parts = append(parts, "terragrunt")
+	}
+
+	// `terraform workspace select` writes the name to .terraform/environment;
+	// its absence means the default workspace.
+	workspace := "default"
+	if data, err := os.ReadFile(filepath.Join(dir, ".terraform", "environment")); err == nil {
+		if ws := strings.TrimSpace(string(data)); ws != "" {
+			workspace = ws
+		}
+	}
+	parts = append(parts, "workspace: "+workspace)
+
+	var backend string
+	var targets []string
+	for _, path := range tfFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		content := string(data)
+		if backend == "" {
+			if m := reTFBackend.FindStringSubmatch(content); m != nil {
+				backend = m[1]
+			}
+		}
+		for _, m := range reTFModule.FindAllStringSubmatch(content, -1) {
+			targets = append(targets, "module."+m[1])
+		}
+		for _, m := range reTFResource.FindAllStringSubmatch(content, -1) {
+			targets = append(targets, m[1]+"."+m[2])
+		}
+	}
+	if backend != "" {
+		parts = append(parts, "backend: "+backend)
+	}
+	if len(targets) > 0 {
+		parts = append(parts, "targets: "+strings.Join(targets, " "))
+	}
+
+	return truncate(strings.Join(parts, ", "), fieldMaxBytes)
+}
+
 // parseStagedFiles parses `git diff --cached --name-status` output into a
 // space-separated string with change-type prefixes (e.g. "M:file.go A:new.go").
 func parseStagedFiles(s string, maxBytes int) string {
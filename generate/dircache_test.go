@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -92,6 +93,70 @@ func TestDirCacheGatherPopulatesListing(t *testing.T) {
 	}
 }
 
+func TestDirCacheGatherSkipsSensitiveDirs(t *testing.T) {
+	dc := NewDirCache()
+	defer dc.Close()
+
+	home := t.TempDir()
+	ssh := filepath.Join(home, ".ssh", "keys")
+	os.MkdirAll(ssh, 0700)
+	os.WriteFile(filepath.Join(ssh, "id_ed25519"), []byte("secret"), 0600)
+	link := filepath.Join(home, "keys")
+	os.Symlink(ssh, link)
+	dc.SetSensitiveDirs([]string{"~/.ssh", "relative/ignored"}, home)
+
+	for _, dir := range []string{filepath.Join(home, ".ssh"), ssh, link} {
+		dc.Gather(context.Background(), dir)
+		if got := dc.Get(dir); got != nil {
+			t.Errorf("Gather(%q) should be refused, got %+v", dir, got)
+		}
+	}
+
+	dc.Gather(context.Background(), home)
+	if dc.Get(home) == nil {
+		t.Error("the home directory itself should still be gathered")
+	}
+}
+
+func TestDirCacheGatherLanguagesWithoutGit(t *testing.T) {
+	dc := NewDirCache()
+	defer dc.Close()
+
+	dir := t.TempDir()
+	for _, name := range []string{"main.go", "util.go", "build.sh", "README.md"} {
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+
+	dc.Gather(context.Background(), dir)
+	got := dc.Get(dir)
+	if got == nil {
+		t.Fatal("expected entry")
+	}
+	if got.Languages != "Go 66%, Shell 33%" {
+		t.Errorf("Languages = %q, want summary of the listing", got.Languages)
+	}
+}
+
+func TestSummarizeLanguages(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"README.md", "LICENSE", "logo.png"}, ""},
+		{[]string{"src/main.rs", "src/lib.rs", "web/app.tsx", "web/index.ts", "web/util.js", "Cargo.toml"}, "Rust 40%, TypeScript 40%, JavaScript 20%"},
+		{[]string{"a.C", "b.h", "c.cpp"}, "C 66%, C++ 33%"},
+		// Only the largest few shares are named, and slivers are dropped.
+		{append(slices.Repeat([]string{"x.go"}, 60), "a.py", "b.rb", "c.lua", "d.zig", "e.nix"), "Go 92%"},
+		{[]string{"a.go", "b.py", "c.rb", "d.lua", "e.zig"}, "Go 20%, Lua 20%, Python 20%, Ruby 20%"},
+	}
+	for _, tt := range tests {
+		if got := summarizeLanguages(tt.paths); got != tt.want {
+			t.Errorf("summarizeLanguages(%v) = %q, want %q", tt.paths, got, tt.want)
+		}
+	}
+}
+
 func TestExtractPackageJSONScripts(t *testing.T) {
 	content := `{
 		"name": "myapp",
@@ -301,3 +366,108 @@ func TestGatherManifests(t *testing.T) {
 		t.Error("expected package.json scripts in manifest output")
 	}
 }
+
+func TestExtractFlakeOutputs(t *testing.T) {
+	content := `{
+  outputs = { self, nixpkgs, flake-utils }:
+    flake-utils.lib.eachDefaultSystem (system: {
+      packages.default = pkgs.hello;
+      packages.${system}.cli = pkgs.callPackage ./cli.nix {};
+      apps.serve = { type = "app"; program = "${self}/bin/serve"; };
+      devShells.default = pkgs.mkShell { };
+    }) // {
+      packages.x86_64-linux = { };
+      packages.aarch64-darwin.extra = pkgs.hello;
+    };
+}`
+	got := extractFlakeOutputs(content)
+	want := "apps: serve; packages: default, cli, extra; devShells: default"
+	if got != want {
+		t.Errorf("extractFlakeOutputs() = %q, want %q", got, want)
+	}
+}
+
+func TestExtractFlakeOutputsEmpty(t *testing.T) {
+	if got := extractFlakeOutputs(`{ description = "nothing"; }`); got != "" {
+		t.Errorf("expected empty summary, got %q", got)
+	}
+}
+
+func TestDetectNix(t *testing.T) {
+	dir := t.TempDir()
+	if got := detectNix(dir, ""); got != "" {
+		t.Errorf("expected empty for plain dir, got %q", got)
+	}
+
+	os.WriteFile(filepath.Join(dir, "shell.nix"), []byte("{}"), 0644)
+	if got := detectNix(dir, ""); got != "shell" {
+		t.Errorf("expected shell, got %q", got)
+	}
+
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "flake.nix"), []byte("{}"), 0644)
+	if got := detectNix(t.TempDir(), root); got != "flake" {
+		t.Errorf("expected flake from git root, got %q", got)
+	}
+}
+
+func TestGatherTerraformNoFiles(t *testing.T) {
+	if got := gatherTerraform(t.TempDir()); got != "" {
+		t.Errorf("expected empty for non-terraform dir, got %q", got)
+	}
+}
+
+func TestGatherTerraform(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "main.tf"), []byte(`terraform {
+  backend "s3" {
+    bucket = "state"
+  }
+}
+
+module "vpc" {
+  source = "./modules/vpc"
+}
+
+resource "aws_instance" "web" {
+  ami = "ami-123"
+}
+`), 0644)
+	os.MkdirAll(filepath.Join(dir, ".terraform"), 0755)
+	os.WriteFile(filepath.Join(dir, ".terraform", "environment"), []byte("staging\n"), 0644)
+
+	got := gatherTerraform(dir)
+	want := "workspace: staging, backend: s3, targets: module.vpc aws_instance.web"
+	if got != want {
+		t.Errorf("gatherTerraform() = %q, want %q", got, want)
+	}
+}
+
+func TestGatherTerraformTerragruntDefaultWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "terragrunt.hcl"), []byte("include {}"), 0644)
+
+	got := gatherTerraform(dir)
+	if got != "terragrunt, workspace: default" {
+		t.Errorf("unexpected terragrunt summary %q", got)
+	}
+}
+
+func TestIsLocalHost(t *testing.T) {
+	local, err := os.Hostname()
+	if err != nil {
+		t.Skip("no hostname")
+	}
+	short, _, _ := strings.Cut(local, ".")
+	for host, want := range map[string]bool{
+		"":                      true,
+		local:                   true,
+		strings.ToUpper(short):  true,
+		short + ".example.com":  true,
+		"not-this-host.invalid": false,
+	} {
+		if got := IsLocalHost(host); got != want {
+			t.Errorf("IsLocalHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package generate
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/index"
+)
+
+const (
+	// docTimeout bounds reading one man page.
+	docTimeout = 3 * time.Second
+	// docTTL is how long a command's documentation is reused.
+	docTTL = 24 * time.Hour
+	// docMaxExamples caps the tldr examples kept.
+	docMaxExamples = 8
+	// docMaxBytes caps the condensed documentation of one command.
+	docMaxBytes = 800
+)
+
+// commandNameRe matches command names whose documentation may be looked
+// up.
+var commandNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// DocCache holds condensed documentation of commands, from a locally
+// cached tldr page or else the start of the man page. Nothing is
+// downloaded.
+type DocCache struct {
+	home string
+
+	mu      sync.Mutex
+	entries map[string]docEntry
+	pending map[string]bool
+}
+
+// docEntry is the condensed documentation of one command; text is empty
+// when none was found.
+type docEntry struct {
+	text    string
+	fetched time.Time
+}
+
+// NewDocCache creates an empty DocCache. home locates tldr page caches.
+func NewDocCache(home string) *DocCache {
+	return &DocCache{
+		home:    home,
+		entries: make(map[string]docEntry),
+		pending: make(map[string]bool),
+	}
+}
+
+// Doc returns the cached documentation of name ("" if not known yet).
+// want reports whether name should be fetched: it is neither cached nor
+// being fetched. A nil cache knows nothing.
+func (dc *DocCache) Doc(name string) (text string, want bool) {
+	if dc == nil {
+		return "", false
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	entry, ok := dc.entries[name]
+	if ok && time.Since(entry.fetched) < docTTL {
+		return entry.text, false
+	}
+	if dc.pending[name] {
+		return entry.text, false
+	}
+	dc.pending[name] = true
+	return entry.text, true
+}
+
+// Fetch reads and caches the documentation of name: its tldr page when
+// one is cached locally, else the NAME and SYNOPSIS of its man page.
+func (dc *DocCache) Fetch(ctx context.Context, name string) {
+	text := condenseTldr(dc.readTldr(name))
+	if text == "" {
+		ctx, cancel := context.WithTimeout(ctx, docTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "man", "-P", "cat", name)
+		cmd.Env = append(os.Environ(), "MANPAGER=cat", "PAGER=cat", "MANWIDTH=120")
+		out, _ := cmd.Output()
+		text = condenseMan(string(out))
+	}
+	slog.Debug("read command docs", "command", name, "bytes", len(text))
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.entries[name] = docEntry{text: truncate(text, docMaxBytes), fetched: time.Now()}
+	delete(dc.pending, name)
+}
+
+// abandon forgets that name is being fetched, so it is tried again.
+func (dc *DocCache) abandon(name string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	delete(dc.pending, name)
+}
+
+// tldrDirs returns the page directories of the tldr clients' caches
+// (tldr-python, tldr-node, tealdeer), this platform's pages before the
+// common ones.
+func (dc *DocCache) tldrDirs() []string {
+	cacheHome := os.Getenv("XDG_CACHE_HOME")
+	if cacheHome == "" {
+		cacheHome = filepath.Join(dc.home, ".cache")
+	}
+	roots := []string{
+		filepath.Join(cacheHome, "tldr", "pages"),
+		filepath.Join(dc.home, ".tldr", "cache", "pages"),
+		filepath.Join(cacheHome, "tealdeer", "tldr-pages", "pages.en"),
+		filepath.Join(cacheHome, "tealdeer", "tldr-master", "pages"),
+		filepath.Join(dc.home, "Library", "Caches", "tealdeer", "tldr-pages", "pages.en"),
+	}
+	platform := "linux"
+	if runtime.GOOS == "darwin" {
+		platform = "osx"
+	}
+	var dirs []string
+	for _, root := range roots {
+		dirs = append(dirs, filepath.Join(root, platform), filepath.Join(root, "common"))
+	}
+	return dirs
+}
+
+// readTldr returns the first cached tldr page found for name.
+func (dc *DocCache) readTldr(name string) string {
+	if dc.home == "" {
+		return ""
+	}
+	for _, dir := range dc.tldrDirs() {
+		if data, err := os.ReadFile(filepath.Join(dir, name+".md")); err == nil {
+			return string(data)
+		}
+	}
+	return ""
+}
+
+// condenseTldr turns a tldr page into one line of "description: `example`"
+// pairs, with {{placeholder}} braces removed.
+func condenseTldr(page string) string {
+	var parts []string
+	var desc string
+	scanner := bufio.NewScanner(strings.NewReader(page))
+	for scanner.Scan() && len(parts) < docMaxExamples {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "- "):
+			desc = strings.TrimSuffix(strings.TrimPrefix(line, "- "), ":")
+		case strings.HasPrefix(line, "`") && desc != "":
+			example := strings.NewReplacer("{{", "", "}}", "").Replace(line)
+			parts = append(parts, desc+": "+example)
+			desc = ""
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// condenseMan returns the NAME and SYNOPSIS sections of a formatted man
+// page on one line, with overstrike formatting removed.
+func condenseMan(page string) string {
+	page = stripOverstrike(page)
+	var parts []string
+	var section string
+	for _, line := range strings.Split(page, "\n") {
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			section = strings.TrimSpace(line)
+			continue
+		}
+		if section != "NAME" && section != "SYNOPSIS" {
+			continue
+		}
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			parts = append(parts, line)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// stripOverstrike removes the "c\bc" bold and "_\bc" underline sequences
+// man uses when its output is not a terminal.
+func stripOverstrike(s string) string {
+	if !strings.Contains(s, "\b") {
+		return s
+	}
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\b' {
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+			continue
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// inputDocs returns the documentation of the command being typed, for
+// the prompt, once its name is complete. A missing entry is fetched in the
+// background for later requests. Commands that are not installed, and
+// shells on another host, get none.
+func (e *Engine) inputDocs(req *ashlet.Request) (name, text string) {
+	if e.docs == nil || !e.localContext(req.Host) {
+		return "", ""
+	}
+	name, ok := commandName(req.Input)
+	if !ok || !commandNameRe.MatchString(name) || shellBuiltins[name] {
+		return "", ""
+	}
+	if fields := strings.Fields(req.Input); fields[len(fields)-1] == name && !strings.HasSuffix(req.Input, " ") {
+		return "", "" // still typing the name
+	}
+	if execs := e.execs.Lookup(req.Path); execs != nil {
+		if !execs[name] {
+			return "", ""
+		}
+	} else if _, err := exec.LookPath(name); err != nil {
+		return "", ""
+	}
+
+	text, want := e.docs.Doc(name)
+	if want {
+		go func() {
+			ctx := context.Background()
+			release, err := e.sched.Acquire(ctx, index.PriorityBackground)
+			if err != nil {
+				e.docs.abandon(name)
+				return
+			}
+			defer release()
+			e.docs.Fetch(ctx, name)
+		}()
+	}
+	return name, text
+}
@@ -0,0 +1,95 @@
+package generate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+const fdPage = "# fd\n\n> An alternative to `find`.\n> More information: <https://github.com/sharkdp/fd>.\n\n" +
+	"- Recursively find files matching a given pattern in the current directory:\n\n`fd {{pattern}}`\n\n" +
+	"- Find files with a given extension:\n\n`fd --extension {{txt}}`\n"
+
+func TestCondenseTldr(t *testing.T) {
+	want := "Recursively find files matching a given pattern in the current directory: `fd pattern`; " +
+		"Find files with a given extension: `fd --extension txt`"
+	if got := condenseTldr(fdPage); got != want {
+		t.Errorf("condenseTldr() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestCondenseMan(t *testing.T) {
+	page := "LS(1)                     User Commands                    LS(1)\n\n" +
+		"N\bNA\bAM\bME\bE\n       ls - list directory contents\n\n" +
+		"SYNOPSIS\n       ls [_\bO_\bP_\bT_\bI_\bO_\bN]... [_\bF_\bI_\bL_\bE]...\n\n" +
+		"DESCRIPTION\n       List information about the FILEs.\n"
+	want := "ls - list directory contents ls [OPTION]... [FILE]..."
+	if got := condenseMan(page); got != want {
+		t.Errorf("condenseMan() = %q, want %q", got, want)
+	}
+}
+
+func TestDocCacheFetchTldr(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", "")
+	dir := filepath.Join(home, ".cache", "tldr", "pages", "common")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "fd.md"), []byte(fdPage), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dc := NewDocCache(home)
+	if text, want := dc.Doc("fd"); text != "" || !want {
+		t.Fatalf("first lookup = %q, %v; want a fetch", text, want)
+	}
+	if _, want := dc.Doc("fd"); want {
+		t.Error("a pending fetch should not be started again")
+	}
+	dc.Fetch(context.Background(), "fd")
+	text, want := dc.Doc("fd")
+	if want || !strings.Contains(text, "`fd --extension txt`") {
+		t.Errorf("after fetch = %q, %v; want fd's examples", text, want)
+	}
+}
+
+func TestInputDocs(t *testing.T) {
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "fd"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	e := testEngine()
+	e.execs = NewExecCache()
+	defer e.execs.Close()
+	e.docs = NewDocCache("")
+	e.docs.entries["fd"] = docEntry{text: "Find files: `fd pattern`", fetched: time.Now()}
+
+	tests := []struct {
+		input string
+		name  string
+	}{
+		{"fd ", "fd"},
+		{"fd -e go", "fd"},
+		{"fd", ""}, // still typing the name
+		{"cd src", ""},
+		{"fdx ", ""}, // not installed
+	}
+	for _, tt := range tests {
+		name, _ := e.inputDocs(&ashlet.Request{Input: tt.input, Path: bin})
+		if name != tt.name {
+			t.Errorf("inputDocs(%q) = %q, want %q", tt.input, name, tt.name)
+		}
+	}
+
+	req := &ashlet.Request{Input: "fd -e ", CursorPos: 6, Path: bin}
+	msg := e.buildUserMessage(req, &Info{}, nil)
+	if !strings.Contains(msg, "docs of fd: Find files: `fd pattern`") {
+		t.Errorf("message should include the command's docs, got:\n%s", msg)
+	}
+}
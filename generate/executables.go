@@ -0,0 +1,198 @@
+package generate
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+const (
+	// execCacheTTL bounds how long the executables found on one $PATH are
+	// reused, so newly installed tools are picked up.
+	execCacheTTL = 1 * time.Minute
+	// execCacheSize caps the distinct $PATH values cached at once.
+	execCacheSize = 16
+)
+
+// ExecCache maps a $PATH value to the names of the executables found in
+// its directories.
+type ExecCache struct {
+	cache *ttlcache.Cache[string, map[string]bool]
+}
+
+// NewExecCache creates an ExecCache with TTL-based expiration.
+func NewExecCache() *ExecCache {
+	c := ttlcache.New[string, map[string]bool](
+		ttlcache.WithTTL[string, map[string]bool](execCacheTTL),
+		ttlcache.WithCapacity[string, map[string]bool](execCacheSize),
+		ttlcache.WithDisableTouchOnHit[string, map[string]bool](),
+	)
+	go c.Start()
+	return &ExecCache{cache: c}
+}
+
+// Close stops the cache expiration loop.
+func (ec *ExecCache) Close() {
+	if ec != nil {
+		ec.cache.Stop()
+	}
+}
+
+// Lookup returns the executables on path, scanning its directories on a
+// cache miss. It returns nil for a nil cache or an empty path.
+func (ec *ExecCache) Lookup(path string) map[string]bool {
+	if ec == nil || path == "" {
+		return nil
+	}
+	if item := ec.cache.Get(path); item != nil {
+		return item.Value()
+	}
+	names := make(map[string]bool)
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			// Symlinks are taken on trust rather than followed, to keep
+			// scanning large bin directories cheap.
+			if entry.Type().IsRegular() {
+				info, err := entry.Info()
+				if err != nil || info.Mode()&0o111 == 0 {
+					continue
+				}
+			}
+			names[entry.Name()] = true
+		}
+	}
+	ec.cache.Set(path, names, ttlcache.DefaultTTL)
+	return names
+}
+
+// shellBuiltins are zsh builtins and reserved words, which run without
+// being on $PATH.
+var shellBuiltins = map[string]bool{
+	".": true, ":": true, "[": true, "[[": true, "alias": true, "autoload": true,
+	"bg": true, "bindkey": true, "break": true, "builtin": true, "case": true,
+	"cd": true, "command": true, "continue": true, "declare": true, "dirs": true,
+	"disown": true, "do": true, "echo": true, "emulate": true, "eval": true,
+	"exec": true, "exit": true, "export": true, "false": true, "fc": true,
+	"fg": true, "for": true, "function": true, "functions": true, "getopts": true,
+	"hash": true, "history": true, "if": true, "jobs": true, "kill": true,
+	"let": true, "local": true, "noglob": true, "popd": true, "print": true,
+	"printf": true, "pushd": true, "pwd": true, "read": true, "readonly": true,
+	"rehash": true, "repeat": true, "return": true, "select": true, "set": true,
+	"setopt": true, "shift": true, "source": true, "test": true, "time": true,
+	"times": true, "trap": true, "true": true, "type": true, "typeset": true,
+	"ulimit": true, "umask": true, "unalias": true, "unfunction": true,
+	"unset": true, "unsetopt": true, "until": true, "wait": true, "whence": true,
+	"where": true, "which": true, "while": true, "zle": true, "zmodload": true,
+	"zstyle": true,
+}
+
+// assignmentRe matches a leading environment assignment (FOO=bar).
+var assignmentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// commandName returns the command a candidate runs first, skipping
+// leading environment assignments. ok is false when the command cannot be
+// checked: it is expanded from a variable or substitution, or the
+// candidate starts with a subshell or group.
+func commandName(cmd string) (name string, ok bool) {
+	for _, field := range strings.Fields(cmd) {
+		if assignmentRe.MatchString(field) {
+			continue
+		}
+		if strings.ContainsAny(field, "$`'\"(){}!*?\\") {
+			return "", false
+		}
+		return strings.TrimRight(field, ";&|"), true
+	}
+	return "", false
+}
+
+// commandResolves reports whether name runs something: a builtin, one of
+// the user's aliases or functions, a path to an existing file (relative
+// to cwd), or an executable on $PATH.
+func commandResolves(name string, execs map[string]bool, aliases map[string]string, cwd string) bool {
+	if name == "" || shellBuiltins[name] || execs[name] {
+		return true
+	}
+	if _, ok := aliases[name]; ok {
+		return true
+	}
+	if strings.HasPrefix(name, "~") {
+		return true // relative to the shell's home, which may not be ours
+	}
+	if strings.Contains(name, "/") {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(cwd, name)
+		}
+		info, err := os.Stat(name)
+		return err == nil && !info.IsDir()
+	}
+	return false
+}
+
+// checkExecutables handles candidates whose command is not found on the
+// shell's $PATH, per generation.unknown_commands: "downrank" (default)
+// moves them after the others, "drop" removes them, "keep" leaves them. A
+// command the user has already typed is never held against a candidate.
+// Requests without a PATH, or from another host, are left alone.
+func (e *Engine) checkExecutables(candidates []ashlet.Candidate, req *ashlet.Request, input string) []ashlet.Candidate {
+	policy := ""
+	if e.config != nil {
+		policy = e.config.Generation.UnknownCommands
+	}
+	if policy == "keep" || !e.localContext(req.Host) {
+		return candidates
+	}
+	execs := e.execs.Lookup(req.Path)
+	if execs == nil {
+		return candidates
+	}
+
+	typed, _ := commandName(input)
+	known := make([]bool, len(candidates))
+	for i, c := range candidates {
+		name, ok := commandName(c.Completion)
+		known[i] = !ok || name == typed || commandResolves(name, execs, req.Aliases, req.Cwd)
+		if !known[i] && c.Score != nil {
+			c.Score.Penalties = append(c.Score.Penalties, "unknown command")
+		}
+	}
+
+	if policy == "drop" {
+		out := candidates[:0]
+		for i, c := range candidates {
+			if known[i] {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	idx := make([]int, len(candidates))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return known[idx[a]] && !known[idx[b]]
+	})
+	out := make([]ashlet.Candidate, len(candidates))
+	for i, j := range idx {
+		out[i] = candidates[j]
+	}
+	return out
+}
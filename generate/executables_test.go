@@ -0,0 +1,101 @@
+package generate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestExecCacheLookup(t *testing.T) {
+	ec := NewExecCache()
+	defer ec.Close()
+
+	bin := t.TempDir()
+	os.WriteFile(filepath.Join(bin, "mytool"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(bin, "notes.txt"), []byte("hi"), 0644)
+	os.Mkdir(filepath.Join(bin, "subdir"), 0755)
+
+	execs := ec.Lookup(bin + string(filepath.ListSeparator) + "/nonexistent")
+	if !execs["mytool"] {
+		t.Error("mytool should be found")
+	}
+	if execs["notes.txt"] || execs["subdir"] {
+		t.Errorf("non-executables should be skipped, got %v", execs)
+	}
+	if ec.Lookup("") != nil {
+		t.Error("an empty PATH should not be looked up")
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		name string
+		ok   bool
+	}{
+		{"git status", "git", true},
+		{"FOO=1 BAR=2 make test", "make", true},
+		{"ls; pwd", "ls", true},
+		{"$EDITOR file", "", false},
+		{"(cd src && make)", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		name, ok := commandName(tt.cmd)
+		if name != tt.name || ok != tt.ok {
+			t.Errorf("commandName(%q) = %q, %v; want %q, %v", tt.cmd, name, ok, tt.name, tt.ok)
+		}
+	}
+}
+
+func TestCheckExecutables(t *testing.T) {
+	bin := t.TempDir()
+	os.WriteFile(filepath.Join(bin, "git"), []byte("#!/bin/sh\n"), 0755)
+	cwd := t.TempDir()
+	os.WriteFile(filepath.Join(cwd, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+
+	candidates := func() []ashlet.Candidate {
+		return []ashlet.Candidate{
+			{Completion: "gitx status"}, // made up
+			{Completion: "git status"},
+			{Completion: "cd build"},
+			{Completion: "gco main"},
+			{Completion: "./run.sh --fast"},
+		}
+	}
+	req := &ashlet.Request{Cwd: cwd, Path: bin, Aliases: map[string]string{"gco": "git checkout"}}
+
+	for _, tt := range []struct {
+		policy string
+		want   []string
+	}{
+		{"", []string{"git status", "cd build", "gco main", "./run.sh --fast", "gitx status"}},
+		{"drop", []string{"git status", "cd build", "gco main", "./run.sh --fast"}},
+		{"keep", []string{"gitx status", "git status", "cd build", "gco main", "./run.sh --fast"}},
+	} {
+		e := testEngine()
+		e.execs = NewExecCache()
+		e.config.Generation.UnknownCommands = tt.policy
+		got := e.checkExecutables(candidates(), req, "")
+		if len(got) != len(tt.want) {
+			t.Fatalf("policy %q: got %+v, want %q", tt.policy, got, tt.want)
+		}
+		for i, c := range got {
+			if c.Completion != tt.want[i] {
+				t.Errorf("policy %q: candidate %d = %q, want %q", tt.policy, i, c.Completion, tt.want[i])
+			}
+		}
+		e.execs.Close()
+	}
+
+	// A command the user typed is kept in place.
+	e := testEngine()
+	e.execs = NewExecCache()
+	defer e.execs.Close()
+	e.config.Generation.UnknownCommands = "drop"
+	if got := e.checkExecutables(candidates(), req, "gitx st"); len(got) != 5 {
+		t.Errorf("typed command should not be dropped, got %+v", got)
+	}
+}
@@ -0,0 +1,435 @@
+package generate
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+)
+
+const (
+	// feedbackMaxShapes caps the number of tracked command shapes; the least
+	// recently seen shapes are evicted first.
+	feedbackMaxShapes = 2000
+	// feedbackMinEvents is the number of events a shape needs before its
+	// acceptance rate influences ranking.
+	feedbackMinEvents = 3
+	// feedbackWeight scales how far acceptance statistics move a candidate.
+	// A shape that is always accepted gains 0.2 confidence, slightly more
+	// than one ranking position (0.15).
+	feedbackWeight = 0.4
+	// feedbackAcceptedPerDir caps the accepted commands remembered per
+	// directory; feedbackMaxDirs caps the number of directories tracked.
+	feedbackAcceptedPerDir = 10
+	feedbackMaxDirs        = 500
+)
+
+// shapeStats holds acceptance counts for one command shape.
+type shapeStats struct {
+	Accepted int       `json:"accepted"`
+	Rejected int       `json:"rejected"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// dirAccepted holds the most recently accepted commands in one directory,
+// newest first. Commands are stored redacted.
+type dirAccepted struct {
+	Commands []string  `json:"commands"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// VariantStats counts how a prompt variant's suggestions fared: responses
+// shown with candidates, and candidates accepted (including edited) or
+// rejected.
+type VariantStats struct {
+	Shown    int `json:"shown"`
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+}
+
+// AcceptanceRate returns the fraction of shown responses whose candidate
+// was accepted, or 0 if none were shown.
+func (vs VariantStats) AcceptanceRate() float64 {
+	if vs.Shown == 0 {
+		return 0
+	}
+	return float64(vs.Accepted) / float64(vs.Shown)
+}
+
+type feedbackFile struct {
+	Version  int                      `json:"version"`
+	Shapes   map[string]*shapeStats   `json:"shapes"`
+	Accepted map[string]*dirAccepted  `json:"accepted,omitempty"`
+	Variants map[string]*VariantStats `json:"variants,omitempty"`
+}
+
+// FeedbackStore records which candidate shapes the user accepts or rejects
+// and persists the statistics to disk.
+type FeedbackStore struct {
+	path string // empty = in-memory only
+
+	mu       sync.Mutex
+	shapes   map[string]*shapeStats
+	accepted map[string]*dirAccepted  // keyed by cwd
+	variants map[string]*VariantStats // keyed by prompt variant
+}
+
+// NewFeedbackStore creates a feedback store backed by the file at path,
+// loading previously saved statistics if present. An empty path keeps the
+// statistics in memory only.
+func NewFeedbackStore(path string) *FeedbackStore {
+	fs := &FeedbackStore{
+		path:     path,
+		shapes:   make(map[string]*shapeStats),
+		accepted: make(map[string]*dirAccepted),
+		variants: make(map[string]*VariantStats),
+	}
+	if path == "" {
+		return fs
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("failed to read feedback store", "path", path, "error", err)
+		}
+		return fs
+	}
+	var ff feedbackFile
+	if err := json.Unmarshal(data, &ff); err != nil {
+		slog.Warn("failed to parse feedback store, starting fresh", "path", path, "error", err)
+		return fs
+	}
+	if ff.Shapes != nil {
+		fs.shapes = ff.Shapes
+	}
+	if ff.Accepted != nil {
+		fs.accepted = ff.Accepted
+	}
+	if ff.Variants != nil {
+		fs.variants = ff.Variants
+	}
+	return fs
+}
+
+// Record updates statistics for a feedback event and persists the store.
+func (fs *FeedbackStore) Record(fb *ashlet.FeedbackRequest) {
+	if fs == nil || fb == nil {
+		return
+	}
+	candidate := commandShape(fb.Candidate)
+	if candidate == "" {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := time.Now()
+	switch fb.Event {
+	case "accepted":
+		fs.statsLocked(candidate, now).Accepted++
+		fs.rememberLocked(fb.Cwd, fb.Candidate, now)
+	case "rejected":
+		fs.statsLocked(candidate, now).Rejected++
+	case "edited":
+		// The user kept the executed command's shape; if editing changed
+		// the shape, the suggested one was effectively rejected.
+		executed := commandShape(fb.Executed)
+		if executed == "" {
+			executed = candidate
+		}
+		fs.statsLocked(executed, now).Accepted++
+		if fb.Executed != "" {
+			fs.rememberLocked(fb.Cwd, fb.Executed, now)
+		} else {
+			fs.rememberLocked(fb.Cwd, fb.Candidate, now)
+		}
+		if executed != candidate {
+			fs.statsLocked(candidate, now).Rejected++
+		}
+	default:
+		return
+	}
+
+	fs.evictLocked()
+	if err := fs.saveLocked(); err != nil {
+		slog.Warn("failed to save feedback store", "path", fs.path, "error", err)
+	}
+}
+
+// RecordShown counts a response from prompt variant that showed the user
+// candidates. The count is persisted with the next feedback event.
+func (fs *FeedbackStore) RecordShown(variant string) {
+	if fs == nil || variant == "" {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.variantLocked(variant).Shown++
+}
+
+// RecordVariant attributes a feedback event ("accepted", "rejected", or
+// "edited") to the prompt variant that produced the candidate, and
+// persists the store.
+func (fs *FeedbackStore) RecordVariant(variant, event string) {
+	if fs == nil || variant == "" {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch event {
+	case "accepted", "edited":
+		fs.variantLocked(variant).Accepted++
+	case "rejected":
+		fs.variantLocked(variant).Rejected++
+	default:
+		return
+	}
+	if err := fs.saveLocked(); err != nil {
+		slog.Warn("failed to save feedback store", "path", fs.path, "error", err)
+	}
+}
+
+// VariantStats returns a copy of the per-variant statistics.
+func (fs *FeedbackStore) VariantStats() map[string]VariantStats {
+	if fs == nil {
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	out := make(map[string]VariantStats, len(fs.variants))
+	for k, v := range fs.variants {
+		out[k] = *v
+	}
+	return out
+}
+
+// Score returns the smoothed acceptance rate (0.0 to 1.0) for the shape of
+// cmd. ok is false when the shape has too few events to be meaningful.
+func (fs *FeedbackStore) Score(cmd string) (score float64, ok bool) {
+	if fs == nil {
+		return 0, false
+	}
+	shape := commandShape(cmd)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	st, exists := fs.shapes[shape]
+	if !exists || st.Accepted+st.Rejected < feedbackMinEvents {
+		return 0, false
+	}
+	// Laplace smoothing: an unseen shape scores 0.5
+	return float64(st.Accepted+1) / float64(st.Accepted+st.Rejected+2), true
+}
+
+// AcceptedIn returns up to limit commands recently accepted in cwd, newest
+// first. Commands are redacted.
+func (fs *FeedbackStore) AcceptedIn(cwd string, limit int) []string {
+	if fs == nil || cwd == "" || limit <= 0 {
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, ok := fs.accepted[cwd]
+	if !ok {
+		return nil
+	}
+	if len(d.Commands) < limit {
+		limit = len(d.Commands)
+	}
+	out := make([]string, limit)
+	copy(out, d.Commands[:limit])
+	return out
+}
+
+// Save writes the store to disk.
+func (fs *FeedbackStore) Save() error {
+	if fs == nil {
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.saveLocked()
+}
+
+func (fs *FeedbackStore) statsLocked(shape string, now time.Time) *shapeStats {
+	st, ok := fs.shapes[shape]
+	if !ok {
+		st = &shapeStats{}
+		fs.shapes[shape] = st
+	}
+	st.LastSeen = now
+	return st
+}
+
+func (fs *FeedbackStore) variantLocked(variant string) *VariantStats {
+	vs, ok := fs.variants[variant]
+	if !ok {
+		vs = &VariantStats{}
+		fs.variants[variant] = vs
+	}
+	return vs
+}
+
+// rememberLocked records cmd as the newest accepted command in cwd, moving
+// an existing copy to the front.
+func (fs *FeedbackStore) rememberLocked(cwd, cmd string, now time.Time) {
+	cmd = core.RedactCommand(strings.TrimSpace(cmd))
+	if cwd == "" || cmd == "" {
+		return
+	}
+	d, ok := fs.accepted[cwd]
+	if !ok {
+		d = &dirAccepted{}
+		fs.accepted[cwd] = d
+	}
+	d.LastSeen = now
+	cmds := []string{cmd}
+	for _, c := range d.Commands {
+		if c != cmd && len(cmds) < feedbackAcceptedPerDir {
+			cmds = append(cmds, c)
+		}
+	}
+	d.Commands = cmds
+}
+
+// evictLocked drops the least recently seen shapes beyond feedbackMaxShapes
+// and the least recently seen directories beyond feedbackMaxDirs.
+func (fs *FeedbackStore) evictLocked() {
+	if len(fs.accepted) > feedbackMaxDirs {
+		dirs := make([]string, 0, len(fs.accepted))
+		for k := range fs.accepted {
+			dirs = append(dirs, k)
+		}
+		sort.Slice(dirs, func(i, j int) bool {
+			return fs.accepted[dirs[i]].LastSeen.Before(fs.accepted[dirs[j]].LastSeen)
+		})
+		for _, k := range dirs[:len(dirs)-feedbackMaxDirs] {
+			delete(fs.accepted, k)
+		}
+	}
+
+	if len(fs.shapes) <= feedbackMaxShapes {
+		return
+	}
+	keys := make([]string, 0, len(fs.shapes))
+	for k := range fs.shapes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fs.shapes[keys[i]].LastSeen.Before(fs.shapes[keys[j]].LastSeen)
+	})
+	for _, k := range keys[:len(keys)-feedbackMaxShapes] {
+		delete(fs.shapes, k)
+	}
+}
+
+// saveLocked atomically writes the store (temp file + rename).
+func (fs *FeedbackStore) saveLocked() error {
+	if fs.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(feedbackFile{Version: 1, Shapes: fs.shapes, Accepted: fs.accepted, Variants: fs.variants})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fs.path), 0700); err != nil {
+		return err
+	}
+	tmp := fs.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fs.path)
+}
+
+// commandShape reduces a command to the parts that describe how the user
+// likes to run things, dropping free-form arguments: the program, its
+// subcommand (if any), and its flags without values.
+// e.g. `git commit -m "fix" --no-verify` → `git commit -m --no-verify`.
+func commandShape(cmd string) string {
+	fields := strings.Fields(core.FilterQuoteContent(cmd))
+	if len(fields) == 0 {
+		return ""
+	}
+	parts := []string{fields[0]}
+	for i, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, "-"):
+			if eq := strings.IndexByte(f, '='); eq > 0 {
+				f = f[:eq]
+			}
+			parts = append(parts, f)
+		case i == 0 && isSubcommand(f):
+			parts = append(parts, f)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// isSubcommand reports whether word looks like a subcommand rather than an
+// argument (path, quoted text, or value).
+func isSubcommand(word string) bool {
+	if word == "" || strings.ContainsAny(word, `/.=:"'$~*`) {
+		return false
+	}
+	for _, r := range word {
+		if !(r >= 'a' && r <= 'z') && r != '-' && r != '_' && !(r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// biasCandidates re-orders candidates using acceptance statistics from the
+// feedback store, then re-assigns position-based confidence. Candidates whose
+// shape lacks enough feedback keep their relative position.
+func biasCandidates(candidates []ashlet.Candidate, fs *FeedbackStore) {
+	if fs == nil || len(candidates) < 2 {
+		return
+	}
+
+	type ranked struct {
+		candidate ashlet.Candidate
+		weight    float64
+	}
+	items := make([]ranked, len(candidates))
+	changed := false
+	for i, c := range candidates {
+		weight := c.Confidence
+		if score, ok := fs.Score(c.Completion); ok {
+			weight += feedbackWeight * (score - 0.5)
+			changed = true
+			if c.Score != nil {
+				c.Score.Learned = feedbackWeight * (score - 0.5)
+			}
+		}
+		items[i] = ranked{candidate: c, weight: weight}
+	}
+	if !changed {
+		return
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].weight > items[j].weight
+	})
+
+	for i, item := range items {
+		candidates[i] = item.candidate
+		candidates[i].Confidence = 0.95 - float64(i)*0.15
+		if candidates[i].Confidence < 0.1 {
+			candidates[i].Confidence = 0.1
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package generate
+
+import (
+	"path/filepath"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestCommandShape(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`git commit -m "fix: bug" --no-verify`, "git commit -m --no-verify"},
+		{"pnpm run build", "pnpm run"},
+		{"npm run build", "npm run"},
+		{"ls -la /tmp", "ls -la"},
+		{"cat ./README.md", "cat"},
+		{"docker run --name=web nginx", "docker run --name"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := commandShape(tt.cmd); got != tt.want {
+			t.Errorf("commandShape(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestFeedbackStoreScoreNeedsMinEvents(t *testing.T) {
+	fs := NewFeedbackStore("")
+	fs.Record(&ashlet.FeedbackRequest{Event: "accepted", Candidate: "pnpm run build"})
+	if _, ok := fs.Score("pnpm run test"); ok {
+		t.Error("score should not be available below feedbackMinEvents")
+	}
+	for i := 0; i < feedbackMinEvents; i++ {
+		fs.Record(&ashlet.FeedbackRequest{Event: "accepted", Candidate: "pnpm run build"})
+	}
+	score, ok := fs.Score("pnpm run test")
+	if !ok {
+		t.Fatal("expected score for shape with enough events")
+	}
+	if score <= 0.5 {
+		t.Errorf("expected score > 0.5 for accepted shape, got %f", score)
+	}
+}
+
+func TestFeedbackStoreEdited(t *testing.T) {
+	fs := NewFeedbackStore("")
+	for i := 0; i < feedbackMinEvents; i++ {
+		fs.Record(&ashlet.FeedbackRequest{
+			Event:     "edited",
+			Candidate: "npm run build",
+			Executed:  "pnpm run build",
+		})
+	}
+	if score, ok := fs.Score("npm run lint"); !ok || score >= 0.5 {
+		t.Errorf("edited-away shape should score < 0.5, got %f (ok=%v)", score, ok)
+	}
+	if score, ok := fs.Score("pnpm run lint"); !ok || score <= 0.5 {
+		t.Errorf("executed shape should score > 0.5, got %f (ok=%v)", score, ok)
+	}
+}
+
+func TestFeedbackStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "feedback.json")
+	fs := NewFeedbackStore(path)
+	for i := 0; i < feedbackMinEvents; i++ {
+		fs.Record(&ashlet.FeedbackRequest{Event: "rejected", Candidate: "rm -rf build"})
+	}
+
+	reloaded := NewFeedbackStore(path)
+	score, ok := reloaded.Score("rm -rf dist")
+	if !ok {
+		t.Fatal("expected statistics to survive reload")
+	}
+	if score >= 0.5 {
+		t.Errorf("expected rejected shape to score < 0.5, got %f", score)
+	}
+}
+
+func TestFeedbackStoreIgnoresUnknownEvent(t *testing.T) {
+	fs := NewFeedbackStore("")
+	for i := 0; i < feedbackMinEvents; i++ {
+		fs.Record(&ashlet.FeedbackRequest{Event: "bogus", Candidate: "ls"})
+	}
+	if _, ok := fs.Score("ls"); ok {
+		t.Error("unknown events should not be recorded")
+	}
+}
+
+func TestBiasCandidatesPromotesAcceptedShape(t *testing.T) {
+	fs := NewFeedbackStore("")
+	for i := 0; i < 5; i++ {
+		fs.Record(&ashlet.FeedbackRequest{Event: "accepted", Candidate: "pnpm run dev"})
+		fs.Record(&ashlet.FeedbackRequest{Event: "rejected", Candidate: "npm run dev"})
+	}
+
+	candidates := []ashlet.Candidate{
+		{Completion: "npm run build", Confidence: 0.95},
+		{Completion: "pnpm run build", Confidence: 0.80},
+	}
+	biasCandidates(candidates, fs)
+
+	if candidates[0].Completion != "pnpm run build" {
+		t.Errorf("expected accepted shape first, got %q", candidates[0].Completion)
+	}
+	if candidates[0].Confidence != 0.95 {
+		t.Errorf("expected position-based confidence 0.95, got %f", candidates[0].Confidence)
+	}
+}
+
+func TestBiasCandidatesNilStore(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: "a", Confidence: 0.95},
+		{Completion: "b", Confidence: 0.80},
+	}
+	biasCandidates(candidates, nil)
+	if candidates[0].Completion != "a" {
+		t.Error("nil store should leave order unchanged")
+	}
+}
+
+func TestFeedbackStoreAcceptedIn(t *testing.T) {
+	fs := NewFeedbackStore("")
+	fs.Record(&ashlet.FeedbackRequest{Event: "accepted", Candidate: "pnpm run build", Cwd: "/proj/a"})
+	fs.Record(&ashlet.FeedbackRequest{Event: "edited", Candidate: "make test", Executed: "just test", Cwd: "/proj/a"})
+	fs.Record(&ashlet.FeedbackRequest{Event: "rejected", Candidate: "npm run build", Cwd: "/proj/a"})
+	fs.Record(&ashlet.FeedbackRequest{Event: "accepted", Candidate: "pnpm run build", Cwd: "/proj/a"})
+	fs.Record(&ashlet.FeedbackRequest{Event: "accepted", Candidate: "cargo build", Cwd: "/proj/b"})
+
+	got := fs.AcceptedIn("/proj/a", 5)
+	want := []string{"pnpm run build", "just test"}
+	if len(got) != len(want) {
+		t.Fatalf("AcceptedIn = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("AcceptedIn[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+	if got := fs.AcceptedIn("/proj/a", 1); len(got) != 1 {
+		t.Errorf("AcceptedIn limit 1 returned %d commands", len(got))
+	}
+	if got := fs.AcceptedIn("/elsewhere", 5); got != nil {
+		t.Errorf("AcceptedIn for unknown dir = %v, want nil", got)
+	}
+}
+
+func TestFeedbackStoreAcceptedRedacted(t *testing.T) {
+	fs := NewFeedbackStore("")
+	fs.Record(&ashlet.FeedbackRequest{Event: "accepted", Candidate: "TOKEN=abc curl $SECRET", Cwd: "/p"})
+	got := fs.AcceptedIn("/p", 5)
+	if len(got) != 1 || got[0] != "TOKEN=*** curl $REDACTED" {
+		t.Errorf("AcceptedIn = %v, want redacted command", got)
+	}
+}
+
+func TestFeedbackStoreAcceptedPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feedback.json")
+	fs := NewFeedbackStore(path)
+	fs.Record(&ashlet.FeedbackRequest{Event: "accepted", Candidate: "just lint", Cwd: "/p"})
+
+	reloaded := NewFeedbackStore(path)
+	if got := reloaded.AcceptedIn("/p", 5); len(got) != 1 || got[0] != "just lint" {
+		t.Errorf("reloaded AcceptedIn = %v, want [just lint]", got)
+	}
+}
+
+func TestFeedbackStoreVariantsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feedback.json")
+	fs := NewFeedbackStore(path)
+	fs.RecordShown("a")
+	fs.RecordShown("a")
+	fs.RecordVariant("a", "rejected")
+	fs.RecordVariant("a", "edited")
+	fs.RecordVariant("a", "unknown")
+
+	reloaded := NewFeedbackStore(path)
+	got := reloaded.VariantStats()["a"]
+	if got != (VariantStats{Shown: 2, Accepted: 1, Rejected: 1}) {
+		t.Errorf("reloaded variant stats = %+v", got)
+	}
+	if rate := got.AcceptanceRate(); rate != 0.5 {
+		t.Errorf("AcceptanceRate = %v, want 0.5", rate)
+	}
+}
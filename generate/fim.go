@@ -0,0 +1,179 @@
+package generate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+)
+
+// --- Fill-in-the-middle (completions) API ---
+
+// fimRequest is a completions request with a suffix, as served by
+// llama.cpp, vLLM, and other completions endpoints for code models.
+type fimRequest struct {
+	Model       string   `json:"model"`
+	Prompt      string   `json:"prompt"`
+	Suffix      string   `json:"suffix"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Temperature float64  `json:"temperature,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Stream      bool     `json:"stream,omitempty"`
+
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+}
+
+type fimResponse struct {
+	Choices []struct {
+		Text string `json:"text"`
+	} `json:"choices"`
+	Usage *apiUsage `json:"usage,omitempty"`
+	Error *apiError `json:"error,omitempty"`
+}
+
+func fimStreamDelta(data []byte) (string, *apiUsage, error) {
+	var chunk fimResponse
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return "", nil, nil // skip events we do not understand
+	}
+	if chunk.Error != nil {
+		return "", nil, fmt.Errorf("API error: %s", chunk.Error.Message)
+	}
+	if len(chunk.Choices) == 0 {
+		return "", chunk.Usage, nil
+	}
+	return chunk.Choices[0].Text, chunk.Usage, nil
+}
+
+// fim reports whether the generator uses the fill-in-the-middle API.
+func (g *Generator) fim() bool {
+	return g != nil && g.apiType == "fim"
+}
+
+// generateFIM requests the text between prompt and suffix. A completion
+// is one line, so generation stops at a newline unless stop sequences are
+// configured.
+func (g *Generator) generateFIM(ctx context.Context, temperature float64, prompt, suffix string, onChunk func(string)) (string, error) {
+	stop := g.stop
+	if len(stop) == 0 {
+		stop = []string{"\n"}
+	}
+	reqBody := fimRequest{
+		Model:       g.model,
+		Prompt:      prompt,
+		Suffix:      suffix,
+		MaxTokens:   g.maxTokens,
+		Temperature: temperature,
+		Stop:        stop,
+		Stream:      onChunk != nil,
+	}
+	if reqBody.Stream {
+		reqBody.StreamOptions = &streamOptions{IncludeUsage: true}
+	}
+	data, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", g.baseURL+"/completions", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	g.setHeaders(httpReq)
+
+	resp, err := g.client.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 && onChunk != nil {
+		return g.readStream(resp.Body, fimStreamDelta, onChunk)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != 200 {
+		return "", &statusError{status: resp.StatusCode, body: string(body)}
+	}
+
+	var result fimResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("failed to parse response: %w (body: %s)", err, string(body))
+	}
+
+	if result.Error != nil {
+		return "", fmt.Errorf("API error: %s", result.Error.Message)
+	}
+	g.recordUsage(result.Usage)
+
+	if len(result.Choices) == 0 {
+		return "", fmt.Errorf("no choices in response")
+	}
+
+	return result.Choices[0].Text, nil
+}
+
+// inferFIM completes uc.Input in place with a fill-in-the-middle model,
+// within generation.timeout_ms. Each request yields a single candidate, so
+// with generation.temperatures set one request per temperature is made in
+// parallel and the results are merged.
+func (e *Engine) inferFIM(ctx context.Context, uc core.UserContext, max int) ([]ashlet.Candidate, error) {
+	if timeout := e.generationTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	prompt, suffix := core.BuildInfillPrompt(uc)
+	slog.Debug("fim prompt", "prompt", prompt, "suffix", suffix)
+	tokens := core.EstimateTokens(prompt + suffix)
+
+	temps := e.fanOutTemperatures()
+	if len(temps) == 0 {
+		temps = []float64{e.generator.temperature}
+	}
+	lists := make([][]ashlet.Candidate, len(temps))
+	errs := make([]error, len(temps))
+	var wg sync.WaitGroup
+	for i, temp := range temps {
+		wg.Go(func() {
+			start := time.Now()
+			output, err := e.generator.GenerateStreamAt(ctx, temp, prompt, suffix, nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			e.latency.Record(e.generator.provider(), tokens, time.Since(start))
+			lists[i] = core.ParseInfill(output, uc.Input, uc.CursorPos)
+		})
+	}
+	wg.Wait()
+
+	var ok [][]ashlet.Candidate
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		ok = append(ok, lists[i])
+	}
+	if len(ok) == 0 {
+		return nil, firstErr
+	}
+	return core.MergeCandidates(ok, max), nil
+}
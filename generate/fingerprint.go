@@ -0,0 +1,193 @@
+package generate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fingerprintRecent is how many of the latest history commands a
+// fingerprint covers.
+const fingerprintRecent = 5
+
+// ContextFingerprint identifies the state of the context a completion is
+// built from: the working directory's contents, the git HEAD and index,
+// and the latest history commands. Anything derived from that context can
+// be reused while the fingerprint is unchanged. Fingerprints are cheap to
+// take: they stat and read a few small files and run no commands.
+type ContextFingerprint struct {
+	Cwd     string
+	Listing uint64 // modification times of the cwd and its manifest files
+	Head    string // commit git HEAD points at, or its ref; empty outside a repository
+	Staged  uint64 // size and modification time of the git index
+	Recent  uint64 // the latest history commands; 0 when none were given
+}
+
+// Fingerprint takes the fingerprint of cwd, and of recent (most recent
+// first) when it is not nil.
+func Fingerprint(cwd string, recent []string) ContextFingerprint {
+	fp := ContextFingerprint{Cwd: cwd}
+
+	h := fnv.New64a()
+	statInto(h, cwd)
+	for _, name := range manifestFiles {
+		statInto(h, filepath.Join(cwd, name))
+	}
+	statInto(h, filepath.Join(cwd, ".terraform", "environment"))
+
+	if root, gitDir := findGitDir(cwd); gitDir != "" {
+		if root != cwd {
+			for _, name := range manifestFiles {
+				statInto(h, filepath.Join(root, name))
+			}
+		}
+		fp.Head = gitHead(gitDir)
+		sh := fnv.New64a()
+		statInto(sh, filepath.Join(gitDir, "index"))
+		fp.Staged = sh.Sum64()
+	}
+	fp.Listing = h.Sum64()
+
+	if len(recent) > 0 {
+		rh := fnv.New64a()
+		for _, cmd := range recent[:min(len(recent), fingerprintRecent)] {
+			rh.Write([]byte(cmd))
+			rh.Write([]byte{0})
+		}
+		fp.Recent = rh.Sum64()
+	}
+	return fp
+}
+
+// Key returns the fingerprint as a short string, for use as a cache key.
+func (fp ContextFingerprint) Key() string {
+	h := fnv.New64a()
+	h.Write([]byte(fp.Cwd))
+	h.Write([]byte{0})
+	h.Write([]byte(fp.Head))
+	h.Write([]byte{0})
+	binary.Write(h, binary.LittleEndian, [3]uint64{fp.Listing, fp.Staged, fp.Recent})
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Diff names the parts of the context that differ between fp and other:
+// "cwd", "listing", "head", "staged", and "recent". It is empty when the
+// fingerprints are equal.
+func (fp ContextFingerprint) Diff(other ContextFingerprint) []string {
+	var changed []string
+	if fp.Cwd != other.Cwd {
+		changed = append(changed, "cwd")
+	}
+	if fp.Listing != other.Listing {
+		changed = append(changed, "listing")
+	}
+	if fp.Head != other.Head {
+		changed = append(changed, "head")
+	}
+	if fp.Staged != other.Staged {
+		changed = append(changed, "staged")
+	}
+	if fp.Recent != other.Recent {
+		changed = append(changed, "recent")
+	}
+	return changed
+}
+
+// statInto hashes path's size and modification time, or a marker when it
+// does not exist.
+func statInto(h io.Writer, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		h.Write([]byte{0})
+		return
+	}
+	binary.Write(h, binary.LittleEndian, [2]int64{info.Size(), info.ModTime().UnixNano()})
+}
+
+// findGitDir returns the work tree root containing dir and its git
+// directory, following the "gitdir:" file of worktrees and submodules.
+// Both are empty outside a repository.
+func findGitDir(dir string) (root, gitDir string) {
+	for d := dir; ; {
+		path := filepath.Join(d, ".git")
+		if info, err := os.Stat(path); err == nil {
+			if info.IsDir() {
+				return d, path
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", ""
+			}
+			target, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+			if !ok {
+				return "", ""
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(d, target)
+			}
+			return d, target
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return "", ""
+		}
+		d = parent
+	}
+}
+
+// gitHead returns the commit HEAD points at, looking the branch up in the
+// loose and packed refs of the repository (its common directory, for a
+// worktree). It falls back to HEAD's ref when the branch has no commit.
+func gitHead(gitDir string) string {
+	data, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	head := strings.TrimSpace(string(data))
+	ref, ok := strings.CutPrefix(head, "ref: ")
+	if !ok {
+		return head // detached
+	}
+
+	dirs := []string{gitDir}
+	if common, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		dir := strings.TrimSpace(string(common))
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(gitDir, dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	for _, dir := range dirs {
+		if data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(ref))); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	for _, dir := range dirs {
+		if commit := packedRef(filepath.Join(dir, "packed-refs"), ref); commit != "" {
+			return commit
+		}
+	}
+	return head
+}
+
+// packedRef looks ref up in a packed-refs file.
+func packedRef(path, ref string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		commit, name, ok := strings.Cut(scanner.Text(), " ")
+		if ok && name == ref {
+			return commit
+		}
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package generate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeRepo lays out a minimal git directory in dir on branch main.
+func fakeRepo(t *testing.T, dir, commit string) string {
+	t.Helper()
+	gitDir := filepath.Join(dir, ".git")
+	os.MkdirAll(filepath.Join(gitDir, "refs", "heads"), 0755)
+	os.WriteFile(filepath.Join(gitDir, "HEAD"), []byte("ref: refs/heads/main\n"), 0644)
+	os.WriteFile(filepath.Join(gitDir, "refs", "heads", "main"), []byte(commit+"\n"), 0644)
+	os.WriteFile(filepath.Join(gitDir, "index"), []byte("index"), 0644)
+	return gitDir
+}
+
+// touch moves path's modification time forward so the change is visible
+// on filesystems with coarse timestamps.
+func touch(t *testing.T, path string) {
+	t.Helper()
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFingerprintDetectsChanges(t *testing.T) {
+	root := t.TempDir()
+	gitDir := fakeRepo(t, root, "1111")
+	cwd := filepath.Join(root, "sub")
+	os.Mkdir(cwd, 0755)
+	recent := []string{"make", "ls"}
+
+	base := Fingerprint(cwd, recent)
+	if base.Head != "1111" {
+		t.Fatalf("Head = %q, want 1111", base.Head)
+	}
+	if again := Fingerprint(cwd, recent); again != base || again.Key() != base.Key() {
+		t.Fatalf("fingerprint should be stable, got %+v and %+v", base, again)
+	}
+
+	os.WriteFile(filepath.Join(gitDir, "refs", "heads", "main"), []byte("2222\n"), 0644)
+	os.WriteFile(filepath.Join(gitDir, "index"), []byte("index v2"), 0644)
+	os.WriteFile(filepath.Join(cwd, "new.txt"), nil, 0644)
+	touch(t, cwd)
+	os.WriteFile(filepath.Join(root, "Makefile"), []byte("all:"), 0644)
+
+	next := Fingerprint(cwd, []string{"git commit", "make", "ls"})
+	if got, want := base.Diff(next), []string{"listing", "head", "staged", "recent"}; !slices.Equal(got, want) {
+		t.Errorf("Diff = %q, want %q", got, want)
+	}
+	if next.Key() == base.Key() {
+		t.Error("keys should differ")
+	}
+}
+
+func TestFingerprintWorktreeAndPackedRefs(t *testing.T) {
+	repo := t.TempDir()
+	gitDir := fakeRepo(t, repo, "1111")
+	os.Remove(filepath.Join(gitDir, "refs", "heads", "main"))
+	os.WriteFile(filepath.Join(gitDir, "packed-refs"), []byte("# pack-refs with: peeled\n3333 refs/heads/main\n"), 0644)
+	if got := Fingerprint(repo, nil).Head; got != "3333" {
+		t.Errorf("packed Head = %q, want 3333", got)
+	}
+
+	// A worktree's .git file points at its own git dir, whose branch lives
+	// in the main repository.
+	wtGit := filepath.Join(gitDir, "worktrees", "wt")
+	os.MkdirAll(wtGit, 0755)
+	os.WriteFile(filepath.Join(wtGit, "HEAD"), []byte("ref: refs/heads/main\n"), 0644)
+	os.WriteFile(filepath.Join(wtGit, "commondir"), []byte("../..\n"), 0644)
+	wt := t.TempDir()
+	os.WriteFile(filepath.Join(wt, ".git"), []byte("gitdir: "+wtGit+"\n"), 0644)
+	if got := Fingerprint(wt, nil).Head; got != "3333" {
+		t.Errorf("worktree Head = %q, want 3333", got)
+	}
+
+	if got := Fingerprint(t.TempDir(), nil); got.Head != "" || got.Staged != 0 {
+		t.Errorf("outside a repository = %+v, want no git state", got)
+	}
+}
+
+func TestDirCacheGatherSkipsUnchanged(t *testing.T) {
+	dc := NewDirCache()
+	defer dc.Close()
+
+	dir := t.TempDir()
+	dc.Gather(context.Background(), dir)
+	first := dc.Get(dir)
+	dc.Gather(context.Background(), dir)
+	if dc.Get(dir) != first {
+		t.Error("an unchanged directory should not be gathered again")
+	}
+
+	os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hi"), 0644)
+	touch(t, dir)
+	dc.Gather(context.Background(), dir)
+	if got := dc.Get(dir); got == first || got.CwdListing != "hello.txt" {
+		t.Errorf("a changed directory should be gathered again, got %+v", got)
+	}
+}
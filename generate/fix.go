@@ -0,0 +1,177 @@
+package generate
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+	defaults "github.com/Paranoid-AF/ashlet/default"
+)
+
+// stderrMaxBytes caps the stderr snippet included in fix prompts.
+const stderrMaxBytes = 512
+
+// completeFix suggests corrections for the previously failed command.
+func (e *Engine) completeFix(ctx context.Context, req *ashlet.Request) *CompleteResult {
+	req.LastCommand = strings.TrimSpace(req.LastCommand)
+	if req.LastCommand == "" {
+		return &CompleteResult{
+			Response: &ashlet.Response{Candidates: []ashlet.Candidate{}},
+		}
+	}
+	if req.DryRun {
+		return e.dryRunFix(req)
+	}
+	if err := e.allowGeneration(e.sampledCalls()); err != nil {
+		slog.Debug("fix not generated", "error", err)
+		return &CompleteResult{
+			Response: &ashlet.Response{Candidates: []ashlet.Candidate{}, Error: generationError(err)},
+		}
+	}
+
+	maxCandidates := req.MaxCandidates
+	if maxCandidates <= 0 {
+		maxCandidates = DefaultMaxCandidates
+	}
+
+	var dirCtx *DirContext
+	if e.localContext(req.Host) {
+		dirCtx = e.anonymizer.AnonymizeDir(e.dirCache.Get(req.Cwd))
+	}
+
+	systemPrompt := e.buildFixSystemPrompt(maxCandidates, req.Shell)
+	userMessage := e.buildFixUserMessage(req, dirCtx)
+
+	slog.Debug("fix prompt", "system", systemPrompt, "user", userMessage)
+
+	// Candidates replace the (empty) buffer. Quote content is kept as-is:
+	// it comes from the user's own command, not from history.
+	candidates, err := e.infer(ctx, systemPrompt, userMessage, "", maxCandidates, nil)
+	if err != nil {
+		slog.Error("generation error", "error", err)
+		return &CompleteResult{
+			Response: &ashlet.Response{
+				Candidates: []ashlet.Candidate{},
+				Error:      generationError(err),
+			},
+			DirContext: dirCtx,
+		}
+	}
+
+	if candidates == nil {
+		candidates = []ashlet.Candidate{}
+	}
+
+	// Drop a "fix" identical to the command that failed.
+	filtered := candidates[:0]
+	for _, c := range candidates {
+		if c.Completion != req.LastCommand {
+			filtered = append(filtered, c)
+		}
+	}
+	filtered = core.FilterNeverSuggest(filtered, e.neverSuggest())
+	core.FlagDangerous(filtered)
+
+	return &CompleteResult{
+		Response:   &ashlet.Response{Candidates: filtered, Meta: e.generator.meta()},
+		DirContext: dirCtx,
+	}
+}
+
+// dryRunFix returns the fix-mode prompt for req without sending it.
+func (e *Engine) dryRunFix(req *ashlet.Request) *CompleteResult {
+	maxCandidates := req.MaxCandidates
+	if maxCandidates <= 0 {
+		maxCandidates = DefaultMaxCandidates
+	}
+	var dirCtx *DirContext
+	if e.localContext(req.Host) {
+		dirCtx = e.anonymizer.AnonymizeDir(e.dirCache.Get(req.Cwd))
+	}
+	prompt := &ashlet.Prompt{
+		System: e.buildFixSystemPrompt(maxCandidates, req.Shell),
+		User:   e.buildFixUserMessage(req, dirCtx),
+	}
+	return &CompleteResult{
+		Response:   &ashlet.Response{Candidates: []ashlet.Candidate{}, Prompt: prompt},
+		DirContext: dirCtx,
+	}
+}
+
+// buildFixSystemPrompt renders the fix-mode system prompt from the template,
+// for a fix in the syntax of shell.
+func (e *Engine) buildFixSystemPrompt(maxCandidates int, shell string) string {
+	data := core.PromptData{
+		MaxCandidates:  maxCandidates,
+		JSONOutput:     ashlet.JSONOutputEnabled(e.config),
+		ToolOutput:     ashlet.ToolOutputEnabled(e.config),
+		ChainSeparator: e.chainSeparator(),
+		Shell:          core.ShellName(shell),
+	}
+	e.promptMu.RLock()
+	tmpl := e.customFix
+	e.promptMu.RUnlock()
+	return e.withNeverSuggest(core.RenderPrompt(tmpl, defaults.DefaultFixPrompt, data))
+}
+
+// buildFixUserMessage constructs the fix-mode user message from the failed
+// command, its exit status and error output, and directory context.
+func (e *Engine) buildFixUserMessage(req *ashlet.Request, dirCtx *DirContext) string {
+	var sb strings.Builder
+
+	if req.Cwd != "" {
+		sb.WriteString("cwd: ")
+		sb.WriteString(e.anonymizer.Anonymize(req.Cwd))
+		sb.WriteString("\n")
+	}
+
+	if dirCtx != nil {
+		if dirCtx.CwdListing != "" {
+			sb.WriteString("files: ")
+			sb.WriteString(dirCtx.CwdListing)
+			sb.WriteString("\n")
+		}
+		if dirCtx.PackageManager != "" {
+			sb.WriteString("pkg: ")
+			sb.WriteString(dirCtx.PackageManager)
+			sb.WriteString("\n")
+		}
+		for name, content := range dirCtx.CwdManifests {
+			sb.WriteString(name)
+			sb.WriteString(": ")
+			sb.WriteString(content)
+			sb.WriteString("\n")
+		}
+		for name, content := range dirCtx.GitManifests {
+			sb.WriteString(name)
+			sb.WriteString(": ")
+			sb.WriteString(content)
+			sb.WriteString("\n")
+		}
+	}
+
+	sb.WriteString("exit code: ")
+	sb.WriteString(strconv.Itoa(req.ExitCode))
+	sb.WriteString("\n")
+
+	// Redacted before it is cut, so no secret is left whole enough to show
+	// but too short to be recognised.
+	if stderr := core.RedactText(strings.TrimSpace(req.Stderr)); stderr != "" {
+		// Keep the tail: the actual error is usually on the last lines.
+		if len(stderr) > stderrMaxBytes {
+			stderr = "..." + stderr[len(stderr)-stderrMaxBytes:]
+		}
+		sb.WriteString("stderr:\n")
+		sb.WriteString(e.anonymizer.Anonymize(stderr))
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\nFailed: `")
+	sb.WriteString(e.anonymizer.Anonymize(core.RedactCommand(req.LastCommand)))
+	sb.WriteString("`")
+
+	return sb.String()
+}
@@ -0,0 +1,289 @@
+package generate
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+	"github.com/Paranoid-AF/ashlet/index"
+)
+
+const (
+	// helpTimeout bounds one --help invocation.
+	helpTimeout = 3 * time.Second
+	// helpTTL is how long a command's flags are trusted before --help is
+	// read again, e.g. after an upgrade.
+	helpTTL = 24 * time.Hour
+	// helpMinFlags is the fewest long flags a help text must list to be
+	// used; fewer usually means --help was not understood.
+	helpMinFlags = 3
+)
+
+// helpTools are the commands whose --help output is read. Commands with
+// subcommands list the ones whose help is read separately; only these are
+// run, since an unknown subcommand may be a user alias or plugin that
+// would be executed rather than described.
+var helpTools = map[string][]string{
+	"git": {"add", "bisect", "blame", "branch", "checkout", "cherry-pick", "clean", "clone",
+		"commit", "config", "diff", "fetch", "grep", "init", "log", "merge", "mv", "pull",
+		"push", "rebase", "reflog", "remote", "reset", "restore", "revert", "rm", "show",
+		"stash", "status", "switch", "tag", "worktree"},
+	"docker": {"build", "compose", "exec", "images", "inspect", "login", "logs", "network",
+		"ps", "pull", "push", "rm", "rmi", "run", "stop", "tag", "volume"},
+	"kubectl": {"annotate", "apply", "config", "cp", "create", "delete", "describe", "edit",
+		"exec", "explain", "get", "label", "logs", "patch", "port-forward", "rollout",
+		"scale", "top"},
+	"cargo": {"add", "bench", "build", "check", "doc", "init", "install", "new", "publish",
+		"run", "test", "tree", "update"},
+	"go": {"build", "clean", "env", "generate", "get", "install", "list", "mod", "run",
+		"test", "vet", "work"},
+	"npm": {"audit", "ci", "exec", "init", "install", "link", "ls", "outdated", "publish",
+		"run", "test", "uninstall", "update"},
+	"helm": {"dependency", "install", "list", "repo", "rollback", "search", "status",
+		"template", "uninstall", "upgrade"},
+	"curl": nil, "tar": nil, "grep": nil, "ls": nil, "rsync": nil, "ssh": nil,
+	"sed": nil, "jq": nil, "rg": nil, "fd": nil, "find": nil, "cp": nil, "mv": nil,
+	"rm": nil, "du": nil, "df": nil,
+}
+
+// longFlagRe matches long options in help text, including git's
+// "--[no-]name" notation.
+var longFlagRe = regexp.MustCompile(`(?:^|[\s,\[(|])--(\[no-\])?([A-Za-z0-9][A-Za-z0-9-]*)`)
+
+// helpKey returns the help cache key for the command cmd runs first: the
+// tool, plus its subcommand for tools that have them. ok is false when the
+// command is not one whose help is read.
+func helpKey(cmd string) (key string, ok bool) {
+	fields := strings.Fields(cmd)
+	for len(fields) > 0 && assignmentRe.MatchString(fields[0]) {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return "", false
+	}
+	subs, ok := helpTools[fields[0]]
+	if !ok {
+		return "", false
+	}
+	if subs == nil {
+		return fields[0], true
+	}
+	if len(fields) < 2 || !slices.Contains(subs, fields[1]) {
+		return "", false
+	}
+	return fields[0] + " " + fields[1], true
+}
+
+// helpArgs returns the command line that prints the help for key.
+func helpArgs(key string) []string {
+	args := strings.Fields(key)
+	switch args[0] {
+	case "git":
+		return append(args, "-h") // --help opens the man page
+	case "go":
+		return []string{"go", "help", args[1]}
+	}
+	return append(args, "--help")
+}
+
+// parseHelpFlags returns the long flags listed in help text, without the
+// leading dashes. "--[no-]name" yields both name and no-name.
+func parseHelpFlags(text string) map[string]bool {
+	flags := make(map[string]bool)
+	for _, m := range longFlagRe.FindAllStringSubmatch(text, -1) {
+		flags[m[2]] = true
+		if m[1] != "" {
+			flags["no-"+m[2]] = true
+		}
+	}
+	return flags
+}
+
+// helpEntry is the parsed help of one command; flags is nil when the help
+// could not be read or listed too few flags to judge by.
+type helpEntry struct {
+	flags   map[string]bool
+	fetched time.Time
+}
+
+// HelpCache holds the long flags of frequently completed commands, read
+// lazily from their --help output.
+type HelpCache struct {
+	mu      sync.Mutex
+	entries map[string]helpEntry
+	pending map[string]bool
+}
+
+// NewHelpCache creates an empty HelpCache.
+func NewHelpCache() *HelpCache {
+	return &HelpCache{
+		entries: make(map[string]helpEntry),
+		pending: make(map[string]bool),
+	}
+}
+
+// Flags returns the cached flags for key, or nil if they are not known
+// (yet). want reports whether key should be fetched: it is neither cached
+// nor being fetched. A nil cache knows no flags.
+func (hc *HelpCache) Flags(key string) (flags map[string]bool, want bool) {
+	if hc == nil {
+		return nil, false
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	entry, ok := hc.entries[key]
+	if ok && time.Since(entry.fetched) < helpTTL {
+		return entry.flags, false
+	}
+	if hc.pending[key] {
+		return entry.flags, false
+	}
+	hc.pending[key] = true
+	return entry.flags, true
+}
+
+// Fetch runs the help command for key in a neutral directory and caches
+// the flags it lists.
+func (hc *HelpCache) Fetch(ctx context.Context, key string) {
+	ctx, cancel := context.WithTimeout(ctx, helpTimeout)
+	defer cancel()
+
+	args := helpArgs(key)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = os.TempDir()
+	out, _ := cmd.CombinedOutput() // git -h exits 129; the text is still usable
+
+	flags := parseHelpFlags(string(out))
+	if len(flags) < helpMinFlags {
+		flags = nil
+	}
+	slog.Debug("read command help", "command", key, "flags", len(flags))
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.entries[key] = helpEntry{flags: flags, fetched: time.Now()}
+	delete(hc.pending, key)
+}
+
+// abandon forgets that key is being fetched, so it is tried again.
+func (hc *HelpCache) abandon(key string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	delete(hc.pending, key)
+}
+
+// unknownFlags returns the long flags of cmd's first command that are not
+// in flags. Quoted text and anything after "--" or a command separator is
+// ignored. A --no-name flag is accepted when name is known, and the other
+// way around.
+func unknownFlags(cmd string, flags map[string]bool) []string {
+	var unknown []string
+	for _, field := range strings.Fields(core.FilterQuoteContent(cmd)) {
+		if field == "--" || strings.ContainsAny(field[:1], ";&|") {
+			break
+		}
+		last := strings.HasSuffix(field, ";")
+		field = strings.TrimRight(field, ";")
+		if strings.HasPrefix(field, "--") && len(field) > 2 {
+			name, _, _ := strings.Cut(field[2:], "=")
+			if !flags[name] && !flags["no-"+name] && !flags[strings.TrimPrefix(name, "no-")] {
+				unknown = append(unknown, "--"+name)
+			}
+		}
+		if last {
+			break
+		}
+	}
+	return unknown
+}
+
+// fetchHelp reads the help for key in the background.
+func (e *Engine) fetchHelp(key string) {
+	go func() {
+		ctx := context.Background()
+		release, err := e.sched.Acquire(ctx, index.PriorityBackground)
+		if err != nil {
+			e.helps.abandon(key)
+			return
+		}
+		defer release()
+		e.helps.Fetch(ctx, key)
+	}()
+}
+
+// helpFlags returns the known flags for the command cmd runs, starting a
+// background fetch when they have not been read yet. It returns nil for
+// commands whose help is not read and for shells on another host.
+func (e *Engine) helpFlags(cmd string, host string) (key string, flags map[string]bool) {
+	if e.helps == nil || !e.localContext(host) {
+		return "", nil
+	}
+	key, ok := helpKey(cmd)
+	if !ok {
+		return "", nil
+	}
+	flags, want := e.helps.Flags(key)
+	if want {
+		e.fetchHelp(key)
+	}
+	return key, flags
+}
+
+// inputFlags returns the flags of the command being typed, for the prompt.
+func (e *Engine) inputFlags(req *ashlet.Request) (key string, flags []string) {
+	key, known := e.helpFlags(req.Input, req.Host)
+	if known == nil {
+		return "", nil
+	}
+	for name := range known {
+		flags = append(flags, "--"+name)
+	}
+	sort.Strings(flags)
+	return key, flags
+}
+
+// checkFlags sets Warning on candidates that pass flags their command's
+// --help does not list, and moves them after the others. Commands whose
+// help has not been read yet are left alone.
+func (e *Engine) checkFlags(candidates []ashlet.Candidate, req *ashlet.Request) []ashlet.Candidate {
+	if e.helps == nil {
+		return candidates
+	}
+	var ok, flagged []ashlet.Candidate
+	for _, c := range candidates {
+		key, flags := e.helpFlags(c.Completion, req.Host)
+		if flags != nil {
+			if unknown := unknownFlags(c.Completion, flags); len(unknown) > 0 {
+				c.Warning = fmt.Sprintf("%s: unknown %s %s", key, plural(len(unknown), "flag", "flags"), strings.Join(unknown, " "))
+				if c.Score != nil {
+					c.Score.Penalties = append(c.Score.Penalties, "unknown "+plural(len(unknown), "flag", "flags"))
+				}
+				flagged = append(flagged, c)
+				continue
+			}
+		}
+		ok = append(ok, c)
+	}
+	if len(flagged) == 0 {
+		return candidates
+	}
+	return append(ok, flagged...)
+}
+
+// plural returns one or many depending on n.
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
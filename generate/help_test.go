@@ -0,0 +1,122 @@
+package generate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestHelpKey(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		key  string
+		want bool
+	}{
+		{"git commit --amend", "git commit", true},
+		{"GIT_EDITOR=vim git rebase -i HEAD~3", "git rebase", true},
+		{"git co main", "", false}, // possibly a user alias, never run
+		{"git", "", false},
+		{"curl -sSL https://example.com", "curl", true},
+		{"mytool --help", "", false},
+	}
+	for _, tt := range tests {
+		key, ok := helpKey(tt.cmd)
+		if key != tt.key || ok != tt.want {
+			t.Errorf("helpKey(%q) = %q, %v; want %q, %v", tt.cmd, key, ok, tt.key, tt.want)
+		}
+	}
+}
+
+func TestParseHelpFlags(t *testing.T) {
+	help := `usage: git commit [-a | --interactive | --patch] [-s] [-v] [-u<mode>] [--amend]
+    -m, --message <message>
+                          commit message
+    --[no-]verify         bypass pre-commit and commit-msg hooks
+    --dry-run             show what would be committed`
+	flags := parseHelpFlags(help)
+	for _, want := range []string{"interactive", "patch", "amend", "message", "verify", "no-verify", "dry-run"} {
+		if !flags[want] {
+			t.Errorf("flag %q not found in %v", want, flags)
+		}
+	}
+}
+
+func TestUnknownFlags(t *testing.T) {
+	flags := map[string]bool{"amend": true, "message": true, "verify": true}
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"git commit --amend --no-verify", nil},
+		{"git commit --message=wip --amned", []string{"--amned"}},
+		{`git commit -m "--bogus text"`, nil},
+		{"git commit --amend && git push --force", nil},
+		{"git commit --amend; git push --force", nil},
+		{"git commit -- --not-a-flag", nil},
+	}
+	for _, tt := range tests {
+		if got := unknownFlags(tt.cmd, flags); !slices.Equal(got, tt.want) {
+			t.Errorf("unknownFlags(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestHelpCacheFetch(t *testing.T) {
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho 'Usage: curl [options...] <url>'\necho ' -o, --output <file>'\necho ' -s, --silent'\necho ' -L, --location'\n"
+	if err := os.WriteFile(filepath.Join(bin, "curl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	hc := NewHelpCache()
+	if flags, want := hc.Flags("curl"); flags != nil || !want {
+		t.Fatalf("first lookup = %v, %v; want a fetch", flags, want)
+	}
+	if _, want := hc.Flags("curl"); want {
+		t.Error("a pending fetch should not be started again")
+	}
+	hc.Fetch(context.Background(), "curl")
+	flags, want := hc.Flags("curl")
+	if want || !flags["output"] || !flags["location"] {
+		t.Errorf("after fetch = %v, %v; want curl's flags", flags, want)
+	}
+
+	hc.Flags("rsync")
+	hc.Fetch(context.Background(), "rsync") // not installed
+	if flags, want := hc.Flags("rsync"); flags != nil || want {
+		t.Errorf("missing command = %v, %v; want no flags and no refetch", flags, want)
+	}
+}
+
+func TestCheckFlags(t *testing.T) {
+	e := testEngine()
+	e.helps = NewHelpCache()
+	e.helps.entries["git commit"] = helpEntry{
+		flags:   map[string]bool{"amend": true, "message": true, "all": true},
+		fetched: time.Now(),
+	}
+
+	got := e.checkFlags([]ashlet.Candidate{
+		{Completion: "git commit --amned"},
+		{Completion: "git commit --amend"},
+		{Completion: "make build"},
+	}, &ashlet.Request{})
+	if len(got) != 3 || got[0].Completion != "git commit --amend" || got[2].Completion != "git commit --amned" {
+		t.Fatalf("flagged candidate should move last, got %+v", got)
+	}
+	if !strings.Contains(got[2].Warning, "--amned") || got[0].Warning != "" {
+		t.Errorf("warnings = %q, %q", got[0].Warning, got[2].Warning)
+	}
+
+	uc := e.userContext(&ashlet.Request{Input: "git commit --a", CursorPos: 14}, &Info{}, nil)
+	if uc.FlagsCommand != "git commit" || !slices.Contains(uc.Flags, "--amend") {
+		t.Errorf("prompt flags = %q %q, want git commit's", uc.FlagsCommand, uc.Flags)
+	}
+}
@@ -1,13 +1,23 @@
 package generate
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+	"github.com/Paranoid-AF/ashlet/index"
 )
 
 // Generator performs text generation via an OpenAI-compatible API.
@@ -15,16 +25,54 @@ type Generator struct {
 	baseURL     string
 	apiKey      string
 	model       string
-	apiType     string // "responses" or "chat_completions"
+	apiType     string // "responses", "chat_completions", or "fim"
 	maxTokens   int
 	temperature float64
 	stop        []string
 	telemetry   bool // send OpenRouter attribution headers
+	jsonOutput  bool // request candidates as JSON via structured outputs
+	toolOutput  bool // request candidates as a submit_candidates tool call
 	client      *http.Client
+	health      *index.HealthTracker // nil = not tracked
+	usage       *index.UsageStore    // nil = not recorded
+	audit       *index.AuditLog      // nil = not recorded
+
+	// noTools and noStructured are set once the API rejects a tool call or
+	// structured output request, after which the next format down is used:
+	// structured outputs, then JSON requested through the prompt alone.
+	noTools      atomic.Bool
+	noStructured atomic.Bool
+}
+
+// requestFormat is how a request asks the model for its candidates.
+type requestFormat int
+
+const (
+	formatText   requestFormat = iota // as the prompt describes
+	formatSchema                      // structured outputs (JSON schema)
+	formatTool                        // a forced submit_candidates tool call
+)
+
+// provider identifies the endpoint and model for latency tracking.
+func (g *Generator) provider() string {
+	return g.baseURL + " " + g.model
+}
+
+// meta returns the provenance of candidates generated now.
+func (g *Generator) meta() *ashlet.Meta {
+	return &ashlet.Meta{Provider: providerHost(g.baseURL), Model: g.model, Time: time.Now()}
+}
+
+// providerHost returns the host of an API base URL, for display.
+func providerHost(baseURL string) string {
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return baseURL
 }
 
 // NewGenerator creates a generator from config.
-func NewGenerator(baseURL, apiKey, model, apiType string, maxTokens int, temperature float64, stop []string, telemetry bool) *Generator {
+func NewGenerator(baseURL, apiKey, model, apiType string, maxTokens int, temperature float64, stop []string, telemetry, jsonOutput bool) *Generator {
 	return &Generator{
 		baseURL:     baseURL,
 		apiKey:      apiKey,
@@ -34,21 +82,175 @@ func NewGenerator(baseURL, apiKey, model, apiType string, maxTokens int, tempera
 		temperature: temperature,
 		stop:        stop,
 		telemetry:   telemetry,
+		jsonOutput:  jsonOutput,
 		client:      &http.Client{Timeout: 30 * time.Second},
 	}
 }
 
 // Generate sends a completion request to the API and returns the response text.
 func (g *Generator) Generate(ctx context.Context, systemPrompt, userMessage string) (string, error) {
-	if g.apiType == "chat_completions" {
-		return g.generateChatCompletions(ctx, systemPrompt, userMessage)
+	return g.GenerateStream(ctx, systemPrompt, userMessage, nil)
+}
+
+// GenerateStream is like Generate, but when onChunk is non-nil the response
+// is streamed and onChunk receives each piece of text as it arrives. If the
+// stream is cut short (e.g. ctx expires), the text received so far is
+// returned along with the error.
+func (g *Generator) GenerateStream(ctx context.Context, systemPrompt, userMessage string, onChunk func(string)) (string, error) {
+	return g.GenerateStreamAt(ctx, g.temperature, systemPrompt, userMessage, onChunk)
+}
+
+// GenerateStreamAt is like GenerateStream but samples at the given
+// temperature instead of the configured one. A temperature of 0 leaves it
+// to the provider's default.
+func (g *Generator) GenerateStreamAt(ctx context.Context, temperature float64, systemPrompt, userMessage string, onChunk func(string)) (string, error) {
+	if err := g.health.Allow(g.provider()); err != nil {
+		return "", err
+	}
+	start := time.Now()
+	output, err := g.generateStructured(ctx, temperature, systemPrompt, userMessage, onChunk)
+	if ctx.Err() != nil {
+		// Cancelled or cut short by the caller: not the provider's fault.
+		g.health.Abandon(g.provider())
+	} else {
+		g.health.Record(g.provider(), time.Since(start), err)
+	}
+	return output, err
+}
+
+// GenerateText is like Generate but always asks for plain text, whatever
+// format candidates are requested in. It is for requests other than
+// completions, such as project summaries.
+func (g *Generator) GenerateText(ctx context.Context, systemPrompt, userMessage string) (string, error) {
+	if err := g.health.Allow(g.provider()); err != nil {
+		return "", err
+	}
+	start := time.Now()
+	output, err := g.generate(ctx, g.temperature, systemPrompt, userMessage, formatText, nil)
+	if ctx.Err() != nil {
+		g.health.Abandon(g.provider())
+	} else {
+		g.health.Record(g.provider(), time.Since(start), err)
+	}
+	return output, err
+}
+
+// format returns the most structured request format configured and not
+// yet rejected by the API.
+func (g *Generator) format() requestFormat {
+	switch {
+	case g.toolOutput && !g.noTools.Load():
+		return formatTool
+	case (g.jsonOutput || g.toolOutput) && !g.noStructured.Load():
+		return formatSchema
+	}
+	return formatText
+}
+
+// generateStructured requests a tool call or structured output when
+// configured, stepping down a format each time the API rejects one. In the
+// tool format the output is the tool call's arguments.
+func (g *Generator) generateStructured(ctx context.Context, temperature float64, systemPrompt, userMessage string, onChunk func(string)) (string, error) {
+	for {
+		format := g.format()
+		output, err := g.generate(ctx, temperature, systemPrompt, userMessage, format, onChunk)
+		switch {
+		case format == formatTool && isUnsupportedTools(err):
+			slog.Info("API does not support tool calls, requesting structured outputs", "error", err)
+			g.noTools.Store(true)
+		case format == formatSchema && isUnsupportedFormat(err):
+			slog.Info("API does not support structured outputs, requesting JSON via prompt only", "error", err)
+			g.noStructured.Store(true)
+		default:
+			return output, err
+		}
 	}
-	return g.generateResponses(ctx, systemPrompt, userMessage)
+}
+
+// generate dispatches on the API type. For "fim", systemPrompt and
+// userMessage are the text before and after the insertion point.
+func (g *Generator) generate(ctx context.Context, temperature float64, systemPrompt, userMessage string, format requestFormat, onChunk func(string)) (string, error) {
+	g.audit.Record("generation", g.model, systemPrompt, userMessage)
+	switch g.apiType {
+	case "chat_completions":
+		return g.generateChatCompletions(ctx, temperature, systemPrompt, userMessage, format, onChunk)
+	case "fim":
+		return g.generateFIM(ctx, temperature, systemPrompt, userMessage, onChunk)
+	}
+	return g.generateResponses(ctx, temperature, systemPrompt, userMessage, format, onChunk)
+}
+
+// statusError is a non-200 API response.
+type statusError struct {
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("API error (status %d): %s", e.status, e.body)
+}
+
+// isUnsupportedFormat reports whether err is the API rejecting the
+// structured output parameters of a request.
+func isUnsupportedFormat(err error) bool {
+	return isRejected(err, "response_format", "json_schema", "text.format")
+}
+
+// isUnsupportedTools reports whether err is the API rejecting the tools of
+// a request.
+func isUnsupportedTools(err error) bool {
+	return isRejected(err, "tool")
+}
+
+// isRejected reports whether err is a bad request response whose body
+// mentions one of params.
+func isRejected(err error, params ...string) bool {
+	var se *statusError
+	if !errors.As(err, &se) || (se.status != http.StatusBadRequest && se.status != http.StatusUnprocessableEntity) {
+		return false
+	}
+	body := strings.ToLower(se.body)
+	for _, param := range params {
+		if strings.Contains(body, param) {
+			return true
+		}
+	}
+	return false
 }
 
 // Close is a no-op (no subprocess to manage).
 func (g *Generator) Close() {}
 
+// apiUsage is the token usage an API reports with a response. Chat
+// Completions and completions name the counts prompt_tokens and
+// completion_tokens, the Responses API input_tokens and output_tokens;
+// OpenRouter adds the cost.
+type apiUsage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	InputTokens      int     `json:"input_tokens"`
+	OutputTokens     int     `json:"output_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// recordUsage adds the usage a response reported, if any.
+func (g *Generator) recordUsage(u *apiUsage) {
+	if u == nil {
+		return
+	}
+	g.usage.Record("generation", g.model, index.Tokens{
+		Prompt:     u.PromptTokens + u.InputTokens,
+		Completion: u.CompletionTokens + u.OutputTokens,
+		Cost:       u.Cost,
+	})
+}
+
+// streamOptions asks a streaming Chat Completions or completions API to
+// report usage in a final chunk.
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
 // --- Responses API ---
 
 type responsesRequest struct {
@@ -57,6 +259,32 @@ type responsesRequest struct {
 	MaxTokens   int              `json:"max_output_tokens,omitempty"`
 	Temperature float64          `json:"temperature,omitempty"`
 	Stop        []string         `json:"stop,omitempty"`
+	Text        *responsesText   `json:"text,omitempty"`
+	Tools       []responsesTool  `json:"tools,omitempty"`
+	ToolChoice  *responsesTool   `json:"tool_choice,omitempty"`
+	Stream      bool             `json:"stream,omitempty"`
+}
+
+// responsesTool is a Responses API function tool, or with only Type and
+// Name set, a tool_choice forcing a call to it.
+type responsesTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      bool            `json:"strict,omitempty"`
+}
+
+type responsesText struct {
+	Format responsesFormat `json:"format"`
+}
+
+// responsesFormat is a Responses API structured output format.
+type responsesFormat struct {
+	Type   string          `json:"type"`
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	Strict bool            `json:"strict"`
 }
 
 type responsesInput struct {
@@ -66,12 +294,15 @@ type responsesInput struct {
 
 type responsesResponse struct {
 	Output []responsesOutput `json:"output"`
+	Usage  *apiUsage         `json:"usage,omitempty"`
 	Error  *apiError         `json:"error,omitempty"`
 }
 
 type responsesOutput struct {
-	Type    string             `json:"type"`
-	Content []responsesContent `json:"content,omitempty"`
+	Type      string             `json:"type"`
+	Content   []responsesContent `json:"content,omitempty"`
+	Name      string             `json:"name,omitempty"`      // function_call
+	Arguments string             `json:"arguments,omitempty"` // function_call
 }
 
 type responsesContent struct {
@@ -84,7 +315,41 @@ type apiError struct {
 	Type    string `json:"type"`
 }
 
-func (g *Generator) generateResponses(ctx context.Context, systemPrompt, userMessage string) (string, error) {
+// responsesStreamEvent is a Responses API server-sent event.
+type responsesStreamEvent struct {
+	Type     string    `json:"type"`
+	Delta    string    `json:"delta"`
+	Message  string    `json:"message"`
+	Error    *apiError `json:"error,omitempty"`
+	Response *struct {
+		Usage *apiUsage `json:"usage"`
+	} `json:"response,omitempty"` // response.completed
+}
+
+func responsesStreamDelta(data []byte) (string, *apiUsage, error) {
+	var ev responsesStreamEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, nil // skip events we do not understand
+	}
+	switch ev.Type {
+	case "response.output_text.delta", "response.function_call_arguments.delta":
+		return ev.Delta, nil, nil
+	case "response.completed":
+		if ev.Response != nil {
+			return "", ev.Response.Usage, nil
+		}
+	case "error":
+		return "", nil, fmt.Errorf("API error: %s", ev.Message)
+	case "response.failed":
+		if ev.Error != nil {
+			return "", nil, fmt.Errorf("API error: %s", ev.Error.Message)
+		}
+		return "", nil, fmt.Errorf("API error: response failed")
+	}
+	return "", nil, nil
+}
+
+func (g *Generator) generateResponses(ctx context.Context, temperature float64, systemPrompt, userMessage string, format requestFormat, onChunk func(string)) (string, error) {
 	reqBody := responsesRequest{
 		Model: g.model,
 		Input: []responsesInput{
@@ -92,8 +357,27 @@ func (g *Generator) generateResponses(ctx context.Context, systemPrompt, userMes
 			{Role: "user", Content: userMessage},
 		},
 		MaxTokens:   g.maxTokens,
-		Temperature: g.temperature,
+		Temperature: temperature,
 		Stop:        g.stop,
+		Stream:      onChunk != nil,
+	}
+	switch format {
+	case formatSchema:
+		reqBody.Text = &responsesText{Format: responsesFormat{
+			Type:   "json_schema",
+			Name:   core.CandidateSchemaName,
+			Schema: core.CandidateSchema,
+			Strict: true,
+		}}
+	case formatTool:
+		reqBody.Tools = []responsesTool{{
+			Type:        "function",
+			Name:        core.SubmitToolName,
+			Description: core.SubmitToolDescription,
+			Parameters:  core.CandidateSchema,
+			Strict:      true,
+		}}
+		reqBody.ToolChoice = &responsesTool{Type: "function", Name: core.SubmitToolName}
 	}
 
 	data, err := json.Marshal(reqBody)
@@ -113,13 +397,17 @@ func (g *Generator) generateResponses(ctx context.Context, systemPrompt, userMes
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == 200 && onChunk != nil {
+		return g.readStream(resp.Body, responsesStreamDelta, onChunk)
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
 	}
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
+		return "", &statusError{status: resp.StatusCode, body: string(body)}
 	}
 
 	var result responsesResponse
@@ -130,8 +418,14 @@ func (g *Generator) generateResponses(ctx context.Context, systemPrompt, userMes
 	if result.Error != nil {
 		return "", fmt.Errorf("API error: %s", result.Error.Message)
 	}
+	g.recordUsage(result.Usage)
 
-	// Extract text from output
+	// Extract the tool call's arguments or the text from output
+	for _, out := range result.Output {
+		if out.Type == "function_call" && out.Name == core.SubmitToolName {
+			return out.Arguments, nil
+		}
+	}
 	for _, out := range result.Output {
 		if out.Type == "message" {
 			for _, c := range out.Content {
@@ -153,15 +447,58 @@ type chatCompletionsRequest struct {
 	MaxTokens   int           `json:"max_tokens,omitempty"`
 	Temperature float64       `json:"temperature,omitempty"`
 	Stop        []string      `json:"stop,omitempty"`
+	Stream      bool          `json:"stream,omitempty"`
+
+	StreamOptions  *streamOptions      `json:"stream_options,omitempty"`
+	ResponseFormat *chatResponseFormat `json:"response_format,omitempty"`
+	Tools          []chatTool          `json:"tools,omitempty"`
+	ToolChoice     *chatTool           `json:"tool_choice,omitempty"`
+}
+
+// chatTool is a Chat Completions function tool, or with only the function
+// name set, a tool_choice forcing a call to it.
+type chatTool struct {
+	Type     string       `json:"type"`
+	Function chatFunction `json:"function"`
+}
+
+type chatFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      bool            `json:"strict,omitempty"`
+}
+
+// chatToolCall is a function call in a Chat Completions message; streamed,
+// each chunk carries a piece of Arguments.
+type chatToolCall struct {
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// chatResponseFormat is a Chat Completions structured output format.
+type chatResponseFormat struct {
+	Type       string         `json:"type"`
+	JSONSchema chatJSONSchema `json:"json_schema"`
+}
+
+type chatJSONSchema struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	Strict bool            `json:"strict"`
 }
 
 type chatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role      string         `json:"role"`
+	Content   string         `json:"content"`
+	ToolCalls []chatToolCall `json:"tool_calls,omitempty"`
 }
 
 type chatCompletionsResponse struct {
 	Choices []chatChoice `json:"choices"`
+	Usage   *apiUsage    `json:"usage,omitempty"`
 	Error   *apiError    `json:"error,omitempty"`
 }
 
@@ -169,7 +506,37 @@ type chatChoice struct {
 	Message chatMessage `json:"message"`
 }
 
-func (g *Generator) generateChatCompletions(ctx context.Context, systemPrompt, userMessage string) (string, error) {
+// chatStreamChunk is a Chat Completions server-sent event.
+type chatStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   string         `json:"content"`
+			ToolCalls []chatToolCall `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *apiUsage `json:"usage,omitempty"` // the final chunk
+	Error *apiError `json:"error,omitempty"`
+}
+
+func chatStreamDelta(data []byte) (string, *apiUsage, error) {
+	var chunk chatStreamChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return "", nil, nil // skip events we do not understand
+	}
+	if chunk.Error != nil {
+		return "", nil, fmt.Errorf("API error: %s", chunk.Error.Message)
+	}
+	if len(chunk.Choices) == 0 {
+		return "", chunk.Usage, nil
+	}
+	delta := chunk.Choices[0].Delta
+	if len(delta.ToolCalls) > 0 {
+		return delta.ToolCalls[0].Function.Arguments, chunk.Usage, nil
+	}
+	return delta.Content, chunk.Usage, nil
+}
+
+func (g *Generator) generateChatCompletions(ctx context.Context, temperature float64, systemPrompt, userMessage string, format requestFormat, onChunk func(string)) (string, error) {
 	reqBody := chatCompletionsRequest{
 		Model: g.model,
 		Messages: []chatMessage{
@@ -177,8 +544,34 @@ func (g *Generator) generateChatCompletions(ctx context.Context, systemPrompt, u
 			{Role: "user", Content: userMessage},
 		},
 		MaxTokens:   g.maxTokens,
-		Temperature: g.temperature,
+		Temperature: temperature,
 		Stop:        g.stop,
+		Stream:      onChunk != nil,
+	}
+	if reqBody.Stream {
+		reqBody.StreamOptions = &streamOptions{IncludeUsage: true}
+	}
+	switch format {
+	case formatSchema:
+		reqBody.ResponseFormat = &chatResponseFormat{
+			Type: "json_schema",
+			JSONSchema: chatJSONSchema{
+				Name:   core.CandidateSchemaName,
+				Schema: core.CandidateSchema,
+				Strict: true,
+			},
+		}
+	case formatTool:
+		reqBody.Tools = []chatTool{{
+			Type: "function",
+			Function: chatFunction{
+				Name:        core.SubmitToolName,
+				Description: core.SubmitToolDescription,
+				Parameters:  core.CandidateSchema,
+				Strict:      true,
+			},
+		}}
+		reqBody.ToolChoice = &chatTool{Type: "function", Function: chatFunction{Name: core.SubmitToolName}}
 	}
 
 	data, err := json.Marshal(reqBody)
@@ -198,13 +591,17 @@ func (g *Generator) generateChatCompletions(ctx context.Context, systemPrompt, u
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == 200 && onChunk != nil {
+		return g.readStream(resp.Body, chatStreamDelta, onChunk)
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
 	}
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
+		return "", &statusError{status: resp.StatusCode, body: string(body)}
 	}
 
 	var result chatCompletionsResponse
@@ -216,11 +613,49 @@ func (g *Generator) generateChatCompletions(ctx context.Context, systemPrompt, u
 		return "", fmt.Errorf("API error: %s", result.Error.Message)
 	}
 
+	g.recordUsage(result.Usage)
+
 	if len(result.Choices) == 0 {
 		return "", fmt.Errorf("no choices in response")
 	}
 
-	return result.Choices[0].Message.Content, nil
+	msg := result.Choices[0].Message
+	for _, call := range msg.ToolCalls {
+		if call.Function.Name == core.SubmitToolName {
+			return call.Function.Arguments, nil
+		}
+	}
+	return msg.Content, nil
+}
+
+// readStream reads a server-sent event stream, passing the text extracted
+// from each event by delta to onChunk and recording the usage an event
+// reports. It returns the accumulated text, and on a read error (such as a
+// cancelled context) the text so far with it.
+func (g *Generator) readStream(body io.Reader, delta func(data []byte) (string, *apiUsage, error), onChunk func(string)) (string, error) {
+	var sb strings.Builder
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue // event names, comments, and blank separators
+		}
+		data = bytes.TrimSpace(data)
+		if string(data) == "[DONE]" {
+			break
+		}
+		text, usage, err := delta(data)
+		if err != nil {
+			return sb.String(), err
+		}
+		g.recordUsage(usage)
+		if text != "" {
+			sb.WriteString(text)
+			onChunk(text)
+		}
+	}
+	return sb.String(), scanner.Err()
 }
 
 // setHeaders sets common headers for API requests.
@@ -0,0 +1,453 @@
+package generate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/index"
+)
+
+func TestGeneratorStructuredOutput(t *testing.T) {
+	var formats []json.RawMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			ResponseFormat json.RawMessage `json:"response_format"`
+		}
+		json.Unmarshal(body, &req)
+		formats = append(formats, req.ResponseFormat)
+		if req.ResponseFormat != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"response_format is not supported"}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(chatCompletionsResponse{
+			Choices: []chatChoice{{Message: chatMessage{Role: "assistant", Content: `{"candidates": []}`}}},
+		})
+	}))
+	defer srv.Close()
+
+	g := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, true)
+	for i := 0; i < 2; i++ {
+		if _, err := g.Generate(context.Background(), "system", "user"); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+	}
+
+	// First call: rejected structured request, then retried without it.
+	// Second call: structured outputs are no longer attempted.
+	if len(formats) != 3 {
+		t.Fatalf("expected 3 API calls, got %d", len(formats))
+	}
+	if formats[0] == nil || !strings.Contains(string(formats[0]), `"json_schema"`) {
+		t.Errorf("first request should carry a json_schema response_format, got %s", formats[0])
+	}
+	if formats[1] != nil || formats[2] != nil {
+		t.Error("requests after rejection should not carry response_format")
+	}
+}
+
+func TestGeneratorToolOutput(t *testing.T) {
+	args := `{"candidates": [{"type": "replace", "commands": ["git status"]}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatCompletionsRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Tools) != 1 || req.Tools[0].Function.Name != "submit_candidates" || req.ToolChoice == nil || req.ResponseFormat != nil {
+			t.Errorf("request should force a submit_candidates call, got tools %+v, choice %+v", req.Tools, req.ToolChoice)
+		}
+		msg := chatMessage{Role: "assistant", Content: "Here you go."}
+		msg.ToolCalls = make([]chatToolCall, 1)
+		msg.ToolCalls[0].Function.Name = "submit_candidates"
+		msg.ToolCalls[0].Function.Arguments = args
+		json.NewEncoder(w).Encode(chatCompletionsResponse{Choices: []chatChoice{{Message: msg}}})
+	}))
+	defer srv.Close()
+
+	g := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, true)
+	g.toolOutput = true
+	output, err := g.Generate(context.Background(), "system", "user")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if output != args {
+		t.Errorf("output = %q, want the tool call arguments", output)
+	}
+}
+
+func TestGeneratorToolOutputStepsDown(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req responsesRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case req.Tools != nil:
+			requests = append(requests, "tool")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"tools are not supported"}}`))
+			return
+		case req.Text != nil:
+			requests = append(requests, "schema")
+		default:
+			requests = append(requests, "text")
+		}
+		w.Write([]byte("event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\"{}\"}\n\n"))
+	}))
+	defer srv.Close()
+
+	g := NewGenerator(srv.URL, "test-key", "test-model", "responses", 120, 0.3, nil, false, true)
+	g.toolOutput = true
+	for range 2 {
+		if _, err := g.GenerateStream(context.Background(), "system", "user", func(string) {}); err != nil {
+			t.Fatalf("GenerateStream: %v", err)
+		}
+	}
+	if got := strings.Join(requests, ","); got != "tool,schema,schema" {
+		t.Errorf("requests = %s, want structured outputs once tools are rejected", got)
+	}
+}
+
+func TestGeneratorStreamToolArguments(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`data: {"choices":[{"delta":{"tool_calls":[{"function":{"name":"submit_candidates","arguments":""}}]}}]}` + "\n\n"))
+		for _, piece := range []string{`{\"candidates\": `, `[]}`} {
+			w.Write([]byte(`data: {"choices":[{"delta":{"tool_calls":[{"function":{"arguments":"` + piece + `"}}]}}]}` + "\n\n"))
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer srv.Close()
+
+	g := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, true)
+	g.toolOutput = true
+	output, err := g.GenerateStream(context.Background(), "system", "user", func(string) {})
+	if err != nil {
+		t.Fatalf("GenerateStream: %v", err)
+	}
+	if want := `{"candidates": []}`; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
+func TestGeneratorRecordsUsage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatCompletionsRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.Stream {
+			w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"ls"}}],"usage":{"prompt_tokens":100,"completion_tokens":7,"cost":0.002}}`))
+			return
+		}
+		if req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+			t.Error("streaming request should ask for usage")
+		}
+		w.Write([]byte(`data: {"choices":[{"delta":{"content":"ls"}}]}` + "\n\n"))
+		w.Write([]byte(`data: {"choices":[],"usage":{"prompt_tokens":50,"completion_tokens":3}}` + "\n\n"))
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer srv.Close()
+
+	g := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	g.usage = index.NewUsageStore("")
+	if _, err := g.Generate(context.Background(), "system", "user"); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if _, err := g.GenerateStream(context.Background(), "system", "user", func(string) {}); err != nil {
+		t.Fatalf("GenerateStream: %v", err)
+	}
+
+	stats := g.usage.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("stats = %+v, want one model/day total", stats)
+	}
+	if got := stats[0]; got.Kind != "generation" || got.Model != "test-model" || got.Requests != 2 ||
+		got.PromptTokens != 150 || got.CompletionTokens != 10 || got.Cost != 0.002 {
+		t.Errorf("usage = %+v", got)
+	}
+}
+
+func TestResponsesStreamUsage(t *testing.T) {
+	text, usage, err := responsesStreamDelta([]byte(`{"type":"response.completed","response":{"usage":{"input_tokens":12,"output_tokens":4}}}`))
+	if err != nil || text != "" || usage == nil || usage.InputTokens != 12 || usage.OutputTokens != 4 {
+		t.Errorf("responsesStreamDelta = %q, %+v, %v", text, usage, err)
+	}
+}
+
+func TestGeneratorStreamChatCompletions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"stream":true`) {
+			t.Errorf("streaming request should set stream, got %s", body)
+		}
+		for _, piece := range []string{"<candidate ", `type=\"replace\">`, "git status</candidate>"} {
+			w.Write([]byte(`data: {"choices":[{"delta":{"content":"` + piece + `"}}]}` + "\n\n"))
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer srv.Close()
+
+	g := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	var chunks []string
+	output, err := g.GenerateStream(context.Background(), "system", "user", func(c string) { chunks = append(chunks, c) })
+	if err != nil {
+		t.Fatalf("GenerateStream: %v", err)
+	}
+	if want := `<candidate type="replace">git status</candidate>`; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+	if len(chunks) != 3 {
+		t.Errorf("expected 3 chunks, got %d", len(chunks))
+	}
+}
+
+func TestGeneratorStreamResponses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("event: response.created\ndata: {\"type\":\"response.created\"}\n\n"))
+		w.Write([]byte("event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\"git \"}\n\n"))
+		w.Write([]byte("event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\"status\"}\n\n"))
+		w.Write([]byte("event: response.completed\ndata: {\"type\":\"response.completed\"}\n\n"))
+	}))
+	defer srv.Close()
+
+	g := NewGenerator(srv.URL, "test-key", "test-model", "responses", 120, 0.3, nil, false, false)
+	output, err := g.GenerateStream(context.Background(), "system", "user", func(string) {})
+	if err != nil {
+		t.Fatalf("GenerateStream: %v", err)
+	}
+	if output != "git status" {
+		t.Errorf("output = %q, want %q", output, "git status")
+	}
+}
+
+func TestCompleteLatencySLOReturnsStreamedCandidates(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`data: {"choices":[{"delta":{"content":"<candidate type=\"replace\"><command>git status</command></candidate>"}}]}` + "\n\n"))
+		w.(http.Flusher).Flush()
+		select { // the model stalls on the second candidate
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.LatencySLOMs = 200
+	e := &Engine{
+		gatherer:  NewGatherer(nil, nil),
+		generator: NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false),
+		dirCache:  NewDirCache(),
+		config:    cfg,
+	}
+	defer e.Close()
+
+	start := time.Now()
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: "git st", CursorPos: 6})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("completion took %v despite a 200ms SLO", elapsed)
+	}
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %+v", resp.Error)
+	}
+	if len(resp.Candidates) != 1 || resp.Candidates[0].Completion != "git status" {
+		t.Errorf("expected the streamed candidate, got %+v", resp.Candidates)
+	}
+}
+
+func TestHistoryCandidates(t *testing.T) {
+	info := &Info{
+		RecentCommands:   []string{"git status", "ls", "git stash pop", "git st"},
+		RelevantCommands: []string{"git status", "git stash list"},
+	}
+	got := historyCandidates("git st", info, 3)
+	want := []string{"git status", "git stash pop", "git stash list"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d candidates, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Completion != want[i] {
+			t.Errorf("candidate %d = %q, want %q", i, got[i].Completion, want[i])
+		}
+	}
+}
+
+func TestCompleteTemperatureFanOut(t *testing.T) {
+	var mu sync.Mutex
+	var temps []float64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatCompletionsRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		temps = append(temps, req.Temperature)
+		mu.Unlock()
+		output := `<candidate type="replace"><command>git status</command></candidate>`
+		if req.Temperature > 0.5 {
+			output += `<candidate type="replace"><command>git stash</command></candidate>`
+		}
+		json.NewEncoder(w).Encode(chatCompletionsResponse{
+			Choices: []chatChoice{{Message: chatMessage{Role: "assistant", Content: output}}},
+		})
+	}))
+	defer srv.Close()
+
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.Temperatures = []float64{0.2, 0.9}
+	e := &Engine{
+		gatherer:  NewGatherer(nil, nil),
+		generator: NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false),
+		dirCache:  NewDirCache(),
+		config:    cfg,
+	}
+	defer e.Close()
+
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: "git st", CursorPos: 6})
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %+v", resp.Error)
+	}
+	if len(temps) != 2 {
+		t.Fatalf("expected one request per temperature, got %v", temps)
+	}
+	var got []string
+	for _, c := range resp.Candidates {
+		got = append(got, c.Completion)
+	}
+	if len(got) != 2 || got[0] != "git status" || got[1] != "git stash" {
+		t.Errorf("expected merged, deduplicated candidates, got %v", got)
+	}
+}
+
+func TestCompleteTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select { // the model never answers
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.TimeoutMs = 100
+	e := &Engine{
+		gatherer:  NewGathererForHistory(nil, nil, ""), // no history to fall back to
+		generator: NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false),
+		dirCache:  NewDirCache(),
+		config:    cfg,
+	}
+	defer e.Close()
+
+	start := time.Now()
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: "git st", CursorPos: 6})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("completion took %v despite a 100ms timeout", elapsed)
+	}
+	if resp.Error == nil || resp.Error.Code != "timeout" {
+		t.Errorf("expected timeout error, got %+v", resp.Error)
+	}
+}
+
+func TestGenerationErrorCodes(t *testing.T) {
+	if got := generationError(&statusError{status: 500, body: "boom"}).Code; got != "api_error" {
+		t.Errorf("API failure code = %q, want api_error", got)
+	}
+	if got := generationError(fmt.Errorf("read: %w", context.DeadlineExceeded)).Code; got != "timeout" {
+		t.Errorf("deadline code = %q, want timeout", got)
+	}
+}
+
+func TestCompleteFIM(t *testing.T) {
+	var req fimRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/completions" {
+			t.Errorf("path = %q, want /completions", r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]string{{"text": "checkout\ngit log"}},
+		})
+	}))
+	defer srv.Close()
+
+	e := &Engine{
+		gatherer:  NewGatherer(nil, nil),
+		generator: NewGenerator(srv.URL, "test-key", "test-model", "fim", 120, 0.3, nil, false, false),
+		dirCache:  NewDirCache(),
+		config:    ashlet.DefaultConfig(),
+	}
+	defer e.Close()
+
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: "git  main", CursorPos: 4})
+	if resp.Error != nil {
+		t.Fatalf("Complete error: %v", resp.Error)
+	}
+	if !strings.HasSuffix(req.Prompt, "git ") || req.Suffix != " main" {
+		t.Errorf("prompt/suffix = %q/%q, want input split at the cursor", req.Prompt, req.Suffix)
+	}
+	if len(req.Stop) != 1 || req.Stop[0] != "\n" {
+		t.Errorf("stop = %q, want a newline", req.Stop)
+	}
+	if len(resp.Candidates) != 1 || resp.Candidates[0].Completion != "git checkout main" {
+		t.Errorf("candidates = %+v, want %q", resp.Candidates, "git checkout main")
+	}
+	if resp.PromptVariant != "" {
+		t.Errorf("PromptVariant = %q, want none for fim", resp.PromptVariant)
+	}
+	if m := resp.Meta; m == nil || m.Model != "test-model" || m.Provider != strings.TrimPrefix(srv.URL, "http://") || m.Time.IsZero() {
+		t.Errorf("Meta = %+v, want the model, API host, and time", m)
+	}
+	if len(resp.Candidates) == 1 {
+		if d := resp.Candidates[0].Diff; d == nil || d.Replaced != (ashlet.Span{Start: 4, End: 4}) || d.Inserted != (ashlet.Span{Start: 4, End: 12}) {
+			t.Errorf("Diff = %+v, want %q inserted at the cursor", d, "checkout")
+		}
+	}
+}
+
+func TestGeneratorCircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, `{"error":"upstream down"}`, http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	health := index.NewHealthTracker()
+	e := &Engine{
+		gatherer:  NewGathererForHistory(nil, nil, ""), // no history to fall back to
+		generator: NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false),
+		dirCache:  NewDirCache(),
+		config:    ashlet.DefaultConfig(),
+		health:    health,
+	}
+	e.generator.health = health
+
+	for range 8 {
+		resp := e.Complete(context.Background(), &ashlet.Request{Input: "git st", CursorPos: 6})
+		if resp.Error == nil || resp.Error.Code != "api_error" {
+			t.Fatalf("response = %+v, want api_error", resp)
+		}
+	}
+	if n := calls.Load(); n != 5 {
+		t.Errorf("provider was called %d times, want 5 before the circuit opened", n)
+	}
+
+	providers := e.ProviderHealth()
+	if len(providers) != 1 {
+		t.Fatalf("providers = %+v, want the generation provider", providers)
+	}
+	p := providers[0]
+	if p.Kind != "generation" || p.Model != "test-model" || p.Provider != strings.TrimPrefix(srv.URL, "http://") {
+		t.Errorf("provider = %+v", p)
+	}
+	if p.Circuit != index.CircuitOpen || p.ErrorRate != 1 || p.LastFailure == nil || p.LastSuccess != nil {
+		t.Errorf("health = %+v, want an open circuit after only failures", p)
+	}
+}
@@ -0,0 +1,171 @@
+package generate
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindow is how many recent requests per provider inform the
+	// latency model; older ones age out so a provider recovering from a
+	// slow spell is noticed quickly.
+	latencyWindow = 16
+	// minLatencySamples is how many requests are observed before the
+	// budget is adapted at all.
+	minLatencySamples = 3
+	// minPromptBudget is the smallest prompt token budget adaptation will
+	// choose, enough for cwd, recent commands, and a short listing.
+	minPromptBudget = 256
+	// defaultTargetLatency is the latency adaptation aims for when no
+	// latency_slo_ms is configured.
+	defaultTargetLatency = 1500 * time.Millisecond
+	// minAdaptiveDeadline keeps an adaptive latency budget from cutting
+	// off a consistently fast provider before it can answer at all.
+	minAdaptiveDeadline = 300 * time.Millisecond
+)
+
+// LatencyStats summarises a provider's recent response latency.
+type LatencyStats struct {
+	P50     time.Duration `json:"p50"`
+	P95     time.Duration `json:"p95"`
+	Samples int           `json:"samples"`
+}
+
+// LatencyTracker models each provider's response latency as a function of
+// prompt size and picks the prompt token budget expected to meet a target
+// latency: optional context shrinks while a provider is slow and grows back
+// when it is fast. It is safe for concurrent use and may be shared between
+// engines; a nil tracker never adapts.
+type LatencyTracker struct {
+	mu        sync.Mutex
+	providers map[string]*latencySamples
+}
+
+type latencySample struct {
+	tokens  int
+	elapsed time.Duration
+}
+
+// latencySamples is a ring of a provider's most recent requests.
+type latencySamples struct {
+	samples []latencySample
+	next    int
+}
+
+// NewLatencyTracker creates an empty latency tracker.
+func NewLatencyTracker() *LatencyTracker {
+	return &LatencyTracker{providers: make(map[string]*latencySamples)}
+}
+
+// Record notes that a prompt of the given estimated tokens took elapsed to
+// answer on provider.
+func (t *LatencyTracker) Record(provider string, tokens int, elapsed time.Duration) {
+	if t == nil || tokens <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.providers[provider]
+	if p == nil {
+		p = &latencySamples{}
+		t.providers[provider] = p
+	}
+	s := latencySample{tokens: tokens, elapsed: elapsed}
+	if len(p.samples) < latencyWindow {
+		p.samples = append(p.samples, s)
+	} else {
+		p.samples[p.next] = s
+	}
+	p.next = (p.next + 1) % latencyWindow
+}
+
+// Stats returns the rolling latency percentiles for provider.
+func (t *LatencyTracker) Stats(provider string) LatencyStats {
+	if t == nil {
+		return LatencyStats{}
+	}
+	t.mu.Lock()
+	var elapsed []time.Duration
+	if p := t.providers[provider]; p != nil {
+		for _, s := range p.samples {
+			elapsed = append(elapsed, s.elapsed)
+		}
+	}
+	t.mu.Unlock()
+	if len(elapsed) == 0 {
+		return LatencyStats{}
+	}
+	slices.Sort(elapsed)
+	return LatencyStats{
+		P50:     percentile(elapsed, 0.50),
+		P95:     percentile(elapsed, 0.95),
+		Samples: len(elapsed),
+	}
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+// Budget returns the prompt token budget for provider, between
+// minPromptBudget and max, expected to keep latency within target. It
+// returns max until enough requests have been observed, and when max is
+// not positive (no budget).
+func (t *LatencyTracker) Budget(provider string, max int, target time.Duration) int {
+	if t == nil || max <= 0 || target <= 0 {
+		return max
+	}
+	t.mu.Lock()
+	p := t.providers[provider]
+	var samples []latencySample
+	if p != nil {
+		samples = append(samples, p.samples...)
+	}
+	t.mu.Unlock()
+	if len(samples) < minLatencySamples {
+		return max
+	}
+
+	budget := predictTokens(samples, target)
+	if budget > max {
+		budget = max
+	}
+	if budget < minPromptBudget {
+		budget = min(minPromptBudget, max)
+	}
+	return budget
+}
+
+// predictTokens estimates the prompt size answered within target. With
+// varied prompt sizes it fits latency = base + perToken*tokens by least
+// squares; otherwise it assumes latency is proportional to prompt size.
+func predictTokens(samples []latencySample, target time.Duration) int {
+	n := float64(len(samples))
+	var sumX, sumY, sumXX, sumXY float64
+	for _, s := range samples {
+		x, y := float64(s.tokens), float64(s.elapsed)
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	meanX, meanY := sumX/n, sumY/n
+	varX := sumXX/n - meanX*meanX
+
+	// Require prompt sizes to vary by ~10% before trusting a slope.
+	if varX > (0.1*meanX)*(0.1*meanX) {
+		slope := (sumXY/n - meanX*meanY) / varX
+		if slope > 0 {
+			base := meanY - slope*meanX
+			return int((float64(target) - base) / slope)
+		}
+	}
+	if meanY <= 0 {
+		return int(meanX * 2)
+	}
+	return int(meanX * float64(target) / meanY)
+}
@@ -0,0 +1,108 @@
+package generate
+
+import (
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestLatencyTrackerNeedsSamples(t *testing.T) {
+	lt := NewLatencyTracker()
+	lt.Record("p", 1000, 5*time.Second)
+	if got := lt.Budget("p", 1024, time.Second); got != 1024 {
+		t.Errorf("Budget() with one sample = %d, want max 1024", got)
+	}
+	var nilTracker *LatencyTracker
+	nilTracker.Record("p", 1000, time.Second)
+	if got := nilTracker.Budget("p", 1024, time.Second); got != 1024 {
+		t.Errorf("nil Budget() = %d, want 1024", got)
+	}
+}
+
+func TestLatencyTrackerShrinksWhenSlow(t *testing.T) {
+	lt := NewLatencyTracker()
+	for range 4 {
+		lt.Record("slow", 1000, 2*time.Second)
+	}
+	got := lt.Budget("slow", 1024, time.Second)
+	if got >= 1000 || got < minPromptBudget {
+		t.Errorf("Budget() = %d, want between %d and 1000", got, minPromptBudget)
+	}
+	// Other providers are unaffected.
+	if got := lt.Budget("fast", 1024, time.Second); got != 1024 {
+		t.Errorf("Budget() for unseen provider = %d, want 1024", got)
+	}
+}
+
+func TestLatencyTrackerExpandsWhenFast(t *testing.T) {
+	lt := NewLatencyTracker()
+	for range 4 {
+		lt.Record("p", 300, 200*time.Millisecond)
+	}
+	if got := lt.Budget("p", 1024, time.Second); got != 1024 {
+		t.Errorf("Budget() = %d, want max 1024", got)
+	}
+}
+
+func TestLatencyTrackerFitsPromptSize(t *testing.T) {
+	lt := NewLatencyTracker()
+	// 400ms base plus 1ms per token: 600 tokens meets a 1s target.
+	for _, tokens := range []int{200, 400, 800, 1000} {
+		lt.Record("p", tokens, 400*time.Millisecond+time.Duration(tokens)*time.Millisecond)
+	}
+	if got := lt.Budget("p", 2048, time.Second); got < 590 || got > 610 {
+		t.Errorf("Budget() = %d, want ~600", got)
+	}
+}
+
+func TestLatencyTrackerFloor(t *testing.T) {
+	lt := NewLatencyTracker()
+	for range 4 {
+		lt.Record("p", 1000, 30*time.Second)
+	}
+	if got := lt.Budget("p", 1024, time.Second); got != minPromptBudget {
+		t.Errorf("Budget() = %d, want floor %d", got, minPromptBudget)
+	}
+	if got := lt.Budget("p", 100, time.Second); got != 100 {
+		t.Errorf("Budget() below floor = %d, want max 100", got)
+	}
+}
+
+func TestLatencyTrackerStats(t *testing.T) {
+	lt := NewLatencyTracker()
+	if got := lt.Stats("p"); got.Samples != 0 {
+		t.Errorf("Stats() for unseen provider = %+v, want zero", got)
+	}
+	for i := 1; i <= 10; i++ {
+		lt.Record("p", 500, time.Duration(i)*100*time.Millisecond)
+	}
+	got := lt.Stats("p")
+	if got.Samples != 10 || got.P50 != 500*time.Millisecond || got.P95 != time.Second {
+		t.Errorf("Stats() = %+v, want p50 500ms, p95 1s over 10 samples", got)
+	}
+}
+
+func TestAdaptiveLatencyDeadline(t *testing.T) {
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.AdaptiveLatency = true
+	e := &Engine{
+		generator: NewGenerator("http://localhost", "k", "m", "chat_completions", 120, 0.3, nil, false, false),
+		latency:   NewLatencyTracker(),
+		config:    cfg,
+	}
+	if got := e.latencyDeadline(); got != 0 {
+		t.Errorf("deadline before any samples = %v, want 0", got)
+	}
+	for _, ms := range []int{400, 500, 600, 2000} {
+		e.latency.Record(e.generator.provider(), 500, time.Duration(ms)*time.Millisecond)
+	}
+	if got := e.latencyDeadline(); got != 2*time.Second {
+		t.Errorf("deadline = %v, want p95 2s", got)
+	}
+
+	cfg.Generation.LatencySLOMs = 800
+	if got := e.latencyDeadline(); got != 800*time.Millisecond {
+		t.Errorf("deadline = %v, want configured SLO 800ms", got)
+	}
+}
@@ -0,0 +1,136 @@
+package generate
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+	"github.com/Paranoid-AF/ashlet/index"
+)
+
+const (
+	// ledgerMaxEntries caps the entries kept on disk; older entries are
+	// dropped when the ledger is compacted.
+	ledgerMaxEntries = 10000
+	// ledgerDedupWindow suppresses re-logging the same suggestion while the
+	// user keeps typing around it.
+	ledgerDedupWindow = 10 * time.Minute
+	// ledgerDefaultLimit is the number of recall results when none is given.
+	ledgerDefaultLimit = 20
+)
+
+// ledgerEntry is one line of the ledger file.
+type ledgerEntry struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"` // "shown" or "accepted"
+	Command string    `json:"command"`
+	Cwd     string    `json:"cwd,omitempty"`
+}
+
+// Ledger is an append-only log of suggestions shown to and accepted by the
+// user, kept so past suggestions can be found again. Commands are redacted
+// before they are stored.
+type Ledger struct {
+	mu         sync.Mutex
+	log        *index.CappedLog[ledgerEntry]
+	lastLogged map[string]time.Time
+}
+
+// NewLedger opens the ledger at path, loading existing entries. An empty
+// path keeps the ledger in memory only.
+func NewLedger(path string) *Ledger {
+	return &Ledger{
+		log:        index.OpenCappedLog[ledgerEntry]("ledger", path, ledgerMaxEntries, nil),
+		lastLogged: make(map[string]time.Time),
+	}
+}
+
+// Record appends an event for each command. Commands recorded with the same
+// event and cwd within ledgerDedupWindow are skipped.
+func (l *Ledger) Record(event, cwd string, commands ...string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.lastLogged) > 1000 {
+		for k, t := range l.lastLogged {
+			if now.Sub(t) >= ledgerDedupWindow {
+				delete(l.lastLogged, k)
+			}
+		}
+	}
+
+	var added []ledgerEntry
+	for _, cmd := range commands {
+		cmd = core.RedactCommand(strings.TrimSpace(cmd))
+		if cmd == "" {
+			continue
+		}
+		key := event + "\x00" + cwd + "\x00" + cmd
+		if last, ok := l.lastLogged[key]; ok && now.Sub(last) < ledgerDedupWindow {
+			continue
+		}
+		l.lastLogged[key] = now
+		added = append(added, ledgerEntry{Time: now, Event: event, Command: cmd, Cwd: cwd})
+	}
+	if len(added) == 0 {
+		return
+	}
+	l.log.Append(added...)
+}
+
+// Search returns past suggestions whose command contains every word of
+// query (case-insensitive), most recent first, one entry per command.
+// An empty query matches everything.
+func (l *Ledger) Search(query string, limit int) []ashlet.RecallEntry {
+	if l == nil {
+		return nil
+	}
+	if limit <= 0 {
+		limit = ledgerDefaultLimit
+	}
+	terms := strings.Fields(strings.ToLower(query))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []ashlet.RecallEntry
+	byCommand := make(map[string]int)
+	for i := len(l.log.Entries) - 1; i >= 0; i-- {
+		entry := l.log.Entries[i]
+		if !matchesAll(strings.ToLower(entry.Command), terms) {
+			continue
+		}
+		if idx, ok := byCommand[entry.Command]; ok {
+			if entry.Event == "accepted" {
+				out[idx].Accepted = true
+			}
+			continue
+		}
+		if len(out) >= limit {
+			continue // keep scanning only to mark accepted flags
+		}
+		byCommand[entry.Command] = len(out)
+		out = append(out, ashlet.RecallEntry{
+			Command:  entry.Command,
+			Cwd:      entry.Cwd,
+			Time:     entry.Time.Format(time.RFC3339),
+			Accepted: entry.Event == "accepted",
+		})
+	}
+	return out
+}
+
+func matchesAll(s string, terms []string) bool {
+	for _, t := range terms {
+		if !strings.Contains(s, t) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package generate
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLedgerSearch(t *testing.T) {
+	l := NewLedger("")
+	l.Record("shown", "/proj", "docker system prune -a", "docker ps")
+	l.Record("shown", "/proj", "docker image prune")
+	l.Record("accepted", "/proj", "docker system prune -a")
+
+	got := l.Search("docker prune", 0)
+	if len(got) != 2 {
+		t.Fatalf("Search returned %d entries, want 2: %+v", len(got), got)
+	}
+	if got[0].Command != "docker system prune -a" || !got[0].Accepted {
+		t.Errorf("first entry = %+v, want accepted docker system prune -a", got[0])
+	}
+	if got[1].Command != "docker image prune" || got[1].Accepted {
+		t.Errorf("second entry = %+v, want shown docker image prune", got[1])
+	}
+
+	if got := l.Search("DOCKER PS", 0); len(got) != 1 {
+		t.Errorf("search should be case-insensitive, got %+v", got)
+	}
+	if got := l.Search("", 1); len(got) != 1 {
+		t.Errorf("limit 1 returned %d entries", len(got))
+	}
+	if got := l.Search("kubectl", 0); len(got) != 0 {
+		t.Errorf("unexpected matches: %+v", got)
+	}
+}
+
+func TestLedgerDedup(t *testing.T) {
+	l := NewLedger("")
+	l.Record("shown", "/proj", "make test")
+	l.Record("shown", "/proj", "make test")
+	l.Record("shown", "/other", "make test")
+	if len(l.log.Entries) != 2 {
+		t.Errorf("expected repeated suggestion to be logged once per cwd, got %d entries", len(l.log.Entries))
+	}
+}
+
+func TestLedgerRedacts(t *testing.T) {
+	l := NewLedger("")
+	l.Record("shown", "/proj", "curl -H $API_TOKEN https://example.com")
+	got := l.Search("curl", 0)
+	if len(got) != 1 || strings.Contains(got[0].Command, "API_TOKEN") {
+		t.Errorf("ledger should store redacted commands, got %+v", got)
+	}
+}
+
+func TestLedgerPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l := NewLedger(path)
+	l.Record("shown", "/proj", "terraform plan")
+	l.Record("accepted", "/proj", "terraform plan")
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("ledger permissions = %o, want 600", perm)
+	}
+
+	reloaded := NewLedger(path)
+	got := reloaded.Search("terraform", 0)
+	if len(got) != 1 || !got[0].Accepted {
+		t.Errorf("reloaded Search = %+v, want accepted terraform plan", got)
+	}
+}
+
+func TestLedgerCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l := NewLedger(path)
+	for i := 0; i < ledgerMaxEntries+ledgerMaxEntries/10+1; i++ {
+		l.Record("shown", "/proj", "echo "+strconv.Itoa(i))
+	}
+	if len(l.log.Entries) != ledgerMaxEntries {
+		t.Errorf("entries after compaction = %d, want %d", len(l.log.Entries), ledgerMaxEntries)
+	}
+	reloaded := NewLedger(path)
+	if len(reloaded.log.Entries) != ledgerMaxEntries {
+		t.Errorf("reloaded entries = %d, want %d", len(reloaded.log.Entries), ledgerMaxEntries)
+	}
+}
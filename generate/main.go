@@ -3,14 +3,19 @@ package generate
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"maps"
+	"net"
 	"os"
-	"regexp"
-	"sort"
+	"slices"
 	"strings"
-	"text/template"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
 	defaults "github.com/Paranoid-AF/ashlet/default"
 	"github.com/Paranoid-AF/ashlet/index"
 )
@@ -18,29 +23,119 @@ import (
 // DefaultMaxCandidates is used when the request does not specify a limit.
 const DefaultMaxCandidates = 4
 
+// backgroundWorkers caps concurrent background tasks (indexing batches,
+// directory warm-ups); they also pause while a completion is running.
+// embedding.parallelism raises it, so indexing can embed that many batches
+// at once.
+const backgroundWorkers = 2
+
+// maxAliases caps the aliases and functions shown to the model; those
+// related to the input are kept first.
+const maxAliases = 40
+
+// maxRecentShown caps the recent commands shown to the model.
+const maxRecentShown = 5
+
 // Engine orchestrates context gathering and model inference for completions.
 type Engine struct {
+	paths        ashlet.Paths // where config, history, and state are
 	gatherer     *Gatherer
 	generator    *Generator
 	dirCache     *DirCache
+	execs        *ExecCache
+	helps        *HelpCache
+	docs         *DocCache
+	feedback     *FeedbackStore
+	ledger       *Ledger
+	capture      *CaptureStore
+	summaries    *SummaryCache
+	sessions     *SessionTracker
 	config       *ashlet.Config
-	customPrompt string // loaded custom prompt template (empty = use default)
+	promptMu     sync.RWMutex // guards the templates below, which are reloaded when their files change
+	customPrompt string       // loaded custom prompt template (empty = use default)
+	customFix    string       // loaded custom fix-mode prompt template (empty = use default)
+	promptB      string       // second prompt template A/B tested against the first (empty = no test)
+	prompts      *promptWatcher
+	promptTurn   atomic.Uint64
+	latency      *LatencyTracker
+	health       *index.HealthTracker
+	embedder     *index.Embedder // nil when embedding is disabled
+	usage        *index.UsageStore
+	audit        *index.AuditLog // nil unless the audit log is on
+	limiter      *rateLimiter
+	sched        *index.Scheduler
+	completers   map[string]Completer // registered with SetCompleter
+	projects     *projectCache        // per-project views; nil in the views themselves
+	flights      flightGroup          // coalesces identical model requests
+	upgrades     upgradeCounters      // outcomes of progressive completions
+	anonymizer   *core.Anonymizer     // nil unless generation.anonymize
+
+	// noLocalContext disables directory context and previews entirely, for a
+	// daemon whose clients are all on other machines.
+	noLocalContext bool
+}
+
+// EngineOptions configures NewEngineWithOptions.
+type EngineOptions struct {
+	// Paths locates config, history, and state; the zero value means the
+	// current user.
+	Paths ashlet.Paths
+	// NoLocalContext disables context read from the daemon's filesystem
+	// (directory listings, manifests, git status, previews). Use it when the
+	// daemon serves shells on another host over a forwarded socket.
+	NoLocalContext bool
+	// Latency is shared between engines so latency observations survive
+	// config reloads and are pooled across users of one provider; nil gives
+	// the engine a tracker of its own.
+	Latency *LatencyTracker
+	// Health is shared between engines like Latency, so provider health
+	// and circuit breaker state survive config reloads; nil gives the
+	// engine a tracker of its own.
+	Health *index.HealthTracker
+	// AuditLog turns the audit log on (see ashlet.TelemetryConfig.AuditLog)
+	// whatever the config says.
+	AuditLog bool
 }
 
-// NewEngine creates a new completion engine.
+// NewEngine creates a new completion engine for the current user.
 func NewEngine() *Engine {
-	cfg, err := ashlet.LoadConfig()
+	return NewEngineWithOptions(EngineOptions{})
+}
+
+// NewEngineWithOptions creates a completion engine that reads config and
+// history and keeps state at the locations described by opts.Paths.
+func NewEngineWithOptions(opts EngineOptions) *Engine {
+	paths := opts.Paths
+	cfg, err := paths.LoadConfig()
 	if err != nil {
 		slog.Warn("failed to load config, using defaults", "error", err)
 		cfg = ashlet.DefaultConfig()
 	}
 
-	// Load custom prompt if available
-	customPrompt := loadCustomPrompt()
+	// Load custom prompts if available
+	customPrompt := loadCustomPrompt(paths, paths.PromptPath())
+	customFix := loadCustomPrompt(paths, paths.FixPromptPath())
+	promptB := loadCustomPrompt(paths, paths.PromptBPath())
 	if customPrompt == "" {
 		slog.Debug("no custom prompt, using built-in default")
 	}
 
+	health := opts.Health
+	if health == nil {
+		health = index.NewHealthTracker()
+	}
+	usage := index.NewUsageStore(paths.UsagePath())
+	var audit *index.AuditLog
+	if cfg.Telemetry.AuditLog || opts.AuditLog {
+		audit = index.NewAuditLog(paths.AuditPath())
+	}
+
+	// Redaction settings are process-wide: only the daemon's own engine
+	// (no Paths.Home override) sets them.
+	if paths.Home == "" {
+		core.SetSecretSensitivity(cfg.Generation.SecretSensitivity)
+	}
+
 	// Create embedder if embedding is configured
 	var embedder *index.Embedder
 	if ashlet.EmbeddingEnabled(cfg) {
@@ -49,40 +144,105 @@ func NewEngine() *Engine {
 			ashlet.ResolveEmbeddingAPIKey(cfg),
 			ashlet.ResolveEmbeddingModel(cfg),
 		)
+		embedder.SetHealth(health)
+		embedder.SetUsage(usage)
+		embedder.SetAudit(audit)
 	}
 
-	// Create generator if API key is available
-	var gen *Generator
-	genAPIKey := ashlet.ResolveGenerationAPIKey(cfg)
-	if genAPIKey != "" {
-		gen = NewGenerator(
-			ashlet.ResolveGenerationBaseURL(cfg),
-			genAPIKey,
-			ashlet.ResolveGenerationModel(cfg),
-			cfg.Generation.APIType,
-			cfg.Generation.MaxTokens,
-			cfg.Generation.Temperature,
-			cfg.Generation.Stop,
-			ashlet.OpenRouterTelemetryEnabled(cfg),
-		)
-	} else {
+	gen := newConfiguredGenerator(cfg, health, usage, audit)
+	if gen == nil {
 		slog.Warn("generation API key not configured")
 	}
 
-	return &Engine{
-		gatherer:     NewGatherer(embedder, cfg),
+	latency := opts.Latency
+	if latency == nil {
+		latency = NewLatencyTracker()
+	}
+
+	sched := index.NewScheduler(max(backgroundWorkers, embedParallelism(cfg)))
+
+	home := paths.Home
+	if home == "" {
+		home, _ = os.UserHomeDir()
+	}
+	dirCache := NewDirCache()
+	dirCache.SetSensitiveDirs(cfg.Generation.SensitiveDirs, home)
+
+	var anonymizer *core.Anonymizer
+	if cfg.Generation.Anonymize {
+		anonymizer = core.NewAnonymizer(home, cfg.Generation.InternalDomains)
+	}
+
+	gatherer := newGatherer(embedder, cfg, historySource(cfg, paths), gathererOptions{
+		sched:      sched,
+		cachePath:  paths.EmbeddingCachePath(),
+		ignore:     historyIgnore(paths),
+		anonymizer: anonymizer,
+	})
+
+	e := &Engine{
+		paths:        paths,
+		gatherer:     gatherer,
 		generator:    gen,
-		dirCache:     NewDirCache(),
+		dirCache:     dirCache,
+		execs:        NewExecCache(),
+		helps:        NewHelpCache(),
+		docs:         NewDocCache(home),
+		feedback:     NewFeedbackStore(paths.FeedbackPath()),
+		ledger:       NewLedger(paths.LedgerPath()),
+		capture:      NewCaptureStore(paths.CorpusPath()),
+		summaries:    NewSummaryCache(),
+		sessions:     NewSessionTracker(),
 		config:       cfg,
 		customPrompt: customPrompt,
+		customFix:    customFix,
+		promptB:      promptB,
+		latency:      latency,
+		health:       health,
+		embedder:     embedder,
+		usage:        usage,
+		audit:        audit,
+		limiter:      newRateLimiter(usage),
+		sched:        sched,
+		projects:     newProjectCache(),
+		anonymizer:   anonymizer,
+
+		noLocalContext: opts.NoLocalContext,
+	}
+	e.prompts = watchPrompts(e, paths)
+	return e
+}
+
+// newConfiguredGenerator creates the generator cfg describes, or returns
+// nil if no generation API key is available.
+func newConfiguredGenerator(cfg *ashlet.Config, health *index.HealthTracker, usage *index.UsageStore, audit *index.AuditLog) *Generator {
+	apiKey := ashlet.ResolveGenerationAPIKey(cfg)
+	if apiKey == "" {
+		return nil
 	}
+	gen := NewGenerator(
+		ashlet.ResolveGenerationBaseURL(cfg),
+		apiKey,
+		ashlet.ResolveGenerationModel(cfg),
+		cfg.Generation.APIType,
+		cfg.Generation.MaxTokens,
+		cfg.Generation.Temperature,
+		cfg.Generation.Stop,
+		ashlet.OpenRouterTelemetryEnabled(cfg),
+		ashlet.JSONOutputEnabled(cfg),
+	)
+	gen.health = health
+	gen.toolOutput = ashlet.ToolOutputEnabled(cfg)
+	gen.usage = usage
+	gen.audit = audit
+	return gen
 }
 
-// loadCustomPrompt loads a custom prompt template.
+// loadCustomPrompt loads a custom prompt template from promptPath, read
+// through paths (see ashlet.Paths.Open).
 // Returns empty string if no custom prompt exists.
-func loadCustomPrompt() string {
-	promptPath := ashlet.PromptPath()
-	data, err := os.ReadFile(promptPath)
+func loadCustomPrompt(paths ashlet.Paths, promptPath string) string {
+	data, err := paths.ReadFile(promptPath)
 	if err != nil {
 		return ""
 	}
@@ -90,7 +250,8 @@ func loadCustomPrompt() string {
 	return string(data)
 }
 
-// Close releases resources held by the engine.
+// Close releases resources held by the engine, writing what it holds in
+// memory to disk.
 func (e *Engine) Close() {
 	if e.generator != nil {
 		e.generator.Close()
@@ -101,21 +262,87 @@ func (e *Engine) Close() {
 	if e.dirCache != nil {
 		e.dirCache.Close()
 	}
+	e.prompts.Close()
+	e.execs.Close()
+	e.sessions.Close()
+	e.usage.Flush()
+	if err := e.feedback.Save(); err != nil {
+		slog.Warn("failed to save feedback", "error", err)
+	}
 }
 
 // WarmContext pre-populates the directory context cache for the given path.
 func (e *Engine) WarmContext(ctx context.Context, cwd string) {
+	if e.noLocalContext {
+		return
+	}
+	release, err := e.sched.Acquire(ctx, index.PriorityBackground)
+	if err != nil {
+		return
+	}
+	defer release()
 	e.dirCache.Gather(ctx, cwd)
 }
 
-// LoadIndexCache loads a previously saved embedding cache from disk.
-func (e *Engine) LoadIndexCache(path string) error {
-	return e.gatherer.LoadIndexCache(path)
+// localContext reports whether a request from host may use context read
+// from the daemon's filesystem.
+func (e *Engine) localContext(host string) bool {
+	return !e.noLocalContext && IsLocalHost(host)
 }
 
-// SaveIndexCache writes the current embedding index to disk.
-func (e *Engine) SaveIndexCache(path string) error {
-	return e.gatherer.SaveIndexCache(path)
+// RecordHistoryEvent learns a command the shell reports having finished,
+// the history read when generation.history_source is "shell".
+func (e *Engine) RecordHistoryEvent(ev *ashlet.HistoryEventRequest) {
+	if e.config.Generation.NoHistory {
+		return
+	}
+	duration := time.Duration(ev.DurationMs) * time.Millisecond
+	e.gatherer.RecordHistory(index.HistoryEntry{
+		Command:  ev.Command,
+		Time:     time.Now().Add(-duration),
+		Cwd:      ev.Cwd,
+		ExitCode: ev.ExitCode,
+		Duration: duration,
+		Session:  ev.SessionID,
+	})
+}
+
+// RecordFeedback records the user's reaction to a candidate so that future
+// rankings favour the command shapes the user accepts.
+func (e *Engine) RecordFeedback(fb *ashlet.FeedbackRequest) {
+	e.feedback.Record(fb)
+	if variant := e.sessions.Variant(fb.SessionID); variant != "" {
+		e.feedback.RecordVariant(variant, fb.Event)
+	}
+	switch fb.Event {
+	case "accepted":
+		e.ledger.Record("accepted", fb.Cwd, fb.Candidate)
+		e.sessions.RecordRan(fb.SessionID, fb.Candidate)
+	case "edited":
+		e.ledger.Record("accepted", fb.Cwd, fb.Executed)
+		e.sessions.RecordRan(fb.SessionID, fb.Executed)
+	}
+}
+
+// Capture starts or stops capturing a session's completions into the eval
+// corpus, or completes the captured entries with the command it ran.
+func (e *Engine) Capture(req *ashlet.CaptureRequest) *ashlet.CaptureResponse {
+	return e.capture.Handle(req)
+}
+
+// Recall searches the ledger of past suggestions.
+func (e *Engine) Recall(req *ashlet.RecallRequest) *ashlet.RecallResponse {
+	entries := e.ledger.Search(req.Query, req.Limit)
+	if entries == nil {
+		entries = []ashlet.RecallEntry{}
+	}
+	return &ashlet.RecallResponse{OK: true, Entries: entries}
+}
+
+// OpenIndexCache keeps the embedding index in the SQLite database at path,
+// so a restart does not embed history again.
+func (e *Engine) OpenIndexCache(path string) error {
+	return e.gatherer.OpenIndexCache(path)
 }
 
 // CompleteResult holds the response and gathered context from a completion.
@@ -123,36 +350,84 @@ type CompleteResult struct {
 	Response   *ashlet.Response
 	Info       *Info
 	DirContext *DirContext
+	// Context is what the completer was shown; nil when it was not asked.
+	Context *core.UserContext
 }
 
 // Complete processes a completion request and returns a response.
 func (e *Engine) Complete(ctx context.Context, req *ashlet.Request) *ashlet.Response {
-	return e.complete(ctx, req).Response
+	if req.Mode != "fix" && !req.DryRun && !e.debounce(ctx) {
+		// Superseded by a newer request from the same session.
+		return &ashlet.Response{Candidates: []ashlet.Candidate{}}
+	}
+	start := time.Now()
+	release, _ := e.sched.Acquire(ctx, index.PriorityInteractive)
+	defer release()
+	result := e.complete(ctx, req)
+	resp := result.Response
+	if result.Context != nil && e.capture.Enabled(req.SessionID) {
+		e.capture.Record(req.SessionID, *result.Context, resp)
+	}
+	core.AnnotateDiffs(resp.Candidates, req.Input)
+	// The scoring breakdown is for verbose responses only.
+	if req.Verbose {
+		resp.Debug = e.debugInfo(req, result, time.Since(start))
+	} else {
+		for i := range resp.Candidates {
+			resp.Candidates[i].Score = nil
+		}
+	}
+	if req.Mode != "fix" && !req.DryRun {
+		e.sessions.RecordInput(req.SessionID, req.Input)
+	}
+	if resp.Error == nil && ctx.Err() == nil && len(resp.Candidates) > 0 {
+		cmds := make([]string, len(resp.Candidates))
+		for i, c := range resp.Candidates {
+			cmds[i] = c.Completion
+		}
+		e.ledger.Record("shown", req.Cwd, cmds...)
+		if resp.PromptVariant != "" {
+			e.sessions.RecordVariant(req.SessionID, resp.PromptVariant)
+			e.feedback.RecordShown(resp.PromptVariant)
+		}
+	}
+	return resp
 }
 
-// CompleteVerbose is like Complete but also returns the gathered context.
+// CompleteVerbose is like Complete but also returns the gathered context,
+// and explains each candidate's ranking in its Score.
 func (e *Engine) CompleteVerbose(ctx context.Context, req *ashlet.Request) *CompleteResult {
-	return e.complete(ctx, req)
+	release, _ := e.sched.Acquire(ctx, index.PriorityInteractive)
+	defer release()
+	result := e.complete(ctx, req)
+	core.AnnotateDiffs(result.Response.Candidates, req.Input)
+	return result
 }
 
 func (e *Engine) complete(ctx context.Context, req *ashlet.Request) *CompleteResult {
-	// Check if API key is configured
-	if e.generator == nil {
-		return &CompleteResult{
-			Response: &ashlet.Response{
-				Candidates: []ashlet.Candidate{},
-				Error: &ashlet.Error{
-					Code:    "not_configured",
-					Message: "generation API key not configured; set ASHLET_GENERATION_API_KEY or run 'ashlet --config'",
-				},
-			},
-		}
+	if p := e.forProject(req); p != e {
+		return p.complete(ctx, req)
+	}
+
+	// Without an API key, complete from history alone; fix mode needs the
+	// model.
+	completer := e.completer(req.Completer)
+	unconfigured := completer == nil
+	if unconfigured {
+		completer = e.fallback()
+	}
+	if req.Mode == "fix" && e.generator == nil {
+		return notConfigured()
 	}
 
 	// Strip trailing newlines the shell client appends as line terminators.
 	req.Input = strings.TrimRight(req.Input, "\n")
 	req.Cwd = strings.TrimRight(req.Cwd, "\n")
 
+	if req.Mode == "fix" {
+		return e.completeFix(ctx, req)
+	}
+
 	// Clamp cursor position to the (now-trimmed) input length.
 	if req.CursorPos > len(req.Input) {
 		req.CursorPos = len(req.Input)
@@ -165,7 +440,38 @@ func (e *Engine) complete(ctx context.Context, req *ashlet.Request) *CompleteRes
 		}
 	}
 
-	info := e.gatherer.Gather(ctx, req)
+	// Of a multi-line (usually pasted) input, only the last line is
+	// completed; the lines above are summarised rather than sent whole.
+	maxLines, maxBytes := e.inputLimits()
+	paste, multiline := splitPastedInput(req.Input, req.CursorPos)
+	if multiline {
+		if paste == nil || strings.TrimSpace(paste.line) == "" {
+			return &CompleteResult{
+				Response: &ashlet.Response{Candidates: []ashlet.Candidate{}},
+			}
+		}
+		lineReq := *req
+		lineReq.Input, lineReq.CursorPos = paste.line, paste.cursor
+		req = &lineReq
+	}
+	if len(req.Input) > maxBytes {
+		slog.Debug("input too large to complete", "bytes", len(req.Input))
+		return &CompleteResult{
+			Response: &ashlet.Response{Candidates: []ashlet.Candidate{}},
+		}
+	}
+
+	gatherStart := time.Now()
+	var info *Info
+	if e.config.Generation.NoHistory {
+		info = &Info{LastFailure: describeLastFailure(req.LastCommand, req.ExitCode)}
+	} else {
+		if !req.DryRun {
+			e.gatherer.NoteExecuted(req.LastCommand)
+		}
+		info = e.gatherer.Gather(ctx, req)
+	}
+	info.Elapsed = time.Since(gatherStart)
 
 	slog.Debug("context gathered",
 		"recent_commands", strings.Join(info.RecentCommands, " | "),
@@ -185,578 +491,604 @@ func (e *Engine) complete(ctx context.Context, req *ashlet.Request) *CompleteRes
 		maxCandidates = DefaultMaxCandidates
 	}
 
-	dirCtx := e.dirCache.Get(req.Cwd)
+	var dirCtx *DirContext
+	if e.localContext(req.Host) {
+		dirCtx = e.anonymizer.AnonymizeDir(e.dirCache.Get(req.Cwd))
+	}
 
-	systemPrompt := e.buildSystemPrompt(maxCandidates)
-	userMessage := e.buildUserMessage(req, info, dirCtx)
+	uc := e.userContext(req, info, dirCtx)
+	if paste != nil {
+		uc.Preceding = paste.summary(maxLines, maxBytes)
+	}
 
-	slog.Debug("prompt", "system", systemPrompt, "user", userMessage)
+	if req.DryRun {
+		return &CompleteResult{
+			Response:   &ashlet.Response{Candidates: []ashlet.Candidate{}, Prompt: e.dryRunPrompt(uc, maxCandidates)},
+			Info:       info,
+			DirContext: dirCtx,
+		}
+	}
 
-	output, err := e.generator.Generate(ctx, systemPrompt, userMessage)
+	input := strings.TrimLeft(req.Input, " \t")
+	query := &Query{Request: req, Input: input, Info: info, Context: uc, Max: maxCandidates}
+	if req.Completer == "" && e.completesFirstWord(req, input) {
+		// The model adds little to a command name; save the API call.
+		completer = commandCompleter{e: e, next: completer}
+	}
+	result, err := completer.Complete(ctx, query)
+	if result == nil {
+		result = &Completion{}
+	}
+	if err != nil && ctx.Err() == nil && !errors.Is(err, errRateLimited) {
+		// The API is failing or unreachable: degraded candidates from
+		// history beat an error. A rate-limited request is reported as
+		// such, so the shell backs off.
+		if fallback, _ := e.fallback().Complete(ctx, query); fallback != nil && len(fallback.Candidates) > 0 {
+			slog.Warn("generation failed, completing from history", "error", err)
+			result, err = fallback, nil
+		}
+	}
+	if unconfigured && len(result.Candidates) == 0 {
+		return notConfigured()
+	}
+	variant := result.PromptVariant
+	candidates := result.Candidates
 	if err != nil {
-		slog.Error("generation error", "error", err)
+		if errors.Is(err, errRateLimited) {
+			slog.Debug("generation skipped", "error", err)
+		} else {
+			slog.Error("generation error", "error", err)
+		}
 		return &CompleteResult{
 			Response: &ashlet.Response{
-				Candidates: []ashlet.Candidate{},
-				Error: &ashlet.Error{
-					Code:    "api_error",
-					Message: err.Error(),
-				},
+				Candidates:    []ashlet.Candidate{},
+				PromptVariant: variant,
+				Error:         generationError(err),
 			},
 			Info:       info,
 			DirContext: dirCtx,
 		}
 	}
 
-	input := strings.TrimLeft(req.Input, " \t")
-	candidates := parseCandidates(output, input, maxCandidates)
 	if candidates == nil {
 		candidates = []ashlet.Candidate{}
 	}
 
 	// Always post-process quote filtering on candidates
-	candidates = filterCandidateQuotes(candidates, input)
-	sortCandidates(candidates, input)
+	candidates = core.FilterCandidateQuotes(candidates, input)
+	candidates = core.FilterNeverSuggest(candidates, e.neverSuggest())
+	candidates = core.PreferAliases(candidates, input, req.Aliases)
+	for i := range candidates {
+		candidates[i].Score = &ashlet.Score{Position: candidates[i].Confidence}
+	}
+	if !result.Ranked {
+		e.rank(candidates, input, info)
+	}
+	if collapsed, dropped := core.CollapseQuoteVariants(candidates); dropped > 0 {
+		candidates = e.diversify(ctx, collapsed, query)
+	}
+	// The command and flag checks and the construct completion parse
+	// candidates as POSIX sh: fish, nushell, and PowerShell candidates
+	// are left as the model wrote them.
+	posix := core.POSIXShell(req.Shell)
+	if posix {
+		candidates = e.checkExecutables(candidates, req, input)
+		candidates = e.checkFlags(candidates, req)
+	}
+	core.FlagDangerous(candidates)
+	if paste != nil {
+		candidates = paste.restore(candidates)
+	}
+	// Close or drop unfinished for/if/case bodies, after the earlier lines
+	// of a multi-line input are back in place.
+	if posix {
+		candidates = core.CompleteConstructs(candidates)
+	}
 
 	return &CompleteResult{
-		Response:   &ashlet.Response{Candidates: candidates},
+		Response:   &ashlet.Response{Candidates: candidates, PromptVariant: variant, Meta: result.Meta},
 		Info:       info,
 		DirContext: dirCtx,
+		Context:    &uc,
 	}
 }
 
-// PromptData holds the data passed to the prompt template.
-type PromptData struct {
-	MaxCandidates    int
-	CWD              string
-	RecentCommands   []string
-	RelevantCommands []string
-	InputBefore      string
-	InputAfter       string
-	Input            string
-	DirListing       string
-	DirManifests     map[string]string
-	GitRootListing   string
-	GitStagedFiles   string
-	GitManifests     map[string]string
-	PackageManager   string
-}
-
-var promptFuncs = template.FuncMap{
-	"bullet": func(items []string) string {
-		if len(items) == 0 {
-			return ""
+// diversify tops up candidates left short by CollapseQuoteVariants with
+// history commands that are not variants of any of them, up to q.Max.
+func (e *Engine) diversify(ctx context.Context, candidates []ashlet.Candidate, q *Query) []ashlet.Candidate {
+	if len(candidates) >= q.Max {
+		return candidates
+	}
+	alternatives, _ := e.fallback().Complete(ctx, q)
+	if alternatives == nil {
+		return candidates
+	}
+	seen := make(map[string]bool, len(candidates))
+	for _, c := range candidates {
+		seen[core.QuoteVariantKey(c.Completion)] = true
+	}
+	// Alternatives go through the same filters as the candidates did.
+	filtered := core.FilterCandidateQuotes(alternatives.Candidates, q.Input)
+	filtered = core.FilterNeverSuggest(filtered, e.neverSuggest())
+	for _, alt := range filtered {
+		if len(candidates) >= q.Max {
+			break
 		}
-		var sb strings.Builder
-		for _, item := range items {
-			sb.WriteString("- ")
-			sb.WriteString(item)
-			sb.WriteString("\n")
+		key := core.QuoteVariantKey(alt.Completion)
+		if seen[key] {
+			continue
 		}
-		return strings.TrimSuffix(sb.String(), "\n")
-	},
-	"join": func(items []string, sep string) string {
-		return strings.Join(items, sep)
-	},
-}
-
-// buildSystemPrompt renders the system prompt from the template.
-func (e *Engine) buildSystemPrompt(maxCandidates int) string {
-	tmplSrc := e.customPrompt
-	if tmplSrc == "" {
-		tmplSrc = defaults.DefaultPrompt
+		seen[key] = true
+		alt.Confidence = positionConfidence(len(candidates))
+		alt.Score = &ashlet.Score{Position: alt.Confidence}
+		candidates = append(candidates, alt)
 	}
+	return candidates
+}
 
-	data := PromptData{
-		MaxCandidates: maxCandidates,
+// notConfigured is the result when the model is needed but has no API key.
+func notConfigured() *CompleteResult {
+	return &CompleteResult{
+		Response: &ashlet.Response{
+			Candidates: []ashlet.Candidate{},
+			Error: &ashlet.Error{
+				Code:    "not_configured",
+				Message: "generation API key not configured; set ASHLET_GENERATION_API_KEY or run 'ashlet --config'",
+			},
+		},
 	}
+}
 
-	t, err := template.New("prompt").Funcs(promptFuncs).Parse(tmplSrc)
-	if err != nil {
-		slog.Warn("failed to parse prompt template, falling back to default", "error", err)
-		t, _ = template.New("prompt").Funcs(promptFuncs).Parse(defaults.DefaultPrompt)
-	}
+// buildSystemPrompt renders the system prompt from the template of the
+// given prompt variant ("" or "a" for prompt.md, "b" for prompt_b.md).
+func (e *Engine) buildSystemPrompt(maxCandidates int, variant string) string {
+	return e.renderSystemPrompt(variant, e.promptData(maxCandidates))
+}
 
-	var buf strings.Builder
-	if err := t.Execute(&buf, data); err != nil {
-		slog.Warn("failed to execute prompt template, falling back to default", "error", err)
-		t, _ = template.New("prompt").Funcs(promptFuncs).Parse(defaults.DefaultPrompt)
-		buf.Reset()
-		t.Execute(&buf, data)
+// buildPrompts renders the system prompt and user message of a completion
+// with context uc. The context goes in the user message unless
+// generation.system_context moves it to the system prompt.
+func (e *Engine) buildPrompts(maxCandidates int, variant string, uc core.UserContext) (systemPrompt, userMessage string) {
+	data := e.promptData(maxCandidates)
+	data.Shell = uc.Shell
+	if e.config == nil || !e.config.Generation.SystemContext {
+		return e.renderSystemPrompt(variant, data), core.BuildUserMessage(uc)
 	}
-
-	return strings.TrimRight(buf.String(), " \t\n")
+	return e.renderSystemPrompt(variant, data.WithContext(uc)), core.BuildInputMessage(uc)
 }
 
-// buildUserMessage constructs the user message from context and input.
-func (e *Engine) buildUserMessage(req *ashlet.Request, info *Info, dirCtx *DirContext) string {
-	var sb strings.Builder
-
-	if req.Cwd != "" {
-		sb.WriteString("cwd: ")
-		sb.WriteString(req.Cwd)
-		sb.WriteString("\n")
+// debugInfo describes, for a verbose response, the context result was
+// completed from and how long it took.
+func (e *Engine) debugInfo(req *ashlet.Request, result *CompleteResult, elapsed time.Duration) *ashlet.Debug {
+	d := &ashlet.Debug{TotalMs: elapsed.Milliseconds()}
+	if info := result.Info; info != nil {
+		d.RecentCommands = info.RecentCommands
+		d.RelevantCommands = info.RelevantCommands
+		d.RecentHere = info.RecentHere
+		d.LastFailure = info.LastFailure
+		d.GatherMs = info.Elapsed.Milliseconds()
 	}
-
-	if dirCtx != nil {
-		if dirCtx.CwdListing != "" {
-			sb.WriteString("files: ")
-			sb.WriteString(dirCtx.CwdListing)
-			sb.WriteString("\n")
-		}
-		if dirCtx.PackageManager != "" {
-			sb.WriteString("pkg: ")
-			sb.WriteString(dirCtx.PackageManager)
-			sb.WriteString("\n")
-		}
-		if dirCtx.GitRootListing != "" {
-			sb.WriteString("project files: ")
-			sb.WriteString(dirCtx.GitRootListing)
-			sb.WriteString("\n")
-		}
-		if dirCtx.GitStagedFiles != "" {
-			sb.WriteString("staged: ")
-			sb.WriteString(dirCtx.GitStagedFiles)
-			sb.WriteString("\n")
-		}
-		for name, content := range dirCtx.CwdManifests {
-			sb.WriteString(name)
-			sb.WriteString(": ")
-			sb.WriteString(content)
-			sb.WriteString("\n")
-		}
-		for name, content := range dirCtx.GitManifests {
-			sb.WriteString(name)
-			sb.WriteString(": ")
-			sb.WriteString(content)
-			sb.WriteString("\n")
+	if dc := result.DirContext; dc != nil {
+		d.Dir = &ashlet.DirSummary{
+			Files:          len(strings.Fields(dc.CwdListing)),
+			ProjectFiles:   len(strings.Fields(dc.GitRootListing)),
+			Staged:         len(strings.Fields(dc.GitStagedFiles)),
+			PackageManager: dc.PackageManager,
+			Nix:            dc.Nix,
+			Terraform:      dc.Terraform,
+			Languages:      dc.Languages,
+			Manifests:      slices.Sorted(maps.Keys(dc.CwdManifests)),
 		}
 	}
-
-	// Cap recent commands at 5
-	limit := len(info.RecentCommands)
-	if limit > 5 {
-		limit = 5
-	}
-	recentCmds := index.FilterQuoteContentSlice(index.RedactCommands(info.RecentCommands[:limit]))
-	if len(recentCmds) > 0 {
-		sb.WriteString("recent: ")
-		sb.WriteString(strings.Join(recentCmds, ", "))
-		sb.WriteString("\n")
+	if result.Context != nil {
+		maxCandidates := req.MaxCandidates
+		if maxCandidates <= 0 {
+			maxCandidates = DefaultMaxCandidates
+		}
+		p := e.dryRunPrompt(*result.Context, maxCandidates)
+		d.SystemPromptBytes = len(p.System)
+		d.UserMessageBytes = len(p.User)
+		d.PromptTokens = core.EstimateTokens(p.System + p.User)
 	}
+	return d
+}
 
-	relevantCmds := index.FilterQuoteContentSlice(index.RedactCommands(info.RelevantCommands))
-	if len(relevantCmds) > 0 {
-		sb.WriteString("related: ")
-		sb.WriteString(strings.Join(relevantCmds, ", "))
-		sb.WriteString("\n")
+// dryRunPrompt returns the prompt the model completer would send for uc,
+// rendered with the first prompt template during an A/B test.
+func (e *Engine) dryRunPrompt(uc core.UserContext, maxCandidates int) *ashlet.Prompt {
+	if e.generator != nil && e.generator.fim() {
+		prefix, suffix := core.BuildInfillPrompt(uc)
+		return &ashlet.Prompt{System: prefix, User: suffix}
 	}
+	system, user := e.buildPrompts(maxCandidates, "", uc)
+	return &ashlet.Prompt{System: system, User: user}
+}
 
-	before := req.Input[:req.CursorPos]
-	after := req.Input[req.CursorPos:]
-
-	sb.WriteString("\nInput: `")
-	sb.WriteString(before)
-	if len(after) > 0 {
-		sb.WriteString("█")
+// promptData returns the template data every completion prompt gets.
+func (e *Engine) promptData(maxCandidates int) core.PromptData {
+	return core.PromptData{
+		MaxCandidates:  maxCandidates,
+		JSONOutput:     ashlet.JSONOutputEnabled(e.config),
+		ToolOutput:     ashlet.ToolOutputEnabled(e.config),
+		ChainSeparator: e.chainSeparator(),
 	}
-	sb.WriteString(after)
-	sb.WriteString("`")
-
-	return sb.String()
 }
 
-// candidateBlock represents a parsed <candidate> tag from model output.
-type candidateBlock struct {
-	typ     string // "replace" or "append"
-	content string // inner content between tags
+// renderSystemPrompt renders the template of variant with data.
+func (e *Engine) renderSystemPrompt(variant string, data core.PromptData) string {
+	return e.withNeverSuggest(core.RenderPrompt(e.promptTemplate(variant), defaults.DefaultPrompt, data))
 }
 
-// commandTag represents a parsed <command> tag from model output.
-type commandTag struct {
-	text   string
-	cursor int // byte offset for cursor, or -1 if not set
+// neverSuggest returns the configured generation.never_suggest patterns.
+func (e *Engine) neverSuggest() []string {
+	if e.config == nil {
+		return nil
+	}
+	return e.config.Generation.NeverSuggest
 }
 
-var (
-	reCandidate = regexp.MustCompile(`(?s)<candidate[^>]*\btype="(replace|append)"[^>]*>(.*?)</candidate>`)
-	reCommand   = regexp.MustCompile(`<command\s*>([^<]*)</command>`)
-)
-
-// parseCandidateBlocks extracts <candidate> blocks from model output.
-func parseCandidateBlocks(output string) []candidateBlock {
-	matches := reCandidate.FindAllStringSubmatch(output, -1)
-	blocks := make([]candidateBlock, 0, len(matches))
-	for _, m := range matches {
-		blocks = append(blocks, candidateBlock{typ: m[1], content: m[2]})
-	}
-	return blocks
-}
-
-// parseCommands extracts <command> tags from a candidate block's inner content.
-// Cursor position is determined by the █ sentinel character in the command text.
-func parseCommands(content string) []commandTag {
-	matches := reCommand.FindAllStringSubmatch(content, -1)
-	cmds := make([]commandTag, 0, len(matches))
-	for _, m := range matches {
-		raw := m[1]
-		cursor := -1
-		if idx := strings.Index(raw, "█"); idx >= 0 {
-			cursor = idx
-			raw = raw[:idx] + raw[idx+len("█"):]
-		}
-		text := collapseSpaces(strings.TrimSpace(raw))
-		if text != "" {
-			cmds = append(cmds, commandTag{text: text, cursor: cursor})
-		}
+// withNeverSuggest appends the never-suggest list to a rendered system
+// prompt. It is added after rendering so custom templates carry it too.
+func (e *Engine) withNeverSuggest(systemPrompt string) string {
+	if guidance := core.NeverSuggestGuidance(e.neverSuggest()); guidance != "" {
+		return strings.TrimRight(systemPrompt, "\n") + "\n\n" + guidance
 	}
-	return cmds
+	return systemPrompt
 }
 
-// chainSeparator returns the string to insert between existing input and
-// appended commands. If the input already ends with a chain operator
-// (&&, ||, |, ;), only a space is added if needed. Otherwise " && ".
-func chainSeparator(input string) string {
-	trimmed := strings.TrimRight(input, " \t")
-	for _, op := range []string{"&&", "||", "|", ";"} {
-		if strings.HasSuffix(trimmed, op) {
-			if strings.HasSuffix(input, " ") {
-				return ""
-			}
-			return " "
-		}
+// chainSeparator returns the configured chain separator policy.
+func (e *Engine) chainSeparator() string {
+	if e.config == nil {
+		return ""
 	}
-	return " && "
+	return e.config.Generation.ChainSeparator
 }
 
-func parseCandidates(output string, input string, max int) []ashlet.Candidate {
-	blocks := parseCandidateBlocks(output)
-
-	if len(blocks) == 0 {
-		return parseCandidatesFallback(output, input, max)
+// infer generates and parses candidates within generation.timeout_ms. With
+// a latency budget (see latencyDeadline), the response is streamed and, if
+// the model has not finished by the deadline, the candidates parsed so far
+// are returned, or local when none have arrived yet. With
+// generation.temperatures set, one request per temperature is made in
+// parallel and the results are merged.
+func (e *Engine) infer(ctx context.Context, systemPrompt, userMessage, input string, max int, local []ashlet.Candidate) ([]ashlet.Candidate, error) {
+	if timeout := e.generationTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	var candidates []ashlet.Candidate
-	seen := make(map[string]bool)
-
-	for _, block := range blocks {
-		if len(candidates) >= max {
-			break
-		}
-
-		commands := parseCommands(block.content)
-		if len(commands) == 0 {
-			continue
-		}
-
-		// Join multiple commands with " && "
-		parts := make([]string, len(commands))
-		for i, cmd := range commands {
-			parts[i] = cmd.text
-		}
-		joined := strings.Join(parts, " && ")
-
-		var completion string
-		var cursorOffset int
-		switch block.typ {
-		case "append":
-			sep := chainSeparator(input)
-			completion = input + sep + joined
-			cursorOffset = len(input) + len(sep)
-		default: // "replace"
-			completion = joined
-		}
+	temps := e.fanOutTemperatures()
+	if len(temps) == 0 {
+		return e.inferOne(ctx, e.generator.GenerateStream, systemPrompt, userMessage, input, max, local)
+	}
 
-		completion = strings.TrimSpace(completion)
-		if completion == "" || seen[completion] {
-			continue
-		}
-		seen[completion] = true
-
-		// Use cursor from the first <command> that specifies one
-		var cursorPos *int
-		for _, cmd := range commands {
-			if cmd.cursor >= 0 {
-				pos := cmd.cursor + cursorOffset
-				cursorPos = &pos
-				break
+	type sample struct {
+		candidates []ashlet.Candidate
+		err        error
+	}
+	samples := make([]sample, len(temps))
+	var wg sync.WaitGroup
+	for i, temp := range temps {
+		wg.Go(func() {
+			generate := func(ctx context.Context, systemPrompt, userMessage string, onChunk func(string)) (string, error) {
+				return e.generator.GenerateStreamAt(ctx, temp, systemPrompt, userMessage, onChunk)
 			}
-		}
-
-		candidates = append(candidates, ashlet.Candidate{
-			Completion: completion,
-			Confidence: -1,
-			CursorPos:  cursorPos,
+			candidates, err := e.inferOne(ctx, generate, systemPrompt, userMessage, input, max, nil)
+			samples[i] = sample{candidates, err}
 		})
 	}
-
-	// Position-based confidence
-	for i := range candidates {
-		candidates[i].Confidence = 0.95 - float64(i)*0.15
-		if candidates[i].Confidence < 0.1 {
-			candidates[i].Confidence = 0.1
+	wg.Wait()
+
+	var lists [][]ashlet.Candidate
+	var firstErr error
+	for _, s := range samples {
+		if s.err != nil {
+			if firstErr == nil {
+				firstErr = s.err
+			}
+			continue
 		}
+		lists = append(lists, s.candidates)
 	}
-
-	return candidates
+	if len(lists) == 0 {
+		return nil, firstErr
+	}
+	if firstErr != nil {
+		slog.Debug("some fan-out samples failed", "failed", len(temps)-len(lists), "error", firstErr)
+	}
+	merged := core.MergeCandidates(lists, max)
+	if len(merged) == 0 {
+		return local, nil
+	}
+	return merged, nil
 }
 
-// parseCandidatesFallback handles model output without <autocomplete> tags.
-// Accepts unmarked lines that share the first word with the input.
-func parseCandidatesFallback(output string, input string, max int) []ashlet.Candidate {
-	lines := strings.Split(strings.TrimSpace(output), "\n")
-	trimmedInput := strings.TrimSpace(input)
-	var candidates []ashlet.Candidate
-	seen := make(map[string]bool)
-
-	for _, rawLine := range lines {
-		if len(candidates) >= max {
-			break
-		}
-		line := strings.TrimSpace(rawLine)
-		if line == "" || strings.HasPrefix(line, "$ ") || strings.HasPrefix(line, "<") {
-			continue
-		}
-
-		candidate := strings.Trim(line, "`")
-		candidate = strings.TrimSpace(candidate)
-
-		var command string
-		if trimmedInput == "" {
-			command = candidate
-		} else if firstWord(candidate) == firstWord(trimmedInput) {
-			command = candidate
-		} else {
-			continue
+// streamFunc is Generator.GenerateStream or a variant of it.
+type streamFunc func(ctx context.Context, systemPrompt, userMessage string, onChunk func(string)) (string, error)
+
+// inferOne makes a single generation request for infer.
+func (e *Engine) inferOne(ctx context.Context, generate streamFunc, systemPrompt, userMessage, input string, max int, local []ashlet.Candidate) ([]ashlet.Candidate, error) {
+	start := time.Now()
+	tokens := core.EstimateTokens(userMessage)
+	slo := e.latencyDeadline()
+	if slo <= 0 {
+		output, err := generate(ctx, systemPrompt, userMessage, nil)
+		if err != nil {
+			return nil, err
 		}
+		e.latency.Record(e.generator.provider(), tokens, time.Since(start))
+		return e.parseOutput(output, input, max), nil
+	}
 
-		command = collapseSpaces(strings.TrimSpace(command))
-
-		if command == "" || seen[command] {
-			continue
-		}
-		seen[command] = true
+	sloCtx, cancel := context.WithTimeout(ctx, slo)
+	defer cancel()
 
-		candidates = append(candidates, ashlet.Candidate{
-			Completion: command,
-			Confidence: -1,
-		})
+	// JSON output cannot be parsed until it is complete, so only XML
+	// candidates are available early.
+	parser := core.NewCandidateParser(input, max, e.chainSeparator())
+	onChunk := func(chunk string) { parser.Write(chunk) }
+	if ashlet.JSONOutputEnabled(e.config) {
+		onChunk = func(string) {}
 	}
 
-	// Position-based confidence
-	for i := range candidates {
-		candidates[i].Confidence = 0.95 - float64(i)*0.15
-		if candidates[i].Confidence < 0.1 {
-			candidates[i].Confidence = 0.1
-		}
+	output, err := generate(sloCtx, systemPrompt, userMessage, onChunk)
+	if err == nil {
+		e.latency.Record(e.generator.provider(), tokens, time.Since(start))
+		return e.parseOutput(output, input, max), nil
+	}
+	if ctx.Err() != nil || sloCtx.Err() == nil {
+		return nil, err
 	}
+	// The true latency is unknown but at least the SLO.
+	e.latency.Record(e.generator.provider(), tokens, slo)
 
-	return candidates
+	candidates := parser.Candidates()
+	slog.Debug("latency budget exceeded", "budget", slo, "streamed_candidates", len(candidates))
+	if ashlet.JSONOutputEnabled(e.config) || len(candidates) == 0 {
+		return local, nil
+	}
+	return candidates, nil
 }
 
-// collapseSpaces replaces runs of multiple spaces with a single space.
-func collapseSpaces(s string) string {
-	var buf strings.Builder
-	buf.Grow(len(s))
-	prevSpace := false
-	for _, r := range s {
-		if r == ' ' {
-			if !prevSpace {
-				buf.WriteByte(' ')
-			}
-			prevSpace = true
-		} else {
-			buf.WriteRune(r)
-			prevSpace = false
-		}
+// fanOutTemperatures returns the temperatures to sample in parallel, or nil
+// for a single request at the configured temperature.
+func (e *Engine) fanOutTemperatures() []float64 {
+	if e.config == nil || len(e.config.Generation.Temperatures) < 2 {
+		return nil
 	}
-	return buf.String()
+	return e.config.Generation.Temperatures
 }
 
-// firstWord returns the first whitespace-delimited word of s.
-func firstWord(s string) string {
-	s = strings.TrimSpace(s)
-	if i := strings.IndexByte(s, ' '); i > 0 {
-		return s[:i]
+// latencyDeadline returns how long a completion waits before returning the
+// candidates streamed so far: latency_slo_ms when set; otherwise, with
+// adaptive_latency, the provider's rolling p95 latency, so only the slowest
+// responses are cut short; otherwise 0 (wait for the full response).
+func (e *Engine) latencyDeadline() time.Duration {
+	if slo := e.latencySLO(); slo > 0 || e.config == nil || !e.config.Generation.AdaptiveLatency {
+		return slo
+	}
+	stats := e.LatencyStats()
+	if stats.Samples < minLatencySamples {
+		return 0
 	}
-	return s
+	return max(stats.P95, minAdaptiveDeadline)
 }
 
-// filterCandidateQuotes applies quote-content filtering to candidates based on input.
-// If the input has no quotes: strip quote content from each candidate, deduplicate,
-// and set CursorPos before the last closing quote (so cursor lands inside "").
-// If the input has quotes: keep content as-is, set CursorPos before last closing quote.
-func filterCandidateQuotes(candidates []ashlet.Candidate, input string) []ashlet.Candidate {
-	if len(candidates) == 0 {
-		return candidates
+// LatencyStats returns rolling generation latency percentiles for the
+// configured provider.
+func (e *Engine) LatencyStats() LatencyStats {
+	if e.generator == nil {
+		return LatencyStats{}
 	}
+	return e.latency.Stats(e.generator.provider())
+}
 
-	inputHasQuotes := strings.ContainsAny(input, "\"'")
-
-	seen := make(map[string]bool, len(candidates))
-	var out []ashlet.Candidate
-	for _, c := range candidates {
-		cmd := c.Completion
-		if !inputHasQuotes {
-			cmd = index.FilterQuoteContent(cmd)
-		}
-
-		if seen[cmd] {
-			continue
-		}
-		seen[cmd] = true
+// generationTimeout returns the configured limit on a whole generation
+// request, or 0 if unset.
+func (e *Engine) generationTimeout() time.Duration {
+	if e.config == nil {
+		return 0
+	}
+	return time.Duration(e.config.Generation.TimeoutMs) * time.Millisecond
+}
 
-		cursorPos := c.CursorPos
-		if cursorPos == nil {
-			if pos := findLastClosingQuotePos(cmd); pos >= 0 {
-				// Only position cursor inside quotes if nothing meaningful
-				// follows the closing quote (e.g. "&&", "||", "| grep").
-				// Otherwise leave cursor at end so user can edit the chain.
-				afterQuote := strings.TrimSpace(cmd[pos+1:])
-				if afterQuote == "" {
-					cursorPos = &pos
-				}
-			}
-		}
+// ProviderHealth reports the recent health of the configured generation
+// and embedding providers.
+func (e *Engine) ProviderHealth() []ashlet.ProviderHealth {
+	providers := []ashlet.ProviderHealth{}
+	if e.generator != nil {
+		h := e.health.Health(e.generator.provider())
+		h.Kind, h.Provider, h.Model = "generation", providerHost(e.generator.baseURL), e.generator.model
+		providers = append(providers, h)
+	}
+	if e.embedder != nil {
+		h := e.health.Health(e.embedder.Provider())
+		h.Kind, h.Provider, h.Model = "embedding", providerHost(e.embedder.BaseURL()), e.embedder.Model()
+		providers = append(providers, h)
+	}
+	return providers
+}
 
-		out = append(out, ashlet.Candidate{
-			Completion: cmd,
-			Confidence: c.Confidence,
-			CursorPos:  cursorPos,
-		})
+// UsageStats reports the API token usage per day and model.
+func (e *Engine) UsageStats() []ashlet.UsageStats {
+	stats := e.usage.Stats()
+	if stats == nil {
+		stats = []ashlet.UsageStats{}
 	}
-	return out
+	return stats
 }
 
-// findLastClosingQuotePos scans for matched quote pairs and returns the byte
-// index of the last closing quote, or -1 if none found.
-func findLastClosingQuotePos(s string) int {
-	lastClose := -1
-	i := 0
-	for i < len(s) {
-		ch := s[i]
-		if ch == '"' || ch == '\'' {
-			quote := ch
-			i++ // skip opening quote
-			// Scan for matching closing quote
-			for i < len(s) {
-				if s[i] == '\\' && i+1 < len(s) {
-					i += 2
-					continue
-				}
-				if s[i] == quote {
-					lastClose = i
-					break
-				}
-				i++
-			}
-		}
-		i++
+// AuditLog returns the last n entries of the audit log, oldest first;
+// none when it is off.
+func (e *Engine) AuditLog(n int) []ashlet.AuditEntry {
+	entries := e.audit.Last(n)
+	if entries == nil {
+		entries = []ashlet.AuditEntry{}
 	}
-	return lastClose
+	return entries
 }
 
-// commonPrefix returns the longest common prefix of two strings.
-func commonPrefix(a, b string) string {
-	n := len(a)
-	if len(b) < n {
-		n = len(b)
+// Metrics reports the size of the history index and how the engine's
+// caches are doing.
+func (e *Engine) Metrics() ashlet.EngineMetrics {
+	var m ashlet.EngineMetrics
+	if e.gatherer != nil {
+		m.IndexedCommands = e.gatherer.IndexedCommands()
+		m.CacheRebuilds = e.gatherer.CacheRebuilds()
 	}
-	for i := 0; i < n; i++ {
-		if a[i] != b[i] {
-			return a[:i]
-		}
+	if e.dirCache != nil {
+		m.DirCacheHits, m.DirCacheMisses = e.dirCache.Stats()
 	}
-	return a[:n]
+	return m
 }
 
-// quoteExtensionLength returns the number of characters before the first
-// closing quote (" or ') in suffix. Returns 0 if no quote found.
-func quoteExtensionLength(suffix string) int {
-	for i, ch := range suffix {
-		if ch == '"' || ch == '\'' {
-			return i
-		}
+// generationError converts a generation failure into a response error:
+// "timeout" when the model did not answer in time, so clients can tell a
+// slow model from a broken API, "rate_limited" when a configured budget is
+// spent, and "api_error" otherwise.
+func generationError(err error) *ashlet.Error {
+	code := "api_error"
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errRateLimited):
+		code = "rate_limited"
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		code = "timeout"
 	}
-	return 0
+	return &ashlet.Error{Code: code, Message: err.Error()}
 }
 
-// sortCandidates re-orders candidates using a weighted formula that favours
-// candidates extending quote content. Candidates are only re-sorted when they
-// share a sufficiently long common prefix; otherwise the original position-based
-// ordering is preserved.
-func sortCandidates(candidates []ashlet.Candidate, input string) {
-	if len(candidates) < 2 {
-		return
+// debounce waits generation.debounce_ms, reporting false if ctx is
+// cancelled first. The server cancels a session's request when the next one
+// arrives, so of a burst of keystrokes only the last is completed.
+func (e *Engine) debounce(ctx context.Context) bool {
+	if e.config == nil || e.config.Generation.DebounceMs <= 0 {
+		return true
 	}
+	t := time.NewTimer(time.Duration(e.config.Generation.DebounceMs) * time.Millisecond)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
 
-	// Compute LCP of all candidates
-	lcp := candidates[0].Completion
-	for _, c := range candidates[1:] {
-		lcp = commonPrefix(lcp, c.Completion)
-		if lcp == "" {
-			break
-		}
+// latencySLO returns the configured generation deadline, or 0 if unset.
+func (e *Engine) latencySLO() time.Duration {
+	if e.config == nil {
+		return 0
 	}
+	return time.Duration(e.config.Generation.LatencySLOMs) * time.Millisecond
+}
 
-	// Threshold: candidates must share a meaningful prefix
-	minLen := len(input) / 2
-	if minLen < 3 {
-		minLen = 3
+// promptBudget returns the token budget for the user message: the
+// configured max_prompt_tokens, shrunk while the provider is slower than
+// three quarters of the latency SLO (or defaultTargetLatency).
+func (e *Engine) promptBudget() int {
+	if e.config == nil {
+		return 0
 	}
-	if len(lcp) < minLen {
-		return
+	max := e.config.Generation.MaxPromptTokens
+	if e.generator == nil {
+		return max
 	}
-
-	// Compute raw scores
-	type scored struct {
-		idx int
-		raw float64
+	target := defaultTargetLatency
+	if slo := e.latencySLO(); slo > 0 {
+		target = slo * 3 / 4
 	}
-	scores := make([]scored, len(candidates))
-	for i, c := range candidates {
-		suffix := c.Completion[len(lcp):]
-		suffixLen := float64(len(suffix))
-		quoteExt := float64(quoteExtensionLength(suffix))
-		scores[i] = scored{idx: i, raw: suffixLen*0.2 + quoteExt*0.8}
+	budget := e.latency.Budget(e.generator.provider(), max, target)
+	if budget != max {
+		slog.Debug("adapted prompt budget", "budget", budget, "max", max)
 	}
+	return budget
+}
 
-	// Min-max normalization
-	minRaw, maxRaw := scores[0].raw, scores[0].raw
-	for _, s := range scores[1:] {
-		if s.raw < minRaw {
-			minRaw = s.raw
+// historyCandidates returns history commands extending input, most recent
+// first, as a stand-in when the model is too slow.
+func historyCandidates(input string, info *Info, max int) []ashlet.Candidate {
+	if info == nil || input == "" {
+		return nil
+	}
+	var candidates []ashlet.Candidate
+	seen := make(map[string]bool)
+	for _, cmd := range append(append([]string(nil), info.RecentCommands...), info.RelevantCommands...) {
+		if len(candidates) >= max {
+			break
 		}
-		if s.raw > maxRaw {
-			maxRaw = s.raw
+		if cmd == input || !strings.HasPrefix(cmd, input) || seen[cmd] {
+			continue
 		}
+		seen[cmd] = true
+		candidates = append(candidates, ashlet.Candidate{Completion: cmd, Confidence: positionConfidence(len(candidates))})
 	}
+	return candidates
+}
 
-	rangeRaw := maxRaw - minRaw
-	type ranked struct {
-		candidate ashlet.Candidate
-		weight    float64
-	}
-	items := make([]ranked, len(candidates))
-	for i, s := range scores {
-		var normalized float64
-		if rangeRaw > 0 {
-			normalized = (s.raw - minRaw) / rangeRaw
-		}
-		weight := candidates[s.idx].Confidence*0.2 + 0.8*normalized
-		items[i] = ranked{candidate: candidates[s.idx], weight: weight}
+// positionConfidence is the confidence given to the i-th candidate of a
+// list ranked without model scores.
+func positionConfidence(i int) float64 {
+	return max(0.95-float64(i)*0.15, 0.1)
+}
+
+// parseOutput parses model output in the configured output format.
+func (e *Engine) parseOutput(output, input string, max int) []ashlet.Candidate {
+	if ashlet.JSONOutputEnabled(e.config) {
+		return core.ParseCandidatesJSON(output, input, max, e.chainSeparator())
 	}
+	return core.ParseCandidates(output, input, max, e.chainSeparator())
+}
 
-	sort.SliceStable(items, func(i, j int) bool {
-		return items[i].weight > items[j].weight
-	})
+// buildUserMessage constructs the user message from context and input.
+// History is redacted and quote content stripped before it is shown.
+func (e *Engine) buildUserMessage(req *ashlet.Request, info *Info, dirCtx *DirContext) string {
+	return core.BuildUserMessage(e.userContext(req, info, dirCtx))
+}
 
-	// Write back and re-assign position-based confidence
-	for i, item := range items {
-		candidates[i] = item.candidate
-		candidates[i].Confidence = 0.95 - float64(i)*0.15
-		if candidates[i].Confidence < 0.1 {
-			candidates[i].Confidence = 0.1
+// redactAliases redacts alias expansions like history commands.
+func redactAliases(aliases map[string]string) map[string]string {
+	if len(aliases) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(aliases))
+	for name, exp := range aliases {
+		if exp != "" {
+			exp = core.FilterQuoteContent(core.RedactCommand(exp))
 		}
+		out[name] = exp
+	}
+	return out
+}
+
+// userContext gathers the context shown to the model for req.
+// With generation.anonymize, dirCtx is expected to be anonymized already.
+func (e *Engine) userContext(req *ashlet.Request, info *Info, dirCtx *DirContext) core.UserContext {
+	limit := min(len(info.RecentCommands), maxRecentShown)
+	flagsCommand, flags := e.inputFlags(req)
+	docsCommand, docs := e.inputDocs(req)
+	anon := e.anonymizer
+	return core.UserContext{
+		Cwd:            anon.Anonymize(req.Cwd),
+		NixShell:       req.NixShell,
+		Shell:          core.ShellName(req.Shell),
+		Dir:            dirCtx,
+		Recent:         anon.AnonymizeAll(core.FilterQuoteContentSlice(core.RedactCommands(info.RecentCommands[:limit]))),
+		Related:        anon.AnonymizeAll(core.FilterQuoteContentSlice(core.RedactCommands(info.RelevantCommands))),
+		LastFailure:    anon.Anonymize(info.LastFailure),
+		Session:        anon.Anonymize(e.sessions.Trail(req.SessionID, req.Input)),
+		AcceptedHere:   anon.AnonymizeAll(core.FilterQuoteContentSlice(e.feedback.AcceptedIn(req.Cwd, 5))),
+		RecentHere:     anon.AnonymizeAll(core.FilterQuoteContentSlice(core.RedactCommands(info.RecentHere))),
+		Date:           formatDate(time.Now()),
+		Aliases:        core.AliasContext(redactAliases(req.Aliases), req.Input, maxAliases),
+		FlagsCommand:   flagsCommand,
+		Flags:          flags,
+		DocsCommand:    docsCommand,
+		Docs:           docs,
+		ProjectSummary: e.projectSummary(req.Cwd, dirCtx),
+		Input:          req.Input,
+		CursorPos:      req.CursorPos,
+		TokenBudget:    e.promptBudget(),
+		Sections:       e.config.Generation.ContextSections,
 	}
 }
@@ -2,12 +2,19 @@ package generate
 
 import (
 	"context"
-	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
 	defaults "github.com/Paranoid-AF/ashlet/default"
+	"github.com/Paranoid-AF/ashlet/index"
 )
 
 // testEngine creates a minimal engine for testing
@@ -18,363 +25,11 @@ func testEngine() *Engine {
 	}
 }
 
-// --- XML candidate parsing tests ---
-
-func TestParseCandidatesXMLReplace(t *testing.T) {
-	output := `<candidate type="replace">
-<command>git checkout</command>
-</candidate>
-<candidate type="replace">
-<command>git cherry-pick</command>
-</candidate>`
-	candidates := parseCandidates(output, "git ch", 4)
-	if len(candidates) != 2 {
-		t.Fatalf("expected 2 candidates, got %d", len(candidates))
-	}
-	if candidates[0].Completion != "git checkout" {
-		t.Errorf("expected %q, got %q", "git checkout", candidates[0].Completion)
-	}
-	if candidates[1].Completion != "git cherry-pick" {
-		t.Errorf("expected %q, got %q", "git cherry-pick", candidates[1].Completion)
-	}
-}
-
-func TestParseCandidatesXMLReplaceWithCursor(t *testing.T) {
-	output := `<candidate type="replace">
-<command>git commit -m "█"</command>
-</candidate>`
-	candidates := parseCandidates(output, "git com", 4)
-	if len(candidates) != 1 {
-		t.Fatalf("expected 1 candidate, got %d", len(candidates))
-	}
-	c := candidates[0]
-	if c.Completion != `git commit -m ""` {
-		t.Errorf("expected %q, got %q", `git commit -m ""`, c.Completion)
-	}
-	if c.CursorPos == nil {
-		t.Fatal("expected CursorPos to be set")
-	}
-	if *c.CursorPos != 15 {
-		t.Errorf("expected CursorPos=15, got %d", *c.CursorPos)
-	}
-}
-
-func TestParseCandidatesXMLNoCursor(t *testing.T) {
-	output := `<candidate type="replace">
-<command>git status</command>
-</candidate>`
-	candidates := parseCandidates(output, "git s", 4)
-	if len(candidates) != 1 {
-		t.Fatalf("expected 1 candidate, got %d", len(candidates))
-	}
-	if candidates[0].CursorPos != nil {
-		t.Errorf("expected CursorPos=nil, got %d", *candidates[0].CursorPos)
-	}
-}
-
-func TestParseCandidatesXMLAppend(t *testing.T) {
-	output := `<candidate type="append">
-<command>git push</command>
-</candidate>
-<candidate type="append">
-<command>npm run build</command>
-</candidate>`
-	input := `git commit -m "initial" && `
-	candidates := parseCandidates(output, input, 4)
-	if len(candidates) != 2 {
-		t.Fatalf("expected 2 candidates, got %d", len(candidates))
-	}
-	if candidates[0].Completion != `git commit -m "initial" && git push` {
-		t.Errorf("expected %q, got %q", `git commit -m "initial" && git push`, candidates[0].Completion)
-	}
-	if candidates[1].Completion != `git commit -m "initial" && npm run build` {
-		t.Errorf("expected %q, got %q", `git commit -m "initial" && npm run build`, candidates[1].Completion)
-	}
-}
-
-func TestParseCandidatesXMLAppendAutoSeparator(t *testing.T) {
-	// Input doesn't end with && — separator is added automatically
-	output := `<candidate type="append">
-<command>git push</command>
-</candidate>`
-	input := `git commit -m "done"`
-	candidates := parseCandidates(output, input, 4)
-	if len(candidates) != 1 {
-		t.Fatalf("expected 1 candidate, got %d", len(candidates))
-	}
-	if candidates[0].Completion != `git commit -m "done" && git push` {
-		t.Errorf("expected %q, got %q", `git commit -m "done" && git push`, candidates[0].Completion)
-	}
-}
-
-func TestParseCandidatesXMLAppendCursorOffset(t *testing.T) {
-	// cursor in append mode is relative to appended part start
-	output := `<candidate type="append">
-<command>git commit -m "█"</command>
-</candidate>`
-	input := "make build && "
-	candidates := parseCandidates(output, input, 4)
-	if len(candidates) != 1 {
-		t.Fatalf("expected 1 candidate, got %d", len(candidates))
-	}
-	c := candidates[0]
-	if c.Completion != `make build && git commit -m ""` {
-		t.Errorf("expected %q, got %q", `make build && git commit -m ""`, c.Completion)
-	}
-	if c.CursorPos == nil {
-		t.Fatal("expected CursorPos to be set")
-	}
-	// "make build && " is 14 chars, separator is "" (input ends with space after &&)
-	// cursor 15 + offset 14 = 29
-	if *c.CursorPos != 29 {
-		t.Errorf("expected CursorPos=29, got %d", *c.CursorPos)
-	}
-}
-
-func TestParseCandidatesXMLMultiCommand(t *testing.T) {
-	// Multiple commands in one candidate are joined with " && "
-	output := `<candidate type="replace">
-<command>git commit -m "█"</command>
-<command>git push</command>
-</candidate>`
-	candidates := parseCandidates(output, "git com", 4)
-	if len(candidates) != 1 {
-		t.Fatalf("expected 1 candidate, got %d", len(candidates))
-	}
-	c := candidates[0]
-	if c.Completion != `git commit -m "" && git push` {
-		t.Errorf("expected %q, got %q", `git commit -m "" && git push`, c.Completion)
-	}
-	if c.CursorPos == nil {
-		t.Fatal("expected CursorPos to be set")
-	}
-	if *c.CursorPos != 15 {
-		t.Errorf("expected CursorPos=15, got %d", *c.CursorPos)
-	}
-}
-
-func TestParseCandidatesXMLDeduplicates(t *testing.T) {
-	output := `<candidate type="replace">
-<command>git status</command>
-</candidate>
-<candidate type="replace">
-<command>git status</command>
-</candidate>
-<candidate type="replace">
-<command>git stash</command>
-</candidate>`
-	candidates := parseCandidates(output, "git s", 4)
-	if len(candidates) != 2 {
-		t.Errorf("expected 2 unique candidates, got %d", len(candidates))
-	}
-}
-
-func TestParseCandidatesXMLRespectsMax(t *testing.T) {
-	output := `<candidate type="replace"><command>one</command></candidate>
-<candidate type="replace"><command>two</command></candidate>
-<candidate type="replace"><command>three</command></candidate>`
-	candidates := parseCandidates(output, "", 2)
-	if len(candidates) != 2 {
-		t.Errorf("expected 2 candidates with max=2, got %d", len(candidates))
-	}
-}
-
-func TestParseCandidatesXMLEmptyCommand(t *testing.T) {
-	// Empty command tag should be skipped
-	output := `<candidate type="replace">
-<command></command>
-</candidate>`
-	candidates := parseCandidates(output, "", 4)
-	if len(candidates) != 0 {
-		t.Errorf("expected 0 candidates for empty command, got %d", len(candidates))
-	}
-}
-
-func TestParseCandidatesConfidence(t *testing.T) {
-	output := `<candidate type="replace"><command>one</command></candidate>
-<candidate type="replace"><command>two</command></candidate>
-<candidate type="replace"><command>three</command></candidate>
-<candidate type="replace"><command>four</command></candidate>`
-	candidates := parseCandidates(output, "", 4)
-	if len(candidates) != 4 {
-		t.Fatalf("expected 4 candidates, got %d", len(candidates))
-	}
-	expectedConf := []float64{0.95, 0.80, 0.65, 0.50}
-	for i, exp := range expectedConf {
-		if math.Abs(candidates[i].Confidence-exp) > 1e-9 {
-			t.Errorf("candidate[%d] confidence: expected %.2f, got %.2f", i, exp, candidates[i].Confidence)
-		}
-	}
-}
-
-func TestParseCandidatesEmptyOutput(t *testing.T) {
-	candidates := parseCandidates("", "", 4)
-	if candidates != nil {
-		t.Errorf("expected nil for empty output, got %v", candidates)
-	}
-}
-
-func TestParseCandidatesXMLPipeReplace(t *testing.T) {
-	output := `<candidate type="replace">
-<command>cat foo.log | grep -i error</command>
-</candidate>
-<candidate type="replace">
-<command>cat foo.log | grep warning</command>
-</candidate>`
-	candidates := parseCandidates(output, "cat foo.log | grep", 4)
-	if len(candidates) != 2 {
-		t.Fatalf("expected 2 candidates, got %d", len(candidates))
-	}
-	if candidates[0].Completion != "cat foo.log | grep -i error" {
-		t.Errorf("expected %q, got %q", "cat foo.log | grep -i error", candidates[0].Completion)
-	}
-	if candidates[1].Completion != "cat foo.log | grep warning" {
-		t.Errorf("expected %q, got %q", "cat foo.log | grep warning", candidates[1].Completion)
-	}
-}
-
-// --- chainSeparator tests ---
-
-func TestChainSeparator(t *testing.T) {
-	tests := []struct {
-		input string
-		want  string
-	}{
-		{`git commit -m "done" && `, ""}, // already has && with trailing space
-		{`git commit -m "done" &&`, " "}, // has && but no space
-		{`echo hello |`, " "},            // pipe, no space
-		{`echo hello | `, ""},            // pipe with space
-		{`echo hello ;`, " "},            // semicolon, no space
-		{`git commit -m "done"`, " && "}, // no operator
-		{`git status`, " && "},           // plain command
-	}
-	for _, tt := range tests {
-		got := chainSeparator(tt.input)
-		if got != tt.want {
-			t.Errorf("chainSeparator(%q) = %q, want %q", tt.input, got, tt.want)
-		}
-	}
-}
-
-// --- Fallback parsing tests (no XML) ---
-
-func TestParseCandidatesFallbackFirstWordMatch(t *testing.T) {
-	output := "git checkout\ngit cherry-pick"
-	candidates := parseCandidates(output, "git ch", 4)
-	if len(candidates) != 2 {
-		t.Fatalf("expected 2 candidates, got %d", len(candidates))
-	}
-	if candidates[0].Completion != "git checkout" {
-		t.Errorf("expected %q, got %q", "git checkout", candidates[0].Completion)
-	}
-	if candidates[1].Completion != "git cherry-pick" {
-		t.Errorf("expected %q, got %q", "git cherry-pick", candidates[1].Completion)
-	}
-}
-
-func TestParseCandidatesFallbackRejectsUnrelatedLine(t *testing.T) {
-	output := "brew install"
-	candidates := parseCandidates(output, "git co", 4)
-	if len(candidates) != 0 {
-		t.Errorf("expected 0 candidates (different first word), got %d: %v", len(candidates), candidates)
-	}
-}
-
-func TestParseCandidatesFallbackRejectsSuffixOnly(t *testing.T) {
-	output := "--amend"
-	candidates := parseCandidates(output, "git c", 4)
-	if len(candidates) != 0 {
-		t.Errorf("expected 0 candidates (suffix without XML), got %d: %v", len(candidates), candidates)
-	}
-}
-
-func TestParseCandidatesFallbackStripsBackticks(t *testing.T) {
-	output := "`git status`\n`git stash`"
-	candidates := parseCandidates(output, "git ", 4)
-	if len(candidates) != 2 {
-		t.Fatalf("expected 2 candidates, got %d", len(candidates))
-	}
-	if candidates[0].Completion != "git status" {
-		t.Errorf("expected 'git status', got %q", candidates[0].Completion)
-	}
-}
-
-func TestParseCandidatesFallbackSkipsXMLLines(t *testing.T) {
-	// Partial/broken XML should be skipped in fallback
-	output := "<autocomplete\ngit checkout"
-	candidates := parseCandidates(output, "git ch", 4)
-	if len(candidates) != 1 {
-		t.Fatalf("expected 1 candidate, got %d", len(candidates))
-	}
-	if candidates[0].Completion != "git checkout" {
-		t.Errorf("expected %q, got %q", "git checkout", candidates[0].Completion)
-	}
-}
-
-func TestParseCandidatesFallbackSkipsPromptDelimiter(t *testing.T) {
-	output := "$ brew install\nbrew install vim"
-	candidates := parseCandidates(output, "brew ", 4)
-	if len(candidates) != 1 {
-		t.Fatalf("expected 1 candidate (skipping $ line), got %d", len(candidates))
-	}
-	if candidates[0].Completion != "brew install vim" {
-		t.Errorf("expected %q, got %q", "brew install vim", candidates[0].Completion)
-	}
-}
-
-// --- parseCandidateBlocks / parseCommands unit tests ---
-
-func TestParseCandidateBlocks(t *testing.T) {
-	output := `<candidate type="replace">
-<command>git checkout</command>
-</candidate>
-<candidate type="append">
-<command>git push</command>
-</candidate>`
-	blocks := parseCandidateBlocks(output)
-	if len(blocks) != 2 {
-		t.Fatalf("expected 2 blocks, got %d", len(blocks))
-	}
-	if blocks[0].typ != "replace" {
-		t.Errorf("block[0] type: expected %q, got %q", "replace", blocks[0].typ)
-	}
-	if blocks[1].typ != "append" {
-		t.Errorf("block[1] type: expected %q, got %q", "append", blocks[1].typ)
-	}
-}
-
-func TestParseCommands(t *testing.T) {
-	content := `<command>git commit -m "█"</command>
-<command>git push</command>`
-	cmds := parseCommands(content)
-	if len(cmds) != 2 {
-		t.Fatalf("expected 2 commands, got %d", len(cmds))
-	}
-	if cmds[0].text != `git commit -m ""` || cmds[0].cursor != 15 {
-		t.Errorf("cmd[0]: expected text=%q cursor=15, got text=%q cursor=%d", `git commit -m ""`, cmds[0].text, cmds[0].cursor)
-	}
-	if cmds[1].text != "git push" || cmds[1].cursor != -1 {
-		t.Errorf("cmd[1]: expected text=%q cursor=-1, got text=%q cursor=%d", "git push", cmds[1].text, cmds[1].cursor)
-	}
-}
-
-func TestParseCommandsNoCursor(t *testing.T) {
-	content := `<command>git commit -m ""</command>`
-	cmds := parseCommands(content)
-	if len(cmds) != 1 {
-		t.Fatalf("expected 1 command, got %d", len(cmds))
-	}
-	// No █ sentinel = no cursor
-	if cmds[0].cursor != -1 {
-		t.Errorf("expected cursor=-1 for no sentinel, got %d", cmds[0].cursor)
-	}
-}
-
 // --- buildSystemPrompt tests ---
 
 func TestBuildSystemPromptContent(t *testing.T) {
 	e := testEngine()
-	prompt := e.buildSystemPrompt(4)
+	prompt := e.buildSystemPrompt(4, "")
 
 	if !strings.Contains(prompt, "auto-completion engine") {
 		t.Error("system prompt should contain 'auto-completion engine'")
@@ -506,6 +161,28 @@ func TestBuildUserMessageHistoryAlwaysFiltered(t *testing.T) {
 	}
 }
 
+func TestBuildUserMessageAnonymized(t *testing.T) {
+	e := &Engine{config: ashlet.DefaultConfig(), anonymizer: core.NewAnonymizer("/home/user", nil)}
+	req := &ashlet.Request{
+		Input:     "ssh ",
+		CursorPos: 4,
+		Cwd:       "/home/user/project",
+	}
+	info := &Info{RecentCommands: []string{"ssh admin@10.1.2.3", "scp build.internal:/home/ops/out.tgz ."}}
+	msg := e.buildUserMessage(req, info, nil)
+
+	for _, leak := range []string{"/home/user", "10.1.2.3", "build.internal", "ops"} {
+		if strings.Contains(msg, leak) {
+			t.Errorf("user message contains %q:\n%s", leak, msg)
+		}
+	}
+	for _, want := range []string{"cwd: ~/project", "ssh admin@<ip>", "scp <host>:/home/<user>/out.tgz ."} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("user message lacks %q:\n%s", want, msg)
+		}
+	}
+}
+
 func TestDefaultPromptEmbedNonEmpty(t *testing.T) {
 	if defaults.DefaultPrompt == "" {
 		t.Fatal("embedded DefaultPrompt should not be empty")
@@ -537,6 +214,99 @@ func TestBuildUserMessageWithDirContext(t *testing.T) {
 	}
 }
 
+func TestBuildUserMessageNixContext(t *testing.T) {
+	e := testEngine()
+	req := &ashlet.Request{
+		Input:     "cargo b",
+		CursorPos: 7,
+		Cwd:       "/home/user/project",
+		NixShell:  "impure",
+	}
+	dirCtx := &DirContext{
+		Nix:          "flake",
+		CwdManifests: map[string]string{"flake outputs": "apps: serve"},
+	}
+	msg := e.buildUserMessage(req, &Info{}, dirCtx)
+
+	if !strings.Contains(msg, "nix shell: impure") {
+		t.Error("user message should contain nix shell state")
+	}
+	if !strings.Contains(msg, "nix: flake") {
+		t.Error("user message should contain nix project type")
+	}
+	if !strings.Contains(msg, "flake outputs: apps: serve") {
+		t.Error("user message should contain flake outputs")
+	}
+}
+
+func TestBuildUserMessageAcceptedHere(t *testing.T) {
+	e := testEngine()
+	e.feedback = NewFeedbackStore("")
+	e.feedback.Record(&ashlet.FeedbackRequest{Event: "accepted", Candidate: "just test", Cwd: "/proj"})
+
+	req := &ashlet.Request{Input: "ju", CursorPos: 2, Cwd: "/proj"}
+	msg := e.buildUserMessage(req, &Info{}, nil)
+	if !strings.Contains(msg, "accepted here: just test") {
+		t.Errorf("user message should contain accepted commands, got:\n%s", msg)
+	}
+
+	req = &ashlet.Request{Input: "ju", CursorPos: 2, Cwd: "/other"}
+	msg = e.buildUserMessage(req, &Info{}, nil)
+	if strings.Contains(msg, "accepted here:") {
+		t.Error("user message should not contain accepted commands from another directory")
+	}
+}
+
+func TestBuildUserMessageSessionTrail(t *testing.T) {
+	e := testEngine()
+	e.sessions = NewSessionTracker()
+	defer e.sessions.Close()
+	e.sessions.RecordRan("42", "cd build")
+
+	req := &ashlet.Request{Input: "ma", CursorPos: 2, Cwd: "/proj/build", SessionID: "42"}
+	msg := e.buildUserMessage(req, &Info{}, nil)
+	if !strings.Contains(msg, "session: ran `cd build`") {
+		t.Errorf("user message should contain session trail, got:\n%s", msg)
+	}
+}
+
+func TestBuildUserMessageDatabaseContext(t *testing.T) {
+	e := testEngine()
+	req := &ashlet.Request{Input: "PGHOST=db psql -c ", CursorPos: 18, Cwd: "/tmp"}
+	msg := e.buildUserMessage(req, &Info{}, nil)
+	if !strings.Contains(msg, "database: psql") {
+		t.Errorf("user message should name the database client, got:\n%s", msg)
+	}
+
+	req = &ashlet.Request{Input: "git st", CursorPos: 6, Cwd: "/tmp"}
+	msg = e.buildUserMessage(req, &Info{}, nil)
+	if strings.Contains(msg, "database:") {
+		t.Error("user message should not contain database line for non-database input")
+	}
+}
+
+func TestBuildUserMessageTerraformContext(t *testing.T) {
+	e := testEngine()
+	req := &ashlet.Request{Input: "terraform plan", CursorPos: 14}
+	dirCtx := &DirContext{Terraform: "workspace: staging, backend: s3"}
+	msg := e.buildUserMessage(req, &Info{}, dirCtx)
+
+	if !strings.Contains(msg, "terraform: workspace: staging, backend: s3") {
+		t.Error("user message should contain terraform context")
+	}
+}
+
+func TestBuildUserMessageLanguages(t *testing.T) {
+	e := testEngine()
+	req := &ashlet.Request{Input: "car", CursorPos: 3}
+	dirCtx := &DirContext{Languages: "Rust 60%, TypeScript 40%"}
+	msg := e.buildUserMessage(req, &Info{}, dirCtx)
+
+	if !strings.Contains(msg, "languages: Rust 60%, TypeScript 40%") {
+		t.Errorf("user message should contain the language summary, got:\n%s", msg)
+	}
+}
+
 func TestBuildUserMessageNilDirContext(t *testing.T) {
 	e := testEngine()
 	req := &ashlet.Request{
@@ -559,7 +329,7 @@ func TestBuildSystemPromptInvalidCustomPromptFallback(t *testing.T) {
 		config:       ashlet.DefaultConfig(),
 		customPrompt: "{{.Invalid | nonexistentFunc}}",
 	}
-	prompt := e.buildSystemPrompt(4)
+	prompt := e.buildSystemPrompt(4, "")
 
 	if !strings.Contains(prompt, "auto-completion engine") {
 		t.Error("expected fallback to default prompt on invalid custom template")
@@ -569,7 +339,7 @@ func TestBuildSystemPromptInvalidCustomPromptFallback(t *testing.T) {
 // --- Complete() tests ---
 
 func TestCompleteReturnsEmptySlice(t *testing.T) {
-	e := &Engine{gatherer: NewGatherer(nil, nil), generator: nil, config: ashlet.DefaultConfig()}
+	e := &Engine{gatherer: NewGatherer(nil, nil), generator: nil, dirCache: NewDirCache(), config: ashlet.DefaultConfig()}
 	req := &ashlet.Request{Input: ""}
 	resp := e.Complete(context.Background(), req)
 	if resp.Error == nil || resp.Error.Code != "not_configured" {
@@ -579,7 +349,7 @@ func TestCompleteReturnsEmptySlice(t *testing.T) {
 }
 
 func TestCompleteNotConfigured(t *testing.T) {
-	e := &Engine{gatherer: NewGatherer(nil, nil), generator: nil, config: ashlet.DefaultConfig()}
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), generator: nil, dirCache: NewDirCache(), config: ashlet.DefaultConfig()}
 	req := &ashlet.Request{Input: "git st", CursorPos: 6}
 	resp := e.Complete(context.Background(), req)
 
@@ -594,235 +364,99 @@ func TestCompleteNotConfigured(t *testing.T) {
 	}
 }
 
-// --- filterCandidateQuotes tests ---
-
-func TestFilterCandidateQuotesNoQuotesInInput(t *testing.T) {
-	candidates := []ashlet.Candidate{
-		{Completion: `git commit -m "initial"`, Confidence: 0.95},
-		{Completion: `git commit -m "fix bug"`, Confidence: 0.80},
-		{Completion: `git status`, Confidence: 0.65},
-	}
-	result := filterCandidateQuotes(candidates, "git commi")
-
-	if len(result) != 2 {
-		t.Fatalf("expected 2 candidates after dedup, got %d", len(result))
-	}
-	if result[0].Completion != `git commit -m ""` {
-		t.Errorf("expected %q, got %q", `git commit -m ""`, result[0].Completion)
-	}
-	if result[0].CursorPos == nil || *result[0].CursorPos != 15 {
-		t.Errorf("expected CursorPos=15 inside quotes, got %v", result[0].CursorPos)
-	}
-}
-
-func TestFilterCandidateQuotesWithQuotesInInput(t *testing.T) {
-	candidates := []ashlet.Candidate{
-		{Completion: `git commit -m "feat: sign-in page"`, Confidence: 0.95},
-	}
-	result := filterCandidateQuotes(candidates, `git commit -m "feat:`)
-
-	if len(result) != 1 {
-		t.Fatalf("expected 1 candidate, got %d", len(result))
-	}
-	if result[0].Completion != `git commit -m "feat: sign-in page"` {
-		t.Errorf("expected content preserved, got %q", result[0].Completion)
-	}
-	if result[0].CursorPos == nil || *result[0].CursorPos != 33 {
-		t.Errorf("expected CursorPos=33, got %v", result[0].CursorPos)
-	}
-}
-
-func TestFilterCandidateQuotesCursorAfterChain(t *testing.T) {
-	candidates := []ashlet.Candidate{
-		{Completion: `git commit -m "a" && git push`, Confidence: 0.95},
-	}
-	result := filterCandidateQuotes(candidates, `git commit -m "a`)
-
-	if len(result) != 1 {
-		t.Fatalf("expected 1 candidate, got %d", len(result))
-	}
-	if result[0].CursorPos != nil {
-		t.Errorf("expected CursorPos=nil when chain follows quote, got %d", *result[0].CursorPos)
-	}
-}
-
-func TestFilterCandidateQuotesNoClobberExistingCursor(t *testing.T) {
-	pos := 5
-	candidates := []ashlet.Candidate{
-		{Completion: `echo "hello"`, Confidence: 0.95, CursorPos: &pos},
-	}
-	result := filterCandidateQuotes(candidates, `echo "he`)
+func TestCompleteDebounceSuperseded(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<candidate>ls -la</candidate>"}}]}`))
+	}))
+	defer srv.Close()
 
-	if result[0].CursorPos == nil || *result[0].CursorPos != 5 {
-		t.Errorf("expected existing CursorPos=5 preserved, got %v", result[0].CursorPos)
-	}
-}
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.DebounceMs = 200
+	gen := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), generator: gen, dirCache: NewDirCache(), config: cfg}
+	defer e.gatherer.Close()
 
-func TestFilterCandidateQuotesNoQuotesInCandidate(t *testing.T) {
-	candidates := []ashlet.Candidate{
-		{Completion: "git status", Confidence: 0.95},
+	// Cancelled within the window, as when the next keystroke arrives.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	resp := e.Complete(ctx, &ashlet.Request{Input: "ls", CursorPos: 2})
+	if resp.Error != nil || len(resp.Candidates) != 0 {
+		t.Errorf("superseded request = %+v, want no candidates and no error", resp)
 	}
-	result := filterCandidateQuotes(candidates, "git s")
-	if result[0].CursorPos != nil {
-		t.Errorf("expected no CursorPos for command without quotes, got %d", *result[0].CursorPos)
+	if got := calls.Load(); got != 0 {
+		t.Errorf("API called %d times for a superseded request, want 0", got)
 	}
-}
 
-func TestFilterCandidateQuotesEmpty(t *testing.T) {
-	result := filterCandidateQuotes(nil, "git s")
-	if result != nil {
-		t.Errorf("expected nil for empty input, got %v", result)
+	if resp := e.Complete(context.Background(), &ashlet.Request{Input: "ls", CursorPos: 2}); resp.Error != nil {
+		t.Errorf("request after the window: %+v", resp.Error)
 	}
-}
-
-func TestFindLastClosingQuotePos(t *testing.T) {
-	tests := []struct {
-		input string
-		want  int
-	}{
-		{`git commit -m ""`, 15},
-		{`echo "hello"`, 11},
-		{`echo ''`, 6},
-		{`git status`, -1},
-		{`echo "a" && echo "b"`, 19},
-		{`echo "escaped \" quote"`, 22},
-		{`echo "`, -1},
-		{`echo 'a' "b"`, 11},
-	}
-	for _, tt := range tests {
-		got := findLastClosingQuotePos(tt.input)
-		if got != tt.want {
-			t.Errorf("findLastClosingQuotePos(%q) = %d, want %d", tt.input, got, tt.want)
-		}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("API called %d times, want 1", got)
 	}
 }
 
-// --- sortCandidates tests ---
+func TestCompleteDryRun(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<candidate>ls -la</candidate>"}}]}`))
+	}))
+	defer srv.Close()
 
-func TestSortCandidatesQuoteExtensionFirst(t *testing.T) {
-	// Scenario: shared prefix = `git commit -m "feat: implement new funct`
-	// The candidate extending the quote content should rank first.
-	prefix := `git commit -m "feat: implement new funct`
-	candidates := []ashlet.Candidate{
-		{Completion: prefix + `" && git push`, Confidence: 0.95},
-		{Completion: prefix + `ion"`, Confidence: 0.80},
-		{Completion: prefix + `"`, Confidence: 0.65},
-	}
-	input := `git commit -m "feat: implement new funct`
+	gen := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), generator: gen, dirCache: NewDirCache(), config: ashlet.DefaultConfig()}
+	defer e.gatherer.Close()
 
-	sortCandidates(candidates, input)
-
-	// Quote-extending candidate should be first
-	if candidates[0].Completion != prefix+`ion"` {
-		t.Errorf("expected quote-extending candidate first, got %q", candidates[0].Completion)
-	}
-	// Chain command second
-	if candidates[1].Completion != prefix+`" && git push` {
-		t.Errorf("expected chain command second, got %q", candidates[1].Completion)
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: "ls -", CursorPos: 4, DryRun: true})
+	if resp.Error != nil || len(resp.Candidates) != 0 {
+		t.Errorf("dry run = %+v, want no candidates and no error", resp)
 	}
-	// Trivial completion last
-	if candidates[2].Completion != prefix+`"` {
-		t.Errorf("expected trivial completion last, got %q", candidates[2].Completion)
+	if resp.Prompt == nil || !strings.Contains(resp.Prompt.System, "auto-completion engine") || !strings.Contains(resp.Prompt.User, "ls -") {
+		t.Errorf("dry run prompt = %+v, want the rendered system prompt and user message", resp.Prompt)
 	}
 
-	// Confidence should be re-assigned position-based
-	if math.Abs(candidates[0].Confidence-0.95) > 1e-9 {
-		t.Errorf("expected first candidate confidence 0.95, got %.2f", candidates[0].Confidence)
+	resp = e.Complete(context.Background(), &ashlet.Request{Mode: "fix", LastCommand: "gti status", ExitCode: 127, DryRun: true})
+	if resp.Prompt == nil || !strings.Contains(resp.Prompt.User, "Failed: `gti status`") {
+		t.Errorf("fix dry run prompt = %+v, want the fix user message", resp.Prompt)
 	}
-	if math.Abs(candidates[1].Confidence-0.80) > 1e-9 {
-		t.Errorf("expected second candidate confidence 0.80, got %.2f", candidates[1].Confidence)
-	}
-	if math.Abs(candidates[2].Confidence-0.65) > 1e-9 {
-		t.Errorf("expected third candidate confidence 0.65, got %.2f", candidates[2].Confidence)
+	if got := calls.Load(); got != 0 {
+		t.Errorf("API called %d times for dry runs, want 0", got)
 	}
 }
 
-func TestSortCandidatesNoResortShortPrefix(t *testing.T) {
-	// Candidates with diverse prefixes (short LCP) should keep original order
-	candidates := []ashlet.Candidate{
-		{Completion: "git status", Confidence: 0.95},
-		{Completion: "git commit", Confidence: 0.80},
-		{Completion: "grep -r foo", Confidence: 0.65},
-	}
+func TestCompleteVerbose(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<candidate type=\"replace\"><command>ls -la</command></candidate>"}}]}`))
+	}))
+	defer srv.Close()
 
-	sortCandidates(candidates, "g")
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module x\n"), 0644)
+	gen := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), generator: gen, dirCache: NewDirCache(), config: ashlet.DefaultConfig()}
+	defer e.gatherer.Close()
+	defer e.dirCache.Close()
+	e.dirCache.Gather(context.Background(), dir)
 
-	// Order should be preserved
-	if candidates[0].Completion != "git status" {
-		t.Errorf("expected order preserved, got %q first", candidates[0].Completion)
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: "ls -", CursorPos: 4, Cwd: dir, LastCommand: "make", ExitCode: 2, Verbose: true})
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Score == nil {
+		t.Fatalf("verbose candidates = %+v, want them with scores", resp.Candidates)
 	}
-	if candidates[1].Completion != "git commit" {
-		t.Errorf("expected order preserved, got %q second", candidates[1].Completion)
+	d := resp.Debug
+	if d == nil {
+		t.Fatal("verbose response has no debug info")
 	}
-	// Confidence should remain unchanged (no re-sort happened)
-	if math.Abs(candidates[0].Confidence-0.95) > 1e-9 {
-		t.Errorf("expected confidence unchanged, got %.2f", candidates[0].Confidence)
+	if d.LastFailure == "" || d.PromptTokens == 0 || d.SystemPromptBytes == 0 || d.UserMessageBytes == 0 {
+		t.Errorf("debug = %+v, want the last failure and prompt sizes", d)
 	}
-}
-
-func TestSortCandidatesSingleCandidate(t *testing.T) {
-	candidates := []ashlet.Candidate{
-		{Completion: "git status", Confidence: 0.95},
-	}
-	sortCandidates(candidates, "git s")
-
-	if candidates[0].Completion != "git status" {
-		t.Errorf("single candidate should be unchanged")
-	}
-	if math.Abs(candidates[0].Confidence-0.95) > 1e-9 {
-		t.Errorf("confidence should be unchanged, got %.2f", candidates[0].Confidence)
-	}
-}
-
-func TestSortCandidatesAllSame(t *testing.T) {
-	candidates := []ashlet.Candidate{
-		{Completion: "git status", Confidence: 0.95},
-		{Completion: "git status", Confidence: 0.80},
-	}
-	sortCandidates(candidates, "git s")
-
-	// Both are identical — should remain stable
-	if candidates[0].Completion != "git status" || candidates[1].Completion != "git status" {
-		t.Error("equal candidates should stay stable")
-	}
-}
-
-// --- commonPrefix / quoteExtensionLength unit tests ---
-
-func TestCommonPrefix(t *testing.T) {
-	tests := []struct {
-		a, b, want string
-	}{
-		{"abc", "abd", "ab"},
-		{"abc", "abc", "abc"},
-		{"abc", "xyz", ""},
-		{"abc", "ab", "ab"},
-		{"", "abc", ""},
-	}
-	for _, tt := range tests {
-		got := commonPrefix(tt.a, tt.b)
-		if got != tt.want {
-			t.Errorf("commonPrefix(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
-		}
+	if d.Dir == nil || d.Dir.Files != 1 {
+		t.Errorf("debug dir = %+v, want the cwd's one file", d.Dir)
 	}
-}
 
-func TestQuoteExtensionLength(t *testing.T) {
-	tests := []struct {
-		suffix string
-		want   int
-	}{
-		{`ion"`, 3},
-		{`" && git push`, 0},
-		{`"`, 0},
-		{`hello world`, 0},
-		{`some text' more`, 9},
-	}
-	for _, tt := range tests {
-		got := quoteExtensionLength(tt.suffix)
-		if got != tt.want {
-			t.Errorf("quoteExtensionLength(%q) = %d, want %d", tt.suffix, got, tt.want)
-		}
+	if resp := e.Complete(context.Background(), &ashlet.Request{Input: "ls -", CursorPos: 4}); resp.Debug != nil || resp.Candidates[0].Score != nil {
+		t.Error("a regular response should carry no debug info or scores")
 	}
 }
 
@@ -959,3 +593,165 @@ func TestGathererWithRawHistory(t *testing.T) {
 	// to nil and only populates RelevantCommands).
 	_ = info.RecentCommands
 }
+
+func TestGathererLastFailure(t *testing.T) {
+	g := NewGatherer(nil, ashlet.DefaultConfig())
+	defer g.Close()
+
+	req := &ashlet.Request{Input: "make", CursorPos: 4, LastCommand: "make test", ExitCode: 2}
+	info := g.Gather(context.Background(), req)
+	if info.LastFailure != "`make test` failed with exit 2" {
+		t.Errorf("LastFailure = %q", info.LastFailure)
+	}
+
+	req = &ashlet.Request{Input: "make", CursorPos: 4, LastCommand: "make test"}
+	if info := g.Gather(context.Background(), req); info.LastFailure != "" {
+		t.Errorf("LastFailure should be empty for exit 0, got %q", info.LastFailure)
+	}
+}
+
+func TestDescribeLastFailure(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		code int
+		want string
+	}{
+		{"", 1, ""},
+		{"ls", 0, ""},
+		{"gti status", 127, "`gti status` failed with exit 127 (command not found)"},
+		{"sleep 100", 130, "`sleep 100` failed with exit 130 (interrupted)"},
+		{"./server", 137, "`./server` failed with exit 137 (killed by signal 9)"},
+		{"TOKEN=abc deploy", 1, "`TOKEN=*** deploy` failed with exit 1"},
+	}
+	for _, tt := range tests {
+		if got := describeLastFailure(tt.cmd, tt.code); got != tt.want {
+			t.Errorf("describeLastFailure(%q, %d) = %q, want %q", tt.cmd, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	cest := time.FixedZone("CEST", 2*60*60)
+	if got := formatDate(time.Date(2026, 5, 1, 14, 3, 59, 0, cest)); got != "2026-05-01 Fri 14:03 +0200 (CEST)" {
+		t.Errorf("formatDate = %q", got)
+	}
+	unnamed := time.FixedZone("", -3*60*60)
+	if got := formatDate(time.Date(2026, 5, 1, 9, 0, 0, 0, unnamed)); got != "2026-05-01 Fri 09:00 -0300" {
+		t.Errorf("formatDate without zone name = %q", got)
+	}
+}
+
+func TestBuildUserMessageDate(t *testing.T) {
+	e := testEngine()
+	req := &ashlet.Request{Input: "git log --since", CursorPos: 15}
+	msg := e.buildUserMessage(req, &Info{}, nil)
+	if !strings.Contains(msg, "date: "+time.Now().Format("2006-01-02")) {
+		t.Errorf("message should include today's date, got:\n%s", msg)
+	}
+}
+
+func TestBuildUserMessageAliases(t *testing.T) {
+	e := testEngine()
+	req := &ashlet.Request{Input: "git ch", CursorPos: 6, Aliases: map[string]string{
+		"gco":    "git checkout",
+		"hit":    "curl -H Authorization:$TOKEN",
+		"deploy": "",
+	}}
+	msg := e.buildUserMessage(req, &Info{}, nil)
+	if !strings.Contains(msg, "aliases: gco='git checkout', deploy(), hit=") {
+		t.Errorf("message should list aliases and functions, related first, got:\n%s", msg)
+	}
+	if strings.Contains(msg, "$TOKEN") {
+		t.Errorf("alias expansions should be redacted, got:\n%s", msg)
+	}
+}
+
+func TestBuildUserMessageLastFailure(t *testing.T) {
+	e := testEngine()
+	req := &ashlet.Request{Input: "make", CursorPos: 4}
+	msg := e.buildUserMessage(req, &Info{LastFailure: "`make test` failed with exit 2"}, nil)
+	if !strings.Contains(msg, "last command: `make test` failed with exit 2") {
+		t.Errorf("user message should report the failed command, got:\n%s", msg)
+	}
+}
+
+func TestBuildPromptsSystemContext(t *testing.T) {
+	e := testEngine()
+	e.config.Generation.SystemContext = true
+	req := &ashlet.Request{Input: "git st", CursorPos: 6, Cwd: "/repo"}
+	uc := e.userContext(req, &Info{RecentCommands: []string{"make", "ls"}}, nil)
+
+	system, user := e.buildPrompts(4, "", uc)
+	if user != "Input: `git st`" {
+		t.Errorf("user message should be just the input, got %q", user)
+	}
+	if !strings.Contains(system, "## Shell Context\ncwd: /repo") || !strings.Contains(system, "recent: make, ls") {
+		t.Errorf("the built-in prompt should carry the context, got:\n%s", system)
+	}
+
+	e.customPrompt = `Suggest {{.MaxCandidates}} for {{.InputBefore}} in {{.CWD}} after {{join .RecentCommands ", "}}.`
+	if system, _ := e.buildPrompts(4, "", uc); system != "Suggest 4 for git st in /repo after make, ls." {
+		t.Errorf("custom template fields not filled in, got %q", system)
+	}
+
+	e.config.Generation.SystemContext = false
+	system, user = e.buildPrompts(4, "", uc)
+	if system != "Suggest 4 for  in  after ." || !strings.Contains(user, "recent: make, ls") {
+		t.Errorf("without system_context the context belongs in the user message, got %q / %q", system, user)
+	}
+}
+
+func TestBuildPromptsShell(t *testing.T) {
+	e := testEngine()
+	req := &ashlet.Request{Input: "ls", CursorPos: 2, Cwd: "/repo", Shell: "/usr/bin/fish"}
+	uc := e.userContext(req, &Info{}, nil)
+
+	system, user := e.buildPrompts(4, "", uc)
+	if !strings.Contains(system, "The shell is fish") {
+		t.Errorf("system prompt should ask for fish syntax, got:\n%s", system)
+	}
+	if !strings.Contains(user, "shell: fish") {
+		t.Errorf("user message should name the shell, got:\n%s", user)
+	}
+
+	req.Shell = ""
+	system, user = e.buildPrompts(4, "", e.userContext(req, &Info{}, nil))
+	if strings.Contains(system, "The shell is") || strings.Contains(user, "shell:") {
+		t.Errorf("zsh is the default and needs no mention, got:\n%s\n%s", system, user)
+	}
+}
+
+func TestHistorySourceFallsBackToFile(t *testing.T) {
+	home := t.TempDir()
+	if err := os.WriteFile(filepath.Join(home, ".zsh_history"), []byte(": 1:0;make test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.HistorySource = "atuin"
+	g := newGatherer(nil, cfg, historySource(cfg, ashlet.Paths{Home: home}), gathererOptions{})
+	defer g.Close()
+	if got := g.historyIndexer.RecentCommands(5); len(got) != 1 || got[0] != "make test" {
+		t.Errorf("without an Atuin database history should come from the history file, got %q", got)
+	}
+}
+
+func TestGathererOpensIndexCache(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "state", "embeddings.db")
+	embedder := index.NewEmbedder("http://127.0.0.1:0", "test-key", "test-model")
+	g := newGatherer(embedder, ashlet.DefaultConfig(), index.NewHistoryFiles(nil), gathererOptions{cachePath: cachePath})
+	defer g.Close()
+	if _, err := os.Stat(cachePath); err != nil {
+		t.Errorf("the embedding cache should be created before indexing starts: %v", err)
+	}
+}
+
+func TestHistoryIgnore(t *testing.T) {
+	t.Setenv("HISTIGNORE", "ls:cd *")
+	t.Setenv("HISTORY_IGNORE", "(pwd|exit)")
+	if got := historyIgnore(ashlet.Paths{}); len(got) != 3 {
+		t.Errorf("expected patterns for both settings, got %q", got)
+	}
+	if got := historyIgnore(ashlet.Paths{Home: t.TempDir()}); got != nil {
+		t.Errorf("another user's engine should not use the daemon's environment, got %q", got)
+	}
+}
@@ -0,0 +1,93 @@
+package generate
+
+import (
+	"fmt"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+)
+
+const (
+	// defaultMaxInputLines is how many lines above the one being edited
+	// are shown to the model when input_max_lines is unset.
+	defaultMaxInputLines = 10
+	// defaultMaxInputBytes bounds the lines shown above the edited line,
+	// and the edited line itself, when input_max_bytes is unset.
+	defaultMaxInputBytes = 1024
+)
+
+// pastedInput is a multi-line input split at the line being edited. Only
+// that line is completed; the lines above are summarised as context.
+type pastedInput struct {
+	head   string // the lines above, without the final newline
+	line   string // the line being edited
+	cursor int    // cursor offset within line
+}
+
+// splitPastedInput splits a multi-line input. ok is false for single-line
+// input; p is nil when the cursor is not on the last line, since only the
+// final line is completed.
+func splitPastedInput(input string, cursor int) (p *pastedInput, ok bool) {
+	nl := strings.LastIndexByte(input, '\n')
+	if nl < 0 {
+		return nil, false
+	}
+	if cursor <= nl {
+		return nil, true
+	}
+	return &pastedInput{head: input[:nl], line: input[nl+1:], cursor: cursor - nl - 1}, true
+}
+
+// summary returns the lines above the edited line for the prompt: the
+// last maxLines of them, redacted, within maxBytes, noting how many were
+// left out.
+func (p *pastedInput) summary(maxLines, maxBytes int) string {
+	lines := strings.Split(p.head, "\n")
+	omitted := 0
+	if len(lines) > maxLines {
+		omitted = len(lines) - maxLines
+		lines = lines[omitted:]
+	}
+	lines = core.RedactCommands(lines)
+	for len(lines) > 1 && len(strings.Join(lines, "\n")) > maxBytes {
+		lines = lines[1:]
+		omitted++
+	}
+	shown := strings.Join(lines, " ⏎ ")
+	if len(shown) > maxBytes {
+		shown = "..." + shown[len(shown)-maxBytes:]
+	}
+	if omitted > 0 {
+		return fmt.Sprintf("(%d earlier lines omitted) %s", omitted, shown)
+	}
+	return shown
+}
+
+// restore turns candidates for the edited line into candidates for the
+// whole input.
+func (p *pastedInput) restore(candidates []ashlet.Candidate) []ashlet.Candidate {
+	offset := len(p.head) + 1
+	for i := range candidates {
+		candidates[i].Completion = p.head + "\n" + candidates[i].Completion
+		if candidates[i].CursorPos != nil {
+			pos := *candidates[i].CursorPos + offset
+			candidates[i].CursorPos = &pos
+		}
+	}
+	return candidates
+}
+
+// inputLimits returns the configured limits on multi-line input.
+func (e *Engine) inputLimits() (maxLines, maxBytes int) {
+	maxLines, maxBytes = defaultMaxInputLines, defaultMaxInputBytes
+	if e.config != nil {
+		if n := e.config.Generation.InputMaxLines; n > 0 {
+			maxLines = n
+		}
+		if n := e.config.Generation.InputMaxBytes; n > 0 {
+			maxBytes = n
+		}
+	}
+	return maxLines, maxBytes
+}
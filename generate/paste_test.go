@@ -0,0 +1,92 @@
+package generate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestSplitPastedInput(t *testing.T) {
+	if _, ok := splitPastedInput("git status", 10); ok {
+		t.Error("single-line input should not be split")
+	}
+
+	input := "cd /tmp\nmake\ngit st"
+	p, ok := splitPastedInput(input, len(input))
+	if !ok || p == nil {
+		t.Fatalf("expected multi-line input to split, got %v %v", p, ok)
+	}
+	if p.head != "cd /tmp\nmake" || p.line != "git st" || p.cursor != 6 {
+		t.Errorf("got head %q, line %q, cursor %d", p.head, p.line, p.cursor)
+	}
+
+	if p, ok := splitPastedInput(input, 3); !ok || p != nil {
+		t.Errorf("cursor above the last line should not be completed, got %v", p)
+	}
+}
+
+func TestPastedInputSummary(t *testing.T) {
+	var lines []string
+	for i := range 30 {
+		lines = append(lines, strings.Repeat("x", i))
+	}
+	p := &pastedInput{head: strings.Join(lines, "\n")}
+
+	got := p.summary(5, 1024)
+	if !strings.HasPrefix(got, "(25 earlier lines omitted) ") {
+		t.Errorf("summary should note omitted lines, got %q", got)
+	}
+	if !strings.HasSuffix(got, strings.Repeat("x", 29)) {
+		t.Errorf("summary should keep the lines nearest the edit, got %q", got)
+	}
+
+	if got := p.summary(30, 100); len(got) > 140 {
+		t.Errorf("summary exceeds byte limit: %d bytes", len(got))
+	}
+
+	secret := &pastedInput{head: "export API_TOKEN=hunter2"}
+	if got := secret.summary(10, 1024); strings.Contains(got, "hunter2") {
+		t.Errorf("summary should be redacted, got %q", got)
+	}
+}
+
+func TestCompletePastedInput(t *testing.T) {
+	var userMessage string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatCompletionsRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		userMessage = req.Messages[len(req.Messages)-1].Content
+		json.NewEncoder(w).Encode(chatCompletionsResponse{
+			Choices: []chatChoice{{Message: chatMessage{Role: "assistant", Content: `<candidate type="replace"><command>git status</command></candidate>`}}},
+		})
+	}))
+	defer srv.Close()
+
+	e := &Engine{
+		gatherer:  NewGatherer(nil, nil),
+		generator: NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false),
+		dirCache:  NewDirCache(),
+		config:    ashlet.DefaultConfig(),
+	}
+	defer e.Close()
+
+	input := "cd /tmp\nmake clean\ngit st"
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: input, CursorPos: len(input)})
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %+v", resp.Error)
+	}
+	if !strings.Contains(userMessage, "Input: `git st`") {
+		t.Errorf("only the last line should be completed, got message:\n%s", userMessage)
+	}
+	if !strings.Contains(userMessage, "lines above: cd /tmp ⏎ make clean") {
+		t.Errorf("earlier lines should be summarised, got message:\n%s", userMessage)
+	}
+	if len(resp.Candidates) != 1 || resp.Candidates[0].Completion != "cd /tmp\nmake clean\ngit status" {
+		t.Errorf("candidate should include the earlier lines, got %+v", resp.Candidates)
+	}
+}
@@ -0,0 +1,328 @@
+package generate
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const (
+	// previewTimeout bounds commands run to produce a preview.
+	previewTimeout = 2 * time.Second
+	// previewMaxLines caps the number of preview output lines returned.
+	previewMaxLines = 50
+)
+
+// Preview produces a side-effect-free preview of what a candidate command
+// would do. Only a few commands are supported; everything else returns
+// Supported=false.
+func (e *Engine) Preview(ctx context.Context, req *ashlet.PreviewRequest) *ashlet.PreviewResponse {
+	if !e.localContext(req.Host) {
+		// The command would run on another machine's filesystem.
+		return &ashlet.PreviewResponse{OK: true}
+	}
+	return preview(ctx, strings.TrimRight(req.Command, "\n"), strings.TrimRight(req.Cwd, "\n"))
+}
+
+func preview(ctx context.Context, command, cwd string) *ashlet.PreviewResponse {
+	resp := &ashlet.PreviewResponse{OK: true}
+
+	args, ok := previewArgs(command, cwd)
+	if !ok || len(args) == 0 {
+		return resp
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, previewTimeout)
+	defer cancel()
+
+	var lines []string
+	switch filepath.Base(args[0]) {
+	case "rm":
+		lines, resp.Supported = previewRm(args[1:], cwd), true
+	case "git":
+		lines, resp.Supported = previewGitClean(ctx, args[1:], cwd)
+	case "rsync":
+		lines, resp.Supported = previewRsync(ctx, args[1:], cwd)
+	}
+
+	if len(lines) > previewMaxLines {
+		lines = lines[:previewMaxLines]
+		resp.Truncated = true
+	}
+	resp.Output = strings.Join(lines, "\n")
+	return resp
+}
+
+// previewArgs parses command into a literal argument list. It rejects
+// anything whose effect cannot be determined statically: multiple
+// statements, pipes, redirects, assignments, and parameter or command
+// expansions. Unquoted globs and leading ~ are expanded relative to cwd.
+func previewArgs(command, cwd string) ([]string, bool) {
+	parser := syntax.NewParser(syntax.Variant(syntax.LangBash))
+	prog, err := parser.Parse(strings.NewReader(command), "")
+	if err != nil || len(prog.Stmts) != 1 {
+		return nil, false
+	}
+	stmt := prog.Stmts[0]
+	if stmt.Negated || stmt.Background || len(stmt.Redirs) > 0 {
+		return nil, false
+	}
+	call, ok := stmt.Cmd.(*syntax.CallExpr)
+	if !ok || len(call.Assigns) > 0 {
+		return nil, false
+	}
+
+	var args []string
+	for _, w := range call.Args {
+		lit, glob, ok := wordLiteral(w)
+		if !ok {
+			return nil, false
+		}
+		if strings.HasPrefix(lit, "~/") || lit == "~" {
+			if home, err := os.UserHomeDir(); err == nil {
+				lit = home + lit[1:]
+			}
+		}
+		if glob {
+			pattern := lit
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(cwd, pattern)
+			}
+			if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+				for _, m := range matches {
+					if !filepath.IsAbs(lit) {
+						if rel, err := filepath.Rel(cwd, m); err == nil {
+							m = rel
+						}
+					}
+					args = append(args, m)
+				}
+				continue
+			}
+		}
+		args = append(args, lit)
+	}
+	return args, true
+}
+
+// wordLiteral returns the literal value of w. glob reports whether an
+// unquoted part contains glob metacharacters. ok is false when the word
+// contains any expansion.
+func wordLiteral(w *syntax.Word) (lit string, glob bool, ok bool) {
+	var sb strings.Builder
+	for _, part := range w.Parts {
+		switch p := part.(type) {
+		case *syntax.Lit:
+			sb.WriteString(p.Value)
+			if strings.ContainsAny(p.Value, "*?[") {
+				glob = true
+			}
+		case *syntax.SglQuoted:
+			sb.WriteString(p.Value)
+		case *syntax.DblQuoted:
+			for _, dp := range p.Parts {
+				l, isLit := dp.(*syntax.Lit)
+				if !isLit {
+					return "", false, false
+				}
+				sb.WriteString(l.Value)
+			}
+		default:
+			return "", false, false
+		}
+	}
+	return sb.String(), glob, true
+}
+
+// previewRm lists the paths an rm invocation would delete, walking
+// directories when -r is given.
+func previewRm(args []string, cwd string) []string {
+	recursive := false
+	var paths []string
+	flagsDone := false
+	for _, a := range args {
+		switch {
+		case flagsDone || !strings.HasPrefix(a, "-") || a == "-":
+			paths = append(paths, a)
+		case a == "--":
+			flagsDone = true
+		case a == "--recursive":
+			recursive = true
+		case !strings.HasPrefix(a, "--") && strings.ContainsAny(a, "rR"):
+			recursive = true
+		}
+	}
+
+	var lines []string
+	for _, p := range paths {
+		abs := p
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(cwd, abs)
+		}
+		info, err := os.Lstat(abs)
+		if err != nil {
+			lines = append(lines, p+" (does not exist)")
+			continue
+		}
+		if !info.IsDir() {
+			lines = append(lines, p)
+			continue
+		}
+		if !recursive {
+			lines = append(lines, p+"/ (directory, not removed without -r)")
+			continue
+		}
+		filepath.WalkDir(abs, func(path string, d fs.DirEntry, err error) error {
+			if len(lines) > previewMaxLines {
+				return fs.SkipAll
+			}
+			rel, relErr := filepath.Rel(abs, path)
+			if relErr != nil {
+				return nil
+			}
+			line := filepath.Join(p, rel)
+			if d != nil && d.IsDir() {
+				line += "/"
+			}
+			lines = append(lines, line)
+			return nil
+		})
+		if len(lines) > previewMaxLines {
+			break
+		}
+	}
+	return lines
+}
+
+// previewGitClean runs `git clean --dry-run` with the candidate's flags,
+// minus force and interactive.
+func previewGitClean(ctx context.Context, args []string, cwd string) ([]string, bool) {
+	if len(args) == 0 || args[0] != "clean" {
+		return nil, false
+	}
+	cmdArgs := []string{"clean", "--dry-run"}
+	// pattern is set when the argument is the value of a preceding -e,
+	// and paths once -- ends the options.
+	pattern, paths := false, false
+	for _, a := range args[1:] {
+		switch {
+		case pattern:
+			pattern = false
+		case paths:
+		case a == "--":
+			paths = true
+		case a == "--force" || a == "--interactive":
+			continue
+		case strings.HasPrefix(a, "-") && !strings.HasPrefix(a, "--"):
+			a, pattern = stripCleanShort(a)
+			if a == "-" {
+				continue
+			}
+		}
+		cmdArgs = append(cmdArgs, a)
+	}
+	return runPreviewCmd(ctx, cwd, "git", cmdArgs...), true
+}
+
+// stripCleanShort drops -f and -i from a cluster of short git clean flags.
+// Flags after -e are its pattern and are kept as they are; wantsPattern
+// reports whether the cluster ends with -e, so the pattern is the next
+// argument.
+func stripCleanShort(cluster string) (flags string, wantsPattern bool) {
+	var b strings.Builder
+	for i, r := range cluster {
+		switch {
+		case i > 0 && r == 'e':
+			b.WriteString(cluster[i:])
+			return b.String(), i == len(cluster)-1
+		case i > 0 && (r == 'f' || r == 'i'):
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), false
+}
+
+// rsyncPreviewFlags are the long rsync options a preview passes on, mapped
+// to whether they take a value. They only choose what would be transferred
+// and how it is reported, so under --dry-run they write nothing and start
+// nothing; options that do (--log-file, --write-batch, --daemon, --config,
+// --rsh) are left out.
+var rsyncPreviewFlags = map[string]bool{
+	"--archive": false, "--recursive": false, "--dirs": false, "--links": false,
+	"--copy-links": false, "--copy-dirlinks": false, "--keep-dirlinks": false,
+	"--hard-links": false, "--perms": false, "--executability": false,
+	"--acls": false, "--xattrs": false, "--owner": false, "--group": false,
+	"--devices": false, "--specials": false, "--times": false,
+	"--omit-dir-times": false, "--sparse": false, "--whole-file": false,
+	"--one-file-system": false, "--relative": false, "--update": false,
+	"--existing": false, "--ignore-existing": false, "--checksum": false,
+	"--size-only": false, "--ignore-times": false, "--fuzzy": false,
+	"--delete": false, "--delete-before": false, "--delete-during": false,
+	"--delete-delay": false, "--delete-after": false, "--delete-excluded": false,
+	"--remove-source-files": false, "--prune-empty-dirs": false,
+	"--cvs-exclude": false, "--partial": false, "--progress": false,
+	"--verbose": false, "--quiet": false, "--human-readable": false,
+	"--itemize-changes": false, "--stats": false, "--compress": false,
+	"--dry-run": false,
+	"--exclude": true, "--include": true, "--exclude-from": true,
+	"--include-from": true, "--filter": true, "--max-size": true,
+	"--min-size": true, "--max-delete": true,
+}
+
+// rsyncPreviewShort are the short forms of rsyncPreviewFlags that take no
+// value.
+const rsyncPreviewShort = "aAcCdDEgHhiklKLmnoOpPqrRStuvWxXyz"
+
+// previewRsync runs rsync with --dry-run for local transfers with only
+// rsyncPreviewFlags. Remote transfers are not previewed since they would
+// contact another host, nor commands with other options, which may write
+// files or start services even in a dry run.
+func previewRsync(ctx context.Context, args []string, cwd string) ([]string, bool) {
+	operands := false
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case operands || !strings.HasPrefix(a, "-") || a == "-":
+			if strings.Contains(a, ":") {
+				return nil, false
+			}
+		case a == "--":
+			operands = true
+		case strings.HasPrefix(a, "--"):
+			name, _, hasValue := strings.Cut(a, "=")
+			takesValue, ok := rsyncPreviewFlags[name]
+			if !ok || hasValue && !takesValue {
+				return nil, false
+			}
+			if takesValue && !hasValue {
+				i++ // the value is the next argument
+			}
+		default:
+			if strings.Trim(a[1:], rsyncPreviewShort) != "" {
+				return nil, false
+			}
+		}
+	}
+	cmdArgs := append([]string{"--dry-run", "--itemize-changes"}, args...)
+	return runPreviewCmd(ctx, cwd, "rsync", cmdArgs...), true
+}
+
+// runPreviewCmd runs a dry-run command and returns its combined output lines.
+func runPreviewCmd(ctx context.Context, dir, name string, args ...string) []string {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	out, _ := cmd.CombinedOutput()
+	text := strings.TrimRight(string(out), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
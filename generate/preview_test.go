@@ -0,0 +1,177 @@
+package generate
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestPreviewArgsRejectsDynamicCommands(t *testing.T) {
+	for _, cmd := range []string{
+		"rm $FILE",
+		"rm $(cat list)",
+		"rm a && rm b",
+		"ls | xargs rm",
+		"rm a > log",
+		"FOO=1 rm a",
+	} {
+		if _, ok := previewArgs(cmd, "/tmp"); ok {
+			t.Errorf("previewArgs(%q) should be rejected", cmd)
+		}
+	}
+}
+
+func TestPreviewArgsLiterals(t *testing.T) {
+	args, ok := previewArgs(`rm -f "a b.txt" 'c.txt' d.txt`, "/tmp")
+	if !ok {
+		t.Fatal("expected literal command to parse")
+	}
+	want := []string{"rm", "-f", "a b.txt", "c.txt", "d.txt"}
+	if strings.Join(args, "|") != strings.Join(want, "|") {
+		t.Errorf("previewArgs = %q, want %q", args, want)
+	}
+}
+
+func TestPreviewRm(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.log"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "b.log"), nil, 0644)
+	os.MkdirAll(filepath.Join(dir, "build", "out"), 0755)
+	os.WriteFile(filepath.Join(dir, "build", "out", "bin"), nil, 0644)
+
+	resp := preview(context.Background(), "rm *.log", dir)
+	if !resp.Supported || resp.Output != "a.log\nb.log" {
+		t.Errorf("rm glob preview = %+v", resp)
+	}
+
+	resp = preview(context.Background(), "rm -rf build", dir)
+	for _, want := range []string{"build/", "build/out/", "build/out/bin"} {
+		if !strings.Contains(resp.Output, want) {
+			t.Errorf("rm -rf preview missing %q, got:\n%s", want, resp.Output)
+		}
+	}
+
+	resp = preview(context.Background(), "rm build missing.txt", dir)
+	if !strings.Contains(resp.Output, "not removed without -r") || !strings.Contains(resp.Output, "missing.txt (does not exist)") {
+		t.Errorf("rm preview should explain skipped paths, got:\n%s", resp.Output)
+	}
+}
+
+func TestPreviewRmTruncates(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < previewMaxLines+10; i++ {
+		os.WriteFile(filepath.Join(dir, "f"+strings.Repeat("x", i)), nil, 0644)
+	}
+	resp := preview(context.Background(), "rm -r .", dir)
+	if !resp.Truncated {
+		t.Error("expected truncated preview")
+	}
+	if n := len(strings.Split(resp.Output, "\n")); n != previewMaxLines {
+		t.Errorf("preview has %d lines, want %d", n, previewMaxLines)
+	}
+}
+
+func TestPreviewGitClean(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	if err := exec.Command("git", "-C", dir, "init", "-q").Run(); err != nil {
+		t.Skip("git init failed")
+	}
+	os.WriteFile(filepath.Join(dir, "junk.txt"), nil, 0644)
+
+	resp := preview(context.Background(), "git clean -fd", dir)
+	if !resp.Supported || !strings.Contains(resp.Output, "Would remove junk.txt") {
+		t.Errorf("git clean preview = %+v", resp)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "junk.txt")); err != nil {
+		t.Error("preview must not delete files")
+	}
+}
+
+func TestPreviewGitCleanPattern(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	if err := exec.Command("git", "-C", dir, "init", "-q").Run(); err != nil {
+		t.Skip("git init failed")
+	}
+	for _, name := range []string{"info.txt", "junk.txt", "-fi.txt"} {
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+
+	// The pattern of -e is kept as typed, attached or not, and so are
+	// paths after --.
+	for _, cmd := range []string{
+		"git clean -fdeinfo.txt -- junk.txt info.txt",
+		"git clean -fde info.txt -- junk.txt info.txt",
+		"git clean -fe info.txt -- -fi.txt junk.txt info.txt",
+	} {
+		resp := preview(context.Background(), cmd, dir)
+		if !resp.Supported || !strings.Contains(resp.Output, "Would remove junk.txt") || strings.Contains(resp.Output, "info.txt") {
+			t.Errorf("preview(%q) = %+v", cmd, resp)
+		}
+	}
+	resp := preview(context.Background(), "git clean -f -- -fi.txt", dir)
+	if !strings.Contains(resp.Output, "Would remove -fi.txt") || strings.Contains(resp.Output, "junk.txt") {
+		t.Errorf("git clean preview of a path after -- = %+v", resp)
+	}
+}
+
+func TestPreviewUnsupported(t *testing.T) {
+	for _, cmd := range []string{
+		"ls -la", "git status", "rsync -a src/ host:dst/",
+		"rsync -a --log-file=/tmp/x src/ dst/", "rsync -a --write-batch=b src/ dst/",
+		"rsync --only-write-batch b src/ dst/", "rsync --daemon", "rsync --config=x src/ dst/",
+		"rsync -ae ssh src/ dst/", "rsync -a --delete=x src/ dst/",
+	} {
+		if resp := preview(context.Background(), cmd, t.TempDir()); resp.Supported {
+			t.Errorf("preview(%q) should be unsupported", cmd)
+		}
+	}
+}
+
+func TestPreviewSkipsForeignHost(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), nil, 0644)
+
+	e := &Engine{}
+	req := &ashlet.PreviewRequest{Command: "rm a.txt", Cwd: dir, Host: "not-this-host.invalid"}
+	if resp := e.Preview(context.Background(), req); resp.Supported {
+		t.Error("preview from another host should be unsupported")
+	}
+
+	e = &Engine{noLocalContext: true}
+	req.Host = ""
+	if resp := e.Preview(context.Background(), req); resp.Supported {
+		t.Error("preview with local context disabled should be unsupported")
+	}
+}
+
+func TestPreviewRsync(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "src"), 0755)
+	os.WriteFile(filepath.Join(dir, "src", "a.txt"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "src", "b.log"), nil, 0644)
+
+	resp := preview(context.Background(), "rsync -avh --delete --exclude '*.log' --max-size=1M src/ dst/", dir)
+	if !resp.Supported {
+		t.Fatalf("rsync preview = %+v, want supported", resp)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dst")); !os.IsNotExist(err) {
+		t.Error("preview must not copy files")
+	}
+	if _, err := exec.LookPath("rsync"); err != nil {
+		t.Skip("rsync not installed")
+	}
+	if !strings.Contains(resp.Output, "a.txt") || strings.Contains(resp.Output, "b.log") {
+		t.Errorf("rsync preview output = %q", resp.Output)
+	}
+}
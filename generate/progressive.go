@@ -0,0 +1,94 @@
+package generate
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+)
+
+// upgradeCounters counts how progressive completions were answered.
+type upgradeCounters struct {
+	immediate atomic.Int64
+	upgraded  atomic.Int64
+	missed    atomic.Int64
+}
+
+// CompleteProgressive is like Complete, but with generation.soft_deadline_ms
+// set it answers a slow completion twice. When the model has not answered
+// by the soft deadline, early is called with candidates from history,
+// marked Pending, and the model's answer is returned if it arrives within
+// generation.upgrade_deadline_ms of the request; otherwise, or if it has no
+// candidates, nil is returned and the early answer stands.
+func (e *Engine) CompleteProgressive(ctx context.Context, req *ashlet.Request, early func(*ashlet.Response)) *ashlet.Response {
+	soft := e.softDeadline()
+	if soft <= 0 || req.Mode == "fix" || req.DryRun {
+		return e.Complete(ctx, req)
+	}
+	if upgrade := e.upgradeDeadline(); upgrade > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, upgrade)
+		defer cancel()
+	}
+
+	// Complete trims and clamps its request in place; the history answer
+	// works on a copy of its own.
+	localReq := *req
+	done := make(chan *ashlet.Response, 1)
+	go func() { done <- e.Complete(ctx, req) }()
+
+	timer := time.NewTimer(soft)
+	defer timer.Stop()
+	select {
+	case resp := <-done:
+		e.upgrades.immediate.Add(1)
+		return resp
+	case <-timer.C:
+	}
+
+	localReq.Completer = completerHistory
+	local := e.complete(ctx, &localReq).Response
+	core.AnnotateDiffs(local.Candidates, localReq.Input)
+	for i := range local.Candidates {
+		local.Candidates[i].Score = nil
+	}
+	local.Pending = true
+	early(local)
+
+	resp := <-done
+	if resp.Error != nil || len(resp.Candidates) == 0 || ctx.Err() != nil {
+		e.upgrades.missed.Add(1)
+		return nil
+	}
+	e.upgrades.upgraded.Add(1)
+	return resp
+}
+
+// UpgradeStats reports how progressive completions have been answered
+// since the daemon started.
+func (e *Engine) UpgradeStats() ashlet.UpgradeStats {
+	return ashlet.UpgradeStats{
+		Immediate: int(e.upgrades.immediate.Load()),
+		Upgraded:  int(e.upgrades.upgraded.Load()),
+		Missed:    int(e.upgrades.missed.Load()),
+	}
+}
+
+// softDeadline returns generation.soft_deadline_ms, or 0 if unset.
+func (e *Engine) softDeadline() time.Duration {
+	if e.config == nil {
+		return 0
+	}
+	return time.Duration(e.config.Generation.SoftDeadlineMs) * time.Millisecond
+}
+
+// upgradeDeadline returns generation.upgrade_deadline_ms, defaulting to the
+// generation timeout.
+func (e *Engine) upgradeDeadline() time.Duration {
+	if e.config == nil || e.config.Generation.UpgradeDeadlineMs <= 0 {
+		return e.generationTimeout()
+	}
+	return time.Duration(e.config.Generation.UpgradeDeadlineMs) * time.Millisecond
+}
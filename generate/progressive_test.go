@@ -0,0 +1,68 @@
+package generate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestCompleteProgressive(t *testing.T) {
+	var delay atomic.Int64
+	delay.Store(int64(150 * time.Millisecond))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Duration(delay.Load())):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<candidate type=\"replace\"><command>git status --short</command></candidate>"}}]}`))
+	}))
+	defer srv.Close()
+
+	hist := filepath.Join(t.TempDir(), ".zsh_history")
+	os.WriteFile(hist, []byte(": 1:0;git status\n"), 0644)
+
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.SoftDeadlineMs = 30
+	cfg.Generation.UpgradeDeadlineMs = 1000
+	gen := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, hist), generator: gen, dirCache: NewDirCache(), config: cfg}
+	defer e.gatherer.Close()
+
+	complete := func() (early, final *ashlet.Response) {
+		final = e.CompleteProgressive(context.Background(), &ashlet.Request{Input: "git st", CursorPos: 6}, func(r *ashlet.Response) { early = r })
+		return early, final
+	}
+
+	early, final := complete()
+	if early == nil || !early.Pending || len(early.Candidates) != 1 || early.Candidates[0].Completion != "git status" {
+		t.Errorf("early = %+v, want a pending answer from history", early)
+	}
+	if final == nil || final.Pending || len(final.Candidates) != 1 || final.Candidates[0].Completion != "git status --short" {
+		t.Errorf("final = %+v, want the model's candidates", final)
+	}
+
+	// The model misses the upgrade deadline: the early answer stands.
+	cfg.Generation.UpgradeDeadlineMs = 60
+	if early, final := complete(); early == nil || final != nil {
+		t.Errorf("late model: early = %+v, final = %+v; want only the early answer", early, final)
+	}
+
+	// The model beats the soft deadline: one answer.
+	delay.Store(0)
+	cfg.Generation.SoftDeadlineMs = 1000
+	if early, final := complete(); early != nil || final == nil || len(final.Candidates) != 1 {
+		t.Errorf("fast model: early = %+v, final = %+v; want one answer", early, final)
+	}
+
+	if got := e.UpgradeStats(); got != (ashlet.UpgradeStats{Immediate: 1, Upgraded: 1, Missed: 1}) {
+		t.Errorf("UpgradeStats = %+v", got)
+	}
+}
@@ -0,0 +1,145 @@
+package generate
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// projectCache holds an engine's views of the projects that override its
+// config, keyed by git work tree root. A view is rebuilt when the
+// project's override files change.
+type projectCache struct {
+	mu    sync.Mutex
+	views map[string]projectView
+}
+
+// projectView is an engine with a project's overrides applied, and the
+// state of the override files it was built from. engine is nil when the
+// files could not be used.
+type projectView struct {
+	stamp  uint64
+	engine *Engine
+}
+
+func newProjectCache() *projectCache {
+	return &projectCache{views: make(map[string]projectView)}
+}
+
+// reset drops all views, so they are rebuilt from the engine's current
+// prompt templates.
+func (pc *projectCache) reset() {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	clear(pc.views)
+}
+
+// forProject returns the engine to complete req with: a view of e with the
+// overrides of the project req comes from (ProjectConfigFile and
+// ProjectPromptPath at its git root), or e itself when there are none.
+// Overrides are read from the daemon's filesystem, so requests from other
+// hosts always get e.
+func (e *Engine) forProject(req *ashlet.Request) *Engine {
+	if e.projects == nil || !e.localContext(req.Host) {
+		return e
+	}
+	cwd := strings.TrimRight(req.Cwd, "\n")
+	if cwd == "" {
+		return e
+	}
+	root, _ := findGitDir(cwd)
+	if root == "" {
+		return e
+	}
+	configPath := filepath.Join(root, ashlet.ProjectConfigFile)
+	promptPath := ashlet.ProjectPromptPath(root)
+	h := fnv.New64a()
+	statInto(h, configPath)
+	statInto(h, promptPath)
+	stamp := h.Sum64()
+
+	pc := e.projects
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if v, ok := pc.views[root]; ok && v.stamp == stamp {
+		if v.engine == nil {
+			return e
+		}
+		return v.engine
+	}
+
+	view := projectView{stamp: stamp}
+	data, err := e.paths.ReadFile(configPath)
+	prompt := loadCustomPrompt(e.paths, promptPath)
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		slog.Warn("failed to read project config", "path", configPath, "error", err)
+	case err != nil && prompt == "":
+		// Neither file exists: not a project with overrides.
+	default:
+		cfg := e.config
+		if err == nil {
+			if cfg, err = e.config.WithProject(data); err != nil {
+				slog.Warn("invalid project config, ignoring it", "path", configPath, "error", err)
+				break
+			}
+		}
+		view.engine = e.withProject(cfg, prompt)
+		slog.Info("loaded project overrides", "root", root)
+	}
+	pc.views[root] = view
+	if view.engine == nil {
+		return e
+	}
+	return view.engine
+}
+
+// withProject returns a view of e completing with cfg and, when prompt is
+// not empty, the prompt template prompt instead of e's (which also ends
+// any prompt A/B test). The view shares e's history, caches, and stores,
+// and has a generator of its own.
+func (e *Engine) withProject(cfg *ashlet.Config, prompt string) *Engine {
+	e.promptMu.RLock()
+	customPrompt, customFix, promptB := e.customPrompt, e.customFix, e.promptB
+	e.promptMu.RUnlock()
+	if prompt != "" {
+		customPrompt, promptB = prompt, ""
+	}
+	return &Engine{
+		paths:        e.paths,
+		gatherer:     e.gatherer,
+		generator:    newConfiguredGenerator(cfg, e.health, e.usage, e.audit),
+		dirCache:     e.dirCache,
+		execs:        e.execs,
+		helps:        e.helps,
+		docs:         e.docs,
+		feedback:     e.feedback,
+		ledger:       e.ledger,
+		capture:      e.capture,
+		summaries:    e.summaries,
+		sessions:     e.sessions,
+		config:       cfg,
+		customPrompt: customPrompt,
+		customFix:    customFix,
+		promptB:      promptB,
+		latency:      e.latency,
+		health:       e.health,
+		embedder:     e.embedder,
+		usage:        e.usage,
+		audit:        e.audit,
+		limiter:      e.limiter,
+		sched:        e.sched,
+		completers:   e.completers,
+		anonymizer:   e.anonymizer,
+
+		noLocalContext: e.noLocalContext,
+	}
+}
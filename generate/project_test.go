@@ -0,0 +1,115 @@
+package generate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestCompleteProjectOverrides(t *testing.T) {
+	var mu sync.Mutex
+	var models, stops, systems []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model    string   `json:"model"`
+			Stop     []string `json:"stop"`
+			Messages []struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		models = append(models, body.Model)
+		stops = append(stops, strings.Join(body.Stop, ","))
+		systems = append(systems, body.Messages[0].Content)
+		mu.Unlock()
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<candidate type=\"replace\"><command>git status</command></candidate>"}}]}`))
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, ".git"), 0755)
+	os.Mkdir(filepath.Join(root, "src"), 0755)
+	os.Mkdir(filepath.Join(root, ".ashlet"), 0755)
+	os.WriteFile(filepath.Join(root, ashlet.ProjectConfigFile), []byte(`{"generation":{"stop":["END"],"model":"project-model","base_url":"https://elsewhere.example"}}`), 0644)
+	os.WriteFile(ashlet.ProjectPromptPath(root), []byte("Project rules."), 0644)
+
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.BaseURL, cfg.Generation.APIKey, cfg.Generation.APIType = srv.URL, "test-key", "chat_completions"
+	cfg.Generation.Model = "global-model"
+	e := &Engine{
+		gatherer:   NewGathererForHistory(nil, nil, ""),
+		generator:  newConfiguredGenerator(cfg, nil, nil, nil),
+		dirCache:   NewDirCache(),
+		config:     cfg,
+		projects:   newProjectCache(),
+		completers: map[string]Completer{},
+	}
+	defer e.gatherer.Close()
+
+	complete := func(cwd string) {
+		t.Helper()
+		resp := e.Complete(context.Background(), &ashlet.Request{Input: "git st", CursorPos: 6, Cwd: cwd})
+		if resp.Error != nil || len(resp.Candidates) == 0 {
+			t.Fatalf("Complete(%q) = %+v", cwd, resp)
+		}
+	}
+	complete(filepath.Join(root, "src"))
+	complete(t.TempDir())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(models) != 2 {
+		t.Fatalf("expected 2 model calls, got %d", len(models))
+	}
+	if stops[0] != "END" || systems[0] != "Project rules." || models[0] != "global-model" {
+		t.Errorf("inside the project: stop %q, prompt %q, model %q; want the project's stop and prompt and the user's model", stops[0], systems[0], models[0])
+	}
+	if stops[1] == "END" || systems[1] == "Project rules." {
+		t.Errorf("outside the project: stop %q, prompt %q; want the global ones", stops[1], systems[1])
+	}
+
+	// An edited override file is picked up on the next request.
+	os.WriteFile(filepath.Join(root, ashlet.ProjectConfigFile), []byte(`{"generation":{"stop":["EDITED"]}}`), 0644)
+	mu.Unlock()
+	complete(root)
+	mu.Lock()
+	if stops[2] != "EDITED" {
+		t.Errorf("after editing .ashlet.json: stop %q, want EDITED", stops[2])
+	}
+}
+
+func TestCompleteProjectNoHistory(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, ".git"), 0755)
+	os.WriteFile(filepath.Join(root, ashlet.ProjectConfigFile), []byte(`{"generation":{"no_history":true}}`), 0644)
+	histFile := filepath.Join(t.TempDir(), ".zsh_history")
+	os.WriteFile(histFile, []byte("git status\nmake test\n"), 0644)
+
+	e := &Engine{
+		gatherer:   NewGathererForHistory(nil, nil, histFile),
+		dirCache:   NewDirCache(),
+		config:     ashlet.DefaultConfig(),
+		projects:   newProjectCache(),
+		completers: map[string]Completer{},
+	}
+	defer e.gatherer.Close()
+
+	req := &ashlet.Request{Input: "git", CursorPos: 3, Cwd: root}
+	if info := e.CompleteVerbose(context.Background(), req).Info; info == nil || len(info.RecentCommands) != 0 {
+		t.Errorf("a no_history project should gather no history, got %+v", info)
+	}
+	req = &ashlet.Request{Input: "git", CursorPos: 3, Cwd: t.TempDir()}
+	if info := e.CompleteVerbose(context.Background(), req).Info; info == nil || len(info.RecentCommands) == 0 {
+		t.Error("outside the project history should be gathered")
+	}
+}
@@ -0,0 +1,82 @@
+package generate
+
+import (
+	"log/slog"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// promptWatcher reloads an engine's prompt templates when their files
+// change, so a prompt can be iterated on without reloading the daemon.
+type promptWatcher struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// watchPrompts watches the config directory for changes to prompt.md,
+// fix_prompt.md, and prompt_b.md and reloads them into e. The directory is
+// watched rather than the files, since editors often save by replacing a
+// file. It returns nil when the directory cannot be watched (e.g. it does
+// not exist yet).
+func watchPrompts(e *Engine, paths ashlet.Paths) *promptWatcher {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Debug("prompt hot reload unavailable", "error", err)
+		return nil
+	}
+	if err := w.Add(paths.ConfigDir()); err != nil {
+		slog.Debug("prompt hot reload unavailable", "dir", paths.ConfigDir(), "error", err)
+		w.Close()
+		return nil
+	}
+	targets := map[string]*string{
+		paths.PromptPath():    &e.customPrompt,
+		paths.FixPromptPath(): &e.customFix,
+		paths.PromptBPath():   &e.promptB,
+	}
+	pw := &promptWatcher{watcher: w, done: make(chan struct{})}
+	go func() {
+		defer close(pw.done)
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				target, ok := targets[filepath.Clean(ev.Name)]
+				if !ok || ev.Op == fsnotify.Chmod {
+					continue
+				}
+				text := loadCustomPrompt(paths, ev.Name)
+				e.promptMu.Lock()
+				changed := *target != text
+				*target = text
+				e.promptMu.Unlock()
+				if changed {
+					e.projects.reset()
+				}
+				if changed && text == "" {
+					slog.Info("custom prompt removed, using built-in default", "path", ev.Name)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("prompt watcher error", "error", err)
+			}
+		}
+	}()
+	return pw
+}
+
+// Close stops watching.
+func (pw *promptWatcher) Close() {
+	if pw == nil {
+		return
+	}
+	pw.watcher.Close()
+	<-pw.done
+}
@@ -0,0 +1,58 @@
+package generate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestPromptHotReload(t *testing.T) {
+	paths := ashlet.Paths{Home: t.TempDir()}
+	if err := os.MkdirAll(paths.ConfigDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	e := &Engine{config: ashlet.DefaultConfig()}
+	e.prompts = watchPrompts(e, paths)
+	if e.prompts == nil {
+		t.Fatal("config directory should be watched")
+	}
+	defer e.prompts.Close()
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	os.WriteFile(paths.PromptPath(), []byte("Suggest {{.MaxCandidates}} commands."), 0644)
+	waitFor("prompt.md to load", func() bool { return e.buildSystemPrompt(3, "") == "Suggest 3 commands." })
+
+	// Editors often save by writing a temporary file and renaming it.
+	tmp := filepath.Join(paths.ConfigDir(), ".prompt.md.swp")
+	os.WriteFile(tmp, []byte("Give {{.MaxCandidates}} commands."), 0644)
+	os.Rename(tmp, paths.PromptPath())
+	waitFor("the replaced prompt.md to load", func() bool { return e.buildSystemPrompt(3, "") == "Give 3 commands." })
+
+	os.Remove(paths.PromptPath())
+	waitFor("the built-in prompt", func() bool { return strings.Contains(e.buildSystemPrompt(3, ""), "auto-completion engine") })
+
+	os.WriteFile(paths.PromptBPath(), []byte("B"), 0644)
+	waitFor("prompt_b.md to start an A/B test", func() bool { return e.promptVariant("") != "" })
+}
+
+func TestWatchPromptsMissingDir(t *testing.T) {
+	e := &Engine{config: ashlet.DefaultConfig()}
+	if pw := watchPrompts(e, ashlet.Paths{Home: t.TempDir()}); pw != nil {
+		pw.Close()
+		t.Error("a missing config directory should not be watched")
+	}
+}
@@ -0,0 +1,101 @@
+package generate
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+)
+
+// frequencyWeight is how far history frequency can move a candidate under
+// the "frequency_blend" strategy; positions are 0.15 apart in confidence.
+const frequencyWeight = 0.3
+
+// rankInput is what a ranking strategy may order candidates by.
+type rankInput struct {
+	input    string
+	info     *Info
+	feedback *FeedbackStore
+}
+
+// rankStrategy re-orders candidates in place, re-assigning position-based
+// confidence when it moves them.
+type rankStrategy func(candidates []ashlet.Candidate, in rankInput)
+
+// rankStrategies maps each of ashlet.RankStrategies to its implementation.
+var rankStrategies = map[string]rankStrategy{
+	"quote_extension": func(candidates []ashlet.Candidate, in rankInput) {
+		core.SortCandidates(candidates, in.input)
+		biasCandidates(candidates, in.feedback)
+	},
+	"position": func([]ashlet.Candidate, rankInput) {},
+	"frequency_blend": func(candidates []ashlet.Candidate, in rankInput) {
+		blendFrequency(candidates, in.info)
+		biasCandidates(candidates, in.feedback)
+	},
+	"learned": func(candidates []ashlet.Candidate, in rankInput) {
+		biasCandidates(candidates, in.feedback)
+	},
+}
+
+// rank orders candidates with the configured rank.strategy, falling back
+// to "quote_extension" for an empty or unknown name.
+func (e *Engine) rank(candidates []ashlet.Candidate, input string, info *Info) {
+	strategy := rankStrategies["quote_extension"]
+	if e.config != nil {
+		if s, ok := rankStrategies[e.config.Rank.Strategy]; ok {
+			strategy = s
+		}
+	}
+	strategy(candidates, rankInput{input: input, info: info, feedback: e.feedback})
+}
+
+// commandKey returns the first two words of cmd, which identify the
+// command (and subcommand) it runs for frequency counting.
+func commandKey(cmd string) string {
+	fields := strings.Fields(cmd)
+	return strings.Join(fields[:min(len(fields), 2)], " ")
+}
+
+// blendFrequency re-orders candidates by their confidence plus the share
+// of the recent and related history commands that run the same command,
+// then re-assigns position-based confidence.
+func blendFrequency(candidates []ashlet.Candidate, info *Info) {
+	if info == nil || len(candidates) < 2 {
+		return
+	}
+	history := slices.Concat(info.RecentCommands, info.RelevantCommands)
+	if len(history) == 0 {
+		return
+	}
+	counts := make(map[string]int)
+	for _, cmd := range history {
+		counts[commandKey(cmd)]++
+	}
+
+	type ranked struct {
+		candidate ashlet.Candidate
+		weight    float64
+	}
+	items := make([]ranked, len(candidates))
+	for i, c := range candidates {
+		share := float64(counts[commandKey(c.Completion)]) / float64(len(history))
+		if c.Score != nil {
+			c.Score.Frequency = frequencyWeight * share
+		}
+		items[i] = ranked{candidate: c, weight: c.Confidence + frequencyWeight*share}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].weight > items[j].weight
+	})
+
+	for i, item := range items {
+		candidates[i] = item.candidate
+		candidates[i].Confidence = 0.95 - float64(i)*0.15
+		if candidates[i].Confidence < 0.1 {
+			candidates[i].Confidence = 0.1
+		}
+	}
+}
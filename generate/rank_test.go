@@ -0,0 +1,67 @@
+package generate
+
+import (
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestRankStrategiesRegistered(t *testing.T) {
+	for _, name := range ashlet.RankStrategies {
+		if rankStrategies[name] == nil {
+			t.Errorf("rank strategy %q has no implementation", name)
+		}
+	}
+	if len(rankStrategies) != len(ashlet.RankStrategies) {
+		t.Errorf("registry has %d strategies, ashlet.RankStrategies lists %d", len(rankStrategies), len(ashlet.RankStrategies))
+	}
+}
+
+func TestRankStrategies(t *testing.T) {
+	input := `git commit -m "`
+	tests := []struct {
+		strategy string
+		first    string
+	}{
+		{"", `git commit -m "fix parser crash on empty input"`},
+		{"quote_extension", `git commit -m "fix parser crash on empty input"`},
+		{"bogus", `git commit -m "fix parser crash on empty input"`},
+		{"position", `git commit -m "wip"`},
+		{"learned", `git commit -m "wip"`},
+		{"frequency_blend", `git commit -m "wip"`}, // no history
+
+	}
+	for _, tt := range tests {
+		e := testEngine()
+		e.config.Rank.Strategy = tt.strategy
+		candidates := []ashlet.Candidate{
+			{Completion: `git commit -m "wip"`, Confidence: 0.95},
+			{Completion: `git commit -m "fix parser crash on empty input"`, Confidence: 0.80},
+		}
+		e.rank(candidates, input, &Info{})
+		if candidates[0].Completion != tt.first {
+			t.Errorf("strategy %q ranked %q first, want %q", tt.strategy, candidates[0].Completion, tt.first)
+		}
+		if candidates[0].Confidence != 0.95 {
+			t.Errorf("strategy %q: first confidence = %v, want 0.95", tt.strategy, candidates[0].Confidence)
+		}
+	}
+}
+
+func TestBlendFrequency(t *testing.T) {
+	candidates := []ashlet.Candidate{
+		{Completion: "git commit -m wip", Confidence: 0.95},
+		{Completion: "jj commit -m wip", Confidence: 0.80},
+		{Completion: "hg commit -m wip", Confidence: 0.65},
+	}
+	blendFrequency(candidates, &Info{
+		RecentCommands:   []string{"jj commit -m init", "ls"},
+		RelevantCommands: []string{"jj commit -m docs"},
+	})
+	if candidates[0].Completion != "jj commit -m wip" || candidates[1].Completion != "git commit -m wip" {
+		t.Errorf("frequent command should move up, got %+v", candidates)
+	}
+	if candidates[0].Confidence != 0.95 || candidates[1].Confidence >= candidates[0].Confidence {
+		t.Errorf("confidence should be position-based, got %+v", candidates)
+	}
+}
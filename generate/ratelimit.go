@@ -0,0 +1,72 @@
+package generate
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Paranoid-AF/ashlet/index"
+)
+
+// errRateLimited is returned instead of asking the model once a configured
+// request or token budget is spent.
+var errRateLimited = errors.New("generation rate limit reached")
+
+// rateLimiter enforces generation.max_requests_per_minute over a sliding
+// one-minute window and generation.max_tokens_per_day against the usage
+// recorded today. It is safe for concurrent use.
+type rateLimiter struct {
+	mu    sync.Mutex
+	sent  []time.Time // requests of the last minute, oldest first
+	usage *index.UsageStore
+	now   func() time.Time
+}
+
+func newRateLimiter(usage *index.UsageStore) *rateLimiter {
+	return &rateLimiter{usage: usage, now: time.Now}
+}
+
+// allow reports whether n more model requests fit in the budgets, counting
+// them against the per-minute budget when they do. A limit of 0 or less is
+// no limit.
+func (l *rateLimiter) allow(perMinute, perDay, n int) error {
+	if perDay > 0 {
+		if t := l.usage.Today("generation"); t.Prompt+t.Completion >= perDay {
+			return errRateLimited
+		}
+	}
+	if perMinute <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	cutoff := now.Add(-time.Minute)
+	i := 0
+	for i < len(l.sent) && !l.sent[i].After(cutoff) {
+		i++
+	}
+	l.sent = l.sent[i:]
+	if len(l.sent)+n > perMinute {
+		return errRateLimited
+	}
+	for range n {
+		l.sent = append(l.sent, now)
+	}
+	return nil
+}
+
+// allowGeneration checks the configured rate limits before making calls
+// requests to the model; it returns errRateLimited when one is reached.
+func (e *Engine) allowGeneration(calls int) error {
+	if e.config == nil || e.limiter == nil {
+		return nil
+	}
+	return e.limiter.allow(e.config.Generation.MaxRequestsPerMinute, e.config.Generation.MaxTokensPerDay, calls)
+}
+
+// sampledCalls returns how many requests to the model a completion makes:
+// one per temperature with generation.temperatures set.
+func (e *Engine) sampledCalls() int {
+	return max(len(e.fanOutTemperatures()), 1)
+}
@@ -0,0 +1,107 @@
+package generate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/index"
+)
+
+func TestRateLimiterWindow(t *testing.T) {
+	now := time.Date(2026, 3, 14, 12, 0, 0, 0, time.Local)
+	l := newRateLimiter(nil)
+	l.now = func() time.Time { return now }
+
+	for i := range 2 {
+		if err := l.allow(2, 0, 1); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if err := l.allow(2, 0, 1); err != errRateLimited {
+		t.Errorf("third request in a minute = %v, want errRateLimited", err)
+	}
+	now = now.Add(time.Minute)
+	if err := l.allow(2, 0, 1); err != nil {
+		t.Errorf("request a minute later = %v, want allowed", err)
+	}
+	if err := l.allow(0, 0, 1); err != nil {
+		t.Errorf("no limit = %v, want allowed", err)
+	}
+}
+
+func TestCompleteRateLimited(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<candidate>ls -la</candidate>"}}],"usage":{"prompt_tokens":50,"completion_tokens":10}}`))
+	}))
+	defer srv.Close()
+
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.MaxRequestsPerMinute = 2
+	usage := index.NewUsageStore("")
+	gen := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	gen.usage = usage
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), generator: gen, dirCache: NewDirCache(), config: cfg, usage: usage, limiter: newRateLimiter(usage)}
+	defer e.gatherer.Close()
+
+	req := func() *ashlet.Response {
+		return e.Complete(context.Background(), &ashlet.Request{Input: "ls", CursorPos: 2})
+	}
+	for i := range 2 {
+		if resp := req(); resp.Error != nil {
+			t.Fatalf("request %d: %+v", i, resp.Error)
+		}
+	}
+	resp := req()
+	if resp.Error == nil || resp.Error.Code != "rate_limited" {
+		t.Errorf("third request = %+v, want rate_limited", resp)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("API called %d times, want 2", got)
+	}
+
+	// 120 tokens are used today.
+	cfg.Generation.MaxRequestsPerMinute = 0
+	cfg.Generation.MaxTokensPerDay = 100
+	resp = e.Complete(context.Background(), &ashlet.Request{Mode: "fix", LastCommand: "gti status", ExitCode: 1})
+	if resp.Error == nil || resp.Error.Code != "rate_limited" {
+		t.Errorf("fix over the daily budget = %+v, want rate_limited", resp)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("API called %d times, want 2", got)
+	}
+}
+
+func TestCompleteRateLimitedCountsSamples(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<candidate>ls -la</candidate>"}}]}`))
+	}))
+	defer srv.Close()
+
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.MaxRequestsPerMinute = 4
+	cfg.Generation.Temperatures = []float64{0.2, 0.7, 1.0}
+	gen := NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false)
+	e := &Engine{gatherer: NewGathererForHistory(nil, nil, ""), generator: gen, dirCache: NewDirCache(), config: cfg, limiter: newRateLimiter(nil)}
+	defer e.gatherer.Close()
+
+	if resp := e.Complete(context.Background(), &ashlet.Request{Input: "ls", CursorPos: 2}); resp.Error != nil {
+		t.Fatalf("first completion: %+v", resp.Error)
+	}
+	// One request of the budget is left, not the three a completion makes.
+	resp := e.Complete(context.Background(), &ashlet.Request{Input: "ls -", CursorPos: 4})
+	if resp.Error == nil || resp.Error.Code != "rate_limited" {
+		t.Errorf("second completion = %+v, want rate_limited", resp)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("API called %d times, want 3", got)
+	}
+}
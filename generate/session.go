@@ -0,0 +1,164 @@
+package generate
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+
+	"github.com/Paranoid-AF/ashlet/core"
+)
+
+const (
+	// sessionTTL is how long an idle shell session's trail is kept.
+	sessionTTL = 2 * time.Hour
+	// sessionMaxSessions caps the number of tracked shell sessions.
+	sessionMaxSessions = 256
+	// sessionTrailMax is the number of events kept per session.
+	sessionTrailMax = 6
+)
+
+// sessionEvent is one step in a shell session: an input the user typed,
+// or a completion they ran.
+type sessionEvent struct {
+	text string
+	ran  bool
+}
+
+type sessionTrail struct {
+	mu      sync.Mutex
+	events  []sessionEvent
+	variant string // prompt variant of the last candidates shown
+}
+
+// SessionTracker keeps a short rolling trail of inputs and accepted
+// completions per shell session, so follow-up completions can see what
+// just happened in this shell.
+type SessionTracker struct {
+	cache *ttlcache.Cache[string, *sessionTrail]
+}
+
+// NewSessionTracker creates a SessionTracker with TTL-based expiration.
+func NewSessionTracker() *SessionTracker {
+	c := ttlcache.New[string, *sessionTrail](
+		ttlcache.WithTTL[string, *sessionTrail](sessionTTL),
+		ttlcache.WithCapacity[string, *sessionTrail](sessionMaxSessions),
+	)
+	go c.Start()
+	return &SessionTracker{cache: c}
+}
+
+// Close stops the cache expiration loop.
+func (st *SessionTracker) Close() {
+	if st == nil {
+		return
+	}
+	st.cache.Stop()
+}
+
+// RecordInput adds a typed input to the session's trail. An input that
+// extends the previous typed input replaces it, so a trail holds one entry
+// per command line rather than one per keystroke.
+func (st *SessionTracker) RecordInput(sessionID, input string) {
+	st.record(sessionID, input, false)
+}
+
+// RecordRan adds a completion the user accepted and ran. It replaces the
+// previous typed input when that input led to it.
+func (st *SessionTracker) RecordRan(sessionID, command string) {
+	st.record(sessionID, command, true)
+}
+
+func (st *SessionTracker) record(sessionID, text string, ran bool) {
+	if st == nil || sessionID == "" {
+		return
+	}
+	text = core.RedactCommand(strings.TrimSpace(text))
+	if text == "" {
+		return
+	}
+	item, _ := st.cache.GetOrSet(sessionID, &sessionTrail{})
+	trail := item.Value()
+
+	trail.mu.Lock()
+	defer trail.mu.Unlock()
+
+	if n := len(trail.events); n > 0 {
+		last := trail.events[n-1]
+		if !last.ran && (strings.HasPrefix(text, last.text) || strings.HasPrefix(last.text, text)) {
+			trail.events = trail.events[:n-1]
+		}
+	}
+	trail.events = append(trail.events, sessionEvent{text: text, ran: ran})
+	if len(trail.events) > sessionTrailMax {
+		trail.events = trail.events[len(trail.events)-sessionTrailMax:]
+	}
+}
+
+// RecordVariant remembers the prompt variant whose candidates the session
+// was last shown, so feedback on them can be attributed to it.
+func (st *SessionTracker) RecordVariant(sessionID, variant string) {
+	if st == nil || sessionID == "" {
+		return
+	}
+	item, _ := st.cache.GetOrSet(sessionID, &sessionTrail{})
+	trail := item.Value()
+
+	trail.mu.Lock()
+	trail.variant = variant
+	trail.mu.Unlock()
+}
+
+// Variant returns the prompt variant last recorded for the session, or "".
+func (st *SessionTracker) Variant(sessionID string) string {
+	if st == nil || sessionID == "" {
+		return ""
+	}
+	item := st.cache.Get(sessionID)
+	if item == nil {
+		return ""
+	}
+	trail := item.Value()
+
+	trail.mu.Lock()
+	defer trail.mu.Unlock()
+	return trail.variant
+}
+
+// Trail renders the session's events oldest first, e.g.
+// "ran `cd build`; typed `make t`". Trailing typed inputs that are a prefix
+// of current (the line being completed now) are omitted.
+func (st *SessionTracker) Trail(sessionID, current string) string {
+	if st == nil || sessionID == "" {
+		return ""
+	}
+	item := st.cache.Get(sessionID)
+	if item == nil {
+		return ""
+	}
+	trail := item.Value()
+
+	trail.mu.Lock()
+	events := append([]sessionEvent(nil), trail.events...)
+	trail.mu.Unlock()
+
+	current = strings.TrimSpace(current)
+	for current != "" && len(events) > 0 {
+		last := events[len(events)-1]
+		if last.ran || !(strings.HasPrefix(current, last.text) || strings.HasPrefix(last.text, current)) {
+			break
+		}
+		events = events[:len(events)-1]
+	}
+
+	parts := make([]string, len(events))
+	for i, ev := range events {
+		verb := "typed"
+		if ev.ran {
+			verb = "ran"
+		}
+		parts[i] = verb + " `" + ev.text + "`"
+	}
+	return strings.Join(parts, "; ")
+}
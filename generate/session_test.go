@@ -0,0 +1,64 @@
+package generate
+
+import "testing"
+
+func TestSessionTrailCollapsesKeystrokes(t *testing.T) {
+	st := NewSessionTracker()
+	defer st.Close()
+
+	st.RecordInput("s1", "cd b")
+	st.RecordInput("s1", "cd bui")
+	st.RecordRan("s1", "cd build")
+	st.RecordInput("s1", "ma")
+
+	if got, want := st.Trail("s1", "make"), "ran `cd build`"; got != want {
+		t.Errorf("Trail = %q, want %q", got, want)
+	}
+	if got, want := st.Trail("s1", "ls"), "ran `cd build`; typed `ma`"; got != want {
+		t.Errorf("Trail = %q, want %q", got, want)
+	}
+}
+
+func TestSessionTrailIsolatedPerSession(t *testing.T) {
+	st := NewSessionTracker()
+	defer st.Close()
+
+	st.RecordRan("s1", "cd build")
+	if got := st.Trail("s2", "make"); got != "" {
+		t.Errorf("Trail for other session = %q, want empty", got)
+	}
+	if got := st.Trail("", "make"); got != "" {
+		t.Errorf("Trail without session = %q, want empty", got)
+	}
+}
+
+func TestSessionTrailCapped(t *testing.T) {
+	st := NewSessionTracker()
+	defer st.Close()
+
+	for _, cmd := range []string{"a1", "b2", "c3", "d4", "e5", "f6", "g7", "h8"} {
+		st.RecordRan("s1", cmd)
+	}
+	got := st.Trail("s1", "x")
+	if want := "ran `c3`; ran `d4`; ran `e5`; ran `f6`; ran `g7`; ran `h8`"; got != want {
+		t.Errorf("Trail = %q, want %q", got, want)
+	}
+}
+
+func TestSessionTrailRedacts(t *testing.T) {
+	st := NewSessionTracker()
+	defer st.Close()
+
+	st.RecordRan("s1", "TOKEN=abc deploy")
+	if got, want := st.Trail("s1", "x"), "ran `TOKEN=*** deploy`"; got != want {
+		t.Errorf("Trail = %q, want %q", got, want)
+	}
+}
+
+func TestSessionTrailNil(t *testing.T) {
+	var st *SessionTracker
+	st.RecordInput("s1", "ls")
+	if got := st.Trail("s1", "ls"); got != "" {
+		t.Errorf("nil tracker Trail = %q, want empty", got)
+	}
+}
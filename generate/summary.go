@@ -0,0 +1,165 @@
+package generate
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Paranoid-AF/ashlet/index"
+)
+
+// summaryRefresh is the least time between two summaries of one project:
+// a project whose listing or manifests change is summarised again once it
+// has passed.
+const summaryRefresh = 10 * time.Minute
+
+// summaryMaxBytes caps a project summary, whatever the model returns.
+const summaryMaxBytes = 400
+
+// summaryPrompt is the system prompt of a project summary request.
+const summaryPrompt = `You summarise software projects for a shell command completion engine.
+Given a project's file listing and build manifests, write 2-3 short plain-text lines: what the project is, its languages, package managers, and build tools, and the commands typically run in it (build, test, lint, run), with their exact names from the manifests.
+Reply with the summary only: no Markdown, no preamble.`
+
+// SummaryCache holds model-written project summaries by git root.
+type SummaryCache struct {
+	mu      sync.Mutex
+	entries map[string]*projectSummary
+}
+
+// projectSummary is the summary of one project and what it was made from.
+type projectSummary struct {
+	text    string
+	source  uint64    // hash of the listing and manifests summarised
+	started time.Time // when the latest summary request started
+	running bool
+}
+
+// NewSummaryCache creates an empty SummaryCache.
+func NewSummaryCache() *SummaryCache {
+	return &SummaryCache{entries: make(map[string]*projectSummary)}
+}
+
+// projectSummary returns the summary of the git project cwd is in when
+// generation.project_summary is on, or "" when there is none yet. A summary
+// is requested in the background when the project has none or its listing
+// or manifests (from dirCtx) changed since the last, at most once every
+// summaryRefresh; until it arrives, the last one is used.
+func (e *Engine) projectSummary(cwd string, dirCtx *DirContext) string {
+	if e.summaries == nil || dirCtx == nil || e.generator == nil || e.generator.fim() ||
+		e.config == nil || !e.config.Generation.ProjectSummary {
+		return ""
+	}
+	root, _ := findGitDir(cwd)
+	if root == "" {
+		return ""
+	}
+	source := summarySource(dirCtx)
+	if source == "" {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write([]byte(source))
+	sum := h.Sum64()
+
+	sc := e.summaries
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	entry := sc.entries[root]
+	if entry == nil {
+		entry = &projectSummary{}
+		sc.entries[root] = entry
+	}
+	if entry.source != sum && !entry.running && time.Since(entry.started) >= summaryRefresh {
+		entry.running, entry.started = true, time.Now()
+		go e.summarize(root, source, sum)
+	}
+	return entry.text
+}
+
+// summarize asks the model to summarise a project from source, and stores
+// the result for root.
+func (e *Engine) summarize(root, source string, sum uint64) {
+	text := ""
+	defer func() {
+		e.summaries.mu.Lock()
+		defer e.summaries.mu.Unlock()
+		entry := e.summaries.entries[root]
+		entry.running = false
+		if text != "" {
+			entry.text, entry.source = text, sum
+		}
+	}()
+
+	ctx := context.Background()
+	if timeout := e.generationTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	release, err := e.sched.Acquire(ctx, index.PriorityBackground)
+	if err != nil {
+		return
+	}
+	defer release()
+	if err := e.allowGeneration(1); err != nil {
+		return
+	}
+	output, err := e.generator.GenerateText(ctx, summaryPrompt, source)
+	if err != nil {
+		slog.Debug("project summary failed", "root", root, "error", err)
+		return
+	}
+	text = cleanSummary(output)
+	slog.Debug("project summarized", "root", root, "summary", text)
+}
+
+// summarySource renders the git root's listing and manifests from dirCtx
+// for the model to summarise, or "" when there are none.
+func summarySource(dirCtx *DirContext) string {
+	listing, manifests := dirCtx.GitRootListing, dirCtx.GitManifests
+	if listing == "" {
+		// The current directory is the root.
+		listing, manifests = dirCtx.CwdListing, dirCtx.CwdManifests
+	}
+	if listing == "" && len(manifests) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("files: ")
+	sb.WriteString(listing)
+	sb.WriteString("\n")
+	names := make([]string, 0, len(manifests))
+	for name := range manifests {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteString(": ")
+		sb.WriteString(manifests[name])
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// cleanSummary keeps the first three non-empty lines of a model's summary,
+// without Markdown list markers, up to summaryMaxBytes.
+func cleanSummary(output string) string {
+	var lines []string
+	for line := range strings.SplitSeq(output, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*#"))
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+		if len(lines) == 3 {
+			break
+		}
+	}
+	return truncate(strings.Join(lines, "\n"), summaryMaxBytes)
+}
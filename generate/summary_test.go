@@ -0,0 +1,83 @@
+package generate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/core"
+)
+
+func TestProjectSummary(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"- A Go CLI.\n\n- Built with make.\n- Tested with go test.\n- Extra line."}}]}`))
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, ".git"), 0755)
+	cfg := ashlet.DefaultConfig()
+	cfg.Generation.ProjectSummary = true
+	e := &Engine{
+		generator: NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false),
+		config:    cfg,
+		summaries: NewSummaryCache(),
+	}
+	dirCtx := &DirContext{CwdListing: "Makefile go.mod main.go", CwdManifests: map[string]string{"Makefile": "build test"}}
+
+	if got := e.projectSummary(root, dirCtx); got != "" {
+		t.Errorf("first request should not wait for the summary, got %q", got)
+	}
+	want := "A Go CLI.\nBuilt with make.\nTested with go test."
+	deadline := time.Now().Add(2 * time.Second)
+	for e.projectSummary(root, dirCtx) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("summary = %q, want %q", e.projectSummary(root, dirCtx), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A changed manifest is summarised again only after summaryRefresh.
+	dirCtx.CwdManifests["Makefile"] = "build test lint"
+	e.projectSummary(root, dirCtx)
+	time.Sleep(50 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 summary request, got %d", n)
+	}
+
+	if got := e.projectSummary(t.TempDir(), dirCtx); got != "" {
+		t.Errorf("outside a git repository there should be no summary, got %q", got)
+	}
+}
+
+func TestUserMessageProjectSummary(t *testing.T) {
+	uc := core.UserContext{
+		Cwd: "/repo/sub",
+		Dir: &core.DirContext{
+			CwdManifests:   map[string]string{"sub/package.json": "scripts: dev"},
+			GitRootListing: "Makefile sub",
+			GitManifests:   map[string]string{"Makefile": "build test"},
+		},
+		ProjectSummary: "A Go CLI built with make.",
+		Input:          "make",
+		CursorPos:      4,
+	}
+	msg := core.BuildUserMessage(uc)
+	if !strings.Contains(msg, "A Go CLI built with make.") {
+		t.Errorf("summary missing from %q", msg)
+	}
+	if strings.Contains(msg, "build test") || strings.Contains(msg, "Makefile sub") {
+		t.Errorf("the project's manifests and listing should give way to the summary: %q", msg)
+	}
+	if !strings.Contains(msg, "scripts: dev") {
+		t.Errorf("the current directory's manifests should stay: %q", msg)
+	}
+}
@@ -0,0 +1,52 @@
+package generate
+
+import "hash/fnv"
+
+// Prompt variants of an A/B test: variantA is prompt.md (or the built-in
+// default), variantB is prompt_b.md.
+const (
+	variantA = "a"
+	variantB = "b"
+)
+
+// promptVariant picks the prompt template for a request from the shell
+// session sessionID. It returns "" when no second template is configured.
+// With prompt_split "session" a session always gets the same variant;
+// otherwise requests alternate between the two.
+func (e *Engine) promptVariant(sessionID string) string {
+	e.promptMu.RLock()
+	ab := e.promptB != ""
+	e.promptMu.RUnlock()
+	if !ab {
+		return ""
+	}
+	if e.config.Generation.PromptSplit == "session" && sessionID != "" {
+		h := fnv.New32a()
+		h.Write([]byte(sessionID))
+		if h.Sum32()%2 == 1 {
+			return variantB
+		}
+		return variantA
+	}
+	if e.promptTurn.Add(1)%2 == 0 {
+		return variantB
+	}
+	return variantA
+}
+
+// promptTemplate returns the template text of a prompt variant; empty
+// means the built-in default.
+func (e *Engine) promptTemplate(variant string) string {
+	e.promptMu.RLock()
+	defer e.promptMu.RUnlock()
+	if variant == variantB {
+		return e.promptB
+	}
+	return e.customPrompt
+}
+
+// PromptVariantStats returns how each prompt variant's suggestions have
+// fared, keyed by variant.
+func (e *Engine) PromptVariantStats() map[string]VariantStats {
+	return e.feedback.VariantStats()
+}
@@ -0,0 +1,86 @@
+package generate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestPromptVariantDisabledWithoutSecondPrompt(t *testing.T) {
+	e := testEngine()
+	if v := e.promptVariant("s1"); v != "" {
+		t.Errorf("promptVariant = %q, want empty without prompt_b.md", v)
+	}
+}
+
+func TestPromptVariantSessionSplit(t *testing.T) {
+	e := testEngine()
+	e.promptB = "B"
+	e.config.Generation.PromptSplit = "session"
+
+	seen := map[string]bool{}
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		v := e.promptVariant(id)
+		if again := e.promptVariant(id); again != v {
+			t.Errorf("session %s got %q then %q, want a stable variant", id, v, again)
+		}
+		seen[v] = true
+	}
+	if !seen[variantA] || !seen[variantB] {
+		t.Errorf("sessions should be split across both variants, got %v", seen)
+	}
+}
+
+func TestCompleteAlternatesPromptVariants(t *testing.T) {
+	var prompts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatCompletionsRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		prompts = append(prompts, req.Messages[0].Content)
+		json.NewEncoder(w).Encode(chatCompletionsResponse{
+			Choices: []chatChoice{{Message: chatMessage{Role: "assistant", Content: `<candidate type="replace"><command>git status</command></candidate>`}}},
+		})
+	}))
+	defer srv.Close()
+
+	e := &Engine{
+		gatherer:     NewGatherer(nil, nil),
+		generator:    NewGenerator(srv.URL, "test-key", "test-model", "chat_completions", 120, 0.3, nil, false, false),
+		dirCache:     NewDirCache(),
+		feedback:     NewFeedbackStore(""),
+		sessions:     NewSessionTracker(),
+		config:       ashlet.DefaultConfig(),
+		customPrompt: "prompt A",
+		promptB:      "prompt B",
+	}
+	defer e.Close()
+
+	req := func() *ashlet.Request {
+		return &ashlet.Request{Input: "git st", CursorPos: 6, SessionID: "s1"}
+	}
+	first := e.Complete(context.Background(), req())
+	second := e.Complete(context.Background(), req())
+	if first.PromptVariant != variantA || second.PromptVariant != variantB {
+		t.Fatalf("variants = %q, %q; want a, b", first.PromptVariant, second.PromptVariant)
+	}
+	if len(prompts) != 2 || prompts[0] != "prompt A" || prompts[1] != "prompt B" {
+		t.Errorf("system prompts = %q, want each variant's template", prompts)
+	}
+
+	e.RecordFeedback(&ashlet.FeedbackRequest{Type: "feedback", Event: "accepted", Candidate: "git status", SessionID: "s1"})
+
+	stats := e.PromptVariantStats()
+	if got := stats[variantA]; got != (VariantStats{Shown: 1}) {
+		t.Errorf("variant a stats = %+v", got)
+	}
+	if got := stats[variantB]; got != (VariantStats{Shown: 1, Accepted: 1}) {
+		t.Errorf("variant b stats = %+v, want the acceptance attributed to b", got)
+	}
+	if rate := stats[variantB].AcceptanceRate(); rate != 1 {
+		t.Errorf("variant b acceptance rate = %v, want 1", rate)
+	}
+}
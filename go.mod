@@ -5,17 +5,27 @@ go 1.25.7
 require (
 	github.com/BurntSushi/toml v1.6.0
 	github.com/coder/hnsw v0.6.1
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/jellydator/ttlcache/v3 v3.4.0
+	golang.org/x/sys v0.41.0
 	golang.org/x/term v0.40.0
+	modernc.org/sqlite v1.39.1
 	mvdan.cc/sh/v3 v3.12.0
 )
 
 require (
 	github.com/chewxy/math32 v1.10.1 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/google/renameio v1.0.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/viterin/partial v1.1.0 // indirect
 	github.com/viterin/vek v0.4.2 // indirect
-	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
-	golang.org/x/sync v0.15.0 // indirect
-	golang.org/x/sys v0.41.0 // indirect
+	golang.org/x/exp v0.0.0-20250620022241-b7579e27df2b // indirect
+	golang.org/x/sync v0.16.0 // indirect
+	modernc.org/libc v1.66.10 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.11.0 // indirect
 )
@@ -0,0 +1,99 @@
+package index
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// atuinHistory reads the history database of Atuin (https://atuin.sh),
+// which records the directory, exit status, duration, and session of every
+// command.
+type atuinHistory struct {
+	path string
+	dsn  string
+}
+
+// NewAtuinHistory returns a source reading the Atuin database at path. The
+// database is opened read-only for each read, so Atuin can keep writing to
+// it.
+func NewAtuinHistory(path string) HistorySource {
+	u := url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro&_pragma=busy_timeout(1000)"}
+	return atuinHistory{path: path, dsn: u.String()}
+}
+
+// ResolveAtuinPath returns where Atuin keeps its database for home by
+// default. An empty home means the current user, in which case
+// $ATUIN_DB_PATH and $XDG_DATA_HOME are also considered.
+func ResolveAtuinPath(home string) string {
+	if home == "" {
+		if path := os.Getenv("ATUIN_DB_PATH"); path != "" {
+			return path
+		}
+		if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+			return filepath.Join(dataHome, "atuin", "history.db")
+		}
+		home, _ = os.UserHomeDir()
+	}
+	return filepath.Join(home, ".local", "share", "atuin", "history.db")
+}
+
+func (h atuinHistory) Last(n int) []HistoryEntry {
+	entries := h.query(`SELECT command, timestamp, cwd, exit, duration, session FROM history
+		WHERE deleted_at IS NULL AND command != '' ORDER BY timestamp DESC LIMIT ?`, n)
+	slices.Reverse(entries)
+	return entries
+}
+
+// since returns the entries recorded after the Unix nanosecond timestamp
+// after, oldest first.
+func (h atuinHistory) since(after int64) []HistoryEntry {
+	return h.query(`SELECT command, timestamp, cwd, exit, duration, session FROM history
+		WHERE deleted_at IS NULL AND command != '' AND timestamp > ? ORDER BY timestamp`, after)
+}
+
+// query reads the entries selected by query, which selects the command,
+// timestamp, cwd, exit, duration, and session columns. Errors read as no
+// entries.
+func (h atuinHistory) query(query string, args ...any) []HistoryEntry {
+	db, err := sql.Open("sqlite", h.dsn)
+	if err != nil {
+		slog.Debug("failed to open atuin history", "error", err)
+		return nil
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		slog.Debug("failed to read atuin history", "error", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var entries []HistoryEntry
+	for rows.Next() {
+		var entry HistoryEntry
+		var start, duration int64
+		if err := rows.Scan(&entry.Command, &start, &entry.Cwd, &entry.ExitCode, &duration, &entry.Session); err != nil {
+			slog.Debug("failed to read atuin history", "error", err)
+			return nil
+		}
+		entry.Command = strings.TrimSpace(entry.Command)
+		entry.Time = time.Unix(0, start)
+		// Atuin records nanoseconds, and -1 while a command is running.
+		entry.Duration = time.Duration(max(duration, 0))
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Debug("failed to read atuin history", "error", err)
+		return nil
+	}
+	return entries
+}
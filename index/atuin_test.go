@@ -0,0 +1,79 @@
+package index
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeAtuinDB creates an Atuin history database at path holding rows of
+// (command, cwd, exit), one second apart, the last deleted.
+func writeAtuinDB(t *testing.T, path string, rows [][3]any) {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE history (
+		id text PRIMARY KEY, timestamp integer NOT NULL, duration integer NOT NULL,
+		exit integer NOT NULL, command text NOT NULL, cwd text NOT NULL,
+		session text NOT NULL, hostname text NOT NULL, deleted_at integer)`); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i, row := range rows {
+		var deleted any
+		if i == len(rows)-1 {
+			deleted = start.UnixNano()
+		}
+		if _, err := db.Exec(`INSERT INTO history VALUES (?, ?, ?, ?, ?, ?, 's1', 'laptop:me', ?)`,
+			i, start.Add(time.Duration(i)*time.Second).UnixNano(), int64(2*time.Second),
+			row[2], row[0], row[1], deleted); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAtuinHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	writeAtuinDB(t, path, [][3]any{
+		{"make build", "/repo", 0},
+		{"go test ./...", "/repo", 1},
+		{"ls", "/tmp", 0},
+		{"make test", "/repo", 0},
+		{"make build", "/repo", 0},
+		{"git push --force", "/repo", 0}, // deleted
+	})
+
+	entries := NewAtuinHistory(path).Last(3)
+	var cmds []string
+	for _, e := range entries {
+		cmds = append(cmds, e.Command)
+	}
+	if want := []string{"ls", "make test", "make build"}; !slices.Equal(cmds, want) {
+		t.Fatalf("Last(3) = %q, want %q (oldest first, deleted left out)", cmds, want)
+	}
+	if e := entries[0]; e.Cwd != "/tmp" || e.ExitCode != 0 || e.Duration != 2*time.Second || e.Session != "s1" || e.Time.IsZero() {
+		t.Errorf("entry = %+v, want its cwd, exit, duration, session, and time", e)
+	}
+
+	idx := NewIndexerForSource(nil, 100, time.Hour, NewAtuinHistory(path))
+	if got := idx.RecentCommands(2); !slices.Equal(got, []string{"make build", "make test"}) {
+		t.Errorf("RecentCommands = %q", got)
+	}
+	if got := idx.RecentIn("/repo", 5); !slices.Equal(got, []string{"make build", "make test"}) {
+		t.Errorf("RecentIn = %q, want distinct successful commands, most recent first", got)
+	}
+	if dirs := idx.readTailCommands().dirs[hashCommand("make build")]; !slices.Equal(dirs, []string{"/repo"}) {
+		t.Errorf("dirs of make build = %q, want [/repo]", dirs)
+	}
+}
+
+func TestAtuinHistoryMissingDB(t *testing.T) {
+	if entries := NewAtuinHistory(filepath.Join(t.TempDir(), "none.db")).Last(5); len(entries) != 0 {
+		t.Errorf("a missing database should read as empty, got %+v", entries)
+	}
+}
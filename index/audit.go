@@ -0,0 +1,56 @@
+package index
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// auditMaxEntries caps the requests an audit log keeps; older ones are
+// dropped when the file is compacted.
+const auditMaxEntries = 1000
+
+// AuditLog records every text sent to the generation and embedding APIs,
+// after redaction, as JSON lines in a local file, so users can check what
+// leaves their machine. It is safe for concurrent use; a nil log records
+// nothing.
+type AuditLog struct {
+	now func() time.Time
+
+	mu  sync.Mutex
+	log *CappedLog[ashlet.AuditEntry]
+}
+
+// NewAuditLog opens the audit log at path, loading the entries recorded
+// before. An empty path keeps it in memory only.
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{
+		now: time.Now,
+		log: OpenCappedLog[ashlet.AuditEntry]("audit log", path, auditMaxEntries, nil),
+	}
+}
+
+// Record logs the texts of one request to an API of kind ("generation" or
+// "embedding") for model.
+func (l *AuditLog) Record(kind, model string, texts ...string) {
+	if l == nil {
+		return
+	}
+	entry := ashlet.AuditEntry{Time: l.now(), Kind: kind, Model: model, Texts: slices.Clone(texts)}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.log.Append(entry)
+}
+
+// Last returns the last n entries, oldest first.
+func (l *AuditLog) Last(n int) []ashlet.AuditEntry {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.log.Last(n))
+}
@@ -0,0 +1,82 @@
+package index
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "audit.jsonl")
+	l := NewAuditLog(path)
+	l.Record("generation", "m", "system", "input: git ")
+	l.Record("embedding", "e", "git status", "git push")
+
+	// A restart reads the entries back.
+	got := NewAuditLog(path).Last(10)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 audit entries, got %+v", got)
+	}
+	if e := got[0]; e.Kind != "generation" || e.Model != "m" || !slices.Equal(e.Texts, []string{"system", "input: git "}) || e.Time.IsZero() {
+		t.Errorf("audit entry = %+v", e)
+	}
+	if last := NewAuditLog(path).Last(1); len(last) != 1 || last[0].Kind != "embedding" {
+		t.Errorf("Last(1) = %+v", last)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("audit log mode = %v, want 0600", perm)
+	}
+
+	var nilLog *AuditLog
+	nilLog.Record("generation", "m", "x")
+	if nilLog.Last(5) != nil {
+		t.Error("a nil audit log should record nothing")
+	}
+}
+
+func TestAuditLogCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l := NewAuditLog(path)
+	l.log.max = 10
+	for i := range 12 {
+		l.Record("embedding", "e", "echo "+string(rune('a'+i)))
+	}
+	var texts []string
+	for _, e := range NewAuditLog(path).Last(3) {
+		texts = append(texts, e.Texts...)
+	}
+	if !slices.Equal(texts, []string{"echo j", "echo k", "echo l"}) {
+		t.Errorf("last audit texts = %q", texts)
+	}
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 10 {
+		t.Errorf("compacted file has %d lines, want 10", n)
+	}
+}
+
+func TestEmbedderAudit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(embeddingResponse{Data: []embeddingDataItem{{Embedding: []float32{1}}, {Embedding: []float32{1}}}})
+	}))
+	defer srv.Close()
+
+	l := NewAuditLog("")
+	e := NewEmbedder(srv.URL, "", "e")
+	e.SetAudit(l)
+	if _, err := e.EmbedBatch([]string{"git status", "git push"}); err != nil {
+		t.Fatal(err)
+	}
+	got := l.Last(5)
+	if len(got) != 1 || got[0].Kind != "embedding" || !slices.Equal(got[0].Texts, []string{"git status", "git push"}) {
+		t.Errorf("audit = %+v, want the batch sent", got)
+	}
+}
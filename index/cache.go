@@ -1,92 +1,398 @@
 package index
 
 import (
-	"encoding/json"
+	"cmp"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/coder/hnsw"
 )
 
-type cacheFile struct {
-	Model   string       `json:"model"`
-	Entries []cacheEntry `json:"entries"`
+// cacheLoadBatch is how many cached embeddings are added to the graph per
+// write lock while the cache loads, so searches are not held up meanwhile.
+const cacheLoadBatch = 256
+
+// cacheSchema is the version of the cache's tables. A cache written with
+// another version is emptied.
+const cacheSchema = "1"
+
+// indexCache keeps embedded commands in a SQLite database, so a restart
+// does not embed history again. Rows are written as commands are embedded
+// and read back one at a time, so the cache never has to fit in a single
+// marshal.
+type indexCache struct {
+	db   *sql.DB
+	dims int // length of the cached vectors; 0 until the first are written
 }
 
-type cacheEntry struct {
-	Hash      string    `json:"hash"`
-	Command   string    `json:"command"`
-	Embedding []float32 `json:"embedding"`
+// openIndexCache opens the cache at path, creating it if needed, for
+// vectors embedded by model at provider. A cache written with another
+// schema, model, or provider is emptied, as its vectors cannot be compared
+// with the model's; rebuilt then says which differed.
+func openIndexCache(path, model, provider string) (c *indexCache, rebuilt string, err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, "", err
+	}
+	u := url.URL{Scheme: "file", Path: path, RawQuery: "_pragma=busy_timeout(1000)"}
+	db, err := sql.Open("sqlite", u.String())
+	if err != nil {
+		return nil, "", err
+	}
+	// One connection: SQLite serializes writers anyway.
+	db.SetMaxOpenConns(1)
+	c = &indexCache{db: db}
+	if rebuilt, err = c.init(map[string]string{"schema": cacheSchema, "model": model, "provider": provider}); err != nil {
+		db.Close()
+		return nil, "", fmt.Errorf("open embedding cache: %w", err)
+	}
+	return c, rebuilt, nil
 }
 
-// EmbeddingModel returns the model name used by the embedder, or empty if disabled.
-func (idx *Indexer) EmbeddingModel() string {
-	if idx.embedder == nil {
-		return ""
+// init creates the tables and checks the cache was written with want, the
+// meta values the vectors depend on, emptying it otherwise. It returns the
+// first key whose value differed, or "" for a matching or new cache.
+func (c *indexCache) init(want map[string]string) (string, error) {
+	if _, err := c.db.Exec(`CREATE TABLE IF NOT EXISTS meta (key TEXT PRIMARY KEY, value TEXT NOT NULL);
+		CREATE TABLE IF NOT EXISTS commands (
+			hash TEXT PRIMARY KEY, command TEXT NOT NULL, embedding BLOB NOT NULL)`); err != nil {
+		return "", err
 	}
-	return idx.embedder.Model()
+	meta, err := c.meta()
+	if err != nil {
+		return "", err
+	}
+	var rebuilt string
+	for _, key := range []string{"schema", "model", "provider"} {
+		if meta[key] != want[key] {
+			rebuilt = key
+			break
+		}
+	}
+	if rebuilt == "" {
+		c.dims, _ = strconv.Atoi(meta["dimensions"])
+		return "", nil
+	}
+	if len(meta) == 0 {
+		rebuilt = "" // a new cache, nothing to rebuild
+	}
+	return rebuilt, c.reset(want)
 }
 
-// SaveCache writes the current index (commands + embeddings) to disk.
-func (idx *Indexer) SaveCache(path string, model string) error {
-	idx.mu.RLock()
-	defer idx.mu.RUnlock()
+// meta returns the cache's meta values by key.
+func (c *indexCache) meta() (map[string]string, error) {
+	rows, err := c.db.Query(`SELECT key, value FROM meta`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	meta := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		meta[key] = value
+	}
+	return meta, rows.Err()
+}
 
-	entries := make([]cacheEntry, 0, len(idx.commands))
-	for hash, cmd := range idx.commands {
-		vec, ok := idx.graph.Lookup(hash)
-		if !ok {
-			continue
+// reset empties the cache, recording meta as what its vectors depend on.
+// The dimensions are recorded again with the next vectors written.
+func (c *indexCache) reset(meta map[string]string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM commands`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM meta`); err != nil {
+		return err
+	}
+	for key, value := range meta {
+		if _, err := tx.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)`, key, value); err != nil {
+			return err
 		}
-		entries = append(entries, cacheEntry{
-			Hash:      hash,
-			Command:   cmd,
-			Embedding: vec,
-		})
 	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.dims = 0
+	return nil
+}
 
-	data, err := json.Marshal(cacheFile{
-		Model:   model,
-		Entries: entries,
-	})
+// clear empties the cache, keeping what it was written with but the
+// dimensions.
+func (c *indexCache) clear() error {
+	meta, err := c.meta()
 	if err != nil {
 		return err
 	}
+	delete(meta, "dimensions")
+	return c.reset(meta)
+}
 
-	return os.WriteFile(path, data, 0644)
+// load calls add for each cached command. Vectors of other dimensions
+// than those recorded are skipped.
+func (c *indexCache) load(add func(hash, cmd string, vec []float32)) error {
+	rows, err := c.db.Query(`SELECT hash, command, embedding FROM commands`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash, cmd string
+		var blob []byte
+		if err := rows.Scan(&hash, &cmd, &blob); err != nil {
+			return err
+		}
+		if c.dims != 0 && len(blob) != 4*c.dims {
+			continue
+		}
+		add(hash, cmd, decodeVector(blob))
+	}
+	return rows.Err()
 }
 
-// LoadCache loads a previously saved index from disk.
-// If the model doesn't match, the cache is silently skipped.
-func (idx *Indexer) LoadCache(path string, model string) error {
-	data, err := os.ReadFile(path)
+// put stores nodes, with the command text of each in commands. The first
+// vectors written record the cache's dimensions; nodes of other dimensions
+// are an error.
+func (c *indexCache) put(nodes []hnsw.Node[string], commands map[string]string) error {
+	if len(nodes) == 0 {
+		return nil
+	}
+	dims := len(nodes[0].Value)
+	for _, n := range nodes {
+		if len(n.Value) != dims || c.dims != 0 && dims != c.dims {
+			return fmt.Errorf("embedding has %d dimensions, cache has %d", len(n.Value), cmp.Or(c.dims, dims))
+		}
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if c.dims == 0 {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES ('dimensions', ?)`, strconv.Itoa(dims)); err != nil {
+			return err
+		}
+	}
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO commands (hash, command, embedding) VALUES (?, ?, ?)`)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
+	for _, n := range nodes {
+		if _, err := stmt.Exec(n.Key, commands[n.Key], encodeVector(n.Value)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.dims = dims
+	return nil
+}
 
-	var cf cacheFile
-	if err := json.Unmarshal(data, &cf); err != nil {
+// remove deletes the commands hashed hashes.
+func (c *indexCache) remove(hashes []string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`DELETE FROM commands WHERE hash = ?`)
+	if err != nil {
 		return err
 	}
+	defer stmt.Close()
+	for _, hash := range hashes {
+		if _, err := stmt.Exec(hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
 
-	if cf.Model != model {
-		return nil
+func (c *indexCache) close() error {
+	return c.db.Close()
+}
+
+// encodeVector packs vec as little-endian float32s.
+func encodeVector(vec []float32) []byte {
+	buf := make([]byte, 4*len(vec))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return buf
+}
+
+func decodeVector(buf []byte) []float32 {
+	vec := make([]float32, len(buf)/4)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return vec
+}
+
+// EmbeddingModel returns the model name used by the embedder, or empty if disabled.
+func (idx *Indexer) EmbeddingModel() string {
+	if idx.embedder == nil {
+		return ""
 	}
+	return idx.embedder.Model()
+}
 
+// OpenCache keeps the index in the SQLite database at path: the commands
+// cached there are added to the index, and commands embedded from then on
+// are written to it as they are added. Without an embedder it does
+// nothing.
+func (idx *Indexer) OpenCache(path string) error {
+	if idx.embedder == nil {
+		return nil
+	}
+	c, rebuilt, err := openIndexCache(path, idx.embedder.Model(), idx.embedder.BaseURL())
+	if err != nil {
+		return err
+	}
+	if rebuilt != "" {
+		idx.noteCacheRebuilt(rebuilt)
+	}
 	idx.mu.Lock()
-	defer idx.mu.Unlock()
+	if idx.cache != nil {
+		idx.cache.close()
+	}
+	idx.cache = c
+	idx.mu.Unlock()
+
+	cached := make(map[string]bool)
+	var excluded []string // embedded before an exclude pattern matched them
+	var batch []hnsw.Node[string]
+	var texts []string
+	flush := func() {
+		idx.mu.Lock()
+		for i, n := range batch {
+			if _, exists := idx.graph.Lookup(n.Key); !exists {
+				idx.graph.Add(n)
+				idx.commands[n.Key] = texts[i]
+			}
+		}
+		idx.mu.Unlock()
+		batch, texts = batch[:0], texts[:0]
+	}
+	err = c.load(func(hash, cmd string, vec []float32) {
+		if idx.excluded(cmd) {
+			excluded = append(excluded, hash)
+			return
+		}
+		cached[hash] = true
+		batch = append(batch, hnsw.MakeNode(hash, vec))
+		texts = append(texts, cmd)
+		if len(batch) == cacheLoadBatch {
+			flush()
+		}
+	})
+	flush()
+	if err != nil {
+		return fmt.Errorf("load embedding cache: %w", err)
+	}
 
-	nodes := make([]hnsw.Node[string], 0, len(cf.Entries))
-	for _, e := range cf.Entries {
-		nodes = append(nodes, hnsw.MakeNode(e.Hash, e.Embedding))
-		idx.commands[e.Hash] = e.Command
+	// Write what was embedded before the cache was opened.
+	idx.mu.RLock()
+	var missing []hnsw.Node[string]
+	commands := make(map[string]string)
+	for hash, cmd := range idx.commands {
+		if cached[hash] {
+			continue
+		}
+		if vec, ok := idx.graph.Lookup(hash); ok {
+			missing = append(missing, hnsw.MakeNode(hash, vec))
+			commands[hash] = cmd
+		}
+	}
+	idx.mu.RUnlock()
+	if len(missing) > 0 {
+		if err := c.put(missing, commands); err != nil {
+			return fmt.Errorf("write embedding cache: %w", err)
+		}
 	}
 
-	if len(nodes) > 0 {
-		idx.graph.Add(nodes...)
+	// A cache written with a larger maximum size may not fit.
+	idx.mu.Lock()
+	evicted := idx.evictLocked()
+	idx.mu.Unlock()
+	idx.uncacheNodes(append(evicted, excluded...))
+
+	if len(cached) > 0 {
 		// Mark init as done so searches can use cached data immediately,
 		// without waiting for the refresh loop's first IndexHistory() call.
 		idx.initOnce.Do(func() { close(idx.initDone) })
 	}
-
 	return nil
 }
+
+// cacheNodes writes newly indexed nodes to the cache, if one is open.
+func (idx *Indexer) cacheNodes(nodes []hnsw.Node[string], commands map[string]string) {
+	idx.mu.RLock()
+	c := idx.cache
+	idx.mu.RUnlock()
+	if c == nil {
+		return
+	}
+	if err := c.put(nodes, commands); err != nil {
+		slog.Warn("failed to write embedding cache", "error", err)
+	}
+}
+
+// clearCache empties the cache, if one is open, after the index was
+// rebuilt for the given reason.
+func (idx *Indexer) clearCache(reason string) {
+	idx.mu.RLock()
+	c := idx.cache
+	idx.mu.RUnlock()
+	if c == nil {
+		return
+	}
+	if err := c.clear(); err != nil {
+		slog.Warn("failed to write embedding cache", "error", err)
+		return
+	}
+	idx.noteCacheRebuilt(reason)
+}
+
+// noteCacheRebuilt logs and counts a cache emptied because its vectors no
+// longer match the embedder's, reason naming what differed.
+func (idx *Indexer) noteCacheRebuilt(reason string) {
+	idx.cacheRebuilds.Add(1)
+	slog.Warn("embedding cache rebuilt", "event", "cache_rebuilt", "reason", reason)
+}
+
+// CacheRebuilds returns how many times the embedding cache was emptied
+// because the embedding schema, model, provider, or dimensions changed.
+func (idx *Indexer) CacheRebuilds() int64 {
+	return idx.cacheRebuilds.Load()
+}
+
+// uncacheNodes deletes evicted commands from the cache, if one is open.
+func (idx *Indexer) uncacheNodes(hashes []string) {
+	if len(hashes) == 0 {
+		return
+	}
+	idx.mu.RLock()
+	c := idx.cache
+	idx.mu.RUnlock()
+	if c == nil {
+		return
+	}
+	if err := c.remove(hashes); err != nil {
+		slog.Warn("failed to write embedding cache", "error", err)
+	}
+}
@@ -0,0 +1,206 @@
+package index
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOpenCache(t *testing.T) {
+	var calls atomic.Int32
+	srv := newEmbeddingServer(t, &calls)
+	path := filepath.Join(t.TempDir(), "embeddings.db")
+
+	idx := NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, "")
+	// Commands embedded before the cache opens are written to it too.
+	if err := idx.IndexCommands([]string{"make build"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.IndexCommands([]string{"kubectl get pods"}); err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	// A restart reads the embeddings back instead of embedding again.
+	idx = NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, "")
+	defer idx.Close()
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-idx.InitDone():
+	default:
+		t.Error("InitDone should be closed once cached embeddings are loaded")
+	}
+	if err := idx.IndexCommands([]string{"make build", "kubectl get pods"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected 2 embedding requests, got %d", n)
+	}
+	var cmds []string
+	for _, cmd := range idx.commands {
+		cmds = append(cmds, cmd)
+	}
+	slices.Sort(cmds)
+	if !slices.Equal(cmds, []string{"kubectl get pods", "make build"}) {
+		t.Errorf("cached commands = %q", cmds)
+	}
+	if vec, ok := idx.graph.Lookup(hashCommand("make build")); !ok || !slices.Equal(vec, []float32{1, 0, 0}) {
+		t.Errorf("cached embedding = %v, %v", vec, ok)
+	}
+}
+
+func TestOpenCacheOtherModel(t *testing.T) {
+	var calls atomic.Int32
+	srv := newEmbeddingServer(t, &calls)
+	path := filepath.Join(t.TempDir(), "embeddings.db")
+
+	idx := NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "model-a"), 100, time.Hour, "")
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.IndexCommands([]string{"make build"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := idx.CacheRebuilds(); n != 0 {
+		t.Errorf("a new cache is not a rebuild, got %d", n)
+	}
+	idx.Close()
+
+	idx = NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "model-b"), 100, time.Hour, "")
+	defer idx.Close()
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := idx.graph.Len(); n != 0 {
+		t.Errorf("embeddings of another model should be dropped, got %d", n)
+	}
+	if n := idx.CacheRebuilds(); n != 1 {
+		t.Errorf("expected 1 cache rebuild, got %d", n)
+	}
+}
+
+func TestOpenCacheOtherProvider(t *testing.T) {
+	var calls atomic.Int32
+	path := filepath.Join(t.TempDir(), "embeddings.db")
+
+	idx := NewIndexerForHistory(NewEmbedder(newEmbeddingServer(t, &calls).URL, "test-key", "test-model"), 100, time.Hour, "")
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.IndexCommands([]string{"make build"}); err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	// The same model name served elsewhere may be another model.
+	idx = NewIndexerForHistory(NewEmbedder(newEmbeddingServer(t, &calls).URL, "test-key", "test-model"), 100, time.Hour, "")
+	defer idx.Close()
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := idx.graph.Len(); n != 0 {
+		t.Errorf("embeddings from another provider should be dropped, got %d", n)
+	}
+	if n := idx.CacheRebuilds(); n != 1 {
+		t.Errorf("expected 1 cache rebuild, got %d", n)
+	}
+}
+
+func TestOpenCacheOtherSchema(t *testing.T) {
+	var calls atomic.Int32
+	srv := newEmbeddingServer(t, &calls)
+	path := filepath.Join(t.TempDir(), "embeddings.db")
+
+	idx := NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, "")
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.IndexCommands([]string{"make build"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.cache.db.Exec(`UPDATE meta SET value = '0' WHERE key = 'schema'`); err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	idx = NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, "")
+	defer idx.Close()
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := idx.graph.Len(); n != 0 {
+		t.Errorf("a cache of another schema should be dropped, got %d", n)
+	}
+}
+
+func TestIndexCommandsDimensionsChanged(t *testing.T) {
+	var dims atomic.Int32
+	dims.Store(3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		vec := make([]float32, dims.Load())
+		vec[0] = 1
+		var resp embeddingResponse
+		for range req.Input {
+			resp.Data = append(resp.Data, embeddingDataItem{Embedding: vec})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	path := filepath.Join(t.TempDir(), "embeddings.db")
+
+	idx := NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, "")
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.IndexCommands([]string{"make build"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The model now returns longer vectors: the old ones are dropped
+	// rather than mixed in.
+	dims.Store(4)
+	if err := idx.IndexCommands([]string{"kubectl get pods"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := idx.graph.Len(); n != 1 || idx.graph.Dims() != 4 {
+		t.Errorf("expected 1 command of 4 dimensions, got %d of %d", n, idx.graph.Dims())
+	}
+	if n := idx.CacheRebuilds(); n != 1 {
+		t.Errorf("expected 1 cache rebuild, got %d", n)
+	}
+	idx.Close()
+
+	idx = NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, "")
+	defer idx.Close()
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.graph.Lookup(hashCommand("kubectl get pods")); !ok || idx.graph.Len() != 1 {
+		t.Errorf("the cache should hold only the new vectors, got %d", idx.graph.Len())
+	}
+}
+
+func TestOpenCacheNilEmbedder(t *testing.T) {
+	idx := NewIndexerForHistory(nil, 100, time.Hour, "")
+	path := filepath.Join(t.TempDir(), "embeddings.db")
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if idx.cache != nil {
+		t.Error("no cache should be opened without an embedder")
+	}
+}
@@ -0,0 +1,119 @@
+package index
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// CappedLog is a file of JSON lines that keeps at most max entries, oldest
+// first. Entries are appended to the file as they are added; once it holds
+// 10% more than max it is rewritten with the newest max, so the file is not
+// rewritten on every append. It is not safe for concurrent use: callers
+// guard it with their own lock.
+type CappedLog[T any] struct {
+	// Entries are the entries kept, oldest first.
+	Entries []T
+
+	name string // what the log holds, for warnings
+	path string // empty = in-memory only
+	max  int
+}
+
+// OpenCappedLog opens the log of name at path, keeping at most max
+// entries, and loads the entries written before for which valid (when not
+// nil) returns true. An empty path keeps the log in memory only.
+func OpenCappedLog[T any](name, path string, max int, valid func(T) bool) *CappedLog[T] {
+	l := &CappedLog[T]{name: name, path: path, max: max}
+	if path == "" {
+		return l
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("failed to read "+name, "path", path, "error", err)
+		}
+		return l
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var entry T
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || (valid != nil && !valid(entry)) {
+			continue // skip a torn or malformed line
+		}
+		l.Entries = append(l.Entries, entry)
+	}
+	if len(l.Entries) > l.max {
+		l.compact()
+	}
+	return l
+}
+
+// Append adds entries to the log.
+func (l *CappedLog[T]) Append(entries ...T) {
+	l.Entries = append(l.Entries, entries...)
+	if len(l.Entries) > l.max+l.max/10 {
+		l.compact()
+		return
+	}
+	if l.path == "" {
+		return
+	}
+	if err := writeJSONLines(l.path, entries, os.O_APPEND); err != nil {
+		slog.Warn("failed to append to "+l.name, "path", l.path, "error", err)
+	}
+}
+
+// Last returns the last n entries, oldest first. The slice is the log's
+// own; callers that keep it past their lock must copy it.
+func (l *CappedLog[T]) Last(n int) []T {
+	n = min(max(n, 0), len(l.Entries))
+	return l.Entries[len(l.Entries)-n:]
+}
+
+// compact keeps the newest max entries and atomically rewrites the file
+// (temp file + rename).
+func (l *CappedLog[T]) compact() {
+	if len(l.Entries) > l.max {
+		l.Entries = slices.Clone(l.Entries[len(l.Entries)-l.max:])
+	}
+	if l.path == "" {
+		return
+	}
+	tmp := l.path + ".tmp"
+	err := writeJSONLines(tmp, l.Entries, os.O_TRUNC)
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		slog.Warn("failed to compact "+l.name, "path", l.path, "error", err)
+	}
+}
+
+// writeJSONLines writes entries as JSON lines to path, opened with flag.
+func writeJSONLines[T any](path string, entries []T, flag int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, flag|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	return w.Flush()
+}
@@ -0,0 +1,27 @@
+package index
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCappedLogLast(t *testing.T) {
+	l := OpenCappedLog[int]("test log", "", 10, nil)
+	l.Append(1, 2, 3)
+	for _, tt := range []struct {
+		n    int
+		want []int
+	}{
+		{2, []int{2, 3}},
+		{5, []int{1, 2, 3}},
+		{0, []int{}},
+		{-1, []int{}},
+	} {
+		if got := l.Last(tt.n); !slices.Equal(got, tt.want) {
+			t.Errorf("Last(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+	if got := NewReportedHistory("").Last(-1); len(got) != 0 {
+		t.Errorf("reported Last(-1) = %v, want none", got)
+	}
+}
@@ -15,6 +15,9 @@ type Embedder struct {
 	apiKey  string
 	model   string
 	client  *http.Client
+	health  *HealthTracker
+	usage   *UsageStore
+	audit   *AuditLog
 }
 
 // NewEmbedder creates an embedder for the given API endpoint.
@@ -30,13 +33,42 @@ func NewEmbedder(baseURL, apiKey, model string) *Embedder {
 // Model returns the embedding model name.
 func (e *Embedder) Model() string { return e.model }
 
+// BaseURL returns the embedding API base URL.
+func (e *Embedder) BaseURL() string { return e.baseURL }
+
+// Provider identifies the endpoint and model for health tracking.
+func (e *Embedder) Provider() string { return e.baseURL + " " + e.model }
+
+// SetHealth makes the embedder record its requests in h and stop calling
+// the API while h's circuit for it is open.
+func (e *Embedder) SetHealth(h *HealthTracker) { e.health = h }
+
+// SetUsage makes the embedder add the token usage of its requests to u.
+func (e *Embedder) SetUsage(u *UsageStore) { e.usage = u }
+
+// SetAudit makes the embedder record the texts it sends in l.
+func (e *Embedder) SetAudit(l *AuditLog) { e.audit = l }
+
 type embeddingRequest struct {
 	Input interface{} `json:"input"` // string or []string
 	Model string      `json:"model"`
 }
 
 type embeddingResponse struct {
-	Data []embeddingDataItem `json:"data"`
+	Data  []embeddingDataItem `json:"data"`
+	Usage *embeddingUsage     `json:"usage,omitempty"`
+}
+
+type embeddingUsage struct {
+	PromptTokens int     `json:"prompt_tokens"`
+	Cost         float64 `json:"cost"` // OpenRouter
+}
+
+// recordUsage adds the usage a response reports, if any.
+func (e *Embedder) recordUsage(result *embeddingResponse) {
+	if result.Usage != nil {
+		e.usage.Record("embedding", e.model, Tokens{Prompt: result.Usage.PromptTokens, Cost: result.Usage.Cost})
+	}
 }
 
 type embeddingDataItem struct {
@@ -45,6 +77,17 @@ type embeddingDataItem struct {
 
 // Embed generates an embedding vector for the given text.
 func (e *Embedder) Embed(text string) ([]float32, error) {
+	if err := e.health.Allow(e.Provider()); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	vector, err := e.embed(text)
+	e.health.Record(e.Provider(), time.Since(start), err)
+	return vector, err
+}
+
+func (e *Embedder) embed(text string) ([]float32, error) {
+	e.audit.Record("embedding", e.model, text)
 	reqBody := embeddingRequest{Input: text, Model: e.model}
 	data, err := json.Marshal(reqBody)
 	if err != nil {
@@ -79,6 +122,7 @@ func (e *Embedder) Embed(text string) ([]float32, error) {
 	if err := json.Unmarshal(body, &result); err != nil {
 		return nil, fmt.Errorf("failed to parse embedding response: %w (body: %s)", err, string(body))
 	}
+	e.recordUsage(&result)
 
 	if len(result.Data) == 0 {
 		return nil, fmt.Errorf("empty embedding response")
@@ -91,7 +135,17 @@ func (e *Embedder) EmbedBatch(texts []string) ([][]float32, error) {
 	if len(texts) == 0 {
 		return nil, nil
 	}
+	if err := e.health.Allow(e.Provider()); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	vectors, err := e.embedBatch(texts)
+	e.health.Record(e.Provider(), time.Since(start), err)
+	return vectors, err
+}
 
+func (e *Embedder) embedBatch(texts []string) ([][]float32, error) {
+	e.audit.Record("embedding", e.model, texts...)
 	reqBody := embeddingRequest{Input: texts, Model: e.model}
 	data, err := json.Marshal(reqBody)
 	if err != nil {
@@ -126,6 +180,7 @@ func (e *Embedder) EmbedBatch(texts []string) ([][]float32, error) {
 	if err := json.Unmarshal(body, &result); err != nil {
 		return nil, fmt.Errorf("failed to parse batch embedding response: %w (body: %s)", err, string(body))
 	}
+	e.recordUsage(&result)
 
 	vectors := make([][]float32, len(result.Data))
 	for i, item := range result.Data {
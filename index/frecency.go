@@ -0,0 +1,99 @@
+package index
+
+import (
+	"math"
+	"slices"
+)
+
+// frecency scores commands by how often and how recently they ran: each
+// run adds its weight to the command's score, and every score halves
+// over frecencyHalfLife further commands. Scores decay lazily, so adding a
+// run is O(1) however many commands are tracked.
+type frecency struct {
+	seq    int // commands added so far
+	scores map[string]frecencyScore
+}
+
+// frecencyScore is a command's score as of the seq-th command.
+type frecencyScore struct {
+	score float64
+	seq   int
+}
+
+func newFrecency() *frecency {
+	return &frecency{scores: make(map[string]frecencyScore)}
+}
+
+// add records a run of the command keyed key, weighted by weight. Every
+// call counts as one command for the decay, whatever its weight.
+func (f *frecency) add(key string, weight float64) {
+	f.seq++
+	f.scores[key] = frecencyScore{score: f.score(key) + weight, seq: f.seq}
+}
+
+// skip counts a command that is not scored towards the decay.
+func (f *frecency) skip() {
+	f.seq++
+}
+
+// score returns the current score of key, 0 for commands never added.
+func (f *frecency) score(key string) float64 {
+	s, ok := f.scores[key]
+	if !ok {
+		return 0
+	}
+	return s.score * math.Exp2(-float64(f.seq-s.seq)/frecencyHalfLife)
+}
+
+// ranked returns up to n of the keys added, the highest score first and
+// the latest run first among equal ones.
+func (f *frecency) ranked(n int) []string {
+	keys := make([]string, 0, len(f.scores))
+	for key := range f.scores {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if sa, sb := f.score(a), f.score(b); sa != sb {
+			if sa > sb {
+				return -1
+			}
+			return 1
+		}
+		return f.scores[b].seq - f.scores[a].seq
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// runWeight returns how much a run counts towards frecency under the
+// watermark policy, and false when a marked run is left out.
+func (idx *Indexer) runWeight(marked bool) (float64, bool) {
+	if !marked {
+		return 1, true
+	}
+	switch idx.watermark {
+	case WatermarkExclude:
+		return 0, false
+	case WatermarkKeep:
+		return 1, true
+	}
+	return 0.5, true
+}
+
+// entryFrecency scores the commands of entries that keep accepts, keyed by
+// command.
+func (idx *Indexer) entryFrecency(entries []HistoryEntry, keep func(cmd string) bool) *frecency {
+	f := newFrecency()
+	for _, entry := range entries {
+		cmd, marked := stripWatermark(entry.Command)
+		weight, ok := idx.runWeight(marked)
+		if cmd == "" || !ok || !keep(cmd) {
+			f.skip()
+			continue
+		}
+		f.add(cmd, weight)
+	}
+	return f
+}
@@ -0,0 +1,199 @@
+package index
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+const (
+	// healthWindow is how many recent requests per provider the error
+	// rate and average latency are computed over.
+	healthWindow = 20
+	// breakerFailures is how many consecutive failures open a provider's
+	// circuit, so requests fail fast instead of waiting on a dead API.
+	breakerFailures = 5
+	// breakerCooldown is how long an open circuit rejects requests before
+	// one is let through to probe whether the provider has recovered.
+	breakerCooldown = 30 * time.Second
+)
+
+// Circuit breaker states, as reported in ashlet.ProviderHealth.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// ErrCircuitOpen is returned instead of calling a provider whose circuit
+// is open.
+var ErrCircuitOpen = errors.New("provider unavailable after repeated failures; retrying shortly")
+
+// HealthTracker records the outcome of each API request per provider and
+// runs a circuit breaker for each: after breakerFailures consecutive
+// failures a provider is not called for breakerCooldown, then a single
+// probe request decides whether it is called again. It is safe for
+// concurrent use and may be shared between engines; a nil tracker allows
+// every request and records nothing.
+type HealthTracker struct {
+	mu        sync.Mutex
+	providers map[string]*providerHealth
+	now       func() time.Time
+}
+
+type healthOutcome struct {
+	ok      bool
+	elapsed time.Duration
+}
+
+// providerHealth is a ring of a provider's most recent outcomes and its
+// circuit state.
+type providerHealth struct {
+	outcomes    []healthOutcome
+	next        int
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+	consecutive int       // failures since the last success
+	total       int64     // requests since the tracker was created
+	failed      int64     // failed requests since the tracker was created
+	openedAt    time.Time // zero while the circuit is closed
+	probing     bool      // a half-open probe is in flight
+}
+
+// NewHealthTracker creates an empty health tracker.
+func NewHealthTracker() *HealthTracker {
+	return &HealthTracker{providers: make(map[string]*providerHealth), now: time.Now}
+}
+
+func (t *HealthTracker) providerLocked(provider string) *providerHealth {
+	p := t.providers[provider]
+	if p == nil {
+		p = &providerHealth{}
+		t.providers[provider] = p
+	}
+	return p
+}
+
+// Allow reports whether a request may be sent to provider: nil, or
+// ErrCircuitOpen while its circuit is open. Once the cooldown has passed
+// it allows one probe; every allowed request must be followed by Record
+// or Abandon.
+func (t *HealthTracker) Allow(provider string) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.providerLocked(provider)
+	if p.openedAt.IsZero() {
+		return nil
+	}
+	if p.probing || t.now().Sub(p.openedAt) < breakerCooldown {
+		return ErrCircuitOpen
+	}
+	p.probing = true
+	return nil
+}
+
+// Record notes the outcome of a request to provider that took elapsed;
+// err is nil on success.
+func (t *HealthTracker) Record(provider string, elapsed time.Duration, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.providerLocked(provider)
+	o := healthOutcome{ok: err == nil, elapsed: elapsed}
+	if len(p.outcomes) < healthWindow {
+		p.outcomes = append(p.outcomes, o)
+	} else {
+		p.outcomes[p.next] = o
+	}
+	p.next = (p.next + 1) % healthWindow
+	p.total++
+	if err != nil {
+		p.failed++
+	}
+
+	now := t.now()
+	if err == nil {
+		p.lastSuccess = now
+		p.consecutive = 0
+		p.openedAt = time.Time{}
+		p.probing = false
+		return
+	}
+	p.lastFailure = now
+	p.lastError = err.Error()
+	p.consecutive++
+	if p.probing || p.consecutive >= breakerFailures {
+		p.openedAt = now
+		p.probing = false
+	}
+}
+
+// Abandon notes that an allowed request to provider was cancelled by the
+// caller, which says nothing about the provider's health.
+func (t *HealthTracker) Abandon(provider string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.providerLocked(provider).probing = false
+}
+
+// Health summarises provider's recent requests. Only the fields the
+// tracker knows are set; the caller fills in what the provider is.
+func (t *HealthTracker) Health(provider string) ashlet.ProviderHealth {
+	h := ashlet.ProviderHealth{Circuit: CircuitClosed}
+	if t == nil {
+		return h
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.providers[provider]
+	if p == nil {
+		return h
+	}
+
+	var failures, successes int
+	var total time.Duration
+	for _, o := range p.outcomes {
+		if o.ok {
+			successes++
+			total += o.elapsed
+		} else {
+			failures++
+		}
+	}
+	h.Requests = len(p.outcomes)
+	h.TotalRequests, h.TotalErrors = p.total, p.failed
+	if h.Requests > 0 {
+		h.ErrorRate = float64(failures) / float64(h.Requests)
+	}
+	if successes > 0 {
+		h.AvgLatencyMs = (total / time.Duration(successes)).Milliseconds()
+	}
+	if !p.lastSuccess.IsZero() {
+		last := p.lastSuccess
+		h.LastSuccess = &last
+	}
+	if !p.lastFailure.IsZero() {
+		last := p.lastFailure
+		h.LastFailure = &last
+		h.LastError = p.lastError
+	}
+	switch {
+	case p.openedAt.IsZero():
+	case p.probing || t.now().Sub(p.openedAt) >= breakerCooldown:
+		h.Circuit = CircuitHalfOpen
+	default:
+		h.Circuit = CircuitOpen
+	}
+	return h
+}
@@ -0,0 +1,98 @@
+package index
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthTrackerStats(t *testing.T) {
+	h := NewHealthTracker()
+	h.Record("p", 100*time.Millisecond, nil)
+	h.Record("p", 300*time.Millisecond, nil)
+	h.Record("p", time.Second, errors.New("API error (status 502)"))
+	h.Record("p", 200*time.Millisecond, nil)
+
+	got := h.Health("p")
+	if got.Requests != 4 || got.ErrorRate != 0.25 || got.AvgLatencyMs != 200 {
+		t.Errorf("health = %+v, want 4 requests, 0.25 error rate, 200ms", got)
+	}
+	if got.LastSuccess == nil || got.LastFailure == nil || got.LastError != "API error (status 502)" {
+		t.Errorf("health = %+v, want last success and failure", got)
+	}
+	if got.Circuit != CircuitClosed {
+		t.Errorf("circuit = %q after one failure, want closed", got.Circuit)
+	}
+
+	// The totals keep counting past the window the rates are over.
+	for range healthWindow {
+		h.Record("p", 100*time.Millisecond, nil)
+	}
+	if got := h.Health("p"); got.Requests != healthWindow || got.TotalRequests != 4+healthWindow || got.TotalErrors != 1 {
+		t.Errorf("health = %+v, want %d recent, %d total requests, 1 error", got, healthWindow, 4+healthWindow)
+	}
+
+	if other := h.Health("unused"); other.Requests != 0 || other.LastSuccess != nil || other.Circuit != CircuitClosed {
+		t.Errorf("unused provider health = %+v, want empty and closed", other)
+	}
+	var nilTracker *HealthTracker
+	if err := nilTracker.Allow("p"); err != nil {
+		t.Errorf("nil tracker should allow every request, got %v", err)
+	}
+	nilTracker.Record("p", 0, nil)
+}
+
+func TestHealthTrackerCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	h := NewHealthTracker()
+	h.now = func() time.Time { return now }
+	fail := errors.New("connection refused")
+
+	for i := range breakerFailures {
+		if err := h.Allow("p"); err != nil {
+			t.Fatalf("request %d rejected before the circuit opened: %v", i, err)
+		}
+		h.Record("p", time.Millisecond, fail)
+	}
+	if err := h.Allow("p"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow after %d failures = %v, want ErrCircuitOpen", breakerFailures, err)
+	}
+	if c := h.Health("p").Circuit; c != CircuitOpen {
+		t.Errorf("circuit = %q, want open", c)
+	}
+
+	// After the cooldown, exactly one probe is let through.
+	now = now.Add(breakerCooldown)
+	if c := h.Health("p").Circuit; c != CircuitHalfOpen {
+		t.Errorf("circuit = %q after cooldown, want half_open", c)
+	}
+	if err := h.Allow("p"); err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	if err := h.Allow("p"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second request during a probe = %v, want ErrCircuitOpen", err)
+	}
+
+	// An abandoned probe frees the slot; a failed one reopens the circuit.
+	h.Abandon("p")
+	if err := h.Allow("p"); err != nil {
+		t.Fatalf("probe after an abandoned one rejected: %v", err)
+	}
+	h.Record("p", time.Millisecond, fail)
+	if err := h.Allow("p"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Allow after a failed probe = %v, want ErrCircuitOpen", err)
+	}
+
+	// A successful probe closes it.
+	now = now.Add(breakerCooldown)
+	if err := h.Allow("p"); err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	h.Record("p", time.Millisecond, nil)
+	if err := h.Allow("p"); err != nil {
+		t.Errorf("Allow after a successful probe = %v, want nil", err)
+	}
+	if c := h.Health("p").Circuit; c != CircuitClosed {
+		t.Errorf("circuit = %q, want closed", c)
+	}
+}
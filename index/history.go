@@ -0,0 +1,222 @@
+package index
+
+import (
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistoryEntry is one command from shell history, with what its source
+// recorded about it.
+type HistoryEntry struct {
+	Command string
+	// Time is when the command started. History files without
+	// timestamps (plain bash history) have it estimated: see
+	// fileHistory.Last.
+	Time time.Time
+	// Cwd is the directory the command ran in; empty when unknown.
+	Cwd string
+	// ExitCode is the command's exit status, or -1 when unknown.
+	ExitCode int
+	// Duration is how long the command ran; 0 when unknown.
+	Duration time.Duration
+	// Session identifies the shell session that ran the command; empty
+	// when unknown.
+	Session string
+}
+
+// HistorySource reads shell history.
+type HistorySource interface {
+	// Last returns the last n entries with a command, oldest first.
+	Last(n int) []HistoryEntry
+}
+
+// fileHistory reads a zsh or bash history file.
+type fileHistory struct {
+	path string
+	open func(string) (*os.File, error) // nil = os.Open
+}
+
+// openWith opens path with open, or with os.Open when open is nil.
+func openWith(open func(string) (*os.File, error), path string) (*os.File, error) {
+	if open == nil {
+		return os.Open(path)
+	}
+	return open(path)
+}
+
+// NewFileHistory returns a source reading the history file at path, or nil
+// when path is empty.
+func NewFileHistory(path string) HistorySource {
+	if path == "" {
+		return nil
+	}
+	return fileHistory{path: path}
+}
+
+// Last reads the last n entries of the file. Bash's timestamp comments
+// ("#1700000000", written with HISTTIMEFORMAT set) date the command that
+// follows them. Entries without a timestamp take that of the entry before
+// them, or after them at the start of the file; a file with no timestamps
+// at all is dated by its modification time, as bash writes history when a
+// shell exits.
+func (h fileHistory) Last(n int) []HistoryEntry {
+	// Read extra lines for the timestamp comments.
+	var lines []string
+	if f, err := openWith(h.open, h.path); err == nil {
+		lines = readLastLines(f, 2*n)
+		f.Close()
+	}
+	entries := parseHistoryLines(lines)
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	datePlainEntries(entries, h.path)
+	return entries
+}
+
+// parseHistoryLines parses the lines of a history file into the entries
+// with a command, dating those that follow a bash timestamp comment.
+func parseHistoryLines(lines []string) []HistoryEntry {
+	entries := make([]HistoryEntry, 0, len(lines))
+	var stamp time.Time
+	for _, line := range lines {
+		if t, ok := bashTimestamp(line); ok {
+			stamp = t
+			continue
+		}
+		entry := parseHistoryEntry(line)
+		if entry.Command == "" {
+			continue
+		}
+		if entry.Time.IsZero() {
+			entry.Time, stamp = stamp, time.Time{}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// bashTimestamp parses a bash history timestamp comment.
+func bashTimestamp(line string) (time.Time, bool) {
+	digits, ok := strings.CutPrefix(strings.TrimSpace(line), "#")
+	if !ok || digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// datePlainEntries fills in the times of entries read without one (see
+// fileHistory.Last).
+func datePlainEntries(entries []HistoryEntry, path string) {
+	var last time.Time
+	for i := range entries {
+		if entries[i].Time.IsZero() {
+			entries[i].Time = last
+		} else {
+			last = entries[i].Time
+		}
+	}
+	if last.IsZero() {
+		if info, err := os.Stat(path); err == nil {
+			last = info.ModTime()
+		}
+		for i := range entries {
+			entries[i].Time = last
+		}
+		return
+	}
+	// Leading entries, before the first timestamp.
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Time.IsZero() {
+			entries[i].Time = entries[i+1].Time
+		}
+	}
+}
+
+// mergedHistory interleaves the entries of several sources by time.
+type mergedHistory []HistorySource
+
+// NewHistoryFiles returns a source reading the history files at paths,
+// their entries interleaved by time, so history from bash and zsh reads as
+// one. It is nil without paths.
+func NewHistoryFiles(paths []string) HistorySource {
+	return NewHistoryFilesOpenedWith(paths, nil)
+}
+
+// NewHistoryFilesOpenedWith is NewHistoryFiles opening the files with
+// open, such as ashlet.Paths.Open for a daemon reading another user's
+// history. A nil open means os.Open.
+func NewHistoryFilesOpenedWith(paths []string, open func(string) (*os.File, error)) HistorySource {
+	switch len(paths) {
+	case 0:
+		return nil
+	case 1:
+		return fileHistory{path: paths[0], open: open}
+	}
+	m := make(mergedHistory, len(paths))
+	for i, path := range paths {
+		m[i] = fileHistory{path: path, open: open}
+	}
+	return m
+}
+
+func (m mergedHistory) Last(n int) []HistoryEntry {
+	var entries []HistoryEntry
+	for _, src := range m {
+		entries = append(entries, src.Last(n)...)
+	}
+	// Stable, so the order of entries sharing a time stays that of their
+	// source.
+	slices.SortStableFunc(entries, func(a, b HistoryEntry) int { return a.Time.Compare(b.Time) })
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries
+}
+
+// parseHistoryEntry parses a history file line. Zsh extended history lines
+// (": <timestamp>:<duration>;<command>") carry the start time and
+// duration; other lines are just the command.
+func parseHistoryEntry(line string) HistoryEntry {
+	entry := HistoryEntry{Command: parseHistoryLine(line), ExitCode: -1}
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), ": ")
+	if !ok {
+		return entry
+	}
+	meta, _, _ := strings.Cut(rest, ";")
+	start, elapsed, _ := strings.Cut(meta, ":")
+	if sec, err := strconv.ParseInt(start, 10, 64); err == nil {
+		entry.Time = time.Unix(sec, 0)
+	}
+	if sec, err := strconv.ParseInt(elapsed, 10, 64); err == nil {
+		entry.Duration = time.Duration(sec) * time.Second
+	}
+	return entry
+}
+
+// lastEntries returns the last n entries of the indexer's history, oldest
+// first, or nil without history. Private commands (see spacePrefixed) and
+// those matching an exclude pattern are left out.
+func (idx *Indexer) lastEntries(n int) []HistoryEntry {
+	var entries []HistoryEntry
+	if idx.history != nil {
+		entries = idx.history.Last(n)
+	} else if idx.historyPath != "" {
+		entries = fileHistory{path: idx.historyPath}.Last(n)
+	}
+	return slices.DeleteFunc(entries, func(e HistoryEntry) bool {
+		return spacePrefixed(e.Command) || idx.excluded(e.Command)
+	})
+}
+
+// hasHistory reports whether the indexer reads any history.
+func (idx *Indexer) hasHistory() bool {
+	return idx.history != nil || idx.historyPath != ""
+}
@@ -0,0 +1,114 @@
+package index
+
+import (
+	"regexp"
+	"strings"
+)
+
+// HistoryIgnorePatterns translates the shells' history ignore settings into
+// exclude patterns (see Indexer.SetExcludePatterns): bash's HISTIGNORE, a
+// colon-separated list of glob patterns, and zsh's HISTORY_IGNORE, a single
+// pattern that may alternate as in "(ls|cd|pwd)". Either may be empty. As
+// in the shells, each pattern must match the whole command. Bash's "&",
+// which ignores a repeat of the previous command, is not about privacy and
+// is skipped.
+func HistoryIgnorePatterns(histignore, historyIgnore string) []string {
+	var patterns []string
+	for _, glob := range splitHistignore(histignore) {
+		if glob == "" || glob == "&" {
+			continue
+		}
+		patterns = append(patterns, globRegexp(glob, false))
+	}
+	if historyIgnore != "" {
+		patterns = append(patterns, globRegexp(historyIgnore, true))
+	}
+	return patterns
+}
+
+// splitHistignore splits s at the colons not escaped with a backslash.
+func splitHistignore(s string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case ':':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// globRegexp returns a regular expression matching what the shell glob
+// matches as a whole: * and ? match any text and character, [...] a class
+// ([!...] or [^...] negated), and a backslash quotes the next character.
+// With alternation, (a|b) groups alternatives, as zsh patterns do.
+func globRegexp(glob string, alternation bool) string {
+	var b strings.Builder
+	b.WriteString(`^(?s:`)
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '*':
+			b.WriteString(`.*`)
+		case c == '?':
+			b.WriteString(`.`)
+		case c == '[':
+			class, end := globClass(glob, i)
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString(class)
+			i = end
+		case alternation && c == '(':
+			b.WriteString(`(?:`)
+		case alternation && (c == ')' || c == '|'):
+			b.WriteByte(c)
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString(`)$`)
+	return b.String()
+}
+
+// globClass translates the bracket expression opening at glob[start] and
+// returns it with the index of its closing bracket, or -1 when it is not
+// closed and the bracket is literal.
+func globClass(glob string, start int) (string, int) {
+	i := start + 1
+	negated := i < len(glob) && (glob[i] == '!' || glob[i] == '^')
+	if negated {
+		i++
+	}
+	first := i
+	if i < len(glob) && glob[i] == ']' {
+		i++ // a leading ] is a member
+	}
+	for i < len(glob) && glob[i] != ']' {
+		i++
+	}
+	if i >= len(glob) {
+		return "", -1
+	}
+	var b strings.Builder
+	b.WriteByte('[')
+	if negated {
+		b.WriteByte('^')
+	}
+	for _, c := range []byte(glob[first:i]) {
+		if c == '\\' || c == '[' || c == ']' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(']')
+	return b.String(), i
+}
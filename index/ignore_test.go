@@ -0,0 +1,45 @@
+package index
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestHistoryIgnorePatterns(t *testing.T) {
+	tests := []struct {
+		histignore, historyIgnore string
+		cmd                       string
+		want                      bool
+	}{
+		{"ls:cd *", "", "ls", true},
+		{"ls:cd *", "", "ls -la", false},
+		{"ls:cd *", "", "cd /tmp", true},
+		{"&:[bf]g:exit", "", "fg", true},
+		{"&:[bf]g:exit", "", "&", false},
+		{"*vault*", "", "vault kv get secret/db", true},
+		{"*vault*", "", "echo \"a\nvault\"", true},
+		{`echo a\:b`, "", "echo a:b", true},
+		{"rm [!a]*", "", "rm b.txt", true},
+		{"rm [!a]*", "", "rm a.txt", false},
+		{"ls?", "", "ls1", true},
+		{"a(b|c)", "", "ab", false},
+		{"a(b|c)", "", "a(b|c)", true},
+		{"", "(ls|cd|pwd|exit)", "pwd", true},
+		{"", "(ls|cd|pwd|exit)", "pwd -P", false},
+		{"", "op run *", "op run -- ./deploy", true},
+		{"", "[", "[", true},
+	}
+	for _, tt := range tests {
+		matched := false
+		for _, pattern := range HistoryIgnorePatterns(tt.histignore, tt.historyIgnore) {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				t.Fatalf("HistoryIgnorePatterns(%q, %q) gave invalid %q: %v", tt.histignore, tt.historyIgnore, pattern, err)
+			}
+			matched = matched || re.MatchString(tt.cmd)
+		}
+		if matched != tt.want {
+			t.Errorf("HistoryIgnorePatterns(%q, %q) matching %q = %v, want %v", tt.histignore, tt.historyIgnore, tt.cmd, matched, tt.want)
+		}
+	}
+}
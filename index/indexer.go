@@ -2,31 +2,116 @@ package index
 
 import (
 	"bufio"
+	"cmp"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/hnsw"
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/Paranoid-AF/ashlet/core"
 )
 
 const indexBatchSize = 32
 
-// Indexer reads and indexes shell history files using in-memory TTL cache.
+// dirBoost is how much nearer, in cosine distance, a related command that
+// ran in or under the current directory counts: commands from unrelated
+// projects are less useful context.
+const dirBoost = 0.1
+
+// maxCommandDirs is how many of the latest directories a command ran in
+// are kept for dirBoost.
+const maxCommandDirs = 8
+
+// relevanceTie is the difference in cosine distance below which related
+// commands count as equally relevant and are ordered by frecency.
+const relevanceTie = 0.01
+
+const (
+	// frecencyWindow is how many history lines RecentCommands and
+	// PrefixMatches rank.
+	frecencyWindow = 2000
+	// frecencyHalfLife is how many commands ago a use counts half as much
+	// as the latest one.
+	frecencyHalfLife = 200
+)
+
+// Watermark is the comment the shell client appends to suggestions the user
+// accepted verbatim (with ASHLET_WATERMARK=1), marking them in history as
+// generated rather than typed.
+const Watermark = "#ashlet"
+
+// Eviction policies decide which commands leave an index at its maximum
+// size first.
+const (
+	// EvictLeastFrecent evicts the commands run least often and lately
+	// first. It is the default.
+	EvictLeastFrecent = "least_frecent"
+	// EvictOldest evicts the commands that last ran longest ago first.
+	EvictOldest = "oldest"
+)
+
+// Watermark policies decide how marked history commands are used as
+// context, so the model is not steered by its own earlier suggestions.
+const (
+	// WatermarkDownweight keeps marked commands in recent history but ranks
+	// them below typed commands in semantic search. It is the default.
+	WatermarkDownweight = "downweight"
+	// WatermarkExclude leaves marked commands out of history context.
+	WatermarkExclude = "exclude"
+	// WatermarkKeep treats marked commands like typed ones.
+	WatermarkKeep = "keep"
+)
+
+// Indexer reads shell history and indexes its commands by embedding in an
+// in-memory HNSW graph, which SearchRelevant searches approximately rather
+// than scanning every command.
 type Indexer struct {
-	historyPath        string // single most-recently-modified history file
+	historyPath        string        // a single history file
+	history            HistorySource // read instead of historyPath when set
 	embedder           *Embedder
 	maxHistoryCommands int
 	ttl                time.Duration
+	sched              *Scheduler       // nil runs indexing unthrottled
+	watermark          string           // policy for watermarked commands; empty means WatermarkDownweight
+	dedupe             float32          // similarity above which a relevant command duplicates an excluded one
+	maxSize            int              // commands kept in the index; 0 is unbounded
+	eviction           string           // which commands leave a full index first; empty means EvictLeastFrecent
+	ageHalfLife        time.Duration    // see SetAgeHalfLife; 0 turns age decay off
+	parallelism        int              // embedding requests in flight at once; 0 means 1
+	exclude            []*regexp.Regexp // see SetExcludePatterns
+	anonymizer         *core.Anonymizer // see SetAnonymizer
 
 	mu       sync.RWMutex
-	graph    *hnsw.Graph[string] // HNSW graph, keyed by command hash
-	commands map[string]string   // hash -> redacted command text
+	graph    *hnsw.Graph[string]  // HNSW graph, keyed by command hash
+	commands map[string]string    // hash -> redacted command text
+	marked   map[string]bool      // hashes of commands only ever run as accepted suggestions
+	runs     *frecency            // frecency of history commands by hash, to order equally relevant ones
+	dirs     map[string][]string  // hash -> latest directories the command ran in, where recorded
+	lastRun  map[string]time.Time // hash -> when the command last ran, where known
+	// embedding holds the hashes of commands being embedded, so a command
+	// reported again meanwhile is not embedded twice.
+	embedding map[string]bool
+	// evicted holds the hashes of history commands evicted from a full
+	// index, so re-reading the history does not embed them again only to
+	// evict them; running one again readmits it.
+	evicted map[string]bool
+	cache   *indexCache // nil until OpenCache
+
+	cacheRebuilds atomic.Int64 // see CacheRebuilds
 
 	stopCh    chan struct{}
 	initDone  chan struct{}
@@ -34,135 +119,324 @@ type Indexer struct {
 	closeOnce sync.Once
 }
 
-// NewIndexer creates a new history indexer.
-// If embedder is nil, semantic features are disabled (RecentCommands still works).
+// NewIndexer creates a new history indexer for the current user's history
+// files, merged (see NewHistoryFiles). If embedder is nil, semantic
+// features are disabled (RecentCommands still works).
 func NewIndexer(embedder *Embedder, maxHistoryCommands int, ttl time.Duration) *Indexer {
+	return NewIndexerForSource(embedder, maxHistoryCommands, ttl, NewHistoryFiles(ResolveHistoryPaths("")))
+}
+
+// NewIndexerForHistory creates a history indexer reading historyPath.
+// An empty historyPath disables history context.
+func NewIndexerForHistory(embedder *Embedder, maxHistoryCommands int, ttl time.Duration, historyPath string) *Indexer {
 	return &Indexer{
-		historyPath:        resolveHistoryPath(),
+		historyPath:        historyPath,
 		embedder:           embedder,
 		maxHistoryCommands: maxHistoryCommands,
 		ttl:                ttl,
 		graph:              hnsw.NewGraph[string](),
 		commands:           make(map[string]string),
+		embedding:          make(map[string]bool),
+		evicted:            make(map[string]bool),
+		lastRun:            make(map[string]time.Time),
 		stopCh:             make(chan struct{}),
 		initDone:           make(chan struct{}),
 	}
 }
 
-// resolveHistoryPath picks the single most recently modified history file.
-func resolveHistoryPath() string {
-	home, _ := os.UserHomeDir()
-	candidates := []string{
+// NewIndexerForSource creates a history indexer reading history from src.
+// A nil src disables history context.
+func NewIndexerForSource(embedder *Embedder, maxHistoryCommands int, ttl time.Duration, src HistorySource) *Indexer {
+	idx := NewIndexerForHistory(embedder, maxHistoryCommands, ttl, "")
+	idx.history = src
+	return idx
+}
+
+// ResolveHistoryPaths returns the history files under home that exist:
+// ~/.zsh_history and ~/.bash_history. An empty home means the current
+// user, in which case $HISTFILE is also considered.
+func ResolveHistoryPaths(home string) []string {
+	var candidates []string
+	if home == "" {
+		home, _ = os.UserHomeDir()
+		if hf := os.Getenv("HISTFILE"); hf != "" {
+			candidates = append(candidates, filepath.Clean(hf))
+		}
+	}
+	candidates = append(candidates,
 		filepath.Join(home, ".zsh_history"),
 		filepath.Join(home, ".bash_history"),
-	}
+	)
 
-	if hf := os.Getenv("HISTFILE"); hf != "" {
-		candidates = append([]string{hf}, candidates...)
+	var paths []string
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
 	}
+	return paths
+}
 
-	var bestPath string
-	var bestTime time.Time
+// RecentCommands returns the n most frecent distinct commands of recent
+// history, the highest first, so commands run again and again come before
+// one-offs run just as recently. Marked commands follow the watermark
+// policy: dropped, or counted half.
+func (idx *Indexer) RecentCommands(n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	entries := idx.lastEntries(frecencyWindow)
+	return idx.entryFrecency(entries, func(string) bool { return true }).ranked(n)
+}
 
-	for _, path := range candidates {
-		info, err := os.Stat(path)
-		if err != nil {
+// RecentIn returns up to n distinct commands that last ran in cwd and
+// succeeded, the most recent first. It is empty for sources that do not
+// record directories and exit statuses (history files). Marked commands
+// follow the watermark policy's exclusion.
+func (idx *Indexer) RecentIn(cwd string, n int) []string {
+	if cwd == "" || n <= 0 {
+		return nil
+	}
+	entries := idx.lastEntries(frecencyWindow)
+	var cmds []string
+	for i := len(entries) - 1; i >= 0 && len(cmds) < n; i-- {
+		entry := entries[i]
+		if entry.Cwd != cwd || entry.ExitCode != 0 {
 			continue
 		}
-		if info.ModTime().After(bestTime) {
-			bestTime = info.ModTime()
-			bestPath = path
+		cmd, marked := stripWatermark(entry.Command)
+		if marked && idx.watermark == WatermarkExclude || slices.Contains(cmds, cmd) {
+			continue
 		}
+		cmds = append(cmds, cmd)
 	}
+	return cmds
+}
 
-	return bestPath
+// SetScheduler makes indexing yield to interactive work scheduled on s.
+// It must be called before StartRefreshLoop.
+func (idx *Indexer) SetScheduler(s *Scheduler) {
+	idx.sched = s
 }
 
-// RecentCommands returns the last n commands from the history file.
-func (idx *Indexer) RecentCommands(n int) []string {
-	if idx.historyPath == "" {
-		return nil
-	}
-	lines := readLastLines(idx.historyPath, n)
-	// Parse history format
-	cmds := make([]string, 0, len(lines))
-	for _, line := range lines {
-		cmd := parseHistoryLine(line)
-		if cmd != "" {
-			cmds = append(cmds, cmd)
+// SetParallelism sets how many batches indexing embeds at once; n below 1
+// embeds one at a time. With a scheduler, its background slots bound this
+// too. It must be called before StartRefreshLoop.
+func (idx *Indexer) SetParallelism(n int) {
+	idx.parallelism = n
+}
+
+// SetExcludePatterns sets regular expressions for history commands that
+// are never embedded nor returned, whether read from history or reported.
+// Invalid patterns are skipped. It must be called before StartRefreshLoop.
+func (idx *Indexer) SetExcludePatterns(patterns []string) {
+	idx.exclude = nil
+	for _, pattern := range patterns {
+		if re, err := regexp.Compile(pattern); err == nil {
+			idx.exclude = append(idx.exclude, re)
 		}
 	}
-	if len(cmds) > n {
-		cmds = cmds[len(cmds)-n:]
+}
+
+// excluded reports whether cmd matches an exclude pattern.
+func (idx *Indexer) excluded(cmd string) bool {
+	for _, re := range idx.exclude {
+		if re.MatchString(cmd) {
+			return true
+		}
 	}
-	return cmds
+	return false
+}
+
+// SetAnonymizer makes the text sent to the embedding API, commands and
+// search queries alike, anonymized by a; nil sends it as it is. The index
+// keeps the commands themselves. It must be called before
+// StartRefreshLoop.
+func (idx *Indexer) SetAnonymizer(a *core.Anonymizer) {
+	idx.anonymizer = a
+}
+
+// SetWatermarkPolicy sets how commands carrying the Watermark are used:
+// WatermarkDownweight (the default for ""), WatermarkExclude, or
+// WatermarkKeep. It must be called before StartRefreshLoop.
+func (idx *Indexer) SetWatermarkPolicy(policy string) {
+	idx.watermark = policy
 }
 
 // IndexHistory reads the last N commands from the history file and embeds them.
 func (idx *Indexer) IndexHistory() error {
-	if idx.embedder == nil || idx.historyPath == "" {
+	if idx.embedder == nil || !idx.hasHistory() {
 		return nil
 	}
 
-	cmds := idx.readTailCommands()
-	if len(cmds) == 0 {
+	tail := idx.readTailCommands()
+	if len(tail.cmds) == 0 {
 		return nil
 	}
 
+	idx.mu.Lock()
+	idx.marked = tail.marked
+	idx.runs = tail.runs
+	idx.dirs = tail.dirs
+	for hash, t := range tail.lastRun {
+		noteRun(idx.lastRun, hash, t)
+	}
+	// Forget evictions of commands no longer in the history read.
+	inTail := make(map[string]bool, len(tail.cmds))
+	for _, cmd := range tail.cmds {
+		inTail[hashCommand(cmd)] = true
+	}
+	maps.DeleteFunc(idx.evicted, func(hash string, _ bool) bool { return !inTail[hash] })
+	idx.mu.Unlock()
+
+	return idx.indexCommands(tail.cmds)
+}
+
+// IndexCommands embeds commands just run and adds them to the index, so
+// they can be found as related commands before the shell writes them to
+// its history. Commands already indexed or being embedded are skipped,
+// and a command typed by hand clears its watermark.
+func (idx *Indexer) IndexCommands(cmds []string) error {
+	if idx.embedder == nil {
+		return nil
+	}
+	typed := make([]string, 0, len(cmds))
+	idx.mu.Lock()
+	for _, cmd := range cmds {
+		if spacePrefixed(cmd) {
+			continue
+		}
+		cmd, isMarked := stripWatermark(strings.TrimSpace(cmd))
+		if cmd == "" || isMarked {
+			continue
+		}
+		hash := hashCommand(cmd)
+		delete(idx.marked, hash)
+		delete(idx.evicted, hash)
+		noteRun(idx.lastRun, hash, time.Now())
+		typed = append(typed, cmd)
+	}
+	idx.mu.Unlock()
+	return idx.indexCommands(typed)
+}
+
+// IndexRun is IndexCommands for a command the shell reports having run in
+// cwd, which is also recorded for boosting it in searches from there.
+func (idx *Indexer) IndexRun(cmd, cwd string) error {
+	if idx.embedder == nil {
+		return nil
+	}
+	if stripped, _ := stripWatermark(strings.TrimSpace(cmd)); stripped != "" {
+		idx.mu.Lock()
+		if idx.dirs == nil {
+			idx.dirs = make(map[string][]string)
+		}
+		addCommandDir(idx.dirs, hashCommand(stripped), cwd)
+		idx.mu.Unlock()
+	}
+	return idx.IndexCommands([]string{cmd})
+}
+
+// indexCommands embeds the commands of cmds missing from the index and
+// adds them to it.
+func (idx *Indexer) indexCommands(cmds []string) error {
 	// Collect new commands that need embedding
-	idx.mu.RLock()
+	idx.mu.Lock()
 	var toEmbed []struct {
 		hash string
 		cmd  string
 	}
 	for _, cmd := range cmds {
 		hash := hashCommand(cmd)
-		if _, exists := idx.graph.Lookup(hash); !exists {
-			toEmbed = append(toEmbed, struct {
-				hash string
-				cmd  string
-			}{hash, cmd})
+		if idx.marked[hash] && idx.watermark == WatermarkExclude || idx.excluded(cmd) {
+			continue
+		}
+		if _, exists := idx.graph.Lookup(hash); exists || idx.embedding[hash] || idx.evicted[hash] {
+			continue
 		}
+		idx.embedding[hash] = true
+		toEmbed = append(toEmbed, struct {
+			hash string
+			cmd  string
+		}{hash, cmd})
 	}
-	idx.mu.RUnlock()
+	idx.mu.Unlock()
 
 	if len(toEmbed) == 0 {
 		return nil
 	}
+	defer func() {
+		idx.mu.Lock()
+		for _, b := range toEmbed {
+			delete(idx.embedding, b.hash)
+		}
+		idx.mu.Unlock()
+	}()
 
-	// Embed in batches via API, accumulating results locally
-	var allNodes []hnsw.Node[string]
-	allCommands := make(map[string]string, len(toEmbed))
+	// Embed in batches via API, up to idx.parallelism at once, accumulating
+	// results locally
+	var (
+		resultMu    sync.Mutex
+		allNodes    []hnsw.Node[string]
+		allCommands = make(map[string]string, len(toEmbed))
+		acquireErr  error
+		wg          sync.WaitGroup
+	)
+	slots := make(chan struct{}, max(idx.parallelism, 1))
 
 	for i := 0; i < len(toEmbed); i += indexBatchSize {
-		end := i + indexBatchSize
-		if end > len(toEmbed) {
-			end = len(toEmbed)
-		}
-		batch := toEmbed[i:end]
-
-		cleaned := make([]string, len(batch))
-		for j, b := range batch {
-			cleaned[j] = FilterQuoteContent(RedactCommand(b.cmd))
-		}
+		batch := toEmbed[i:min(i+indexBatchSize, len(toEmbed))]
 
-		vectors, err := idx.embedder.EmbedBatch(cleaned)
+		slots <- struct{}{}
+		release, err := idx.sched.Acquire(context.Background(), PriorityBackground)
 		if err != nil {
-			slog.Error("batch embed error", "error", err)
-			continue
+			<-slots
+			acquireErr = err
+			break
 		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				release()
+				wg.Done()
+			}()
 
-		for j, b := range batch {
-			allNodes = append(allNodes, hnsw.MakeNode(b.hash, vectors[j]))
-			allCommands[b.hash] = cleaned[j]
-		}
+			cleaned := make([]string, len(batch))
+			for j, b := range batch {
+				cleaned[j] = idx.anonymizer.Anonymize(core.FilterQuoteContent(core.RedactCommand(b.cmd)))
+			}
+			vectors, err := idx.embedder.EmbedBatch(cleaned)
+			if err != nil {
+				slog.Error("batch embed error", "error", err)
+				return
+			}
+
+			resultMu.Lock()
+			defer resultMu.Unlock()
+			for j, b := range batch {
+				allNodes = append(allNodes, hnsw.MakeNode(b.hash, vectors[j]))
+				allCommands[b.hash] = cleaned[j]
+			}
+		}()
+	}
+	wg.Wait()
+	if acquireErr != nil {
+		return acquireErr
 	}
 
 	// Single graph insertion under one write lock.
-	// Re-check for duplicates: another goroutine (e.g. LoadCache) may have
+	// Re-check for duplicates: another goroutine (e.g. OpenCache) may have
 	// added the same nodes between our earlier read lock and this write lock.
 	if len(allNodes) > 0 {
 		idx.mu.Lock()
+		// Vectors of other dimensions cannot share the graph: when the
+		// model's dimensions changed, the index starts afresh.
+		resized := idx.graph.Len() > 0 && idx.graph.Dims() != len(allNodes[0].Value)
+		if resized {
+			idx.graph = hnsw.NewGraph[string]()
+			clear(idx.commands)
+		}
 		filtered := allNodes[:0]
 		for _, n := range allNodes {
 			if _, exists := idx.graph.Lookup(n.Key); !exists {
@@ -175,37 +449,119 @@ func (idx *Indexer) IndexHistory() error {
 		for k, v := range allCommands {
 			idx.commands[k] = v
 		}
+		evicted := idx.evictLocked()
 		idx.mu.Unlock()
+		if resized {
+			idx.clearCache("dimensions")
+		}
+		if len(filtered) > 0 {
+			idx.cacheNodes(filtered, allCommands)
+		}
+		idx.uncacheNodes(evicted)
 	}
 
 	return nil
 }
 
+// historyCommands is what readTailCommands reads from history.
+type historyCommands struct {
+	cmds []string
+	// marked holds the hashes of commands that appear only with the
+	// Watermark; typing a command once clears its mark.
+	marked map[string]bool
+	// runs scores the commands' hashes by frecency.
+	runs *frecency
+	// dirs holds the latest directories each command's hash ran in, for
+	// sources that record them.
+	dirs map[string][]string
+	// lastRun holds when each command's hash last ran.
+	lastRun map[string]time.Time
+}
+
 // readTailCommands reads the last maxHistoryCommands from the history file.
 // Commands that differ only in quoted content (e.g. git commit -m "A" vs
 // git commit -m "B") are deduplicated, keeping the most recent variant.
-func (idx *Indexer) readTailCommands() []string {
-	lines := readLastLines(idx.historyPath, idx.maxHistoryCommands)
-	cmds := make([]string, 0, len(lines))
+func (idx *Indexer) readTailCommands() historyCommands {
+	entries := idx.lastEntries(idx.maxHistoryCommands)
+	h := historyCommands{
+		cmds:    make([]string, 0, len(entries)),
+		marked:  make(map[string]bool),
+		runs:    newFrecency(),
+		dirs:    make(map[string][]string),
+		lastRun: make(map[string]time.Time),
+	}
 	seen := make(map[string]int) // quote-filtered form -> index in cmds
-	for _, line := range lines {
-		cmd := parseHistoryLine(line)
+	for _, entry := range entries {
+		cmd, isMarked := stripWatermark(entry.Command)
 		if cmd == "" {
+			h.runs.skip()
 			continue
 		}
-		key := FilterQuoteContent(cmd)
+		hash := hashCommand(cmd)
+		if weight, ok := idx.runWeight(isMarked); ok {
+			h.runs.add(hash, weight)
+		} else {
+			h.runs.skip()
+		}
+		addCommandDir(h.dirs, hash, entry.Cwd)
+		noteRun(h.lastRun, hash, entry.Time)
+		key := core.FilterQuoteContent(cmd)
 		if prev, exists := seen[key]; exists {
 			// Replace earlier variant with the more recent one
-			cmds[prev] = cmd
+			h.cmds[prev] = cmd
+			if !isMarked {
+				delete(h.marked, hash)
+			}
 			continue
 		}
-		seen[key] = len(cmds)
-		cmds = append(cmds, cmd)
+		seen[key] = len(h.cmds)
+		h.cmds = append(h.cmds, cmd)
+		if isMarked {
+			h.marked[hash] = true
+		}
 	}
-	return cmds
+	return h
+}
+
+// addCommandDir records that the command hashed hash ran in dir, keeping
+// the latest maxCommandDirs directories. An empty dir is unknown.
+func addCommandDir(dirs map[string][]string, hash, dir string) {
+	if dir == "" {
+		return
+	}
+	list := slices.DeleteFunc(dirs[hash], func(d string) bool { return d == dir })
+	list = append(list, dir)
+	if len(list) > maxCommandDirs {
+		list = list[len(list)-maxCommandDirs:]
+	}
+	dirs[hash] = list
+}
+
+// noteRun records that the command hashed hash ran at t, if that is later
+// than known. A zero t is unknown.
+func noteRun(lastRun map[string]time.Time, hash string, t time.Time) {
+	if t.After(lastRun[hash]) {
+		lastRun[hash] = t
+	}
+}
+
+// ranUnderLocked reports whether the command hashed hash ran in cwd or a
+// directory under it.
+func (idx *Indexer) ranUnderLocked(hash, cwd string) bool {
+	if cwd == "" {
+		return false
+	}
+	for _, dir := range idx.dirs[hash] {
+		if rel, err := filepath.Rel(cwd, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
 }
 
-// StartRefreshLoop runs IndexHistory immediately, then re-indexes every TTL interval.
+// StartRefreshLoop runs IndexHistory immediately, then follows the history
+// as it grows, embedding only the commands added (see followHistory). Where
+// the history cannot be watched, it re-indexes every TTL interval instead.
 // It blocks until Close() is called. If embedder is nil, it closes initDone and returns.
 func (idx *Indexer) StartRefreshLoop() {
 	if idx.embedder == nil {
@@ -213,11 +569,24 @@ func (idx *Indexer) StartRefreshLoop() {
 		return
 	}
 
+	// Find the end of the history first, so commands run while it is
+	// indexed are picked up after.
+	tail := idx.tail()
 	if err := idx.IndexHistory(); err != nil {
 		slog.Error("initial indexing error", "error", err)
 	}
 	idx.initOnce.Do(func() { close(idx.initDone) })
 
+	if tail != nil && len(tail.paths()) > 0 {
+		w, err := watchFiles(tail.paths())
+		if err == nil {
+			defer w.Close()
+			idx.followHistory(tail, w)
+			return
+		}
+		slog.Warn("cannot watch history, re-indexing periodically", "error", err)
+	}
+
 	ticker := time.NewTicker(idx.ttl)
 	defer ticker.Stop()
 
@@ -233,18 +602,143 @@ func (idx *Indexer) StartRefreshLoop() {
 	}
 }
 
+// followHistory indexes the entries tail reads each time w reports its
+// files changed, until Close() is called. A rewritten history is indexed
+// again in full.
+func (idx *Indexer) followHistory(tail historyTail, w *fsnotify.Watcher) {
+	paths := tail.paths()
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-idx.stopCh:
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod || !slices.Contains(paths, filepath.Clean(ev.Name)) {
+				continue
+			}
+			if pending == nil {
+				pending = time.After(tailDelay)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("history watch error", "error", err)
+		case <-pending:
+			pending = nil
+			entries, reset := tail.next()
+			if reset {
+				if err := idx.IndexHistory(); err != nil {
+					slog.Error("re-indexing error", "error", err)
+				}
+				continue
+			}
+			if err := idx.indexEntries(entries); err != nil {
+				slog.Error("incremental indexing error", "error", err)
+			}
+		}
+	}
+}
+
+// indexEntries embeds the commands of entries newly added to the history.
+// Like readTailCommands, a command run only as an accepted suggestion is
+// marked and typing it clears the mark, runs are scored by frecency, and
+// the directories they ran in are recorded.
+func (idx *Indexer) indexEntries(entries []HistoryEntry) error {
+	cmds := make([]string, 0, len(entries))
+	idx.mu.Lock()
+	if idx.marked == nil {
+		idx.marked = make(map[string]bool)
+	}
+	if idx.runs == nil {
+		idx.runs = newFrecency()
+	}
+	if idx.dirs == nil {
+		idx.dirs = make(map[string][]string)
+	}
+	for _, entry := range entries {
+		cmd, isMarked := stripWatermark(entry.Command)
+		if cmd == "" || spacePrefixed(entry.Command) || idx.excluded(cmd) {
+			idx.runs.skip()
+			continue
+		}
+		hash := hashCommand(cmd)
+		if weight, ok := idx.runWeight(isMarked); ok {
+			idx.runs.add(hash, weight)
+		} else {
+			idx.runs.skip()
+		}
+		addCommandDir(idx.dirs, hash, entry.Cwd)
+		noteRun(idx.lastRun, hash, entry.Time)
+		delete(idx.evicted, hash)
+		if !isMarked {
+			delete(idx.marked, hash)
+		} else if _, typed := idx.commands[hash]; !typed {
+			idx.marked[hash] = true
+		}
+		cmds = append(cmds, cmd)
+	}
+	idx.mu.Unlock()
+	return idx.indexCommands(cmds)
+}
+
 // InitDone returns a channel that is closed after the first IndexHistory call completes.
 func (idx *Indexer) InitDone() <-chan struct{} {
 	return idx.initDone
 }
 
-// SearchRelevant embeds the query and returns the topK most similar commands.
-func (idx *Indexer) SearchRelevant(query string, topK int) ([]string, error) {
+// Len returns the number of commands in the index.
+func (idx *Indexer) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.commands)
+}
+
+// SetMaxSize caps the index at n commands, evicting per policy
+// (EvictLeastFrecent or EvictOldest) beyond it. n <= 0 leaves it
+// unbounded. It must be called before StartRefreshLoop.
+func (idx *Indexer) SetMaxSize(n int, policy string) {
+	idx.maxSize = n
+	idx.eviction = policy
+}
+
+// SetAgeHalfLife makes related commands that last ran long ago count as
+// less similar: after halfLife a command's similarity has lost half of
+// what age can take off it, which is at most half. halfLife <= 0 turns the
+// decay off. It must be called before StartRefreshLoop.
+func (idx *Indexer) SetAgeHalfLife(halfLife time.Duration) {
+	idx.ageHalfLife = halfLife
+}
+
+// SetDedupeThreshold sets the cosine similarity above which
+// SearchRelevantExcluding treats a command as a duplicate of an excluded
+// one. At 1 or more only exact duplicates are dropped.
+func (idx *Indexer) SetDedupeThreshold(threshold float64) {
+	idx.dedupe = float32(threshold)
+}
+
+// SearchRelevant embeds the query and returns the topK most similar
+// commands. Commands run in or under cwd, where the source records
+// directories, count as nearer (see dirBoost); an empty cwd boosts none.
+func (idx *Indexer) SearchRelevant(query, cwd string, topK int) ([]string, error) {
+	return idx.SearchRelevantExcluding(query, cwd, topK, nil)
+}
+
+// SearchRelevantExcluding is like SearchRelevant, but leaves out commands
+// that duplicate one of exclude (e.g. recent commands already in the
+// prompt): the same command once quotes are filtered and it is normalized,
+// or one whose embedding is within the dedupe threshold of an excluded
+// command's. Results that are variants of one command (see
+// collapseVariantsLocked) are collapsed into the first.
+func (idx *Indexer) SearchRelevantExcluding(query, cwd string, topK int, exclude []string) ([]string, error) {
 	if idx.embedder == nil {
 		return nil, nil
 	}
 
-	queryVec, err := idx.embedder.Embed(RedactCommand(query))
+	queryVec, err := idx.embedder.Embed(idx.anonymizer.Anonymize(core.RedactCommand(query)))
 	if err != nil {
 		return nil, err
 	}
@@ -256,19 +750,236 @@ func (idx *Indexer) SearchRelevant(query string, topK int) ([]string, error) {
 		return nil, nil
 	}
 
-	neighbors := idx.graph.Search(queryVec, topK)
-	commands := make([]string, len(neighbors))
-	for i, n := range neighbors {
-		commands[i] = idx.commands[n.Key]
+	// Search wider, as variants of one command collapse into one result,
+	// and when marked commands may be demoted or dropped, so typed ones can
+	// fill their places.
+	k := 2 * topK
+	if len(idx.marked) > 0 && idx.watermark != WatermarkKeep {
+		k *= 2
+	}
+	// And when commands run here may be boosted past nearer ones.
+	if cwd != "" && len(idx.dirs) > 0 {
+		k *= 2
+	}
+	k += len(exclude)
+	neighbors := idx.graph.Search(queryVec, k)
+	idx.rankNeighborsLocked(queryVec, cwd, neighbors)
+	keys := make([]string, 0, len(neighbors))
+	for _, n := range neighbors {
+		if !idx.duplicatesLocked(n, exclude) {
+			keys = append(keys, n.Key)
+		}
+	}
+	keys = rankMarked(keys, idx.marked, idx.watermark)
+	keys = idx.collapseVariantsLocked(keys, exclude)
+	if len(keys) > topK {
+		keys = keys[:topK]
+	}
+
+	commands := make([]string, len(keys))
+	for i, key := range keys {
+		commands[i] = idx.commands[key]
 	}
 	return commands, nil
 }
 
+// rankNeighborsLocked sorts search results nearest to vec first, as the
+// graph returns them in no particular order. Similarity decays with the
+// time since a command last ran (see SetAgeHalfLife), and commands that ran
+// in or under cwd count dirBoost nearer. Results about as near as each
+// other (within relevanceTie) go by frecency, the most frecent first.
+func (idx *Indexer) rankNeighborsLocked(vec []float32, cwd string, neighbors []hnsw.Node[string]) {
+	now := time.Now()
+	bucket := make(map[string]float64, len(neighbors))
+	for _, n := range neighbors {
+		dist := 1 - (1-float64(hnsw.CosineDistance(vec, n.Value)))*idx.ageFactorLocked(n.Key, now)
+		if idx.ranUnderLocked(n.Key, cwd) {
+			dist -= dirBoost
+		}
+		bucket[n.Key] = math.Round(dist / relevanceTie)
+	}
+	slices.SortStableFunc(neighbors, func(a, b hnsw.Node[string]) int {
+		if c := cmp.Compare(bucket[a.Key], bucket[b.Key]); c != 0 {
+			return c
+		}
+		if idx.runs == nil {
+			return 0
+		}
+		return cmp.Compare(idx.runs.score(b.Key), idx.runs.score(a.Key))
+	})
+}
+
+// ageFactorLocked returns what the similarity of the command hashed hash
+// is scaled by for the time since it last ran: from 1 just after, down
+// towards 1/2. Commands not known to have run are not scaled.
+func (idx *Indexer) ageFactorLocked(hash string, now time.Time) float64 {
+	last, ok := idx.lastRun[hash]
+	if idx.ageHalfLife <= 0 || !ok {
+		return 1
+	}
+	age := max(now.Sub(last), 0)
+	return 0.5 + 0.5*math.Exp2(-float64(age)/float64(idx.ageHalfLife))
+}
+
+// evictLocked removes the commands past the maximum size from the index,
+// per the eviction policy, and returns their hashes.
+func (idx *Indexer) evictLocked() []string {
+	over := idx.graph.Len() - idx.maxSize
+	if idx.maxSize <= 0 || over <= 0 {
+		return nil
+	}
+	byRun := func(a, b string) int { return idx.lastRun[a].Compare(idx.lastRun[b]) }
+	byFrecency := func(a, b string) int {
+		if idx.runs == nil {
+			return 0
+		}
+		return cmp.Compare(idx.runs.score(a), idx.runs.score(b))
+	}
+	first, then := byFrecency, byRun
+	if idx.eviction == EvictOldest {
+		first, then = byRun, byFrecency
+	}
+	keys := make([]string, 0, len(idx.commands))
+	for key := range idx.commands {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if c := first(a, b); c != 0 {
+			return c
+		}
+		if c := then(a, b); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	evicted := keys[:min(over, len(keys))]
+	for _, key := range evicted {
+		idx.graph.Delete(key)
+		delete(idx.commands, key)
+		delete(idx.marked, key)
+		delete(idx.dirs, key)
+		delete(idx.lastRun, key)
+		idx.evicted[key] = true
+	}
+	return evicted
+}
+
+// collapseVariantsLocked keeps the first of each group of keys whose
+// commands share a normalized syntax tree once quoted text is filtered
+// (core.QuoteVariantKey), and drops those sharing one with a command of
+// exclude, so that each result tells something new: git commit -m "" run
+// hundreds of times with different messages fills one slot, not five.
+func (idx *Indexer) collapseVariantsLocked(keys, exclude []string) []string {
+	seen := make(map[string]bool, len(keys)+len(exclude))
+	for _, cmd := range exclude {
+		seen[core.QuoteVariantKey(core.RedactCommand(cmd))] = true
+	}
+	out := keys[:0]
+	for _, key := range keys {
+		variant := core.QuoteVariantKey(idx.commands[key])
+		if seen[variant] {
+			continue
+		}
+		seen[variant] = true
+		out = append(out, key)
+	}
+	return out
+}
+
+// duplicatesLocked reports whether n is the same command as one of
+// exclude, or its embedding is within the dedupe threshold of one. Excluded
+// commands that were never embedded only match exactly.
+func (idx *Indexer) duplicatesLocked(n hnsw.Node[string], exclude []string) bool {
+	for _, cmd := range exclude {
+		hash := hashCommand(cmd)
+		if hash == n.Key {
+			return true
+		}
+		if idx.dedupe <= 0 || idx.dedupe >= 1 {
+			continue
+		}
+		if vec, ok := idx.graph.Lookup(hash); ok && 1-hnsw.CosineDistance(vec, n.Value) > idx.dedupe {
+			return true
+		}
+	}
+	return false
+}
+
+// PrefixMatches returns up to n history commands that extend prefix,
+// ranked by frecency: every use of a command counts, recent uses more than
+// old ones. It needs no embeddings, so it can complete without any API.
+// Marked commands follow the watermark policy: dropped, counted half, or
+// counted like typed ones.
+func (idx *Indexer) PrefixMatches(prefix string, n int) []string {
+	if !idx.hasHistory() || prefix == "" || n <= 0 {
+		return nil
+	}
+	entries := idx.lastEntries(frecencyWindow)
+	return idx.entryFrecency(entries, func(cmd string) bool {
+		return cmd != prefix && strings.HasPrefix(cmd, prefix)
+	}).ranked(n)
+}
+
+// CommandFrecency scores the commands (first words) run in recent
+// history by frecency, weighted like PrefixMatches, including the
+// watermark policy. Leading environment assignments are skipped.
+func (idx *Indexer) CommandFrecency() map[string]float64 {
+	if !idx.hasHistory() {
+		return nil
+	}
+	entries := idx.lastEntries(frecencyWindow)
+	scores := make(map[string]float64)
+	for i, entry := range entries {
+		cmd, marked := stripWatermark(entry.Command)
+		weight, ok := idx.runWeight(marked)
+		if !ok {
+			continue
+		}
+		weight *= math.Exp2(-float64(len(entries)-1-i) / frecencyHalfLife)
+		for _, field := range strings.Fields(cmd) {
+			if eq := strings.IndexByte(field, '='); eq > 0 && !strings.ContainsAny(field[:eq], "/-.") {
+				continue
+			}
+			scores[field] += weight
+			break
+		}
+	}
+	return scores
+}
+
+// rankMarked applies a watermark policy to search results keys, nearest
+// first: marked keys are dropped (WatermarkExclude), kept in place
+// (WatermarkKeep), or moved after the unmarked ones (otherwise).
+func rankMarked(keys []string, marked map[string]bool, policy string) []string {
+	if len(marked) == 0 || policy == WatermarkKeep {
+		return keys
+	}
+	typed := make([]string, 0, len(keys))
+	var generated []string
+	for _, key := range keys {
+		if marked[key] {
+			generated = append(generated, key)
+		} else {
+			typed = append(typed, key)
+		}
+	}
+	if policy == WatermarkExclude {
+		return typed
+	}
+	return append(typed, generated...)
+}
+
 // Close stops the refresh loop and releases resources held by the indexer.
 func (idx *Indexer) Close() {
 	idx.closeOnce.Do(func() {
 		close(idx.stopCh)
 	})
+	idx.mu.Lock()
+	if idx.cache != nil {
+		idx.cache.close()
+		idx.cache = nil
+	}
+	idx.mu.Unlock()
 	if idx.embedder != nil {
 		idx.embedder.Close()
 	}
@@ -277,34 +988,53 @@ func (idx *Indexer) Close() {
 // parseHistoryLine strips shell-specific prefixes from history lines.
 // Zsh extended history format: ": 1234567890:0;actual command"
 // Bash format: just the command (no prefix)
+// Commands typed with a leading space are private (see spacePrefixed) and
+// parse as empty.
 func parseHistoryLine(line string) string {
-	line = strings.TrimSpace(line)
-	if line == "" {
+	line = strings.TrimRight(line, " \t\r\n")
+	if line == "" || spacePrefixed(line) {
 		return ""
 	}
 	// Zsh extended history: ": <timestamp>:<duration>;<command>"
 	if strings.HasPrefix(line, ": ") {
 		if idx := strings.Index(line, ";"); idx != -1 {
+			if spacePrefixed(line[idx+1:]) {
+				return ""
+			}
 			return strings.TrimSpace(line[idx+1:])
 		}
 	}
-	return line
+	return strings.TrimSpace(line)
+}
+
+// spacePrefixed reports whether cmd was typed with a leading space, which
+// marks it private: the shells keep such commands out of history
+// (HIST_IGNORE_SPACE, HISTCONTROL=ignorespace), and ashlet leaves them out
+// wherever they were recorded anyway.
+func spacePrefixed(cmd string) bool {
+	return strings.HasPrefix(cmd, " ")
+}
+
+// stripWatermark removes a trailing Watermark comment from cmd and reports
+// whether there was one. The marker must be a separate word, as the shell
+// only treats it as a comment then.
+func stripWatermark(cmd string) (string, bool) {
+	rest, ok := strings.CutSuffix(cmd, Watermark)
+	if !ok || (rest != "" && !strings.HasSuffix(rest, " ") && !strings.HasSuffix(rest, "\t")) {
+		return cmd, false
+	}
+	return strings.TrimRight(rest, " \t"), true
 }
 
 // hashCommand hashes by the quote-filtered form so that commands differing
 // only in quoted content (e.g. git commit -m "A" vs "B") share one graph node.
 func hashCommand(cmd string) string {
-	h := sha256.Sum256([]byte(FilterQuoteContent(cmd)))
+	h := sha256.Sum256([]byte(core.FilterQuoteContent(cmd)))
 	return fmt.Sprintf("%x", h)
 }
 
-func readLastLines(path string, n int) []string {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil
-	}
-	defer f.Close()
-
+// readLastLines reads the last n lines of f.
+func readLastLines(f *os.File, n int) []string {
 	// For efficiency, seek near end of file for large files
 	info, err := f.Stat()
 	if err != nil {
@@ -1,8 +1,15 @@
 package index
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,6 +24,7 @@ func TestParseHistoryLineZsh(t *testing.T) {
 		{": 1234567890:0;git status", "git status"},
 		{": 1234567890:0;ls -la /tmp", "ls -la /tmp"},
 		{": 1234567890:0;", ""},
+		{": 1234567890:0; export TOKEN=secret", ""},
 	}
 	for _, tt := range tests {
 		got := parseHistoryLine(tt.input)
@@ -33,7 +41,8 @@ func TestParseHistoryLineBash(t *testing.T) {
 	}{
 		{"git status", "git status"},
 		{"ls -la /tmp", "ls -la /tmp"},
-		{"  git commit -m 'test'  ", "git commit -m 'test'"},
+		{"git commit -m 'test'  ", "git commit -m 'test'"},
+		{"  git commit -m 'test'", ""}, // typed with a leading space: private
 		{"", ""},
 	}
 	for _, tt := range tests {
@@ -44,6 +53,16 @@ func TestParseHistoryLineBash(t *testing.T) {
 	}
 }
 
+func TestParseHistoryEntry(t *testing.T) {
+	e := parseHistoryEntry(": 1700000000:12;make test")
+	if e.Command != "make test" || !e.Time.Equal(time.Unix(1700000000, 0)) || e.Duration != 12*time.Second || e.ExitCode != -1 {
+		t.Errorf("zsh extended entry = %+v", e)
+	}
+	if e := parseHistoryEntry("make test"); e.Command != "make test" || !e.Time.IsZero() || e.Cwd != "" {
+		t.Errorf("bash entry = %+v, want just the command", e)
+	}
+}
+
 func TestRecentCommandsReadsBashHistory(t *testing.T) {
 	dir := t.TempDir()
 	bashHist := filepath.Join(dir, ".bash_history")
@@ -62,11 +81,158 @@ func TestRecentCommandsReadsBashHistory(t *testing.T) {
 	if len(cmds) != 3 {
 		t.Fatalf("expected 3 commands, got %d", len(cmds))
 	}
-	if cmds[0] != "git status" {
-		t.Errorf("expected 'git status', got %q", cmds[0])
+	if cmds[0] != "echo hello" {
+		t.Errorf("expected 'echo hello', got %q", cmds[0])
+	}
+	if cmds[2] != "git status" {
+		t.Errorf("expected 'git status', got %q", cmds[2])
+	}
+}
+
+func TestRecentCommandsFrecency(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), ".zsh_history")
+	var content strings.Builder
+	for range 5 {
+		content.WriteString(": 1:0;make test\n: 1:0;vim main.go\n")
+	}
+	content.WriteString(": 2:0;cat notes.txt\n: 3:0;make test\n")
+	if err := os.WriteFile(hist, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := NewIndexerForHistory(nil, 3000, time.Hour, hist)
+	got := idx.RecentCommands(3)
+	if want := "make test|vim main.go|cat notes.txt"; strings.Join(got, "|") != want {
+		t.Errorf("RecentCommands = %q, want %q: repeated commands first, each once", got, want)
+	}
+}
+
+func TestStripWatermark(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   string
+		marked bool
+	}{
+		{"git status #ashlet", "git status", true},
+		{"git status\t#ashlet", "git status", true},
+		{"git status", "git status", false},
+		{"echo foo#ashlet", "echo foo#ashlet", false},
+		{"#ashlet", "", true},
+	}
+	for _, tt := range tests {
+		got, marked := stripWatermark(tt.input)
+		if got != tt.want || marked != tt.marked {
+			t.Errorf("stripWatermark(%q) = %q, %v; want %q, %v", tt.input, got, marked, tt.want, tt.marked)
+		}
+	}
+}
+
+func TestRecentCommandsWatermark(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), ".zsh_history")
+	content := ": 1:0;make build #ashlet\n: 2:0;ls\n: 3:0;git push #ashlet\n"
+	if err := os.WriteFile(hist, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := NewIndexerForHistory(nil, 3000, time.Hour, hist)
+	if got := idx.RecentCommands(5); strings.Join(got, "|") != "ls|git push|make build" {
+		t.Errorf("downweight RecentCommands = %q, want markers stripped and marked commands counted half", got)
+	}
+	idx.SetWatermarkPolicy(WatermarkExclude)
+	if got := idx.RecentCommands(5); strings.Join(got, "|") != "ls" {
+		t.Errorf("exclude RecentCommands = %q, want only typed commands", got)
+	}
+}
+
+func TestPrefixMatchesFrecency(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), ".zsh_history")
+	var content strings.Builder
+	// git status is used often but long ago; git stash once, just now.
+	for range 10 {
+		content.WriteString(": 1:0;git status\n")
+	}
+	for range 1000 {
+		content.WriteString(": 2:0;ls\n")
+	}
+	content.WriteString(": 3:0;git stash\n: 4:0;git st\n: 5:0;git show #ashlet\n: 6:0;git log\n")
+	if err := os.WriteFile(hist, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := NewIndexerForHistory(nil, 3000, time.Hour, hist)
+	if got := idx.PrefixMatches("git st", 5); strings.Join(got, "|") != "git stash|git status" {
+		t.Errorf("PrefixMatches = %q, want recent use first and the input itself left out", got)
+	}
+	if got := idx.PrefixMatches("git sta", 1); strings.Join(got, "|") != "git stash" {
+		t.Errorf("PrefixMatches(n=1) = %q", got)
+	}
+	idx.SetWatermarkPolicy(WatermarkExclude)
+	if got := idx.PrefixMatches("git sh", 5); len(got) != 0 {
+		t.Errorf("exclude PrefixMatches = %q, want marked commands dropped", got)
+	}
+	if got := idx.PrefixMatches("", 5); got != nil {
+		t.Errorf("PrefixMatches of empty input = %q, want none", got)
+	}
+}
+
+func TestCommandFrecency(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), ".zsh_history")
+	content := ": 1:0;docker ps\n: 2:0;docker build .\n: 3:0;FOO=1 make test\n: 4:0;dotnet run\n"
+	if err := os.WriteFile(hist, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scores := NewIndexerForHistory(nil, 3000, time.Hour, hist).CommandFrecency()
+	if scores["docker"] <= scores["dotnet"] {
+		t.Errorf("docker (used twice) should outscore dotnet (once, latest): %v", scores)
+	}
+	if scores["make"] == 0 || scores["FOO=1"] != 0 {
+		t.Errorf("leading assignments should be skipped: %v", scores)
+	}
+	if got := NewIndexerForHistory(nil, 3000, time.Hour, "").CommandFrecency(); got != nil {
+		t.Errorf("no history = %v, want nil", got)
+	}
+}
+
+func TestReadTailCommandsMarks(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), ".bash_history")
+	content := "make build #ashlet\nls\ngit push #ashlet\nmake build\nls #ashlet\n"
+	if err := os.WriteFile(hist, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := NewIndexerForHistory(nil, 3000, time.Hour, hist)
+	tail := idx.readTailCommands()
+	cmds, marked, runs := tail.cmds, tail.marked, tail.runs
+	if strings.Join(cmds, "|") != "make build|ls|git push" {
+		t.Errorf("cmds = %q", cmds)
+	}
+	// Only "git push" was never typed.
+	if len(marked) != 1 || !marked[hashCommand("git push")] {
+		t.Errorf("marked = %v, want only git push", marked)
 	}
-	if cmds[2] != "echo hello" {
-		t.Errorf("expected 'echo hello', got %q", cmds[2])
+	if runs.score(hashCommand("make build")) <= runs.score(hashCommand("git push")) {
+		t.Error("make build, run twice, should be more frecent than git push")
+	}
+}
+
+func TestRankMarked(t *testing.T) {
+	keys := []string{"a", "b", "c", "d"}
+	marked := map[string]bool{"a": true, "c": true}
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{"", "b d a c"},
+		{WatermarkDownweight, "b d a c"},
+		{WatermarkExclude, "b d"},
+		{WatermarkKeep, "a b c d"},
+	}
+	for _, tt := range tests {
+		got := rankMarked(append([]string(nil), keys...), marked, tt.policy)
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("rankMarked(policy %q) = %v, want %s", tt.policy, got, tt.want)
+		}
 	}
 }
 
@@ -92,7 +258,7 @@ func TestNewIndexerNilEmbedder(t *testing.T) {
 
 func TestSearchRelevantNilEmbedder(t *testing.T) {
 	idx := NewIndexer(nil, 3000, time.Hour)
-	cmds, err := idx.SearchRelevant("test", 5)
+	cmds, err := idx.SearchRelevant("test", "", 5)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -108,9 +274,50 @@ func TestNewIndexerUsesHISTFILE(t *testing.T) {
 		t.Fatal(err)
 	}
 	t.Setenv("HISTFILE", histFile)
+	t.Setenv("HOME", dir)
 	idx := NewIndexer(nil, 3000, time.Hour)
-	if idx.historyPath != histFile {
-		t.Errorf("expected historyPath %s, got %s", histFile, idx.historyPath)
+	if cmds := idx.RecentCommands(5); len(cmds) != 1 || cmds[0] != "test" {
+		t.Errorf("expected history read from HISTFILE, got %q", cmds)
+	}
+}
+
+func TestHistoryFilesMerged(t *testing.T) {
+	dir := t.TempDir()
+	zsh := filepath.Join(dir, ".zsh_history")
+	bash := filepath.Join(dir, ".bash_history")
+	plain := filepath.Join(dir, "plain_history")
+	os.WriteFile(zsh, []byte(": 100:0;make\n: 300:0;make test\n: 500:0;git push\n"), 0644)
+	os.WriteFile(bash, []byte("#200\ncd src\n#400\ngit add -A\ngit commit\n"), 0644)
+	os.WriteFile(plain, []byte("ls\npwd\n"), 0644)
+	os.Chtimes(plain, time.Unix(450, 0), time.Unix(450, 0))
+
+	got := NewIndexerForSource(nil, 100, time.Hour, NewHistoryFiles([]string{zsh, bash, plain})).RecentCommands(8)
+	// Each command ran once, so the latest comes first.
+	want := []string{"git push", "pwd", "ls", "git commit", "git add -A", "make test", "cd src", "make"}
+	if !slices.Equal(got, want) {
+		t.Errorf("merged history = %q, want %q", got, want)
+	}
+	if got := NewHistoryFiles([]string{zsh, bash}).Last(2); len(got) != 2 || got[0].Command != "git commit" || got[1].Command != "git push" {
+		t.Errorf("Last(2) = %+v, want the 2 latest across files", got)
+	}
+}
+
+func TestHistoryFilesOpenedWith(t *testing.T) {
+	dir := t.TempDir()
+	zsh := filepath.Join(dir, ".zsh_history")
+	bash := filepath.Join(dir, ".bash_history")
+	os.WriteFile(zsh, []byte(": 100:0;make\n"), 0644)
+	os.WriteFile(bash, []byte("#200\ncd src\n"), 0644)
+
+	// Only the files open lets through are read.
+	open := func(path string) (*os.File, error) {
+		if path != zsh {
+			return nil, os.ErrPermission
+		}
+		return os.Open(path)
+	}
+	if got := NewHistoryFilesOpenedWith([]string{zsh, bash}, open).Last(5); len(got) != 1 || got[0].Command != "make" {
+		t.Errorf("Last(5) = %+v, want only the command of the file open allows", got)
 	}
 }
 
@@ -167,6 +374,190 @@ func TestHNSWSearchIntegration(t *testing.T) {
 	}
 }
 
+func TestRankNeighborsFrecency(t *testing.T) {
+	idx := NewIndexerForHistory(nil, 100, time.Hour, "")
+	idx.runs = newFrecency()
+	for range 3 {
+		idx.runs.add("often", 1)
+	}
+	idx.runs.add("once", 1)
+
+	neighbors := []hnsw.Node[string]{
+		hnsw.MakeNode("far", []float32{0, 1, 0}),
+		hnsw.MakeNode("once", []float32{1, 0.001, 0}),
+		hnsw.MakeNode("often", []float32{1, 0, 0.001}),
+	}
+	idx.rankNeighborsLocked([]float32{1, 0, 0}, "", neighbors)
+	var keys []string
+	for _, n := range neighbors {
+		keys = append(keys, n.Key)
+	}
+	if want := []string{"often", "once", "far"}; !slices.Equal(keys, want) {
+		t.Errorf("ranked = %q, want %q: nearest first, equally near by frecency", keys, want)
+	}
+}
+
+func TestRankNeighborsDirBoost(t *testing.T) {
+	idx := NewIndexerForHistory(nil, 100, time.Hour, "")
+	idx.dirs = make(map[string][]string)
+	addCommandDir(idx.dirs, "here", "/repo/api")
+	addCommandDir(idx.dirs, "sibling", "/repository")
+
+	neighbors := func() []hnsw.Node[string] {
+		return []hnsw.Node[string]{
+			hnsw.MakeNode("near", []float32{1, 0, 0}),
+			hnsw.MakeNode("sibling", []float32{1, 0.3, 0}),
+			hnsw.MakeNode("here", []float32{1, 0.3, 0}),
+		}
+	}
+	keys := func(nodes []hnsw.Node[string]) []string {
+		var out []string
+		for _, n := range nodes {
+			out = append(out, n.Key)
+		}
+		return out
+	}
+
+	ranked := neighbors()
+	idx.rankNeighborsLocked([]float32{1, 0, 0}, "/repo", ranked)
+	if got, want := keys(ranked), []string{"here", "near", "sibling"}; !slices.Equal(got, want) {
+		t.Errorf("ranked from /repo = %q, want %q: commands run under cwd boosted", got, want)
+	}
+	ranked = neighbors()
+	idx.rankNeighborsLocked([]float32{1, 0, 0}, "/srv", ranked)
+	if got := keys(ranked); got[0] != "near" {
+		t.Errorf("ranked from /srv = %q, want no boost", got)
+	}
+}
+
+func TestAddCommandDir(t *testing.T) {
+	dirs := make(map[string][]string)
+	for i := range maxCommandDirs + 2 {
+		addCommandDir(dirs, "h", "/d"+strconv.Itoa(i))
+	}
+	addCommandDir(dirs, "h", "/d3")
+	addCommandDir(dirs, "h", "")
+	got := dirs["h"]
+	if len(got) != maxCommandDirs || got[len(got)-1] != "/d3" || got[0] != "/d2" {
+		t.Errorf("dirs = %q, want the latest %d, each once", got, maxCommandDirs)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	now := time.Now()
+	newIndex := func(policy string) *Indexer {
+		idx := NewIndexerForHistory(nil, 100, time.Hour, "")
+		idx.SetMaxSize(2, policy)
+		idx.runs = newFrecency()
+		// "often" ran most but longest ago, "once" least, "lately" last.
+		for range 5 {
+			idx.runs.add("often", 1)
+		}
+		idx.runs.add("once", 1)
+		idx.runs.add("lately", 1)
+		for i, key := range []string{"often", "once", "lately"} {
+			idx.graph.Add(hnsw.MakeNode(key, []float32{1, float32(i), 0}))
+			idx.commands[key] = key
+			idx.lastRun[key] = now.Add(time.Duration(i) * time.Hour)
+		}
+		return idx
+	}
+
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{"", "once"},
+		{EvictLeastFrecent, "once"},
+		{EvictOldest, "often"},
+	}
+	for _, tt := range tests {
+		idx := newIndex(tt.policy)
+		if got := idx.evictLocked(); !slices.Equal(got, []string{tt.want}) {
+			t.Errorf("%q evicted %q, want [%s]", tt.policy, got, tt.want)
+		}
+		if _, ok := idx.graph.Lookup(tt.want); ok || idx.graph.Len() != 2 || idx.commands[tt.want] != "" {
+			t.Errorf("%q: %s should be gone from the index", tt.policy, tt.want)
+		}
+	}
+}
+
+func TestReindexSkipsEvicted(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), ".zsh_history")
+	content := ": 1:0;make build\n: 2:0;make test\n: 3:0;git status\n: 4:0;git push\n"
+	if err := os.WriteFile(hist, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	srv := newEmbeddingServer(t, &calls)
+
+	idx := NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, hist)
+	idx.SetMaxSize(2, EvictOldest)
+	if err := idx.IndexHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if idx.graph.Len() != 2 {
+		t.Fatalf("expected 2 indexed commands, got %d", idx.graph.Len())
+	}
+	first := calls.Load()
+
+	// A TTL refresh reads the same history: the evicted commands are not
+	// embedded again.
+	if err := idx.IndexHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != first {
+		t.Errorf("re-index made %d embedding requests, want 0", n-first)
+	}
+
+	// Running an evicted command again readmits it.
+	if err := idx.IndexCommands([]string{"make build"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.graph.Lookup(hashCommand("make build")); !ok {
+		t.Error("a command run again should be indexed again")
+	}
+}
+
+func TestRankNeighborsAgeDecay(t *testing.T) {
+	idx := NewIndexerForHistory(nil, 100, time.Hour, "")
+	idx.SetAgeHalfLife(24 * time.Hour)
+	idx.lastRun["stale"] = time.Now().Add(-30 * 24 * time.Hour)
+	idx.lastRun["fresh"] = time.Now()
+
+	neighbors := []hnsw.Node[string]{
+		hnsw.MakeNode("stale", []float32{1, 0, 0}),
+		hnsw.MakeNode("fresh", []float32{1, 0.5, 0}),
+	}
+	idx.rankNeighborsLocked([]float32{1, 0, 0}, "", neighbors)
+	if neighbors[0].Key != "fresh" {
+		t.Errorf("ranked = %v, want the command run a month ago after a slightly less similar fresh one", neighbors)
+	}
+
+	idx.SetAgeHalfLife(0)
+	idx.rankNeighborsLocked([]float32{1, 0, 0}, "", neighbors)
+	if neighbors[0].Key != "stale" {
+		t.Error("without decay the nearest command should come first")
+	}
+}
+
+func TestCollapseVariants(t *testing.T) {
+	idx := NewIndexerForHistory(nil, 100, time.Hour, "")
+	idx.commands = map[string]string{
+		"a": `git commit -m ""`,
+		"b": `git commit --message=""`,
+		"c": `git  commit -m ''`,
+		"d": "ls -la",
+		"e": "git push",
+		"f": "ls -l -a",
+		"g": "make test",
+	}
+	got := idx.collapseVariantsLocked([]string{"a", "b", "c", "d", "e", "f", "g"}, []string{"git push"})
+	if want := []string{"a", "d", "g"}; !slices.Equal(got, want) {
+		t.Errorf("collapsed = %q, want %q", got, want)
+	}
+}
+
 func TestStartRefreshLoopStopsOnClose(t *testing.T) {
 	idx := NewIndexer(nil, 3000, time.Hour)
 	done := make(chan struct{})
@@ -206,3 +597,189 @@ func TestHashCommandDeterministic(t *testing.T) {
 		t.Error("different commands should produce different hashes")
 	}
 }
+
+func TestDuplicatesLocked(t *testing.T) {
+	idx := NewIndexerForHistory(nil, 100, time.Hour, "")
+	idx.SetDedupeThreshold(0.95)
+	vectors := map[string][]float32{
+		"git status":    {1, 0, 0},
+		"git status -s": {0.99, 0.05, 0},
+		"git log":       {0.7, 0.7, 0},
+		"docker ps":     {0, 0, 1},
+	}
+	for cmd, vec := range vectors {
+		idx.graph.Add(hnsw.MakeNode(hashCommand(cmd), vec))
+	}
+	node := func(cmd string) hnsw.Node[string] {
+		return hnsw.MakeNode(hashCommand(cmd), vectors[cmd])
+	}
+	recent := []string{"git status"}
+
+	if !idx.duplicatesLocked(node("git status"), recent) {
+		t.Error("the same command should be a duplicate")
+	}
+	if !idx.duplicatesLocked(node("git status -s"), recent) {
+		t.Error("a near-identical embedding should be a duplicate")
+	}
+	if idx.duplicatesLocked(node("git log"), recent) {
+		t.Error("a related command should not be a duplicate")
+	}
+	if idx.duplicatesLocked(node("docker ps"), []string{"never embedded"}) {
+		t.Error("a command never embedded should only match exactly")
+	}
+
+	idx.SetDedupeThreshold(1)
+	if idx.duplicatesLocked(node("git status -s"), recent) {
+		t.Error("a threshold of 1 should drop only exact duplicates")
+	}
+	if !idx.duplicatesLocked(node("git status"), recent) {
+		t.Error("exact duplicates should still be dropped")
+	}
+}
+
+// newEmbeddingServer serves embeddings for any input, counting requests
+// in calls.
+func newEmbeddingServer(t *testing.T, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Write([]byte(`{"data":[`))
+		for i := range req.Input {
+			if i > 0 {
+				w.Write([]byte(","))
+			}
+			w.Write([]byte(`{"embedding":[1,0,0],"index":` + strconv.Itoa(i) + `}`))
+		}
+		w.Write([]byte(`]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestIndexCommands(t *testing.T) {
+	var calls atomic.Int32
+	srv := newEmbeddingServer(t, &calls)
+
+	idx := NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, "")
+	if err := idx.IndexCommands([]string{"kubectl rollout status deploy/web", "  ", "ls #ashlet"}); err != nil {
+		t.Fatal(err)
+	}
+	if idx.graph.Len() != 1 {
+		t.Fatalf("expected 1 indexed command, got %d", idx.graph.Len())
+	}
+	if got := idx.commands[hashCommand("kubectl rollout status deploy/web")]; got != "kubectl rollout status deploy/web" {
+		t.Errorf("indexed command text = %q", got)
+	}
+
+	// A command already indexed is not embedded again.
+	if err := idx.IndexCommands([]string{"kubectl rollout status deploy/web"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 embedding request, got %d", n)
+	}
+}
+
+func TestIndexCommandsParallel(t *testing.T) {
+	var inflight, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(50 * time.Millisecond)
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Write([]byte(`{"data":[`))
+		for i := range req.Input {
+			if i > 0 {
+				w.Write([]byte(","))
+			}
+			w.Write([]byte(`{"embedding":[1,0,0],"index":` + strconv.Itoa(i) + `}`))
+		}
+		w.Write([]byte(`]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	idx := NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 1000, time.Hour, "")
+	idx.SetScheduler(NewScheduler(4))
+	idx.SetParallelism(2)
+	cmds := make([]string, 6*indexBatchSize)
+	for i := range cmds {
+		cmds[i] = "echo " + strconv.Itoa(i)
+	}
+	if err := idx.IndexCommands(cmds); err != nil {
+		t.Fatal(err)
+	}
+	if idx.graph.Len() != len(cmds) {
+		t.Fatalf("expected %d indexed commands, got %d", len(cmds), idx.graph.Len())
+	}
+	if p := peak.Load(); p != 2 {
+		t.Errorf("expected 2 embedding requests at once, got %d", p)
+	}
+}
+
+func TestExcludePatterns(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), ".zsh_history")
+	content := ": 1:0;vault kv get secret/db\n: 2:0;make test\n: 3:0;op run -- ./deploy\n: 4:0;git status\n"
+	if err := os.WriteFile(hist, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	srv := newEmbeddingServer(t, &calls)
+	path := filepath.Join(t.TempDir(), "embeddings.db")
+
+	// Commands embedded before a pattern matched them are dropped from
+	// the cache.
+	idx := NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, hist)
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.IndexHistory(); err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	idx = NewIndexerForHistory(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, hist)
+	defer idx.Close()
+	idx.SetExcludePatterns([]string{"vault", "^op run", "("})
+	if err := idx.OpenCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.IndexHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.IndexCommands([]string{"vault login"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := idx.RecentCommands(10)
+	slices.Sort(got)
+	if want := []string{"git status", "make test"}; !slices.Equal(got, want) {
+		t.Errorf("RecentCommands = %q, want %q", got, want)
+	}
+	var indexed []string
+	for _, cmd := range idx.commands {
+		indexed = append(indexed, cmd)
+	}
+	slices.Sort(indexed)
+	if want := []string{"git status", "make test"}; !slices.Equal(indexed, want) {
+		t.Errorf("indexed commands = %q, want %q", indexed, want)
+	}
+	if idx.graph.Len() != 2 {
+		t.Errorf("expected 2 embedded commands, got %d", idx.graph.Len())
+	}
+	var cachedRows int
+	if err := idx.cache.db.QueryRow(`SELECT COUNT(*) FROM commands`).Scan(&cachedRows); err != nil {
+		t.Fatal(err)
+	}
+	if cachedRows != 2 {
+		t.Errorf("expected excluded commands to leave the cache, got %d rows", cachedRows)
+	}
+}
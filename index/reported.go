@@ -0,0 +1,88 @@
+package index
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Paranoid-AF/ashlet/core"
+)
+
+// reportedMaxEntries caps the commands a reported history keeps; older
+// ones are dropped when the file is compacted.
+const reportedMaxEntries = 10000
+
+// reportedEntry is one line of a reported history file.
+type reportedEntry struct {
+	Time       time.Time `json:"time"`
+	Command    string    `json:"command"`
+	Cwd        string    `json:"cwd,omitempty"`
+	ExitCode   int       `json:"exit_code"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Session    string    `json:"session,omitempty"`
+}
+
+// ReportedHistory is the history the shell reports as commands finish,
+// instead of ashlet reading the shell's history files. It is kept as JSON
+// lines in a file of its own, commands redacted, so it survives restarts
+// without depending on a history format.
+type ReportedHistory struct {
+	mu  sync.RWMutex
+	log *CappedLog[reportedEntry]
+}
+
+// NewReportedHistory opens the reported history at path, loading the
+// commands reported before. An empty path keeps it in memory only.
+func NewReportedHistory(path string) *ReportedHistory {
+	return &ReportedHistory{
+		log: OpenCappedLog("reported history", path, reportedMaxEntries, func(e reportedEntry) bool {
+			return e.Command != ""
+		}),
+	}
+}
+
+// Add records a command that finished. Commands with a leading space,
+// which the shell keeps out of history, are not recorded.
+func (h *ReportedHistory) Add(entry HistoryEntry) {
+	if strings.HasPrefix(entry.Command, " ") {
+		return
+	}
+	cmd := core.RedactCommand(strings.TrimSpace(entry.Command))
+	if cmd == "" {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	added := reportedEntry{
+		Time:       entry.Time,
+		Command:    cmd,
+		Cwd:        entry.Cwd,
+		ExitCode:   entry.ExitCode,
+		DurationMs: entry.Duration.Milliseconds(),
+		Session:    entry.Session,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.log.Append(added)
+}
+
+// Last implements HistorySource.
+func (h *ReportedHistory) Last(n int) []HistoryEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	tail := h.log.Last(n)
+	entries := make([]HistoryEntry, len(tail))
+	for i, e := range tail {
+		entries[i] = HistoryEntry{
+			Command:  e.Command,
+			Time:     e.Time,
+			Cwd:      e.Cwd,
+			ExitCode: e.ExitCode,
+			Duration: time.Duration(e.DurationMs) * time.Millisecond,
+			Session:  e.Session,
+		}
+	}
+	return entries
+}
@@ -0,0 +1,68 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportedHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "history.jsonl")
+	h := NewReportedHistory(path)
+	h.Add(HistoryEntry{Command: "make test", Cwd: "/repo", ExitCode: 2, Duration: 1500 * time.Millisecond, Session: "1"})
+	h.Add(HistoryEntry{Command: " export TOKEN=x"})
+	h.Add(HistoryEntry{Command: "API_KEY=hunter2 ./deploy"})
+
+	// A restart reads the reported commands back.
+	got := NewReportedHistory(path).Last(10)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 reported commands, got %+v", got)
+	}
+	if e := got[0]; e.Command != "make test" || e.Cwd != "/repo" || e.ExitCode != 2 || e.Duration != 1500*time.Millisecond || e.Session != "1" {
+		t.Errorf("reported entry = %+v", e)
+	}
+	if strings.Contains(got[1].Command, "hunter2") {
+		t.Errorf("reported commands should be redacted, got %q", got[1].Command)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "TOKEN") {
+		t.Error("commands with a leading space should not be recorded")
+	}
+}
+
+func TestReportedHistoryCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	h := NewReportedHistory(path)
+	h.log.max = 10
+	for i := range 12 {
+		h.Add(HistoryEntry{Command: "echo " + string(rune('a'+i))})
+	}
+	var cmds []string
+	for _, e := range NewReportedHistory(path).Last(3) {
+		cmds = append(cmds, e.Command)
+	}
+	if !slices.Equal(cmds, []string{"echo j", "echo k", "echo l"}) {
+		t.Errorf("last reported commands = %q", cmds)
+	}
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 10 {
+		t.Errorf("compacted file has %d lines, want 10", n)
+	}
+}
+
+func TestRecentInReportedHistory(t *testing.T) {
+	h := NewReportedHistory("")
+	h.Add(HistoryEntry{Command: "go test ./...", Cwd: "/repo"})
+	h.Add(HistoryEntry{Command: "make lint", Cwd: "/repo", ExitCode: 1})
+	h.Add(HistoryEntry{Command: "ls", Cwd: "/tmp"})
+	idx := NewIndexerForSource(nil, 100, time.Hour, h)
+	if got := idx.RecentIn("/repo", 5); !slices.Equal(got, []string{"go test ./..."}) {
+		t.Errorf("RecentIn = %q", got)
+	}
+}
@@ -0,0 +1,81 @@
+package index
+
+import (
+	"context"
+	"sync"
+)
+
+// Priority orders work competing for CPU and the provider's rate limit.
+type Priority int
+
+const (
+	// PriorityBackground is work nobody is waiting on: indexing,
+	// re-embedding, and directory warm-ups.
+	PriorityBackground Priority = iota
+	// PriorityInteractive is a completion a user is waiting for.
+	PriorityInteractive
+)
+
+// Scheduler lets interactive work preempt background work. Interactive
+// work never waits; background work waits while any interactive work is
+// running and for one of a fixed number of background slots. Background
+// tasks acquire per unit of work (e.g. per embedding batch), so a long job
+// pauses between units rather than holding up a completion. A nil
+// Scheduler runs everything immediately.
+type Scheduler struct {
+	maxBackground int
+
+	mu          sync.Mutex
+	interactive int
+	background  int
+	changed     chan struct{} // closed and replaced whenever work finishes
+}
+
+// NewScheduler creates a scheduler running at most maxBackground
+// background tasks at once.
+func NewScheduler(maxBackground int) *Scheduler {
+	if maxBackground < 1 {
+		maxBackground = 1
+	}
+	return &Scheduler{maxBackground: maxBackground, changed: make(chan struct{})}
+}
+
+// Acquire waits until work at priority p may run and returns a function to
+// call when it is done. It returns ctx's error if ctx ends while waiting.
+func (s *Scheduler) Acquire(ctx context.Context, p Priority) (release func(), err error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	if p == PriorityInteractive {
+		s.interactive++
+	} else {
+		for s.interactive > 0 || s.background >= s.maxBackground {
+			changed := s.changed
+			s.mu.Unlock()
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			s.mu.Lock()
+		}
+		s.background++
+	}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() { once.Do(func() { s.release(p) }) }, nil
+}
+
+func (s *Scheduler) release(p Priority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p == PriorityInteractive {
+		s.interactive--
+	} else {
+		s.background--
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
@@ -0,0 +1,79 @@
+package index
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerBackgroundWaitsForInteractive(t *testing.T) {
+	s := NewScheduler(2)
+	releaseInteractive, err := s.Acquire(context.Background(), PriorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		release, err := s.Acquire(context.Background(), PriorityBackground)
+		if err == nil {
+			release()
+		}
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("background work ran while interactive work was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	releaseInteractive()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("background work did not resume after interactive work finished")
+	}
+}
+
+func TestSchedulerInteractiveNeverWaits(t *testing.T) {
+	s := NewScheduler(1)
+	releaseBackground, _ := s.Acquire(context.Background(), PriorityBackground)
+	defer releaseBackground()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	release, err := s.Acquire(ctx, PriorityInteractive)
+	if err != nil {
+		t.Fatalf("interactive acquire should not wait: %v", err)
+	}
+	release()
+}
+
+func TestSchedulerBackgroundSlots(t *testing.T) {
+	s := NewScheduler(1)
+	release, _ := s.Acquire(context.Background(), PriorityBackground)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Acquire(ctx, PriorityBackground); err == nil {
+		t.Fatal("second background task should wait for a free slot")
+	}
+
+	release()
+	release() // releasing twice is harmless
+	next, err := s.Acquire(context.Background(), PriorityBackground)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next()
+}
+
+func TestSchedulerNil(t *testing.T) {
+	var s *Scheduler
+	release, err := s.Acquire(context.Background(), PriorityBackground)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
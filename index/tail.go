@@ -0,0 +1,182 @@
+package index
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// tailDelay coalesces the writes of one history update (zsh appends a
+// line per command, Atuin writes its database and WAL) into one read.
+const tailDelay = 500 * time.Millisecond
+
+// historyTail follows a history source as it grows.
+type historyTail interface {
+	// paths returns the files whose changes may add entries.
+	paths() []string
+	// next returns the entries added since the last call, oldest first.
+	// reset reports that the history was rewritten rather than appended
+	// to (zsh truncating its file to SAVEHIST, say), so it must be read
+	// again in full.
+	next() (entries []HistoryEntry, reset bool)
+}
+
+// tail returns a follower of the indexer's history, starting at its
+// current end, or nil when the history cannot be followed.
+func (idx *Indexer) tail() historyTail {
+	src := idx.history
+	if src == nil && idx.historyPath != "" {
+		src = fileHistory{path: idx.historyPath}
+	}
+	return tailSource(src)
+}
+
+func tailSource(src HistorySource) historyTail {
+	switch src := src.(type) {
+	case fileHistory:
+		t := &fileTail{path: src.path, open: src.open}
+		t.seekEnd()
+		return t
+	case mergedHistory:
+		var m mergedTail
+		for _, s := range src {
+			if t := tailSource(s); t != nil {
+				m = append(m, t)
+			}
+		}
+		return m
+	case atuinHistory:
+		t := &atuinTail{h: src}
+		if last := src.Last(1); len(last) > 0 {
+			t.after = last[0].Time.UnixNano()
+		}
+		return t
+	}
+	return nil
+}
+
+// fileTail follows a history file by the offset read up to.
+type fileTail struct {
+	path   string
+	open   func(string) (*os.File, error) // nil = os.Open
+	offset int64
+	info   os.FileInfo // the file read, to tell when it is replaced
+}
+
+func (t *fileTail) seekEnd() {
+	t.info, _ = os.Stat(t.path)
+	t.offset = 0
+	if t.info != nil {
+		t.offset = t.info.Size()
+	}
+}
+
+func (t *fileTail) paths() []string { return []string{t.path} }
+
+func (t *fileTail) next() ([]HistoryEntry, bool) {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return nil, false
+	}
+	if t.info == nil || !os.SameFile(t.info, info) || info.Size() < t.offset {
+		t.seekEnd()
+		return nil, true
+	}
+	t.info = info
+	if info.Size() == t.offset {
+		return nil, false
+	}
+
+	f, err := openWith(t.open, t.path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	data := make([]byte, info.Size()-t.offset)
+	n, err := f.ReadAt(data, t.offset)
+	if err != nil && err != io.EOF {
+		return nil, false
+	}
+	// Leave a line still being written for the next read.
+	end := bytes.LastIndexByte(data[:n], '\n') + 1
+	if end == 0 {
+		return nil, false
+	}
+	t.offset += int64(end)
+
+	entries := parseHistoryLines(strings.Split(string(data[:end-1]), "\n"))
+	datePlainEntries(entries, t.path)
+	return entries, false
+}
+
+// mergedTail follows several history files.
+type mergedTail []historyTail
+
+func (m mergedTail) paths() []string {
+	var paths []string
+	for _, t := range m {
+		paths = append(paths, t.paths()...)
+	}
+	return paths
+}
+
+func (m mergedTail) next() ([]HistoryEntry, bool) {
+	var entries []HistoryEntry
+	reset := false
+	for _, t := range m {
+		added, r := t.next()
+		entries = append(entries, added...)
+		reset = reset || r
+	}
+	slices.SortStableFunc(entries, func(a, b HistoryEntry) int { return a.Time.Compare(b.Time) })
+	return entries, reset
+}
+
+// atuinTail follows an Atuin database by the time of the latest entry read.
+type atuinTail struct {
+	h     atuinHistory
+	after int64 // Unix nanoseconds
+}
+
+func (t *atuinTail) paths() []string {
+	path := t.h.path
+	// Atuin writes through SQLite's write-ahead log.
+	return []string{path, path + "-wal"}
+}
+
+func (t *atuinTail) next() ([]HistoryEntry, bool) {
+	entries := t.h.since(t.after)
+	if len(entries) > 0 {
+		t.after = entries[len(entries)-1].Time.UnixNano()
+	}
+	return entries, false
+}
+
+// watchFiles watches the directories holding paths, so files that do not
+// exist yet or are replaced by a rename are followed too. Events for other
+// files in those directories must be filtered out by the caller.
+func watchFiles(paths []string) (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if slices.Contains(dirs, dir) {
+			continue
+		}
+		dirs = append(dirs, dir)
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
@@ -0,0 +1,126 @@
+package index
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tailCommands(t *testing.T, tail historyTail) ([]string, bool) {
+	t.Helper()
+	entries, reset := tail.next()
+	var cmds []string
+	for _, entry := range entries {
+		cmds = append(cmds, entry.Command)
+	}
+	return cmds, reset
+}
+
+func TestFileTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".zsh_history")
+	appendFile(t, path, ": 1700000000:0;ls\n")
+
+	tail := tailSource(NewFileHistory(path))
+	if cmds, reset := tailCommands(t, tail); len(cmds) != 0 || reset {
+		t.Fatalf("tail read %q (reset %v) before any append", cmds, reset)
+	}
+
+	// A line still being written is read once complete.
+	appendFile(t, path, ": 1700000001:0;git status\n: 1700000002:0;make")
+	if cmds, _ := tailCommands(t, tail); !slices.Equal(cmds, []string{"git status"}) {
+		t.Errorf("after append = %q, want [git status]", cmds)
+	}
+	appendFile(t, path, " test\n")
+	if cmds, _ := tailCommands(t, tail); !slices.Equal(cmds, []string{"make test"}) {
+		t.Errorf("after completing the line = %q, want [make test]", cmds)
+	}
+
+	// Truncating the file, as zsh does when it trims history, resets.
+	if err := os.WriteFile(path, []byte(": 1700000003:0;pwd\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, reset := tailCommands(t, tail); !reset {
+		t.Error("expected a reset after the file shrank")
+	}
+	appendFile(t, path, ": 1700000004:0;whoami\n")
+	if cmds, _ := tailCommands(t, tail); !slices.Equal(cmds, []string{"whoami"}) {
+		t.Errorf("after reset = %q, want [whoami]", cmds)
+	}
+}
+
+func TestAtuinTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	writeAtuinDB(t, path, [][3]any{{"ls", "/tmp", 0}, {"rm -rf build", "/repo", 0}})
+
+	tail := tailSource(NewAtuinHistory(path))
+	if cmds, _ := tailCommands(t, tail); len(cmds) != 0 {
+		t.Fatalf("tail read %q before any insert", cmds)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stamp := time.Date(2026, 5, 1, 11, 0, 0, 0, time.UTC).UnixNano()
+	if _, err := db.Exec(`INSERT INTO history VALUES ('new', ?, 0, 0, 'git status', '/repo', 's1', 'laptop:me', NULL)`, stamp); err != nil {
+		t.Fatal(err)
+	}
+	if cmds, _ := tailCommands(t, tail); !slices.Equal(cmds, []string{"git status"}) {
+		t.Errorf("after insert = %q, want [git status]", cmds)
+	}
+	if cmds, _ := tailCommands(t, tail); len(cmds) != 0 {
+		t.Errorf("read %q again", cmds)
+	}
+}
+
+func TestStartRefreshLoopFollowsHistory(t *testing.T) {
+	var calls atomic.Int32
+	srv := newEmbeddingServer(t, &calls)
+	path := filepath.Join(t.TempDir(), ".zsh_history")
+	appendFile(t, path, ": 1700000000:0;ls\n")
+
+	idx := NewIndexerForSource(NewEmbedder(srv.URL, "test-key", "test-model"), 100, time.Hour, NewFileHistory(path))
+	go idx.StartRefreshLoop()
+	defer idx.Close()
+	<-idx.InitDone()
+
+	appendFile(t, path, ": 1700000001:0;kubectl get pods\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		idx.mu.RLock()
+		_, ok := idx.commands[hashCommand("kubectl get pods")]
+		n := idx.graph.Len()
+		idx.mu.RUnlock()
+		if ok {
+			if n != 2 {
+				t.Errorf("expected 2 indexed commands, got %d", n)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("appended command was not indexed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Only the appended command was embedded after the initial indexing.
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected 2 embedding requests, got %d", n)
+	}
+}
@@ -0,0 +1,196 @@
+package index
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+const (
+	// usageDays is how many days of usage are kept, today included.
+	usageDays = 90
+	// usageSaveInterval limits how often the usage file is rewritten;
+	// Flush writes what is left on shutdown.
+	usageSaveInterval = time.Minute
+)
+
+// Tokens is the usage an API reports for one request.
+type Tokens struct {
+	Prompt     int
+	Completion int
+	// Cost is the request's price in the provider's currency, for
+	// providers that report it (OpenRouter); 0 otherwise.
+	Cost float64
+}
+
+// UsageStore accumulates API token usage per day, kind ("generation" or
+// "embedding"), and model, and keeps it on disk so users can see what
+// completion costs them. It is safe for concurrent use; a nil store records
+// nothing.
+type UsageStore struct {
+	path string // empty = in-memory only
+
+	mu    sync.Mutex
+	stats map[usageKey]*ashlet.UsageStats
+	dirty bool
+	saved time.Time
+	now   func() time.Time
+}
+
+type usageKey struct {
+	date, kind, model string
+}
+
+// usageFile is the on-disk format of the usage store.
+type usageFile struct {
+	Version int                 `json:"version"`
+	Usage   []ashlet.UsageStats `json:"usage"`
+}
+
+// NewUsageStore opens the usage store at path, loading existing totals. An
+// empty path keeps usage in memory only.
+func NewUsageStore(path string) *UsageStore {
+	s := &UsageStore{path: path, stats: make(map[usageKey]*ashlet.UsageStats), now: time.Now}
+	if path == "" {
+		return s
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("failed to read usage", "path", path, "error", err)
+		}
+		return s
+	}
+	var f usageFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		slog.Warn("failed to parse usage", "path", path, "error", err)
+		return s
+	}
+	for _, u := range f.Usage {
+		s.stats[usageKey{u.Date, u.Kind, u.Model}] = &u
+	}
+	return s
+}
+
+// Record adds one request's usage for model to today's totals.
+func (s *UsageStore) Record(kind, model string, t Tokens) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	key := usageKey{now.Format(time.DateOnly), kind, model}
+	u := s.stats[key]
+	if u == nil {
+		u = &ashlet.UsageStats{Date: key.date, Kind: kind, Model: model}
+		s.stats[key] = u
+		s.pruneLocked(now)
+	}
+	u.Requests++
+	u.PromptTokens += t.Prompt
+	u.CompletionTokens += t.Completion
+	u.Cost += t.Cost
+	s.dirty = true
+
+	if now.Sub(s.saved) >= usageSaveInterval {
+		s.saveLocked(now)
+	}
+}
+
+// Stats returns the recorded usage, most recent day first, then by kind
+// and model.
+func (s *UsageStore) Stats() []ashlet.UsageStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedLocked()
+}
+
+// Today returns today's usage of kind, summed over models.
+func (s *UsageStore) Today(kind string) Tokens {
+	var t Tokens
+	if s == nil {
+		return t
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	date := s.now().Format(time.DateOnly)
+	for key, u := range s.stats {
+		if key.date == date && key.kind == kind {
+			t.Prompt += u.PromptTokens
+			t.Completion += u.CompletionTokens
+			t.Cost += u.Cost
+		}
+	}
+	return t
+}
+
+// Flush writes unsaved usage to disk.
+func (s *UsageStore) Flush() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dirty {
+		s.saveLocked(s.now())
+	}
+}
+
+func (s *UsageStore) sortedLocked() []ashlet.UsageStats {
+	out := make([]ashlet.UsageStats, 0, len(s.stats))
+	for _, u := range s.stats {
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Date != out[j].Date {
+			return out[i].Date > out[j].Date
+		}
+		if out[i].Kind != out[j].Kind {
+			return out[i].Kind > out[j].Kind // generation before embedding
+		}
+		return out[i].Model < out[j].Model
+	})
+	return out
+}
+
+// pruneLocked drops the days older than usageDays.
+func (s *UsageStore) pruneLocked(now time.Time) {
+	cutoff := now.AddDate(0, 0, 1-usageDays).Format(time.DateOnly)
+	for key := range s.stats {
+		if key.date < cutoff {
+			delete(s.stats, key)
+		}
+	}
+}
+
+func (s *UsageStore) saveLocked(now time.Time) {
+	s.saved = now
+	s.dirty = false
+	if s.path == "" {
+		return
+	}
+	data, err := json.Marshal(usageFile{Version: 1, Usage: s.sortedLocked()})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	}
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		slog.Warn("failed to save usage", "path", s.path, "error", err)
+	}
+}
@@ -0,0 +1,58 @@
+package index
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	day := time.Date(2026, 3, 14, 12, 0, 0, 0, time.Local)
+	s := NewUsageStore(path)
+	s.now = func() time.Time { return day }
+
+	s.Record("generation", "m", Tokens{Prompt: 100, Completion: 10, Cost: 0.001})
+	s.Record("generation", "m", Tokens{Prompt: 50, Completion: 5, Cost: 0.0005})
+	s.Record("embedding", "e", Tokens{Prompt: 8})
+	day = day.AddDate(0, 0, 1)
+	s.Record("generation", "m", Tokens{Prompt: 1, Completion: 1})
+
+	if got := s.Today("generation"); got.Prompt != 1 || got.Completion != 1 {
+		t.Errorf("today = %+v, want only today's generation usage", got)
+	}
+
+	stats := s.Stats()
+	if len(stats) != 3 {
+		t.Fatalf("stats = %+v, want 3 day/model totals", stats)
+	}
+	if got := stats[0]; got.Date != "2026-03-15" || got.Requests != 1 {
+		t.Errorf("first total = %+v, want the latest day", got)
+	}
+	if got := stats[1]; got.Kind != "generation" || got.Requests != 2 || got.PromptTokens != 150 || got.CompletionTokens != 15 || got.Cost < 0.0015-1e-9 {
+		t.Errorf("generation total = %+v", got)
+	}
+	if got := stats[2]; got.Kind != "embedding" || got.PromptTokens != 8 {
+		t.Errorf("embedding total = %+v", got)
+	}
+
+	// Totals survive a restart once flushed.
+	s.Flush()
+	if reloaded := NewUsageStore(path).Stats(); len(reloaded) != 3 || reloaded[1] != stats[1] {
+		t.Errorf("reloaded stats = %+v, want %+v", reloaded, stats)
+	}
+
+	// Old days are dropped.
+	day = day.AddDate(0, 0, usageDays)
+	s.Record("generation", "m", Tokens{Prompt: 1})
+	if stats := s.Stats(); len(stats) != 1 {
+		t.Errorf("stats = %+v, want only the latest day", stats)
+	}
+
+	var nilStore *UsageStore
+	nilStore.Record("generation", "m", Tokens{Prompt: 1})
+	nilStore.Flush()
+	if nilStore.Stats() != nil || nilStore.Today("generation") != (Tokens{}) {
+		t.Error("nil store should report nothing")
+	}
+}
@@ -0,0 +1,112 @@
+package ashlet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configMigration upgrades a raw config.json object by one version. It
+// edits cfg in place and returns notes on what it changed, shown as
+// config warnings.
+type configMigration func(cfg map[string]any) []string
+
+// configMigrations holds the upgrade from each version to the next: entry
+// i upgrades version i to i+1, so the current version is its length. Add
+// an entry, and adjust default_config.json's version, with each breaking
+// change to the config format.
+var configMigrations = []configMigration{
+	// Version 0 is a config written before the version field existed; its
+	// fields are read the same way.
+	func(map[string]any) []string { return nil },
+}
+
+// ConfigVersion is the config.json format version this build reads.
+var ConfigVersion = len(configMigrations)
+
+// deprecatedConfigFields maps dotted paths of config fields that are
+// still read but should no longer be used to advice on what to use
+// instead.
+var deprecatedConfigFields = map[string]string{}
+
+// migrateConfig upgrades data to the latest version in migrations. It
+// returns the upgraded JSON (nil when data is already current), the
+// version data had, and notes for the user. Deprecated fields are noted
+// whether or not an upgrade was needed.
+func migrateConfig(data []byte, migrations []configMigration) (out []byte, from int, notes []string, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // keep numbers as written
+	var raw map[string]any
+	if err := dec.Decode(&raw); err != nil {
+		return nil, 0, nil, err
+	}
+
+	if v, ok := raw["version"].(json.Number); ok {
+		n, err := strconv.Atoi(v.String())
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("invalid config version %s", v)
+		}
+		from = n
+	}
+	latest := len(migrations)
+	switch {
+	case from > latest:
+		notes = append(notes, fmt.Sprintf("config version %d is newer than this ashlet supports (%d); some settings may be ignored", from, latest))
+	case from < latest:
+		for v := from; v < latest; v++ {
+			notes = append(notes, migrations[v](raw)...)
+		}
+		raw["version"] = latest
+		out, err = json.MarshalIndent(raw, "", "  ")
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		out = append(out, '\n')
+	}
+
+	for path, advice := range deprecatedConfigFields {
+		if hasConfigField(raw, path) {
+			notes = append(notes, path+" is deprecated; "+advice)
+		}
+	}
+	return out, from, notes, nil
+}
+
+// hasConfigField reports whether the dotted path (e.g.
+// "generation.model") is set in cfg.
+func hasConfigField(cfg map[string]any, path string) bool {
+	var node any = cfg
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := node.(map[string]any)
+		if !ok {
+			return false
+		}
+		if node, ok = obj[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// migrateConfigFile upgrades the config at path, whose contents are data,
+// and returns the contents to load. The old file is kept next to it as
+// config.json.v<version>.bak. If the upgrade cannot be written, the
+// upgraded config is still used and a note says so.
+func migrateConfigFile(path string, data []byte) ([]byte, []string, error) {
+	out, from, notes, err := migrateConfig(data, configMigrations)
+	if err != nil || out == nil {
+		return data, notes, err
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", path, from)
+	if err := os.WriteFile(backup, data, 0600); err != nil {
+		return out, append(notes, "could not back up config before upgrading it: "+err.Error()), nil
+	}
+	if err := os.WriteFile(path, out, 0600); err != nil {
+		return out, append(notes, "could not save upgraded config: "+err.Error()), nil
+	}
+	return out, append(notes, fmt.Sprintf("upgraded config from version %d to %d; the old file is at %s", from, len(configMigrations), backup)), nil
+}
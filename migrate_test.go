@@ -0,0 +1,127 @@
+package ashlet
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDefaultConfigIsCurrentVersion(t *testing.T) {
+	if got := DefaultConfig().Version; got != ConfigVersion {
+		t.Errorf("default_config.json version = %d, want %d", got, ConfigVersion)
+	}
+}
+
+func TestMigrateConfigRunsEachStep(t *testing.T) {
+	migrations := []configMigration{
+		func(map[string]any) []string { return nil },
+		func(cfg map[string]any) []string {
+			gen := cfg["generation"].(map[string]any)
+			gen["model"] = gen["llm"]
+			delete(gen, "llm")
+			return []string{"generation.llm was renamed to generation.model"}
+		},
+	}
+	out, from, notes, err := migrateConfig([]byte(`{"generation":{"llm":"m","max_tokens":120}}`), migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 {
+		t.Errorf("from = %d, want 0", from)
+	}
+	if !slices.Equal(notes, []string{"generation.llm was renamed to generation.model"}) {
+		t.Errorf("notes = %q", notes)
+	}
+	var cfg Config
+	if err := json.Unmarshal(out, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Version != 2 || cfg.Generation.Model != "m" || cfg.Generation.MaxTokens != 120 {
+		t.Errorf("migrated config = %+v", cfg)
+	}
+
+	// Only the steps after the file's version run.
+	out, _, notes, err = migrateConfig([]byte(`{"version":1,"generation":{"llm":"m"}}`), migrations[:1])
+	if err != nil || out != nil || notes != nil {
+		t.Errorf("current config should be left alone, got %s, %q, %v", out, notes, err)
+	}
+}
+
+func TestMigrateConfigNewerAndDeprecated(t *testing.T) {
+	deprecatedConfigFields["generation.old"] = "use generation.new instead"
+	defer delete(deprecatedConfigFields, "generation.old")
+
+	out, _, notes, err := migrateConfig([]byte(`{"version":9,"generation":{"old":true}}`), configMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil {
+		t.Error("a newer config should not be rewritten")
+	}
+	if len(notes) != 2 || !strings.Contains(notes[0], "newer") || !strings.Contains(notes[1], "generation.old is deprecated") {
+		t.Errorf("notes = %q", notes)
+	}
+}
+
+func TestLoadConfigFileUpgradesInPlace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	original := []byte(`{"generation":{"model":"custom"}}`)
+	if err := os.WriteFile(path, original, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Version != ConfigVersion || cfg.Generation.Model != "custom" {
+		t.Errorf("loaded config = %+v", cfg)
+	}
+	warnings := ValidateConfig(cfg)
+	if len(warnings) == 0 || !strings.Contains(warnings[0], "upgraded config from version 0") {
+		t.Errorf("warnings should report the upgrade, got %q", warnings)
+	}
+
+	backup, err := os.ReadFile(path + ".v0.bak")
+	if err != nil || string(backup) != string(original) {
+		t.Errorf("backup = %q, %v; want the original", backup, err)
+	}
+	upgraded, _ := os.ReadFile(path)
+	if !strings.Contains(string(upgraded), `"version": 1`) {
+		t.Errorf("config should be saved with its new version, got %s", upgraded)
+	}
+
+	// The upgraded file loads without further changes.
+	cfg, err = LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnings := ValidateConfig(cfg); len(warnings) != 0 && strings.Contains(warnings[0], "upgraded") {
+		t.Errorf("second load should not upgrade again, got %q", warnings)
+	}
+}
+
+func TestLoadConfigWithOwnerUpgradesInMemory(t *testing.T) {
+	p := Paths{Home: t.TempDir(), Owner: strconv.Itoa(os.Getuid())}
+	os.MkdirAll(p.ConfigDir(), 0700)
+	original := []byte(`{"generation":{"model":"custom"}}`)
+	if err := os.WriteFile(p.ConfigPath(), original, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := p.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Version != ConfigVersion || cfg.Generation.Model != "custom" {
+		t.Errorf("loaded config = %+v", cfg)
+	}
+	if data, _ := os.ReadFile(p.ConfigPath()); string(data) != string(original) {
+		t.Errorf("config of another user should not be rewritten, got %s", data)
+	}
+	if _, err := os.Stat(p.ConfigPath() + ".v0.bak"); !os.IsNotExist(err) {
+		t.Error("no backup should be written for another user")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package ashlet
+
+import (
+	"fmt"
+	"os"
+)
+
+// openOwned cannot tell who owns a file on this platform, so it refuses
+// every file.
+func openOwned(path, owner string) (*os.File, error) {
+	return nil, fmt.Errorf("%s: %w", path, errNotOwned)
+}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package ashlet
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// openOwned opens the regular file at path for reading when the user with
+// uid owner owns it. Ownership is checked on the opened file, so the path
+// cannot be swapped between the check and the read. Special files are
+// refused before they are opened, and O_NONBLOCK keeps a FIFO swapped in
+// afterwards from blocking the open.
+func openOwned(path, owner string) (*os.File, error) {
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: %w", path, errNotOwned)
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.Mode().IsRegular() || strconv.FormatUint(uint64(st.Uid), 10) != owner {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, errNotOwned)
+	}
+	return f, nil
+}
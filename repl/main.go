@@ -42,7 +42,7 @@ func main() {
 	// Embedding cache in project root .cache/
 	cacheDir := filepath.Join(cwd, ".cache")
 	os.MkdirAll(cacheDir, 0755)
-	cachePath := filepath.Join(cacheDir, "embeddings.json")
+	cachePath := filepath.Join(cacheDir, "embeddings.db")
 
 	fmt.Fprintf(tty, "\033[2J\033[H") // clear screen
 	fmt.Fprintf(tty, "ashlet repl\r\n")
@@ -54,15 +54,10 @@ func main() {
 	engine := generate.NewEngine()
 	defer engine.Close()
 
-	// Load previous embedding cache before the refresh loop gets far.
-	if err := engine.LoadIndexCache(cachePath); err != nil {
-		slog.Debug("no embedding cache loaded", "error", err)
+	// Reuse the embeddings of earlier runs before the refresh loop gets far.
+	if err := engine.OpenIndexCache(cachePath); err != nil {
+		slog.Debug("no embedding cache opened", "error", err)
 	}
-	defer func() {
-		if err := engine.SaveIndexCache(cachePath); err != nil {
-			slog.Warn("failed to save embedding cache", "error", err)
-		}
-	}()
 
 	engine.WarmContext(context.Background(), cwd)
 
@@ -127,6 +122,16 @@ func main() {
 					cursor = fmt.Sprintf("%d", *c.CursorPos)
 				}
 				fmt.Fprintf(tty, "  %d. [%.2f] %s (cursor: %s)\r\n", i+1, c.Confidence, c.Completion, cursor)
+				if c.Danger != "" {
+					fmt.Fprintf(tty, "     ⚠ %s\r\n", c.Danger)
+				}
+				if s := c.Score; s != nil {
+					fmt.Fprintf(tty, "     position %.2f, quote %.2f, frequency %.2f, learned %+.2f", s.Position, s.QuoteExtension, s.Frequency, s.Learned)
+					if len(s.Penalties) > 0 {
+						fmt.Fprintf(tty, "; %s", strings.Join(s.Penalties, ", "))
+					}
+					fmt.Fprintf(tty, "\r\n")
+				}
 			}
 		}
 		fmt.Fprintf(tty, "\r\n")
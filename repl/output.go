@@ -53,12 +53,12 @@ func writeContext(w io.Writer, result *generate.CompleteResult) {
 
 	if result.DirContext != nil {
 		dc := result.DirContext
-		if dc.CwdListing != "" || dc.PackageManager != "" {
+		if dc.CwdListing != "" || dc.PackageManager != "" || dc.Nix != "" || dc.Terraform != "" || dc.Languages != "" {
 			hasContext = true
 		}
 	}
 	if result.Info != nil {
-		if len(result.Info.RecentCommands) > 0 || len(result.Info.RelevantCommands) > 0 {
+		if len(result.Info.RecentCommands) > 0 || len(result.Info.RelevantCommands) > 0 || result.Info.LastFailure != "" {
 			hasContext = true
 		}
 	}
@@ -76,6 +76,15 @@ func writeContext(w io.Writer, result *generate.CompleteResult) {
 		if dc.PackageManager != "" {
 			fmt.Fprintf(w, "package_manager = %s\n", tomlQuote(dc.PackageManager))
 		}
+		if dc.Nix != "" {
+			fmt.Fprintf(w, "nix = %s\n", tomlQuote(dc.Nix))
+		}
+		if dc.Terraform != "" {
+			fmt.Fprintf(w, "terraform = %s\n", tomlQuote(dc.Terraform))
+		}
+		if dc.Languages != "" {
+			fmt.Fprintf(w, "languages = %s\n", tomlQuote(dc.Languages))
+		}
 		if dc.GitRootListing != "" {
 			fmt.Fprintf(w, "project_files = %s\n", tomlQuote(dc.GitRootListing))
 		}
@@ -97,6 +106,9 @@ func writeContext(w io.Writer, result *generate.CompleteResult) {
 		if len(info.RelevantCommands) > 0 {
 			fmt.Fprintf(w, "relevant_commands = %s\n", tomlQuote(strings.Join(info.RelevantCommands, " | ")))
 		}
+		if info.LastFailure != "" {
+			fmt.Fprintf(w, "last_failure = %s\n", tomlQuote(info.LastFailure))
+		}
 	}
 
 	fmt.Fprintln(w)
@@ -118,6 +130,13 @@ func writeResponse(w io.Writer, resp *ashlet.Response) {
 		if c.CursorPos != nil {
 			fmt.Fprintf(w, "cursor_pos = %d\n", *c.CursorPos)
 		}
+		if c.Danger != "" {
+			fmt.Fprintf(w, "danger = %s\n", tomlQuote(c.Danger))
+		}
+		if s := c.Score; s != nil {
+			fmt.Fprintf(w, "score = { position = %.2f, quote_extension = %.2f, frequency = %.2f, learned = %.2f, penalties = [%s] }\n",
+				s.Position, s.QuoteExtension, s.Frequency, s.Learned, tomlList(s.Penalties))
+		}
 		fmt.Fprintln(w)
 	}
 }
@@ -133,6 +152,15 @@ func tomlBareKey(key string) string {
 	return bare
 }
 
+// tomlList returns the items of a TOML array of strings.
+func tomlList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = tomlQuote(item)
+	}
+	return strings.Join(quoted, ", ")
+}
+
 // tomlQuote returns a TOML basic-string quoted value.
 func tomlQuote(s string) string {
 	s = strings.ReplaceAll(s, "\\", "\\\\")
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// errPeerCredUnsupported is returned by peerUID on platforms without peer
+// credentials.
+var errPeerCredUnsupported = errors.New("peer credentials are not supported on this platform")
+
+// SetToken makes the server answer only messages carrying token in their
+// "token" field; empty serves every message. Call it before Serve.
+func (s *Server) SetToken(token string) {
+	s.token = token
+}
+
+// checkToken rejects raw unless it carries the server's token.
+func (s *Server) checkToken(raw []byte) *ashlet.Error {
+	if s.token == "" {
+		return nil
+	}
+	var msg struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(raw, &msg)
+	if subtle.ConstantTimeCompare([]byte(msg.Token), []byte(s.token)) != 1 {
+		if msg.Token == "" {
+			return &ashlet.Error{Code: "unauthorized", Message: "token required; set ASHLET_TOKEN"}
+		}
+		return &ashlet.Error{Code: "unauthorized", Message: "invalid token"}
+	}
+	return nil
+}
+
+// checkOwner rejects a Unix socket connection from a user other than the
+// daemon's. Where peer credentials are unavailable it relies on the socket
+// file's permissions.
+func (s *Server) checkOwner(conn net.Conn) error {
+	if _, ok := conn.(*net.UnixConn); !ok {
+		return nil
+	}
+	uid, err := peerUID(conn)
+	if errors.Is(err, errPeerCredUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if uid != s.ownerUID {
+		return fmt.Errorf("user %d may not use the daemon of user %d", uid, s.ownerUID)
+	}
+	return nil
+}
+
+// loadToken returns the token in file, or $ASHLET_TOKEN without one.
+func loadToken(file string) (string, error) {
+	if file == "" {
+		return os.Getenv("ASHLET_TOKEN"), nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		slog.Warn("token file is readable by other users", "path", file, "mode", info.Mode().Perm())
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", file)
+	}
+	return token, nil
+}
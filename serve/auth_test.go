@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// sendRaw sends line to the server at sockPath and returns its response.
+func sendRaw(t *testing.T, sockPath, line string) *ashlet.Response {
+	t.Helper()
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(line + "\n"))
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		t.Fatal("no response from server")
+	}
+	var resp ashlet.Response
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestHandleConnRequiresToken(t *testing.T) {
+	n := testSocketCounter.Add(1)
+	srv, err := NewServerWithCompleter(fmt.Sprintf("/tmp/ashlet-t%d.sock", n), &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{{Completion: "git status"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	srv.SetToken("s3cret")
+	go srv.Serve()
+
+	for _, line := range []string{
+		`{"request_id":1,"input":"git st"}`,
+		`{"token":"guess","request_id":1,"input":"git st"}`,
+		`{"token":"guess","action":"get"}`,
+	} {
+		if resp := sendRaw(t, srv.sockPath, line); resp.Error == nil || resp.Error.Code != "unauthorized" || len(resp.Candidates) != 0 {
+			t.Errorf("%s answered with %+v, want unauthorized", line, resp)
+		}
+	}
+	resp := sendRaw(t, srv.sockPath, `{"token":"s3cret","request_id":2,"input":"git st"}`)
+	if resp.Error != nil || resp.RequestID != 2 || len(resp.Candidates) != 1 {
+		t.Errorf("request with the token answered with %+v, want a candidate", resp)
+	}
+}
+
+func TestHandleConnRejectsOtherUsers(t *testing.T) {
+	if _, err := peerUID(nil); err == errPeerCredUnsupported {
+		t.Skip("peer credentials are not supported on this platform")
+	}
+	n := testSocketCounter.Add(1)
+	srv, err := NewServerWithCompleter(fmt.Sprintf("/tmp/ashlet-t%d.sock", n), &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	if info, err := os.Stat(srv.sockPath); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, want 0600", info.Mode().Perm())
+	}
+	srv.ownerUID = os.Getuid() + 1
+	go srv.Serve()
+
+	resp := sendRequest(t, srv.sockPath, &ashlet.Request{RequestID: 1, Input: "git st"})
+	if resp.Error == nil || resp.Error.Code != "unauthorized" {
+		t.Errorf("response to another user = %+v, want unauthorized", resp)
+	}
+}
+
+func TestLoadToken(t *testing.T) {
+	t.Setenv("ASHLET_TOKEN", "from-env")
+	if token, err := loadToken(""); err != nil || token != "from-env" {
+		t.Errorf("loadToken without a file = %q, %v; want $ASHLET_TOKEN", token, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(path, []byte("from-file\n"), 0600)
+	if token, err := loadToken(path); err != nil || token != "from-file" {
+		t.Errorf("loadToken(file) = %q, %v; want the file's token", token, err)
+	}
+	os.WriteFile(path, []byte("\n"), 0600)
+	if _, err := loadToken(path); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("loadToken(empty file) error = %v, want empty", err)
+	}
+}
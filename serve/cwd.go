@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// maxSessionCwds bounds the number of sessions whose cwd is remembered;
+// the least recently used is forgotten first. A forgotten session's next
+// request gets unknown_cwd_generation and resends its cwd.
+const maxSessionCwds = 1024
+
+// cwdEntry is the last cwd a session sent, with the generation it was
+// sent under.
+type cwdEntry struct {
+	generation int
+	cwd        string
+	used       uint64 // tick of the last request that used the entry
+}
+
+// cwdTable remembers each session's cwd so that clients need send it only
+// when it changes. A client numbers its cwds (cwd_generation) and sends
+// the path with the first request under a new number; later requests
+// carry only the number.
+type cwdTable struct {
+	mu      sync.Mutex
+	entries map[string]*cwdEntry
+	tick    uint64
+}
+
+func newCwdTable() *cwdTable {
+	return &cwdTable{entries: make(map[string]*cwdEntry)}
+}
+
+// resolve fills in req.Cwd for session sid from the table, or records it
+// when the request carries one. It reports false when the request names a
+// generation the table does not have, so the cwd is unknown. Requests
+// without a generation are left alone.
+func (t *cwdTable) resolve(sid string, req *ashlet.Request) bool {
+	if req.CwdGeneration <= 0 || sid == "" {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tick++
+
+	if req.Cwd != "" {
+		// Trimmed once here, so later requests reuse the clean path.
+		req.Cwd = strings.TrimRight(req.Cwd, "\n")
+		entry, ok := t.entries[sid]
+		if !ok {
+			t.evictLocked()
+			entry = &cwdEntry{}
+			t.entries[sid] = entry
+		}
+		if req.CwdGeneration >= entry.generation {
+			entry.generation, entry.cwd = req.CwdGeneration, req.Cwd
+		}
+		entry.used = t.tick
+		return true
+	}
+
+	entry, ok := t.entries[sid]
+	if !ok || entry.generation != req.CwdGeneration {
+		return false
+	}
+	entry.used = t.tick
+	req.Cwd = entry.cwd
+	return true
+}
+
+// evictLocked makes room for a new entry by dropping the least recently
+// used one when the table is full.
+func (t *cwdTable) evictLocked() {
+	if len(t.entries) < maxSessionCwds {
+		return
+	}
+	var oldest string
+	for sid, entry := range t.entries {
+		if oldest == "" || entry.used < t.entries[oldest].used {
+			oldest = sid
+		}
+	}
+	delete(t.entries, oldest)
+}
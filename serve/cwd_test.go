@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+func TestCwdTable(t *testing.T) {
+	table := newCwdTable()
+	resolve := func(sid, cwd string, generation int) (string, bool) {
+		req := &ashlet.Request{Cwd: cwd, CwdGeneration: generation}
+		ok := table.resolve(sid, req)
+		return req.Cwd, ok
+	}
+
+	if cwd, ok := resolve("1", "/tmp\n", 0); !ok || cwd != "/tmp\n" {
+		t.Errorf("requests without a generation should pass through, got %q, %v", cwd, ok)
+	}
+	if _, ok := resolve("1", "", 1); ok {
+		t.Error("an unknown generation should not resolve")
+	}
+	if cwd, ok := resolve("1", "/home/me/project\n", 1); !ok || cwd != "/home/me/project" {
+		t.Errorf("sending a cwd should record it trimmed, got %q, %v", cwd, ok)
+	}
+	if cwd, ok := resolve("1", "", 1); !ok || cwd != "/home/me/project" {
+		t.Errorf("resolve(1, gen 1) = %q, %v; want the recorded cwd", cwd, ok)
+	}
+	if _, ok := resolve("2", "", 1); ok {
+		t.Error("generations are per session")
+	}
+
+	resolve("1", "/srv", 2)
+	if _, ok := resolve("1", "", 1); ok {
+		t.Error("a superseded generation should not resolve")
+	}
+	// A late request from an older generation does not roll the cwd back.
+	resolve("1", "/home/me/project", 1)
+	if cwd, ok := resolve("1", "", 2); !ok || cwd != "/srv" {
+		t.Errorf("resolve(1, gen 2) = %q, %v; want /srv", cwd, ok)
+	}
+}
+
+func TestCwdTableEvicts(t *testing.T) {
+	table := newCwdTable()
+	for i := range maxSessionCwds {
+		table.resolve(strconv.Itoa(i), &ashlet.Request{Cwd: "/", CwdGeneration: 1})
+	}
+	table.resolve("0", &ashlet.Request{CwdGeneration: 1}) // session 1 is now the least recently used
+	table.resolve("new", &ashlet.Request{Cwd: "/", CwdGeneration: 1})
+	if len(table.entries) != maxSessionCwds {
+		t.Errorf("table holds %d sessions, want at most %d", len(table.entries), maxSessionCwds)
+	}
+	if table.entries["0"] == nil || table.entries["1"] != nil {
+		t.Error("the least recently used session should be evicted")
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/generate"
+)
+
+// End-to-end tests: a real daemon (server and engine) talks to a mock
+// generation provider, driven over its socket by a fake shell client.
+
+const (
+	// mockProviderDelay is how long the mock provider takes to answer; the
+	// fake shell types faster than this, so earlier requests are cancelled.
+	mockProviderDelay = 150 * time.Millisecond
+	// e2eLatencyBound is the longest a completion may take end to end
+	// beyond the provider's own delay.
+	e2eLatencyBound = 2 * time.Second
+	// e2eCancelBound is how soon a superseded request's connection must be
+	// closed after the request replacing it is sent.
+	e2eCancelBound = time.Second
+)
+
+// mockProvider is a chat completions API that always suggests the same
+// commands after a delay, counting the requests it sees and those the
+// daemon abandons before the answer.
+type mockProvider struct {
+	*httptest.Server
+	requests  atomic.Int64
+	abandoned atomic.Int64
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	p := &mockProvider{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.requests.Add(1)
+		// Reading the body lets the server notice the daemon hanging up.
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-time.After(mockProviderDelay):
+		case <-r.Context().Done():
+			p.abandoned.Add(1)
+			return
+		}
+		content := `<candidate type="replace"><command>git status</command></candidate>` +
+			`<candidate type="replace"><command>git stash list</command></candidate>`
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]any{{"message": map[string]string{"role": "assistant", "content": content}}},
+		})
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// newE2EDaemon starts a daemon for a fresh user whose config points at
+// provider.
+func newE2EDaemon(t *testing.T, provider *mockProvider) *Server {
+	t.Helper()
+	for _, env := range []string{"ASHLET_GENERATION_API_BASE_URL", "ASHLET_GENERATION_API_KEY", "ASHLET_GENERATION_MODEL", "ASHLET_EMBEDDING_API_KEY"} {
+		t.Setenv(env, "")
+	}
+	home := t.TempDir()
+	paths := ashlet.Paths{Home: home, State: t.TempDir()}
+	cfg := fmt.Sprintf(`{"version": %d, "generation": {"base_url": %q, "api_key": "test-key", "api_type": "chat_completions", "model": "test-model"}}`,
+		ashlet.ConfigVersion, provider.URL)
+	if err := os.MkdirAll(paths.ConfigDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(paths.ConfigPath(), []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	history := ": 1700000000:0;git pull\n: 1700000001:0;make test\n"
+	if err := os.WriteFile(filepath.Join(home, ".zsh_history"), []byte(history), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	n := testSocketCounter.Add(1)
+	srv, err := NewServer(fmt.Sprintf("/tmp/ashlet-e2e%d.sock", n), generate.EngineOptions{Paths: paths})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	go srv.Serve()
+	return srv
+}
+
+// fakeShell drives a daemon the way the zsh client does: one connection
+// per message, closed for writing once sent (as socat does), a new
+// completion request on every keystroke.
+type fakeShell struct {
+	t       *testing.T
+	sock    string
+	session string
+	cwd     string
+	nextID  int
+}
+
+// reply is what came back on one connection.
+type reply struct {
+	line    []byte // nil when the daemon closed the connection without answering
+	elapsed time.Duration
+}
+
+// send writes one message and waits for the daemon's single-line reply
+// or for it to close the connection.
+func (sh *fakeShell) send(msg any) reply {
+	sh.t.Helper()
+	conn, err := net.Dial("unix", sh.sock)
+	if err != nil {
+		sh.t.Fatal(err)
+	}
+	defer conn.Close()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		sh.t.Fatal(err)
+	}
+	start := time.Now()
+	conn.Write(append(data, '\n'))
+	conn.(*net.UnixConn).CloseWrite()
+	conn.SetReadDeadline(start.Add(mockProviderDelay + e2eLatencyBound))
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	r := reply{elapsed: time.Since(start)}
+	if err != nil {
+		if len(line) > 0 {
+			sh.t.Errorf("reply %q is not newline-terminated", line)
+		}
+		return r
+	}
+	if rest, _ := reader.ReadByte(); rest != 0 {
+		sh.t.Errorf("daemon wrote more than one line in reply to %s", data)
+	}
+	r.line = line
+	return r
+}
+
+// warm sends the context warm-up the client sends on cd.
+func (sh *fakeShell) warm() {
+	sh.t.Helper()
+	r := sh.send(&ashlet.ContextRequest{Type: "context", Cwd: sh.cwd})
+	var resp ashlet.ContextResponse
+	if err := json.Unmarshal(r.line, &resp); err != nil || !resp.OK {
+		sh.t.Fatalf("context warm-up = %s, %v; want ok", r.line, err)
+	}
+}
+
+// typeKeys sends a completion request for each prefix of text, gap apart
+// and without waiting for replies, and returns the replies by request ID
+// along with when each request was sent.
+func (sh *fakeShell) typeKeys(text string, gap time.Duration) (map[int]reply, map[int]time.Time) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	replies := make(map[int]reply)
+	sent := make(map[int]time.Time)
+	for i := 1; i <= len(text); i++ {
+		sh.nextID++
+		req := &ashlet.Request{
+			RequestID:     sh.nextID,
+			Input:         text[:i],
+			CursorPos:     i,
+			Cwd:           sh.cwd,
+			SessionID:     sh.session,
+			MaxCandidates: 4,
+		}
+		mu.Lock()
+		sent[req.RequestID] = time.Now()
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := sh.send(req)
+			mu.Lock()
+			replies[req.RequestID] = r
+			mu.Unlock()
+		}()
+		if i < len(text) {
+			time.Sleep(gap)
+		}
+	}
+	wg.Wait()
+	return replies, sent
+}
+
+// feedback reports what the user did with a candidate.
+func (sh *fakeShell) feedback(event, candidate string) {
+	sh.t.Helper()
+	r := sh.send(&ashlet.FeedbackRequest{Type: "feedback", Event: event, Candidate: candidate, Cwd: sh.cwd, SessionID: sh.session})
+	var resp ashlet.FeedbackResponse
+	if err := json.Unmarshal(r.line, &resp); err != nil || !resp.OK {
+		sh.t.Fatalf("feedback = %s, %v; want ok", r.line, err)
+	}
+}
+
+// checkCompletion asserts the protocol invariants of a completion reply
+// to input: it is JSON echoing the request ID, candidates is an array, and
+// each candidate's cursor, diff, and word ends are consistent with its text.
+func checkCompletion(t *testing.T, id int, input string, line []byte) *ashlet.Response {
+	t.Helper()
+	if !strings.Contains(string(line), `"candidates":[`) {
+		t.Errorf("reply %d lacks a candidates array: %s", id, line)
+	}
+	var resp ashlet.Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatalf("reply %d is not JSON: %v: %s", id, err, line)
+	}
+	if resp.RequestID != id {
+		t.Errorf("reply to request %d carries request_id %d", id, resp.RequestID)
+	}
+	for _, c := range resp.Candidates {
+		if c.CursorPos != nil && (*c.CursorPos < 0 || *c.CursorPos > len(c.Completion)) {
+			t.Errorf("candidate %q has cursor %d out of range", c.Completion, *c.CursorPos)
+		}
+		if c.Confidence < 0 || c.Confidence > 1 {
+			t.Errorf("candidate %q has confidence %v", c.Completion, c.Confidence)
+		}
+		d := c.Diff
+		if d == nil {
+			t.Errorf("candidate %q has no diff", c.Completion)
+			continue
+		}
+		if d.Replaced.End > len(input) || d.Inserted.End > len(c.Completion) ||
+			input[:d.Replaced.Start]+c.Completion[d.Inserted.Start:d.Inserted.End]+input[d.Replaced.End:] != c.Completion {
+			t.Errorf("diff %+v does not turn %q into %q", d, input, c.Completion)
+		}
+		if !slices.IsSorted(c.Words) || (len(c.Words) > 0 && (c.Words[0] <= d.Prefix || c.Words[len(c.Words)-1] > len(c.Completion))) {
+			t.Errorf("candidate %q has word ends %v out of range", c.Completion, c.Words)
+		}
+	}
+	return &resp
+}
+
+func TestE2EShellSession(t *testing.T) {
+	provider := newMockProvider(t)
+	srv := newE2EDaemon(t, provider)
+	sh := &fakeShell{t: t, sock: srv.sockPath, session: "4242", cwd: t.TempDir()}
+
+	sh.warm()
+
+	// A burst of keystrokes: only the last request is answered; the others
+	// are cancelled, their connections closed, and their provider calls
+	// abandoned.
+	const text = "git st"
+	replies, sent := sh.typeKeys(text, 10*time.Millisecond)
+	last := sh.nextID
+	for id, r := range replies {
+		if id == last {
+			continue
+		}
+		if r.line != nil {
+			t.Errorf("superseded request %d was answered: %s", id, r.line)
+		}
+		if closed := sent[id].Add(r.elapsed).Sub(sent[id+1]); closed > e2eCancelBound {
+			t.Errorf("superseded request %d was closed %v after its successor", id, closed)
+		}
+	}
+	final := replies[last]
+	if final.line == nil {
+		t.Fatalf("final request %d got no reply", last)
+	}
+	if final.elapsed > mockProviderDelay+e2eLatencyBound {
+		t.Errorf("final reply took %v", final.elapsed)
+	}
+	resp := checkCompletion(t, last, text, final.line)
+	if resp.Error != nil || len(resp.Candidates) == 0 {
+		t.Fatalf("final reply = %s, want candidates", final.line)
+	}
+	if !slices.ContainsFunc(resp.Candidates, func(c ashlet.Candidate) bool { return c.Completion == "git status" }) {
+		t.Errorf("candidates = %+v, want the provider's suggestions", resp.Candidates)
+	}
+	if resp.Meta == nil || resp.Meta.Model != "test-model" {
+		t.Errorf("meta = %+v, want the configured model", resp.Meta)
+	}
+	// Every provider call but the final one is abandoned (cancelled
+	// requests may also stop before reaching the provider).
+	deadline := time.Now().Add(e2eCancelBound)
+	for provider.requests.Load()-provider.abandoned.Load() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if completed := provider.requests.Load() - provider.abandoned.Load(); completed != 1 {
+		t.Errorf("provider answered %d calls, want only the final request's", completed)
+	}
+
+	// Accepting a candidate is recorded and can be recalled.
+	sh.feedback("accepted", "git status")
+	r := sh.send(&ashlet.RecallRequest{Type: "recall", Query: "git status"})
+	var recall ashlet.RecallResponse
+	if err := json.Unmarshal(r.line, &recall); err != nil || !recall.OK || len(recall.Entries) == 0 {
+		t.Fatalf("recall = %s, %v; want the accepted command", r.line, err)
+	}
+	if e := recall.Entries[0]; e.Command != "git status" || !e.Accepted {
+		t.Errorf("recall entry = %+v, want accepted git status", e)
+	}
+
+	// Requests sent one after another are each answered.
+	for _, input := range []string{"make", "git pu"} {
+		sh.nextID++
+		req := &ashlet.Request{RequestID: sh.nextID, Input: input, CursorPos: len(input), Cwd: sh.cwd, SessionID: sh.session}
+		r := sh.send(req)
+		if r.line == nil {
+			t.Fatalf("request %q got no reply", input)
+		}
+		checkCompletion(t, req.RequestID, input, r.line)
+	}
+}
+
+func TestE2EConcurrentSessions(t *testing.T) {
+	provider := newMockProvider(t)
+	srv := newE2EDaemon(t, provider)
+
+	// Sessions do not cancel each other: every shell's last keystroke is
+	// answered.
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sh := &fakeShell{t: t, sock: srv.sockPath, session: fmt.Sprint(1000 + i), cwd: t.TempDir(), nextID: i * 100}
+			replies, _ := sh.typeKeys("git s", 5*time.Millisecond)
+			final := replies[sh.nextID]
+			if final.line == nil {
+				t.Errorf("session %s: final request got no reply after %v", sh.session, final.elapsed)
+				return
+			}
+			checkCompletion(t, sh.nextID, "git s", final.line)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestE2ECwdGeneration(t *testing.T) {
+	provider := newMockProvider(t)
+	srv := newE2EDaemon(t, provider)
+	sh := &fakeShell{t: t, sock: srv.sockPath, session: "4343", cwd: t.TempDir()}
+
+	complete := func(cwd string) *ashlet.Response {
+		t.Helper()
+		sh.nextID++
+		r := sh.send(&ashlet.Request{RequestID: sh.nextID, Input: "git st", CursorPos: 6, Cwd: cwd, CwdGeneration: 1, SessionID: sh.session})
+		return checkCompletion(t, sh.nextID, "git st", r.line)
+	}
+
+	// The daemon has no cwd for generation 1 yet.
+	if resp := complete(""); resp.Error == nil || resp.Error.Code != "unknown_cwd_generation" {
+		t.Fatalf("first request without cwd = %+v, want unknown_cwd_generation", resp)
+	}
+	if resp := complete(sh.cwd); resp.Error != nil || len(resp.Candidates) == 0 {
+		t.Fatalf("request with cwd = %+v, want candidates", resp)
+	}
+	if resp := complete(""); resp.Error != nil || len(resp.Candidates) == 0 {
+		t.Fatalf("request reusing the cwd = %+v, want candidates", resp)
+	}
+}
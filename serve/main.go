@@ -4,12 +4,18 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
+
+	"github.com/Paranoid-AF/ashlet/generate"
 )
 
 // Version is set at build time via -ldflags.
@@ -18,6 +24,16 @@ var Version = "dev"
 func main() {
 	showVersion := flag.Bool("version", false, "print version and exit")
 	verbose := flag.Bool("verbose", false, "log every request and response to stdout")
+	system := flag.Bool("system", false, "serve all local users from one daemon (run as root)")
+	remote := flag.Bool("remote", false, "serve shells on other hosts over a forwarded socket (no local filesystem context, which system mode never has)")
+	audit := flag.Bool("audit", false, "keep a local log of everything sent to the APIs, as telemetry.audit_log does (not in system mode)")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Second, "on SIGTERM, how long to wait for running requests before cancelling them")
+	listenAddr := flag.String("listen", "", "listen on `addr`: a Unix socket path, or tcp://host:port or tls://host:port to serve other machines (default $ASHLET_SOCKET, else a per-user socket)")
+	tlsCert := flag.String("tls-cert", "", "server certificate `file` for a tls:// listen address")
+	tlsKey := flag.String("tls-key", "", "private key `file` of -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "only serve TLS clients with a certificate signed by a CA in `file` (mutual TLS)")
+	tokenFile := flag.String("token-file", "", "only answer clients sending the token in `file` (default $ASHLET_TOKEN; empty answers any client that can connect)")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics over HTTP at `addr`/metrics, e.g. 127.0.0.1:9464")
 	flag.Parse()
 
 	if *showVersion {
@@ -31,26 +47,66 @@ func main() {
 	}
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
 
-	socketPath := resolveSocketPath()
-
-	slog.Info("starting", "socket", socketPath)
+	token, err := loadToken(*tokenFile)
+	if err != nil {
+		slog.Error("failed to read token", "error", err)
+		os.Exit(1)
+	}
 
-	srv, err := NewServer(socketPath)
+	var srv *Server
+	if *system {
+		socketPath := cmp.Or(*listenAddr, resolveSystemSocketPath())
+		if _, tcp := cutTCPScheme(socketPath); tcp {
+			// Users are told apart by the peer credentials of a Unix socket.
+			slog.Error("system mode needs a Unix socket", "listen", socketPath)
+			os.Exit(1)
+		}
+		stateBase := resolveSystemStateDir()
+		group := os.Getenv("ASHLET_SOCKET_GROUP")
+		slog.Info("starting in system mode", "socket", socketPath, "state", stateBase, "group", group)
+		srv, err = NewSystemServer(socketPath, stateBase, group)
+	} else {
+		socketPath := cmp.Or(*listenAddr, resolveSocketPath())
+		slog.Info("starting", "socket", socketPath, "remote", *remote)
+		srv, err = NewServer(socketPath, generate.EngineOptions{NoLocalContext: *remote, AuditLog: *audit})
+		if err == nil {
+			if err = configureListener(srv, socketPath, *tlsCert, *tlsKey, *tlsClientCA, token); err != nil {
+				srv.Close()
+			}
+		}
+	}
 	if err != nil {
 		slog.Error("failed to start server", "error", err)
 		os.Exit(1)
 	}
 	defer srv.Close()
+	srv.SetToken(token)
 
-	// Handle graceful shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	if *metricsAddr != "" {
+		go func() {
+			if err := srv.ServeMetrics(*metricsAddr); err != nil {
+				slog.Error("metrics listener failed", "addr", *metricsAddr, "error", err)
+			}
+		}()
+	}
 
+	// Handle graceful shutdown: let running requests finish, then flush
+	// state to disk. A second signal exits at once.
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
 	go func() {
 		<-sigCh
-		slog.Info("shutting down")
-		srv.Close()
-		os.Exit(0)
+		slog.Info("shutting down", "drain_timeout", *drainTimeout)
+		go func() {
+			<-sigCh
+			slog.Warn("forced shutdown")
+			os.Exit(1)
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+		close(stopped)
 	}()
 
 	slog.Info("ready")
@@ -58,6 +114,7 @@ func main() {
 		slog.Error("server error", "error", err)
 		os.Exit(1)
 	}
+	<-stopped
 }
 
 func resolveSocketPath() string {
@@ -69,3 +126,25 @@ func resolveSocketPath() string {
 	}
 	return fmt.Sprintf("/tmp/ashlet-%d.sock", os.Getuid())
 }
+
+// resolveSystemSocketPath returns the socket for system mode, creating its
+// directory if needed.
+func resolveSystemSocketPath() string {
+	path := os.Getenv("ASHLET_SOCKET")
+	if path == "" {
+		path = "/run/ashlet/ashlet.sock"
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		slog.Warn("failed to create socket directory", "error", err)
+	}
+	return path
+}
+
+// resolveSystemStateDir returns the base directory for per-user state in
+// system mode: $ASHLET_STATE_DIR > /var/lib/ashlet.
+func resolveSystemStateDir() string {
+	if dir := os.Getenv("ASHLET_STATE_DIR"); dir != "" {
+		return dir
+	}
+	return "/var/lib/ashlet"
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// MetricsReporter is implemented by completers that count what their index
+// and caches hold.
+type MetricsReporter interface {
+	Metrics() ashlet.EngineMetrics
+}
+
+var (
+	// latencyBuckets are the upper bounds, in seconds, of the completion
+	// latency histogram.
+	latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10}
+	// candidateBuckets are the upper bounds of the histogram of candidates
+	// per completion.
+	candidateBuckets = []float64{0, 1, 2, 3, 5, 8}
+)
+
+// serverMetrics counts the requests a server has handled since it started.
+// The zero value is ready to use.
+type serverMetrics struct {
+	cancelled atomic.Int64 // completions superseded by a newer request of their session
+	inFlight  atomic.Int64 // completions being answered
+
+	mu         sync.Mutex
+	requests   map[string]int64            // message type -> requests
+	errors     map[string]int64            // error code -> completions answered with it
+	lastErrors map[int]*ashlet.StatusError // user (0 outside system mode) -> last completion error
+	latency    histogram
+	candidates histogram
+}
+
+// request counts a message of kind ("completion", "context", "config", ...).
+func (m *serverMetrics) request(kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = make(map[string]int64)
+	}
+	m.requests[kind]++
+}
+
+// completion records how a completion request of user uid that took
+// elapsed was answered. A nil resp means the early answer of a progressive
+// completion stood.
+func (m *serverMetrics) completion(ctx context.Context, uid int, resp *ashlet.Response, elapsed time.Duration) {
+	if ctx.Err() != nil {
+		m.cancelled.Add(1)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency.observe(latencyBuckets, elapsed.Seconds())
+	if resp == nil {
+		return
+	}
+	if resp.Error != nil {
+		if m.errors == nil {
+			m.errors = make(map[string]int64)
+		}
+		m.errors[resp.Error.Code]++
+		if m.lastErrors == nil {
+			m.lastErrors = make(map[int]*ashlet.StatusError)
+		}
+		m.lastErrors[uid] = &ashlet.StatusError{Time: time.Now(), Error: *resp.Error}
+		return
+	}
+	m.candidates.observe(candidateBuckets, float64(len(resp.Candidates)))
+}
+
+// histogram counts observations per bucket; bucket i counts those at most
+// bounds[i] and above bounds[i-1], the last one those above all bounds.
+type histogram struct {
+	counts []int64
+	sum    float64
+}
+
+func (h *histogram) observe(bounds []float64, v float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(bounds)+1)
+	}
+	i, _ := slices.BinarySearch(bounds, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+// write writes h as the Prometheus histogram name.
+func (h *histogram) write(w io.Writer, name, help string, bounds []float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var total int64
+	for i, bound := range bounds {
+		if h.counts != nil {
+			total += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(bound), total)
+	}
+	if h.counts != nil {
+		total += h.counts[len(bounds)]
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, total, name, formatFloat(h.sum), name, total)
+}
+
+// writeMetrics writes the server's counters, and those of engines, in the
+// Prometheus text exposition format. Engine counters are summed; provider
+// health is shared between engines, so each provider is reported once.
+func (s *Server) writeMetrics(w io.Writer, engines []Completer) {
+	m := &s.metrics
+	m.mu.Lock()
+	writeLabeled(w, "ashlet_requests_total", "Requests received, by message type.", "counter", "type", m.requests)
+	writeCounter(w, "ashlet_completions_cancelled_total", "Completion requests superseded by a newer request from the same shell.", m.cancelled.Load())
+	fmt.Fprintf(w, "# HELP ashlet_completions_in_flight Completion requests being answered.\n# TYPE ashlet_completions_in_flight gauge\nashlet_completions_in_flight %d\n", m.inFlight.Load())
+	writeLabeled(w, "ashlet_completion_errors_total", "Completion requests answered with an error, by error code.", "counter", "code", m.errors)
+	m.latency.write(w, "ashlet_completion_duration_seconds", "Time taken to answer completion requests.", latencyBuckets)
+	m.candidates.write(w, "ashlet_completion_candidates", "Candidates returned per successful completion.", candidateBuckets)
+	m.mu.Unlock()
+
+	var em ashlet.EngineMetrics
+	var providers []ashlet.ProviderHealth
+	var upgrades ashlet.UpgradeStats
+	for _, engine := range engines {
+		if mr, ok := engine.(MetricsReporter); ok {
+			got := mr.Metrics()
+			em.IndexedCommands += got.IndexedCommands
+			em.CacheRebuilds += got.CacheRebuilds
+			em.DirCacheHits += got.DirCacheHits
+			em.DirCacheMisses += got.DirCacheMisses
+		}
+		if ur, ok := engine.(UpgradeReporter); ok {
+			u := ur.UpgradeStats()
+			upgrades.Immediate += u.Immediate
+			upgrades.Upgraded += u.Upgraded
+			upgrades.Missed += u.Missed
+		}
+		if hr, ok := engine.(HealthReporter); ok {
+			for _, p := range hr.ProviderHealth() {
+				if !slices.ContainsFunc(providers, func(q ashlet.ProviderHealth) bool {
+					return q.Kind == p.Kind && q.Provider == p.Provider && q.Model == p.Model
+				}) {
+					providers = append(providers, p)
+				}
+			}
+		}
+	}
+	writeLabeled(w, "ashlet_progressive_completions_total", "Progressive completions, by how they were answered.", "counter", "outcome", map[string]int64{
+		"immediate": int64(upgrades.Immediate),
+		"upgraded":  int64(upgrades.Upgraded),
+		"missed":    int64(upgrades.Missed),
+	})
+	writeLabeled(w, "ashlet_dir_cache_lookups_total", "Completions whose directory context was already gathered (hit) or not (miss).", "counter", "result", map[string]int64{
+		"hit":  em.DirCacheHits,
+		"miss": em.DirCacheMisses,
+	})
+	writeCounter(w, "ashlet_embedding_cache_rebuilds_total", "Times the embedding cache was emptied because the embedding model or schema changed.", em.CacheRebuilds)
+	fmt.Fprintf(w, "# HELP ashlet_index_commands History commands in the semantic index.\n# TYPE ashlet_index_commands gauge\nashlet_index_commands %d\n", em.IndexedCommands)
+
+	writeProviders(w, "ashlet_api_requests_total", "API requests, by provider.", "counter", providers, func(p ashlet.ProviderHealth) string {
+		return strconv.FormatInt(p.TotalRequests, 10)
+	})
+	writeProviders(w, "ashlet_api_errors_total", "Failed API requests, by provider.", "counter", providers, func(p ashlet.ProviderHealth) string {
+		return strconv.FormatInt(p.TotalErrors, 10)
+	})
+	writeProviders(w, "ashlet_api_error_rate", "Fraction of the last 20 API requests that failed, by provider.", "gauge", providers, func(p ashlet.ProviderHealth) string {
+		return formatFloat(p.ErrorRate)
+	})
+}
+
+func writeCounter(w io.Writer, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+// writeLabeled writes a metric with one label, a sample per key of values
+// in key order.
+func writeLabeled(w io.Writer, name, help, typ, label string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, label, quoteLabel(k), values[k])
+	}
+}
+
+// writeProviders writes a metric with a sample per provider, valued by value.
+func writeProviders(w io.Writer, name, help, typ string, providers []ashlet.ProviderHealth, value func(ashlet.ProviderHealth) string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, p := range providers {
+		fmt.Fprintf(w, "%s{kind=%s,provider=%s,model=%s} %s\n", name,
+			quoteLabel(p.Kind), quoteLabel(p.Provider), quoteLabel(p.Model), value(p))
+	}
+}
+
+// quoteLabel quotes a label value as the exposition format escapes it.
+func quoteLabel(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// status reports the daemon's state to c, with the providers, counters,
+// and last error of c's own engine.
+func (s *Server) status(c *client) *ashlet.DaemonStatus {
+	st := &ashlet.DaemonStatus{
+		Version:       Version,
+		StartedAt:     s.started,
+		UptimeSeconds: int64(time.Since(s.started).Seconds()),
+		InFlight:      int(s.metrics.inFlight.Load()),
+		Providers:     []ashlet.ProviderHealth{},
+	}
+	if hr, ok := c.engine.(HealthReporter); ok {
+		st.Providers = hr.ProviderHealth()
+	}
+	if mr, ok := c.engine.(MetricsReporter); ok {
+		em := mr.Metrics()
+		st.Engine = &em
+	}
+	s.metrics.mu.Lock()
+	st.LastError = s.metrics.lastErrors[c.uid()]
+	s.metrics.mu.Unlock()
+	return st
+}
+
+// engines returns every live engine: the one engine, or in system mode
+// each connected user's.
+func (s *Server) engines() []Completer {
+	if s.users == nil {
+		return []Completer{s.currentEngine()}
+	}
+	return s.users.engines()
+}
+
+// ServeMetrics serves the metrics of every engine over HTTP at
+// http://addr/metrics until the server is closed. Anyone who can reach addr
+// can read them; in system mode they are summed over all users.
+func (s *Server) ServeMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w, s.engines())
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	s.mu.Lock()
+	s.metricsHTTP = srv
+	s.mu.Unlock()
+	slog.Info("serving metrics", "addr", ln.Addr().String())
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// metricsCompleter is a healthCompleter that also counts its index and
+// caches.
+type metricsCompleter struct {
+	healthCompleter
+}
+
+func (m *metricsCompleter) Metrics() ashlet.EngineMetrics {
+	return ashlet.EngineMetrics{IndexedCommands: 1200, CacheRebuilds: 1, DirCacheHits: 9, DirCacheMisses: 3}
+}
+
+func TestConfigMetricsAction(t *testing.T) {
+	mc := &metricsCompleter{healthCompleter{
+		stubCompleter: stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{{Completion: "git status"}, {Completion: "git stash"}}}},
+		providers: []ashlet.ProviderHealth{
+			{Kind: "generation", Provider: "openrouter.ai", Model: "m", ErrorRate: 0.25, TotalRequests: 40, TotalErrors: 6},
+		},
+	}}
+	srv := newTestServer(t, mc)
+
+	sendRequest(t, srv.sockPath, &ashlet.Request{RequestID: 1, Input: "git st"})
+	sendRequest(t, srv.sockPath, &ashlet.Request{RequestID: 2, Input: "git s"})
+	resp := sendConfigRequest(t, srv.sockPath, &ashlet.ConfigRequest{Action: "metrics"})
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %s", resp.Error.Message)
+	}
+	for _, want := range []string{
+		`ashlet_requests_total{type="completion"} 2`,
+		`ashlet_requests_total{type="config"} 1`,
+		"ashlet_completions_cancelled_total 0",
+		"ashlet_completion_duration_seconds_count 2",
+		`ashlet_completion_candidates_bucket{le="1"} 0`,
+		`ashlet_completion_candidates_bucket{le="2"} 2`,
+		"ashlet_completion_candidates_sum 4",
+		`ashlet_dir_cache_lookups_total{result="hit"} 9`,
+		`ashlet_dir_cache_lookups_total{result="miss"} 3`,
+		"ashlet_embedding_cache_rebuilds_total 1",
+		"ashlet_index_commands 1200",
+		`ashlet_api_requests_total{kind="generation",provider="openrouter.ai",model="m"} 40`,
+		`ashlet_api_errors_total{kind="generation",provider="openrouter.ai",model="m"} 6`,
+		`ashlet_api_error_rate{kind="generation",provider="openrouter.ai",model="m"} 0.25`,
+	} {
+		if !strings.Contains(resp.Metrics, want+"\n") {
+			t.Errorf("metrics missing %q:\n%s", want, resp.Metrics)
+		}
+	}
+}
+
+func TestServerMetricsCompletion(t *testing.T) {
+	srv := &Server{}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.metrics.completion(ctx, 0, &ashlet.Response{Error: &ashlet.Error{Code: "timeout"}}, 3*time.Second)
+	// The early answer of a progressive completion stood.
+	srv.metrics.completion(ctx, 0, nil, 300*time.Millisecond)
+	cancel()
+	srv.metrics.completion(ctx, 0, &ashlet.Response{}, time.Second)
+
+	var b strings.Builder
+	srv.writeMetrics(&b, nil)
+	for _, want := range []string{
+		`ashlet_completion_errors_total{code="timeout"} 1`,
+		"ashlet_completions_cancelled_total 1",
+		`ashlet_completion_duration_seconds_bucket{le="0.25"} 0`,
+		`ashlet_completion_duration_seconds_bucket{le="0.5"} 1`,
+		`ashlet_completion_duration_seconds_bucket{le="5"} 2`,
+		`ashlet_completion_duration_seconds_bucket{le="+Inf"} 2`,
+		"ashlet_completion_candidates_count 0",
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("metrics missing %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestConfigStatusAction(t *testing.T) {
+	mc := &metricsCompleter{healthCompleter{
+		stubCompleter: stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}, Error: &ashlet.Error{Code: "timeout", Message: "generation timed out"}}},
+		providers:     []ashlet.ProviderHealth{{Kind: "generation", Provider: "openrouter.ai", Model: "m", Circuit: "closed"}},
+	}}
+	srv := newTestServer(t, mc)
+
+	resp := sendConfigRequest(t, srv.sockPath, &ashlet.ConfigRequest{Action: "status"})
+	st := resp.Status
+	if resp.Error != nil || st == nil {
+		t.Fatalf("status = %+v, want a status", resp)
+	}
+	if st.Version != Version || st.StartedAt.IsZero() || st.InFlight != 0 || st.LastError != nil {
+		t.Errorf("status = %+v, want version, start time, nothing in flight, no error", st)
+	}
+	if len(st.Providers) != 1 || st.Engine == nil || st.Engine.IndexedCommands != 1200 {
+		t.Errorf("status = %+v, want the engine's providers and counters", st)
+	}
+
+	sendRequest(t, srv.sockPath, &ashlet.Request{RequestID: 1, Input: "git st"})
+	st = sendConfigRequest(t, srv.sockPath, &ashlet.ConfigRequest{Action: "status"}).Status
+	if st.LastError == nil || st.LastError.Code != "timeout" || st.LastError.Time.IsZero() {
+		t.Errorf("last error = %+v, want the timeout", st.LastError)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "net"
+
+// peerUID is not supported on this platform; system mode is unavailable.
+func peerUID(conn net.Conn) (int, error) {
+	return -1, errPeerCredUnsupported
+}
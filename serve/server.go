@@ -2,17 +2,23 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	ashlet "github.com/Paranoid-AF/ashlet"
 	defaults "github.com/Paranoid-AF/ashlet/default"
 	"github.com/Paranoid-AF/ashlet/generate"
+	"github.com/Paranoid-AF/ashlet/index"
 )
 
 // Completer processes a completion request and returns a response.
@@ -22,104 +28,551 @@ type Completer interface {
 	Close()
 }
 
+// FeedbackRecorder is implemented by completers that learn from candidate feedback.
+type FeedbackRecorder interface {
+	RecordFeedback(fb *ashlet.FeedbackRequest)
+}
+
+// HistoryRecorder is implemented by completers that learn history from
+// the commands the shell reports.
+type HistoryRecorder interface {
+	RecordHistoryEvent(ev *ashlet.HistoryEventRequest)
+}
+
+// Previewer is implemented by completers that can preview a candidate's effect.
+type Previewer interface {
+	Preview(ctx context.Context, req *ashlet.PreviewRequest) *ashlet.PreviewResponse
+}
+
+// Recaller is implemented by completers that keep a searchable ledger of past suggestions.
+type Recaller interface {
+	Recall(req *ashlet.RecallRequest) *ashlet.RecallResponse
+}
+
+// Capturer is implemented by completers that can capture completions into
+// an eval corpus.
+type Capturer interface {
+	Capture(req *ashlet.CaptureRequest) *ashlet.CaptureResponse
+}
+
+// HealthReporter is implemented by completers that track the health of
+// their API providers.
+type HealthReporter interface {
+	ProviderHealth() []ashlet.ProviderHealth
+}
+
+// UsageReporter is implemented by completers that account for their API
+// token usage.
+type UsageReporter interface {
+	UsageStats() []ashlet.UsageStats
+}
+
+// AuditReporter is implemented by completers that keep an audit log of
+// what they send to APIs.
+type AuditReporter interface {
+	AuditLog(n int) []ashlet.AuditEntry
+}
+
+// ProgressiveCompleter is implemented by completers that can answer a
+// request early and then again with better candidates.
+type ProgressiveCompleter interface {
+	CompleteProgressive(ctx context.Context, req *ashlet.Request, early func(*ashlet.Response)) *ashlet.Response
+}
+
+// UpgradeReporter is implemented by completers that count how their
+// progressive completions were answered.
+type UpgradeReporter interface {
+	UpgradeStats() ashlet.UpgradeStats
+}
+
+// requestReadTimeout is how long a new connection may take to send its
+// first request.
+const requestReadTimeout = 10 * time.Second
+
+// drainCancelWait is how long Shutdown waits for the completions it
+// cancelled to return.
+const drainCancelWait = time.Second
+
 // sessionEntry tracks a cancellable in-flight request for a session.
 type sessionEntry struct {
 	requestID int
 	cancel    context.CancelFunc
 }
 
-// Server listens on a Unix domain socket for completion requests.
+// Server listens on a Unix domain socket, or on TCP, for completion requests.
 type Server struct {
 	listener net.Listener
-	sockPath string
-	engine   Completer
+	sockPath string        // empty when listening on TCP
+	engine   Completer     // single-user mode; guarded by mu, reloadEngine swaps it
+	users    *userRegistry // system mode; nil otherwise
+
+	engineOpts generate.EngineOptions // used to recreate the engine on reload
+
+	mu          sync.Mutex
+	sessions    map[string]sessionEntry
+	cwds        *cwdTable
+	started     time.Time
+	metrics     serverMetrics
+	metricsHTTP *http.Server // nil unless ServeMetrics was called
+	token       string       // see SetToken
+	ownerUID    int          // the only user served over a Unix socket outside system mode
+
+	// base is the parent of every completion's context; cancelAll cancels
+	// them all when the server stops.
+	base      context.Context
+	cancelAll context.CancelFunc
+	conns     sync.WaitGroup        // connections being handled
+	open      map[net.Conn]struct{} // connections being handled; guarded by mu
+	closing   bool                  // guarded by mu
+	closeOnce sync.Once
+}
 
-	mu       sync.Mutex
-	sessions map[string]sessionEntry
+// client is the identity a connection is served as: the daemon's own user,
+// or in system mode the connecting UNIX user.
+type client struct {
+	engine Completer
+	paths  ashlet.Paths
+	user   *userEngine // nil in single-user mode
 }
 
-// NewServer creates a new IPC server bound to the given socket path.
-func NewServer(sockPath string) (*Server, error) {
-	engine := generate.NewEngine()
-	return NewServerWithCompleter(sockPath, engine)
+// uid returns the connecting user's UID in system mode, and 0 otherwise.
+func (c *client) uid() int {
+	if c.user == nil {
+		return 0
+	}
+	return c.user.uid
+}
+
+// NewServer creates a new IPC server bound to the given socket path, with an
+// engine configured by opts. A tcp:// or tls:// address always has
+// NoLocalContext: the request's host cannot be trusted to tell a shell on
+// the daemon's machine from one elsewhere.
+func NewServer(sockPath string, opts generate.EngineOptions) (*Server, error) {
+	if _, tcp := cutTCPScheme(sockPath); tcp {
+		opts.NoLocalContext = true
+	}
+	if opts.Latency == nil {
+		// Keep latency observations across engine reloads.
+		opts.Latency = generate.NewLatencyTracker()
+	}
+	if opts.Health == nil {
+		opts.Health = index.NewHealthTracker()
+	}
+	engine := generate.NewEngineWithOptions(opts)
+	srv, err := NewServerWithCompleter(sockPath, engine)
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	srv.engineOpts = opts
+	return srv, nil
 }
 
 // NewServerWithCompleter creates a new IPC server with a custom Completer.
+// sockPath is a Unix socket path, or tcp://host:port or tls://host:port to
+// serve other machines over TCP (see UseTLS).
 func NewServerWithCompleter(sockPath string, completer Completer) (*Server, error) {
-	// Remove stale socket file if it exists
-	if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+	listener, socket, err := listen(sockPath)
+	if err != nil {
 		return nil, err
 	}
+	// Only the daemon's own user may connect (see checkOwner).
+	if socket != "" {
+		if err := os.Chmod(socket, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return newServer(listener, socket, completer, nil), nil
+}
 
-	listener, err := net.Listen("unix", sockPath)
+// NewSystemServer creates a server that serves every local UNIX user from
+// one daemon. Each connecting user (identified by peer credentials) gets an
+// isolated engine with their own config and history; per-user state is kept
+// under stateBase/<uid>. Any local user may connect, or with group set only
+// its members.
+func NewSystemServer(sockPath, stateBase, group string) (*Server, error) {
+	return newSystemServer(sockPath, group, newUserRegistry(stateBase))
+}
+
+func newSystemServer(sockPath, group string, users *userRegistry) (*Server, error) {
+	listener, err := listenUnix(sockPath)
 	if err != nil {
 		return nil, err
 	}
+	// Isolation comes from peer credentials; the mode only decides who may
+	// connect at all.
+	mode := os.FileMode(0666)
+	if group != "" {
+		gid, err := lookupGroup(group)
+		if err == nil {
+			err = os.Chown(sockPath, -1, gid)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		mode = 0660
+	}
+	if err := os.Chmod(sockPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
 
+	return newServer(listener, sockPath, nil, users), nil
+}
+
+// newServer creates a server on listener for the one engine, or in system
+// mode for users.
+func newServer(listener net.Listener, sockPath string, engine Completer, users *userRegistry) *Server {
+	base, cancelAll := context.WithCancel(context.Background())
 	return &Server{
-		listener: listener,
-		sockPath: sockPath,
-		engine:   completer,
-		sessions: make(map[string]sessionEntry),
-	}, nil
+		listener:  listener,
+		sockPath:  sockPath,
+		engine:    engine,
+		users:     users,
+		sessions:  make(map[string]sessionEntry),
+		cwds:      newCwdTable(),
+		started:   time.Now(),
+		ownerUID:  os.Getuid(),
+		open:      make(map[net.Conn]struct{}),
+		base:      base,
+		cancelAll: cancelAll,
+	}
+}
+
+// listen listens on addr: TCP for tcp://host:port and tls://host:port,
+// otherwise the Unix socket at path addr, which is returned as socket so it
+// can be removed on close.
+func listen(addr string) (ln net.Listener, socket string, err error) {
+	if hostport, ok := cutTCPScheme(addr); ok {
+		ln, err = net.Listen("tcp", hostport)
+		return ln, "", err
+	}
+	ln, err = listenUnix(addr)
+	return ln, addr, err
 }
 
-// Serve accepts connections and handles requests.
+// cutTCPScheme returns the host:port of a tcp:// or tls:// address.
+func cutTCPScheme(addr string) (string, bool) {
+	if hostport, ok := strings.CutPrefix(addr, "tcp://"); ok {
+		return hostport, true
+	}
+	return strings.CutPrefix(addr, "tls://")
+}
+
+// listenUnix listens on sockPath, removing a stale socket file first.
+func listenUnix(sockPath string) (net.Listener, error) {
+	if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", sockPath)
+}
+
+// Serve accepts connections and handles requests. It returns nil once
+// Shutdown or Close has stopped the server.
 func (s *Server) Serve() error {
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if s.isClosing() {
+				return nil
+			}
 			return err
 		}
-		go s.handleConn(conn)
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns.Add(1)
+		s.open[conn] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			defer s.conns.Done()
+			s.handleConn(conn)
+			s.mu.Lock()
+			delete(s.open, conn)
+			s.mu.Unlock()
+		}()
 	}
 }
 
-// Close shuts down the server, inference engine, and removes the socket file.
-func (s *Server) Close() {
-	s.engine.Close()
+// Shutdown stops the server gracefully. It stops accepting connections and
+// reading requests, and waits for the requests being handled until ctx is
+// done, then cancels the
+// completions still running and waits drainCancelWait more for them to
+// return. Finally it closes the engines, which writes what they hold in
+// memory (usage, feedback, the embedding cache) to disk.
+func (s *Server) Shutdown(ctx context.Context) {
+	s.stopAccepting()
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("cancelling in-flight requests", "in_flight", s.metrics.inFlight.Load())
+		s.cancelAll()
+		select {
+		case <-done:
+		case <-time.After(drainCancelWait):
+			slog.Warn("requests still running at shutdown")
+		}
+	}
+	s.Close()
+}
+
+// stopAccepting closes the listener and removes the socket file, so new
+// clients see no daemon while the running requests finish. Connections
+// waiting for their next request are woken so they close.
+func (s *Server) stopAccepting() {
+	s.mu.Lock()
+	s.closing = true
+	for conn := range s.open {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
 	s.listener.Close()
-	os.Remove(s.sockPath)
+	if s.sockPath != "" {
+		os.Remove(s.sockPath)
+	}
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// Close shuts down the server at once: in-flight requests are cancelled,
+// and the engines are closed. Calling it again does nothing.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		s.stopAccepting()
+		s.cancelAll()
+		s.mu.Lock()
+		if s.metricsHTTP != nil {
+			s.metricsHTTP.Close()
+		}
+		s.mu.Unlock()
+		if s.users != nil {
+			s.users.closeAll()
+		} else {
+			s.currentEngine().Close()
+		}
+	})
+}
+
+// clientFor identifies who conn is served as. In system mode this resolves
+// the peer's UID to its own engine; otherwise only the daemon's own user
+// may connect over a Unix socket.
+func (s *Server) clientFor(conn net.Conn) (*client, *ashlet.Error) {
+	if s.users == nil {
+		if err := s.checkOwner(conn); err != nil {
+			return nil, &ashlet.Error{Code: "unauthorized", Message: err.Error()}
+		}
+		return &client{engine: s.currentEngine(), paths: s.engineOpts.Paths}, nil
+	}
+	uid, err := peerUID(conn)
+	if err != nil {
+		return nil, &ashlet.Error{Code: "unauthorized", Message: err.Error()}
+	}
+	u, err := s.users.get(uid)
+	if err != nil {
+		code := "unauthorized"
+		if errors.Is(err, errTooManyUsers) {
+			code = "quota_exceeded"
+		}
+		return nil, &ashlet.Error{Code: code, Message: err.Error()}
+	}
+	return &client{engine: s.users.engineOf(u), paths: u.paths, user: u}, nil
 }
 
+// writeError replies to request reqID with a bare error response.
+func writeError(conn net.Conn, reqID int, e *ashlet.Error) {
+	data, err := json.Marshal(&ashlet.Response{RequestID: reqID, Candidates: []ashlet.Candidate{}, Error: e})
+	if err != nil {
+		return
+	}
+	conn.Write(append(data, '\n'))
+}
+
+// handleConn answers the messages a client sends on conn, one per line,
+// until the client closes its side of the connection or the server stops.
+// A client may send a single request and close, or keep the connection for
+// many: completions are answered as they finish, possibly out of order,
+// each tagged with its request_id.
 func (s *Server) handleConn(conn net.Conn) {
 	defer conn.Close()
-
+	// Answer every completion before closing.
+	var pending sync.WaitGroup
+	defer pending.Wait()
+
+	// A client sends its first request as soon as it connects; do not let
+	// one that never does (or stalls a TLS handshake) hold the connection.
+	// After that the connection may idle until the client's next request.
+	conn.SetReadDeadline(time.Now().Add(requestReadTimeout))
 	scanner := bufio.NewScanner(conn)
-	if !scanner.Scan() {
-		return
+	for first := true; scanner.Scan(); first = false {
+		if first {
+			conn.SetReadDeadline(time.Time{})
+		}
+		// Completions are answered in the background, after the scanner
+		// has reused its buffer.
+		raw := bytes.Clone(scanner.Bytes())
+		if !s.handleMessage(conn, raw, &pending) || s.isClosing() {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil && !s.isClosing() {
+		slog.Debug("failed to read request", "error", err)
 	}
+}
 
-	raw := scanner.Bytes()
+// handleMessage answers one message read from conn. Completion requests are
+// answered in the background, tracked by pending, so that the client's
+// next request can supersede them; other messages are answered before it
+// returns. It returns false when the connection should be closed.
+//
+// Answers are written to conn with one Write each, which net.Conn
+// serializes, so concurrent answers do not interleave.
+func (s *Server) handleMessage(conn net.Conn, raw []byte, pending *sync.WaitGroup) bool {
 	slog.Debug("request", "data", string(raw))
 
-	// Check if this is a context warm-up request (has "type":"context" field)
-	var ctxReq ashlet.ContextRequest
-	if err := json.Unmarshal(raw, &ctxReq); err == nil && ctxReq.Type == "context" {
-		s.handleContextRequest(conn, &ctxReq)
-		return
+	// Route by message kind: typed messages carry "type", config requests
+	// carry "action", everything else is a completion request.
+	var envelope struct {
+		Type      string `json:"type"`
+		Action    string `json:"action"`
+		RequestID int    `json:"request_id"`
 	}
+	envErr := json.Unmarshal(raw, &envelope)
 
-	// Check if this is a config request (has "action" field)
-	var cfgReq ashlet.ConfigRequest
-	if err := json.Unmarshal(raw, &cfgReq); err == nil && cfgReq.Action != "" {
-		s.handleConfigRequest(conn, &cfgReq)
-		return
+	cerr := s.checkToken(raw)
+	var c *client
+	if cerr == nil {
+		c, cerr = s.clientFor(conn)
+	}
+	if cerr != nil {
+		slog.Warn("rejected connection", "code", cerr.Code, "error", cerr.Message)
+		writeError(conn, envelope.RequestID, cerr)
+		return false
+	}
+
+	if envErr == nil {
+		switch {
+		case envelope.Type == "context":
+			s.metrics.request("context")
+			var ctxReq ashlet.ContextRequest
+			json.Unmarshal(raw, &ctxReq)
+			s.handleContextRequest(conn, c, &ctxReq)
+			return true
+		case envelope.Type == "feedback":
+			s.metrics.request("feedback")
+			var fbReq ashlet.FeedbackRequest
+			json.Unmarshal(raw, &fbReq)
+			s.handleFeedbackRequest(conn, c, &fbReq)
+			return true
+		case envelope.Type == "history_event":
+			s.metrics.request("history_event")
+			var hReq ashlet.HistoryEventRequest
+			json.Unmarshal(raw, &hReq)
+			s.handleHistoryEventRequest(conn, c, &hReq)
+			return true
+		case envelope.Type == "preview":
+			s.metrics.request("preview")
+			var pvReq ashlet.PreviewRequest
+			json.Unmarshal(raw, &pvReq)
+			s.handlePreviewRequest(conn, c, &pvReq)
+			return true
+		case envelope.Type == "recall":
+			s.metrics.request("recall")
+			var rcReq ashlet.RecallRequest
+			json.Unmarshal(raw, &rcReq)
+			s.handleRecallRequest(conn, c, &rcReq)
+			return true
+		case envelope.Type == "capture":
+			s.metrics.request("capture")
+			var cpReq ashlet.CaptureRequest
+			json.Unmarshal(raw, &cpReq)
+			s.handleCaptureRequest(conn, c, &cpReq)
+			return true
+		case envelope.Action != "":
+			s.metrics.request("config")
+			var cfgReq ashlet.ConfigRequest
+			json.Unmarshal(raw, &cfgReq)
+			s.handleConfigRequest(conn, c, &cfgReq)
+			return true
+		}
 	}
 
 	var req ashlet.Request
 	if err := json.Unmarshal(raw, &req); err != nil {
 		slog.Warn("invalid request", "error", err)
-		return
+		return true
+	}
+	s.metrics.request("completion")
+
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		s.handleCompletion(conn, c, &req)
+	}()
+	return true
+}
+
+// handleCompletion answers the completion request req. It writes nothing
+// when a newer request from the same shell supersedes req.
+func (s *Server) handleCompletion(conn net.Conn, c *client, req *ashlet.Request) {
+	if c.user != nil {
+		if !c.user.acquire() {
+			writeResponse(s.base, conn, req.RequestID, &ashlet.Response{
+				Candidates: []ashlet.Candidate{},
+				Error:      &ashlet.Error{Code: "quota_exceeded", Message: errBusy.Error()},
+			})
+			return
+		}
+		defer c.user.release()
 	}
 
 	// Cancel any in-flight request for this session and create a new context.
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(s.base)
 	sid := req.SessionID
+	if sid != "" && c.user != nil {
+		// Session IDs are shell PIDs; scope them per user.
+		sid = strconv.Itoa(c.user.uid) + ":" + sid
+	}
 	reqID := req.RequestID
+	if !s.cwds.resolve(sid, req) {
+		cancel()
+		data, _ := json.Marshal(&ashlet.Response{
+			RequestID:  reqID,
+			Candidates: []ashlet.Candidate{},
+			Error: &ashlet.Error{
+				Code:    "unknown_cwd_generation",
+				Message: "cwd generation " + strconv.Itoa(req.CwdGeneration) + " is not known; resend cwd",
+			},
+		})
+		conn.Write(append(data, '\n'))
+		return
+	}
 	if sid != "" {
 		s.mu.Lock()
 		if prev, ok := s.sessions[sid]; ok {
+			if prev.requestID > reqID {
+				// A later request from this shell overtook this one on
+				// its way here; it is already stale.
+				s.mu.Unlock()
+				cancel()
+				s.metrics.cancelled.Add(1)
+				return
+			}
 			prev.cancel()
 		}
 		s.sessions[sid] = sessionEntry{requestID: reqID, cancel: cancel}
@@ -136,14 +589,31 @@ func (s *Server) handleConn(conn net.Conn) {
 		}
 	}()
 
-	resp := s.engine.Complete(ctx, &req)
+	s.metrics.inFlight.Add(1)
+	defer s.metrics.inFlight.Add(-1)
+	start := time.Now()
+	var resp *ashlet.Response
+	if pc, ok := c.engine.(ProgressiveCompleter); ok && req.Progressive {
+		resp = pc.CompleteProgressive(ctx, req, func(early *ashlet.Response) {
+			writeResponse(ctx, conn, req.RequestID, early)
+		})
+	} else {
+		resp = c.engine.Complete(ctx, req)
+	}
+	s.metrics.completion(ctx, c.uid(), resp, time.Since(start))
+	if resp != nil {
+		writeResponse(ctx, conn, req.RequestID, resp)
+	}
+}
 
-	// If cancelled, skip writing — the client has already moved on.
+// writeResponse sends resp as the reply to request reqID, unless ctx is
+// cancelled: the client has then already moved on.
+func writeResponse(ctx context.Context, conn net.Conn, reqID int, resp *ashlet.Response) {
 	if ctx.Err() != nil {
 		return
 	}
 
-	resp.RequestID = req.RequestID
+	resp.RequestID = reqID
 
 	data, err := json.Marshal(resp)
 	if err != nil {
@@ -156,18 +626,20 @@ func (s *Server) handleConn(conn net.Conn) {
 	conn.Write(append(data, '\n'))
 }
 
-func (s *Server) handleContextRequest(conn net.Conn, req *ashlet.ContextRequest) {
+func (s *Server) handleContextRequest(conn net.Conn, c *client, req *ashlet.ContextRequest) {
 	resp := ashlet.ContextResponse{OK: true}
 
 	cwd := strings.TrimRight(req.Cwd, "\n")
 	if cwd == "" {
 		resp.OK = false
 		resp.Error = &ashlet.Error{Code: "invalid_request", Message: "cwd is required"}
-	} else {
-		// Gather in background — respond immediately
-		go s.engine.WarmContext(context.Background(), cwd)
+	} else if generate.IsLocalHost(req.Host) {
+		// Gather in background — respond immediately. A cwd on another
+		// host (remote daemon) cannot be read here, so it is skipped.
+		go c.engine.WarmContext(context.Background(), cwd)
 	}
 
+	resp.RequestID = req.RequestID
 	data, err := json.Marshal(resp)
 	if err != nil {
 		slog.Error("failed to marshal context response", "error", err)
@@ -179,12 +651,126 @@ func (s *Server) handleContextRequest(conn net.Conn, req *ashlet.ContextRequest)
 	conn.Write(append(data, '\n'))
 }
 
-func (s *Server) handleConfigRequest(conn net.Conn, req *ashlet.ConfigRequest) {
+func (s *Server) handleFeedbackRequest(conn net.Conn, c *client, req *ashlet.FeedbackRequest) {
+	resp := ashlet.FeedbackResponse{OK: true}
+
+	switch {
+	case req.Event != "accepted" && req.Event != "rejected" && req.Event != "edited":
+		resp.OK = false
+		resp.Error = &ashlet.Error{Code: "invalid_request", Message: "unknown feedback event: " + req.Event}
+	case strings.TrimSpace(req.Candidate) == "":
+		resp.OK = false
+		resp.Error = &ashlet.Error{Code: "invalid_request", Message: "candidate is required"}
+	default:
+		if rec, ok := c.engine.(FeedbackRecorder); ok {
+			rec.RecordFeedback(req)
+		}
+	}
+
+	resp.RequestID = req.RequestID
+	data, err := json.Marshal(resp)
+	if err != nil {
+		slog.Error("failed to marshal feedback response", "error", err)
+		return
+	}
+
+	slog.Debug("response", "data", string(data))
+
+	conn.Write(append(data, '\n'))
+}
+
+func (s *Server) handleHistoryEventRequest(conn net.Conn, c *client, req *ashlet.HistoryEventRequest) {
+	resp := ashlet.HistoryEventResponse{OK: true}
+
+	if strings.TrimSpace(req.Command) == "" {
+		resp.OK = false
+		resp.Error = &ashlet.Error{Code: "invalid_request", Message: "command is required"}
+	} else if rec, ok := c.engine.(HistoryRecorder); ok {
+		rec.RecordHistoryEvent(req)
+	}
+
+	resp.RequestID = req.RequestID
+	data, err := json.Marshal(resp)
+	if err != nil {
+		slog.Error("failed to marshal history event response", "error", err)
+		return
+	}
+
+	slog.Debug("response", "data", string(data))
+
+	conn.Write(append(data, '\n'))
+}
+
+func (s *Server) handlePreviewRequest(conn net.Conn, c *client, req *ashlet.PreviewRequest) {
+	resp := &ashlet.PreviewResponse{OK: true}
+
+	switch {
+	case strings.TrimSpace(req.Command) == "":
+		resp.OK = false
+		resp.Error = &ashlet.Error{Code: "invalid_request", Message: "command is required"}
+	case strings.TrimRight(req.Cwd, "\n") == "":
+		resp.OK = false
+		resp.Error = &ashlet.Error{Code: "invalid_request", Message: "cwd is required"}
+	default:
+		if pv, ok := c.engine.(Previewer); ok {
+			resp = pv.Preview(context.Background(), req)
+		}
+	}
+
+	resp.RequestID = req.RequestID
+	data, err := json.Marshal(resp)
+	if err != nil {
+		slog.Error("failed to marshal preview response", "error", err)
+		return
+	}
+
+	slog.Debug("response", "data", string(data))
+
+	conn.Write(append(data, '\n'))
+}
+
+func (s *Server) handleRecallRequest(conn net.Conn, c *client, req *ashlet.RecallRequest) {
+	resp := &ashlet.RecallResponse{OK: true, Entries: []ashlet.RecallEntry{}}
+	if rc, ok := c.engine.(Recaller); ok {
+		resp = rc.Recall(req)
+	}
+
+	resp.RequestID = req.RequestID
+	data, err := json.Marshal(resp)
+	if err != nil {
+		slog.Error("failed to marshal recall response", "error", err)
+		return
+	}
+
+	slog.Debug("response", "data", string(data))
+
+	conn.Write(append(data, '\n'))
+}
+
+func (s *Server) handleCaptureRequest(conn net.Conn, c *client, req *ashlet.CaptureRequest) {
+	resp := &ashlet.CaptureResponse{Error: &ashlet.Error{Code: "unsupported", Message: "completer does not capture completions"}}
+	if cp, ok := c.engine.(Capturer); ok {
+		resp = cp.Capture(req)
+	}
+
+	resp.RequestID = req.RequestID
+	data, err := json.Marshal(resp)
+	if err != nil {
+		slog.Error("failed to marshal capture response", "error", err)
+		return
+	}
+
+	slog.Debug("response", "data", string(data))
+
+	conn.Write(append(data, '\n'))
+}
+
+func (s *Server) handleConfigRequest(conn net.Conn, c *client, req *ashlet.ConfigRequest) {
 	var resp ashlet.ConfigResponse
 
 	switch req.Action {
 	case "get":
-		cfg, err := ashlet.LoadConfig()
+		cfg, err := c.paths.LoadConfig()
 		if err != nil {
 			resp.Error = &ashlet.Error{
 				Code:    "config_error",
@@ -197,8 +783,12 @@ func (s *Server) handleConfigRequest(conn net.Conn, req *ashlet.ConfigRequest) {
 	case "reload":
 		// Respond immediately; reload engine in the background.
 		// Engine reload may block, so we must not block the client.
-		go s.reloadEngine()
-		cfg, _ := ashlet.LoadConfig()
+		if c.user != nil {
+			go s.users.reload(c.user.uid, nil)
+		} else {
+			go s.reloadEngine(nil)
+		}
+		cfg, _ := c.paths.LoadConfig()
 		resp.Config = cfg
 
 	case "defaults":
@@ -207,8 +797,11 @@ func (s *Server) handleConfigRequest(conn net.Conn, req *ashlet.ConfigRequest) {
 	case "default_prompt":
 		resp.Prompt = defaults.DefaultPrompt
 
+	case "prompt_reference":
+		resp.Prompt = defaults.PromptReference
+
 	case "validate":
-		cfg, err := ashlet.LoadConfig()
+		cfg, err := c.paths.LoadConfig()
 		if err != nil {
 			resp.Error = &ashlet.Error{
 				Code:    "config_error",
@@ -218,6 +811,62 @@ func (s *Server) handleConfigRequest(conn net.Conn, req *ashlet.ConfigRequest) {
 			resp.Warnings = ashlet.ValidateConfig(cfg)
 		}
 
+	case "providers":
+		resp.Providers = []ashlet.ProviderHealth{}
+		if hr, ok := c.engine.(HealthReporter); ok {
+			resp.Providers = hr.ProviderHealth()
+		}
+
+	case "stats":
+		resp.Stats = []ashlet.UsageStats{}
+		if ur, ok := c.engine.(UsageReporter); ok {
+			resp.Stats = ur.UsageStats()
+		}
+		if ur, ok := c.engine.(UpgradeReporter); ok {
+			upgrades := ur.UpgradeStats()
+			resp.Upgrades = &upgrades
+		}
+
+	case "metrics":
+		// Only the caller's own engine: in system mode other users'
+		// engines are none of their business.
+		var b strings.Builder
+		s.writeMetrics(&b, []Completer{c.engine})
+		resp.Metrics = b.String()
+
+	case "status":
+		resp.Status = s.status(c)
+
+	case "storage":
+		resp.Storage = ashlet.StorageUsage(c.paths)
+
+	case "audit":
+		limit := req.Limit
+		if limit <= 0 {
+			limit = 20
+		}
+		resp.Audit = []ashlet.AuditEntry{}
+		if ar, ok := c.engine.(AuditReporter); ok {
+			resp.Audit = ar.AuditLog(limit)
+		}
+
+	case "prune":
+		// The engine holds some of the state in memory: close it before
+		// deleting the files, and start a new one from what is left.
+		var err error
+		prune := func() { resp.Storage, err = ashlet.PruneStorage(c.paths, req.Items) }
+		if c.user != nil {
+			s.users.reload(c.user.uid, prune)
+		} else {
+			s.reloadEngine(prune)
+		}
+		if err != nil {
+			resp.Error = &ashlet.Error{
+				Code:    "storage_error",
+				Message: err.Error(),
+			}
+		}
+
 	default:
 		resp.Error = &ashlet.Error{
 			Code:    "unknown_action",
@@ -225,6 +874,15 @@ func (s *Server) handleConfigRequest(conn net.Conn, req *ashlet.ConfigRequest) {
 		}
 	}
 
+	// The API keys are the daemon user's secrets: only a client on the
+	// machine, over the Unix socket, is sent them.
+	if _, local := conn.(*net.UnixConn); !local && resp.Config != nil {
+		cfg := *resp.Config
+		cfg.Generation.APIKey, cfg.Embedding.APIKey = "", ""
+		resp.Config = &cfg
+	}
+
+	resp.RequestID = req.RequestID
 	data, err := json.Marshal(resp)
 	if err != nil {
 		slog.Error("failed to marshal config response", "error", err)
@@ -236,7 +894,18 @@ func (s *Server) handleConfigRequest(conn net.Conn, req *ashlet.ConfigRequest) {
 	conn.Write(append(data, '\n'))
 }
 
-func (s *Server) reloadEngine() {
+// currentEngine returns the engine outside system mode. Reload may swap
+// it, so read it under the lock.
+func (s *Server) currentEngine() Completer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.engine
+}
+
+// reloadEngine replaces the engine so it picks up config changes.
+// whileClosed, when not nil, runs after the old engine is closed and before
+// the new one is created.
+func (s *Server) reloadEngine(whileClosed func()) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -244,8 +913,11 @@ func (s *Server) reloadEngine() {
 	if s.engine != nil {
 		s.engine.Close()
 	}
+	if whileClosed != nil {
+		whileClosed()
+	}
 
 	// Create new engine with updated config
-	s.engine = generate.NewEngine()
+	s.engine = generate.NewEngineWithOptions(s.engineOpts)
 	slog.Info("engine reloaded")
 }
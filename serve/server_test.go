@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -201,6 +204,157 @@ func TestConfigDefaultsAction(t *testing.T) {
 	}
 }
 
+func TestConfigPromptReferenceAction(t *testing.T) {
+	srv := newTestServer(t, &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}})
+
+	resp := sendConfigRequest(t, srv.sockPath, &ashlet.ConfigRequest{Action: "prompt_reference"})
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %s", resp.Error.Message)
+	}
+	if !strings.Contains(resp.Prompt, "ifNonEmpty") {
+		t.Errorf("expected the template reference, got %q", resp.Prompt)
+	}
+}
+
+// healthCompleter is a stubCompleter that reports provider health.
+type healthCompleter struct {
+	stubCompleter
+	providers []ashlet.ProviderHealth
+}
+
+func (h *healthCompleter) ProviderHealth() []ashlet.ProviderHealth { return h.providers }
+
+func TestConfigProvidersAction(t *testing.T) {
+	hc := &healthCompleter{providers: []ashlet.ProviderHealth{
+		{Kind: "generation", Provider: "openrouter.ai", Model: "m", Circuit: "open", Requests: 5, ErrorRate: 1},
+	}}
+	srv := newTestServer(t, hc)
+
+	resp := sendConfigRequest(t, srv.sockPath, &ashlet.ConfigRequest{Action: "providers"})
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %s", resp.Error.Message)
+	}
+	if len(resp.Providers) != 1 || resp.Providers[0].Circuit != "open" || resp.Providers[0].Kind != "generation" {
+		t.Errorf("providers = %+v, want the completer's report", resp.Providers)
+	}
+
+	// Completers that do not track health report none.
+	srv = newTestServer(t, &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}})
+	if resp := sendConfigRequest(t, srv.sockPath, &ashlet.ConfigRequest{Action: "providers"}); resp.Error != nil || len(resp.Providers) != 0 {
+		t.Errorf("providers without health tracking = %+v", resp)
+	}
+}
+
+// usageCompleter is a stubCompleter that accounts for token usage.
+type usageCompleter struct {
+	stubCompleter
+	stats []ashlet.UsageStats
+}
+
+func (u *usageCompleter) UsageStats() []ashlet.UsageStats { return u.stats }
+
+func TestConfigStatsAction(t *testing.T) {
+	uc := &usageCompleter{stats: []ashlet.UsageStats{
+		{Date: "2026-03-14", Kind: "generation", Model: "m", Requests: 3, PromptTokens: 300, CompletionTokens: 30, Cost: 0.01},
+	}}
+	srv := newTestServer(t, uc)
+
+	resp := sendConfigRequest(t, srv.sockPath, &ashlet.ConfigRequest{Action: "stats"})
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %s", resp.Error.Message)
+	}
+	if len(resp.Stats) != 1 || resp.Stats[0] != uc.stats[0] {
+		t.Errorf("stats = %+v, want the completer's totals", resp.Stats)
+	}
+}
+
+// auditCompleter is a stubCompleter that keeps an audit log.
+type auditCompleter struct {
+	stubCompleter
+	entries []ashlet.AuditEntry
+	limit   int
+}
+
+func (a *auditCompleter) AuditLog(n int) []ashlet.AuditEntry {
+	a.limit = n
+	return a.entries[max(len(a.entries)-n, 0):]
+}
+
+func TestConfigAuditAction(t *testing.T) {
+	ac := &auditCompleter{entries: []ashlet.AuditEntry{
+		{Kind: "embedding", Model: "e", Texts: []string{"git status"}},
+		{Kind: "generation", Model: "m", Texts: []string{"system", "input: git "}},
+	}}
+	srv := newTestServer(t, ac)
+
+	resp := sendConfigRequest(t, srv.sockPath, &ashlet.ConfigRequest{Action: "audit", Limit: 1})
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %s", resp.Error.Message)
+	}
+	if len(resp.Audit) != 1 || resp.Audit[0].Kind != "generation" || len(resp.Audit[0].Texts) != 2 {
+		t.Errorf("audit = %+v, want the latest entry", resp.Audit)
+	}
+	if sendConfigRequest(t, srv.sockPath, &ashlet.ConfigRequest{Action: "audit"}); ac.limit != 20 {
+		t.Errorf("default limit = %d, want 20", ac.limit)
+	}
+}
+
+// progressiveCompleter is a stubCompleter that answers progressive
+// requests early and then with an upgrade.
+type progressiveCompleter struct {
+	stubCompleter
+}
+
+func (p *progressiveCompleter) CompleteProgressive(_ context.Context, _ *ashlet.Request, early func(*ashlet.Response)) *ashlet.Response {
+	early(&ashlet.Response{Candidates: []ashlet.Candidate{{Completion: "git status"}}, Pending: true})
+	return &ashlet.Response{Candidates: []ashlet.Candidate{{Completion: "git status --short"}}}
+}
+
+func (p *progressiveCompleter) UpgradeStats() ashlet.UpgradeStats {
+	return ashlet.UpgradeStats{Upgraded: 1}
+}
+
+func TestHandleConnProgressive(t *testing.T) {
+	pc := &progressiveCompleter{stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{{Completion: "git stash"}}}}}
+	srv := newTestServer(t, pc)
+
+	conn, err := net.Dial("unix", srv.sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, _ := json.Marshal(&ashlet.Request{RequestID: 9, Input: "git st", CursorPos: 6, Progressive: true})
+	conn.Write(append(data, '\n'))
+	// Done sending, as socat is: the daemon closes once it has answered.
+	conn.(*net.UnixConn).CloseWrite()
+
+	var got []ashlet.Response
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var resp ashlet.Response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, resp)
+	}
+	if len(got) != 2 || !got[0].Pending || got[1].Pending || got[0].RequestID != 9 || got[1].RequestID != 9 {
+		t.Fatalf("responses = %+v, want a pending one and its upgrade for request 9", got)
+	}
+	if got[1].Candidates[0].Completion != "git status --short" {
+		t.Errorf("upgrade = %+v", got[1])
+	}
+
+	// Clients that do not ask for it get one answer.
+	if resp := sendRequest(t, srv.sockPath, &ashlet.Request{RequestID: 10, Input: "git st"}); resp.Candidates[0].Completion != "git stash" {
+		t.Errorf("non-progressive response = %+v", resp)
+	}
+
+	stats := sendConfigRequest(t, srv.sockPath, &ashlet.ConfigRequest{Action: "stats"})
+	if stats.Upgrades == nil || stats.Upgrades.Upgraded != 1 {
+		t.Errorf("stats upgrades = %+v", stats.Upgrades)
+	}
+}
+
 func TestHandleConnCancelsOldSession(t *testing.T) {
 	slow := &slowCompleter{}
 	srv := newTestServer(t, slow)
@@ -317,3 +471,500 @@ func TestHandleConnContextRequestNoCwd(t *testing.T) {
 		t.Errorf("expected error for empty cwd")
 	}
 }
+
+// feedbackCompleter records feedback events it receives.
+type feedbackCompleter struct {
+	stubCompleter
+	mu     sync.Mutex
+	events []ashlet.FeedbackRequest
+}
+
+func (f *feedbackCompleter) RecordFeedback(fb *ashlet.FeedbackRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, *fb)
+}
+
+func sendFeedbackRequest(t *testing.T, sockPath string, req *ashlet.FeedbackRequest) *ashlet.FeedbackResponse {
+	t.Helper()
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(data, '\n'))
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		t.Fatal("no response from server")
+	}
+
+	var resp ashlet.FeedbackResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestHandleConnFeedbackRequest(t *testing.T) {
+	fc := &feedbackCompleter{stubCompleter: stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}}}
+	srv := newTestServer(t, fc)
+
+	resp := sendFeedbackRequest(t, srv.sockPath, &ashlet.FeedbackRequest{
+		Type:      "feedback",
+		Event:     "accepted",
+		Candidate: "git status",
+	})
+	if !resp.OK || resp.Error != nil {
+		t.Fatalf("expected OK, got %+v", resp)
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if len(fc.events) != 1 || fc.events[0].Candidate != "git status" {
+		t.Errorf("expected feedback to reach the completer, got %+v", fc.events)
+	}
+}
+
+func TestHandleConnFeedbackRequestInvalidEvent(t *testing.T) {
+	fc := &feedbackCompleter{stubCompleter: stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}}}
+	srv := newTestServer(t, fc)
+
+	resp := sendFeedbackRequest(t, srv.sockPath, &ashlet.FeedbackRequest{
+		Type:      "feedback",
+		Event:     "liked",
+		Candidate: "git status",
+	})
+	if resp.OK || resp.Error == nil || resp.Error.Code != "invalid_request" {
+		t.Errorf("expected invalid_request error, got %+v", resp)
+	}
+}
+
+// historyCompleter records history events it receives.
+type historyCompleter struct {
+	stubCompleter
+	mu     sync.Mutex
+	events []ashlet.HistoryEventRequest
+}
+
+func (h *historyCompleter) RecordHistoryEvent(ev *ashlet.HistoryEventRequest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, *ev)
+}
+
+func sendHistoryEventRequest(t *testing.T, sockPath string, req *ashlet.HistoryEventRequest) *ashlet.HistoryEventResponse {
+	t.Helper()
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(data, '\n'))
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		t.Fatal("no response from server")
+	}
+
+	var resp ashlet.HistoryEventResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestHandleConnHistoryEventRequest(t *testing.T) {
+	hc := &historyCompleter{stubCompleter: stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}}}
+	srv := newTestServer(t, hc)
+
+	resp := sendHistoryEventRequest(t, srv.sockPath, &ashlet.HistoryEventRequest{
+		Type:       "history_event",
+		Command:    "make test",
+		Cwd:        "/repo",
+		ExitCode:   2,
+		DurationMs: 5321,
+	})
+	if !resp.OK || resp.Error != nil {
+		t.Fatalf("expected OK, got %+v", resp)
+	}
+	resp = sendHistoryEventRequest(t, srv.sockPath, &ashlet.HistoryEventRequest{Type: "history_event", Command: "  "})
+	if resp.OK || resp.Error == nil || resp.Error.Code != "invalid_request" {
+		t.Errorf("expected invalid_request error for an empty command, got %+v", resp)
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if len(hc.events) != 1 || hc.events[0].Command != "make test" || hc.events[0].ExitCode != 2 || hc.events[0].DurationMs != 5321 {
+		t.Errorf("expected the event to reach the completer, got %+v", hc.events)
+	}
+}
+
+// previewCompleter returns a fixed preview for every command.
+type previewCompleter struct {
+	stubCompleter
+}
+
+func (p *previewCompleter) Preview(ctx context.Context, req *ashlet.PreviewRequest) *ashlet.PreviewResponse {
+	return &ashlet.PreviewResponse{OK: true, Supported: true, Output: "would remove " + req.Command}
+}
+
+func sendPreviewRequest(t *testing.T, sockPath string, req *ashlet.PreviewRequest) *ashlet.PreviewResponse {
+	t.Helper()
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(data, '\n'))
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		t.Fatal("no response from server")
+	}
+
+	var resp ashlet.PreviewResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestHandleConnPreviewRequest(t *testing.T) {
+	pc := &previewCompleter{stubCompleter: stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}}}
+	srv := newTestServer(t, pc)
+
+	resp := sendPreviewRequest(t, srv.sockPath, &ashlet.PreviewRequest{Type: "preview", Command: "rm a.txt", Cwd: "/tmp"})
+	if !resp.OK || !resp.Supported || resp.Output != "would remove rm a.txt" {
+		t.Errorf("unexpected preview response: %+v", resp)
+	}
+}
+
+func TestHandleConnPreviewRequestUnsupportedCompleter(t *testing.T) {
+	srv := newTestServer(t, &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}})
+
+	resp := sendPreviewRequest(t, srv.sockPath, &ashlet.PreviewRequest{Type: "preview", Command: "rm a.txt", Cwd: "/tmp"})
+	if !resp.OK || resp.Supported {
+		t.Errorf("expected OK unsupported preview, got %+v", resp)
+	}
+}
+
+func TestHandleConnPreviewRequestMissingCommand(t *testing.T) {
+	srv := newTestServer(t, &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}})
+
+	resp := sendPreviewRequest(t, srv.sockPath, &ashlet.PreviewRequest{Type: "preview", Cwd: "/tmp"})
+	if resp.OK || resp.Error == nil || resp.Error.Code != "invalid_request" {
+		t.Errorf("expected invalid_request error, got %+v", resp)
+	}
+}
+
+// recallCompleter returns a fixed recall result.
+type recallCompleter struct {
+	stubCompleter
+}
+
+func (r *recallCompleter) Recall(req *ashlet.RecallRequest) *ashlet.RecallResponse {
+	return &ashlet.RecallResponse{OK: true, Entries: []ashlet.RecallEntry{{Command: req.Query + " -a", Accepted: true}}}
+}
+
+func sendRecallRequest(t *testing.T, sockPath string, req *ashlet.RecallRequest) *ashlet.RecallResponse {
+	t.Helper()
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(data, '\n'))
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		t.Fatal("no response from server")
+	}
+
+	var resp ashlet.RecallResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestHandleConnRecallRequest(t *testing.T) {
+	rc := &recallCompleter{stubCompleter: stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}}}
+	srv := newTestServer(t, rc)
+
+	resp := sendRecallRequest(t, srv.sockPath, &ashlet.RecallRequest{Type: "recall", Query: "docker system prune"})
+	if !resp.OK || len(resp.Entries) != 1 || resp.Entries[0].Command != "docker system prune -a" {
+		t.Errorf("unexpected recall response: %+v", resp)
+	}
+}
+
+func TestHandleConnRecallRequestUnsupportedCompleter(t *testing.T) {
+	srv := newTestServer(t, &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}})
+
+	resp := sendRecallRequest(t, srv.sockPath, &ashlet.RecallRequest{Type: "recall", Query: "docker"})
+	if !resp.OK || resp.Entries == nil || len(resp.Entries) != 0 {
+		t.Errorf("expected OK with empty entries, got %+v", resp)
+	}
+}
+
+func TestConfigStorageActions(t *testing.T) {
+	home := t.TempDir()
+	paths := ashlet.Paths{Home: home, State: filepath.Join(home, "state")}
+	if err := os.MkdirAll(paths.StateDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(paths.FeedbackPath(), []byte(`{"entries":[]}`), 0600)
+	os.WriteFile(paths.UsagePath(), []byte(`{}`), 0600)
+
+	sockPath := fmt.Sprintf("/tmp/ashlet-t%d.sock", testSocketCounter.Add(1))
+	srv, err := NewServerWithCompleter(sockPath, &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.engineOpts.Paths = paths
+	t.Cleanup(func() { srv.Close() })
+	go srv.Serve()
+
+	resp := sendConfigRequest(t, sockPath, &ashlet.ConfigRequest{Action: "storage"})
+	sizes := make(map[string]int64)
+	for _, item := range resp.Storage {
+		sizes[item.Name] = item.Bytes
+	}
+	if len(resp.Storage) != len(ashlet.StateItemNames()) || sizes["feedback"] != 14 || sizes["usage"] != 2 || sizes["ledger"] != 0 {
+		t.Fatalf("storage = %+v, want every item with its size", resp.Storage)
+	}
+
+	resp = sendConfigRequest(t, sockPath, &ashlet.ConfigRequest{Action: "prune", Items: []string{"feedback"}})
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %s", resp.Error.Message)
+	}
+	if len(resp.Storage) != 1 || resp.Storage[0].Name != "feedback" || resp.Storage[0].Bytes != 14 {
+		t.Errorf("pruned = %+v, want feedback with its size", resp.Storage)
+	}
+	if _, err := os.Stat(paths.FeedbackPath()); !os.IsNotExist(err) {
+		t.Error("feedback store should be deleted")
+	}
+	if _, err := os.Stat(paths.UsagePath()); err != nil {
+		t.Error("usage totals should be kept")
+	}
+
+	resp = sendConfigRequest(t, sockPath, &ashlet.ConfigRequest{Action: "prune", Items: []string{"history"}})
+	if resp.Error == nil || resp.Error.Code != "storage_error" {
+		t.Errorf("pruning an unknown item should fail, got %+v", resp)
+	}
+}
+
+// delayCompleter is a stubCompleter that takes delay to answer.
+type delayCompleter struct {
+	stubCompleter
+	delay time.Duration
+}
+
+func (d *delayCompleter) Complete(ctx context.Context, req *ashlet.Request) *ashlet.Response {
+	time.Sleep(d.delay)
+	return d.stubCompleter.Complete(ctx, req)
+}
+
+// startShutdownServer starts a server for completer and returns it with
+// the error Serve returns.
+func startShutdownServer(t *testing.T, completer Completer) (*Server, <-chan error) {
+	t.Helper()
+	n := testSocketCounter.Add(1)
+	srv, err := NewServerWithCompleter(fmt.Sprintf("/tmp/ashlet-t%d.sock", n), completer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve() }()
+	return srv, served
+}
+
+// waitInFlight waits until srv is answering a completion.
+func waitInFlight(t *testing.T, srv *Server) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); srv.metrics.inFlight.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("request never started")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	dc := &delayCompleter{
+		stubCompleter: stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{{Completion: "git status"}}}},
+		delay:         100 * time.Millisecond,
+	}
+	srv, served := startShutdownServer(t, dc)
+
+	answered := make(chan *ashlet.Response, 1)
+	go func() { answered <- sendRequest(t, srv.sockPath, &ashlet.Request{RequestID: 1, Input: "git st"}) }()
+	waitInFlight(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	if resp := <-answered; len(resp.Candidates) != 1 {
+		t.Errorf("in-flight request answered with %+v, want its candidate", resp)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve = %v after shutdown, want nil", err)
+	}
+	if _, err := os.Stat(srv.sockPath); !os.IsNotExist(err) {
+		t.Errorf("socket still exists after shutdown: %v", err)
+	}
+	if _, err := net.Dial("unix", srv.sockPath); err == nil {
+		t.Error("new connection accepted after shutdown")
+	}
+}
+
+func TestShutdownCancelsRequestsAfterDeadline(t *testing.T) {
+	slow := &slowCompleter{}
+	srv, served := startShutdownServer(t, slow)
+
+	conn, err := net.Dial("unix", srv.sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, _ := json.Marshal(&ashlet.Request{RequestID: 7, Input: "git st"})
+	conn.Write(append(req, '\n'))
+	waitInFlight(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	srv.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > drainCancelWait {
+		t.Errorf("shutdown took %v, want the request cancelled at the deadline", elapsed)
+	}
+
+	slow.mu.Lock()
+	defer slow.mu.Unlock()
+	if len(slow.cancelled) != 1 || slow.cancelled[0] != 7 {
+		t.Errorf("cancelled = %v, want request 7", slow.cancelled)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve = %v after shutdown, want nil", err)
+	}
+}
+
+// sleepyCompleter is a stubCompleter that answers each request after the
+// delay given for its ID.
+type sleepyCompleter struct {
+	stubCompleter
+	delays map[int]time.Duration
+}
+
+func (s *sleepyCompleter) Complete(ctx context.Context, req *ashlet.Request) *ashlet.Response {
+	time.Sleep(s.delays[req.RequestID])
+	return s.stubCompleter.Complete(ctx, req)
+}
+
+func TestHandleConnPersistent(t *testing.T) {
+	sc := &sleepyCompleter{
+		stubCompleter: stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{{Completion: "git status"}}}},
+		delays:        map[int]time.Duration{1: 200 * time.Millisecond},
+	}
+	srv := newTestServer(t, sc)
+
+	conn, err := net.Dial("unix", srv.sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, msg := range []any{
+		&ashlet.Request{RequestID: 1, Input: "git st", SessionID: "a"},
+		&ashlet.Request{RequestID: 2, Input: "git st", SessionID: "b"},
+		&ashlet.ContextRequest{RequestID: 7, Type: "context", Cwd: t.TempDir()},
+		&ashlet.ConfigRequest{RequestID: 8, Action: "status"},
+	} {
+		data, _ := json.Marshal(msg)
+		conn.Write(append(data, '\n'))
+	}
+
+	scanner := bufio.NewScanner(conn)
+	var ids []int
+	for len(ids) < 4 && scanner.Scan() {
+		var resp struct {
+			RequestID int  `json:"request_id"`
+			OK        bool `json:"ok"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.RequestID == 7 && !resp.OK {
+			t.Errorf("context response = %s, want ok", scanner.Bytes())
+		}
+		ids = append(ids, resp.RequestID)
+	}
+	// Every response echoes its request's ID, and the slow request is
+	// answered last, after the messages sent behind it.
+	slices.Sort(ids[:3])
+	if !slices.Equal(ids, []int{2, 7, 8, 1}) {
+		t.Fatalf("answered %v, want 2, 7 and 8 in any order, then 1", ids)
+	}
+
+	// The connection stays open for more requests until the client is done.
+	data, _ := json.Marshal(&ashlet.Request{RequestID: 3, Input: "git st"})
+	conn.Write(append(data, '\n'))
+	conn.(*net.UnixConn).CloseWrite()
+	if !scanner.Scan() || !strings.Contains(scanner.Text(), `"request_id":3`) {
+		t.Fatalf("third response = %q, want request 3", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Errorf("unexpected response %q after the client closed", scanner.Text())
+	}
+}
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	srv, served := startShutdownServer(t, &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}})
+
+	conn, err := net.Dial("unix", srv.sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, _ := json.Marshal(&ashlet.Request{RequestID: 1, Input: "git st"})
+	conn.Write(append(data, '\n'))
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		t.Fatal("no response from server")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	srv.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v, want the idle connection closed at once", elapsed)
+	}
+	if scanner.Scan() {
+		t.Errorf("unexpected response %q, want the connection closed", scanner.Text())
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve = %v after shutdown, want nil", err)
+	}
+}
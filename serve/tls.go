@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// UseTLS serves connections over TLS with cfg. With cfg.ClientCAs set (see
+// loadTLSConfig), only clients presenting a certificate signed by one of
+// them are served. The server must listen on TCP; call it before Serve.
+func (s *Server) UseTLS(cfg *tls.Config) error {
+	if s.sockPath != "" || s.users != nil {
+		return errors.New("TLS needs a tcp:// or tls:// listen address")
+	}
+	s.listener = tls.NewListener(s.listener, cfg)
+	return nil
+}
+
+// loadTLSConfig loads the server certificate from certFile and keyFile.
+// With clientCAFile, clients must present a certificate signed by one of
+// the CAs in it (mutual TLS).
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("a TLS listener needs both -tls-cert and -tls-key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
+
+// configureListener sets srv up for its listen address addr: TLS for a
+// tls:// address, from the -tls-* flags' files. Peer credentials cannot
+// tell who is on the other end of a TCP connection, so a TCP listener is
+// refused unless clients must present token or a certificate signed by a
+// CA in clientCAFile.
+func configureListener(srv *Server, addr, certFile, keyFile, clientCAFile, token string) error {
+	hostport, tcp := cutTCPScheme(addr)
+	if tcp && token == "" && clientCAFile == "" {
+		return errors.New("a TCP listener needs a token (-token-file or ASHLET_TOKEN) or -tls-client-ca")
+	}
+	if !strings.HasPrefix(addr, "tls://") {
+		if certFile != "" || keyFile != "" || clientCAFile != "" {
+			return errors.New("the -tls-* flags need a tls:// listen address")
+		}
+		if tcp && !isLoopback(hostport) {
+			slog.Warn("listening on TCP without TLS: requests and the token travel in the clear", "addr", hostport)
+		}
+		return nil
+	}
+	cfg, err := loadTLSConfig(certFile, keyFile, clientCAFile)
+	if err != nil {
+		return err
+	}
+	return srv.UseTLS(cfg)
+}
+
+// isLoopback reports whether hostport names a loopback address.
+func isLoopback(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
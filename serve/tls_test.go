@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/generate"
+)
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ashlet test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate signed by ca for usage, as PEM files in dir.
+func (ca *testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// startTCPServer serves completer on a free loopback port at addr's scheme,
+// configured with the given TLS files and token.
+func startTCPServer(t *testing.T, scheme string, completer Completer, certFile, keyFile, clientCAFile, token string) *Server {
+	t.Helper()
+	addr := scheme + "127.0.0.1:0"
+	srv, err := NewServerWithCompleter(addr, completer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	if err := configureListener(srv, addr, certFile, keyFile, clientCAFile, token); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetToken(token)
+	go srv.Serve()
+	return srv
+}
+
+// roundTrip sends msg over conn and reads the response.
+func roundTrip(conn net.Conn, msg any) (*ashlet.Response, error) {
+	defer conn.Close()
+	data, _ := json.Marshal(msg)
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, net.ErrClosed
+	}
+	var resp ashlet.Response
+	err := json.Unmarshal(scanner.Bytes(), &resp)
+	return &resp, err
+}
+
+// tokenRequest is a completion request carrying a token.
+type tokenRequest struct {
+	Token string `json:"token"`
+	*ashlet.Request
+}
+
+func TestServeTCP(t *testing.T) {
+	stub := &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{{Completion: "git status"}}}}
+	srv := startTCPServer(t, "tcp://", stub, "", "", "", "s3cret")
+	if srv.sockPath != "" {
+		t.Errorf("sockPath = %q for a TCP listener, want none", srv.sockPath)
+	}
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := roundTrip(conn, tokenRequest{"s3cret", &ashlet.Request{RequestID: 3, Input: "git st"}})
+	if err != nil || resp.RequestID != 3 || len(resp.Candidates) != 1 {
+		t.Errorf("response = %+v, %v; want request 3's candidate", resp, err)
+	}
+}
+
+func TestServeTCPHidesAPIKeys(t *testing.T) {
+	stub := &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}}
+	srv := startTCPServer(t, "tcp://", stub, "", "", "", "s3cret")
+	srv.engineOpts.Paths = ashlet.Paths{Home: t.TempDir()}
+	os.MkdirAll(srv.engineOpts.Paths.ConfigDir(), 0700)
+	os.WriteFile(srv.engineOpts.Paths.ConfigPath(), []byte(`{"generation":{"api_key":"sk-gen"},"embedding":{"api_key":"sk-emb"}}`), 0600)
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(`{"token":"s3cret","action":"get"}` + "\n"))
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		t.Fatal("no response")
+	}
+	var resp ashlet.ConfigResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil || resp.Config == nil {
+		t.Fatalf("response = %s, %v", scanner.Bytes(), err)
+	}
+	if resp.Config.Generation.APIKey != "" || resp.Config.Embedding.APIKey != "" {
+		t.Errorf("API keys sent over TCP: %+v", resp.Config)
+	}
+}
+
+func TestNewServerTCPHasNoLocalContext(t *testing.T) {
+	srv, err := NewServer("tcp://127.0.0.1:0", generate.EngineOptions{Paths: ashlet.Paths{Home: t.TempDir(), State: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if !srv.engineOpts.NoLocalContext {
+		t.Error("a TCP listener should not serve local context")
+	}
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "client", x509.ExtKeyUsageClientAuth)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, ca.pem, 0600)
+
+	stub := &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{{Completion: "git status"}}}}
+	srv := startTCPServer(t, "tls://", stub, serverCert, serverKey, caFile, "")
+	addr := srv.listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := roundTrip(conn, &ashlet.Request{RequestID: 1, Input: "git st"})
+	if err != nil || len(resp.Candidates) != 1 {
+		t.Errorf("response with a client certificate = %+v, %v; want a candidate", resp, err)
+	}
+
+	// Without a client certificate the handshake fails and nothing is
+	// answered.
+	conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err == nil {
+		if resp, err := roundTrip(conn, &ashlet.Request{RequestID: 2, Input: "git st"}); err == nil {
+			t.Errorf("response without a client certificate = %+v, want none", resp)
+		}
+	}
+}
+
+func TestConfigureListenerErrors(t *testing.T) {
+	stub := &stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}}
+	srv := newTestServer(t, stub)
+	if err := configureListener(srv, srv.sockPath, "cert.pem", "key.pem", "", ""); err == nil {
+		t.Error("TLS files accepted for a Unix socket")
+	}
+	if err := srv.UseTLS(&tls.Config{}); err == nil {
+		t.Error("UseTLS accepted a Unix socket")
+	}
+
+	tcp, err := NewServerWithCompleter("tls://127.0.0.1:0", stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if err := configureListener(tcp, "tls://127.0.0.1:0", "", "", "", "s3cret"); err == nil {
+		t.Error("tls:// accepted without a certificate")
+	}
+	if err := configureListener(tcp, "tcp://127.0.0.1:0", "", "", "", ""); err == nil {
+		t.Error("tcp:// accepted without a token or client CA")
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:7878":  true,
+		"[::1]:7878":      true,
+		"localhost:7878":  true,
+		"0.0.0.0:7878":    false,
+		"10.0.0.5:7878":   false,
+		"workstation:787": false,
+	} {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("isLoopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
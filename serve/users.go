@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+	"github.com/Paranoid-AF/ashlet/generate"
+	"github.com/Paranoid-AF/ashlet/index"
+)
+
+const (
+	// systemMaxUsers caps the number of users with a live engine in system
+	// mode; the least recently used idle engine is closed to make room.
+	systemMaxUsers = 32
+	// systemMaxInflight caps concurrent completion requests per user.
+	systemMaxInflight = 2
+)
+
+var (
+	errTooManyUsers = errors.New("daemon is serving the maximum number of users")
+	errBusy         = errors.New("too many concurrent requests for this user")
+)
+
+// userEngine is one user's completer in system mode.
+type userEngine struct {
+	uid      int
+	paths    ashlet.Paths
+	engine   Completer
+	inflight chan struct{} // completion request semaphore
+	lastUsed time.Time
+}
+
+// acquire reserves a completion slot, or returns false when the user is at
+// its concurrency quota.
+func (u *userEngine) acquire() bool {
+	select {
+	case u.inflight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *userEngine) release() {
+	<-u.inflight
+}
+
+// userRegistry lazily creates one isolated completer per connecting UNIX
+// user (system mode). Each user gets their own config, history index, and
+// state directory.
+type userRegistry struct {
+	stateBase   string // per-user state lives in stateBase/<uid>
+	lookup      func(uid int) (ashlet.Paths, error)
+	newEngine   func(paths ashlet.Paths) Completer
+	maxUsers    int
+	maxInflight int
+
+	mu    sync.Mutex
+	users map[int]*userEngine
+}
+
+// newUserRegistry creates a registry backed by real engines, keeping
+// per-user state under stateBase.
+//
+// The engines run as root on a user's behalf, so they read no context from
+// the filesystem for the directory a client names: listings, manifests,
+// git, previews, and --help, tldr, and man pages are all off. The files
+// they do read (config, prompts, history) must be owned by the user (see
+// ashlet.Paths.Owner).
+func newUserRegistry(stateBase string) *userRegistry {
+	// Users of the same provider share its latency observations and
+	// circuit breaker.
+	latency := generate.NewLatencyTracker()
+	health := index.NewHealthTracker()
+	r := &userRegistry{
+		stateBase: stateBase,
+		newEngine: func(p ashlet.Paths) Completer {
+			return generate.NewEngineWithOptions(generate.EngineOptions{
+				Paths:          p,
+				NoLocalContext: true,
+				Latency:        latency,
+				Health:         health,
+			})
+		},
+		maxUsers:    systemMaxUsers,
+		maxInflight: systemMaxInflight,
+		users:       make(map[int]*userEngine),
+	}
+	r.lookup = r.lookupUser
+	return r
+}
+
+// lookupUser resolves a UID to its home directory and per-user state dir.
+// The user's cache is kept in the state dir too, so that the daemon, running
+// as root, never writes into their home.
+func (r *userRegistry) lookupUser(uid int) (ashlet.Paths, error) {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return ashlet.Paths{}, fmt.Errorf("unknown user %d: %w", uid, err)
+	}
+	if u.HomeDir == "" {
+		return ashlet.Paths{}, fmt.Errorf("user %d has no home directory", uid)
+	}
+	state := filepath.Join(r.stateBase, strconv.Itoa(uid))
+	return ashlet.Paths{Home: u.HomeDir, State: state, Cache: state, Owner: u.Uid}, nil
+}
+
+// lookupGroup resolves a group name, or a numeric gid, to its gid.
+func lookupGroup(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		if g, err = user.LookupGroupId(name); err != nil {
+			return -1, fmt.Errorf("unknown group %s", name)
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// get returns the engine for uid, creating it on first use.
+func (r *userRegistry) get(uid int) (*userEngine, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if u, ok := r.users[uid]; ok {
+		u.lastUsed = time.Now()
+		return u, nil
+	}
+
+	if len(r.users) >= r.maxUsers && !r.evictIdleLocked() {
+		return nil, errTooManyUsers
+	}
+
+	paths, err := r.lookup(uid)
+	if err != nil {
+		return nil, err
+	}
+	u := &userEngine{
+		uid:      uid,
+		paths:    paths,
+		engine:   r.newEngine(paths),
+		inflight: make(chan struct{}, r.maxInflight),
+		lastUsed: time.Now(),
+	}
+	r.users[uid] = u
+	slog.Info("created engine for user", "uid", uid, "home", paths.Home)
+	return u, nil
+}
+
+// evictIdleLocked closes the least recently used engine with no requests
+// in flight. Returns false if every engine is busy.
+func (r *userRegistry) evictIdleLocked() bool {
+	var victim *userEngine
+	for _, u := range r.users {
+		if len(u.inflight) > 0 {
+			continue
+		}
+		if victim == nil || u.lastUsed.Before(victim.lastUsed) {
+			victim = u
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	delete(r.users, victim.uid)
+	victim.engine.Close()
+	slog.Info("evicted idle user engine", "uid", victim.uid)
+	return true
+}
+
+// reload replaces uid's engine so it picks up config changes.
+// whileClosed, when not nil, runs after the old engine is closed and before
+// the new one is created.
+func (r *userRegistry) reload(uid int, whileClosed func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[uid]
+	if !ok {
+		return
+	}
+	u.engine.Close()
+	if whileClosed != nil {
+		whileClosed()
+	}
+	u.engine = r.newEngine(u.paths)
+	slog.Info("engine reloaded", "uid", uid)
+}
+
+// engineOf returns the current engine for u. Reload may swap it, so read it
+// under the registry lock.
+func (r *userRegistry) engineOf(u *userEngine) Completer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return u.engine
+}
+
+// engines returns the engine of every user with a live one.
+func (r *userRegistry) engines() []Completer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	engines := make([]Completer, 0, len(r.users))
+	for _, u := range r.users {
+		engines = append(engines, u.engine)
+	}
+	return engines
+}
+
+// closeAll closes every user engine.
+func (r *userRegistry) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for uid, u := range r.users {
+		u.engine.Close()
+		delete(r.users, uid)
+	}
+}
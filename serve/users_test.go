@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	ashlet "github.com/Paranoid-AF/ashlet"
+)
+
+// closeTrackingCompleter records whether Close was called.
+type closeTrackingCompleter struct {
+	stubCompleter
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *closeTrackingCompleter) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+func (c *closeTrackingCompleter) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// newTestRegistry returns a registry that creates stub engines and records
+// the paths they were created for.
+func newTestRegistry(maxUsers int) (*userRegistry, *[]ashlet.Paths) {
+	var created []ashlet.Paths
+	r := &userRegistry{
+		lookup: func(uid int) (ashlet.Paths, error) {
+			if uid < 0 {
+				return ashlet.Paths{}, fmt.Errorf("unknown user %d", uid)
+			}
+			return ashlet.Paths{Home: fmt.Sprintf("/home/u%d", uid), State: fmt.Sprintf("/state/%d", uid)}, nil
+		},
+		newEngine: func(p ashlet.Paths) Completer {
+			created = append(created, p)
+			return &closeTrackingCompleter{stubCompleter: stubCompleter{resp: &ashlet.Response{Candidates: []ashlet.Candidate{}}}}
+		},
+		maxUsers:    maxUsers,
+		maxInflight: 1,
+		users:       make(map[int]*userEngine),
+	}
+	return r, &created
+}
+
+func TestUserRegistryIsolatesUsers(t *testing.T) {
+	r, created := newTestRegistry(4)
+
+	a, err := r.get(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := r.get(1000)
+	b, _ := r.get(1001)
+
+	if a != again {
+		t.Error("same uid should reuse its engine")
+	}
+	if a.engine == b.engine {
+		t.Error("different users must not share an engine")
+	}
+	if len(*created) != 2 || (*created)[0].Home != "/home/u1000" || (*created)[1].State != "/state/1001" {
+		t.Errorf("engines created with unexpected paths: %+v", *created)
+	}
+}
+
+func TestLookupUserOwnsPaths(t *testing.T) {
+	r := &userRegistry{stateBase: "/var/lib/ashlet"}
+	uid := os.Getuid()
+	p, err := r.lookupUser(uid)
+	if err != nil {
+		t.Skipf("current user cannot be looked up: %v", err)
+	}
+	state := fmt.Sprintf("/var/lib/ashlet/%d", uid)
+	if p.Owner != strconv.Itoa(uid) || p.State != state || p.Cache != state {
+		t.Errorf("paths = %+v, want owned by %d and kept under %s", p, uid, state)
+	}
+}
+
+func TestUserRegistryUnknownUser(t *testing.T) {
+	r, _ := newTestRegistry(4)
+	if _, err := r.get(-5); err == nil {
+		t.Error("expected error for unknown user")
+	}
+}
+
+func TestUserRegistryEvictsIdleUser(t *testing.T) {
+	r, _ := newTestRegistry(1)
+
+	a, _ := r.get(1000)
+	old := a.engine.(*closeTrackingCompleter)
+	if _, err := r.get(1001); err != nil {
+		t.Fatalf("expected idle user to be evicted, got %v", err)
+	}
+	if !old.isClosed() {
+		t.Error("evicted engine should be closed")
+	}
+}
+
+func TestUserRegistryBusyUsersNotEvicted(t *testing.T) {
+	r, _ := newTestRegistry(1)
+
+	a, _ := r.get(1000)
+	if !a.acquire() {
+		t.Fatal("first acquire should succeed")
+	}
+	defer a.release()
+
+	if _, err := r.get(1001); err != errTooManyUsers {
+		t.Errorf("expected errTooManyUsers while the only user is busy, got %v", err)
+	}
+}
+
+func TestUserEngineInflightQuota(t *testing.T) {
+	r, _ := newTestRegistry(4)
+	u, _ := r.get(1000)
+
+	if !u.acquire() {
+		t.Fatal("first acquire should succeed")
+	}
+	if u.acquire() {
+		t.Error("acquire beyond maxInflight should fail")
+	}
+	u.release()
+	if !u.acquire() {
+		t.Error("acquire should succeed after release")
+	}
+}
+
+func TestUserRegistryReload(t *testing.T) {
+	r, created := newTestRegistry(4)
+	u, _ := r.get(1000)
+	old := r.engineOf(u).(*closeTrackingCompleter)
+
+	r.reload(1000, nil)
+	if !old.isClosed() {
+		t.Error("reload should close the old engine")
+	}
+	if r.engineOf(u) == Completer(old) {
+		t.Error("reload should install a new engine")
+	}
+	if len(*created) != 2 || (*created)[1].Home != "/home/u1000" {
+		t.Errorf("reloaded engine created with unexpected paths: %+v", *created)
+	}
+}
+
+func TestSystemServerServesPeerUser(t *testing.T) {
+	r, created := newTestRegistry(4)
+	n := testSocketCounter.Add(1)
+	sockPath := fmt.Sprintf("/tmp/ashlet-t%d.sock", n)
+	srv, err := newSystemServer(sockPath, "", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	go srv.Serve()
+
+	info, err := os.Stat(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0666 {
+		t.Errorf("system socket permissions = %o, want 666", perm)
+	}
+
+	resp := sendRequest(t, sockPath, &ashlet.Request{RequestID: 7, Input: "ls", CursorPos: 2, SessionID: "1"})
+	if resp.Error != nil || resp.RequestID != 7 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	want := fmt.Sprintf("/home/u%d", os.Getuid())
+	if len(*created) != 1 || (*created)[0].Home != want {
+		t.Errorf("engine should be created for the peer uid (%s), got %+v", want, *created)
+	}
+}
+
+func TestSystemServerSocketGroup(t *testing.T) {
+	r, _ := newTestRegistry(4)
+	n := testSocketCounter.Add(1)
+	sockPath := fmt.Sprintf("/tmp/ashlet-t%d.sock", n)
+	if _, err := newSystemServer(sockPath, "no-such-group-ashlet", r); err == nil {
+		t.Fatal("an unknown group should be an error")
+	}
+
+	srv, err := newSystemServer(sockPath, strconv.Itoa(os.Getgid()), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	info, err := os.Stat(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0660 {
+		t.Errorf("group socket permissions = %o, want 660", perm)
+	}
+}
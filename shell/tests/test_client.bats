@@ -53,6 +53,64 @@ run_zsh() {
     [[ "$output" =~ ^/tmp/ashlet-[0-9]+\.sock$ ]]
 }
 
+@test ".ashlet:socat-address: connects to a Unix socket by default" {
+    run zsh -c "
+        source '${TEST_DIR}/client/socket.zsh'
+        .ashlet:socat-address /run/user/1000/ashlet.sock
+    "
+    [ "$status" -eq 0 ]
+    [ "$output" = "UNIX-CONNECT:/run/user/1000/ashlet.sock" ]
+}
+
+@test ".ashlet:socat-address: connects over TCP for tcp://" {
+    run zsh -c "
+        source '${TEST_DIR}/client/socket.zsh'
+        .ashlet:socat-address tcp://workstation:7878
+    "
+    [ "$status" -eq 0 ]
+    [ "$output" = "TCP:workstation:7878" ]
+}
+
+@test ".ashlet:socat-address: presents the client certificate for tls://" {
+    run zsh -c "
+        source '${TEST_DIR}/client/socket.zsh'
+        ASHLET_TLS_CERT=/certs/client.pem ASHLET_TLS_KEY=/certs/client-key.pem ASHLET_TLS_CA=/certs/ca.pem
+        .ashlet:socat-address tls://workstation:7878
+    "
+    [ "$status" -eq 0 ]
+    [ "$output" = "OPENSSL:workstation:7878,cert=/certs/client.pem,key=/certs/client-key.pem,cafile=/certs/ca.pem" ]
+}
+
+@test ".ashlet:authorize: adds ASHLET_TOKEN to the request" {
+    run zsh -c "
+        source '${TEST_DIR}/client/socket.zsh'
+        ASHLET_TOKEN=abc
+        .ashlet:authorize '{\"action\":\"get\"}'
+    "
+    [ "$status" -eq 0 ]
+    [ "$output" = '{"token":"abc","action":"get"}' ]
+}
+
+@test ".ashlet:authorize: leaves the request alone without ASHLET_TOKEN" {
+    run zsh -c "
+        source '${TEST_DIR}/client/socket.zsh'
+        unset ASHLET_TOKEN
+        .ashlet:authorize '{\"action\":\"get\"}'
+    "
+    [ "$status" -eq 0 ]
+    [ "$output" = '{"action":"get"}' ]
+}
+
+@test ".ashlet:daemon-reachable: trusts TCP addresses, checks socket files" {
+    run zsh -c "
+        source '${TEST_DIR}/client/socket.zsh'
+        .ashlet:daemon-reachable tls://workstation:7878 || exit 1
+        .ashlet:daemon-reachable /nonexistent/ashlet.sock && exit 2
+        exit 0
+    "
+    [ "$status" -eq 0 ]
+}
+
 # =============================================================================
 # Response ID Parsing Tests
 # =============================================================================
@@ -125,6 +183,24 @@ run_zsh() {
     [ "$output" = "" ]
 }
 
+@test ".ashlet:parse-candidate-words-at: extracts word ends one per line" {
+    run_zsh '.ashlet:parse-candidate-words-at '"'"'{"request_id":1,"candidates":[{"completion":"git status --short","words":[10,18]}]}'"'"' 0'
+    [ "$status" -eq 0 ]
+    [ "$output" = $'10\n18' ]
+}
+
+@test ".ashlet:parse-candidate-words-at: returns empty when words absent" {
+    run_zsh '.ashlet:parse-candidate-words-at '"'"'{"request_id":1,"candidates":[{"completion":"git status"}]}'"'"' 0'
+    [ "$status" -eq 0 ]
+    [ "$output" = "" ]
+}
+
+@test ".ashlet:parse-candidate-danger-at: extracts danger when present" {
+    run_zsh '.ashlet:parse-candidate-danger-at '"'"'{"request_id":1,"candidates":[{"completion":"rm -rf /","danger":"recursively deletes a root or home directory"}]}'"'"' 0'
+    [ "$status" -eq 0 ]
+    [ "$output" = "recursively deletes a root or home directory" ]
+}
+
 # =============================================================================
 # Error Handling Tests
 # =============================================================================
@@ -168,6 +244,20 @@ run_zsh() {
     [[ "$output" == *"█"* ]]
 }
 
+@test ".ashlet:format-candidate: marks dangerous candidate" {
+    run_zsh '.ashlet:format-candidate "rm -rf /" 0 1 "" "formats a filesystem"'
+    [ "$status" -eq 0 ]
+    [[ "$output" == *"⚠ rm -rf /"* ]]
+}
+
+@test ".ashlet:format-candidate: indents further lines of a multi-line candidate" {
+    run_zsh '.ashlet:format-candidate $'"'"'for f in *; do\n  echo $f\ndone'"'"' 0 2'
+    [ "$status" -eq 0 ]
+    [ "${lines[0]}" = "(1/2) for f in *; do" ]
+    [ "${lines[1]}" = "        echo \$f" ]
+    [ "${lines[2]}" = "      done" ]
+}
+
 @test ".ashlet:hint-text: returns keybinding hints" {
     run_zsh '.ashlet:hint-text'
     [ "$status" -eq 0 ]
@@ -0,0 +1,91 @@
+package ashlet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// stateItem is one kind of state the daemon keeps in the state or cache
+// directory.
+type stateItem struct {
+	name        string
+	description string
+	path        func(Paths) string
+}
+
+// stateItems lists everything the daemon writes to the state and cache
+// directories.
+// Each store takes its path from here through Paths, so this list is the
+// complete layout.
+var stateItems = []stateItem{
+	{"embeddings", "embeddings of history commands", Paths.EmbeddingCachePath},
+	{"reported_history", "commands the shell reported, read with history_source \"shell\"", Paths.ReportedHistoryPath},
+	{"feedback", "accepted and dismissed suggestions, used for ranking", Paths.FeedbackPath},
+	{"ledger", "suggestions shown and accepted, searched by ashlet recall", Paths.LedgerPath},
+	{"corpus", "captured completions for evaluation", Paths.CorpusPath},
+	{"usage", "API token usage totals, shown by ashlet stats", Paths.UsagePath},
+	{"audit", "texts sent to the APIs, kept with telemetry.audit_log", Paths.AuditPath},
+}
+
+// StateItemNames returns the names of the kinds of state, in listing order.
+func StateItemNames() []string {
+	names := make([]string, len(stateItems))
+	for i, item := range stateItems {
+		names[i] = item.name
+	}
+	return names
+}
+
+// StorageUsage reports the size of each kind of state under p. Items that
+// have not been written yet are listed with zero bytes.
+func StorageUsage(p Paths) []StorageItem {
+	out := make([]StorageItem, len(stateItems))
+	for i, item := range stateItems {
+		out[i] = item.usage(p)
+	}
+	return out
+}
+
+// PruneStorage deletes the named kinds of state under p, or all of them
+// when names is empty, and returns what was deleted with the bytes freed.
+// Unknown names are an error, and nothing is deleted. Stores that hold the
+// state in memory must be reopened afterwards, or they write it back.
+func PruneStorage(p Paths, names []string) ([]StorageItem, error) {
+	if unknown := slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+		return slices.Contains(StateItemNames(), name)
+	}); len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown storage %s (known: %s)",
+			strings.Join(unknown, ", "), strings.Join(StateItemNames(), ", "))
+	}
+
+	var pruned []StorageItem
+	var errs []error
+	for _, item := range stateItems {
+		if len(names) > 0 && !slices.Contains(names, item.name) {
+			continue
+		}
+		usage := item.usage(p)
+		// Also the temporary files of atomic writes and SQLite's journals,
+		// which a new database would otherwise pick up.
+		for _, path := range []string{usage.Path, usage.Path + ".tmp", usage.Path + "-journal", usage.Path + "-wal", usage.Path + "-shm"} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+		pruned = append(pruned, usage)
+	}
+	return pruned, errors.Join(errs...)
+}
+
+// usage reports the size of item under p.
+func (item stateItem) usage(p Paths) StorageItem {
+	path := item.path(p)
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	return StorageItem{Name: item.name, Description: item.description, Path: path, Bytes: size}
+}
@@ -0,0 +1,41 @@
+package ashlet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPruneStorage(t *testing.T) {
+	p := Paths{State: t.TempDir(), Cache: t.TempDir()}
+	os.WriteFile(p.LedgerPath(), []byte("{}\n{}\n"), 0600)
+	os.WriteFile(p.EmbeddingCachePath(), []byte("db"), 0600)
+	os.WriteFile(p.FeedbackPath()+".tmp", []byte("{"), 0600)
+	os.WriteFile(filepath.Join(p.StateDir(), "notes.txt"), []byte("mine"), 0600)
+
+	if _, err := PruneStorage(p, []string{"ledger", "cache"}); err == nil {
+		t.Fatal("an unknown name should be an error")
+	}
+	if _, err := os.Stat(p.LedgerPath()); err != nil {
+		t.Fatal("nothing should be deleted when a name is unknown")
+	}
+
+	pruned, err := PruneStorage(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != len(stateItems) {
+		t.Errorf("pruned %d items, want all %d", len(pruned), len(stateItems))
+	}
+	for _, item := range StorageUsage(p) {
+		if item.Bytes != 0 {
+			t.Errorf("%s still holds %d bytes", item.Name, item.Bytes)
+		}
+	}
+	if _, err := os.Stat(p.FeedbackPath() + ".tmp"); !os.IsNotExist(err) {
+		t.Error("a leftover temporary file should be deleted with its store")
+	}
+	if _, err := os.Stat(filepath.Join(p.StateDir(), "notes.txt")); err != nil {
+		t.Error("files ashlet does not own should be left alone")
+	}
+}